@@ -0,0 +1,369 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package bake precomputes static lighting into the colors of octree files.
+package bake
+
+import (
+	"errors"
+	"image"
+	"io"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/andreas-jonsson/octatron/pack"
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+var (
+	InvalidSamplesError = errors.New("number of samples must be positive")
+	InvalidLightError   = errors.New("light intensities must not be negative")
+)
+
+// LightConfig describes the lighting baked into a tree. Positions and distances are
+// relative to the tree, which is treated as a unit cube.
+type LightConfig struct {
+	// Direction points from the tree towards the sun. A zero direction disables
+	// direct light.
+	Direction [3]float32
+
+	// Sun and Ambient scale the direct and the sky light. A leaf that is fully lit
+	// by both gets its color scaled by Sun+Ambient, clamped to one.
+	Sun, Ambient float32
+
+	// Radius limits the distance of the ambient occlusion rays. Zero means that
+	// the whole tree occludes.
+	Radius float32
+
+	// Workers is the number of goroutines casting rays. Zero uses one per CPU.
+	Workers int
+
+	// Progress is called with the number of baked and total leafs. It is never
+	// called concurrently.
+	Progress func(done, total uint64)
+}
+
+const (
+	bakeChunk    = 256
+	bakeMaxDepth = 64
+	bakeViewDist = 1e6
+
+	sqrt3 = 1.7320508
+)
+
+// BakeLighting writes the tree from in to out with the colors of every leaf
+// pre-multiplied by the light reaching it. Each leaf casts a shadow ray towards the
+// sun and samples ambient occlusion rays in random directions. Parents are scaled
+// by the average of their children so distant levels of detail match. The output
+// keeps the format, palette and checksum of the input.
+func BakeLighting(in io.ReadSeeker, out io.WriteSeeker, light LightConfig, samples int) error {
+	if samples <= 0 {
+		return InvalidSamplesError
+	}
+	if light.Sun < 0 || light.Ambient < 0 || light.Radius < 0 {
+		return InvalidLightError
+	}
+
+	start, err := in.Seek(0, 1)
+	if err != nil {
+		return err
+	}
+
+	tree, _, err := trace.LoadOctreeWithInfo(in)
+	if err != nil {
+		return err
+	}
+
+	if _, err := in.Seek(start, 0); err != nil {
+		return err
+	}
+
+	header, palette, colors, children, err := readNodes(in)
+	if err != nil {
+		return err
+	}
+
+	factors := bakeLeafs(tree, children, light, samples)
+	if len(children) > 0 {
+		scaleParents(children, factors, 0)
+	}
+
+	if err := pack.EncodeHeader(out, header); err != nil {
+		return err
+	}
+
+	if header.Format.Paletted() {
+		if err := pack.EncodePalette(out, palette); err != nil {
+			return err
+		}
+	}
+
+	var writer io.Writer = out
+	var checkedWriter *pack.ChecksumWriter
+	if header.Checksummed() {
+		checkedWriter = pack.NewChecksumWriter(writer)
+		writer = checkedWriter
+	}
+
+	encoder := pack.NewNodeEncoder(writer, header.Format, palette)
+	for i, color := range colors {
+		f := factors[i]
+		color.R *= f
+		color.G *= f
+		color.B *= f
+		if err := encoder.Encode(color, children[i][:]); err != nil {
+			return err
+		}
+	}
+
+	if checkedWriter != nil {
+		return checkedWriter.WriteTrailer()
+	}
+	return nil
+}
+
+// readNodes reads the header, palette and all nodes of a tree.
+func readNodes(in io.Reader) (pack.OctreeHeader, pack.Palette, []pack.Color, [][8]pack.NodeIndex, error) {
+	var header pack.OctreeHeader
+	if err := pack.DecodeHeader(in, &header); err != nil {
+		return header, nil, nil, nil, err
+	}
+
+	palette, err := pack.DecodePalette(in, &header)
+	if err != nil {
+		return header, nil, nil, nil, err
+	}
+
+	var reader io.Reader = in
+	var checkedReader *pack.ChecksumReader
+	if header.Checksummed() {
+		checkedReader = pack.NewChecksumReader(reader, true)
+		reader = checkedReader
+	}
+
+	colors := make([]pack.Color, header.NumNodes)
+	children := make([][8]pack.NodeIndex, header.NumNodes)
+
+	decoder := pack.NewNodeDecoder(reader, header.Format, palette)
+	for i := range colors {
+		if err := decoder.Decode(&colors[i], children[i][:]); err != nil {
+			return header, nil, nil, nil, err
+		}
+	}
+
+	if checkedReader != nil {
+		if err := checkedReader.ReadTrailer(); err != nil {
+			return header, nil, nil, nil, err
+		}
+	}
+	return header, palette, colors, children, nil
+}
+
+type leaf struct {
+	index  int
+	center [3]float32
+	radius float32
+}
+
+func isLeaf(children *[8]pack.NodeIndex) bool {
+	for _, child := range children {
+		if child != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// findLeafs returns every leaf of the tree with its bounding sphere.
+func findLeafs(children [][8]pack.NodeIndex) []leaf {
+	type item struct {
+		index int
+		pos   [3]float32
+		size  float32
+	}
+
+	var leafs []leaf
+	if len(children) == 0 {
+		return leafs
+	}
+
+	stack := []item{{0, [3]float32{}, 1}}
+	for len(stack) > 0 {
+		it := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if isLeaf(&children[it.index]) {
+			half := it.size * 0.5
+			center := [3]float32{it.pos[0] + half, it.pos[1] + half, it.pos[2] + half}
+			leafs = append(leafs, leaf{it.index, center, half * sqrt3})
+			continue
+		}
+
+		size := it.size * 0.5
+		for i, child := range children[it.index] {
+			if child == 0 {
+				continue
+			}
+			pos := it.pos
+			for axis := uint(0); axis < 3; axis++ {
+				if i&(1<<axis) != 0 {
+					pos[axis] += size
+				}
+			}
+			stack = append(stack, item{int(child), pos, size})
+		}
+	}
+	return leafs
+}
+
+// bakeLeafs returns the light factor of every node. Only leafs are set, parents are
+// left at zero.
+func bakeLeafs(tree trace.Octree, children [][8]pack.NodeIndex, light LightConfig, samples int) []float32 {
+	factors := make([]float32, len(children))
+	leafs := findLeafs(children)
+
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	rt := trace.NewRaytracer(trace.Config{
+		TreeScale: 1,
+		ViewDist:  bakeViewDist,
+		Images:    [2]*image.RGBA{img, img},
+	})
+	defer rt.Close()
+
+	sun := light.Direction
+	hasSun := sun != [3]float32{} && light.Sun > 0
+	radius := light.Radius
+	if radius == 0 {
+		radius = 2 * sqrt3
+	}
+
+	workers := light.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	var (
+		next, done uint64
+		total      = uint64(len(leafs))
+		wg         sync.WaitGroup
+		progress   sync.Mutex
+	)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				first := atomic.AddUint64(&next, bakeChunk) - bakeChunk
+				if first >= total {
+					return
+				}
+				last := first + bakeChunk
+				if last > total {
+					last = total
+				}
+
+				for _, l := range leafs[first:last] {
+					var f float32
+					if light.Ambient > 0 {
+						f += light.Ambient * ambient(rt, tree, &l, radius, samples)
+					}
+					if hasSun && !occluded(rt, tree, &l, sun, bakeViewDist) {
+						f += light.Sun
+					}
+					if f > 1 {
+						f = 1
+					}
+					factors[l.index] = f
+				}
+
+				if light.Progress != nil {
+					progress.Lock()
+					done += last - first
+					light.Progress(done, total)
+					progress.Unlock()
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	return factors
+}
+
+// occluded reports if a ray leaving the bounding sphere of l in dir hits the tree
+// within maxDist.
+func occluded(rt *trace.Raytracer, tree trace.Octree, l *leaf, dir [3]float32, maxDist float32) bool {
+	n := float32(math.Sqrt(float64(dir[0]*dir[0] + dir[1]*dir[1] + dir[2]*dir[2])))
+	offset := l.radius * 1.001 / n
+
+	var origin trace.Vec3
+	for axis := range origin {
+		origin[axis] = l.center[axis] + dir[axis]*offset
+	}
+
+	_, hit := rt.CastRay(tree, bakeMaxDepth, origin, trace.Vec3(dir), maxDist)
+	return hit
+}
+
+// ambient returns the fraction of uniformly distributed rays from l that escape
+// within radius. The directions are seeded by the node index so the result does
+// not depend on the scheduling of the workers.
+func ambient(rt *trace.Raytracer, tree trace.Octree, l *leaf, radius float32, samples int) float32 {
+	seed := uint64(l.index)*0x9e3779b97f4a7c15 + 1
+	random := func() float64 {
+		seed ^= seed << 13
+		seed ^= seed >> 7
+		seed ^= seed << 17
+		return float64(seed>>11) / (1 << 53)
+	}
+
+	open := 0
+	for i := 0; i < samples; i++ {
+		z := 1 - 2*random()
+		r := math.Sqrt(1 - z*z)
+		phi := 2 * math.Pi * random()
+		dir := [3]float32{float32(r * math.Cos(phi)), float32(z), float32(r * math.Sin(phi))}
+
+		if !occluded(rt, tree, l, dir, radius) {
+			open++
+		}
+	}
+	return float32(open) / float32(samples)
+}
+
+// scaleParents sets the factor of every parent below index to the average of its
+// children and returns the factor of index.
+func scaleParents(children [][8]pack.NodeIndex, factors []float32, index int) float32 {
+	if isLeaf(&children[index]) {
+		return factors[index]
+	}
+
+	var sum float32
+	var n int
+	for _, child := range children[index] {
+		if child != 0 {
+			sum += scaleParents(children, factors, int(child))
+			n++
+		}
+	}
+
+	factors[index] = sum / float32(n)
+	return factors[index]
+}
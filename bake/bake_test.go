@@ -0,0 +1,164 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package bake
+
+import (
+	"bytes"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/pack"
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+const depth = 3
+
+func voxel(x, y, z int) [3]float32 {
+	const size = 1.0 / (1 << depth)
+	return [3]float32{(float32(x) + 0.5) * size, (float32(y) + 0.5) * size, (float32(z) + 0.5) * size}
+}
+
+// overhangTree returns a floor with a roof over the half with low x.
+func overhangTree() *bytes.Buffer {
+	tree := trace.NewMutableTree(nil, 1<<depth)
+	c := color.RGBA{200, 200, 200, 255}
+
+	for x := 0; x < 1<<depth; x++ {
+		for z := 0; z < 1<<depth; z++ {
+			if err := tree.SetVoxel(voxel(x, 0, z), depth, c); err != nil {
+				panic(err)
+			}
+			if x < 4 {
+				if err := tree.SetVoxel(voxel(x, 3, z), depth, c); err != nil {
+					panic(err)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := tree.Save(&buf, pack.MipR8G8B8A8UnpackUI32); err != nil {
+		panic(err)
+	}
+	return &buf
+}
+
+func leafColor(data []byte, pos [3]float32) pack.Color {
+	tree, _, err := trace.LoadOctree(bytes.NewReader(data))
+	if err != nil {
+		panic(err)
+	}
+
+	idx, d, ok := tree.NodeAt(pos, [3]float32{}, 1, depth)
+	if !ok || d != depth {
+		panic("no leaf")
+	}
+
+	reader := bytes.NewReader(data)
+	var header pack.OctreeHeader
+	if err := pack.DecodeHeader(reader, &header); err != nil {
+		panic(err)
+	}
+
+	var (
+		c        pack.Color
+		children [8]pack.NodeIndex
+	)
+	decoder := pack.NewNodeDecoder(reader, header.Format, nil)
+	for i := uint32(0); i <= idx; i++ {
+		if err := decoder.Decode(&c, children[:]); err != nil {
+			panic(err)
+		}
+	}
+	return c
+}
+
+func TestBakeLighting(t *testing.T) {
+	in := overhangTree()
+
+	out, err := ioutil.TempFile("", "bake")
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		out.Close()
+		os.Remove(out.Name())
+	}()
+
+	light := LightConfig{
+		Direction: [3]float32{0.2, 1, 0.1},
+		Sun:       0.6,
+		Ambient:   0.4,
+		Workers:   4,
+	}
+
+	var calls int
+	var last, total uint64
+	light.Progress = func(done, n uint64) {
+		calls++
+		last, total = done, n
+	}
+
+	if err := BakeLighting(bytes.NewReader(in.Bytes()), out, light, 64); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls == 0 || last != total || total == 0 {
+		t.Errorf("progress: %d calls, %d of %d", calls, last, total)
+	}
+
+	if _, err := out.Seek(0, 0); err != nil {
+		panic(err)
+	}
+	data, err := ioutil.ReadAll(out)
+	if err != nil {
+		panic(err)
+	}
+
+	covered := leafColor(data, voxel(1, 0, 4))
+	exposed := leafColor(data, voxel(6, 0, 4))
+	original := leafColor(in.Bytes(), voxel(6, 0, 4))
+
+	if !(covered.R < exposed.R) {
+		t.Errorf("covered leaf is not darker: %v >= %v", covered, exposed)
+	}
+	if !(exposed.R < original.R) || exposed.A != original.A {
+		t.Errorf("exposed leaf: %v, original %v", exposed, original)
+	}
+}
+
+func TestBakeLightingInvalid(t *testing.T) {
+	in := overhangTree()
+	out, err := ioutil.TempFile("", "bake")
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		out.Close()
+		os.Remove(out.Name())
+	}()
+
+	if err := BakeLighting(bytes.NewReader(in.Bytes()), out, LightConfig{Ambient: 1}, 0); err != InvalidSamplesError {
+		t.Error(err)
+	}
+	if err := BakeLighting(bytes.NewReader(in.Bytes()), out, LightConfig{Sun: -1}, 1); err != InvalidLightError {
+		t.Error(err)
+	}
+}
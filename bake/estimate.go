@@ -0,0 +1,334 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package bake
+
+import (
+	"errors"
+	"io"
+	"math"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+var TreeDepthError = errors.New("tree is too deep to estimate its lighting")
+
+const (
+	// maxEstimateDepth keeps cell coordinates in range and guards against trees
+	// with cycles.
+	maxEstimateDepth = 32
+
+	// minEstimateSamples is the number of surface leafs needed for an estimate.
+	minEstimateSamples = 16
+
+	estimateIterations = 8
+)
+
+type (
+	cell struct {
+		depth   int
+		x, y, z int64
+	}
+
+	// lightSample is the normal and brightness of a leaf on the surface.
+	lightSample struct {
+		normal     [3]float64
+		brightness float64
+	}
+)
+
+// EstimateLighting estimates the light a scanned tree was captured in, so that
+// synthetic light can be set up to roughly match the shading baked into its
+// colors. The normal of each leaf on the surface is taken from which of its
+// neighbors are empty and compared with its brightness, assuming diffuse surfaces
+// lit by the sky and a single sun. Sun and Ambient of the result are relative to
+// a fully lit leaf and add up to one.
+//
+// The estimate is statistical. Confidence is the fraction of the brightness
+// variation of the surface explained by the light, from zero to one. Changes in
+// albedo, cast shadows and overcast scans lower it. With too few surface leafs, or
+// no brighter side, the confidence is zero and so is the direction.
+func EstimateLighting(r io.ReadSeeker) (LightConfig, float32, error) {
+	_, _, colors, children, err := readNodes(r)
+	if err != nil {
+		return LightConfig{}, 0, err
+	}
+
+	samples, err := surfaceSamples(colors, children)
+	if err != nil {
+		return LightConfig{}, 0, err
+	}
+
+	light, confidence := fitLight(samples)
+	return light, confidence, nil
+}
+
+// surfaceSamples returns the leafs on the surface of the tree. Leafs on the border
+// of the tree are skipped, scans are cut there and the cut was never lit.
+func surfaceSamples(colors []pack.Color, children [][8]pack.NodeIndex) ([]lightSample, error) {
+	if len(children) == 0 {
+		return nil, nil
+	}
+
+	type item struct {
+		index pack.NodeIndex
+		cell  cell
+	}
+
+	var (
+		leafs []item
+		nodes = make(map[cell]bool)
+		stack = []item{{0, cell{}}}
+	)
+
+	for len(stack) > 0 {
+		it := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if it.cell.depth > maxEstimateDepth {
+			return nil, TreeDepthError
+		}
+
+		leaf := isLeaf(&children[it.index])
+		nodes[it.cell] = leaf
+		if leaf {
+			leafs = append(leafs, it)
+			continue
+		}
+
+		for i, child := range children[it.index] {
+			if child == 0 {
+				continue
+			}
+			c := it.cell
+			c.depth++
+			c.x, c.y, c.z = c.x*2+int64(i&1), c.y*2+int64(i>>1&1), c.z*2+int64(i>>2&1)
+			stack = append(stack, item{child, c})
+		}
+	}
+
+	// solid reports if c is filled. Cells of internal nodes are partly filled and
+	// count as solid, cells missing from an internal node are empty. The root is
+	// always found.
+	solid := func(c cell) bool {
+		for n := c; ; n = (cell{n.depth - 1, n.x >> 1, n.y >> 1, n.z >> 1}) {
+			if leaf, ok := nodes[n]; ok {
+				return leaf || n == c
+			}
+		}
+	}
+
+	var samples []lightSample
+	for _, it := range leafs {
+		c := it.cell
+		last := int64(1)<<uint(c.depth) - 1
+		if c.x == 0 || c.y == 0 || c.z == 0 || c.x == last || c.y == last || c.z == last {
+			continue
+		}
+
+		// The normal points towards the empty neighbors.
+		var normal [3]float64
+		for dx := int64(-1); dx <= 1; dx++ {
+			for dy := int64(-1); dy <= 1; dy++ {
+				for dz := int64(-1); dz <= 1; dz++ {
+					if (dx == 0 && dy == 0 && dz == 0) || solid(cell{c.depth, c.x + dx, c.y + dy, c.z + dz}) {
+						continue
+					}
+
+					l := math.Sqrt(float64(dx*dx + dy*dy + dz*dz))
+					normal[0] += float64(dx) / l
+					normal[1] += float64(dy) / l
+					normal[2] += float64(dz) / l
+				}
+			}
+		}
+
+		// Interior leafs and thin walls have no side facing out.
+		l := length(normal)
+		if l < 0.5 {
+			continue
+		}
+
+		col := colors[it.index]
+		s := lightSample{brightness: 0.299*float64(col.R) + 0.587*float64(col.G) + 0.114*float64(col.B)}
+		for axis := range normal {
+			s.normal[axis] = normal[axis] / l
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+// fitLight fits ambient and sun light to the samples. A linear fit of brightness
+// to normal gives the first direction, which is then refined by fitting it again
+// to the leafs it lights only.
+func fitLight(samples []lightSample) (LightConfig, float32) {
+	if len(samples) < minEstimateSamples {
+		return LightConfig{}, 0
+	}
+
+	w, ok := fitNormals(samples, nil)
+	if !ok {
+		return LightConfig{}, 0
+	}
+	dir := [3]float64{w[1], w[2], w[3]}
+
+	for i := 0; ; i++ {
+		l := length(dir)
+		if l == 0 {
+			return LightConfig{}, 0
+		}
+		for axis := range dir {
+			dir[axis] /= l
+		}
+
+		if i == estimateIterations {
+			break
+		}
+		if w, ok = fitNormals(samples, &dir); !ok {
+			break
+		}
+		dir = [3]float64{w[1], w[2], w[3]}
+	}
+
+	ambient, sun := fitSun(samples, dir)
+	if !(sun > 0) {
+		return LightConfig{}, 0
+	}
+
+	var mean, total, residual float64
+	for _, s := range samples {
+		mean += s.brightness
+	}
+	mean /= float64(len(samples))
+
+	for _, s := range samples {
+		d := s.brightness - (ambient + sun*lit(s.normal, dir))
+		residual += d * d
+		d = s.brightness - mean
+		total += d * d
+	}
+
+	confidence := 1 - residual/total
+	if confidence <= 0 {
+		return LightConfig{}, 0
+	}
+
+	if ambient < 0 {
+		ambient = 0
+	}
+	sum := ambient + sun
+	light := LightConfig{
+		Direction: [3]float32{float32(dir[0]), float32(dir[1]), float32(dir[2])},
+		Sun:       float32(sun / sum),
+		Ambient:   float32(ambient / sum),
+	}
+	return light, float32(confidence)
+}
+
+// fitNormals fits the brightness of the samples to a constant plus a linear
+// function of their normal, and returns the constant followed by the weights of
+// the three axes. With dir set only the samples lit from it are used.
+func fitNormals(samples []lightSample, dir *[3]float64) ([]float64, bool) {
+	var (
+		m [4][4]float64
+		v [4]float64
+	)
+
+	for _, s := range samples {
+		if dir != nil && lit(s.normal, *dir) <= 0 {
+			continue
+		}
+
+		f := [4]float64{1, s.normal[0], s.normal[1], s.normal[2]}
+		for i := range f {
+			for j := range f {
+				m[i][j] += f[i] * f[j]
+			}
+			v[i] += f[i] * s.brightness
+		}
+	}
+
+	rows := make([][]float64, len(m))
+	for i := range m {
+		rows[i] = m[i][:]
+	}
+	return solve(rows, v[:])
+}
+
+// fitSun fits brightness = ambient + sun * max(0, normal . dir) to the samples.
+func fitSun(samples []lightSample, dir [3]float64) (ambient, sun float64) {
+	var sx, sb, sxx, sxb float64
+	for _, s := range samples {
+		x := lit(s.normal, dir)
+		sx += x
+		sb += s.brightness
+		sxx += x * x
+		sxb += x * s.brightness
+	}
+
+	n := float64(len(samples))
+	if d := n*sxx - sx*sx; d > 1e-12 {
+		sun = (n*sxb - sx*sb) / d
+	}
+	return (sb - sun*sx) / n, sun
+}
+
+func lit(normal, dir [3]float64) float64 {
+	return math.Max(0, normal[0]*dir[0]+normal[1]*dir[1]+normal[2]*dir[2])
+}
+
+func length(v [3]float64) float64 {
+	return math.Sqrt(v[0]*v[0] + v[1]*v[1] + v[2]*v[2])
+}
+
+// solve solves m x = v with Gaussian elimination. False is returned if m is
+// singular. M and v are overwritten.
+func solve(m [][]float64, v []float64) ([]float64, bool) {
+	n := len(v)
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(m[row][col]) > math.Abs(m[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(m[pivot][col]) < 1e-12 {
+			return nil, false
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		v[col], v[pivot] = v[pivot], v[col]
+
+		for row := col + 1; row < n; row++ {
+			f := m[row][col] / m[col][col]
+			for k := col; k < n; k++ {
+				m[row][k] -= f * m[col][k]
+			}
+			v[row] -= f * v[col]
+		}
+	}
+
+	x := make([]float64, n)
+	for row := n - 1; row >= 0; row-- {
+		sum := v[row]
+		for k := row + 1; k < n; k++ {
+			sum -= m[row][k] * x[k]
+		}
+		x[row] = sum / m[row][row]
+	}
+	return x, true
+}
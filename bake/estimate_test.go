@@ -0,0 +1,101 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package bake
+
+import (
+	"bytes"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/pack"
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+// litSphere returns a sphere lit from dir by ambient and sun light. The albedo
+// varies a little, like the colors of a scan.
+func litSphere(dir [3]float64, ambient, sun float64) *bytes.Buffer {
+	const (
+		depth  = 5
+		size   = 1 << depth
+		radius = 12
+	)
+
+	l := length(dir)
+	tree := trace.NewMutableTree(nil, size)
+	for x := 0; x < size; x++ {
+		for y := 0; y < size; y++ {
+			for z := 0; z < size; z++ {
+				n := [3]float64{float64(x) + 0.5 - size/2, float64(y) + 0.5 - size/2, float64(z) + 0.5 - size/2}
+				r := length(n)
+				if r > radius {
+					continue
+				}
+
+				var dot float64
+				for axis := range n {
+					dot += n[axis] / r * dir[axis] / l
+				}
+				albedo := 0.8 + 0.1*math.Sin(float64(x*7+y*13+z*3))
+				v := uint8(255 * albedo * (ambient + sun*math.Max(0, dot)))
+
+				pos := [3]float32{(float32(x) + 0.5) / size, (float32(y) + 0.5) / size, (float32(z) + 0.5) / size}
+				if err := tree.SetVoxel(pos, depth, color.RGBA{v, v, v, 255}); err != nil {
+					panic(err)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := tree.Save(&buf, pack.MipR8G8B8A8UnpackUI32); err != nil {
+		panic(err)
+	}
+	return &buf
+}
+
+func TestEstimateLighting(t *testing.T) {
+	dir := [3]float64{0.4, 1, -0.6}
+	light, confidence, err := EstimateLighting(bytes.NewReader(litSphere(dir, 0.25, 0.75).Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dot float64
+	for axis := range dir {
+		dot += float64(light.Direction[axis]) * dir[axis] / length(dir)
+	}
+	if angle := math.Acos(math.Min(dot, 1)) * 180 / math.Pi; angle > 15 {
+		t.Errorf("direction %v is %.1f degrees off", light.Direction, angle)
+	}
+	if math.Abs(float64(light.Ambient)-0.25) > 0.1 || math.Abs(float64(light.Sun+light.Ambient)-1) > 1e-4 {
+		t.Errorf("unexpected intensities, sun %v and ambient %v", light.Sun, light.Ambient)
+	}
+	if confidence < 0.5 || confidence > 1 {
+		t.Errorf("unexpected confidence %v", confidence)
+	}
+
+	// Without a sun there is nothing to find.
+	light, confidence, err = EstimateLighting(bytes.NewReader(litSphere(dir, 1, 0).Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confidence > 0.1 {
+		t.Errorf("unlit sphere estimated with confidence %v, %+v", confidence, light)
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+// Package bench generates the reference trees used to compare the performance of
+// the builder and the raytracer across changes. The trees are generated from a
+// seed and are the same on every machine.
+package bench
+
+import (
+	"io"
+	"math/rand"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+// Scene is a family of reference trees, one per depth.
+type Scene struct {
+	Name string
+
+	// Position and LookAt are the camera of the benchmarked view, in the unit cube
+	// the tree is built in.
+	Position, LookAt [3]float32
+
+	voxels func(res int, seed int64) pack.VoxelFunc
+}
+
+var (
+	// Outdoor is a sparse scene, a ground layer with a few pillars.
+	Outdoor = &Scene{
+		Name:     "outdoor",
+		Position: [3]float32{0.1, 0.2, 0.93},
+		LookAt:   [3]float32{0.6, 0.1, 0.2},
+		voxels:   outdoorVoxels,
+	}
+
+	// Interior is a dense scene, a room with thick walls full of holes, seen
+	// from inside.
+	Interior = &Scene{
+		Name:     "interior",
+		Position: [3]float32{0.47, 0.52, 0.51},
+		LookAt:   [3]float32{0.1, 0.3, 0.2},
+		voxels:   interiorVoxels,
+	}
+
+	// Noise fills the tree with randomly placed voxels, seen from outside.
+	Noise = &Scene{
+		Name:     "noise",
+		Position: [3]float32{1.6, 1.4, 1.8},
+		LookAt:   [3]float32{0.5, 0.5, 0.5},
+		voxels:   noiseVoxels,
+	}
+
+	Scenes = []*Scene{Outdoor, Interior, Noise}
+)
+
+// FindScene returns the scene with name, or nil if there is none.
+func FindScene(name string) *Scene {
+	for _, s := range Scenes {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// Worker returns a worker that sends the voxels of the tree of depth, with
+// 1<<depth voxels per axis, in the unit cube.
+func (s *Scene) Worker(depth int, seed int64) pack.BuildWorker {
+	res := 1 << uint(depth)
+	return pack.NewFuncWorker(Bounds, res, s.voxels(res, seed))
+}
+
+// Config returns the build config of the tree of depth.
+func (s *Scene) Config(writer io.Writer, depth int, seed int64, format pack.OctreeFormat) pack.BuildConfig {
+	return pack.BuildConfig{
+		Worker:        s.Worker(depth, seed),
+		Writer:        writer,
+		Bounds:        Bounds,
+		VoxelsPerAxis: 1 << uint(depth),
+		Format:        format,
+	}
+}
+
+// Build writes the tree of depth to writer.
+func (s *Scene) Build(writer io.Writer, depth int, seed int64, format pack.OctreeFormat) error {
+	cfg := s.Config(writer, depth, seed, format)
+	_, err := pack.BuildTree(&cfg)
+	return err
+}
+
+// Bounds is the unit cube the trees are built in.
+var Bounds = pack.Box{Pos: pack.Point{X: 0, Y: 0, Z: 0}, Size: 1}
+
+// hash returns random bits for voxel x, y, z. Unlike a shared rand.Rand it does
+// not depend on the order voxels are visited in.
+func hash(seed int64, x, y, z int) uint64 {
+	h := uint64(seed)
+	for _, v := range [...]int{x, y, z} {
+		h ^= uint64(v)
+		h += 0x9e3779b97f4a7c15
+		h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+		h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+		h ^= h >> 31
+	}
+	return h
+}
+
+// randomColor returns an opaque color from the bits of h.
+func randomColor(h uint64) pack.Color {
+	return pack.Color{R: float32(h&0xff) / 255, G: float32(h>>8&0xff) / 255, B: float32(h>>16&0xff) / 255, A: 1}
+}
+
+func outdoorVoxels(res int, seed int64) pack.VoxelFunc {
+	rnd := rand.New(rand.NewSource(seed))
+	pillars := make(map[[2]int]int)
+	for i := 0; i < 20; i++ {
+		x, z, height := rnd.Intn(res), rnd.Intn(res), 1+rnd.Intn(res/2+1)
+		if height > pillars[[2]int{x, z}] {
+			pillars[[2]int{x, z}] = height
+		}
+	}
+
+	return func(x, y, z int) (pack.Color, bool) {
+		c := pack.Color{R: float32(x) / float32(res), G: float32(y) / float32(res), B: float32(z) / float32(res), A: 1}
+		return c, y == 0 || y < pillars[[2]int{x, z}]
+	}
+}
+
+func interiorVoxels(res int, seed int64) pack.VoxelFunc {
+	inside := func(v int) bool { return v >= res/4 && v < res*3/4 }
+	return func(x, y, z int) (pack.Color, bool) {
+		h := hash(seed, x, y, z)
+		if (inside(x) && inside(y) && inside(z)) || h>>62 == 0 {
+			return pack.Color{}, false
+		}
+		return randomColor(h), true
+	}
+}
+
+func noiseVoxels(res int, seed int64) pack.VoxelFunc {
+	return func(x, y, z int) (pack.Color, bool) {
+		h := hash(seed, x, y, z)
+		return randomColor(h), h>>61 < 3
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package bench
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+func build(scene *Scene, depth int, seed int64) []byte {
+	var buffer bytes.Buffer
+	if err := scene.Build(&buffer, depth, seed, pack.MipR8G8B8A8UnpackUI32); err != nil {
+		panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestScenes(t *testing.T) {
+	for _, scene := range Scenes {
+		if FindScene(scene.Name) != scene {
+			t.Errorf("%s: not found by name", scene.Name)
+		}
+
+		tree := build(scene, 4, 1)
+		if !bytes.Equal(tree, build(scene, 4, 1)) {
+			t.Errorf("%s: expected the same tree from the same seed", scene.Name)
+		}
+		if bytes.Equal(tree, build(scene, 4, 2)) {
+			t.Errorf("%s: expected another tree from another seed", scene.Name)
+		}
+
+		var header pack.OctreeHeader
+		if err := pack.DecodeHeader(bytes.NewReader(tree), &header); err != nil {
+			panic(err)
+		}
+		if header.VoxelsPerAxis != 16 || header.NumLeafs == 0 {
+			t.Errorf("%s: unexpected header %+v", scene.Name, header)
+		}
+	}
+
+	if FindScene("missing") != nil {
+		t.Error("expected no scene for an unknown name")
+	}
+}
+
+// The voxels must not depend on the order they are visited in, or on the
+// machine, for the numbers of different runs to be comparable.
+func TestSceneVoxels(t *testing.T) {
+	if h := hash(1, 2, 3, 4); h != hash(1, 2, 3, 4) || h == hash(1, 2, 4, 3) || h == hash(2, 2, 3, 4) {
+		t.Error("expected hash to depend on the seed and the position only")
+	}
+
+	fn := Noise.voxels(16, 1)
+	forward, _ := fn(3, 5, 7)
+	fn(8, 8, 8)
+	if again, _ := fn(3, 5, 7); again != forward {
+		t.Errorf("expected the same voxel when visited again, got %v and %v", forward, again)
+	}
+}
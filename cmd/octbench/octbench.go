@@ -0,0 +1,289 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andreas-jonsson/octatron/bench"
+	"github.com/andreas-jonsson/octatron/pack"
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+func assert(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(trace.ExitCode(err))
+	}
+}
+
+var arguments struct {
+	scenes, depths, sizes      string
+	jitter, viewDist, traverse string
+	output, compare            string
+
+	seed          int64
+	benchTime     time.Duration
+	build, tracer bool
+	multiThreaded bool
+}
+
+var traversals = map[string]trace.Traversal{
+	"recursive": trace.Recursive,
+	"marching":  trace.Marching,
+}
+
+func init() {
+	flag.Usage = func() {
+		fmt.Printf("Usage: octbench [options]\n")
+		fmt.Printf("       octbench -compare old.csv [new.csv]\n\n")
+		fmt.Printf("Without new.csv the benchmarks are run and compared to old.csv.\n\n")
+		flag.PrintDefaults()
+	}
+
+	flag.StringVar(&arguments.scenes, "scenes", "outdoor,interior,noise", "reference scenes")
+	flag.StringVar(&arguments.depths, "depths", "5,6", "depths of the reference trees")
+	flag.StringVar(&arguments.sizes, "sizes", "320x240", "image sizes traced")
+	flag.StringVar(&arguments.jitter, "jitter", "false,true", "frame jitter settings traced")
+	flag.StringVar(&arguments.viewDist, "view-dist", "5,2", "view distances traced, shorter distances reduce the level of detail")
+	flag.StringVar(&arguments.traverse, "traversal", "recursive,marching", "traversal modes traced")
+	flag.StringVar(&arguments.output, "output", "", "write the results to this CSV file instead of stdout")
+	flag.StringVar(&arguments.compare, "compare", "", "compare the results to this CSV file")
+	flag.Int64Var(&arguments.seed, "seed", 1, "seed of the reference trees")
+	flag.DurationVar(&arguments.benchTime, "time", time.Second, "minimum run time of every benchmark")
+	flag.BoolVar(&arguments.build, "build", true, "run the builder benchmarks")
+	flag.BoolVar(&arguments.tracer, "trace", true, "run the raytracer benchmarks")
+	flag.BoolVar(&arguments.multiThreaded, "mt", true, "trace with one worker per CPU")
+}
+
+// measure calls fn at least once and until benchTime has passed, and returns the
+// number of calls and the average time of a call.
+func measure(benchTime time.Duration, fn func()) (int, float64) {
+	var (
+		ops   int
+		start = time.Now()
+	)
+
+	for ops == 0 || time.Since(start) < benchTime {
+		fn()
+		ops++
+	}
+	return ops, float64(time.Since(start).Nanoseconds()) / float64(ops)
+}
+
+// benchmarkBuild builds the tree of scene at depth and returns it with the result.
+// The tree is built once if benchTime is zero.
+func benchmarkBuild(scene *bench.Scene, depth int, benchTime time.Duration) ([]byte, result) {
+	var tree bytes.Buffer
+	ops, ns := measure(benchTime, func() {
+		tree.Reset()
+		assert(scene.Build(&tree, depth, arguments.seed, pack.MipR8G8B8A8UnpackUI32))
+	})
+	return tree.Bytes(), result{Kind: "build", Scene: scene.Name, Depth: depth, Ops: ops, NsPerOp: ns}
+}
+
+// benchmarkTrace traces frames of tree with the settings of r and fills in the
+// timing of r.
+func benchmarkTrace(tree trace.Octree, maxDepth int, scene *bench.Scene, r result) result {
+	rect := image.Rect(0, 0, r.Width, r.Height)
+	cfg := trace.Config{
+		FieldOfView:   1,
+		TreeScale:     1,
+		ViewDist:      float32(r.ViewDist),
+		Jitter:        r.Jitter,
+		MultiThreaded: arguments.multiThreaded,
+		Traversal:     traversals[r.Traversal],
+		Images:        [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+	assert(cfg.Validate())
+
+	rt := trace.NewRaytracer(cfg)
+	defer rt.Close()
+
+	camera := trace.LookAtCamera{Pos: scene.Position, Look: scene.LookAt}
+	frame := func() {
+		assert(rt.Wait(rt.Trace(&camera, tree, maxDepth)))
+	}
+
+	// The first frame warms up the workers.
+	frame()
+	r.Ops, r.NsPerOp = measure(arguments.benchTime, frame)
+	return r
+}
+
+func splitList(list string) []string {
+	var fields []string
+	for _, f := range strings.Split(list, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+func parseInts(list string) []int {
+	var values []int
+	for _, f := range splitList(list) {
+		v, err := strconv.Atoi(f)
+		assert(err)
+		values = append(values, v)
+	}
+	return values
+}
+
+func parseFloats(list string) []float64 {
+	var values []float64
+	for _, f := range splitList(list) {
+		v, err := strconv.ParseFloat(f, 64)
+		assert(err)
+		values = append(values, v)
+	}
+	return values
+}
+
+func parseBools(list string) []bool {
+	var values []bool
+	for _, f := range splitList(list) {
+		v, err := strconv.ParseBool(f)
+		assert(err)
+		values = append(values, v)
+	}
+	return values
+}
+
+func parseSizes(list string) []image.Point {
+	var sizes []image.Point
+	for _, f := range splitList(list) {
+		var p image.Point
+		if n, err := fmt.Sscanf(f, "%dx%d", &p.X, &p.Y); n != 2 || p.X <= 0 || p.Y <= 0 {
+			assert(fmt.Errorf("invalid size %q: %v", f, err))
+		}
+		sizes = append(sizes, p)
+	}
+	return sizes
+}
+
+// run runs all benchmarks and reports them to progress as they complete.
+func run(progress io.Writer) []result {
+	var scenes []*bench.Scene
+	for _, name := range splitList(arguments.scenes) {
+		scene := bench.FindScene(name)
+		if scene == nil {
+			assert(fmt.Errorf("unknown scene %q", name))
+		}
+		scenes = append(scenes, scene)
+	}
+
+	for _, name := range splitList(arguments.traverse) {
+		if _, ok := traversals[name]; !ok {
+			assert(fmt.Errorf("unknown traversal %q", name))
+		}
+	}
+
+	var results []result
+	report := func(r result) {
+		results = append(results, r)
+		fmt.Fprintf(progress, "%s: %v ops, %.3f ms/op\n", r.key(), r.Ops, r.NsPerOp/1e6)
+	}
+
+	for _, scene := range scenes {
+		for _, depth := range parseInts(arguments.depths) {
+			data, r := benchmarkBuild(scene, depth, 0)
+			if arguments.build {
+				data, r = benchmarkBuild(scene, depth, arguments.benchTime)
+				report(r)
+			}
+			if !arguments.tracer {
+				continue
+			}
+
+			tree, info, err := trace.LoadOctreeWithInfo(bytes.NewReader(data))
+			assert(err)
+
+			for _, size := range parseSizes(arguments.sizes) {
+				for _, jitter := range parseBools(arguments.jitter) {
+					for _, viewDist := range parseFloats(arguments.viewDist) {
+						for _, traversal := range splitList(arguments.traverse) {
+							report(benchmarkTrace(tree, info.Depth, scene, result{
+								Kind:      "trace",
+								Scene:     scene.Name,
+								Depth:     depth,
+								Width:     size.X,
+								Height:    size.Y,
+								Jitter:    jitter,
+								ViewDist:  viewDist,
+								Traversal: traversal,
+							}))
+						}
+					}
+				}
+			}
+		}
+	}
+	return results
+}
+
+func readResultsFile(file string) []result {
+	fp, err := os.Open(file)
+	assert(err)
+	defer fp.Close()
+
+	results, err := readResults(fp)
+	assert(err)
+	return results
+}
+
+func main() {
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		if arguments.compare == "" || flag.NArg() != 1 {
+			flag.Usage()
+			os.Exit(-1)
+		}
+		assert(compareResults(os.Stdout, readResultsFile(arguments.compare), readResultsFile(flag.Arg(0))))
+		return
+	}
+
+	var old []result
+	if arguments.compare != "" {
+		old = readResultsFile(arguments.compare)
+	}
+
+	results := run(os.Stderr)
+
+	if arguments.output != "" {
+		fp, err := os.Create(arguments.output)
+		assert(err)
+		assert(writeResults(fp, results))
+		assert(fp.Close())
+	} else if arguments.compare == "" {
+		assert(writeResults(os.Stdout, results))
+	}
+
+	if arguments.compare != "" {
+		assert(compareResults(os.Stdout, old, results))
+	}
+}
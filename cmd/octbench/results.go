@@ -0,0 +1,133 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+)
+
+var errInvalidResults = errors.New("invalid results file")
+
+var resultColumns = []string{"kind", "scene", "depth", "width", "height", "jitter", "view_dist", "traversal", "ops", "ns_per_op"}
+
+// result is the outcome of one benchmark. Builder benchmarks only have the
+// scene and depth.
+type result struct {
+	Kind, Scene   string
+	Depth         int
+	Width, Height int
+	Jitter        bool
+	ViewDist      float64
+	Traversal     string
+
+	Ops     int
+	NsPerOp float64
+}
+
+// key identifies the benchmark that produced r, results of different runs are
+// compared by it.
+func (r *result) key() string {
+	if r.Kind == "build" {
+		return fmt.Sprintf("build/%s/%d", r.Scene, r.Depth)
+	}
+	return fmt.Sprintf("trace/%s/%d/%dx%d/jitter=%v/dist=%v/%s", r.Scene, r.Depth, r.Width, r.Height, r.Jitter, r.ViewDist, r.Traversal)
+}
+
+func writeResults(writer io.Writer, results []result) error {
+	w := csv.NewWriter(writer)
+	if err := w.Write(resultColumns); err != nil {
+		return err
+	}
+
+	for _, r := range results {
+		record := []string{r.Kind, r.Scene, strconv.Itoa(r.Depth), "", "", "", "", "", strconv.Itoa(r.Ops), strconv.FormatFloat(r.NsPerOp, 'f', 0, 64)}
+		if r.Kind != "build" {
+			record[3] = strconv.Itoa(r.Width)
+			record[4] = strconv.Itoa(r.Height)
+			record[5] = strconv.FormatBool(r.Jitter)
+			record[6] = strconv.FormatFloat(r.ViewDist, 'g', -1, 64)
+			record[7] = r.Traversal
+		}
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+func readResults(reader io.Reader) ([]result, error) {
+	records, err := csv.NewReader(reader).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 || len(records[0]) != len(resultColumns) {
+		return nil, errInvalidResults
+	}
+
+	var results []result
+	for _, record := range records[1:] {
+		r := result{Kind: record[0], Scene: record[1], Traversal: record[7]}
+
+		var errs [8]error
+		r.Depth, errs[0] = strconv.Atoi(record[2])
+		r.Ops, errs[1] = strconv.Atoi(record[8])
+		r.NsPerOp, errs[2] = strconv.ParseFloat(record[9], 64)
+		if r.Kind != "build" {
+			r.Width, errs[3] = strconv.Atoi(record[3])
+			r.Height, errs[4] = strconv.Atoi(record[4])
+			r.Jitter, errs[5] = strconv.ParseBool(record[5])
+			r.ViewDist, errs[6] = strconv.ParseFloat(record[6], 64)
+		}
+
+		for _, err := range errs {
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", errInvalidResults, err)
+			}
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// compareResults writes the time per operation of every benchmark in results
+// next to the time in old, with the change in percent. Negative changes are
+// faster.
+func compareResults(writer io.Writer, old, results []result) error {
+	before := make(map[string]float64)
+	for _, r := range old {
+		before[r.key()] = r.NsPerOp
+	}
+
+	w := tabwriter.NewWriter(writer, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "benchmark\told ms/op\tnew ms/op\tdelta\t\n")
+	for _, r := range results {
+		ns, ok := before[r.key()]
+		if !ok {
+			fmt.Fprintf(w, "%s\t-\t%.3f\t-\t\n", r.key(), r.NsPerOp/1e6)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%.3f\t%.3f\t%+.2f%%\t\n", r.key(), ns/1e6, r.NsPerOp/1e6, (r.NsPerOp-ns)/ns*100)
+	}
+	return w.Flush()
+}
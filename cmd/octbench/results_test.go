@@ -0,0 +1,78 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testResults = []result{
+	{Kind: "build", Scene: "noise", Depth: 5, Ops: 3, NsPerOp: 2000000},
+	{Kind: "trace", Scene: "noise", Depth: 5, Width: 320, Height: 240, Jitter: true, ViewDist: 2.5, Traversal: "marching", Ops: 40, NsPerOp: 1000000},
+}
+
+func TestResultsRoundTrip(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := writeResults(&buffer, testResults); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(buffer.String(), "kind,scene,depth,width,height,jitter,view_dist,traversal,ops,ns_per_op\nbuild,noise,5,,,,,,3,2000000\n") {
+		t.Errorf("unexpected CSV:\n%s", buffer.String())
+	}
+
+	results, err := readResults(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(results, testResults) {
+		t.Errorf("expected %+v, got %+v", testResults, results)
+	}
+
+	for _, csv := range []string{"", "kind,scene\n", "kind,scene,depth,width,height,jitter,view_dist,traversal,ops,ns_per_op\ntrace,noise,5,320,240,maybe,2,marching,1,1\n"} {
+		if _, err := readResults(strings.NewReader(csv)); err == nil {
+			t.Errorf("expected an error for %q", csv)
+		}
+	}
+}
+
+func TestCompareResults(t *testing.T) {
+	results := []result{testResults[0], testResults[1], testResults[1]}
+	results[0].NsPerOp = 3000000
+	results[1].NsPerOp = 750000
+	results[2].Traversal = "recursive"
+
+	var buffer bytes.Buffer
+	if err := compareResults(&buffer, testResults, results); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected a header and three lines, got:\n%s", buffer.String())
+	}
+
+	for i, expected := range []string{"+50.00%", "-25.00%", "-"} {
+		fields := strings.Fields(lines[i+1])
+		if fields[0] != results[i].key() || fields[len(fields)-1] != expected {
+			t.Errorf("expected %s to change by %s, got %q", results[i].key(), expected, lines[i+1])
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+func assert(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(pack.ExitCode(err))
+	}
+}
+
+var arguments struct {
+	output    string
+	dump      string
+	threshold float64
+	max       int
+}
+
+func init() {
+	flag.Usage = func() {
+		fmt.Printf("Usage: octdiff [options] a.oct b.oct\n\n")
+		flag.PrintDefaults()
+	}
+
+	flag.StringVar(&arguments.output, "output", "", "write a diff tree with differing leafs in red")
+	flag.StringVar(&arguments.dump, "dump", "", "write text dumps of both trees to PREFIX.a.txt and PREFIX.b.txt")
+	flag.Float64Var(&arguments.threshold, "threshold", 0, "color distance before leafs are reported as recolored")
+	flag.IntVar(&arguments.max, "max", 20, "maximum number of leafs listed per category")
+}
+
+func printLeafs(title string, leafs []pack.LeafDiff) {
+	if len(leafs) == 0 {
+		return
+	}
+
+	fmt.Printf("%s: %v\n", title, len(leafs))
+	for i, l := range leafs {
+		if i == arguments.max {
+			fmt.Printf("  ...\n")
+			break
+		}
+		fmt.Printf("  depth %v (%v,%v,%v): %v -> %v\n", l.Depth, l.X, l.Y, l.Z, l.A, l.B)
+	}
+}
+
+// dumpTree writes the text dump of the tree in file to output.
+func dumpTree(file, output string) {
+	in, err := os.Open(file)
+	assert(err)
+	defer in.Close()
+
+	out, err := os.Create(output)
+	assert(err)
+	defer out.Close()
+
+	assert(pack.DumpText(bufio.NewReader(in), out))
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	if arguments.dump != "" {
+		dumpTree(flag.Arg(0), arguments.dump+".a.txt")
+		dumpTree(flag.Arg(1), arguments.dump+".b.txt")
+	}
+
+	a, err := os.Open(flag.Arg(0))
+	assert(err)
+	defer a.Close()
+
+	b, err := os.Open(flag.Arg(1))
+	assert(err)
+	defer b.Close()
+
+	var diffTree *os.File
+	if arguments.output != "" {
+		diffTree, err = os.Create(arguments.output)
+		assert(err)
+		defer diffTree.Close()
+	}
+
+	var diff *pack.TreeDiff
+	if diffTree != nil {
+		diff, err = pack.DiffTrees(a, b, float32(arguments.threshold), diffTree)
+	} else {
+		diff, err = pack.DiffTrees(a, b, float32(arguments.threshold), nil)
+	}
+	assert(err)
+
+	for _, change := range diff.HeaderChanges {
+		fmt.Println("Header:", change)
+	}
+
+	for depth, count := range diff.NodesPerLevel {
+		if count[0] != count[1] {
+			fmt.Printf("Level %v: %v != %v nodes\n", depth, count[0], count[1])
+		}
+	}
+
+	printLeafs("Only in "+flag.Arg(0), diff.OnlyA)
+	printLeafs("Only in "+flag.Arg(1), diff.OnlyB)
+	printLeafs("Recolored", diff.Recolored)
+
+	if !diff.Identical() {
+		fmt.Println("Trees differ")
+		if diffTree != nil {
+			diffTree.Close()
+		}
+		os.Exit(1)
+	}
+	fmt.Println("Trees are identical")
+}
@@ -0,0 +1,63 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+func assert(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(trace.ExitCode(err))
+	}
+}
+
+var commands = map[string]func(args []string){
+	"orbit": orbitCommand,
+	"path":  pathCommand,
+}
+
+func usage() {
+	fmt.Printf("Usage: octsnap <command> [options] tree.oct\n\n")
+	fmt.Printf("Commands:\n")
+	fmt.Printf("  orbit  render a turntable animation around the tree\n")
+	fmt.Printf("  path   render a flythrough along keyframed cameras\n\n")
+	fmt.Printf("Run octsnap <command> -h for the options of a command.\n")
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(-1)
+	}
+
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+		os.Exit(-1)
+	}
+	command(flag.Args()[1:])
+}
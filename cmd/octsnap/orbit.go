@@ -0,0 +1,352 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+// aviQuality is the JPEG quality of the frames of videos.
+const aviQuality = 90
+
+type orbitOptions struct {
+	frames    int
+	size      int
+	elevation float64
+	radius    float64
+	fov       float64
+}
+
+func orbitCommand(args []string) {
+	var (
+		opt      orbitOptions
+		out      string
+		pipe     string
+		delay    int
+		manifest bool
+	)
+
+	flags := flag.NewFlagSet("orbit", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf("Usage: octsnap orbit [options] tree.oct\n\n")
+		flags.PrintDefaults()
+	}
+
+	flags.IntVar(&opt.frames, "frames", 72, "number of frames in one turn")
+	flags.IntVar(&opt.size, "size", 512, "width and height of the frames")
+	flags.Float64Var(&opt.elevation, "elevation", 30, "camera elevation in degrees")
+	flags.Float64Var(&opt.radius, "radius", 0, "distance from the center of the tree, zero frames the whole tree")
+	flags.Float64Var(&opt.fov, "fov", 45, "field of view in degrees")
+	flags.StringVar(&out, "out", "orbit.gif", "animated gif, avi video, or png file the frame number is appended to")
+	flags.StringVar(&pipe, "pipe", "", "command to pipe the raw frames to instead, {width}, {height} and {fps} are replaced")
+	flags.IntVar(&delay, "delay", 4, "frame delay in 100ths of a second")
+	flags.BoolVar(&manifest, "manifest", false, "write a JSON render manifest alongside every frame")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(-1)
+	}
+	assert(opt.validate())
+	if delay < 1 {
+		assert(errors.New("invalid frame delay"))
+	}
+
+	mapped, err := trace.LoadOctreeMapped(flags.Arg(0))
+	assert(err)
+	defer mapped.Close()
+
+	tree, ok := mapped.Acquire()
+	if !ok {
+		assert(errors.New("tree is closed"))
+	}
+	frames, manifests := renderOrbit(tree, mapped.Info(), &opt)
+	mapped.Release()
+
+	if manifest {
+		assert(writeManifests(out, flags.Arg(0), manifests))
+	}
+	assert(writeOutput(out, pipe, frames, 100/float64(delay)))
+}
+
+func (opt *orbitOptions) validate() error {
+	switch {
+	case opt.frames < 1:
+		return errors.New("at least one frame is needed")
+	case opt.size < 1:
+		return errors.New("invalid frame size")
+	case !(math.Abs(opt.elevation) < 90):
+		return errors.New("elevation must be between -90 and 90 degrees")
+	case !(opt.radius >= 0):
+		return errors.New("invalid radius")
+	case !(opt.fov > 0 && opt.fov < 180):
+		return errors.New("invalid field of view")
+	}
+	return nil
+}
+
+// orbitCamera returns the camera of frame i, looking at the center of the tree.
+func orbitCamera(info *trace.TreeInfo, opt *orbitOptions, i int) trace.Camera {
+	angle := 2 * math.Pi * float64(i) / float64(opt.frames)
+	elevation := opt.elevation * math.Pi / 180
+
+	// Direction from the camera towards the center of the tree.
+	dir := trace.Vec3{
+		float32(-math.Cos(elevation) * math.Sin(angle)),
+		float32(-math.Sin(elevation)),
+		float32(-math.Cos(elevation) * math.Cos(angle)),
+	}
+
+	framed := trace.FrameTree(info, dir)
+	if opt.radius == 0 {
+		return &framed
+	}
+
+	center := framed.LookAt()
+	pos := trace.Vec3{
+		center[0] - dir[0]*float32(opt.radius),
+		center[1] - dir[1]*float32(opt.radius),
+		center[2] - dir[2]*float32(opt.radius),
+	}
+	return &trace.LookAtCamera{Pos: pos, Look: center}
+}
+
+// renderOrbit renders the frames of the orbit.
+func renderOrbit(tree trace.Octree, info *trace.TreeInfo, opt *orbitOptions) ([]*image.RGBA, []trace.RenderManifest) {
+	return renderFrames(tree, info, opt, func(i int) trace.Camera {
+		return orbitCamera(info, opt, i)
+	})
+}
+
+// renderFrames renders opt.frames frames with the cameras returned by camera, one
+// per CPU at a time. The manifests of the frames are returned with them.
+func renderFrames(tree trace.Octree, info *trace.TreeInfo, opt *orbitOptions, camera func(i int) trace.Camera) ([]*image.RGBA, []trace.RenderManifest) {
+	var (
+		frames    = make([]*image.RGBA, opt.frames)
+		manifests = make([]trace.RenderManifest, opt.frames)
+		slots     = make(chan struct{}, runtime.NumCPU())
+		wg        sync.WaitGroup
+	)
+
+	for i := range frames {
+		wg.Add(1)
+		slots <- struct{}{}
+
+		go func(i int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			frames[i], manifests[i] = renderFrame(tree, info, opt, camera(i))
+			manifests[i].Frame = i
+		}(i)
+	}
+
+	wg.Wait()
+	return frames, manifests
+}
+
+func renderFrame(tree trace.Octree, info *trace.TreeInfo, opt *orbitOptions, camera trace.Camera) (*image.RGBA, trace.RenderManifest) {
+	rect := image.Rect(0, 0, opt.size, opt.size)
+	cfg := trace.Config{
+		FieldOfViewDegrees: float32(opt.fov),
+		Images:             [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+	cfg.FitTree(info)
+	cfg.ViewDist = 4 * (cfg.TreeScale + float32(opt.radius))
+
+	raytracer := trace.NewRaytracer(cfg)
+	defer raytracer.Close()
+
+	raytracer.SetClearColor(color.RGBA{0, 0, 0, 255})
+
+	start := time.Now()
+	img := raytracer.Image(raytracer.Trace(camera, tree, info.Depth))
+
+	manifest := trace.NewRenderManifest(&cfg, camera, rect.Size())
+	manifest.RenderTime = time.Since(start).Seconds()
+	return img, manifest
+}
+
+// writeOutput writes the frames to out, an animated GIF, an AVI video or numbered
+// PNGs by its extension, or pipes them to command if it is set. Fps is the frame
+// rate of the animation.
+func writeOutput(out, command string, frames []*image.RGBA, fps float64) error {
+	if command != "" {
+		size := frames[0].Rect.Size()
+		args := trace.PipeArgs(command, size, fps)
+		if len(args) == 0 {
+			return errors.New("empty pipe command")
+		}
+
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		sink, err := trace.StartPipe(cmd, size, fps)
+		if err != nil {
+			return err
+		}
+		return writeSink(sink, frames, fps)
+	}
+
+	switch strings.ToLower(filepath.Ext(out)) {
+	case ".gif":
+		fp, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+
+		err = writeGIF(fp, frames, int(math.Round(100/fps)))
+		if cerr := fp.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	case ".avi":
+		sink, err := trace.CreateAVI(out, fps, aviQuality)
+		if err != nil {
+			return err
+		}
+		return writeSink(sink, frames, fps)
+	}
+	return writePNGs(out, frames)
+}
+
+// writeSink writes the frames to sink at fps frames per second and closes it.
+func writeSink(sink trace.FrameSink, frames []*image.RGBA, fps float64) error {
+	for i, frame := range frames {
+		if err := sink.WriteFrame(frame, time.Duration(float64(i)/fps*float64(time.Second))); err != nil {
+			sink.Close()
+			return err
+		}
+	}
+	return sink.Close()
+}
+
+func writeGIF(w io.Writer, frames []*image.RGBA, delay int) error {
+	palette := medianCut(frames, 256)
+	anim := &gif.GIF{}
+
+	for _, frame := range frames {
+		img := image.NewPaletted(frame.Bounds(), palette)
+		draw.Draw(img, img.Rect, frame, frame.Rect.Min, draw.Src)
+
+		anim.Image = append(anim.Image, img)
+		anim.Delay = append(anim.Delay, delay)
+	}
+	return gif.EncodeAll(w, anim)
+}
+
+// frameName returns the name of frame i for the output out, without extension.
+func frameName(out string, i int) string {
+	return fmt.Sprintf("%s%03d", strings.TrimSuffix(out, filepath.Ext(out)), i)
+}
+
+// writePNGs writes the frames to numbered files named after out.
+func writePNGs(out string, frames []*image.RGBA) error {
+	ext := filepath.Ext(out)
+	if ext == "" {
+		ext = ".png"
+	}
+
+	for i, frame := range frames {
+		fp, err := os.Create(frameName(out, i) + ext)
+		if err != nil {
+			return err
+		}
+
+		err = png.Encode(fp, frame)
+		if cerr := fp.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashFile returns the SHA-256 of the file as a hex string.
+func hashFile(file string) (string, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fp); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeManifests writes the manifest of every frame next to it, with the name
+// and hash of the tree. The frames of a GIF or video share one file with a list.
+func writeManifests(out, tree string, manifests []trace.RenderManifest) error {
+	hash, err := hashFile(tree)
+	if err != nil {
+		return err
+	}
+
+	for i := range manifests {
+		manifests[i].Tree = filepath.Base(tree)
+		manifests[i].TreeHash = hash
+	}
+
+	write := func(file string, v interface{}) error {
+		data, err := json.MarshalIndent(v, "", "\t")
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(file, data, 0644)
+	}
+
+	if ext := strings.ToLower(filepath.Ext(out)); ext == ".gif" || ext == ".avi" {
+		return write(strings.TrimSuffix(out, filepath.Ext(out))+".json", manifests)
+	}
+
+	for i, manifest := range manifests {
+		if err := write(frameName(out, i)+".json", manifest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
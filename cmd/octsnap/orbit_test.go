@@ -0,0 +1,184 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/gif"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+func tinyTree() (trace.Octree, *trace.TreeInfo) {
+	tree := trace.NewMutableTree(nil, 2)
+	colors := []color.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}}
+
+	for i, pos := range [][3]float32{{0.25, 0.25, 0.25}, {0.75, 0.25, 0.75}, {0.25, 0.75, 0.75}} {
+		if err := tree.SetVoxel(pos, 1, colors[i]); err != nil {
+			panic(err)
+		}
+	}
+
+	info := &trace.TreeInfo{VoxelsPerAxis: 2, Depth: trace.TreeWidthToDepth(2)}
+	return tree.Octree(), info
+}
+
+func TestOrbitGIF(t *testing.T) {
+	tree, info := tinyTree()
+	opt := orbitOptions{frames: 4, size: 32, elevation: 30, fov: 45}
+	if err := opt.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	frames, _ := renderOrbit(tree, info, &opt)
+	for i, frame := range frames {
+		hits := 0
+		for y := 1; y < 32; y++ {
+			for x := 0; x < 32; x++ {
+				if frame.RGBAAt(x, y) != (color.RGBA{0, 0, 0, 255}) {
+					hits++
+				}
+			}
+		}
+		if hits == 0 {
+			t.Errorf("expected tree in frame %v", i)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeGIF(&buf, frames, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	anim, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anim.Image) != 4 {
+		t.Fatalf("expected 4 frames, got %v", len(anim.Image))
+	}
+	if anim.Image[0].Bounds() != image.Rect(0, 0, 32, 32) {
+		t.Errorf("unexpected frame size %v", anim.Image[0].Bounds())
+	}
+}
+
+func TestOrbitAVI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "octsnap")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tree, info := tinyTree()
+	opt := orbitOptions{frames: 5, size: 16, elevation: 30, fov: 45}
+	frames, _ := renderOrbit(tree, info, &opt)
+
+	out := filepath.Join(dir, "orbit.avi")
+	if err := writeOutput(out, "", frames, 25); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 224 || string(data[:4]) != "RIFF" || string(data[8:12]) != "AVI " {
+		t.Fatal("expected an AVI file")
+	}
+
+	// The frame count of the main header and the number of index entries.
+	if n := binary.LittleEndian.Uint32(data[48:]); n != 5 {
+		t.Errorf("expected 5 frames, got %d", n)
+	}
+	if idx := bytes.LastIndex(data, []byte("idx1")); idx < 0 || binary.LittleEndian.Uint32(data[idx+4:]) != 5*16 {
+		t.Error("expected an index of 5 frames")
+	}
+}
+
+func TestMedianCut(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 4))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 4; y++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 4), uint8(y * 64), 0, 255})
+		}
+	}
+
+	if palette := medianCut([]*image.RGBA{img}, 16); len(palette) != 16 {
+		t.Errorf("expected 16 colors, got %v", len(palette))
+	}
+
+	// A single color is not split.
+	flat := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	if palette := medianCut([]*image.RGBA{flat}, 16); len(palette) != 1 {
+		t.Errorf("expected 1 color, got %v", len(palette))
+	}
+}
+
+func TestWriteManifests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "octsnap")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tree := filepath.Join(dir, "tree.oct")
+	if err := ioutil.WriteFile(tree, []byte("octree"), 0644); err != nil {
+		panic(err)
+	}
+
+	manifests := []trace.RenderManifest{{Frame: 0}, {Frame: 1}}
+	if err := writeManifests(filepath.Join(dir, "frame.png"), tree, manifests); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "frame001.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var manifest trace.RenderManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	// The SHA-256 of "octree".
+	const hash = "1630ffb8dd031a54cdd3dea27d623e8e78adb987e68fd71076cde7e85e25d6f7"
+	if manifest.Frame != 1 || manifest.Tree != "tree.oct" || manifest.TreeHash != hash {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+
+	if err := writeManifests(filepath.Join(dir, "orbit.gif"), tree, manifests); err != nil {
+		t.Fatal(err)
+	}
+
+	var list []trace.RenderManifest
+	if data, err = ioutil.ReadFile(filepath.Join(dir, "orbit.json")); err == nil {
+		err = json.Unmarshal(data, &list)
+	}
+	if err != nil || len(list) != 2 {
+		t.Errorf("expected the manifests of the gif in one file: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+// pathKey is a keyframe of a flythrough, read from JSON. Up defaults to +y.
+type pathKey struct {
+	Time     float32     `json:"time"`
+	Position trace.Vec3  `json:"position"`
+	LookAt   trace.Vec3  `json:"look_at"`
+	Up       *trace.Vec3 `json:"up"`
+}
+
+// keyCamera is the camera of a pathKey.
+type keyCamera struct {
+	pos, look, up trace.Vec3
+}
+
+func (c *keyCamera) Position() trace.Vec3 {
+	return c.pos
+}
+
+func (c *keyCamera) LookAt() trace.Vec3 {
+	return c.look
+}
+
+func (c *keyCamera) Up() trace.Vec3 {
+	return c.up
+}
+
+func pathCommand(args []string) {
+	var (
+		opt      orbitOptions
+		keys     string
+		out      string
+		pipe     string
+		fps      float64
+		manifest bool
+	)
+
+	flags := flag.NewFlagSet("path", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf("Usage: octsnap path [options] tree.oct\n\n")
+		flags.PrintDefaults()
+	}
+
+	flags.StringVar(&keys, "keys", "path.json", "JSON list of keyframes with time, position, look_at and optional up")
+	flags.Float64Var(&fps, "fps", 25, "frames per second of the animation")
+	flags.IntVar(&opt.size, "size", 512, "width and height of the frames")
+	flags.Float64Var(&opt.fov, "fov", 45, "field of view in degrees")
+	flags.StringVar(&out, "out", "path.gif", "animated gif, avi video, or png file the frame number is appended to")
+	flags.StringVar(&pipe, "pipe", "", "command to pipe the raw frames to instead, {width}, {height} and {fps} are replaced")
+	flags.BoolVar(&manifest, "manifest", false, "write a JSON render manifest alongside every frame")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(-1)
+	}
+
+	fp, err := os.Open(keys)
+	assert(err)
+	path, err := readPath(fp)
+	fp.Close()
+	assert(err)
+
+	if !(fps > 0 && fps <= 100) {
+		assert(errors.New("frames per second must be between 0 and 100"))
+	}
+	opt.frames = int(float64(path.Duration())*fps) + 1
+	assert(opt.validate())
+
+	mapped, err := trace.LoadOctreeMapped(flags.Arg(0))
+	assert(err)
+	defer mapped.Close()
+
+	tree, ok := mapped.Acquire()
+	if !ok {
+		assert(errors.New("tree is closed"))
+	}
+	frames, manifests := renderPath(tree, mapped.Info(), &opt, path, fps)
+	mapped.Release()
+
+	if manifest {
+		assert(writeManifests(out, flags.Arg(0), manifests))
+	}
+	assert(writeOutput(out, pipe, frames, fps))
+}
+
+// readPath reads the keyframes of a path.
+func readPath(r io.Reader) (*trace.CatmullRomPath, error) {
+	var keys []pathKey
+	if err := json.NewDecoder(r).Decode(&keys); err != nil {
+		return nil, err
+	}
+
+	cameraKeys := make([]trace.CameraKey, len(keys))
+	for i, key := range keys {
+		camera := &keyCamera{key.Position, key.LookAt, trace.Vec3{0, 1, 0}}
+		if key.Up != nil {
+			camera.up = *key.Up
+		}
+		cameraKeys[i] = trace.CameraKey{Time: key.Time, Camera: camera}
+	}
+	return trace.NewCatmullRomPath(cameraKeys)
+}
+
+// renderPath renders the frames of path, fps frames per second from its first key.
+// The radius of opt is set to the largest distance of a camera from the tree.
+func renderPath(tree trace.Octree, info *trace.TreeInfo, opt *orbitOptions, path *trace.CatmullRomPath, fps float64) ([]*image.RGBA, []trace.RenderManifest) {
+	cameras := make([]trace.PathCamera, opt.frames)
+
+	// The view distance has to reach the tree from every camera.
+	framed := trace.FrameTree(info, trace.Vec3{})
+	center := framed.LookAt()
+
+	for i := range cameras {
+		cameras[i] = path.Eval(path.Start() + float32(float64(i)/fps))
+		var d float64
+		for axis := range center {
+			v := float64(cameras[i].Pos[axis] - center[axis])
+			d += v * v
+		}
+		opt.radius = math.Max(opt.radius, math.Sqrt(d))
+	}
+
+	return renderFrames(tree, info, opt, func(i int) trace.Camera { return &cameras[i] })
+}
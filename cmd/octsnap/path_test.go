@@ -0,0 +1,78 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"image/color"
+	"strings"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+func TestRenderPath(t *testing.T) {
+	keys := `[
+		{"time": 0, "position": [0.5, 0.5, 3], "look_at": [0.5, 0.5, 0.5]},
+		{"time": 0.5, "position": [3, 2, 0.5], "look_at": [0.5, 0.5, 0.5]},
+		{"time": 1, "position": [0.5, 3, 0.5], "look_at": [0.5, 0.5, 0.5], "up": [1, 0, 0]}
+	]`
+
+	path, err := readPath(strings.NewReader(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, info := tinyTree()
+	opt := orbitOptions{frames: 5, size: 32, fov: 45}
+	frames, manifests := renderPath(tree, info, &opt, path, 4)
+
+	if len(frames) != 5 {
+		t.Fatalf("expected 5 frames, got %v", len(frames))
+	}
+	if opt.radius < 2.5 {
+		t.Errorf("expected radius to reach the cameras, got %v", opt.radius)
+	}
+
+	for i, frame := range frames {
+		hits := 0
+		for y := 1; y < 32; y++ {
+			for x := 0; x < 32; x++ {
+				if frame.RGBAAt(x, y) != (color.RGBA{0, 0, 0, 255}) {
+					hits++
+				}
+			}
+		}
+		if hits == 0 {
+			t.Errorf("expected tree in frame %v", i)
+		}
+
+		if m := manifests[i]; m.Frame != i || m.Width != 32 || m.Height != 32 {
+			t.Errorf("unexpected manifest of frame %v: %+v", i, m)
+		}
+	}
+
+	if p := manifests[0].Camera.Position; p != (trace.Vec3{0.5, 0.5, 3}) {
+		t.Errorf("expected the manifest to hold the first key, got %v", p)
+	}
+	if up := manifests[4].Camera.Up; up != (trace.Vec3{1, 0, 0}) {
+		t.Errorf("expected the manifest to hold the up vector of the last key, got %v", up)
+	}
+
+	if _, err := readPath(strings.NewReader(`[{"time": 1, "position": [0, 0, 0], "look_at": [0, 0, 0]}]`)); err == nil {
+		t.Error("expected error for a camera looking at itself")
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"sort"
+)
+
+// maxQuantizeSamples bounds the number of pixels the palette is computed from.
+const maxQuantizeSamples = 1 << 18
+
+type colorBox struct {
+	colors [][3]uint8
+}
+
+// widest returns the channel with the largest range and the range.
+func (b *colorBox) widest() (int, int) {
+	var lo, hi [3]uint8
+	lo = b.colors[0]
+	hi = b.colors[0]
+
+	for _, c := range b.colors[1:] {
+		for i := range c {
+			if c[i] < lo[i] {
+				lo[i] = c[i]
+			}
+			if c[i] > hi[i] {
+				hi[i] = c[i]
+			}
+		}
+	}
+
+	channel := 0
+	for i := 1; i < 3; i++ {
+		if int(hi[i])-int(lo[i]) > int(hi[channel])-int(lo[channel]) {
+			channel = i
+		}
+	}
+	return channel, int(hi[channel]) - int(lo[channel])
+}
+
+func (b *colorBox) average() color.RGBA {
+	var sum [3]int
+	for _, c := range b.colors {
+		for i := range c {
+			sum[i] += int(c[i])
+		}
+	}
+
+	n := len(b.colors)
+	return color.RGBA{uint8(sum[0] / n), uint8(sum[1] / n), uint8(sum[2] / n), 255}
+}
+
+type byChannel struct {
+	colors  [][3]uint8
+	channel int
+}
+
+func (s byChannel) Len() int {
+	return len(s.colors)
+}
+
+func (s byChannel) Less(i, j int) bool {
+	return s.colors[i][s.channel] < s.colors[j][s.channel]
+}
+
+func (s byChannel) Swap(i, j int) {
+	s.colors[i], s.colors[j] = s.colors[j], s.colors[i]
+}
+
+// medianCut returns a palette of at most size colors for the images. The box with
+// the widest channel is split at its median until there are size boxes.
+func medianCut(images []*image.RGBA, size int) color.Palette {
+	var numPixels int
+	for _, img := range images {
+		numPixels += img.Rect.Dx() * img.Rect.Dy()
+	}
+
+	step := numPixels/maxQuantizeSamples + 1
+	colors := make([][3]uint8, 0, numPixels/step+1)
+
+	var n int
+	for _, img := range images {
+		for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+			for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+				if n++; n%step == 0 {
+					c := img.RGBAAt(x, y)
+					colors = append(colors, [3]uint8{c.R, c.G, c.B})
+				}
+			}
+		}
+	}
+
+	if len(colors) == 0 {
+		return color.Palette{color.RGBA{0, 0, 0, 255}}
+	}
+
+	boxes := []colorBox{{colors}}
+	for len(boxes) < size {
+		best, bestRange := -1, 0
+		for i := range boxes {
+			if len(boxes[i].colors) < 2 {
+				continue
+			}
+			if _, r := boxes[i].widest(); r > bestRange {
+				best, bestRange = i, r
+			}
+		}
+
+		if best < 0 {
+			break
+		}
+
+		box := boxes[best]
+		channel, _ := box.widest()
+		sort.Sort(byChannel{box.colors, channel})
+
+		mid := len(box.colors) / 2
+		boxes[best] = colorBox{box.colors[:mid]}
+		boxes = append(boxes, colorBox{box.colors[mid:]})
+	}
+
+	palette := make(color.Palette, len(boxes))
+	for i := range boxes {
+		palette[i] = boxes[i].average()
+	}
+	return palette
+}
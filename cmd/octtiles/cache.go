@@ -0,0 +1,159 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tileCache keeps encoded tiles in a directory and removes the least recently used
+// ones when there are more than max. Tiles already in the directory are used, the
+// most recently modified ones counting as the most recently used. A nil cache
+// keeps nothing.
+type tileCache struct {
+	dir string
+	max int
+
+	lock  sync.Mutex
+	tiles map[string]*list.Element
+	lru   *list.List
+}
+
+const tileExt = ".png"
+
+func openTileCache(dir string, max int) (*tileCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+
+	c := &tileCache{dir: dir, max: max, tiles: make(map[string]*list.Element), lru: list.New()}
+	for _, file := range files {
+		if name := file.Name(); !file.IsDir() && strings.HasSuffix(name, tileExt) {
+			key := strings.TrimSuffix(name, tileExt)
+			c.tiles[key] = c.lru.PushBack(key)
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c, c.evict()
+}
+
+func (c *tileCache) path(key string) string {
+	return filepath.Join(c.dir, key+tileExt)
+}
+
+// get returns the tile stored under key.
+func (c *tileCache) get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	elem, ok := c.tiles[key]
+	if ok {
+		c.lru.MoveToFront(elem)
+	}
+	c.lock.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		c.remove(key)
+		return nil, false
+	}
+	return data, true
+}
+
+// put stores the tile under key. The file is written under a temporary name and
+// renamed so readers never see a partial tile.
+func (c *tileCache) put(key string, data []byte) error {
+	if c == nil {
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(c.dir, "tile")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path(key)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.tiles[key]; ok {
+		c.lru.MoveToFront(elem)
+	} else {
+		c.tiles[key] = c.lru.PushFront(key)
+	}
+	return c.evict()
+}
+
+// evict removes the least recently used tiles beyond max, the lock must be held.
+func (c *tileCache) evict() error {
+	for c.lru.Len() > c.max {
+		oldest := c.lru.Back()
+		key := oldest.Value.(string)
+		c.lru.Remove(oldest)
+		delete(c.tiles, key)
+
+		if err := os.Remove(c.path(key)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *tileCache) remove(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.tiles[key]; ok {
+		c.lru.Remove(elem)
+		delete(c.tiles, key)
+	}
+}
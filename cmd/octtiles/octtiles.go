@@ -0,0 +1,119 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+func assert(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(trace.ExitCode(err))
+	}
+}
+
+var arguments struct {
+	addr      string
+	cache     string
+	cacheSize int
+	tileSize  int
+	maxZoom   int
+
+	warm         bool
+	warmFraction float64
+}
+
+func init() {
+	flag.Usage = func() {
+		fmt.Printf("Usage: octtiles [options] tree.oct\n\n")
+		fmt.Printf("Tiles are served as /tiles/{z}/{x}/{y}.png and the world bounds of the\n")
+		fmt.Printf("tiles as /tiles.json.\n\n")
+		flag.PrintDefaults()
+	}
+
+	flag.StringVar(&arguments.addr, "addr", ":8080", "address to listen on")
+	flag.StringVar(&arguments.cache, "cache", "", "directory of the tile cache of this tree, none if empty")
+	flag.IntVar(&arguments.cacheSize, "cache-size", 4096, "number of tiles kept in the cache")
+	flag.IntVar(&arguments.tileSize, "tile-size", 256, "width and height of the tiles, a power of two")
+	flag.IntVar(&arguments.maxZoom, "max-zoom", 20, "largest zoom level served")
+	flag.BoolVar(&arguments.warm, "warm", true, "save the blocks of the tree in memory at shutdown and read them again at start")
+	flag.Float64Var(&arguments.warmFraction, "warm-fraction", 0.9, "fraction of the saved blocks read before tiles are rendered")
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	mapped, err := trace.LoadOctreeMapped(flag.Arg(0))
+	assert(err)
+	defer mapped.Close()
+
+	tree, ok := mapped.Acquire()
+	if !ok {
+		assert(errors.New("tree is closed"))
+	}
+	defer mapped.Release()
+
+	var cache *tileCache
+	if arguments.cache != "" {
+		cache, err = openTileCache(arguments.cache, arguments.cacheSize)
+		assert(err)
+	}
+
+	server, err := newTileServer(tree, mapped.Info(), arguments.tileSize, arguments.maxZoom, cache)
+	assert(err)
+
+	if arguments.warm && mapped.Mapped() {
+		server.warm, err = mapped.WarmUp(arguments.warmFraction)
+		if err != nil {
+			log.Println("Tree is not warmed up:", err)
+		}
+		go saveHotSet(mapped, server.warm)
+	}
+
+	log.Println("Serving tiles on", arguments.addr)
+	assert(http.ListenAndServe(arguments.addr, server))
+}
+
+// saveHotSet saves the hot set of the tree when the server is stopped.
+func saveHotSet(mapped *trace.MappedTree, warm *trace.WarmUp) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	if warm != nil {
+		warm.Stop()
+	}
+	if err := mapped.SaveHotSet(); err != nil {
+		log.Println("Could not save the hot set:", err)
+	}
+	os.Exit(0)
+}
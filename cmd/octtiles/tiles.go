@@ -0,0 +1,307 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"math/bits"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+// tileServer renders the tree straight from above. Zoom level zero is a single
+// tile covering the XZ footprint of the tree, every level splits the tiles of the
+// previous one in four. Tile rows go from min z to max z.
+type tileServer struct {
+	tree     trace.Octree
+	info     *trace.TreeInfo
+	size     int
+	maxZoom  int
+	cache    *tileCache
+	renderer *trace.Raytracer
+
+	// warm reads the hot set of the tree file, nil if there is none. Tiles are
+	// not rendered before it is ready.
+	warm *trace.WarmUp
+
+	// renders counts the tiles rendered, tiles served from the cache are not.
+	renders int64
+}
+
+// tileBounds is the area of the XZ plane covered by the tiles, as min x, min z,
+// max x, max z in world coordinates.
+type tileBounds struct {
+	TileSize int        `json:"tile_size"`
+	MaxZoom  int        `json:"max_zoom"`
+	Bounds   [4]float64 `json:"bounds"`
+
+	// CRS is the coordinate reference system of picked positions, empty if the
+	// tree is not geo referenced.
+	CRS string `json:"crs,omitempty"`
+
+	// Ready is false while the tree is warmed up, requests for tiles wait until
+	// it is done.
+	Ready bool `json:"ready"`
+}
+
+// tilePick is the leaf seen at a pixel of a tile. Position is in world
+// coordinates, those of the CRS for geo referenced trees.
+type tilePick struct {
+	Hit      bool       `json:"hit"`
+	Node     uint32     `json:"node,omitempty"`
+	Position [3]float64 `json:"position,omitempty"`
+	Color    [3]uint8   `json:"color,omitempty"`
+}
+
+func newTileServer(tree trace.Octree, info *trace.TreeInfo, size, maxZoom int, cache *tileCache) (*tileServer, error) {
+	if size <= 0 || size&(size-1) != 0 {
+		return nil, errors.New("tile size must be a power of two")
+	}
+	if maxZoom < 0 || maxZoom > 30 {
+		return nil, errors.New("max zoom must be between 0 and 30")
+	}
+
+	// Rays are cast one by one, the images are never rendered to. The view distance
+	// is far beyond the rays so the level of detail only depends on the zoom.
+	rect := image.Rect(0, 0, 1, 1)
+	renderer := trace.NewRaytracer(trace.Config{
+		TreeScale: 1,
+		ViewDist:  1000,
+		Images:    [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	return &tileServer{tree: tree, info: info, size: size, maxZoom: maxZoom, cache: cache, renderer: renderer}, nil
+}
+
+// bounds returns the world area covered by zoom level zero. Trees without world
+// bounds cover the unit square.
+func (s *tileServer) bounds() tileBounds {
+	b := tileBounds{TileSize: s.size, MaxZoom: s.maxZoom, Bounds: [4]float64{0, 0, 1, 1}}
+	if s.info.Bounds.Size > 0 {
+		min, size := s.info.Bounds.Pos, s.info.Bounds.Size
+		b.Bounds = [4]float64{min.X, min.Z, min.X + size, min.Z + size}
+	}
+	if s.info.GeoReference != nil {
+		b.CRS = s.info.GeoReference.CRS
+	}
+	b.Ready = s.ready()
+	return b
+}
+
+// ready returns true if the warm-up is far enough for tiles to be rendered.
+func (s *tileServer) ready() bool {
+	if s.warm == nil {
+		return true
+	}
+	select {
+	case <-s.warm.Ready():
+		return true
+	default:
+		return false
+	}
+}
+
+// waitReady waits for the warm-up, false is returned if the request is canceled
+// first.
+func (s *tileServer) waitReady(r *http.Request) bool {
+	if s.warm == nil {
+		return true
+	}
+	select {
+	case <-s.warm.Ready():
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// writeMetrics writes the tile counters and the progress of the warm-up in the
+// Prometheus text format.
+func (s *tileServer) writeMetrics(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "octtiles_tiles_rendered_total %d\n", atomic.LoadInt64(&s.renders))
+
+	var loaded, total int64
+	if s.warm != nil {
+		loaded, total = s.warm.Progress()
+	}
+	ready := 0
+	if s.ready() {
+		ready = 1
+	}
+	fmt.Fprintf(w, "octtiles_warmup_blocks_loaded %d\n", loaded)
+	fmt.Fprintf(w, "octtiles_warmup_blocks_total %d\n", total)
+	fmt.Fprintf(w, "octtiles_ready %d\n", ready)
+}
+
+// maxDepth returns the depth leafs are resolved to at zoom level z.
+func (s *tileServer) maxDepth(z int) int {
+	// Leafs are not resolved below the size of a pixel.
+	maxDepth := z + bits.TrailingZeros(uint(s.size))
+	if maxDepth > s.info.Depth {
+		maxDepth = s.info.Depth
+	}
+	return maxDepth
+}
+
+// castPixel casts the vertical ray through pixel px, py of tile x, y of zoom
+// level z.
+func (s *tileServer) castPixel(z, x, y, px, py, maxDepth int) (trace.Hit, bool) {
+	pixel := 1 / float64(int(1)<<uint(z)*s.size)
+	origin := trace.Vec3{
+		float32((float64(x*s.size+px) + 0.5) * pixel),
+		2,
+		float32((float64(y*s.size+py) + 0.5) * pixel),
+	}
+
+	return s.renderer.CastRay(s.tree, maxDepth, origin, trace.Vec3{0, -1, 0}, 3)
+}
+
+// pick returns the leaf seen at pixel px, py of tile x, y of zoom level z.
+func (s *tileServer) pick(z, x, y, px, py int) tilePick {
+	tiles := 1 << uint(z)
+	if x < 0 || y < 0 || x >= tiles || y >= tiles || px < 0 || py < 0 || px >= s.size || py >= s.size {
+		return tilePick{}
+	}
+
+	hit, ok := s.castPixel(z, x, y, px, py, s.maxDepth(z))
+	if !ok {
+		return tilePick{}
+	}
+
+	pos := s.renderer.WorldPosition(s.info, hit.Position)
+	return tilePick{
+		Hit:      true,
+		Node:     hit.Node,
+		Position: [3]float64{pos.X, pos.Y, pos.Z},
+		Color:    [3]uint8{hit.Color.R, hit.Color.G, hit.Color.B},
+	}
+}
+
+// renderTile renders tile x, y of zoom level z with one vertical ray per pixel.
+// Lower leafs are darker and pixels where nothing is hit are transparent. Tiles
+// outside of the tree are transparent.
+func (s *tileServer) renderTile(z, x, y int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, s.size, s.size))
+	tiles := 1 << uint(z)
+	if x < 0 || y < 0 || x >= tiles || y >= tiles {
+		return img
+	}
+	atomic.AddInt64(&s.renders, 1)
+
+	maxDepth := s.maxDepth(z)
+	for py := 0; py < s.size; py++ {
+		for px := 0; px < s.size; px++ {
+			hit, ok := s.castPixel(z, x, y, px, py, maxDepth)
+			if !ok {
+				continue
+			}
+
+			shade := 0.5 + 0.5*hit.Position[1]
+			if shade > 1 {
+				shade = 1
+			} else if shade < 0.5 {
+				shade = 0.5
+			}
+			c := hit.Color
+			img.SetRGBA(px, py, color.RGBA{uint8(float32(c.R) * shade), uint8(float32(c.G) * shade), uint8(float32(c.B) * shade), 0xFF})
+		}
+	}
+	return img
+}
+
+// tile returns the encoded tile, from the cache if it is there.
+func (s *tileServer) tile(z, x, y int) ([]byte, error) {
+	key := fmt.Sprintf("%d-%d-%d-%d", s.size, z, x, y)
+	if data, ok := s.cache.get(key); ok {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, s.renderTile(z, x, y)); err != nil {
+		return nil, err
+	}
+
+	if err := s.cache.put(key, buf.Bytes()); err != nil {
+		log.Println(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *tileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/tiles.json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(w).Encode(s.bounds())
+		return
+	}
+	if r.URL.Path == "/metrics" {
+		s.writeMetrics(w)
+		return
+	}
+
+	var z, x, y int
+	var rest string
+
+	var px, py int
+	if n, _ := fmt.Sscanf(r.URL.Path, "/pick/%d/%d/%d/%d/%d%s", &z, &x, &y, &px, &py, &rest); n == 5 {
+		if z < 0 || z > s.maxZoom {
+			http.NotFound(w, r)
+			return
+		}
+		if !s.waitReady(r) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(w).Encode(s.pick(z, x, y, px, py))
+		return
+	}
+
+	if n, _ := fmt.Sscanf(r.URL.Path, "/tiles/%d/%d/%d%s", &z, &x, &y, &rest); n != 4 || rest != ".png" {
+		http.NotFound(w, r)
+		return
+	}
+	if z < 0 || z > s.maxZoom {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !s.waitReady(r) {
+		return
+	}
+
+	data, err := s.tile(z, x, y)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "could not render tile", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(data)
+}
@@ -0,0 +1,285 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/pack"
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+var updateGolden = flag.Bool("update", false, "write the golden tiles instead of comparing with them")
+
+const testTileSize = 16
+
+// testTree is a floor of 8x8 voxels with a tower in the min x, max z quarter.
+func testTree() (trace.Octree, *trace.TreeInfo) {
+	const depth = 3
+	tree := trace.NewMutableTree(nil, 1<<depth)
+	size := float32(1) / (1 << depth)
+
+	set := func(x, y, z int, c color.RGBA) {
+		pos := [3]float32{(float32(x) + 0.5) * size, (float32(y) + 0.5) * size, (float32(z) + 0.5) * size}
+		if err := tree.SetVoxel(pos, depth, c); err != nil {
+			panic(err)
+		}
+	}
+
+	for z := 0; z < 8; z++ {
+		for x := 0; x < 8; x++ {
+			set(x, 0, z, color.RGBA{uint8(x * 32), 64, uint8(z * 32), 255})
+			if x < 2 && z >= 6 {
+				set(x, 5, z, color.RGBA{40, 220, 40, 255})
+			}
+		}
+	}
+
+	info := &trace.TreeInfo{Depth: depth, VoxelsPerAxis: 1 << depth, Bounds: pack.Box{Pos: pack.Point{X: 100, Y: 0, Z: 200}, Size: 50}}
+	return tree.Octree(), info
+}
+
+func newTestServer(t *testing.T, cache *tileCache) *tileServer {
+	tree, info := testTree()
+	server, err := newTileServer(tree, info, testTileSize, 4, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func getTile(t *testing.T, server *tileServer, path string) []byte {
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: status %d", path, rec.Code)
+	}
+	return rec.Body.Bytes()
+}
+
+func decodeTile(t *testing.T, data []byte) *image.RGBA {
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewRGBA(decoded.Bounds())
+	draw.Draw(img, img.Bounds(), decoded, image.ZP, draw.Src)
+	return img
+}
+
+func TestTileGolden(t *testing.T) {
+	server := newTestServer(t, nil)
+	data := getTile(t, server, "/tiles/1/0/1.png")
+
+	golden := filepath.Join("testdata", "tile-1-0-1.png")
+	if *updateGolden {
+		if err := ioutil.WriteFile(golden, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, want := decodeTile(t, data), decodeTile(t, expected)
+	if img.Rect != image.Rect(0, 0, testTileSize, testTileSize) || !bytes.Equal(img.Pix, want.Pix) {
+		t.Error("tile differs from the golden tile")
+	}
+
+	// The tower is in the lower left quarter of the tile and lit brighter than the floor.
+	if c := img.RGBAAt(2, 10); c.G < 150 || c.A != 255 {
+		t.Errorf("expected the tower at 2, 10, got %v", c)
+	}
+	if c := img.RGBAAt(12, 2); c.A != 255 || c.G >= 64 {
+		t.Errorf("expected the shaded floor at 12, 2, got %v", c)
+	}
+}
+
+func TestTileOutOfBounds(t *testing.T) {
+	server := newTestServer(t, nil)
+	for _, path := range []string{"/tiles/1/2/0.png", "/tiles/2/0/-1.png", "/tiles/0/1/0.png"} {
+		img := decodeTile(t, getTile(t, server, path))
+		if img.Rect.Dx() != testTileSize || img.Rect.Dy() != testTileSize {
+			t.Errorf("%s: unexpected size %v", path, img.Rect)
+		}
+		for i := 3; i < len(img.Pix); i += 4 {
+			if img.Pix[i] != 0 {
+				t.Fatalf("%s: tile is not transparent", path)
+			}
+		}
+	}
+
+	if server.renders != 0 {
+		t.Errorf("%d tiles outside of the tree were rendered", server.renders)
+	}
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("GET", "/tiles/5/0/0.png", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected zoom levels beyond the max to be missing, got %d", rec.Code)
+	}
+}
+
+func TestTileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "octtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := openTileCache(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestServer(t, cache)
+
+	first := getTile(t, server, "/tiles/1/1/1.png")
+	if second := getTile(t, server, "/tiles/1/1/1.png"); !bytes.Equal(first, second) || server.renders != 1 {
+		t.Errorf("cached tile was rendered again, %d renders", server.renders)
+	}
+
+	// The cache outlives the server.
+	if cache, err = openTileCache(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	server = newTestServer(t, cache)
+	if cached := getTile(t, server, "/tiles/1/1/1.png"); !bytes.Equal(first, cached) || server.renders != 0 {
+		t.Errorf("tile was not served from the disk cache, %d renders", server.renders)
+	}
+
+	getTile(t, server, "/tiles/1/0/0.png")
+	getTile(t, server, "/tiles/1/0/1.png")
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+tileExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("expected 2 cached tiles, got %d", len(files))
+	}
+	if _, ok := cache.get("16-1-1-1"); ok {
+		t.Error("least recently used tile was not evicted")
+	}
+}
+
+func TestTileBounds(t *testing.T) {
+	server := newTestServer(t, nil)
+
+	var bounds tileBounds
+	if err := json.Unmarshal(getTile(t, server, "/tiles.json"), &bounds); err != nil {
+		t.Fatal(err)
+	}
+	if bounds.Bounds != [4]float64{100, 200, 150, 250} || bounds.TileSize != testTileSize {
+		t.Errorf("unexpected bounds %+v", bounds)
+	}
+}
+
+func TestTilePick(t *testing.T) {
+	server := newTestServer(t, nil)
+	server.info.GeoReference = &pack.GeoReference{CRS: "EPSG:32633", Origin: [3]float64{500000, 0, 6000000}, Scale: [3]float64{1, 1, 1}}
+
+	var bounds tileBounds
+	if err := json.Unmarshal(getTile(t, server, "/tiles.json"), &bounds); err != nil {
+		t.Fatal(err)
+	}
+	if bounds.CRS != "EPSG:32633" {
+		t.Errorf("unexpected CRS %q", bounds.CRS)
+	}
+
+	// The first pixel of zoom level zero sees the top of the tower, which is
+	// six voxels of 6.25 world units up.
+	var pick tilePick
+	if err := json.Unmarshal(getTile(t, server, "/pick/0/0/0/0/15"), &pick); err != nil {
+		t.Fatal(err)
+	}
+	const pixel = 50.0 / testTileSize
+	expected := [3]float64{500000 + 100 + pixel/2, 37.5, 6000000 + 200 + 15.5*pixel}
+	for i := range expected {
+		if d := pick.Position[i] - expected[i]; !pick.Hit || d < -1e-3 || d > 1e-3 {
+			t.Fatalf("expected a hit at %v, got %+v", expected, pick)
+		}
+	}
+	if pick.Color != [3]uint8{40, 220, 40} {
+		t.Errorf("expected the tower, got %v", pick.Color)
+	}
+
+	if err := json.Unmarshal(getTile(t, server, "/pick/0/1/0/0/0"), &pick); err != nil || pick.Hit {
+		t.Errorf("expected a miss outside of the tree, got %+v", pick)
+	}
+}
+
+// blockingReaderAt waits for resume before every read.
+type blockingReaderAt chan struct{}
+
+func (r blockingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	<-r
+	return len(p), nil
+}
+
+func TestTileWarmUp(t *testing.T) {
+	server := newTestServer(t, nil)
+	resume := make(blockingReaderAt)
+	server.warm = trace.StartWarmUp(resume, &trace.HotSet{BlockSize: 16, Ranges: [][2]int64{{0, 4}}}, 0.5)
+
+	var bounds tileBounds
+	if err := json.Unmarshal(getTile(t, server, "/tiles.json"), &bounds); err != nil || bounds.Ready {
+		t.Fatal("expected the tree not to be ready")
+	}
+
+	rendered := make(chan []byte)
+	go func() {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest("GET", "/tiles/0/0/0.png", nil))
+		rendered <- rec.Body.Bytes()
+	}()
+
+	resume <- struct{}{}
+	select {
+	case <-rendered:
+		t.Fatal("tile was rendered before the tree was ready")
+	default:
+	}
+	resume <- struct{}{}
+	if data := <-rendered; len(data) == 0 {
+		t.Error("expected a tile once the tree is ready")
+	}
+
+	metrics := string(getTile(t, server, "/metrics"))
+	if !strings.Contains(metrics, "octtiles_warmup_blocks_total 4\n") || !strings.Contains(metrics, "octtiles_ready 1\n") {
+		t.Errorf("unexpected metrics:\n%s", metrics)
+	}
+
+	server.warm.Stop()
+	close(resume)
+	<-server.warm.Done()
+}
@@ -19,13 +19,18 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"math"
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
 	"github.com/andreas-jonsson/octatron/go3d/float64/mat4"
 	"github.com/andreas-jonsson/octatron/go3d/float64/vec3"
@@ -48,7 +53,7 @@ func (s *xyzSample) Position() pack.Point {
 func assert(err error) {
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(-1)
+		os.Exit(pack.ExitCode(err))
 	}
 }
 
@@ -62,17 +67,28 @@ var formatLookup = map[string]pack.OctreeFormat{
 	"MipR4G4B4A4PackUI30": pack.MipR4G4B4A4PackUI30,
 	"MipR5G6B5PackUI30":   pack.MipR5G6B5PackUI30,
 	"MipR3G3B2PackUI31":   pack.MipR3G3B2PackUI31,
+
+	"MipR8G8B8A8RelativeUI16": pack.MipR8G8B8A8RelativeUI16,
+	"MipR8G8B8A8DeltaUI32":    pack.MipR8G8B8A8DeltaUI32,
+	"MipR8G8B8A8UnpackUI64":   pack.MipR8G8B8A8UnpackUI64,
+	"MipR8G8B8A8FlagsUI32":    pack.MipR8G8B8A8FlagsUI32,
 }
 
 var arguments struct {
 	format, input, output     string
 	rotate, translate, bounds string
-
-	vpa       int
-	threshold float64
-
-	reflectComponent, compress bool
-	optimize, filter, dryRun   bool
+	previewOut, gain, sidecar string
+	coordinates, statsOut     string
+	crs, geoOrigin, geoScale  string
+
+	vpa, estimateLevels, outliers, restarts int
+	chunkSize, epoch, parallelism           int
+	threshold, variance, outlierRadius      float64
+	preview, dedup                          float64
+
+	reflectComponent, compress, checksum bool
+	optimize, filter, dryRun, estimate   bool
+	levels, verbose                      bool
 }
 
 func init() {
@@ -85,25 +101,87 @@ func init() {
 	flag.StringVar(&arguments.bounds, "bounds", "0,0,0,1", "octree bounding-box X,Y,Z,SIZE")
 	flag.StringVar(&arguments.input, "input", "cloud.xyz", "input files \"cloud0.xyz,cloud1.xyz\"")
 	flag.StringVar(&arguments.output, "output", "tree.oct", "")
+	flag.StringVar(&arguments.previewOut, "preview-out", "preview.png", "image written by -preview")
+	flag.StringVar(&arguments.sidecar, "sidecar", "", "write the sample count and input files of each leaf to this file")
+	flag.StringVar(&arguments.statsOut, "stats-out", "", "write color histograms, extent and voxel counts of sampled points to this JSON file")
 
+	flag.StringVar(&arguments.gain, "gain", "", "per input color gain \"R,G,B;R,G,B\", to white balance inputs")
 	flag.StringVar(&arguments.rotate, "rotate", "0,0,0", "YAW,PITCH,ROLL")
 	flag.StringVar(&arguments.translate, "translate", "0,0,0", "X,Y,Z")
+	flag.StringVar(&arguments.coordinates, "coordinates", "y-up-rh", "convention of the input and bounds: y-up-rh, z-up-rh or z-up-lh")
+	flag.StringVar(&arguments.crs, "crs", "", "coordinate reference system of the input, like EPSG:32633, recorded in the tree")
+	flag.StringVar(&arguments.geoOrigin, "geo-origin", "", "CRS position X,Y,Z of the input origin, for inputs stored relative to an offset")
+	flag.StringVar(&arguments.geoScale, "geo-scale", "1,1,1", "CRS units per input unit X,Y,Z")
 
 	flag.IntVar(&arguments.vpa, "vpa", 64, "voxels per axis")
+	flag.IntVar(&arguments.chunkSize, "chunk-size", 0, "write the tree to chunk files of this many MiB, output is their JSON manifest")
+	flag.IntVar(&arguments.estimateLevels, "estimate-levels", 6, "levels counted by -estimate")
+	flag.IntVar(&arguments.parallelism, "parallelism", 0, "input files parsed at once with -sidecar, the number of cores if zero")
+	flag.IntVar(&arguments.epoch, "epoch", 0, "epoch of the scan, stored with each leaf of the -sidecar")
 	flag.Float64Var(&arguments.threshold, "threshold", 0.25, "color-filter threshold")
+	flag.Float64Var(&arguments.variance, "variance", 0, "make solid nodes with lower color variance leafs")
+	flag.Float64Var(&arguments.preview, "preview", 0, "render the partially built tree every this many seconds")
+	flag.IntVar(&arguments.restarts, "restarts", 0, "restart the build this many times if an input file changes")
+	flag.IntVar(&arguments.outliers, "outliers", 0, "drop isolated leafs with fewer samples")
+	flag.Float64Var(&arguments.outlierRadius, "outlier-radius", 0, "distance in voxels searched for neighbors by -outliers, adjacent voxels if zero")
+	flag.Float64Var(&arguments.dedup, "dedup", 0, "merge points closer than this distance in the same voxel")
 
 	flag.BoolVar(&arguments.compress, "compress", false, "use data compression")
+	flag.BoolVar(&arguments.checksum, "checksum", false, "append checksums to detect corrupted files")
 	flag.BoolVar(&arguments.optimize, "optimize", true, "optimize tree")
 	flag.BoolVar(&arguments.filter, "filter", true, "apply color-filter")
 	flag.BoolVar(&arguments.reflectComponent, "reflect", true, "reflection component")
 	flag.BoolVar(&arguments.dryRun, "dry", false, "dry-run, parses and transform cloud")
+	flag.BoolVar(&arguments.estimate, "estimate", false, "estimate tree size without writing output")
+	flag.BoolVar(&arguments.levels, "levels", false, "print the time spent on every level of the tree")
+	flag.BoolVar(&arguments.verbose, "verbose", false, "log the workers and cells of the build as they start and finish")
 }
 
-func main() {
-	flag.Parse()
+// importVox converts a MagicaVoxel file, the voxels of the model are used as is.
+func importVox(file string) {
+	infile, err := os.Open(file)
+	assert(err)
+	defer infile.Close()
 
 	outfile, err := os.Create(arguments.output)
 	assert(err)
+	defer outfile.Close()
+
+	err = pack.ImportVox(bufio.NewReader(infile), outfile, formatLookup[arguments.format])
+	if skipped, ok := err.(*pack.ErrVoxModelsSkipped); ok {
+		fmt.Println("Warning:", skipped)
+	} else {
+		assert(err)
+	}
+}
+
+// parseGains returns the color gain of each input, one R,G,B triple per input
+// separated by semicolons. Inputs have no gain if gain is empty.
+func parseGains(gain string, numInputs int) ([]pack.ColorGain, error) {
+	gains := make([]pack.ColorGain, numInputs)
+	if gain == "" {
+		for i := range gains {
+			gains[i] = pack.ColorGain{1, 1, 1}
+		}
+		return gains, nil
+	}
+
+	fields := strings.Split(gain, ";")
+	if len(fields) != numInputs {
+		return nil, fmt.Errorf("expected %d gains, one per input, got %d", numInputs, len(fields))
+	}
+
+	for i, f := range fields {
+		g := &gains[i]
+		if _, err := fmt.Sscanf(f, "%f,%f,%f", &g[0], &g[1], &g[2]); err != nil {
+			return nil, fmt.Errorf("invalid gain %q: %v", f, err)
+		}
+	}
+	return gains, nil
+}
+
+func main() {
+	flag.Parse()
 
 	var (
 		yaw, pitch, roll float64
@@ -118,65 +196,83 @@ func main() {
 
 	inputFiles := strings.Split(arguments.input, ",")
 	numFiles := len(inputFiles)
+
+	if numFiles == 1 && strings.ToLower(path.Ext(inputFiles[0])) == ".vox" {
+		importVox(inputFiles[0])
+		return
+	}
+	gains, err := parseGains(arguments.gain, numFiles)
+	assert(err)
+
 	box := pack.Box{pack.Point{math.MaxFloat64, math.MaxFloat64, math.MaxFloat64}, -math.MaxFloat64}
 
-	parser := func(samples chan<- pack.Sample) error {
-		for num, file := range inputFiles {
-			infile, err := os.Open(file)
-			assert(err)
-			defer infile.Close()
-
-			var reads int64
-			size, _ := infile.Seek(0, 2)
-			infile.Seek(0, 0)
-
-			scanner := bufio.NewScanner(infile)
-			progress := -1
-
-			var (
-				s       pack.Sample
-				r, g, b byte
-			)
-
-			for scanner.Scan() {
-				text := scanner.Text()
-
-				var ref float64
-				if arguments.reflectComponent {
-					_, err := fmt.Sscan(text, &s.Pos.X, &s.Pos.Y, &s.Pos.Z, &ref, &r, &g, &b)
-					assert(err)
-				} else {
-					_, err := fmt.Sscan(text, &s.Pos.X, &s.Pos.Y, &s.Pos.Z, &r, &g, &b)
-					assert(err)
-				}
-
-				s.Col.R = float32(r) / 255
-				s.Col.G = float32(g) / 255
-				s.Col.B = float32(b) / 255
-				s.Col.A = 1
-
-				v := vec3.T{s.Pos.X, s.Pos.Y, s.Pos.Z}
-				mat.TransformVec3(&v)
-				s.Pos = pack.Point{v[0], v[1], v[2]}
-
-				box.Pos.X = math.Min(box.Pos.X, s.Pos.X)
-				box.Pos.Y = math.Min(box.Pos.Y, s.Pos.Y)
-				box.Pos.Z = math.Min(box.Pos.Z, s.Pos.Z)
-				box.Size = math.Max(math.Max(math.Max(s.Pos.X, s.Pos.Y), s.Pos.Z), box.Size) - math.Max(math.Max(box.Pos.X, box.Pos.Y), box.Pos.Z)
-
-				reads += int64(len(text) + 1)
-				p := int((float64(reads) / float64(size)) * 100)
-				if p > progress {
-					progress = p
-					fmt.Printf("\rProgress: %v%% (%v/%v)", p, num+1, numFiles)
-				}
-
-				if !arguments.dryRun {
-					samples <- s
-				}
+	// The files of a sidecar build are parsed at once.
+	var boxLock sync.Mutex
+
+	parseFile := func(num int, samples chan<- pack.Sample) error {
+		infile, err := os.Open(inputFiles[num])
+		assert(err)
+		defer infile.Close()
+
+		var reads int64
+		size, _ := infile.Seek(0, 2)
+		infile.Seek(0, 0)
+
+		scanner := bufio.NewScanner(infile)
+		progress := -1
+
+		var (
+			s       pack.Sample
+			r, g, b byte
+		)
+
+		for scanner.Scan() {
+			text := scanner.Text()
+
+			var ref float64
+			if arguments.reflectComponent {
+				_, err := fmt.Sscan(text, &s.Pos.X, &s.Pos.Y, &s.Pos.Z, &ref, &r, &g, &b)
+				assert(err)
+			} else {
+				_, err := fmt.Sscan(text, &s.Pos.X, &s.Pos.Y, &s.Pos.Z, &r, &g, &b)
+				assert(err)
 			}
 
-			if err := scanner.Err(); err != nil {
+			s.Col.R = float32(r) / 255
+			s.Col.G = float32(g) / 255
+			s.Col.B = float32(b) / 255
+			s.Col.A = 1
+			s.Col = gains[num].TransformColor(s.Col)
+
+			v := vec3.T{s.Pos.X, s.Pos.Y, s.Pos.Z}
+			mat.TransformVec3(&v)
+			s.Pos = pack.Point{X: v[0], Y: v[1], Z: v[2]}
+
+			boxLock.Lock()
+			box.Pos.X = math.Min(box.Pos.X, s.Pos.X)
+			box.Pos.Y = math.Min(box.Pos.Y, s.Pos.Y)
+			box.Pos.Z = math.Min(box.Pos.Z, s.Pos.Z)
+			box.Size = math.Max(math.Max(math.Max(s.Pos.X, s.Pos.Y), s.Pos.Z), box.Size) - math.Max(math.Max(box.Pos.X, box.Pos.Y), box.Pos.Z)
+			boxLock.Unlock()
+
+			reads += int64(len(text) + 1)
+			p := int((float64(reads) / float64(size)) * 100)
+			if p > progress {
+				progress = p
+				fmt.Printf("\rProgress: %v%% (%v/%v)", p, num+1, numFiles)
+			}
+
+			if !arguments.dryRun {
+				samples <- s
+			}
+		}
+
+		return scanner.Err()
+	}
+
+	parser := func(samples chan<- pack.Sample) error {
+		for num := range inputFiles {
+			if err := parseFile(num, samples); err != nil {
 				return err
 			}
 		}
@@ -194,20 +290,118 @@ func main() {
 	var bounds pack.Box
 	fmt.Sscanf(arguments.bounds, "%f,%f,%f,%f", &bounds.Pos.X, &bounds.Pos.Y, &bounds.Pos.Z, &bounds.Size)
 
+	coords, err := pack.ParseCoordinateSystem(arguments.coordinates)
+	assert(err)
+
 	cfg := pack.BuildConfig{
 		Worker:         parser,
-		Writer:         outfile,
 		Bounds:         bounds,
+		Coordinates:    coords,
 		VoxelsPerAxis:  arguments.vpa,
 		Format:         formatLookup[arguments.format],
 		Optimize:       arguments.optimize,
 		ColorFilter:    arguments.filter,
 		ColorThreshold: float32(arguments.threshold),
+
+		ColorVarianceThreshold: float32(arguments.variance),
+		OutlierFilter:          pack.OutlierFilter{MinNeighbors: arguments.outliers, Radius: float32(arguments.outlierRadius)},
+		DedupRadius:            arguments.dedup,
+		Checksum:               arguments.checksum,
+		Source:                 pack.FileSource(inputFiles),
+		RestartOnChange:        arguments.restarts,
+		LevelStats:             arguments.levels,
+	}
+
+	if arguments.verbose {
+		cfg.Logger = pack.StdLogger(log.New(os.Stderr, "", log.LstdFlags), pack.LogDebug)
+	}
+
+	if arguments.crs != "" || arguments.geoOrigin != "" {
+		geo := &pack.GeoReference{CRS: arguments.crs}
+		fmt.Sscanf(arguments.geoOrigin, "%f,%f,%f", &geo.Origin[0], &geo.Origin[1], &geo.Origin[2])
+		fmt.Sscanf(arguments.geoScale, "%f,%f,%f", &geo.Scale[0], &geo.Scale[1], &geo.Scale[2])
+		cfg.GeoReference = geo
+	}
+
+	if arguments.estimate {
+		cfg.DryRun = true
+		cfg.EstimateLevels = arguments.estimateLevels
+
+		status, err := pack.BuildTree(&cfg)
+		assert(err)
+
+		est := status.Estimate
+		fmt.Printf("Samples: %v\n", est.Samples)
+		for level, n := range est.Levels {
+			kind := "counted"
+			if level >= est.Counted {
+				kind = "estimated"
+			}
+			fmt.Printf("Level %v: %v nodes (%v)\n", level, n, kind)
+		}
+		fmt.Printf("Nodes: %v, leafs: %v\n", est.NumNodes, est.NumLeafs)
+		fmt.Printf("Size: %v bytes (%.1f MiB), before optimization and compression\n", est.Bytes, float64(est.Bytes)/(1<<20))
+		return
+	}
+
+	var outfile *os.File
+	if arguments.chunkSize > 0 {
+		if arguments.compress {
+			assert(errors.New("chunked trees can not be compressed"))
+		}
+		cfg.ChunkPath = arguments.output
+		cfg.ChunkSize = int64(arguments.chunkSize) << 20
+	} else {
+		outfile, err = os.Create(arguments.output)
+		assert(err)
+		cfg.Writer = outfile
+	}
+
+	if arguments.sidecar != "" {
+		sidecar, err := os.Create(arguments.sidecar)
+		assert(err)
+		defer sidecar.Close()
+
+		// The inputs are separate workers so the sidecar can tell them apart.
+		for num := range inputFiles {
+			num := num
+			cfg.Workers = append(cfg.Workers, func(samples chan<- pack.Sample) error {
+				return parseFile(num, samples)
+			})
+		}
+		cfg.Parallelism = arguments.parallelism
+		cfg.Sidecar = sidecar
+		cfg.SidecarFormat = pack.SidecarText
+		cfg.Epoch = uint16(arguments.epoch)
+	}
+
+	var stats *pack.SampleStats
+	if arguments.statsOut != "" {
+		stats = pack.NewSampleStats(bounds, arguments.vpa)
+		cfg.SampleObserver = stats
+	}
+
+	if arguments.preview > 0 {
+		cfg.Preview = writePreview
+		cfg.PreviewInterval = time.Duration(arguments.preview * float64(time.Second))
 	}
 
 	status, err := pack.BuildTree(&cfg)
 	assert(err)
+
+	levels := status.Levels
+	status.Levels = nil
 	fmt.Println("Status:", status)
+	if levels != nil {
+		printLevels(levels)
+	}
+
+	if stats != nil {
+		statsFile, err := os.Create(arguments.statsOut)
+		assert(err)
+		assert(stats.WriteJSON(statsFile))
+		assert(statsFile.Close())
+	}
 
 	if arguments.compress {
 		fmt.Println("Compressing...")
@@ -225,7 +419,17 @@ func main() {
 
 		assert(os.Remove(arguments.output))
 		assert(os.Rename(zipfilePath, arguments.output))
-	} else {
+	} else if outfile != nil {
 		outfile.Close()
 	}
 }
+
+// printLevels prints a table of the work done on every level of the tree.
+func printLevels(levels []pack.LevelStats) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Level\tCells\tWorker\tSamples\tSampling\tNodes\tBytes\tWriting\t")
+	for depth, l := range levels {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t\n", depth, l.NumCells, l.WorkerTime, l.NumSamples, l.SampleTime, l.NumNodes, l.NumBytes, l.WriteTime)
+	}
+	w.Flush()
+}
@@ -0,0 +1,81 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+// previewSize is the width and height of preview images.
+const previewSize = 512
+
+// writePreview renders a snapshot of the tree being built. The image is renamed
+// into place so viewers never see a partial file. Errors are only printed, a
+// failed preview does not stop the build.
+func writePreview(snapshot []byte) {
+	if err := renderPreview(snapshot, arguments.previewOut); err != nil {
+		fmt.Fprintln(os.Stderr, "\npreview:", err)
+	}
+}
+
+func renderPreview(snapshot []byte, out string) error {
+	tree, info, err := trace.LoadOctreeWithInfo(bytes.NewReader(snapshot))
+	if err != nil {
+		return err
+	}
+
+	rect := image.Rect(0, 0, previewSize, previewSize)
+	cfg := trace.Config{
+		FieldOfViewDegrees: 45,
+		Images:             [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+	cfg.FitTree(info)
+	cfg.ViewDist = 4 * cfg.TreeScale
+
+	raytracer := trace.NewRaytracer(cfg)
+	defer raytracer.Close()
+
+	camera := trace.FrameTree(info, trace.Vec3{1, -1, -1})
+	raytracer.SetClearColor(color.RGBA{0, 0, 0, 255})
+	img := raytracer.Image(raytracer.Trace(&camera, tree, info.Depth))
+
+	fp, err := ioutil.TempFile(path.Dir(out), "")
+	if err != nil {
+		return err
+	}
+
+	err = png.Encode(fp, img)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fp.Name(), out)
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+	}
+	return err
+}
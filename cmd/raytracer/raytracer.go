@@ -21,6 +21,9 @@ import (
 	"flag"
 	"fmt"
 	"image"
+	"image/color"
+	"image/png"
+	"math"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -30,6 +33,7 @@ import (
 	"unsafe"
 
 	"github.com/andreas-jonsson/octatron/trace"
+	"github.com/andreas-jonsson/octatron/trace/scene"
 	"github.com/veandco/go-sdl2/sdl"
 )
 
@@ -43,21 +47,31 @@ var arguments struct {
 	ppm,
 	pprof,
 	multiThreaded,
+	autoExposure,
 	enableJitter bool
 
 	fieldOfView int
+	reload      uint
 	viewDistance,
-	treeScale float64
+	treeScale,
+	maxFPS float64
 
 	windowSize,
 	resolution,
 	treePosition,
 	scaleFilter,
+	panorama,
+	sceneFile,
 	inputFile string
 }
 
 var (
 	enableInput = true
+	showCost    = false
+	showGrid    = false
+
+	// wireframe is the depth of the debug wireframe, -1 when it is hidden.
+	wireframe = -1
 
 	screenWidth,
 	screenHeight,
@@ -115,6 +129,35 @@ func writePPM(img image.Image) {
 	os.Stdout.Sync()
 }
 
+// writePanorama renders an equirectangular panorama around camera, twice as wide
+// as it is high, and saves it as a PNG file.
+func writePanorama(file string, camera trace.Camera, tree trace.Octree, maxDepth int, pos trace.Vec3, height int) error {
+	rect := image.Rect(0, 0, height*2, height)
+
+	raytracer := trace.NewRaytracer(trace.Config{
+		Projection:    trace.Panorama,
+		TreeScale:     float32(arguments.treeScale),
+		TreePosition:  pos,
+		ViewDist:      float32(arguments.viewDistance),
+		Images:        [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		MultiThreaded: arguments.multiThreaded,
+	})
+	defer raytracer.Close()
+
+	img := raytracer.Image(raytracer.Trace(camera, tree, maxDepth))
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+
+	fp, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	return png.Encode(fp, img)
+}
+
 func init() {
 	runtime.LockOSThread()
 
@@ -124,17 +167,22 @@ func init() {
 	}
 
 	flag.StringVar(&arguments.inputFile, "tree", "tree.oct", "path to .oct file.")
+	flag.StringVar(&arguments.sceneFile, "scene", "", "scene file, its first tree replaces -tree, -pos and -scale and the others are drawn next to it")
 	flag.StringVar(&arguments.treePosition, "pos", "0,0,0", "octree position in world")
 	flag.StringVar(&arguments.scaleFilter, "filter", "linear", "used to scale image")
 	flag.StringVar(&arguments.windowSize, "window", "640,360", "window size")
 	flag.StringVar(&arguments.resolution, "resolution", "640,360", "back-buffer size")
-	flag.IntVar(&arguments.fieldOfView, "fov", 45, "camera field-of-view")
+	flag.IntVar(&arguments.fieldOfView, "fov", 45, "camera field-of-view in degrees")
 	flag.Float64Var(&arguments.viewDistance, "dist", 1, "max view-distance")
 	flag.Float64Var(&arguments.treeScale, "scale", 1, "octree scale")
 	flag.BoolVar(&arguments.enableJitter, "jitter", true, "enables frame jitter")
 	flag.BoolVar(&arguments.multiThreaded, "mt", true, "enables multi-threading")
+	flag.BoolVar(&arguments.autoExposure, "auto-exposure", false, "adapts the exposure to the brightness of the view")
 	flag.BoolVar(&arguments.pprof, "pprof", false, "enables cpu profiler and pprof over http, port 6060")
 	flag.BoolVar(&arguments.ppm, "ppm", false, "write ppm-stream to stdout")
+	flag.StringVar(&arguments.panorama, "panorama", "", "write a 360 degree panorama png and exit")
+	flag.UintVar(&arguments.reload, "reload", 2, "seconds between checks for a changed tree, 0 to disable")
+	flag.Float64Var(&arguments.maxFPS, "fps", 0, "max frames per second, 0 for unlimited")
 }
 
 func main() {
@@ -143,18 +191,43 @@ func main() {
 	fmt.Sscanf(arguments.windowSize, "%d,%d", &screenWidth, &screenHeight)
 	fmt.Sscanf(arguments.resolution, "%d,%d", &resolutionX, &resolutionY)
 
-	fp, err := os.Open(arguments.inputFile)
-	if err != nil {
+	// The first tree of the scene is traced and reloaded, the others are drawn as
+	// instances.
+	var sc *scene.Scene
+	if arguments.sceneFile != "" {
+		var err error
+		if sc, err = scene.Load(arguments.sceneFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+
+		first := sc.Instances[0]
+		arguments.inputFile = first.File
+		arguments.treePosition = fmt.Sprintf("%v,%v,%v", first.Position[0], first.Position[1], first.Position[2])
+		arguments.treeScale = float64(first.Scale)
+		if sc.Config.ViewDist > 0 {
+			arguments.viewDistance = float64(sc.Config.ViewDist)
+		}
+	}
+
+	loaded, err := loadTree(arguments.inputFile)
+	if os.IsNotExist(err) {
 		fmt.Fprintln(os.Stderr, err)
 		return
+	} else if err != nil {
+		panic(err)
 	}
-	defer fp.Close()
+	tree, maxDepth := loaded.tree, loaded.maxDepth
 
-	tree, vpa, err := trace.LoadOctree(fp)
-	if err != nil {
-		panic(err)
+	var pos [3]float32
+	fmt.Sscanf(arguments.treePosition, "%f,%f,%f", &pos[0], &pos[1], &pos[2])
+
+	if arguments.panorama != "" {
+		if err := writePanorama(arguments.panorama, &trace.FreeFlightCamera{}, tree, maxDepth, pos, resolutionY); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return
 	}
-	maxDepth := trace.TreeWidthToDepth(vpa)
 
 	sdl.Init(sdl.INIT_EVERYTHING)
 	defer sdl.Quit()
@@ -184,6 +257,7 @@ func main() {
 
 	surfaces := [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}
 	backBuffer := image.NewRGBA(image.Rect(0, 0, resolutionX, resolutionY))
+	costImage := image.NewRGBA(rect)
 
 	texture, err := renderer.CreateTexture(sdl.PIXELFORMAT_ABGR8888, sdl.TEXTUREACCESS_STREAMING, resolutionX, resolutionY)
 	if err != nil {
@@ -191,25 +265,63 @@ func main() {
 	}
 	defer texture.Destroy()
 
-	var pos [3]float32
-	fmt.Sscanf(arguments.treePosition, "%f,%f,%f", &pos[0], &pos[1], &pos[2])
-
 	cfg := trace.Config{
-		FieldOfView:   float32(arguments.fieldOfView),
-		TreeScale:     float32(arguments.treeScale),
-		TreePosition:  pos,
-		ViewDist:      float32(arguments.viewDistance),
-		Images:        surfaces,
-		Jitter:        arguments.enableJitter,
-		MultiThreaded: arguments.multiThreaded,
-		Depth:         enableDepthTest,
+		FieldOfViewDegrees: float32(arguments.fieldOfView),
+		TreeScale:          float32(arguments.treeScale),
+		TreePosition:       pos,
+		ViewDist:           float32(arguments.viewDistance),
+		Images:             surfaces,
+		Jitter:             arguments.enableJitter,
+		MultiThreaded:      arguments.multiThreaded,
+		Depth:              enableDepthTest,
+		AutoExposure:       arguments.autoExposure,
+	}
+
+	if sc != nil {
+		cfg.Fog = sc.Config.Fog
+		cfg.GroundPlane = sc.Config.GroundPlane
+		cfg.SurfaceShader = sc.Config.SurfaceShader
+		cfg.Instances = sc.Config.Instances
+	}
+
+	if err := cfg.Validate(); err != nil {
+		panic(err)
 	}
 
 	raytracer := trace.NewRaytracer(cfg)
 	defer raytracer.Close()
+	raytracer.SetTree(tree, maxDepth)
+
+	reloaded := make(chan loadedTree)
+	if arguments.reload > 0 {
+		go watchTree(arguments.inputFile, loaded.stamp, time.Duration(arguments.reload)*time.Second, reloaded)
+	}
 
 	camera := trace.FreeFlightCamera{XRot: 0, YRot: 0}
 
+	// Tab cycles through the cameras of the scene.
+	var sceneCamera int
+	if sc != nil && len(sc.Cameras) > 0 {
+		camera = sc.Cameras[0].FreeFlightCamera
+	}
+
+	// A still view is traced until both images of a jittered frame are done, and
+	// then presented again without tracing. Profiling and auto exposure, which
+	// adapts over frames, always trace.
+	var (
+		tracedCamera trace.FreeFlightCamera
+		numStill     int
+		needed       = 1
+	)
+	if arguments.enableJitter {
+		needed = 2
+	}
+	if arguments.pprof || arguments.autoExposure {
+		needed = math.MaxInt32
+	}
+
+	pacer := trace.NewFramePacer(arguments.maxFPS)
+
 	nf := 0
 	dt := time.Duration(1000 / 60)
 	ft := time.Duration(nf)
@@ -230,9 +342,20 @@ func main() {
 	}
 
 	for {
+		pacer.Wait()
 		t := time.Now()
 		dtf := float32(dt / time.Millisecond)
 
+		select {
+		case loaded := <-reloaded:
+			// The frame in flight finishes with the old tree, it is dropped after.
+			raytracer.SetTree(loaded.tree, loaded.maxDepth)
+			maxDepth = loaded.maxDepth
+			numStill = 0
+			fmt.Fprintln(os.Stderr, "reloaded tree:", arguments.inputFile)
+		default:
+		}
+
 		for event := sdl.PollEvent(); event != nil; event = sdl.PollEvent() {
 			switch t := event.(type) {
 			case *sdl.QuitEvent:
@@ -252,9 +375,41 @@ func main() {
 					if !arguments.ppm {
 						fmt.Println("Camera:", camera)
 					}
+				case sdl.K_TAB:
+					if sc != nil && len(sc.Cameras) > 0 {
+						sceneCamera = (sceneCamera + 1) % len(sc.Cameras)
+						camera = sc.Cameras[sceneCamera].FreeFlightCamera
+					}
 				case sdl.K_SPACE:
 					enableInput = !enableInput
 					sdl.SetRelativeMouseMode(enableInput)
+				case sdl.K_h:
+					numStill = 0
+					showCost = !showCost
+					if showCost {
+						raytracer.SetCostImage(costImage)
+					} else {
+						raytracer.SetCostImage(nil)
+					}
+				case sdl.K_g:
+					numStill = 0
+					if wireframe++; wireframe > maxDepth {
+						wireframe = -1
+					}
+					raytracer.SetDebugWireframe(trace.DebugWireframe{
+						Enabled:  wireframe >= 0,
+						MaxDepth: wireframe,
+						Color:    color.RGBA{255, 255, 0, 160},
+					})
+				case sdl.K_x:
+					// The grid has eight lines per tree on the ground plane.
+					numStill = 0
+					showGrid = !showGrid
+					raytracer.SetGridOverlay(trace.GridOverlay{
+						Enabled: showGrid,
+						Spacing: float32(arguments.treeScale) / 8,
+						Color:   color.RGBA{255, 255, 255, 96},
+					})
 				}
 			}
 		}
@@ -267,14 +422,29 @@ func main() {
 				window.WarpMouseInWindow(screenWidth/2, screenHeight/2)
 			}
 
-			if enableDepthTest {
-				raytracer.ClearDepth(raytracer.Frame())
+			if camera != tracedCamera {
+				tracedCamera = camera
+				numStill = 0
 			}
 
-			raytracer.Trace(&camera, tree, maxDepth)
+			if numStill < needed {
+				if enableDepthTest {
+					raytracer.ClearDepth(raytracer.Frame())
+				}
+
+				raytracer.Trace(&camera, nil, 0)
+				numStill++
+			}
 		}
 
-		if arguments.enableJitter {
+		if showCost && arguments.enableJitter {
+			// Both halves of the jittered frames are written to the cost image.
+			if err := trace.Reconstruct(costImage, costImage, backBuffer); err != nil {
+				panic(err)
+			}
+		} else if showCost {
+			backBuffer = costImage
+		} else if arguments.enableJitter {
 			if err := trace.Reconstruct(raytracer.Image(0), raytracer.Image(1), backBuffer); err != nil {
 				panic(err)
 			}
@@ -0,0 +1,96 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+type (
+	// fileStamp identifies a version of a file.
+	fileStamp struct {
+		size    int64
+		modTime time.Time
+	}
+
+	loadedTree struct {
+		tree     trace.Octree
+		maxDepth int
+		stamp    fileStamp
+	}
+)
+
+func stampOf(info os.FileInfo) fileStamp {
+	return fileStamp{info.Size(), info.ModTime()}
+}
+
+func loadTree(file string) (loadedTree, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return loadedTree{}, err
+	}
+	defer fp.Close()
+
+	info, err := fp.Stat()
+	if err != nil {
+		return loadedTree{}, err
+	}
+
+	tree, vpa, err := trace.LoadOctree(fp)
+	if err != nil {
+		return loadedTree{}, err
+	}
+	return loadedTree{tree, trace.TreeWidthToDepth(vpa), stampOf(info)}, nil
+}
+
+// watchTree checks file every interval and sends it on reloaded when it has changed
+// since stamp. The file must be unchanged since the previous check before it is
+// loaded, so trees that are still being written are left alone. Failed loads are
+// tried again by the next check.
+func watchTree(file string, stamp fileStamp, interval time.Duration, reloaded chan<- loadedTree) {
+	var pending fileStamp
+	for range time.Tick(interval) {
+		info, err := os.Stat(file)
+		if err != nil || stampOf(info) == stamp {
+			continue
+		}
+
+		if stampOf(info) != pending {
+			pending = stampOf(info)
+			continue
+		}
+
+		tree, err := loadTree(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "could not reload tree:", err)
+			continue
+		}
+
+		// The file was written again during the load.
+		if tree.stamp != pending {
+			continue
+		}
+
+		stamp = tree.stamp
+		reloaded <- tree
+	}
+}
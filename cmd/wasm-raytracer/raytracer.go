@@ -0,0 +1,263 @@
+// +build js,wasm
+
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"strconv"
+	"sync"
+	"syscall/js"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+const (
+	imgWidth    = 320
+	imgHeight   = 180
+	imgScale    = 2
+	cameraSpeed = 0.02
+	viewDist    = 1
+)
+
+var (
+	keys   = make(map[int]bool)
+	camera = trace.FreeFlightCamera{Pos: trace.Vec3{0.5, 0.5, -0.5}}
+)
+
+func throw(err error) {
+	js.Global().Call("alert", err.Error())
+	panic(err)
+}
+
+func assert(err error) {
+	if err != nil {
+		throw(err)
+	}
+}
+
+// await blocks until the promise is settled.
+func await(promise js.Value) (js.Value, error) {
+	var (
+		result = make(chan js.Value, 1)
+		failed = make(chan error, 1)
+	)
+
+	onResolve := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		result <- args[0]
+		return nil
+	})
+	defer onResolve.Release()
+
+	onReject := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		failed <- errors.New(args[0].Call("toString").String())
+		return nil
+	})
+	defer onReject.Release()
+
+	promise.Call("then", onResolve, onReject)
+
+	select {
+	case v := <-result:
+		return v, nil
+	case err := <-failed:
+		return js.Undefined(), err
+	}
+}
+
+func fetchTree(url string) (trace.Octree, int, error) {
+	response, err := await(js.Global().Call("fetch", url))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !response.Get("ok").Bool() {
+		return nil, 0, errors.New("could not fetch " + url + ": " + response.Get("statusText").String())
+	}
+
+	buffer, err := await(response.Call("arrayBuffer"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	array := js.Global().Get("Uint8Array").New(buffer)
+	data := make([]byte, array.Length())
+	js.CopyBytesToGo(data, array)
+
+	return trace.LoadOctree(bytes.NewReader(data))
+}
+
+func moveCamera() {
+	switch {
+	case keys[38]: // Up
+		camera.YRot += cameraSpeed
+	case keys[40]: // Down
+		camera.YRot -= cameraSpeed
+	case keys[37]: // Left
+		camera.XRot += cameraSpeed
+	case keys[39]: // Right
+		camera.XRot -= cameraSpeed
+	case keys[87]: // W
+		camera.Move(cameraSpeed)
+	case keys[83]: // S
+		camera.Move(-cameraSpeed)
+	case keys[65]: // A
+		camera.Strafe(cameraSpeed)
+	case keys[68]: // D
+		camera.Strafe(-cameraSpeed)
+	case keys[69]: // E
+		camera.Lift(cameraSpeed)
+	case keys[81]: // Q
+		camera.Lift(-cameraSpeed)
+	}
+}
+
+func treeURL() string {
+	params := js.Global().Get("URLSearchParams").New(js.Global().Get("location").Get("search"))
+	if url := params.Call("get", "tree"); url.Truthy() {
+		return url.String()
+	}
+	return "tree.oct"
+}
+
+// patchesURL returns the websocket URL of the patch stream of the tree, empty if the
+// tree is not edited.
+func patchesURL() string {
+	params := js.Global().Get("URLSearchParams").New(js.Global().Get("location").Get("search"))
+	if url := params.Call("get", "patches"); url.Truthy() {
+		return url.String()
+	}
+	return ""
+}
+
+// patchQueue holds the patches received but not applied yet. Callbacks must not
+// block, so they are queued instead of sent on a channel.
+type patchQueue struct {
+	lock    sync.Mutex
+	patches []trace.TreePatch
+}
+
+func (q *patchQueue) push(patch trace.TreePatch) {
+	q.lock.Lock()
+	q.patches = append(q.patches, patch)
+	q.lock.Unlock()
+}
+
+func (q *patchQueue) take() []trace.TreePatch {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	patches := q.patches
+	q.patches = nil
+	return patches
+}
+
+// streamPatches connects to the patch stream at url and queues the patches it
+// receives.
+func streamPatches(url string, queue *patchQueue) {
+	ws := js.Global().Get("WebSocket").New(url)
+	ws.Set("onmessage", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		var msg struct {
+			Patch *trace.TreePatch `json:"patch"`
+		}
+		if err := json.Unmarshal([]byte(args[0].Get("data").String()), &msg); err == nil && msg.Patch != nil {
+			queue.push(*msg.Patch)
+		}
+		return nil
+	}))
+}
+
+func main() {
+	document := js.Global().Get("document")
+
+	document.Set("onkeydown", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		keys[args[0].Get("keyCode").Int()] = true
+		return nil
+	}))
+
+	document.Set("onkeyup", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		keys[args[0].Get("keyCode").Int()] = false
+		return nil
+	}))
+
+	canvas := document.Call("createElement", "canvas")
+	canvas.Call("setAttribute", "width", strconv.Itoa(imgWidth))
+	canvas.Call("setAttribute", "height", strconv.Itoa(imgHeight))
+	canvas.Get("style").Set("width", strconv.Itoa(imgWidth*imgScale)+"px")
+	canvas.Get("style").Set("height", strconv.Itoa(imgHeight*imgScale)+"px")
+	document.Get("body").Call("appendChild", canvas)
+
+	ctx := canvas.Call("getContext", "2d")
+	imgData := ctx.Call("createImageData", imgWidth, imgHeight)
+	pixels := js.Global().Get("Uint8ClampedArray").New(imgWidth * imgHeight * 4)
+
+	url := treeURL()
+	tree, vpa, err := fetchTree(url)
+	assert(err)
+
+	rect := image.Rect(0, 0, imgWidth, imgHeight)
+	cfg := trace.Config{
+		FieldOfViewDegrees: 45,
+		TreeScale:          1,
+		ViewDist:           viewDist,
+		Images:             [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+
+		// There is no parallelism in WASM, a single worker avoids the scheduling overhead.
+		MultiThreaded: false,
+	}
+
+	raytracer := trace.NewRaytracer(cfg)
+	raytracer.SetTree(tree, trace.TreeWidthToDepth(vpa))
+
+	var queue patchQueue
+	if url := patchesURL(); url != "" {
+		streamPatches(url, &queue)
+	}
+
+	var renderFrame js.Func
+	renderFrame = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		// Rendering blocks, so it can't run in the callback.
+		go func() {
+			moveCamera()
+
+			// The previous frame is done, so the tree is patched in place.
+			if patches := queue.take(); len(patches) > 0 {
+				for i := range patches {
+					tree, err = trace.ApplyPatch(tree, &patches[i])
+					assert(err)
+				}
+				raytracer.SetTree(tree, trace.TreeWidthToDepth(vpa))
+			}
+
+			img := raytracer.Image(raytracer.Trace(&camera, nil, 0))
+			js.CopyBytesToJS(pixels, img.Pix)
+			imgData.Get("data").Call("set", pixels)
+			ctx.Call("putImageData", imgData, 0, 0)
+
+			js.Global().Call("requestAnimationFrame", renderFrame)
+		}()
+		return nil
+	})
+
+	js.Global().Call("requestAnimationFrame", renderFrame)
+	select {}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits the number of connection attempts per remote address within a
+// sliding window.
+type rateLimiter struct {
+	lock     sync.Mutex
+	window   time.Duration
+	max      int
+	attempts map[string][]time.Time
+}
+
+func newRateLimiter(max int, window time.Duration) *rateLimiter {
+	return &rateLimiter{window: window, max: max, attempts: make(map[string][]time.Time)}
+}
+
+// allow records an attempt from addr and reports if it is within the limit. A limit
+// of zero disables rate limiting.
+func (l *rateLimiter) allow(addr string, now time.Time) bool {
+	if l.max <= 0 {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	attempts := l.attempts[addr]
+	for len(attempts) > 0 && now.Sub(attempts[0]) >= l.window {
+		attempts = attempts[1:]
+	}
+
+	// Drop addresses that have been quiet for a full window.
+	for a, t := range l.attempts {
+		if len(t) > 0 && now.Sub(t[len(t)-1]) >= l.window {
+			delete(l.attempts, a)
+		}
+	}
+
+	if len(attempts) >= l.max {
+		l.attempts[addr] = attempts
+		return false
+	}
+
+	l.attempts[addr] = append(attempts, now)
+	return true
+}
+
+// remoteHost returns the IP of a remote address without the port.
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// validToken reports if token matches the configured token. Any token is accepted if
+// authentication is disabled.
+func validToken(token string) bool {
+	if config.AuthToken == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(config.AuthToken)) == 1
+}
@@ -0,0 +1,191 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+type testServer struct {
+	*httptest.Server
+	handlers sync.WaitGroup
+}
+
+// Close stops the server and waits for all handlers to return, since they share the
+// global configuration with the next test.
+func (s *testServer) Close() {
+	s.Server.Close()
+	s.handlers.Wait()
+}
+
+// resetServerState sets the global configuration and tree cache used by the tests.
+func resetServerState(token string, maxAttempts int) {
+	config = defaultConfig()
+	config.AuthToken = token
+	clientSlots = nil
+	limiter = newRateLimiter(maxAttempts, time.Minute)
+	memory = newMemoryBudget()
+
+	trees.cache = map[string]*treeData{
+		config.treePath(): {
+			file:      config.treePath(),
+			bookmarks: &bookmarkStore{bookmarks: make(map[string]bookmark)},
+			maxDepth:  1,
+			frames:    []trace.Octree{make(trace.Octree, 1)},
+			infos:     []*trace.TreeInfo{{NumNodes: 1, NumLeafs: 1, VoxelsPerAxis: 1, Depth: 1}},
+		},
+	}
+}
+
+func startTestServer(token string, maxAttempts int) *testServer {
+	resetServerState(token, maxAttempts)
+
+	server := &testServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.handlers.Add(1)
+		defer server.handlers.Done()
+		websocket.Handler(renderServer).ServeHTTP(w, r)
+	}))
+	return server
+}
+
+// dial connects to the server, sends the setup message and returns the first message
+// received. Strings are sent as is.
+func dial(server *testServer, setup interface{}) ([]byte, *websocket.Conn) {
+	ws, err := websocket.Dial("ws"+server.URL[len("http"):], "", "http://localhost/")
+	if err != nil {
+		panic(err)
+	}
+
+	// The server may already have rejected the connection, so the error is ignored
+	// in favour of the message received.
+	if text, ok := setup.(string); ok {
+		websocket.Message.Send(ws, text)
+	} else {
+		websocket.JSON.Send(ws, setup)
+	}
+
+	var data []byte
+	if err := websocket.Message.Receive(ws, &data); err != nil {
+		panic(err)
+	}
+	return data, ws
+}
+
+func testSetup() setupMessage {
+	return setupMessage{Width: 32, Height: 16, FieldOfView: 45, ColorFormat: "RGBA"}
+}
+
+// handshake sends a valid setup message with token and decodes the JSON reply.
+func handshake(server *testServer, token string) (map[string]interface{}, *websocket.Conn) {
+	setup := testSetup()
+	setup.Token = token
+	data, ws := dial(server, setup)
+
+	msg := make(map[string]interface{})
+	if err := json.Unmarshal(data, &msg); err != nil {
+		panic(err)
+	}
+	return msg, ws
+}
+
+func expectClosed(t *testing.T, ws *websocket.Conn) {
+	var data string
+	if err := websocket.Message.Receive(ws, &data); err == nil {
+		t.Error("expected connection to be closed")
+	}
+}
+
+func TestAuthAccepted(t *testing.T) {
+	server := startTestServer("secret", 0)
+	defer server.Close()
+
+	msg, ws := handshake(server, "secret")
+	ws.Close()
+
+	if msg["NumNodes"] != 1.0 {
+		t.Error("expected tree info, got:", msg)
+	}
+}
+
+func TestAuthRejected(t *testing.T) {
+	server := startTestServer("secret", 0)
+	defer server.Close()
+
+	for _, token := range []string{"wrong", ""} {
+		msg, ws := handshake(server, token)
+		if msg["Error"] != unauthorizedError {
+			t.Errorf("expected %s for token %q, got: %v", unauthorizedError, token, msg)
+		}
+
+		expectClosed(t, ws)
+		ws.Close()
+	}
+}
+
+func TestAuthDisabled(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+
+	msg, ws := handshake(server, "")
+	ws.Close()
+
+	if msg["NumNodes"] != 1.0 {
+		t.Error("expected tree info, got:", msg)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	server := startTestServer("secret", 2)
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		msg, ws := handshake(server, "wrong")
+		if msg["Error"] != unauthorizedError {
+			t.Error("expected unauthorized, got:", msg)
+		}
+		ws.Close()
+	}
+
+	// The correct token is rejected as well once the limit is reached.
+	msg, ws := handshake(server, "secret")
+	if msg["Error"] != rateLimitedError {
+		t.Error("expected rate limit, got:", msg)
+	}
+
+	expectClosed(t, ws)
+	ws.Close()
+
+	now := time.Now()
+	if !limiter.allow("127.0.0.2", now) {
+		t.Error("limit should be per address")
+	}
+
+	if !limiter.allow("127.0.0.1", now.Add(time.Minute)) {
+		t.Error("limit should expire after the window")
+	}
+}
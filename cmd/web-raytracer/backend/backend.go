@@ -25,31 +25,61 @@ import (
 	"image"
 	"image/color"
 	"image/color/palette"
-	"image/draw"
 	_ "image/png"
-	"log"
+	"io"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime/pprof"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/websocket"
 
+	"github.com/andreas-jonsson/octatron/pack"
 	"github.com/andreas-jonsson/octatron/trace"
 )
 
 var closeFrameErr = errors.New("close-frame")
 
+// eyeSeparation is the distance between the eyes in stereo mode, in tree units.
+const eyeSeparation = 0.01
+
 var (
 	messageCodec = websocket.Codec{Marshal: nil, Unmarshal: unmarshalMessage}
 	streamCodec  = websocket.Codec{Marshal: marshalData, Unmarshal: nil}
 )
 
-var loadedTree struct {
-	maxDepth int
-	tree     trace.Octree
-	pal      color.Palette
-	rawPal   []byte
+var (
+	config      serverConfig
+	clientSlots chan struct{}
+	limiter     = newRateLimiter(0, time.Minute)
+)
+
+type treeData struct {
+	file      string
+	stamp     treeStamp
+	replaced  chan struct{}
+	bookmarks *bookmarkStore
+	maxDepth  int
+	frames    []trace.Octree
+	infos     []*trace.TreeInfo
+	pal       color.Palette
+	rawPal    []byte
+
+	// editor is the copy of the tree that edits are made to and patches the
+	// edits made since the tree was loaded, see changeTree. The journal holds
+	// the edits that revert the last ones, see undoTree.
+	editor  *trace.MutableTree
+	patches []trace.TreePatch
+	journal [][]voxelEdit
+
+	// snapshots are the references of the cache to the frames, set while the
+	// tree is cached. The renderers hold their own, see treeData.snapshot.
+	snapshots []*trace.TreeSnapshot
 }
 
 type (
@@ -58,7 +88,74 @@ type (
 		Height      int     `height`
 		FieldOfView float32 `field_of_view`
 		ColorFormat string  `color_format`
+
+		// Preset names a render quality, see qualityPresets. Width, Height,
+		// ColorFormat, Samples and Jitter override it when set. Presets and
+		// Samples are clamped to the server limits, explicit resolutions over
+		// the limits are rejected.
+		Preset  string `preset`
+		Samples int    `samples`
+		Jitter  *bool  `jitter`
+
 		ClearColor  [4]byte `clear_color`
+		FoveaRadius int     `fovea_radius`
+		Token       string  `token`
+
+		// Tree is the name of the tree in the data directory, the default tree
+		// is used if it is empty. Errors are sent as binary frames instead of
+		// JSON if BinaryErrors is set.
+		Tree         string `tree`
+		BinaryErrors bool   `binary_errors`
+
+		// Stereo renders the left and right eye side by side.
+		Stereo bool `stereo`
+
+		// Progressive sends the tiles of a frame as soon as they are rendered,
+		// followed by an end-of-frame marker. Foveated frames and frames that
+		// are sent again are still sent whole.
+		Progressive bool `progressive`
+
+		// Walk keeps the camera from moving through leafs and lets it fall to
+		// the ground. Corrected positions are sent back as cameraMessages.
+		Walk bool `walk`
+
+		// Smooth renders every frame with a camera interpolated between the
+		// last two updates, one update interval behind the client.
+		Smooth bool `smooth`
+
+		// Idle changes when and how fast the camera orbits the tree once the
+		// client stops moving it, the server defaults are used if it is nil.
+		// Moving the camera ends the orbit, the client is sent a cameraMessage
+		// with the pose it was shown.
+		Idle *idleSetup `idle`
+
+		// Camera is the start camera of the client, usually restored from its
+		// last session. If it is nil or too far from the tree to see it, the
+		// info message is followed by a cameraMessage with the start bookmark
+		// of the tree. Without a start bookmark the camera frames the tree,
+		// clients without a camera only get it if the tree was built with
+		// world bounds.
+		Camera *bookmark `camera`
+
+		// Minimap asks for a minimapMessage after the info message and after
+		// every tree switch.
+		Minimap bool `minimap`
+
+		// LUT is the name of a .cube file in the data directory that grades
+		// every frame.
+		LUT string `lut`
+
+		// Viewports are views rendered next to the main view, with viewport
+		// ids from one. Their pixels and the pixels of the main view together
+		// may not be more than the maximum resolution.
+		Viewports []viewportSetup `viewports`
+	}
+
+	infoMessage struct {
+		NumNodes      uint64 `num_nodes`
+		NumLeafs      uint64 `num_leafs`
+		VoxelsPerAxis int    `voxels_per_axis`
+		NumFrames     int    `num_frames`
 	}
 
 	updateMessage struct {
@@ -67,6 +164,109 @@ type (
 			XRot     float32    `x_rot`
 			YRot     float32    `y_rot`
 		} "camera"
+		Frame  int         `frame`
+		Cursor *[2]float32 `cursor`
+
+		// Ping is the client time of a ping message. Ping messages carry no
+		// camera update and are answered with a pongMessage.
+		Ping *float64 `ping`
+
+		// Screenshot requests a high quality render of the camera, answered
+		// with a screenshotMessage.
+		Screenshot bool             `screenshot`
+		Bookmark   *bookmarkRequest `bookmark`
+
+		// Tree switches to another tree in the data directory. It is loaded in
+		// the background while frames of the current tree are still sent, the
+		// switch is answered with a treeReadyMessage.
+		Tree *string `tree`
+
+		// Quality changes the render quality between frames. It is answered
+		// with a qualityMessage, or an error if the quality is invalid.
+		Quality *qualityRequest `quality`
+
+		// Filter hides leafs by their classification code from the next frame
+		// on. It is kept when the quality or tree changes. Trees without codes
+		// render all leafs and the client is sent a noticeMessage.
+		Filter *filterRequest `filter`
+
+		// Edit changes a voxel of the tree if the server allows edits. The
+		// connections viewing the tree are sent a patchMessage.
+		Edit *editRequest `edit`
+
+		// Paint edits the voxels under a brush, its pixel is resolved with the
+		// camera of the update. Undo reverts the last edit or paint stroke of the
+		// tree. Both are handled like Edit.
+		Paint *paintRequest `paint`
+		Undo  bool          `undo`
+
+		// Measure resolves two points of the tree and their distance, with the
+		// camera and frame of the update.
+		Measure *measureRequest `measure`
+
+		// Detail trades detail for speed, from zero for the coarsest frames to
+		// one for full detail. It is applied from the next frame on, kept when
+		// the quality changes and answered with a detailMessage.
+		Detail *float32 `detail`
+
+		// received is the time the update was received.
+		received time.Time
+	}
+
+	// bookmarkRequest lists, saves, deletes or goes to a bookmark. Saved bookmarks
+	// use the camera of the update, start saves the start bookmark of the tree.
+	// All actions are answered with a bookmarksMessage, goto also with a
+	// cameraMessage.
+	bookmarkRequest struct {
+		Action string `action`
+		Name   string `name`
+	}
+
+	screenshotMessage struct {
+		Screenshot string `screenshot`
+	}
+
+	bookmarksMessage struct {
+		Bookmarks []bookmark `bookmarks`
+	}
+
+	cameraMessage struct {
+		Goto bookmark `goto`
+	}
+
+	treeReadyMessage struct {
+		TreeReady string      `tree_ready`
+		Info      infoMessage `info`
+	}
+
+	// noticeMessage lists the features the server turned off because the tree
+	// can not support them, see trace.Downgrade. The frames are still sent.
+	noticeMessage struct {
+		Notices []notice `notices`
+	}
+
+	notice struct {
+		Feature  string `feature`
+		Reason   string `reason`
+		Fallback string `fallback`
+	}
+
+	foveaLevel struct {
+		scale     int
+		raytracer *trace.Raytracer
+	}
+
+	// renderer holds the raytracers and frame buffers of a connection for one
+	// render quality. It is replaced when the client changes the quality.
+	renderer struct {
+		quality    quality
+		cfg        trace.Config
+		rect       image.Rectangle
+		surfaces   [2]*image.RGBA
+		backBuffer *image.Paletted
+		raytracer  *trace.Raytracer
+		levels     []foveaLevel
+		accumulate bool
 	}
 )
 
@@ -88,24 +288,79 @@ func unmarshalMessage(data []byte, ty byte, v interface{}) error {
 	}
 }
 
-func loadTree(file string) error {
+// loadTree loads a tree or sequence. Failures that should be reported to the client
+// are returned as protocol errors. The load is aborted if cancel is closed.
+func loadTree(file string, cancel <-chan struct{}) (*treeData, error) {
 	pal := palette.Plan9
 	rawPal := make([]byte, 4*256)
 
 	treeFp, err := os.Open(file)
-	if err != nil {
-		return err
+	if os.IsNotExist(err) {
+		return nil, &protocolError{unknownTreeError, "unknown tree: " + filepath.Base(file)}
+	} else if err != nil {
+		return nil, err
 	}
 	defer treeFp.Close()
 
-	log.Println("loading octree:", file)
-	tree, vpa, err := trace.LoadOctree(treeFp)
+	stat, err := treeFp.Stat()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	loadedTree.maxDepth = trace.TreeWidthToDepth(vpa)
-	loadedTree.tree = tree
+	var readers []io.ReadSeeker
+	if seq, err := pack.OpenSequence(treeFp); err == nil {
+		serverLog().Infof("loading sequence: %s", file)
+		for i := 0; i < seq.NumFrames(); i++ {
+			frame, err := seq.Frame(i)
+			if err != nil {
+				return nil, err
+			}
+			readers = append(readers, frame)
+		}
+	} else {
+		serverLog().Infof("loading octree: %s", file)
+		readers = append(readers, treeFp)
+	}
+
+	if err := checkTreeSize(file, readers); err != nil {
+		return nil, err
+	}
+
+	bookmarks, err := openBookmarks(bookmarkFile(file))
+	if err != nil {
+		return nil, err
+	}
+	addSceneCameras(file, bookmarks)
+
+	loadedTree := &treeData{file: file, stamp: stampOf(stat), replaced: make(chan struct{}), bookmarks: bookmarks}
+	for _, reader := range readers {
+		opts := trace.LoadOctreeOptions{MaxNodes: config.MaxNodes}
+		tree, info, err := trace.LoadOctreeWithOptions(&cancelReader{reader, cancel}, opts)
+		if err == errLoadCanceled {
+			return nil, err
+		} else if err != nil {
+			return nil, treeError(err)
+		}
+
+		if info.Depth > loadedTree.maxDepth {
+			loadedTree.maxDepth = info.Depth
+		}
+		loadedTree.frames = append(loadedTree.frames, tree)
+		loadedTree.infos = append(loadedTree.infos, info)
+	}
+
+	if len(loadedTree.frames) == 0 {
+		return nil, &protocolError{unsupportedFormatError, "sequence has no frames"}
+	}
+
+	info := loadedTree.infos[0]
+	serverLog().Infof("nodes: %v, leafs: %v, voxels per axis: %v", info.NumNodes, info.NumLeafs, info.VoxelsPerAxis)
+
+	// The tree is rendered with TreeScale 1, so voxels smaller than the float32
+	// precision can't be resolved.
+	if loadedTree.maxDepth > 23 {
+		serverLog().Warnf("tree is too deep to be rendered accurately")
+	}
 
 	paletteFile := file + ".png"
 	paletteFp, err := os.Open(paletteFile)
@@ -116,7 +371,7 @@ func loadTree(file string) error {
 			size := src.Bounds().Max
 
 			if size.X == 16 && size.Y == 16 {
-				log.Println("loading palette:", paletteFile)
+				serverLog().Infof("loading palette: %s", paletteFile)
 				pal = make([]color.Color, 256)
 
 				for y := 0; y < 16; y++ {
@@ -140,139 +395,588 @@ func loadTree(file string) error {
 
 	loadedTree.pal = pal
 	loadedTree.rawPal = rawPal
+	return loadedTree, nil
+}
+
+// foveaRect returns the rectangle around the normalized cursor position. The radius is
+// given in client pixels, the image is half width since the jitter provides the other half.
+func foveaRect(cursor [2]float32, radius int, bounds image.Rectangle) image.Rectangle {
+	x := bounds.Min.X + int(cursor[0]*float32(bounds.Dx()))
+	y := bounds.Min.Y + int(cursor[1]*float32(bounds.Dy()))
+	return image.Rect(x-radius/2, y-radius, x+radius/2, y+radius).Intersect(bounds)
+}
+
+func upsample(dst, src *image.RGBA, region, exclude image.Rectangle, scale int) {
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := region.Min.X; x < region.Max.X; x++ {
+			if !image.Pt(x, y).In(exclude) {
+				dst.SetRGBA(x, y, src.RGBAAt(x/scale, y/scale))
+			}
+		}
+	}
+}
+
+// traceFoveated renders the area around the cursor at full resolution and the
+// periphery at lower resolution. The levels are ordered from finest to coarsest.
+func traceFoveated(raytracer *trace.Raytracer, levels []foveaLevel, camera trace.Camera, bounds image.Rectangle, cursor [2]float32, radius int) int {
+	rects := make([]image.Rectangle, len(levels))
+	frames := make([]int, len(levels))
+
+	for i, level := range levels {
+		if i == len(levels)-1 {
+			rects[i] = bounds
+			frames[i] = level.raytracer.Trace(camera, nil, 0)
+			continue
+		}
+
+		s := level.scale
+		r := foveaRect(cursor, radius*s, bounds)
+		rects[i] = r
+
+		r = image.Rect(r.Min.X/s, r.Min.Y/s, (r.Max.X+s-1)/s, (r.Max.Y+s-1)/s)
+		frames[i] = level.raytracer.TraceRect(camera, nil, 0, r)
+	}
+
+	fovea := foveaRect(cursor, radius, bounds)
+	idx := raytracer.TraceRect(camera, nil, 0, fovea)
+	dst := raytracer.Image(idx)
+
+	exclude := fovea
+	for i, level := range levels {
+		upsample(dst, level.raytracer.Image(frames[i]), rects[i], exclude, level.scale)
+		exclude = rects[i]
+	}
+	return idx
+}
+
+// qualityRequest returns the quality asked for by the setup.
+func (setup *setupMessage) qualityRequest() qualityRequest {
+	return qualityRequest{setup.Preset, setup.Width, setup.Height, setup.Samples, setup.Jitter, setup.ColorFormat, false}
+}
+
+// validate checks the setup and returns the quality it asks for. Errors are
+// protocol errors.
+func (setup *setupMessage) validate() (quality, error) {
+	if setup.Width > config.MaxWidth || setup.Height > config.MaxHeight {
+		message := fmt.Sprintf("resolution %vx%v is over the maximum %vx%v", setup.Width, setup.Height, config.MaxWidth, config.MaxHeight)
+		return quality{}, &protocolError{resolutionError, message}
+	}
+
+	request := setup.qualityRequest()
+	q, err := request.resolve()
+	if err != nil || !(setup.FieldOfView >= 45) {
+		return quality{}, &protocolError{invalidSetupError, fmt.Sprint("invalid setup: ", *setup)}
+	}
+
+	if len(setup.Viewports) >= maxViewports {
+		return quality{}, &protocolError{invalidSetupError, fmt.Sprintf("at most %d viewports may be rendered, the main view included", maxViewports)}
+	}
+	for i := range setup.Viewports {
+		if err := setup.Viewports[i].validate(); err != nil {
+			return quality{}, err
+		}
+	}
+	if err := setup.Idle.validate(); err != nil {
+		return quality{}, err
+	}
+	if err := setup.checkPixels(q); err != nil {
+		return quality{}, err
+	}
+	return q, nil
+}
+
+// checkPixels returns a protocol error if the main view at quality q and the
+// viewports have more pixels than the maximum resolution.
+func (setup *setupMessage) checkPixels(q quality) error {
+	if pixels, limit := viewportPixels(q, setup.Viewports), config.MaxWidth*config.MaxHeight; pixels > limit {
+		return &protocolError{resolutionError, fmt.Sprintf("viewports have %v pixels, over the maximum %v", pixels, limit)}
+	}
 	return nil
 }
 
+// newRenderer creates the raytracers of a connection at quality q, rendering frame of
+// tree. The image is half width since the jitter provides the other half.
+func newRenderer(setup *setupMessage, q quality, tree *treeData, frame int, clear color.RGBA, lut *trace.LUT, tiles *tileStream) (*renderer, error) {
+	r := &renderer{quality: q, rect: image.Rect(0, 0, q.Width/2, q.Height)}
+	r.backBuffer = image.NewPaletted(r.rect, tree.pal)
+	r.surfaces = [2]*image.RGBA{
+		image.NewRGBA(r.rect),
+		image.NewRGBA(r.rect),
+	}
+
+	r.cfg = trace.Config{
+		FieldOfViewDegrees: setup.FieldOfView,
+		TreeScale:          1,
+		ViewDist:           float32(config.ViewDistance),
+		Images:             r.surfaces,
+		Jitter:             q.Jitter,
+		Samples:            q.Samples,
+		MultiThreaded:      true,
+		FrameSeed:          1,
+		LUT:                lut,
+		Logger:             serverLog(),
+	}
+
+	if setup.Stereo {
+		r.cfg.Stereo = eyeSeparation
+	}
+	applyScene(&r.cfg)
+
+	r.accumulate = config.Accumulate > 1 && !q.Jitter && !q.Raster && setup.FoveaRadius == 0
+	r.cfg.Accumulate = r.accumulate
+
+	if err := r.cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	rtCfg := r.cfg
+	if setup.Progressive {
+		rtCfg.TileSize = progressiveTileSize
+		rtCfg.OnTileDone = tiles.done
+	}
+
+	r.raytracer = trace.NewRaytracer(rtCfg)
+	r.raytracer.SetClearColor(clear)
+
+	// Periphery levels at half and quarter resolution. Jitter is disabled so they
+	// don't need to stay in step with the full resolution frames.
+	if setup.FoveaRadius > 0 {
+		for _, scale := range []int{2, 4} {
+			levelRect := image.Rect(0, 0, r.rect.Dx()/scale, r.rect.Dy()/scale)
+			levelCfg := r.cfg
+			levelCfg.Jitter = false
+			levelCfg.Images = [2]*image.RGBA{image.NewRGBA(levelRect), image.NewRGBA(levelRect)}
+
+			level := foveaLevel{scale, trace.NewRaytracer(levelCfg)}
+			level.raytracer.SetClearColor(clear)
+			r.levels = append(r.levels, level)
+		}
+	}
+
+	r.setTree(tree, frame)
+	return r, nil
+}
+
+// setTree renders a frame of tree from the next frame on. Frames in flight finish
+// with the tree they started with.
+func (r *renderer) setTree(tree *treeData, frame int) {
+	s := tree.snapshot(frame)
+	defer s.Release()
+
+	r.raytracer.SetSnapshot(s)
+	for _, level := range r.levels {
+		level.raytracer.SetSnapshot(s)
+	}
+}
+
+// setLODBias drops levels of detail from the next frame on.
+func (r *renderer) setLODBias(bias float32) error {
+	if err := r.raytracer.SetLODBias(bias); err != nil {
+		return err
+	}
+	for _, level := range r.levels {
+		if err := level.raytracer.SetLODBias(bias); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setFilter hides the leafs rejected by filter from the next frame on.
+func (r *renderer) setFilter(filter func(attrs trace.NodeAttributes) bool) {
+	r.raytracer.SetNodeFilter(filter)
+	for _, level := range r.levels {
+		level.raytracer.SetNodeFilter(filter)
+	}
+}
+
+// close releases the raytracers once their frames in flight are done.
+func (r *renderer) close() {
+	release := func(rt *trace.Raytracer) {
+		rt.Wait(0)
+		rt.Wait(1)
+		rt.Close()
+	}
+
+	release(r.raytracer)
+	for _, level := range r.levels {
+		release(level.raytracer)
+	}
+}
+
 func renderServer(ws *websocket.Conn) {
-	addr := ws.RemoteAddr()
-	log.Println("new connection:", addr)
-	defer func() { log.Println(addr, "was disconnected") }()
+	addr := ws.Request().RemoteAddr
+
+	if !limiter.allow(remoteHost(addr), time.Now()) {
+		rejectClient(ws, false, rateLimitedError, "too many connection attempts")
+		return
+	}
+
+	if !sessions.enter() {
+		rejectClient(ws, false, serverRestartingError, "server is restarting")
+		return
+	}
+	defer sessions.leave()
+
+	if clientSlots != nil {
+		select {
+		case clientSlots <- struct{}{}:
+			defer func() { <-clientSlots }()
+		default:
+			rejectClient(ws, false, serverFullError, "too many clients")
+			return
+		}
+	}
+
+	logv(1, "new connection:", addr)
+	defer func() { logv(1, addr, "was disconnected") }()
+
+	metrics.addClients(1)
+	defer metrics.addClients(-1)
 
 	// Setup watchdog.
+	timeout := time.Duration(config.Timeout) * time.Minute
 	shutdownWatch := make(chan struct{}, 1)
 	defer func() { shutdownWatch <- struct{}{} }()
 	go func() {
 		select {
 		case <-shutdownWatch:
-		case <-time.After(time.Duration(arguments.timeout) * time.Minute):
-			log.Println("session timeout")
+		case <-time.After(timeout):
+			serverLog().Infof("%s: session timeout", addr)
 			ws.Close()
 		}
 	}()
 
-	var setup setupMessage
-	if err := messageCodec.Receive(ws, &setup); err != nil {
-		log.Println(err)
+	s := &session{ws: ws, addr: addr}
+	setup := &s.setup
+
+	// A panic only takes down the connection it was raised in.
+	defer func() {
+		if r := recover(); r != nil {
+			serverLog().Errorf("%s: panic: %v", addr, r)
+			rejectClient(ws, setup.BinaryErrors, internalError, "internal server error")
+		}
+	}()
+
+	if err := messageCodec.Receive(ws, setup); err != nil {
+		serverLog().Errorf("%s: %v", addr, err)
+		if isSyntaxError(err) {
+			rejectClient(ws, false, invalidSetupError, "malformed setup message: "+err.Error())
+		}
 		return
 	}
-	log.Println(setup)
 
-	if setup.Width*setup.Height > 1280*720 || setup.FieldOfView < 45 || setup.FieldOfView > 180 {
-		log.Println("invalid setup")
-		log.Println(setup)
+	if !validToken(setup.Token) {
+		rejectClient(ws, setup.BinaryErrors, unauthorizedError, "invalid token")
 		return
 	}
 
-	rect := image.Rect(0, 0, setup.Width/2, setup.Height)
-	backBuffer := image.NewPaletted(rect, loadedTree.pal)
-	surfaces := [2]*image.RGBA{
-		image.NewRGBA(rect),
-		image.NewRGBA(rect),
+	setup.Token = ""
+	logv(2, *setup)
+
+	q, err := setup.validate()
+	if err != nil {
+		perr := err.(*protocolError)
+		rejectClient(ws, setup.BinaryErrors, perr.code, perr.message)
+		return
+	}
+
+	if s.tree, err = openTree(setup.Tree); err != nil {
+		if perr, ok := err.(*protocolError); ok {
+			rejectClient(ws, setup.BinaryErrors, perr.code, perr.message)
+		} else {
+			serverLog().Errorf("%s: %v", addr, err)
+			rejectClient(ws, setup.BinaryErrors, internalError, "could not load tree")
+		}
+		return
+	}
+
+	memory.view(s.tree.file)
+	defer func() { memory.unview(s.currentTree().file) }()
+
+	// Clients that don't fit in the memory budget get a lower resolution, the
+	// quality message tells them.
+	if q, s.reserved, err = memory.admit(setup, q); err != nil {
+		perr := err.(*protocolError)
+		rejectClient(ws, setup.BinaryErrors, perr.code, perr.message)
+		return
 	}
+	defer func() { memory.resize(&s.reserved, 0) }()
 
-	cfg := trace.Config{
-		FieldOfView:   setup.FieldOfView,
-		TreeScale:     1,
-		ViewDist:      float32(arguments.viewDistance),
-		Images:        surfaces,
-		Jitter:        true,
-		MultiThreaded: true,
-		FrameSeed:     1,
+	if s.lut, err = loadLUT(setup.LUT); err != nil {
+		if perr, ok := err.(*protocolError); ok {
+			rejectClient(ws, setup.BinaryErrors, perr.code, perr.message)
+		} else {
+			serverLog().Errorf("%s: %v", addr, err)
+			rejectClient(ws, setup.BinaryErrors, internalError, "could not load LUT")
+		}
+		return
 	}
 
-	raytracer := trace.NewRaytracer(cfg)
+	s.tiles = newTileStream()
+	s.frameTimeout = time.Duration(config.FrameTimeout) * time.Second
 	clear := setup.ClearColor
-	raytracer.SetClearColor(color.RGBA{clear[0], clear[1], clear[2], clear[3]})
-	updateChan := make(chan updateMessage, 2)
+	s.clearColor = color.RGBA{clear[0], clear[1], clear[2], clear[3]}
 
-	go func() {
-		var update updateMessage
-		for {
-			if err := messageCodec.Receive(ws, &update); err != nil {
-				log.Println(err)
-				return
-			}
+	if s.render, err = newRenderer(setup, q, s.tree, s.currentFrame, s.clearColor, s.lut, s.tiles); err != nil {
+		rejectClient(ws, setup.BinaryErrors, invalidSetupError, err.Error())
+		return
+	}
+	defer func() { s.currentRenderer().close() }()
 
-			// TODO Verify message.
-			updateChan <- update
+	// A failed recording does not stop the session.
+	if s.recording, err = newRecording(config.RecordDir, config.RecordFormat, config.RecordCmd, image.Pt(q.Width, q.Height), config.RecordFPS); err != nil {
+		serverLog().Errorf("%s: could not record session: %v", addr, err)
+	}
+	defer func() {
+		if err := s.recording.close(); err != nil {
+			serverLog().Errorf("%s: recording failed: %v", addr, err)
 		}
 	}()
 
-	// Send palette.
-	if setup.ColorFormat == "PALETTED" {
-		log.Println("sending palette...")
-		if err := streamCodec.Send(ws, loadedTree.rawPal); err != nil {
-			log.Println(err)
+	// The reader is not blocked by a render loop that has ended.
+	s.updates = make(chan updateMessage, 2)
+	s.done = make(chan struct{})
+	defer close(s.done)
+	s.screenshotSlot = make(chan struct{}, 1)
+
+	s.loader = newTreeLoader()
+	defer s.loader.stop()
+
+	go s.read()
+
+	if err := s.start(q); err != nil {
+		serverLog().Errorf("%s: %v", addr, err)
+		return
+	}
+
+	s.sender = newFrameSender(s.sendStream)
+	defer s.sender.close()
+
+	defer func() {
+		for _, vp := range s.viewports {
+			vp.close()
+		}
+	}()
+	for i := range setup.Viewports {
+		vp, err := newViewport(uint32(i+1), &setup.Viewports[i], setup.FieldOfView, s.clearColor, s.lut, s.sendStream)
+		if err != nil {
+			rejectClient(ws, setup.BinaryErrors, invalidSetupError, err.Error())
 			return
 		}
+		s.viewports = append(s.viewports, vp)
 	}
 
-	for {
-		update := <-updateChan
-		camera := trace.FreeFlightCamera{
-			Pos:  update.Camera.Position,
-			XRot: update.Camera.XRot,
-			YRot: update.Camera.YRot,
+	s.lastSent = -1
+	s.idle = newIdleOrbit(setup.Idle)
+	s.treeName = setup.Tree
+	s.wanted = q
+	s.budget = renderBudget{window: time.Duration(config.BudgetWindow) * time.Second}
+	s.adapt = qualityController{budget: frameBudget()}
+	s.pacer = trace.NewFramePacer(config.MaxFPS)
+	s.detail = 1
+
+	defer s.summary()
+	s.run()
+}
+
+// validate checks that the camera and cursor are finite. JSON can not encode NaN or
+// infinity but the values are passed on to the raytracer and are checked anyway.
+func (update *updateMessage) validate() error {
+	values := []float32{update.Camera.XRot, update.Camera.YRot}
+	values = append(values, update.Camera.Position[:]...)
+	if update.Cursor != nil {
+		values = append(values, update.Cursor[:]...)
+	}
+
+	for _, v := range values {
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return errors.New("camera is not finite")
 		}
+	}
 
-		frame := 1 + raytracer.Trace(&camera, loadedTree.tree, loadedTree.maxDepth)
-		idx := frame % 2
+	if update.Detail != nil && !validDetail(*update.Detail) {
+		return errors.New("detail is not within [0, 1]")
+	}
 
-		var err error
-		if setup.ColorFormat == "PALETTED" {
-			draw.Draw(backBuffer, rect, raytracer.Image(idx), image.ZP, draw.Src)
-			err = streamCodec.Send(ws, backBuffer.Pix)
-		} else {
-			err = streamCodec.Send(ws, raytracer.Image(idx).Pix)
+	if update.Edit != nil {
+		if err := update.Edit.validate(); err != nil {
+			return err
 		}
+	}
 
-		if err != nil {
-			log.Println(err)
-			return
+	if update.Paint != nil {
+		if err := update.Paint.validate(); err != nil {
+			return err
 		}
 	}
+
+	if update.Measure != nil {
+		if err := update.Measure.validate(); err != nil {
+			return err
+		}
+	}
+
+	if update.Filter != nil {
+		return update.Filter.validate()
+	}
+	return nil
 }
 
-var arguments struct {
-	web,
-	tree string
-	pprof bool
-	port,
-	timeout uint
-	viewDistance float64
+// waitFrame waits for frame like Wait. If it is not done within timeout the frames
+// in flight are aborted, so a view that is pathologically slow to trace can't stall
+// the session, and the camera is logged to find the view again. Zero disables the
+// timeout.
+func waitFrame(rt *trace.Raytracer, frame int, timeout time.Duration, camera *trace.FreeFlightCamera) error {
+	if timeout > 0 {
+		watchdog := time.AfterFunc(timeout, func() {
+			rt.Abort()
+			metrics.addTimedOut(1)
+			serverLog().Warnf("frame timed out after %v, camera at %v rotated %v, %v", timeout, camera.Pos, camera.XRot, camera.YRot)
+		})
+		defer watchdog.Stop()
+	}
+	return rt.Wait(frame)
 }
 
-func init() {
-	flag.Usage = func() {
-		fmt.Printf("Usage: program [options]\n\n")
-		flag.PrintDefaults()
+func cameraFromUpdate(update *updateMessage) trace.FreeFlightCamera {
+	return trace.FreeFlightCamera{
+		Pos:  update.Camera.Position,
+		XRot: update.Camera.XRot,
+		YRot: update.Camera.YRot,
+	}
+}
+
+func sendScreenshot(ws *websocket.Conn, tree *treeData, update updateMessage, cfg trace.Config, clear color.RGBA, width, height int) {
+	frame := update.Frame
+	if frame < 0 || frame >= len(tree.frames) {
+		frame = 0
+	}
+
+	camera := cameraFromUpdate(&update)
+	img := renderScreenshot(tree.frames[frame], tree.maxDepth, &camera, cfg, clear, width, height)
+
+	url, err := screenshots.add(img)
+	if err != nil {
+		serverLog().Errorf("%v", err)
+		return
+	}
+
+	logv(1, "screenshot:", url)
+	if err := websocket.JSON.Send(ws, screenshotMessage{url}); err != nil {
+		serverLog().Errorf("%v", err)
+	}
+}
+
+// handleBookmark executes a bookmark request. Bookmark errors are logged and answered
+// with the current list, only send errors are returned.
+func handleBookmark(ws *websocket.Conn, store *bookmarkStore, update updateMessage) error {
+	req := update.Bookmark
+
+	var err error
+	switch req.Action {
+	case "save":
+		b := bookmark{req.Name, update.Camera.Position, update.Camera.XRot, update.Camera.YRot, false}
+		err = store.save(b)
+	case "start":
+		b := bookmark{req.Name, update.Camera.Position, update.Camera.XRot, update.Camera.YRot, true}
+		err = store.saveStart(b)
+	case "delete":
+		err = store.remove(req.Name)
+	case "goto":
+		var b bookmark
+		if b, err = store.get(req.Name); err == nil {
+			if err := websocket.JSON.Send(ws, cameraMessage{b}); err != nil {
+				return err
+			}
+		}
+	case "list":
+	default:
+		err = errors.New("invalid bookmark action: " + req.Action)
 	}
 
-	flag.StringVar(&arguments.web, "web", "cmd/web-raytracer/frontend", "web frontend location")
-	flag.StringVar(&arguments.tree, "tree", "tree.oct", "octree to serve clients")
-	flag.BoolVar(&arguments.pprof, "pprof", false, "enables cpu profiler and pprof over http, port 6060")
-	flag.UintVar(&arguments.port, "port", 8080, "server port")
-	flag.UintVar(&arguments.timeout, "timeout", 3, "max session length in minutes")
-	flag.Float64Var(&arguments.viewDistance, "dist", 1, "max view-distance")
+	if err != nil {
+		serverLog().Errorf("%v", err)
+	}
+	return websocket.JSON.Send(ws, bookmarksMessage{store.list()})
+}
+
+// setupRendering loads the tree and installs the handlers of a render server.
+func setupRendering() error {
+	if _, err := openTree(""); err != nil {
+		return err
+	}
+
+	if config.Reload > 0 {
+		go watchTrees(time.Duration(config.Reload) * time.Second)
+	}
+
+	if config.Edit && config.Autosave > 0 {
+		go autosaveTrees(time.Duration(config.Autosave) * time.Second)
+	}
+
+	if config.MaxClients > 0 {
+		clientSlots = make(chan struct{}, config.MaxClients)
+	}
+
+	if config.AuthToken == "" {
+		serverLog().Warnf("authentication is disabled")
+	}
+	limiter = newRateLimiter(config.MaxAttempts, time.Minute)
+
+	http.Handle("/render", websocket.Handler(renderServer))
+	http.Handle(screenshotPath, screenshots)
+	http.Handle(patchesPath, websocket.Handler(patchServer))
+	http.Handle(metricsPath, &metrics)
+
+	if config.Register != "" {
+		go register(config.Register, config.CoordinatorToken, config.PublicAddr, time.Duration(config.Heartbeat)*time.Second, sessions.closing)
+	}
+	return nil
 }
 
 func main() {
-	flag.Parse()
+	var err error
+	if config, err = parseConfig(os.Args[1:], os.Getenv); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Println(err)
+		}
+
+		fmt.Printf("Usage: program [options]\n\n")
+		fmt.Printf("Options can also be set with %sNAME environment variables.\n\n", envPrefix)
+
+		fs := flag.NewFlagSet("backend", flag.ContinueOnError)
+		defaults, configFile := defaultConfig(), ""
+		defaults.flags(fs, &configFile)
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+
+	if config.Demo {
+		cleanup, err := setupDemo(&config)
+		if err != nil {
+			serverLog().Errorf("%v", err)
+			os.Exit(trace.ExitCode(err))
+		}
+		defer cleanup()
+	}
 
-	if arguments.pprof {
-		log.Println("pprof enabled")
+	if config.Scene != "" {
+		if err := setupScene(&config); err != nil {
+			serverLog().Errorf("%v", err)
+			os.Exit(trace.ExitCode(err))
+		}
+	}
+
+	if err := config.validate(); err != nil {
+		serverLog().Errorf("%v", err)
+		os.Exit(-1)
+	}
+
+	if config.Pprof {
+		serverLog().Infof("pprof enabled")
 		go func() {
-			log.Println(http.ListenAndServe("localhost:6060", nil))
+			serverLog().Errorf("%v", http.ListenAndServe("localhost:6060", nil))
 		}()
 
 		fp, err := os.Create("backend.pprof")
@@ -285,17 +989,44 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	if err := loadTree(arguments.tree); err != nil {
-		log.Println(err)
+	http.Handle("/", webHandler(&config))
+	if config.Coordinator {
+		serverLog().Infof("coordinating render servers")
+		http.Handle(serversPath, newCoordinator(config.CoordinatorToken, time.Duration(config.Heartbeat)*time.Second))
+	} else if err := setupRendering(); err != nil {
+		serverLog().Errorf("%v", err)
+		os.Exit(trace.ExitCode(err))
+	}
+
+	ln, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		serverLog().Errorf("%v", err)
 		os.Exit(-1)
 	}
 
-	http.Handle("/", http.FileServer(http.Dir(arguments.web)))
-	http.Handle("/render", websocket.Handler(renderServer))
+	server := &http.Server{Addr: config.Listen}
+	listen := func() error {
+		if config.TLSCert != "" {
+			return server.ServeTLS(ln, config.TLSCert, config.TLSKey)
+		}
+		return server.Serve(ln)
+	}
 
-	log.Println("waiting for connections...")
-	if err := http.ListenAndServe(fmt.Sprintf(":%v", arguments.port), nil); err != nil {
-		log.Println(err)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	serverLog().Infof("waiting for connections on %s", config.Listen)
+	if config.Demo {
+		scheme := "http"
+		if config.TLSCert != "" {
+			scheme = "https"
+		}
+		if err := openBrowser(scheme + "://" + ln.Addr().String() + "/"); err != nil {
+			serverLog().Warnf("could not open the browser: %v", err)
+		}
+	}
+	if err := serve(server, listen, signals, time.Duration(config.DrainTimeout)*time.Second); err != nil {
+		serverLog().Errorf("%v", err)
 		os.Exit(-1)
 	}
 }
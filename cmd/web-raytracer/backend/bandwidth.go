@@ -0,0 +1,158 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// bandwidthDecay is the weight of the earlier writes of a connection after
+	// another write, so the estimate follows changes within a few frames.
+	bandwidthDecay = 0.9
+
+	// adaptInterval is the shortest time between quality changes of a connection,
+	// so the estimate settles before the next one.
+	adaptInterval = 2 * time.Second
+
+	// adaptHeadroom is the part of the frame budget the frames of the next higher
+	// quality must fit in before the quality is raised again.
+	adaptHeadroom = 0.5
+
+	// adaptResolutions is the number of times the resolution may be halved.
+	adaptResolutions = 3
+
+	// adaptFrameTime is the frame budget without MaxFPS.
+	adaptFrameTime = time.Second / 30
+)
+
+type (
+	// bandwidthEstimator estimates the throughput of a connection from the time
+	// its writes take. Writes return once the data is buffered by the system, so
+	// fast connections are overestimated, but writes to a saturated connection
+	// block and bring the estimate down to what it sustains.
+	bandwidthEstimator struct {
+		lock           sync.Mutex
+		bytes, seconds float64
+	}
+
+	// qualityController lowers the quality of a connection when its frames take
+	// longer to send than the frame budget, first to paletted colors and then to
+	// half the resolution at a time, and raises it again when the connection has
+	// room for the higher quality.
+	qualityController struct {
+		level   int
+		changed time.Time
+		budget  time.Duration
+	}
+)
+
+// add records a write of n bytes that took d.
+func (b *bandwidthEstimator) add(n int, d time.Duration) {
+	b.lock.Lock()
+	b.bytes = b.bytes*bandwidthDecay + float64(n)
+	b.seconds = b.seconds*bandwidthDecay + d.Seconds()
+	b.lock.Unlock()
+}
+
+// rate returns the estimated bytes per second, zero before anything is written.
+func (b *bandwidthEstimator) rate() float64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.seconds <= 0 {
+		return 0
+	}
+	return b.bytes / b.seconds
+}
+
+// frameBudget returns the time frames may take to send, a frame at MaxFPS.
+func frameBudget() time.Duration {
+	if config.MaxFPS > 0 {
+		return time.Duration(float64(time.Second) / config.MaxFPS)
+	}
+	return adaptFrameTime
+}
+
+// frameBytes returns the size of the pixels of a frame of q.
+func (q quality) frameBytes() int {
+	n := q.Width / 2 * q.Height
+	if !q.paletted() {
+		n *= 4
+	}
+	return n
+}
+
+// levels returns the number of qualities below q the controller steps through.
+func levels(q quality) int {
+	if q.paletted() {
+		return adaptResolutions
+	}
+	return adaptResolutions + 1
+}
+
+// apply returns q lowered to the current level.
+func (c *qualityController) apply(q quality) quality {
+	return lowered(q, c.level)
+}
+
+// lowered returns q lowered by level steps.
+func lowered(q quality, level int) quality {
+	if level > 0 && !q.paletted() {
+		q.ColorFormat = "PALETTED"
+		level--
+	}
+
+	for ; level > 0; level-- {
+		q.Width = q.Width / 2 &^ 1
+		q.Height /= 2
+	}
+	if q.Width < 2 {
+		q.Width = 2
+	}
+	if q.Height < 1 {
+		q.Height = 1
+	}
+	return q
+}
+
+// update steps the level of base, the quality before it is lowered, by the
+// time a frame takes at rate bytes per second. It reports if the level changed.
+func (c *qualityController) update(now time.Time, base quality, rate float64) bool {
+	if rate <= 0 || now.Sub(c.changed) < adaptInterval {
+		return false
+	}
+
+	sendTime := func(level int) float64 {
+		q := lowered(base, level)
+		return float64(q.frameBytes()) / rate
+	}
+
+	budget := c.budget.Seconds()
+	switch {
+	case c.level < levels(base) && sendTime(c.level) > budget:
+		c.level++
+	case c.level > 0 && sendTime(c.level-1) < budget*adaptHeadroom:
+		c.level--
+	default:
+		return false
+	}
+
+	c.changed = now
+	return true
+}
@@ -0,0 +1,120 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// slowLink stands in for the connection of a client, writes take as long as the
+// bytes need at rate bytes per second.
+type slowLink struct {
+	rate float64
+}
+
+func (l *slowLink) write(n int) time.Duration {
+	return time.Duration(float64(n) / l.rate * float64(time.Second))
+}
+
+// streamFrames sends frames of base over link for d, with the quality adapted by
+// c, and returns the levels the controller was at.
+func streamFrames(c *qualityController, est *bandwidthEstimator, link *slowLink, base quality, now *time.Time, d time.Duration) []int {
+	var levels []int
+	for end := now.Add(d); now.Before(end); {
+		spent := link.write(c.apply(base).frameBytes())
+		est.add(c.apply(base).frameBytes(), spent)
+
+		// Frames are rendered once per budget unless they take longer to send.
+		if spent < c.budget {
+			spent = c.budget
+		}
+		*now = now.Add(spent)
+
+		c.update(*now, base, est.rate())
+		levels = append(levels, c.level)
+	}
+	return levels
+}
+
+func TestBandwidthEstimator(t *testing.T) {
+	var est bandwidthEstimator
+	if rate := est.rate(); rate != 0 {
+		t.Error("expected no estimate before writes, got", rate)
+	}
+
+	link := slowLink{100000}
+	for i := 0; i < 50; i++ {
+		est.add(5000, link.write(5000))
+	}
+	if rate := est.rate(); math.Abs(rate-link.rate) > 1 {
+		t.Errorf("expected %v bytes per second, got %v", link.rate, rate)
+	}
+
+	// The estimate follows a slower connection within a few frames.
+	link.rate = 10000
+	for i := 0; i < 30; i++ {
+		est.add(5000, link.write(5000))
+	}
+	if rate := est.rate(); rate > 12000 {
+		t.Errorf("expected the estimate to drop to %v bytes per second, got %v", link.rate, rate)
+	}
+}
+
+func TestQualityController(t *testing.T) {
+	base := quality{Width: 320, Height: 180, Samples: 1, ColorFormat: "RGBA"}
+	c := qualityController{budget: time.Second / 30}
+
+	var est bandwidthEstimator
+	link := &slowLink{100000}
+	now := time.Unix(1000, 0)
+
+	// Full frames take over a second. Paletted frames at an eighth of the
+	// resolution are the first to fit in the budget.
+	levels := streamFrames(&c, &est, link, base, &now, time.Minute)
+	if c.level != 3 {
+		t.Fatalf("expected to settle at level 3, got %d", c.level)
+	}
+	if q := c.apply(base); q != (quality{80, 45, 1, false, "PALETTED", false}) {
+		t.Error("unexpected adapted quality:", q)
+	}
+
+	// The controller holds the level once it fits.
+	for _, level := range levels[len(levels)/2:] {
+		if level != 3 {
+			t.Fatal("expected the level to hold, got", levels)
+		}
+	}
+
+	// A faster connection gets the full quality back.
+	link.rate = 1e7
+	streamFrames(&c, &est, link, base, &now, time.Minute)
+	if c.level != 0 || c.apply(base) != base {
+		t.Errorf("expected the full quality, got level %d", c.level)
+	}
+
+	// Paletted qualities are only lowered in resolution.
+	paletted := base
+	paletted.ColorFormat = "PALETTED"
+	if q := lowered(paletted, 1); q.ColorFormat != "PALETTED" || q.Width != 160 || q.Height != 90 {
+		t.Error("unexpected lowered quality:", q)
+	}
+	if q := lowered(quality{Width: 4, Height: 2}, 3); q.Width != 2 || q.Height != 1 {
+		t.Error("lowered quality is below the minimum resolution:", q)
+	}
+}
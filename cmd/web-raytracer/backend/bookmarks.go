@@ -0,0 +1,194 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var errUnknownBookmark = errors.New("unknown bookmark")
+
+type (
+	// bookmark is a named camera. The start bookmark is where clients without a
+	// camera of their own start.
+	bookmark struct {
+		Name     string     `json:"name"`
+		Position [3]float32 `json:"position"`
+		XRot     float32    `json:"x_rot"`
+		YRot     float32    `json:"y_rot"`
+		Start    bool       `json:"start,omitempty"`
+	}
+
+	// bookmarkStore holds the camera bookmarks of a tree. They are saved as JSON next
+	// to the tree so they can be shared between sessions.
+	bookmarkStore struct {
+		lock      sync.Mutex
+		file      string
+		bookmarks map[string]bookmark
+	}
+)
+
+type byName []bookmark
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+func bookmarkFile(treeFile string) string {
+	return treeFile + ".bookmarks.json"
+}
+
+// openBookmarks loads the bookmarks from file. A missing file gives an empty store.
+func openBookmarks(file string) (*bookmarkStore, error) {
+	store := &bookmarkStore{file: file, bookmarks: make(map[string]bookmark)}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var bookmarks []bookmark
+	if err := json.Unmarshal(data, &bookmarks); err != nil {
+		return nil, err
+	}
+
+	for _, b := range bookmarks {
+		store.bookmarks[b.Name] = b
+	}
+	return store, nil
+}
+
+// list returns the bookmarks sorted by name.
+func (s *bookmarkStore) list() []bookmark {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.sorted()
+}
+
+func (s *bookmarkStore) sorted() []bookmark {
+	bookmarks := make([]bookmark, 0, len(s.bookmarks))
+	for _, b := range s.bookmarks {
+		bookmarks = append(bookmarks, b)
+	}
+
+	sort.Sort(byName(bookmarks))
+	return bookmarks
+}
+
+func (s *bookmarkStore) get(name string) (bookmark, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b, ok := s.bookmarks[name]
+	if !ok {
+		return b, errUnknownBookmark
+	}
+	return b, nil
+}
+
+// save adds or replaces a bookmark and writes the store to disk. A replaced start
+// bookmark stays the start bookmark.
+func (s *bookmarkStore) save(b bookmark) error {
+	if b.Name == "" {
+		return errors.New("bookmark has no name")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b.Start = b.Start || s.bookmarks[b.Name].Start
+	s.bookmarks[b.Name] = b
+	return s.write()
+}
+
+// saveStart saves b as the start bookmark, replacing the previous one.
+func (s *bookmarkStore) saveStart(b bookmark) error {
+	if b.Name == "" {
+		return errors.New("bookmark has no name")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for name, old := range s.bookmarks {
+		old.Start = false
+		s.bookmarks[name] = old
+	}
+
+	b.Start = true
+	s.bookmarks[b.Name] = b
+	return s.write()
+}
+
+// start returns the start bookmark, false if there is none.
+func (s *bookmarkStore) start() (bookmark, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, b := range s.bookmarks {
+		if b.Start {
+			return b, true
+		}
+	}
+	return bookmark{}, false
+}
+
+func (s *bookmarkStore) remove(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.bookmarks[name]; !ok {
+		return errUnknownBookmark
+	}
+
+	delete(s.bookmarks, name)
+	return s.write()
+}
+
+// write replaces the file atomically so readers never see a partial store.
+func (s *bookmarkStore) write() error {
+	data, err := json.MarshalIndent(s.sorted(), "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.file), ".bookmarks")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.file)
+}
@@ -0,0 +1,130 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBookmarkStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "octatron")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := bookmarkFile(filepath.Join(dir, "tree.oct"))
+	store, err := openBookmarks(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.list()) != 0 {
+		t.Error("expected empty store")
+	}
+
+	tower := bookmark{"tower", [3]float32{1, 2, 3}, 0.5, -0.5, false}
+	for _, b := range []bookmark{tower, {"bridge", [3]float32{4, 5, 6}, 0, 0, false}} {
+		if err := store.save(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.save(bookmark{}); err == nil {
+		t.Error("expected error for bookmark without name")
+	}
+
+	if b, err := store.get("tower"); err != nil || b != tower {
+		t.Error("unexpected bookmark:", b, err)
+	}
+
+	if _, err := store.get("castle"); err != errUnknownBookmark {
+		t.Error("expected unknown bookmark, got:", err)
+	}
+
+	tower.XRot = 1
+	if err := store.save(tower); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bookmarks are persisted and listed by name.
+	store, err = openBookmarks(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := store.list()
+	if len(list) != 2 || list[0].Name != "bridge" || list[1] != tower {
+		t.Error("unexpected bookmarks:", list)
+	}
+
+	if err := store.remove("bridge"); err != nil {
+		t.Error(err)
+	}
+
+	if err := store.remove("bridge"); err != errUnknownBookmark {
+		t.Error("expected unknown bookmark, got:", err)
+	}
+
+	if store, err = openBookmarks(file); err != nil {
+		t.Fatal(err)
+	}
+
+	if list := store.list(); len(list) != 1 || list[0] != tower {
+		t.Error("unexpected bookmarks after delete:", list)
+	}
+
+	// The start bookmark is persisted, kept when it is saved again and replaced
+	// by the next one.
+	if _, ok := store.start(); ok {
+		t.Error("expected no start bookmark")
+	}
+	home := bookmark{"home", [3]float32{0, 1, 0}, 0, 0, false}
+	if err := store.saveStart(home); err != nil {
+		t.Fatal(err)
+	}
+	home.XRot = 1
+	if err := store.save(home); err != nil {
+		t.Fatal(err)
+	}
+	if store, err = openBookmarks(file); err != nil {
+		t.Fatal(err)
+	}
+	home.Start = true
+	if b, ok := store.start(); !ok || b != home {
+		t.Error("unexpected start bookmark:", b, ok)
+	}
+
+	if err := store.saveStart(tower); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := store.get("home"); err != nil || b.Start {
+		t.Error("expected the previous start bookmark to be replaced:", b, err)
+	}
+	if b, ok := store.start(); !ok || b.Name != "tower" {
+		t.Error("unexpected start bookmark:", b, ok)
+	}
+
+	// No temporary files are left behind.
+	if files, _ := filepath.Glob(filepath.Join(dir, ".bookmarks*")); len(files) != 0 {
+		t.Error("temporary files left:", files)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import "time"
+
+const (
+	// throttledFrameTime is the shortest time between frames of throttled clients.
+	throttledFrameTime = 100 * time.Millisecond
+
+	budgetThrottle   = "throttle"
+	budgetDisconnect = "disconnect"
+)
+
+type (
+	budgetSpan struct {
+		at    time.Time
+		spent time.Duration
+	}
+
+	// renderBudget sums the render time of a connection within a sliding window.
+	renderBudget struct {
+		window time.Duration
+		spans  []budgetSpan
+		total  time.Duration
+	}
+
+	// connStats are the totals of a connection, logged when it is closed. The
+	// bytes are written by the frame sender.
+	connStats struct {
+		bytes      int64
+		renderTime time.Duration
+	}
+)
+
+// add records render time spent on a frame that completed at now.
+func (b *renderBudget) add(now time.Time, spent time.Duration) {
+	b.spans = append(b.spans, budgetSpan{now, spent})
+	b.total += spent
+}
+
+// used returns the render time spent within the window before now.
+func (b *renderBudget) used(now time.Time) time.Duration {
+	for len(b.spans) > 0 && now.Sub(b.spans[0].at) >= b.window {
+		b.total -= b.spans[0].spent
+		b.spans = b.spans[1:]
+	}
+	return b.total
+}
+
+// budgetLimit returns the render time a client may use per budget window, zero if
+// it is unlimited.
+func budgetLimit() time.Duration {
+	return time.Duration(config.RenderBudget * float64(time.Second))
+}
+
+// throttled returns the quality throttled clients are rendered at, half the
+// resolution with a single sample per pixel.
+func (q quality) throttled() quality {
+	q.Width = q.Width / 2 &^ 1
+	q.Height /= 2
+	if q.Width < 2 {
+		q.Width = 2
+	}
+	if q.Height < 1 {
+		q.Height = 1
+	}
+	if q.Samples > 1 {
+		q.Samples = 1
+	}
+	return q
+}
@@ -0,0 +1,122 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestRenderBudget(t *testing.T) {
+	budget := renderBudget{window: time.Minute}
+	start := time.Now()
+
+	budget.add(start, 10*time.Millisecond)
+	budget.add(start.Add(30*time.Second), 20*time.Millisecond)
+
+	for _, c := range []struct {
+		at   time.Duration
+		used time.Duration
+	}{
+		{30 * time.Second, 30 * time.Millisecond},
+		{61 * time.Second, 20 * time.Millisecond},
+		{2 * time.Minute, 0},
+	} {
+		if used := budget.used(start.Add(c.at)); used != c.used {
+			t.Errorf("after %v: expected %v used, got %v", c.at, c.used, used)
+		}
+	}
+
+	q := quality{64, 32, 4, true, "RGBA", false}
+	if throttled := q.throttled(); throttled != (quality{32, 16, 1, true, "RGBA", false}) {
+		t.Error("unexpected throttled quality:", throttled)
+	}
+
+	q = quality{Width: 2, Height: 1}
+	if throttled := q.throttled(); throttled.Width != 2 || throttled.Height != 1 {
+		t.Error("throttled quality is below the minimum resolution:", throttled)
+	}
+}
+
+// heavyClient sends camera updates that all need a new frame and returns the first
+// message that is not a frame.
+func heavyClient(ws *websocket.Conn) []byte {
+	for i := 0; i < 10; i++ {
+		var update updateMessage
+		update.Camera.Position = [3]float32{0.5, 0.5, 2 + float32(i)}
+		if err := websocket.JSON.Send(ws, update); err != nil {
+			panic(err)
+		}
+
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			panic(err)
+		}
+		if !bytes.HasPrefix(data, frameMagic) {
+			return data
+		}
+	}
+	return nil
+}
+
+func TestRenderBudgetThrottle(t *testing.T) {
+	server := startTestServer("", 0)
+	config.RenderBudget = 1e-9
+
+	_, ws := handshake(server, "")
+
+	var msg qualityMessage
+	if err := json.Unmarshal(heavyClient(ws), &msg); err != nil {
+		t.Fatal("expected quality message:", err)
+	}
+
+	// The test setup asks for 32x16.
+	if msg.Quality.Width != 16 || msg.Quality.Height != 8 {
+		t.Errorf("expected throttled quality, got %+v", msg.Quality)
+	}
+	if n := atomic.LoadInt64(&metrics.throttled); n != 1 {
+		t.Errorf("expected one throttled client, got %v", n)
+	}
+
+	ws.Close()
+	server.Close()
+
+	if n := atomic.LoadInt64(&metrics.throttled); n != 0 {
+		t.Errorf("expected no throttled clients after disconnect, got %v", n)
+	}
+}
+
+func TestRenderBudgetDisconnect(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+	config.RenderBudget = 1e-9
+	config.BudgetAction = budgetDisconnect
+
+	_, ws := handshake(server, "")
+	defer ws.Close()
+
+	var msg errorMessage
+	if err := json.Unmarshal(heavyClient(ws), &msg); err != nil || msg.Error != renderBudgetError {
+		t.Fatalf("expected %s, got %+v", renderBudgetError, msg)
+	}
+	expectClosed(t, ws)
+}
@@ -0,0 +1,97 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"math"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+// viewEpsilon is how much camera values may differ for views to be equal.
+const viewEpsilon = 1e-5
+
+type (
+	// renderView is everything a client update changes that affects a frame.
+	renderView struct {
+		camera    trace.FreeFlightCamera
+		cursor    [2]float32
+		hasCursor bool
+		tree      *treeData
+		frame     int
+	}
+
+	// renderCache counts the frames rendered in a row for the same view, so a
+	// client that stopped moving is sent the last frame again instead of a new
+	// render.
+	renderCache struct {
+		view   renderView
+		frames int
+	}
+)
+
+func newRenderView(camera trace.FreeFlightCamera, cursor *[2]float32, tree *treeData, frame int) renderView {
+	view := renderView{camera: camera, tree: tree, frame: frame}
+	if cursor != nil {
+		view.cursor, view.hasCursor = *cursor, true
+	}
+	return view
+}
+
+func nearlyEqual(a, b float32) bool {
+	return math.Abs(float64(a-b)) <= viewEpsilon
+}
+
+func (v *renderView) equal(o *renderView) bool {
+	if v.tree != o.tree || v.frame != o.frame || v.hasCursor != o.hasCursor {
+		return false
+	}
+
+	values := [...][2]float32{
+		{v.camera.Pos[0], o.camera.Pos[0]},
+		{v.camera.Pos[1], o.camera.Pos[1]},
+		{v.camera.Pos[2], o.camera.Pos[2]},
+		{v.camera.XRot, o.camera.XRot},
+		{v.camera.YRot, o.camera.YRot},
+		{v.cursor[0], o.cursor[0]},
+		{v.cursor[1], o.cursor[1]},
+	}
+
+	for _, ab := range values {
+		if !nearlyEqual(ab[0], ab[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// hit returns true if at least needed frames were rendered for view. A different
+// view restarts the count.
+func (c *renderCache) hit(view *renderView, needed int) bool {
+	if !c.view.equal(view) {
+		c.view = *view
+		c.frames = 0
+		return false
+	}
+	return c.frames >= needed
+}
+
+// rendered counts a frame rendered for the current view.
+func (c *renderCache) rendered() {
+	c.frames++
+}
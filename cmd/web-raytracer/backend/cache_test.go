@@ -0,0 +1,123 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+func TestRenderCache(t *testing.T) {
+	for _, jitter := range []bool{false, true} {
+		server := startTestServer("", 0)
+		config.Jitter = jitter
+
+		_, ws := handshake(server, "")
+
+		rendered := atomic.LoadInt64(&metrics.framesRendered)
+		hits := atomic.LoadInt64(&metrics.cacheHits)
+
+		for i := 0; i < 5; i++ {
+			if msg := nextMessage(ws); msg != nil {
+				t.Fatal("expected a frame, got:", msg)
+			}
+		}
+
+		needed := int64(1)
+		if jitter {
+			needed = 2
+		}
+
+		if n := atomic.LoadInt64(&metrics.framesRendered) - rendered; n != needed {
+			t.Errorf("expected %v renders with jitter %v, got %v", needed, jitter, n)
+		}
+
+		if n := atomic.LoadInt64(&metrics.cacheHits) - hits; n != 5-needed {
+			t.Errorf("expected %v cache hits with jitter %v, got %v", 5-needed, jitter, n)
+		}
+
+		// A moved camera is rendered again.
+		var update updateMessage
+		update.Camera.Position = [3]float32{0.5, 0.6, 2}
+		if err := websocket.JSON.Send(ws, update); err != nil {
+			panic(err)
+		}
+
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := atomic.LoadInt64(&metrics.framesRendered) - rendered; n != needed+1 {
+			t.Errorf("expected the moved camera to be rendered, got %v renders", n)
+		}
+
+		ws.Close()
+		server.Close()
+	}
+}
+
+func TestRenderViewEqual(t *testing.T) {
+	tree := &treeData{}
+	a := newRenderView(trace.FreeFlightCamera{Pos: trace.Vec3{1, 2, 3}, XRot: 0.5}, nil, tree, 0)
+
+	b := a
+	b.camera.Pos[1] += viewEpsilon / 2
+	if !a.equal(&b) {
+		t.Error("expected views within epsilon to be equal")
+	}
+
+	for _, change := range []func(v *renderView){
+		func(v *renderView) { v.camera.YRot = 0.1 },
+		func(v *renderView) { v.camera.Pos[2] = 3.1 },
+		func(v *renderView) { v.cursor, v.hasCursor = [2]float32{0, 0}, true },
+		func(v *renderView) { v.tree = &treeData{} },
+		func(v *renderView) { v.frame = 1 },
+	} {
+		b := a
+		change(&b)
+		if a.equal(&b) {
+			t.Errorf("expected %+v to differ from %+v", b, a)
+		}
+	}
+}
+
+func TestAccumulateStillCamera(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+	config.Jitter = false
+	config.Accumulate = 4
+
+	_, ws := handshake(server, "")
+	defer ws.Close()
+
+	rendered := atomic.LoadInt64(&metrics.framesRendered)
+	for i := 0; i < 6; i++ {
+		if msg := nextMessage(ws); msg != nil {
+			t.Fatal("expected a frame, got:", msg)
+		}
+	}
+
+	if n := atomic.LoadInt64(&metrics.framesRendered) - rendered; n != 4 {
+		t.Errorf("expected 4 accumulated renders, got %v", n)
+	}
+}
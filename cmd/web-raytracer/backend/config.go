@@ -0,0 +1,439 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+// envPrefix is prepended to the upper-case flag name to form the environment
+// variable that overrides it. The flag "max-clients" is overridden by
+// OCTATRON_MAX_CLIENTS.
+const envPrefix = "OCTATRON_"
+
+type serverConfig struct {
+	Listen  string `json:"listen"`
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+	Web     string `json:"web"`
+
+	// Demo serves the embedded frontend and sample tree on localhost and opens
+	// the browser. Web, DataDir and Tree are ignored.
+	Demo bool `json:"demo"`
+
+	// DataDir is the directory trees are loaded from. Tree is relative to it
+	// and the first readable tree in the directory is used if it is empty.
+	DataDir string `json:"data_dir"`
+	Tree    string `json:"tree"`
+
+	// Scene is a scene file, see package scene. Its first tree is served with
+	// the fog, ground plane, lights and cameras of the scene, DataDir and Tree
+	// are ignored.
+	Scene string `json:"scene"`
+
+	MaxClients   int     `json:"max_clients"`
+	MaxWidth     int     `json:"max_width"`
+	MaxHeight    int     `json:"max_height"`
+	MaxSamples   int     `json:"max_samples"`
+	Timeout      uint    `json:"timeout"`
+	ViewDistance float64 `json:"view_distance"`
+	Jitter       bool    `json:"jitter"`
+
+	// Accumulate is the number of samples per pixel frames are refined to while
+	// the camera is still, zero to disable. It requires Jitter to be disabled
+	// and is not used by foveated clients.
+	Accumulate int `json:"accumulate"`
+
+	// IdleTimeout is the number of seconds without camera input after which the
+	// camera of a client blends into an orbit around the tree, zero to disable.
+	// IdleOrbit is the number of seconds of a full orbit. Clients can change
+	// both in their setup.
+	IdleTimeout float64 `json:"idle_timeout"`
+	IdleOrbit   float64 `json:"idle_orbit"`
+
+	// MaxFPS is the number of frames per second rendered for each client, zero
+	// for unlimited. Unchanged views are sent again without rendering either way.
+	MaxFPS float64 `json:"max_fps"`
+
+	// AdaptQuality lowers the color format and then the resolution of clients
+	// whose connection can't send their frames within a frame at MaxFPS, or at
+	// 30 frames per second without it, and raises it again when the bandwidth
+	// allows. Clients are told the quality they are rendered at.
+	AdaptQuality bool `json:"adapt_quality"`
+
+	// MaxMemory is the number of bytes a tree may use once loaded, zero for
+	// unlimited.
+	MaxMemory int64 `json:"max_memory"`
+
+	// MemoryBudget is the number of bytes the cached trees and the frame
+	// buffers of the clients may use together, zero for unlimited. Unused trees
+	// are evicted to make room, then new clients get a lower resolution, and
+	// clients that still don't fit are rejected.
+	MemoryBudget int64 `json:"memory_budget"`
+
+	// MaxNodes is the number of nodes a tree may have, checked before the nodes
+	// are allocated so forged headers can't exhaust the memory of the server.
+	MaxNodes uint64 `json:"max_nodes"`
+
+	// Reload is the number of seconds between checks for changed tree files,
+	// zero to disable. Changed trees are loaded again and sent to the clients
+	// viewing them.
+	Reload uint `json:"reload"`
+
+	// Edit lets clients edit the trees they view. Edits are kept in memory and
+	// lost when the tree is loaded again, they are never written to the file.
+	// Autosave is the number of seconds between saves of the edited trees to
+	// their autosave files, see autosaveName, zero to disable.
+	Edit     bool `json:"edit"`
+	Autosave uint `json:"autosave"`
+
+	// Verbose is the log level. Errors are always logged, 1 adds connections
+	// and 2 adds client messages and the summary of every frame rendered.
+	Verbose int  `json:"verbose"`
+	Pprof   bool `json:"pprof"`
+
+	// Logger receives the log of the server and its raytracers. If nil it is
+	// written to the standard logger, debug messages only at a Verbose of two.
+	Logger pack.Logger `json:"-"`
+
+	// AuthToken is the shared secret clients must send in the setup message.
+	// Authentication is disabled if it is empty. MaxAttempts limits the number
+	// of connection attempts per minute from a single address.
+	AuthToken   string `json:"auth_token"`
+	MaxAttempts int    `json:"max_attempts"`
+
+	// RenderBudget is the number of seconds of render time a client may use
+	// within BudgetWindow seconds, zero for unlimited. Clients over the budget
+	// are throttled or disconnected, as given by BudgetAction.
+	RenderBudget float64 `json:"render_budget"`
+	BudgetWindow uint    `json:"budget_window"`
+	BudgetAction string  `json:"budget_action"`
+
+	// DrainTimeout is the number of seconds the sessions are given to finish
+	// their frames when the server is stopped with SIGINT or SIGTERM.
+	DrainTimeout uint `json:"drain_timeout"`
+
+	// FrameTimeout is the number of seconds a frame may render before it is
+	// aborted and the view logged, zero to disable.
+	FrameTimeout uint `json:"frame_timeout"`
+
+	// RecordDir archives the frames sent to every client, in a directory per
+	// session with a manifest of the cameras. RecordFormat is jpg or png for
+	// numbered images, or avi for a Motion JPEG video. RecordCmd is started for
+	// every session with the raw RGBA frames on stdin, {width}, {height} and
+	// {fps} in its arguments are replaced with the frame size and RecordFPS.
+	// Videos and the command get a constant RecordFPS, frames are repeated to
+	// keep their timing. Frames are dropped rather than slowing down the
+	// session.
+	RecordDir    string  `json:"record_dir"`
+	RecordFormat string  `json:"record_format"`
+	RecordCmd    string  `json:"record_cmd"`
+	RecordFPS    float64 `json:"record_fps"`
+
+	// Coordinator makes the server list the render servers registered with it
+	// instead of rendering. Register is the URL of the coordinator to send
+	// heartbeats to every Heartbeat seconds, with PublicAddr as the address
+	// clients connect to. CoordinatorToken is the secret heartbeats must carry.
+	Coordinator      bool   `json:"coordinator"`
+	Register         string `json:"register"`
+	PublicAddr       string `json:"public_addr"`
+	Heartbeat        uint   `json:"heartbeat"`
+	CoordinatorToken string `json:"coordinator_token"`
+}
+
+func defaultConfig() serverConfig {
+	return serverConfig{
+		Listen:       ":8080",
+		Web:          "cmd/web-raytracer/frontend",
+		DataDir:      ".",
+		Tree:         "tree.oct",
+		MaxClients:   16,
+		MaxWidth:     1280,
+		MaxHeight:    720,
+		MaxSamples:   4,
+		Timeout:      3,
+		ViewDistance: 1,
+		Jitter:       true,
+		IdleOrbit:    60,
+		Verbose:      1,
+		MaxAttempts:  30,
+		MaxNodes:     1 << 26,
+		Reload:       2,
+		BudgetWindow: 60,
+		BudgetAction: budgetThrottle,
+		DrainTimeout: 10,
+		FrameTimeout: 10,
+		RecordFormat: recordJPEG,
+		RecordFPS:    30,
+		Heartbeat:    5,
+	}
+}
+
+func (cfg *serverConfig) flags(fs *flag.FlagSet, configFile *string) {
+	fs.StringVar(configFile, "config", *configFile, "JSON configuration file")
+	fs.StringVar(&cfg.Listen, "listen", cfg.Listen, "listen address")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", cfg.TLSCert, "TLS certificate file")
+	fs.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey, "TLS key file")
+	fs.StringVar(&cfg.Web, "web", cfg.Web, "web frontend location")
+	fs.BoolVar(&cfg.Demo, "demo", cfg.Demo, "serve the embedded frontend and sample tree on localhost and open the browser")
+	fs.StringVar(&cfg.DataDir, "data", cfg.DataDir, "directory containing trees")
+	fs.StringVar(&cfg.Tree, "tree", cfg.Tree, "octree to serve clients, relative to the data directory")
+	fs.StringVar(&cfg.Scene, "scene", cfg.Scene, "scene file, its first tree is served with its fog, ground plane, lights and cameras")
+	fs.IntVar(&cfg.MaxClients, "max-clients", cfg.MaxClients, "max number of concurrent clients, 0 for unlimited")
+	fs.IntVar(&cfg.MaxWidth, "max-width", cfg.MaxWidth, "max client resolution width")
+	fs.IntVar(&cfg.MaxHeight, "max-height", cfg.MaxHeight, "max client resolution height")
+	fs.IntVar(&cfg.MaxSamples, "max-samples", cfg.MaxSamples, "max samples per pixel a client may ask for")
+	fs.UintVar(&cfg.Timeout, "timeout", cfg.Timeout, "max session length in minutes")
+	fs.Float64Var(&cfg.ViewDistance, "dist", cfg.ViewDistance, "max view-distance")
+	fs.BoolVar(&cfg.Jitter, "jitter", cfg.Jitter, "enables frame jitter")
+	fs.IntVar(&cfg.Accumulate, "accumulate", cfg.Accumulate, "samples per pixel to refine still frames to, requires -jitter=false")
+	fs.Float64Var(&cfg.IdleTimeout, "idle-timeout", cfg.IdleTimeout, "seconds without camera input before the camera orbits the tree, 0 to disable")
+	fs.Float64Var(&cfg.IdleOrbit, "idle-orbit", cfg.IdleOrbit, "seconds of a full idle orbit")
+	fs.Float64Var(&cfg.MaxFPS, "max-fps", cfg.MaxFPS, "max frames per second rendered for each client, 0 for unlimited")
+	fs.BoolVar(&cfg.AdaptQuality, "adapt-quality", cfg.AdaptQuality, "lowers the quality of clients with too little bandwidth for their frames")
+	fs.Int64Var(&cfg.MaxMemory, "max-memory", cfg.MaxMemory, "max bytes used by a loaded tree, 0 for unlimited")
+	fs.Int64Var(&cfg.MemoryBudget, "memory-budget", cfg.MemoryBudget, "max bytes used by the cached trees and client buffers together, 0 for unlimited")
+	fs.Uint64Var(&cfg.MaxNodes, "max-nodes", cfg.MaxNodes, "max nodes of a loaded tree")
+	fs.UintVar(&cfg.Reload, "reload", cfg.Reload, "seconds between checks for changed trees, 0 to disable")
+	fs.BoolVar(&cfg.Edit, "edit", cfg.Edit, "lets clients edit the trees they view")
+	fs.UintVar(&cfg.Autosave, "autosave", cfg.Autosave, "seconds between saves of edited trees, 0 to disable")
+	fs.IntVar(&cfg.Verbose, "v", cfg.Verbose, "log verbosity")
+	fs.BoolVar(&cfg.Pprof, "pprof", cfg.Pprof, "enables cpu profiler and pprof over http, port 6060")
+	fs.StringVar(&cfg.AuthToken, "auth-token", cfg.AuthToken, "shared secret required from clients")
+	fs.IntVar(&cfg.MaxAttempts, "max-attempts", cfg.MaxAttempts, "max connection attempts per minute and address, 0 for unlimited")
+	fs.Float64Var(&cfg.RenderBudget, "render-budget", cfg.RenderBudget, "seconds of render time per client and budget window, 0 for unlimited")
+	fs.UintVar(&cfg.BudgetWindow, "budget-window", cfg.BudgetWindow, "length of the render budget window in seconds")
+	fs.StringVar(&cfg.BudgetAction, "budget-action", cfg.BudgetAction, "what happens to clients over the render budget, throttle or disconnect")
+	fs.UintVar(&cfg.DrainTimeout, "drain-timeout", cfg.DrainTimeout, "seconds to let sessions finish when the server is stopped")
+	fs.UintVar(&cfg.FrameTimeout, "frame-timeout", cfg.FrameTimeout, "seconds a frame may render before it is aborted, 0 to disable")
+	fs.StringVar(&cfg.RecordDir, "record-dir", cfg.RecordDir, "directory to record the frames of every session to")
+	fs.StringVar(&cfg.RecordFormat, "record-format", cfg.RecordFormat, "format of recorded sessions, jpg, png or avi")
+	fs.StringVar(&cfg.RecordCmd, "record-cmd", cfg.RecordCmd, "command to pipe the raw frames of every session to")
+	fs.Float64Var(&cfg.RecordFPS, "record-fps", cfg.RecordFPS, "frame rate of recorded videos and the record command, 0 to pipe every frame once")
+	fs.BoolVar(&cfg.Coordinator, "coordinator", cfg.Coordinator, "list registered render servers instead of rendering")
+	fs.StringVar(&cfg.Register, "register", cfg.Register, "URL of the coordinator to register with")
+	fs.StringVar(&cfg.PublicAddr, "public-addr", cfg.PublicAddr, "address clients connect to, sent to the coordinator")
+	fs.UintVar(&cfg.Heartbeat, "heartbeat", cfg.Heartbeat, "seconds between heartbeats to the coordinator")
+	fs.StringVar(&cfg.CoordinatorToken, "coordinator-token", cfg.CoordinatorToken, "shared secret required in heartbeats")
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// parseConfig builds the configuration from the defaults, the configuration file,
+// the environment and the command line, in increasing order of priority.
+func parseConfig(args []string, getenv func(string) string) (serverConfig, error) {
+	var (
+		cfg        = defaultConfig()
+		scratch    = cfg
+		configFile = getenv(envName("config"))
+	)
+
+	// The command line is parsed twice, first to find the configuration file.
+	fs := flag.NewFlagSet("backend", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	scratch.flags(fs, &configFile)
+
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if configFile != "" {
+		data, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return cfg, err
+		}
+
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("%s: %v", configFile, err)
+		}
+	}
+
+	fs = flag.NewFlagSet("backend", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	cfg.flags(fs, &configFile)
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if v := getenv(envName(f.Name)); v != "" && err == nil {
+			if e := fs.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("%s: %v", envName(f.Name), e)
+			}
+		}
+	})
+
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, fs.Parse(args)
+}
+
+func isTree(file string) bool {
+	fp, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer fp.Close()
+
+	if _, err := pack.OpenSequence(fp); err == nil {
+		return true
+	}
+
+	if _, err := fp.Seek(0, 0); err != nil {
+		return false
+	}
+
+	var header pack.OctreeHeader
+	return pack.DecodeHeader(fp, &header) == nil
+}
+
+// findTrees returns the readable trees in dir.
+func findTrees(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var trees []string
+	for _, f := range files {
+		file := filepath.Join(dir, f.Name())
+		if f.Mode().IsRegular() && isTree(file) {
+			trees = append(trees, file)
+		}
+	}
+	return trees, nil
+}
+
+// treePath returns the tree to serve. The configuration is expected to be valid.
+func (cfg *serverConfig) treePath() string {
+	if cfg.Tree != "" {
+		return filepath.Join(cfg.DataDir, cfg.Tree)
+	}
+
+	trees, _ := findTrees(cfg.DataDir)
+	return trees[0]
+}
+
+func (cfg *serverConfig) validate() error {
+	if cfg.Listen == "" {
+		return errors.New("no listen address")
+	}
+
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return errors.New("both TLS certificate and key must be given")
+	}
+
+	if cfg.MaxClients < 0 || cfg.MaxAttempts < 0 || cfg.MaxMemory < 0 || cfg.MemoryBudget < 0 || cfg.MaxSamples < 0 || cfg.MaxNodes == 0 || cfg.MaxWidth <= 0 || cfg.MaxHeight <= 0 {
+		return errors.New("invalid client limits")
+	}
+
+	if cfg.Timeout == 0 || cfg.ViewDistance <= 0 || cfg.MaxFPS < 0 {
+		return errors.New("invalid session settings")
+	}
+
+	if cfg.RenderBudget < 0 || cfg.BudgetWindow == 0 || (cfg.BudgetAction != budgetThrottle && cfg.BudgetAction != budgetDisconnect) {
+		return errors.New("invalid render budget")
+	}
+
+	if !(cfg.RecordFPS >= 0) || (cfg.RecordFormat == recordAVI && cfg.RecordFPS == 0) {
+		return errors.New("invalid record frame rate")
+	}
+
+	switch cfg.RecordFormat {
+	case recordJPEG, recordPNG, recordAVI:
+	default:
+		return fmt.Errorf("unknown record format %q", cfg.RecordFormat)
+	}
+
+	if (cfg.Coordinator || cfg.Register != "") && cfg.Heartbeat == 0 {
+		return errors.New("invalid heartbeat interval")
+	}
+
+	if cfg.Coordinator {
+		if cfg.Register != "" {
+			return errors.New("a coordinator can't register with another coordinator")
+		}
+		return nil
+	}
+
+	if cfg.Register != "" && cfg.PublicAddr == "" {
+		return errors.New("no public address to register")
+	}
+
+	if info, err := os.Stat(cfg.DataDir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", cfg.DataDir)
+	}
+
+	if cfg.Tree != "" {
+		if file := cfg.treePath(); !isTree(file) {
+			return fmt.Errorf("%s is not a readable tree", file)
+		}
+		return nil
+	}
+
+	trees, err := findTrees(cfg.DataDir)
+	if err != nil {
+		return err
+	}
+
+	if len(trees) == 0 {
+		return fmt.Errorf("%s contains no readable trees", cfg.DataDir)
+	}
+	return nil
+}
+
+// serverLog returns config.Logger, or the standard logger at the level of
+// config.Verbose.
+func serverLog() pack.Logger {
+	if config.Logger != nil {
+		return config.Logger
+	}
+
+	level := pack.LogInfo
+	if config.Verbose >= 2 {
+		level = pack.LogDebug
+	}
+	return pack.StdLogger(nil, level)
+}
+
+// logv logs if the verbosity is at least level, as info or, from level two, as
+// debug messages.
+func logv(level int, v ...interface{}) {
+	if config.Verbose < level {
+		return
+	}
+
+	msg := strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+	if level >= 2 {
+		serverLog().Debugf("%s", msg)
+	} else {
+		serverLog().Infof("%s", msg)
+	}
+}
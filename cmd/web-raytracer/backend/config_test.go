@@ -0,0 +1,131 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+func TestParseConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "octatron")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "config.json")
+	data := []byte(`{"listen": ":9000", "max_clients": 4, "jitter": false, "tree": "a.oct"}`)
+	if err := ioutil.WriteFile(configFile, data, 0644); err != nil {
+		panic(err)
+	}
+
+	env := map[string]string{
+		"OCTATRON_CONFIG":      configFile,
+		"OCTATRON_MAX_CLIENTS": "8",
+		"OCTATRON_TREE":        "b.oct",
+	}
+	getenv := func(key string) string { return env[key] }
+
+	cfg, err := parseConfig([]string{"-tree", "c.oct", "-max-width", "640"}, getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Listen != ":9000" || cfg.Jitter {
+		t.Error("configuration file was not applied:", cfg)
+	}
+
+	if cfg.MaxClients != 8 {
+		t.Error("environment does not override configuration file:", cfg.MaxClients)
+	}
+
+	if cfg.Tree != "c.oct" || cfg.MaxWidth != 640 {
+		t.Error("flags does not override environment:", cfg)
+	}
+
+	if cfg.MaxHeight != defaultConfig().MaxHeight {
+		t.Error("default was not kept:", cfg.MaxHeight)
+	}
+
+	if _, err := parseConfig([]string{"-max-clients", "many"}, getenv); err == nil {
+		t.Error("expected error for invalid flag")
+	}
+
+	env["OCTATRON_JITTER"] = "maybe"
+	if _, err := parseConfig(nil, getenv); err == nil {
+		t.Error("expected error for invalid environment variable")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "octatron")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := defaultConfig()
+	cfg.DataDir = filepath.Join(dir, "missing")
+	if cfg.validate() == nil {
+		t.Error("expected error for missing data directory")
+	}
+
+	cfg.DataDir = dir
+	cfg.Tree = ""
+	if cfg.validate() == nil {
+		t.Error("expected error for data directory without trees")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "tree.oct.png"), []byte("not a tree"), 0644); err != nil {
+		panic(err)
+	}
+
+	fp, err := os.Create(filepath.Join(dir, "tree.oct"))
+	if err != nil {
+		panic(err)
+	}
+
+	if err := pack.EncodeHeader(fp, pack.NewOctreeHeader(pack.MipR8G8B8A8UnpackUI32, 1)); err != nil {
+		panic(err)
+	}
+	fp.Close()
+
+	if err := cfg.validate(); err != nil {
+		t.Error(err)
+	}
+
+	if file := cfg.treePath(); file != filepath.Join(dir, "tree.oct") {
+		t.Error("unexpected tree:", file)
+	}
+
+	cfg.Tree = "tree.oct.png"
+	if cfg.validate() == nil {
+		t.Error("expected error for unreadable tree")
+	}
+
+	cfg.Tree = "tree.oct"
+	cfg.TLSCert = "cert.pem"
+	if cfg.validate() == nil {
+		t.Error("expected error for certificate without key")
+	}
+}
@@ -0,0 +1,221 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	serversPath = "/servers"
+
+	// heartbeatExpiry is the number of heartbeat intervals a server is listed for
+	// after its last heartbeat.
+	heartbeatExpiry = 3
+)
+
+// heartbeat is posted by render servers to the coordinator. Addr is the address
+// clients connect to and FrameTime the average render time of a frame since the
+// last heartbeat, in milliseconds. Leaving removes the server from the list.
+type heartbeat struct {
+	Addr       string  `json:"addr"`
+	Clients    int     `json:"clients"`
+	MaxClients int     `json:"max_clients"`
+	FrameTime  float64 `json:"frame_time"`
+	Leaving    bool    `json:"leaving,omitempty"`
+}
+
+func (h *heartbeat) full() bool {
+	return h.MaxClients > 0 && h.Clients >= h.MaxClients
+}
+
+// coordinator keeps the render servers that sent a heartbeat recently and lists
+// them, least loaded first, for the frontend to pick from.
+type coordinator struct {
+	lock    sync.Mutex
+	token   string
+	expiry  time.Duration
+	servers map[string]heartbeat
+	seen    map[string]time.Time
+	now     func() time.Time
+}
+
+func newCoordinator(token string, interval time.Duration) *coordinator {
+	return &coordinator{
+		token:   token,
+		expiry:  heartbeatExpiry * interval,
+		servers: make(map[string]heartbeat),
+		seen:    make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+// update records a heartbeat.
+func (c *coordinator) update(h heartbeat) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if h.Leaving {
+		delete(c.servers, h.Addr)
+		delete(c.seen, h.Addr)
+		return
+	}
+	c.servers[h.Addr] = h
+	c.seen[h.Addr] = c.now()
+}
+
+// list evicts the servers with stale heartbeats and returns the others. Servers
+// with free slots come first, then fewer clients and then shorter frame times.
+func (c *coordinator) list() []heartbeat {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.now()
+	list := make([]heartbeat, 0, len(c.servers))
+	for addr, h := range c.servers {
+		if now.Sub(c.seen[addr]) > c.expiry {
+			delete(c.servers, addr)
+			delete(c.seen, addr)
+			continue
+		}
+		list = append(list, h)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		a, b := &list[i], &list[j]
+		switch {
+		case a.full() != b.full():
+			return b.full()
+		case a.Clients != b.Clients:
+			return a.Clients < b.Clients
+		case a.FrameTime != b.FrameTime:
+			return a.FrameTime < b.FrameTime
+		}
+		return a.Addr < b.Addr
+	})
+	return list
+}
+
+func (c *coordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(c.list())
+	case http.MethodPost:
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if c.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) != 1 {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		var h heartbeat
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&h); err != nil || h.Addr == "" {
+			http.Error(w, "invalid heartbeat", http.StatusBadRequest)
+			return
+		}
+		c.update(h)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// postHeartbeat sends h to the coordinator at url.
+func postHeartbeat(url, token string, h heartbeat) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(url, "/")+serversPath, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("heartbeat rejected: %s", resp.Status)
+	}
+	return nil
+}
+
+// frameTimer computes the average frame time from the metrics between calls.
+type frameTimer struct {
+	rendered, renderTime int64
+}
+
+func (t *frameTimer) average(m *serverMetrics) float64 {
+	rendered, renderTime := atomic.LoadInt64(&m.framesRendered), atomic.LoadInt64(&m.renderTime)
+	frames, spent := rendered-t.rendered, renderTime-t.renderTime
+	t.rendered, t.renderTime = rendered, renderTime
+
+	if frames <= 0 {
+		return 0
+	}
+	return float64(spent) / float64(frames) / float64(time.Millisecond)
+}
+
+// register sends a heartbeat for addr to the coordinator at url every interval
+// until stop is closed. The server is then removed from the list.
+func register(url, token, addr string, interval time.Duration, stop <-chan struct{}) {
+	var timer frameTimer
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		h := heartbeat{
+			Addr:       addr,
+			Clients:    int(atomic.LoadInt64(&metrics.clients)),
+			MaxClients: config.MaxClients,
+			FrameTime:  timer.average(&metrics),
+		}
+
+		if err := postHeartbeat(url, token, h); err != nil {
+			logv(1, "coordinator:", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			h.Leaving = true
+			if err := postHeartbeat(url, token, h); err != nil {
+				logv(1, "coordinator:", err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a settable clock for the coordinator.
+type fakeClock struct {
+	lock sync.Mutex
+	t    time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.lock.Lock()
+	c.t = c.t.Add(d)
+	c.lock.Unlock()
+}
+
+// listServers returns the addresses listed by the coordinator, in order.
+func listServers(url string) []string {
+	resp, err := http.Get(url + serversPath)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+
+	var list []heartbeat
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		panic(err)
+	}
+
+	addrs := []string{}
+	for _, h := range list {
+		addrs = append(addrs, h.Addr)
+	}
+	return addrs
+}
+
+// connectFirst picks a server the way the frontend does, trying the listed
+// servers in order until one answers.
+func connectFirst(addrs []string) string {
+	for _, addr := range addrs {
+		if resp, err := http.Get("http://" + addr + "/render"); err == nil {
+			resp.Body.Close()
+			return addr
+		}
+	}
+	return ""
+}
+
+func TestCoordinator(t *testing.T) {
+	const (
+		token    = "secret"
+		interval = 5 * time.Second
+	)
+
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	coord := newCoordinator(token, interval)
+	coord.now = clock.now
+
+	mux := http.NewServeMux()
+	mux.Handle(serversPath, coord)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var fakes [2]*httptest.Server
+	var addrs [2]string
+	for i := range fakes {
+		fakes[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer fakes[i].Close()
+		addrs[i] = fakes[i].Listener.Addr().String()
+	}
+	a, b := addrs[0], addrs[1]
+
+	beat := func(h heartbeat) {
+		if err := postHeartbeat(server.URL, token, h); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := postHeartbeat(server.URL, "wrong", heartbeat{Addr: a}); err == nil {
+		t.Error("heartbeat with the wrong token was accepted")
+	}
+	if got := listServers(server.URL); len(got) != 0 {
+		t.Errorf("unexpected servers %v", got)
+	}
+
+	beat(heartbeat{Addr: a, Clients: 2, MaxClients: 4, FrameTime: 10})
+	beat(heartbeat{Addr: b, Clients: 1, MaxClients: 4, FrameTime: 20})
+
+	if got := listServers(server.URL); !reflect.DeepEqual(got, []string{b, a}) {
+		t.Errorf("fewer clients should come first, got %v", got)
+	}
+
+	beat(heartbeat{Addr: b, Clients: 2, MaxClients: 4, FrameTime: 20})
+	if got := listServers(server.URL); !reflect.DeepEqual(got, []string{a, b}) {
+		t.Errorf("shorter frame time should come first, got %v", got)
+	}
+
+	beat(heartbeat{Addr: a, Clients: 4, MaxClients: 4, FrameTime: 10})
+	if got := listServers(server.URL); !reflect.DeepEqual(got, []string{b, a}) {
+		t.Errorf("full servers should come last, got %v", got)
+	}
+
+	// The frontend falls back to the next server when the first one fails.
+	fakes[1].Close()
+	if got := connectFirst(listServers(server.URL)); got != a {
+		t.Errorf("expected failover to %s, got %s", a, got)
+	}
+
+	// The failed server stops sending heartbeats and is evicted.
+	clock.advance(2 * interval)
+	beat(heartbeat{Addr: a, Clients: 1, MaxClients: 4, FrameTime: 10})
+	clock.advance(2 * interval)
+
+	if got := listServers(server.URL); !reflect.DeepEqual(got, []string{a}) {
+		t.Errorf("stale server should be evicted, got %v", got)
+	}
+
+	beat(heartbeat{Addr: a, Leaving: true})
+	if got := listServers(server.URL); len(got) != 0 {
+		t.Errorf("leaving server should be removed, got %v", got)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	resetServerState("", 0)
+
+	coord := newCoordinator("", time.Second)
+	server := httptest.NewServer(coord)
+	defer server.Close()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		register(server.URL, "", "render:8080", time.Hour, stop)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(coord.list()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("server was not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if list := coord.list(); list[0].Addr != "render:8080" || list[0].MaxClients != config.MaxClients {
+		t.Errorf("unexpected heartbeat %+v", list[0])
+	}
+
+	close(stop)
+	<-done
+
+	if list := coord.list(); len(list) != 0 {
+		t.Errorf("server was not removed when stopped, got %+v", list)
+	}
+}
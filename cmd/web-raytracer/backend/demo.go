@@ -0,0 +1,83 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	_ "embed"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"github.com/andreas-jonsson/octatron/cmd/web-raytracer/frontend"
+)
+
+//go:generate go run gendemo.go
+
+// demoTree is the sample tree served with -demo, written by gendemo.go.
+//
+//go:embed demo.oct
+var demoTree []byte
+
+const demoTreeName = "demo.oct"
+
+// setupDemo writes the embedded tree to a new data directory and changes cfg to
+// serve it on localhost. The returned function removes the directory.
+func setupDemo(cfg *serverConfig) (func(), error) {
+	dir, err := ioutil.TempDir("", "octatron-demo")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, demoTreeName), demoTree, 0644); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	cfg.DataDir, cfg.Tree = dir, demoTreeName
+
+	if host, port, err := net.SplitHostPort(cfg.Listen); err == nil && host == "" {
+		cfg.Listen = net.JoinHostPort("localhost", port)
+	}
+	return func() { os.RemoveAll(dir) }, nil
+}
+
+// webHandler serves the frontend from the Web directory, or the embedded
+// frontend with Demo.
+func webHandler(cfg *serverConfig) http.Handler {
+	if cfg.Demo {
+		return http.FileServer(http.FS(frontend.Assets))
+	}
+	return http.FileServer(http.Dir(cfg.Web))
+}
+
+// openBrowser opens url in the default browser.
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
@@ -0,0 +1,75 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDemo(t *testing.T) {
+	resetServerState("", 0)
+	config.Demo = true
+
+	cleanup, err := setupDemo(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	if config.Listen != "localhost:8080" {
+		t.Errorf("expected the demo to listen on localhost, got %s", config.Listen)
+	}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := openTree("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := tree.infos[0]; info.NumNodes == 0 || info.VoxelsPerAxis != 32 {
+		t.Errorf("unexpected demo tree %+v", info)
+	}
+
+	server := httptest.NewServer(webHandler(&config))
+	defer server.Close()
+
+	// The bundle holds the frame magic as a quoted string literal where the
+	// frontend parses the frame headers.
+	frontendJS := strconv.Quote(string(frameMagic))
+	for path, content := range map[string]string{"/": `<script src="frontend.js">`, "/frontend.js": frontendJS} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), content) {
+			t.Errorf("%s: unexpected response %s", path, resp.Status)
+		}
+	}
+}
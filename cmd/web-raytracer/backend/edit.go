@@ -0,0 +1,247 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+// patchesPath streams the patches of a tree to clients rendering their own copy.
+const patchesPath = "/patches"
+
+type (
+	// editRequest sets the color of a voxel or removes it. Position is in the unit
+	// cube of the tree and Depth the depth of the voxel, at most the depth of the
+	// tree. The action is set or clear.
+	editRequest struct {
+		Action   string     `action`
+		Position [3]float32 `position`
+		Depth    int        `depth`
+		Color    [3]uint8   `color`
+	}
+
+	// patchMessage carries an edit of the tree, see trace.TreePatch. Clients that
+	// render their own copy of the tree apply it with trace.ApplyPatch.
+	patchMessage struct {
+		Patch trace.TreePatch `patch`
+	}
+)
+
+// editLock serializes the edits, so every patch is made from the tree of the one
+// before.
+var editLock sync.Mutex
+
+func (req *editRequest) validate() error {
+	if req.Action != "set" && req.Action != "clear" {
+		return errors.New("unknown edit action: " + req.Action)
+	}
+	for _, v := range req.Position {
+		if !(v >= 0 && v < 1) {
+			return errors.New("edit position is outside the tree")
+		}
+	}
+	if req.Depth < 0 {
+		return errors.New("edit depth is negative")
+	}
+	return nil
+}
+
+// voxelEdit is a single change of the tree, the voxel containing pos at depth is
+// set to color or cleared.
+type voxelEdit struct {
+	pos   [3]float32
+	depth int
+	clear bool
+	color color.RGBA
+}
+
+// editTree applies the edit to the cached version of tree, see changeTree.
+func editTree(tree *treeData, req *editRequest) error {
+	return changeTree(tree, false, func(current *treeData) ([]voxelEdit, error) {
+		if req.Depth > current.maxDepth {
+			return nil, &protocolError{invalidUpdateError, fmt.Sprintf("edit depth is over the tree depth %d", current.maxDepth)}
+		}
+		edit := voxelEdit{pos: req.Position, depth: req.Depth, clear: req.Action == "clear"}
+		edit.color = color.RGBA{req.Color[0], req.Color[1], req.Color[2], 255}
+		return []voxelEdit{edit}, nil
+	})
+}
+
+// changeTree makes the edits returned by resolve to the cached version of tree, in
+// order. The edited tree replaces it in the cache, the connections viewing the tree
+// switch to it and send the patches on. The first edit copies the tree for editing,
+// the copy is kept by the edited trees. The edits are one step of the undo journal,
+// unless undo is set and they revert the last one.
+func changeTree(tree *treeData, undo bool, resolve func(current *treeData) ([]voxelEdit, error)) error {
+	if !config.Edit {
+		return &protocolError{invalidUpdateError, "edits are disabled"}
+	}
+
+	editLock.Lock()
+	defer editLock.Unlock()
+
+	current := cachedTree(tree.file)
+	if current == nil {
+		return &protocolError{unknownTreeError, "tree is no longer loaded"}
+	}
+	if len(current.frames) != 1 {
+		return &protocolError{invalidUpdateError, "sequences can not be edited"}
+	}
+
+	edits, err := resolve(current)
+	if err != nil || len(edits) == 0 {
+		return err
+	}
+
+	editor := current.editor
+	if editor == nil {
+		editor = trace.NewMutableTreeWithInfo(append(trace.Octree(nil), current.frames[0]...), current.infos[0])
+	}
+
+	// Frames in flight still render the current tree, a copy is patched.
+	var (
+		frame   = append(trace.Octree(nil), current.frames[0]...)
+		patches = current.patches[:len(current.patches):len(current.patches)]
+		reverts = make([]voxelEdit, len(edits))
+	)
+	for i, edit := range edits {
+		reverts[len(edits)-1-i] = revertEdit(editor.Octree(), edit)
+
+		var patch trace.TreePatch
+		if edit.clear {
+			patch, err = editor.ClearVoxelPatch(edit.pos, edit.depth)
+		} else {
+			patch, err = editor.SetVoxelPatch(edit.pos, edit.depth, edit.color)
+		}
+		if err == nil {
+			frame, err = trace.ApplyPatch(frame, &patch)
+		}
+		if err != nil {
+			// The failed edit may be half done, the next edit starts from a new copy.
+			current.editor = nil
+			return err
+		}
+		patches = append(patches, patch)
+	}
+
+	edited := *current
+	edited.frames = []trace.Octree{frame}
+	edited.replaced = nil
+	edited.editor = editor
+	edited.patches = patches
+	if undo {
+		edited.journal = current.journal[:len(current.journal)-1]
+	} else {
+		edited.journal = appendJournal(current.journal, reverts)
+	}
+
+	replaceTree(current, &edited)
+	return nil
+}
+
+// patchesSince returns the patches that turn old into tree, false if tree is not an
+// edited version of old.
+func (tree *treeData) patchesSince(old *treeData) ([]trace.TreePatch, bool) {
+	if tree.file != old.file || tree.stamp != old.stamp || len(tree.patches) < len(old.patches) {
+		return nil, false
+	}
+	return tree.patches[len(old.patches):], true
+}
+
+// patchServer streams the patches of the tree named by the tree query parameter to
+// clients that render their own copy of it, like the WASM raytracer. The patches
+// made since the tree was loaded are sent first, so a client that fetched the tree
+// file is brought up to date. The connection is closed when the tree is loaded
+// again from its file.
+func patchServer(ws *websocket.Conn) {
+	defer ws.Close()
+	addr := ws.Request().RemoteAddr
+
+	if !limiter.allow(remoteHost(addr), time.Now()) {
+		rejectClient(ws, false, rateLimitedError, "too many connection attempts")
+		return
+	}
+
+	if !sessions.enter() {
+		rejectClient(ws, false, serverRestartingError, "server is restarting")
+		return
+	}
+	defer sessions.leave()
+
+	query := ws.Request().URL.Query()
+	if !validToken(query.Get("token")) {
+		rejectClient(ws, false, unauthorizedError, "invalid token")
+		return
+	}
+
+	tree, err := openTree(query.Get("tree"))
+	if err != nil {
+		if perr, ok := err.(*protocolError); ok {
+			rejectClient(ws, false, perr.code, perr.message)
+		} else {
+			serverLog().Errorf("%s: %v", addr, err)
+		}
+		return
+	}
+
+	// Nothing is read from the client, the reader ends when it disconnects.
+	disconnected := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, ws)
+		close(disconnected)
+	}()
+
+	patches, _ := tree.patchesSince(&treeData{file: tree.file, stamp: tree.stamp})
+	for {
+		for _, patch := range patches {
+			if err := websocket.JSON.Send(ws, patchMessage{patch}); err != nil {
+				logv(1, err)
+				return
+			}
+		}
+
+		select {
+		case <-tree.replaced:
+		case <-disconnected:
+			return
+		case <-sessions.closing:
+			return
+		}
+
+		next := cachedTree(tree.file)
+		if next == nil {
+			return
+		}
+
+		var ok bool
+		if patches, ok = next.patchesSince(tree); !ok {
+			logv(1, addr, "tree was reloaded, closing patch stream")
+			return
+		}
+		tree = next
+	}
+}
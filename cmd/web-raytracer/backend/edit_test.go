@@ -0,0 +1,402 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/color"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+var (
+	editRed  = color.RGBA{255, 0, 0, 255}
+	editBlue = color.RGBA{0, 0, 255, 255}
+)
+
+// useEditTree replaces the default tree with a red cube of eight voxels and returns
+// a copy of its nodes.
+func useEditTree() trace.Octree {
+	tree := trace.NewMutableTree(nil, 2)
+	for _, z := range []float32{0.25, 0.75} {
+		for _, y := range []float32{0.25, 0.75} {
+			for _, x := range []float32{0.25, 0.75} {
+				if err := tree.SetVoxel([3]float32{x, y, z}, 1, editRed); err != nil {
+					panic(err)
+				}
+			}
+		}
+	}
+
+	file := config.treePath()
+	trees.cache[file] = &treeData{
+		file:      file,
+		replaced:  make(chan struct{}),
+		bookmarks: &bookmarkStore{bookmarks: make(map[string]bookmark)},
+		maxDepth:  1,
+		frames:    []trace.Octree{tree.Octree()},
+		infos:     []*trace.TreeInfo{{NumNodes: uint64(len(tree.Octree())), NumLeafs: 8, VoxelsPerAxis: 2, Depth: 1}},
+	}
+	return append(trace.Octree(nil), tree.Octree()...)
+}
+
+// nextEditMessage returns the next message, frames are returned as their pixels and
+// patches decoded.
+func nextEditMessage(ws *websocket.Conn) ([]byte, *patchMessage) {
+	var data []byte
+	if err := websocket.Message.Receive(ws, &data); err != nil {
+		panic(err)
+	}
+	if bytes.HasPrefix(data, frameMagic) {
+		return data[frameHeaderSize:], nil
+	}
+
+	var msg struct {
+		Patch *trace.TreePatch `patch`
+		Error string           `error`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		panic(err)
+	}
+	if msg.Patch == nil {
+		panic("unexpected message: " + string(data))
+	}
+	return nil, &patchMessage{*msg.Patch}
+}
+
+// nextFrame sends a camera update in front of the tree and returns the pixels of
+// the frame.
+func nextFrame(ws *websocket.Conn) []byte {
+	var update updateMessage
+	update.Camera.Position = [3]float32{0.5, 0.5, 2}
+	if err := websocket.JSON.Send(ws, update); err != nil {
+		panic(err)
+	}
+
+	pix, patch := nextEditMessage(ws)
+	if patch != nil {
+		panic("expected a frame")
+	}
+	return pix
+}
+
+// countColor counts the RGBA pixels of color c.
+func countColor(pix []byte, c color.RGBA) int {
+	var n int
+	for i := 0; i+3 < len(pix); i += 4 {
+		if pix[i] == c.R && pix[i+1] == c.G && pix[i+2] == c.B {
+			n++
+		}
+	}
+	return n
+}
+
+func sendEdit(ws *websocket.Conn, edit editRequest) {
+	var update updateMessage
+	update.Edit = &edit
+	if err := websocket.JSON.Send(ws, update); err != nil {
+		panic(err)
+	}
+}
+
+func TestEditPatch(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+	config.Edit, config.Jitter, config.ViewDistance = true, false, 10
+	original := useEditTree()
+
+	_, ws := dial(server, testSetup())
+	defer ws.Close()
+
+	pix := nextFrame(ws)
+	if countColor(pix, editRed) == 0 || countColor(pix, editBlue) != 0 {
+		t.Fatal("expected a red tree")
+	}
+
+	// The voxel facing the camera is painted blue, the patch is sent before the
+	// frames showing it.
+	sendEdit(ws, editRequest{Action: "set", Position: [3]float32{0.25, 0.25, 0.75}, Depth: 1, Color: [3]uint8{0, 0, 255}})
+	_, patch := nextEditMessage(ws)
+	if patch == nil {
+		t.Fatal("expected a patch")
+	}
+
+	patched, err := trace.ApplyPatch(append(trace.Octree(nil), original...), &patch.Patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edited := cachedTree(config.treePath())
+	if len(edited.patches) != 1 {
+		t.Fatal("expected the edited tree to hold the patch")
+	}
+	want := renderMinimap(edited.frames[0], 1, color.RGBA{}, 16)
+	if got := renderMinimap(patched, 1, color.RGBA{}, 16); !bytes.Equal(got.Pix, want.Pix) {
+		t.Error("patch does not bring the client tree up to date")
+	}
+
+	// Frames are only sent for camera updates, the next one shows the edit.
+	if pix = nextFrame(ws); countColor(pix, editBlue) == 0 {
+		t.Error("edit is not rendered")
+	}
+
+	// Removing the voxel sends a removal.
+	sendEdit(ws, editRequest{Action: "clear", Position: [3]float32{0.25, 0.25, 0.75}, Depth: 1})
+	if _, patch = nextEditMessage(ws); patch == nil || len(patch.Patch.Nodes) != 0 {
+		t.Error("expected a removal patch, got:", patch)
+	}
+	if pix = nextFrame(ws); countColor(pix, editBlue) != 0 {
+		t.Error("removed voxel is rendered")
+	}
+}
+
+func TestEditDisabled(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+	original := useEditTree()
+
+	_, ws := dial(server, testSetup())
+	defer ws.Close()
+
+	sendEdit(ws, editRequest{Action: "clear", Position: [3]float32{0.25, 0.25, 0.75}, Depth: 1})
+
+	var msg errorMessage
+	if err := websocket.JSON.Receive(ws, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Error != invalidUpdateError {
+		t.Error("expected an invalid update error, got:", msg)
+	}
+
+	tree := cachedTree(config.treePath())
+	if len(tree.frames[0]) != len(original) || len(tree.patches) != 0 {
+		t.Error("tree was edited")
+	}
+}
+
+func TestPatchStream(t *testing.T) {
+	resetServerState("", 0)
+	config.Edit = true
+	original := useEditTree()
+
+	server := httptest.NewServer(websocket.Handler(patchServer))
+	defer server.Close()
+
+	edits := []editRequest{
+		{Action: "set", Position: [3]float32{0.6, 0.6, 0.6}, Depth: 1, Color: [3]uint8{0, 0, 255}},
+		{Action: "clear", Position: [3]float32{0.1, 0.1, 0.1}, Depth: 1},
+	}
+
+	tree := cachedTree(config.treePath())
+	if err := editTree(tree, &edits[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	ws, err := websocket.Dial("ws"+server.URL[len("http"):]+patchesPath, "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// The earlier edit is sent first, the later one as it is made.
+	client := append(trace.Octree(nil), original...)
+	for i := range edits {
+		if i > 0 {
+			if err := editTree(tree, &edits[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, patch := nextEditMessage(ws)
+		if client, err = trace.ApplyPatch(client, &patch.Patch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := renderMinimap(cachedTree(config.treePath()).frames[0], 1, color.RGBA{}, 16)
+	if got := renderMinimap(client, 1, color.RGBA{}, 16); !bytes.Equal(got.Pix, want.Pix) {
+		t.Error("streamed patches do not bring the client tree up to date")
+	}
+}
+
+// TestConcurrentEdits edits and reloads the tree while four clients render it.
+// Run with -race.
+func TestConcurrentEdits(t *testing.T) {
+	server := startTestServer("", 0)
+	config.Edit, config.Jitter, config.ViewDistance = true, false, 10
+	useEditTree()
+	before := atomic.LoadInt64(&metrics.snapshots)
+
+	var (
+		wg   sync.WaitGroup
+		stop = make(chan struct{})
+	)
+	for i := 0; i < 4; i++ {
+		_, ws := dial(server, testSetup())
+		wg.Add(1)
+		go func(ws *websocket.Conn) {
+			defer wg.Done()
+			defer ws.Close()
+
+			// Frames, patches and reloaded trees are all read the same way.
+			var update updateMessage
+			update.Camera.Position = [3]float32{0.5, 0.5, 2}
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				var data []byte
+				if websocket.JSON.Send(ws, update) != nil || websocket.Message.Receive(ws, &data) != nil {
+					t.Error("connection closed")
+					return
+				}
+			}
+		}(ws)
+	}
+
+	for i := 0; i < 20; i++ {
+		pos := [3]float32{float32(i%2)/2 + 0.25, float32(i/2%2)/2 + 0.25, 0.75}
+		if err := editTree(cachedTree(config.treePath()), &editRequest{Action: "set", Position: pos, Depth: 1, Color: [3]uint8{0, 0, uint8(i * 10)}}); err != nil {
+			t.Fatal(err)
+		}
+
+		// A reload starts over from a tree without edits.
+		if i%5 == 4 {
+			current := cachedTree(config.treePath())
+			reloaded := *current
+			reloaded.stamp.size++
+			reloaded.replaced, reloaded.editor, reloaded.patches = nil, nil, nil
+			replaceTree(current, &reloaded)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(stop)
+	wg.Wait()
+	server.Close()
+
+	// Only the snapshot of the cached tree is left once the renderers are done.
+	if n := atomic.LoadInt64(&metrics.snapshots) - before; n != 1 {
+		t.Errorf("expected one snapshot to be left, got %d", n)
+	}
+}
+
+// sendPaint sends a paint or undo message with the camera of nextFrame.
+func sendPaint(ws *websocket.Conn, paint *paintRequest) {
+	var update updateMessage
+	update.Camera.Position = [3]float32{0.5, 0.5, 2}
+	update.Paint, update.Undo = paint, paint == nil
+	if err := websocket.JSON.Send(ws, update); err != nil {
+		panic(err)
+	}
+}
+
+func TestPaint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := startTestServer("", 0)
+	defer server.Close()
+	config.Edit, config.Jitter, config.ViewDistance, config.DataDir = true, false, 10, dir
+	useEditTree()
+
+	_, ws := dial(server, testSetup())
+	defer ws.Close()
+
+	if pix := nextFrame(ws); countColor(pix, editBlue) != 0 {
+		t.Fatal("expected a red tree")
+	}
+
+	// The pixel is on the lower left voxel facing the camera. It is erased, then
+	// the voxel behind it is hit and blue is added in front of it again.
+	front := [3]float32{0.25, 0.25, 0.75}
+	steps := []struct {
+		paint  *paintRequest
+		filled bool
+		blue   bool
+	}{
+		{&paintRequest{Pixel: &[2]float32{0.4, 0.6}, Mode: "erase"}, false, false},
+		{&paintRequest{Pixel: &[2]float32{0.4, 0.6}, Color: [3]uint8{0, 0, 255}, Mode: "add"}, true, true},
+		{nil, false, false},
+		{nil, true, false},
+	}
+	for i, step := range steps {
+		sendPaint(ws, step.paint)
+		if _, patch := nextEditMessage(ws); patch == nil {
+			t.Fatalf("step %d: expected a patch", i)
+		}
+
+		tree := cachedTree(config.treePath())
+		if _, filled := tree.frames[0].VoxelAt(front, 1); filled != step.filled {
+			t.Errorf("step %d: expected the voxel to be filled %v", i, step.filled)
+		}
+		if pix := nextFrame(ws); (countColor(pix, editBlue) != 0) != step.blue {
+			t.Errorf("step %d: expected blue to be rendered %v", i, step.blue)
+		}
+	}
+
+	// The journal is empty again.
+	sendPaint(ws, nil)
+	var msg errorMessage
+	if err := websocket.JSON.Receive(ws, &msg); err != nil || msg.Error != invalidUpdateError {
+		t.Error("expected an error when there is nothing to undo, got:", msg, err)
+	}
+
+	// The edited tree is saved next to the tree.
+	autosave(make(map[string]*treeData))
+
+	fp, err := os.Open(filepath.Join(dir, "tree.autosave.oct"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	saved, _, err := trace.LoadOctree(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := saved.VoxelAt(front, 1); !ok || c.R != 255 {
+		t.Error("saved tree differs from the edited tree")
+	}
+}
+
+func TestPaintJournal(t *testing.T) {
+	var journal [][]voxelEdit
+	for i := 0; i < maxJournal+10; i++ {
+		journal = appendJournal(journal, []voxelEdit{{depth: i}})
+	}
+	if len(journal) != maxJournal || journal[0][0].depth != 10 {
+		t.Errorf("expected the last %d edits, got %d from %d", maxJournal, len(journal), journal[0][0].depth)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/andreas-jonsson/octatron/pack"
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+// Error codes sent to the client before the connection is closed.
+const (
+	unauthorizedError      = "unauthorized"
+	rateLimitedError       = "rate_limited"
+	serverFullError        = "server_full"
+	serverCapacityError    = "server_at_capacity"
+	invalidSetupError      = "invalid_setup"
+	invalidUpdateError     = "invalid_update"
+	resolutionError        = "resolution_too_large"
+	unknownTreeError       = "unknown_tree"
+	unknownLUTError        = "unknown_lut"
+	treeTooLargeError      = "tree_too_large"
+	unsupportedFormatError = "unsupported_format"
+	corruptTreeError       = "corrupt_tree"
+	renderBudgetError      = "render_budget_exceeded"
+	serverRestartingError  = "server_restarting"
+	internalError          = "internal_error"
+)
+
+// binaryErrorMagic starts the binary variant of the error message. It is followed by
+// the length of the code as a single byte, the code and the message text.
+var binaryErrorMagic = []byte("ERR\x00")
+
+type (
+	errorMessage struct {
+		Error   string `error`
+		Message string `message`
+	}
+
+	// protocolError is an error that is reported to the client.
+	protocolError struct {
+		code, message string
+	}
+)
+
+func (e *protocolError) Error() string {
+	return e.code + ": " + e.message
+}
+
+func (msg *errorMessage) marshalBinary() []byte {
+	data := append([]byte{}, binaryErrorMagic...)
+	data = append(data, byte(len(msg.Error)))
+	data = append(data, msg.Error...)
+	return append(data, msg.Message...)
+}
+
+// treeError returns the protocol error for a tree that could not be decoded.
+// Damaged and truncated trees are corrupt, trees with too many nodes too large
+// and other trees are in a format the server does not support.
+func treeError(err error) error {
+	var (
+		corrupt *pack.ErrCorrupt
+		count   *trace.NodeCountError
+	)
+
+	switch {
+	case errors.As(err, &count) && !count.Truncated:
+		return &protocolError{treeTooLargeError, err.Error()}
+	case errors.As(err, &corrupt), errors.As(err, &count), errors.Is(err, io.ErrUnexpectedEOF):
+		return &protocolError{corruptTreeError, err.Error()}
+	}
+	return &protocolError{unsupportedFormatError, err.Error()}
+}
+
+func isSyntaxError(err error) bool {
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return true
+	}
+	return false
+}
+
+// sendError sends an error message to the client and logs it with the address of
+// the client.
+func sendError(ws *websocket.Conn, binary bool, code, message string) error {
+	serverLog().Warnf("%s: %s: %s", ws.Request().RemoteAddr, code, message)
+	return writeError(ws, binary, code, message)
+}
+
+func writeError(ws *websocket.Conn, binary bool, code, message string) error {
+	msg := errorMessage{code, message}
+	if binary {
+		return streamCodec.Send(ws, msg.marshalBinary())
+	}
+	return websocket.JSON.Send(ws, msg)
+}
+
+// rejectClient sends an error message to the client and closes the connection.
+func rejectClient(ws *websocket.Conn, binary bool, code, message string) {
+	serverLog().Warnf("%s was rejected: %s: %s", ws.Request().RemoteAddr, code, message)
+	writeError(ws, binary, code, message)
+	ws.Close()
+}
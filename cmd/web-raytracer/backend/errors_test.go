@@ -0,0 +1,398 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/andreas-jonsson/octatron/pack"
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+func writeTestTree(file string) {
+	tree := trace.NewMutableTree(nil, 2)
+	if err := tree.SetVoxel([3]float32{0.25, 0.25, 0.25}, 1, color.RGBA{255, 0, 0, 255}); err != nil {
+		panic(err)
+	}
+
+	fp, err := os.Create(file)
+	if err != nil {
+		panic(err)
+	}
+	defer fp.Close()
+
+	if err := tree.Save(fp, pack.MipR8G8B8A8UnpackUI32); err != nil {
+		panic(err)
+	}
+}
+
+func TestErrorMessages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "octatron")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestTree(filepath.Join(dir, "tree.oct"))
+	if err := ioutil.WriteFile(filepath.Join(dir, "bad.oct"), []byte("not a tree"), 0644); err != nil {
+		panic(err)
+	}
+
+	server := startTestServer("", 0)
+	defer server.Close()
+
+	config.DataDir = dir
+	config.MaxMemory = 1024
+
+	// Cached trees are not validated, which allows a broken tree to be used.
+	trees.cache[filepath.Join(dir, "broken.oct")] = &treeData{}
+
+	setup := func(tree string, width int) setupMessage {
+		s := testSetup()
+		s.Tree = tree
+		s.Width = width
+		return s
+	}
+
+	tests := []struct {
+		setup interface{}
+		code  string
+	}{
+		{"{\"width\": 32,", invalidSetupError},
+		{setup("", -1), invalidSetupError},
+		{setup("", config.MaxWidth+1), resolutionError},
+		{setup("missing.oct", 32), unknownTreeError},
+		{setup("../tree.oct", 32), unknownTreeError},
+		{setup("bad.oct", 32), unsupportedFormatError},
+		{setup("broken.oct", 32), internalError},
+	}
+
+	for _, test := range tests {
+		data, ws := dial(server, test.setup)
+		var msg errorMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Error(err)
+		}
+
+		if msg.Error != test.code {
+			t.Errorf("expected %s, got %s: %s", test.code, msg.Error, msg.Message)
+		}
+
+		expectClosed(t, ws)
+		ws.Close()
+	}
+
+	// The tree is rejected when it does not fit in the memory budget.
+	config.MaxMemory = 16
+	data, ws := dial(server, setup("tree.oct", 32))
+	ws.Close()
+
+	var msg errorMessage
+	if json.Unmarshal(data, &msg); msg.Error != treeTooLargeError {
+		t.Errorf("expected %s, got %s", treeTooLargeError, msg.Error)
+	}
+
+	config.MaxMemory = 0
+	data, ws = dial(server, setup("tree.oct", 32))
+	ws.Close()
+
+	var info infoMessage
+	if err := json.Unmarshal(data, &info); err != nil || info.NumNodes == 0 {
+		t.Error("expected tree info, got:", string(data))
+	}
+
+	// Forged headers are rejected before the nodes are allocated. The file is too
+	// small for the nodes, so the tree is corrupt if it is within the limit.
+	header := pack.NewOctreeHeader(pack.MipR8G8B8A8UnpackUI32, 2)
+	header.NumNodes = 1 << 24
+	var buf bytes.Buffer
+	if err := pack.EncodeHeader(&buf, header); err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "forged.oct"), buf.Bytes(), 0644); err != nil {
+		panic(err)
+	}
+
+	for _, test := range []struct {
+		maxNodes uint64
+		code     string
+	}{
+		{1 << 26, corruptTreeError},
+		{1 << 20, treeTooLargeError},
+	} {
+		config.MaxNodes = test.maxNodes
+		data, ws = dial(server, setup("forged.oct", 32))
+		ws.Close()
+
+		var msg errorMessage
+		if json.Unmarshal(data, &msg); msg.Error != test.code {
+			t.Errorf("max nodes %v: expected %s, got %s: %s", test.maxNodes, test.code, msg.Error, msg.Message)
+		}
+	}
+}
+
+// captureLogger records the messages of all levels.
+type captureLogger struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (l *captureLogger) Enabled(level pack.LogLevel) bool {
+	return true
+}
+
+func (l *captureLogger) logf(level pack.LogLevel, format string, args []interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.messages = append(l.messages, level.String()+": "+fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) Debugf(format string, args ...interface{}) {
+	l.logf(pack.LogDebug, format, args)
+}
+
+func (l *captureLogger) Infof(format string, args ...interface{}) {
+	l.logf(pack.LogInfo, format, args)
+}
+
+func (l *captureLogger) Warnf(format string, args ...interface{}) {
+	l.logf(pack.LogWarn, format, args)
+}
+
+func (l *captureLogger) Errorf(format string, args ...interface{}) {
+	l.logf(pack.LogError, format, args)
+}
+
+// find returns the first message starting with prefix that contains all of parts.
+func (l *captureLogger) find(prefix string, parts ...string) (string, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+next:
+	for _, msg := range l.messages {
+		if !strings.HasPrefix(msg, prefix) {
+			continue
+		}
+		for _, part := range parts {
+			if !strings.Contains(msg, part) {
+				continue next
+			}
+		}
+		return msg, true
+	}
+	return "", false
+}
+
+func TestProtocolErrorLog(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+
+	logger := &captureLogger{}
+	config.Logger = logger
+
+	s := testSetup()
+	s.Tree = "missing.oct"
+	_, ws := dial(server, s)
+	expectClosed(t, ws)
+	ws.Close()
+
+	// The error is logged before it is sent, with the address of the client.
+	if msg, ok := logger.find("warning: 127.0.0.1:", "was rejected", unknownTreeError, "missing.oct"); !ok {
+		t.Errorf("rejection not logged: %q", logger.messages)
+	} else if _, ok := logger.find("info: new connection: 127.0.0.1:"); !ok {
+		t.Errorf("connection not logged before %q", msg)
+	}
+}
+
+func TestBinaryErrorMessage(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+
+	setup := testSetup()
+	setup.Tree = "missing.oct"
+	setup.BinaryErrors = true
+
+	data, ws := dial(server, setup)
+	defer ws.Close()
+
+	if !bytes.HasPrefix(data, binaryErrorMagic) {
+		t.Fatal("expected binary error message, got:", string(data))
+	}
+
+	data = data[len(binaryErrorMagic):]
+	code := string(data[1 : 1+data[0]])
+	if code != unknownTreeError {
+		t.Errorf("expected %s, got %s", unknownTreeError, code)
+	}
+
+	if message := string(data[1+data[0]:]); message != "unknown tree: missing.oct" {
+		t.Error("unexpected message:", message)
+	}
+}
+
+func TestInvalidUpdate(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+
+	// Numbers that overflow float32 are rejected by the decoder.
+	for _, text := range []string{`{"camera": {"position": [0, 1e39, 0]}}`, `{"camera": {"xrot": "NaN"}}`} {
+		_, ws := handshake(server, "")
+		if err := websocket.Message.Send(ws, text); err != nil {
+			panic(err)
+		}
+
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			t.Fatal("expected an error message:", err)
+		}
+
+		var msg errorMessage
+		if json.Unmarshal(data, &msg); msg.Error != invalidUpdateError {
+			t.Errorf("expected %s, got: %s", invalidUpdateError, string(data))
+		}
+
+		expectClosed(t, ws)
+		ws.Close()
+	}
+}
+
+func TestValidateUpdate(t *testing.T) {
+	nan := float32(math.NaN())
+	inf := float32(math.Inf(-1))
+
+	var update updateMessage
+	if err := update.validate(); err != nil {
+		t.Error(err)
+	}
+
+	for _, set := range []func(u *updateMessage){
+		func(u *updateMessage) { u.Camera.Position[1] = nan },
+		func(u *updateMessage) { u.Camera.XRot = inf },
+		func(u *updateMessage) { u.Camera.YRot = nan },
+		func(u *updateMessage) { u.Cursor = &[2]float32{0, inf} },
+	} {
+		var update updateMessage
+		set(&update)
+		if err := update.validate(); err == nil {
+			t.Errorf("expected %+v to be rejected", update)
+		}
+	}
+}
+
+func frameType(binary bool) byte {
+	if binary {
+		return websocket.BinaryFrame
+	}
+	return websocket.TextFrame
+}
+
+func FuzzSetupMessage(f *testing.F) {
+	// The struct tags of the messages are not json tags, so the keys are matched
+	// against the field names.
+	f.Add([]byte(`{"width": 640, "height": 480, "FieldOfView": 60, "ColorFormat": "RGBA"}`), false)
+	f.Add([]byte(`{"preset": "high", "width": 100000, "jitter": true, "ClearColor": [1, 2, 3, 4]}`), false)
+	f.Add([]byte(`{"preset": "raster", "FieldOfView": 90, "camera": {"name": "a"}, "FoveaRadius": -1}`), false)
+	f.Add([]byte("ERR\x00"), true)
+
+	f.Fuzz(func(t *testing.T, data []byte, binary bool) {
+		config = defaultConfig()
+
+		var setup setupMessage
+		if err := unmarshalMessage(data, frameType(binary), &setup); err != nil {
+			return
+		}
+
+		q, err := setup.validate()
+		if err != nil {
+			if _, ok := err.(*protocolError); !ok {
+				t.Fatalf("expected a protocol error, got %v", err)
+			}
+			return
+		}
+
+		if q.Width < 2 || q.Width > config.MaxWidth || q.Height < 1 || q.Height > config.MaxHeight {
+			t.Errorf("resolution %vx%v is out of bounds", q.Width, q.Height)
+		}
+		if q.Samples < 0 || q.Samples > config.MaxSamples {
+			t.Errorf("%v samples is out of bounds", q.Samples)
+		}
+	})
+}
+
+func FuzzUpdateMessage(f *testing.F) {
+	f.Add([]byte(`{"camera": {"position": [0, 1, 2], "x_rot": 0.5, "y_rot": 1}, "frame": 1, "cursor": [0.5, 0.5]}`), false)
+	f.Add([]byte(`{"ping": 12.5, "quality": {"preset": "low", "samples": 3}}`), false)
+	f.Add([]byte(`{"bookmark": {"action": "save", "name": "a"}, "tree": "b.oct", "screenshot": true}`), false)
+	f.Add([]byte{0}, true)
+
+	f.Fuzz(func(t *testing.T, data []byte, binary bool) {
+		config = defaultConfig()
+
+		var update updateMessage
+		if err := unmarshalMessage(data, frameType(binary), &update); err != nil {
+			return
+		}
+		if err := update.validate(); err != nil {
+			return
+		}
+
+		camera := cameraFromUpdate(&update)
+		for _, v := range append(camera.Pos[:], camera.XRot, camera.YRot) {
+			if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+				t.Fatalf("camera %+v is not finite", camera)
+			}
+		}
+
+		if update.Quality != nil {
+			if q, err := update.Quality.resolve(); err == nil && (q.Width < 2 || q.Width > config.MaxWidth || q.Height < 1 || q.Height > config.MaxHeight) {
+				t.Errorf("resolution %vx%v is out of bounds", q.Width, q.Height)
+			}
+		}
+	})
+}
+
+func TestTreeError(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		code string
+	}{
+		{pack.ErrBadMagic, unsupportedFormatError},
+		{fmt.Errorf("frame 2: %w", pack.ErrUnsupportedFormat), unsupportedFormatError},
+		{&pack.ErrCorrupt{Offset: 36, Reason: "invalid file"}, corruptTreeError},
+		{&pack.ErrChecksumMismatch{Offset: 0, Size: 100}, corruptTreeError},
+		{io.ErrUnexpectedEOF, corruptTreeError},
+		{&trace.NodeCountError{NumNodes: 10, Limit: 5}, treeTooLargeError},
+	} {
+		if e, ok := treeError(test.err).(*protocolError); !ok || e.code != test.code {
+			t.Errorf("%v: expected %s, got %v", test.err, test.code, e)
+		}
+	}
+}
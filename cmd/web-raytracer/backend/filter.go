@@ -0,0 +1,81 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+// filterRequest limits the rendered leafs to the classification codes in Classes,
+// see trace.NodeAttributes. A request without classes renders all leafs again and
+// an empty list hides them all.
+type filterRequest struct {
+	Classes []int `classes`
+}
+
+func (req *filterRequest) validate() error {
+	for _, class := range req.Classes {
+		if class < 0 || class > 255 {
+			return fmt.Errorf("invalid classification code: %d", class)
+		}
+	}
+	return nil
+}
+
+// compile returns the node filter of the request, nil if all leafs are rendered.
+func (req *filterRequest) compile() func(attrs trace.NodeAttributes) bool {
+	if req.Classes == nil {
+		return nil
+	}
+
+	var allowed [256]bool
+	for _, class := range req.Classes {
+		allowed[class] = true
+	}
+	return func(attrs trace.NodeAttributes) bool {
+		return allowed[attrs.Class]
+	}
+}
+
+// classFilter returns the filter to render tree with. The classification codes are
+// stored in alpha, trees without alpha or with coverage in it have none, so the
+// filter is dropped for them and all leafs are rendered. The downgrade is
+// returned for the client.
+func classFilter(filter func(attrs trace.NodeAttributes) bool, tree *treeData) (func(attrs trace.NodeAttributes) bool, []trace.Downgrade) {
+	if filter == nil {
+		return nil, nil
+	}
+
+	caps := tree.infos[0].Capabilities()
+	switch {
+	case caps&trace.HasAlpha == 0:
+		return nil, []trace.Downgrade{{Feature: "filter", Reason: "the tree stores no alpha for classification codes", Fallback: "all leafs are rendered"}}
+	case caps&trace.AlphaIsCoverage != 0:
+		return nil, []trace.Downgrade{{Feature: "filter", Reason: "the alpha of the tree stores coverage instead of classification codes", Fallback: "all leafs are rendered"}}
+	}
+	return filter, nil
+}
+
+func newNoticeMessage(downgrades []trace.Downgrade) noticeMessage {
+	msg := noticeMessage{make([]notice, len(downgrades))}
+	for i, d := range downgrades {
+		msg.Notices[i] = notice{d.Feature, d.Reason, d.Fallback}
+	}
+	return msg
+}
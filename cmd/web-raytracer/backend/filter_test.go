@@ -0,0 +1,156 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/andreas-jonsson/octatron/pack"
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+func TestFilterCompile(t *testing.T) {
+	if f := (&filterRequest{}).compile(); f != nil {
+		t.Error("expected no filter without classes")
+	}
+
+	f := (&filterRequest{Classes: []int{2, 6}}).compile()
+	for class, expected := range map[uint8]bool{0: false, 2: true, 5: false, 6: true, 255: false} {
+		if f(trace.NodeAttributes{Class: class}) != expected {
+			t.Errorf("class %d: expected %v", class, expected)
+		}
+	}
+
+	none := (&filterRequest{Classes: []int{}}).compile()
+	if none == nil || none(trace.NodeAttributes{}) {
+		t.Error("expected an empty list to hide all leafs")
+	}
+
+	for _, class := range []int{-1, 256} {
+		if (&filterRequest{Classes: []int{class}}).validate() == nil {
+			t.Errorf("expected class %d to be rejected", class)
+		}
+	}
+}
+
+func TestFilterUpdate(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+	config.Jitter, config.ViewDistance = false, 10
+
+	setup := testSetup()
+	setup.ClearColor = [4]byte{0, 0, 255, 255}
+	_, ws := dial(server, setup)
+	defer ws.Close()
+
+	// center returns the center pixel of the next frame. The tree is a single
+	// black leaf of class 0 in front of the camera.
+	center := func() [4]byte {
+		var update updateMessage
+		update.Camera.Position = [3]float32{0.5, 0.5, 2}
+		if err := websocket.JSON.Send(ws, update); err != nil {
+			panic(err)
+		}
+
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			t.Fatal(err)
+		}
+		if size := frameHeaderSize + 16*16*4; len(data) != size {
+			t.Fatalf("expected frame of %v bytes, got %v", size, len(data))
+		}
+
+		var c [4]byte
+		copy(c[:], data[frameHeaderSize+(8*16+8)*4:])
+		return c
+	}
+
+	sendFilter := func(req filterRequest) {
+		var update updateMessage
+		update.Filter = &req
+		if err := websocket.JSON.Send(ws, update); err != nil {
+			panic(err)
+		}
+	}
+
+	if c := center(); c[2] != 0 {
+		t.Fatalf("expected the leaf at the center, got %v", c)
+	}
+
+	sendFilter(filterRequest{Classes: []int{1}})
+	if c := center(); c[2] != 255 {
+		t.Errorf("expected the clear color behind the filtered leaf, got %v", c)
+	}
+
+	sendFilter(filterRequest{})
+	if c := center(); c[2] != 0 {
+		t.Errorf("expected the leaf without a filter, got %v", c)
+	}
+
+	// Invalid codes close the connection.
+	sendFilter(filterRequest{Classes: []int{300}})
+	var errMsg errorMessage
+	if err := websocket.JSON.Receive(ws, &errMsg); err != nil || errMsg.Error != invalidUpdateError {
+		t.Fatalf("expected %s, got %+v", invalidUpdateError, errMsg)
+	}
+	expectClosed(t, ws)
+}
+
+func TestFilterNotice(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+	config.Jitter, config.ViewDistance = false, 10
+
+	// The tree has no alpha to store classification codes in.
+	trees.cache[config.treePath()].infos[0].Format = pack.MipR5G6B5UnpackUI16
+
+	setup := testSetup()
+	setup.ClearColor = [4]byte{0, 0, 255, 255}
+	_, ws := dial(server, setup)
+	defer ws.Close()
+
+	var update updateMessage
+	update.Filter = &filterRequest{Classes: []int{1}}
+	if err := websocket.JSON.Send(ws, update); err != nil {
+		panic(err)
+	}
+
+	var msg noticeMessage
+	if err := websocket.JSON.Receive(ws, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Notices) != 1 || msg.Notices[0].Feature != "filter" || msg.Notices[0].Fallback == "" {
+		t.Fatalf("unexpected notices %+v", msg)
+	}
+
+	// The leaf is rendered, the filter is dropped.
+	update = updateMessage{}
+	update.Camera.Position = [3]float32{0.5, 0.5, 2}
+	if err := websocket.JSON.Send(ws, update); err != nil {
+		panic(err)
+	}
+
+	var data []byte
+	if err := websocket.Message.Receive(ws, &data); err != nil {
+		t.Fatal(err)
+	}
+	if c := data[frameHeaderSize+(8*16+8)*4+2]; c != 0 {
+		t.Errorf("expected the leaf at the center, got blue %v", c)
+	}
+}
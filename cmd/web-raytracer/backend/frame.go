@@ -0,0 +1,193 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// frameHeaderSize is the size of the header that starts every image frame. It holds
+// frameMagic, the frame number, the render time in microseconds, the server time in
+// milliseconds when the frame was rendered, the number of frames dropped so far and
+// the image index used to reconstruct jittered frames, all little-endian.
+const frameHeaderSize = 28
+
+var (
+	frameMagic = []byte("FRM\x00")
+
+	// endMagic starts the end-of-frame marker of progressive frames. It has the
+	// layout of the frame header but carries no pixels.
+	endMagic = []byte("END\x00")
+
+	// viewportMagic starts the frames of the viewports after the main view. The
+	// frame header is followed by the viewport id, little-endian, and the pixels.
+	// The image index is always zero since viewports are not jittered.
+	viewportMagic = []byte("VPF\x00")
+)
+
+type (
+	frameHeader struct {
+		Frame      uint32
+		RenderTime time.Duration
+		Timestamp  time.Time
+		Dropped    uint32
+		Image      uint32
+
+		// Viewport is the id of the view the frame belongs to, zero for the
+		// main view.
+		Viewport uint32
+	}
+
+	// frameSender is the outbound queue of a connection. It holds at most one frame
+	// waiting to be sent, a newer frame replaces it so a slow client always gets
+	// the latest frame and never more than three frame buffers are allocated.
+	frameSender struct {
+		lock    sync.Mutex
+		pending []byte
+		free    [][]byte
+		dropped uint32
+		err     error
+		ready   chan struct{}
+		done    chan struct{}
+		send    func([]byte) error
+	}
+
+	// pongMessage answers a ping, the client timestamp is returned unchanged.
+	// Bandwidth is the estimated throughput of the connection in bytes per
+	// second, zero before frames are sent.
+	pongMessage struct {
+		Pong      float64 `pong`
+		Bandwidth float64 `bandwidth`
+	}
+)
+
+// appendFrame appends the header followed by the pixels to buf.
+func (h *frameHeader) appendFrame(buf, pix []byte) []byte {
+	if h.Viewport == 0 {
+		buf = h.appendHeader(buf, frameMagic)
+	} else {
+		var id [4]byte
+		binary.LittleEndian.PutUint32(id[:], h.Viewport)
+		buf = append(h.appendHeader(buf, viewportMagic), id[:]...)
+	}
+	return append(buf, pix...)
+}
+
+func (h *frameHeader) appendHeader(buf, magic []byte) []byte {
+	var header [frameHeaderSize]byte
+	copy(header[:], magic)
+
+	binary.LittleEndian.PutUint32(header[4:], h.Frame)
+	binary.LittleEndian.PutUint32(header[8:], uint32(h.RenderTime/time.Microsecond))
+	binary.LittleEndian.PutUint64(header[12:], uint64(h.Timestamp.UnixNano()/int64(time.Millisecond)))
+	binary.LittleEndian.PutUint32(header[20:], h.Dropped)
+	binary.LittleEndian.PutUint32(header[24:], h.Image)
+
+	return append(buf, header[:]...)
+}
+
+func newFrameSender(send func([]byte) error) *frameSender {
+	s := &frameSender{
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+		send:  send,
+	}
+	go s.sendLoop()
+	return s
+}
+
+// push queues a frame, replacing the frame waiting to be sent if there is one. The
+// error of the last failed send is returned.
+func (s *frameSender) push(h *frameHeader, pix []byte) error {
+	var buf []byte
+
+	s.lock.Lock()
+	if n := len(s.free); n > 0 {
+		buf = s.free[n-1]
+		s.free = s.free[:n-1]
+	}
+	err := s.err
+	h.Dropped = s.dropped
+	s.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	buf = h.appendFrame(buf[:0], pix)
+
+	s.lock.Lock()
+	if s.pending != nil {
+		s.free = append(s.free, s.pending)
+		s.dropped++
+		metrics.addDropped(1)
+	}
+	s.pending = buf
+	s.lock.Unlock()
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *frameSender) numDropped() uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.dropped
+}
+
+func (s *frameSender) sendLoop() {
+	defer close(s.done)
+
+	for range s.ready {
+		s.lock.Lock()
+		buf := s.pending
+		s.pending = nil
+		s.lock.Unlock()
+
+		if buf == nil {
+			continue
+		}
+
+		err := s.send(buf)
+		if err == nil {
+			metrics.addSent(1)
+		}
+
+		s.lock.Lock()
+		s.free = append(s.free, buf)
+		if err != nil && s.err == nil {
+			s.err = err
+		}
+		s.lock.Unlock()
+	}
+}
+
+// close stops the sender once the current frame is sent. Pending frames are dropped.
+func (s *frameSender) close() {
+	s.lock.Lock()
+	s.pending = nil
+	s.lock.Unlock()
+
+	close(s.ready)
+	<-s.done
+}
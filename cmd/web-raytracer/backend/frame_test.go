@@ -0,0 +1,283 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andreas-jonsson/octatron/trace"
+	"golang.org/x/net/websocket"
+)
+
+func TestPingAndFrameHeader(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+
+	setup := testSetup()
+	msg, ws := handshake(server, "")
+	defer ws.Close()
+
+	if msg["NumNodes"] != 1.0 {
+		t.Fatal("expected tree info, got:", msg)
+	}
+
+	if err := websocket.Message.Send(ws, `{"ping": 1234.5}`); err != nil {
+		panic(err)
+	}
+
+	var pong pongMessage
+	if err := websocket.JSON.Receive(ws, &pong); err != nil {
+		t.Fatal(err)
+	}
+
+	if pong.Pong != 1234.5 {
+		t.Error("unexpected pong:", pong.Pong)
+	}
+
+	for i := 0; i < 2; i++ {
+		var update updateMessage
+		update.Camera.Position = [3]float32{0.5, 0.5, 2}
+		if err := websocket.JSON.Send(ws, update); err != nil {
+			panic(err)
+		}
+
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.HasPrefix(data, frameMagic) {
+			t.Fatal("expected frame header")
+		}
+
+		if size := frameHeaderSize + setup.Width/2*setup.Height*4; len(data) != size {
+			t.Errorf("expected %d bytes, got %d", size, len(data))
+		}
+
+		if frame := binary.LittleEndian.Uint32(data[4:]); frame != uint32(i) {
+			t.Errorf("expected frame %d, got %d", i, frame)
+		}
+
+		if timestamp := binary.LittleEndian.Uint64(data[12:]); timestamp == 0 {
+			t.Error("frame has no timestamp")
+		}
+
+		if image := binary.LittleEndian.Uint32(data[24:]); image > 1 {
+			t.Error("invalid image index:", image)
+		}
+	}
+}
+
+func TestFrameSenderDropsOldFrames(t *testing.T) {
+	const numFrames = 50
+
+	var (
+		lock    sync.Mutex
+		sent    []uint32
+		buffers = make(map[*byte]bool)
+	)
+
+	sender := newFrameSender(func(buf []byte) error {
+		time.Sleep(5 * time.Millisecond)
+
+		lock.Lock()
+		sent = append(sent, binary.LittleEndian.Uint32(buf[4:]))
+		buffers[&buf[0]] = true
+		lock.Unlock()
+		return nil
+	})
+
+	pix := make([]byte, 1024)
+	for i := 0; i < numFrames; i++ {
+		header := frameHeader{Frame: uint32(i), Timestamp: time.Now()}
+		if err := sender.push(&header, pix); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Wait for the last frame before closing, close drops pending frames.
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		lock.Lock()
+		done := len(sent) > 0 && sent[len(sent)-1] == numFrames-1
+		lock.Unlock()
+		if done {
+			break
+		}
+	}
+	sender.close()
+
+	if len(sent) == 0 || sent[len(sent)-1] != numFrames-1 {
+		t.Fatal("newest frame was not sent:", sent)
+	}
+
+	for i := 1; i < len(sent); i++ {
+		if sent[i] <= sent[i-1] {
+			t.Fatal("frames out of order:", sent)
+		}
+	}
+
+	dropped := int(sender.numDropped())
+	if dropped == 0 || dropped+len(sent) != numFrames {
+		t.Errorf("expected %d frames sent or dropped, got %d sent and %d dropped", numFrames, len(sent), dropped)
+	}
+
+	if len(buffers) > 3 {
+		t.Errorf("expected at most 3 frame buffers, got %d", len(buffers))
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", metricsPath, nil))
+
+	body := rec.Body.String()
+	for _, name := range []string{"octatron_clients", "octatron_frames_sent_total", "octatron_frames_dropped_total", "octatron_frames_rendered_total", "octatron_render_cache_hits_total", "octatron_throttled_clients", "octatron_frames_timed_out_total", "octatron_frames_per_second", "octatron_tree_snapshots", "octatron_memory_budget_bytes", "octatron_memory_tree_bytes", "octatron_memory_buffer_bytes", "octatron_trees_evicted_total", "octatron_clients_downgraded_total", "octatron_memory_rejected_total"} {
+		if !strings.Contains(body, "\n"+name+" ") {
+			t.Error("missing metric:", name)
+		}
+	}
+}
+
+func TestFrameWithoutJitter(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+	config.Jitter = false
+
+	setup := testSetup()
+	setup.ClearColor = [4]byte{10, 20, 30, 255}
+	_, ws := dial(server, setup)
+	defer ws.Close()
+
+	var update updateMessage
+	update.Camera.Position = [3]float32{0.5, 0.5, 2}
+	if err := websocket.JSON.Send(ws, update); err != nil {
+		panic(err)
+	}
+
+	var data []byte
+	if err := websocket.Message.Receive(ws, &data); err != nil {
+		t.Fatal(err)
+	}
+
+	pix := data[frameHeaderSize:]
+	if len(pix) != setup.Width/2*setup.Height*4 {
+		t.Fatalf("frame has %d bytes", len(pix))
+	}
+	for i := 0; i < len(pix); i += 4 {
+		if pix[i+3] != 255 {
+			t.Fatal("frame holds an image that was not rendered")
+		}
+	}
+}
+
+func TestMaxFPS(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+	config.Jitter = false
+	config.MaxFPS = 20
+
+	_, ws := dial(server, testSetup())
+	defer ws.Close()
+
+	const frames = 5
+	start := time.Now()
+	for i := 0; i < frames; i++ {
+		var update updateMessage
+		update.Camera.Position = [3]float32{0.5, 0.5, 2 + float32(i)}
+		if err := websocket.JSON.Send(ws, update); err != nil {
+			panic(err)
+		}
+
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first frame is rendered at once and the others a frame time apart.
+	if elapsed, expected := time.Since(start), (frames-1)*time.Second/20; elapsed < expected-10*time.Millisecond {
+		t.Errorf("expected %d frames to take at least %v, took %v", frames, expected, elapsed)
+	}
+}
+
+func TestWaitFrameTimeout(t *testing.T) {
+	tree := trace.NewMutableTree(nil, 1)
+	if err := tree.SetVoxel([3]float32{0.5, 0.5, 0.5}, 0, color.RGBA{255, 255, 255, 255}); err != nil {
+		panic(err)
+	}
+
+	// Pixels block on release while the shader is slow, standing in for a view
+	// that takes pathologically long to trace.
+	var slow int32
+	release := make(chan struct{})
+	rect := image.Rect(0, 0, 16, 8)
+	cfg := trace.Config{
+		FieldOfViewDegrees: 45,
+		TreeScale:          1,
+		ViewDist:           10,
+		Shader: func(p image.Point, c color.RGBA, dist float32, hit bool) [3]float32 {
+			if atomic.LoadInt32(&slow) != 0 {
+				<-release
+			}
+			return [3]float32{float32(c.R) / 255, float32(c.G) / 255, float32(c.B) / 255}
+		},
+		Images: [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+
+	rt := trace.NewRaytracer(cfg)
+	defer rt.Close()
+
+	camera := trace.FreeFlightCamera{Pos: trace.Vec3{0.5, 0.5, 3}}
+	idx := rt.Trace(&camera, tree.Octree(), 1)
+	if err := waitFrame(rt, idx, time.Second, &camera); err != nil {
+		t.Fatal("expected the frame to complete, got:", err)
+	}
+
+	timedOut := atomic.LoadInt64(&metrics.timedOut)
+	atomic.StoreInt32(&slow, 1)
+	idx = rt.Trace(&camera, tree.Octree(), 1)
+
+	// The stuck pixels return once the frame is aborted.
+	go func() {
+		for {
+			if _, ok := rt.TryWait(); ok || atomic.LoadInt64(&metrics.timedOut) != timedOut {
+				atomic.StoreInt32(&slow, 0)
+				close(release)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	if err := waitFrame(rt, idx, 20*time.Millisecond, &camera); err != trace.FrameAbortedError {
+		t.Error("expected the frame to be aborted, got:", err)
+	}
+	if n := atomic.LoadInt64(&metrics.timedOut); n != timedOut+1 {
+		t.Errorf("expected one timed out frame, got %d", n-timedOut)
+	}
+}
@@ -0,0 +1,45 @@
+//go:build ignore
+// +build ignore
+
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Gendemo writes demo.oct, the sample tree embedded for -demo. Run it with go
+// generate.
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/andreas-jonsson/octatron/bench"
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+func main() {
+	fp, err := os.Create("demo.oct")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := bench.Outdoor.Build(fp, 5, 1, pack.MipR8G8B8A8PackUI28); err != nil {
+		log.Fatal(err)
+	}
+	if err := fp.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
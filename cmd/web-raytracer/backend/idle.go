@@ -0,0 +1,186 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+const (
+	// idleBlend is how long the camera takes to blend into the orbit and back.
+	idleBlend = 2 * time.Second
+
+	// idleMinRadius is the smallest orbit radius in tree units, and idleMaxSlope
+	// the largest height of the camera over the center per unit of radius. The
+	// orbit never looks straight down, where the yaw of the camera is undefined.
+	idleMinRadius = 0.5
+	idleMaxSlope  = 2
+)
+
+// idleCenter is the point the camera orbits, the center of the tree.
+var idleCenter = trace.Vec3{0.5, 0.5, 0.5}
+
+type (
+	// idleSetup changes the idle orbit of a client, zero fields keep the default
+	// of the server. Timeout is the number of seconds without camera input before
+	// the orbit starts, negative to disable it. Period is the number of seconds
+	// of a full orbit.
+	idleSetup struct {
+		Timeout float64 `timeout`
+		Period  float64 `period`
+	}
+
+	idleState int
+
+	// idleOrbit blends the camera of a client into a slow orbit around the tree
+	// once the client has not moved it for a while, and back to the camera of
+	// the client when it moves it again. The tree is rendered at the origin with
+	// scale one.
+	idleOrbit struct {
+		timeout, period time.Duration
+		state           idleState
+
+		// input is the last camera of the client and lastInput when it changed.
+		input     trace.FreeFlightCamera
+		lastInput time.Time
+		known     bool
+
+		// from is the camera the blend of the current state starts from, at
+		// since.
+		from  trace.FreeFlightCamera
+		since time.Time
+
+		radius, height, angle float64
+	}
+)
+
+const (
+	idleActive idleState = iota
+	idleOrbiting
+	idleReturning
+)
+
+func (s *idleSetup) validate() error {
+	if s == nil {
+		return nil
+	}
+	if math.IsNaN(s.Timeout) || math.IsInf(s.Timeout, 0) || !(s.Period >= 0) || math.IsInf(s.Period, 0) {
+		return &protocolError{invalidSetupError, "invalid idle orbit"}
+	}
+	return nil
+}
+
+// newIdleOrbit returns the idle orbit of a client with setup, nil if it is disabled.
+func newIdleOrbit(setup *idleSetup) *idleOrbit {
+	timeout, period := config.IdleTimeout, config.IdleOrbit
+	if setup != nil {
+		if setup.Timeout != 0 {
+			timeout = setup.Timeout
+		}
+		if setup.Period != 0 {
+			period = setup.Period
+		}
+	}
+
+	if !(timeout > 0) || !(period > 0) {
+		return nil
+	}
+	return &idleOrbit{
+		timeout: time.Duration(timeout * float64(time.Second)),
+		period:  time.Duration(period * float64(time.Second)),
+	}
+}
+
+// update returns the camera to render at now. Input is the camera the client sent,
+// any change to it counts as input, and camera is what is rendered without the
+// orbit. Left is set when input ends the orbit, the returned camera is then the
+// pose the client should continue from.
+func (o *idleOrbit) update(input, camera trace.FreeFlightCamera, now time.Time) (trace.FreeFlightCamera, bool) {
+	moved := !o.known || input != o.input
+	if moved {
+		o.input, o.lastInput, o.known = input, now, true
+	}
+
+	switch o.state {
+	case idleActive:
+		if now.Sub(o.lastInput) < o.timeout {
+			return camera, false
+		}
+		o.start(camera, now)
+	case idleOrbiting:
+		if moved {
+			o.from = o.orbitCamera(now)
+			o.state, o.since = idleReturning, now
+			return o.from, true
+		}
+	case idleReturning:
+		if now.Sub(o.since) >= idleBlend {
+			o.state = idleActive
+			return camera, false
+		}
+		return blendCameras(o.from, camera, o.blend(now)), false
+	}
+	return o.orbitCamera(now), false
+}
+
+// start starts the orbit from camera. The orbit passes through its position unless
+// it is too close to the vertical axis through the center.
+func (o *idleOrbit) start(camera trace.FreeFlightCamera, now time.Time) {
+	x, y, z := float64(camera.Pos[0]-idleCenter[0]), float64(camera.Pos[1]-idleCenter[1]), float64(camera.Pos[2]-idleCenter[2])
+
+	o.radius = math.Max(math.Hypot(x, z), idleMinRadius)
+	o.height = math.Max(-idleMaxSlope*o.radius, math.Min(y, idleMaxSlope*o.radius))
+	o.angle = math.Atan2(x, z)
+
+	o.state, o.since, o.from = idleOrbiting, now, camera
+}
+
+// orbitCamera returns the camera of the orbit at now, blended from the camera it
+// started from.
+func (o *idleOrbit) orbitCamera(now time.Time) trace.FreeFlightCamera {
+	angle := o.angle + 2*math.Pi*now.Sub(o.since).Seconds()/o.period.Seconds()
+	offset := trace.Vec3{float32(o.radius * math.Sin(angle)), float32(o.height), float32(o.radius * math.Cos(angle))}
+
+	pos := trace.Vec3{idleCenter[0] + offset[0], idleCenter[1] + offset[1], idleCenter[2] + offset[2]}
+	orbit := flightCamera(pos, trace.Vec3{-offset[0], -offset[1], -offset[2]})
+	return blendCameras(o.from, orbit, o.blend(now))
+}
+
+// blend returns how far the blend of the current state has come, from zero to one.
+func (o *idleOrbit) blend(now time.Time) float64 {
+	return math.Max(0, math.Min(now.Sub(o.since).Seconds()/idleBlend.Seconds(), 1))
+}
+
+// blendCameras returns the camera at w between a and b, eased in and out. The view
+// turns along the shortest arc, see trace.CatmullRomPath.
+func blendCameras(a, b trace.FreeFlightCamera, w float64) trace.FreeFlightCamera {
+	if w <= 0 {
+		return a
+	} else if w >= 1 {
+		return b
+	}
+
+	path, err := trace.NewCatmullRomPath([]trace.CameraKey{{Time: 0, Camera: &a}, {Time: 1, Camera: &b}})
+	if err != nil {
+		return b
+	}
+	pose := path.Eval(float32(w * w * (3 - 2*w)))
+	return flightCamera(pose.Pos, pose.Forward())
+}
@@ -0,0 +1,164 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+// poseJump returns how far the camera moved between a and b, and the angle between
+// their view directions.
+func poseJump(a, b trace.FreeFlightCamera) (float64, float64) {
+	var dist, dot float64
+	fa, fb := a.Forward(), b.Forward()
+	for i := range a.Pos {
+		d := float64(a.Pos[i] - b.Pos[i])
+		dist += d * d
+		dot += float64(fa[i] * fb[i])
+	}
+	return math.Sqrt(dist), math.Acos(math.Max(-1, math.Min(1, dot)))
+}
+
+func TestIdleOrbit(t *testing.T) {
+	const step = 20 * time.Millisecond
+
+	o := &idleOrbit{timeout: 10 * time.Second, period: 60 * time.Second}
+	now := time.Now()
+
+	// The client looks away from the tree, so blending in turns the view.
+	client := trace.FreeFlightCamera{Pos: trace.Vec3{0.5, 0.6, 2}, XRot: 2}
+
+	var (
+		last    trace.FreeFlightCamera
+		started bool
+	)
+	// run updates the orbit every step for d, the camera must not jump between
+	// updates. Left is the camera the client is told to take over from.
+	run := func(d time.Duration, move func()) (left *trace.FreeFlightCamera) {
+		for end := now.Add(d); now.Before(end); now = now.Add(step) {
+			if move != nil {
+				move()
+			}
+
+			camera, ok := o.update(client, client, now)
+			if ok {
+				left = &camera
+				client = camera
+			}
+			if started {
+				if dist, angle := poseJump(last, camera); dist > 0.01 || angle > 0.05 {
+					t.Fatalf("state %d: the camera jumps %.3f units and %.3f radians at %v", o.state, dist, angle, now)
+				}
+			}
+			last, started = camera, true
+		}
+		return left
+	}
+
+	run(9*time.Second, nil)
+	if o.state != idleActive || last != client {
+		t.Fatalf("expected the client camera before the timeout, got state %d", o.state)
+	}
+
+	run(2*time.Second, nil)
+	if o.state != idleOrbiting {
+		t.Fatalf("expected an orbit after the timeout, got state %d", o.state)
+	}
+
+	// Once blended in the camera looks at the center from the orbit radius.
+	run(3*time.Second, nil)
+	x, z := float64(last.Pos[0]-idleCenter[0]), float64(last.Pos[2]-idleCenter[2])
+	if r := math.Hypot(x, z); math.Abs(r-1.5) > 1e-3 {
+		t.Errorf("expected an orbit radius of 1.5, got %v", r)
+	}
+	center := flightCamera(last.Pos, trace.Vec3{idleCenter[0] - last.Pos[0], idleCenter[1] - last.Pos[1], idleCenter[2] - last.Pos[2]})
+	if _, angle := poseJump(last, center); angle > 1e-3 {
+		t.Errorf("expected the orbit to look at the center, %v radians off", angle)
+	}
+
+	// Input ends the orbit where it is, the client continues from there.
+	moved := false
+	left := run(step, func() {
+		if !moved {
+			client.XRot += 0.01
+			moved = true
+		}
+	})
+	if left == nil || o.state != idleReturning {
+		t.Fatalf("expected input to end the orbit, got state %d", o.state)
+	}
+
+	// The client walks off from the pose it was given while the blend returns.
+	run(idleBlend+step, func() { client.Pos[0] += 0.001 })
+	if o.state != idleActive || last != client {
+		t.Fatalf("expected the client camera after the blend, got state %d", o.state)
+	}
+
+	// Idle again after another timeout.
+	run(o.timeout+step, nil)
+	if o.state != idleOrbiting {
+		t.Errorf("expected a second orbit, got state %d", o.state)
+	}
+}
+
+func TestIdleOrbitClamp(t *testing.T) {
+	o := &idleOrbit{timeout: time.Second, period: 10 * time.Second}
+	now := time.Now()
+
+	// A camera straight above the center orbits at the smallest radius, never
+	// looking straight down.
+	above := trace.FreeFlightCamera{Pos: trace.Vec3{0.5, 5, 0.5}, YRot: -math.Pi / 2}
+	o.update(above, above, now)
+	o.update(above, above, now.Add(o.timeout))
+	camera, _ := o.update(above, above, now.Add(o.timeout+idleBlend))
+
+	x, y, z := float64(camera.Pos[0]-idleCenter[0]), float64(camera.Pos[1]-idleCenter[1]), float64(camera.Pos[2]-idleCenter[2])
+	if r := math.Hypot(x, z); math.Abs(r-idleMinRadius) > 1e-3 || y > idleMaxSlope*r+1e-3 {
+		t.Errorf("unexpected orbit position %v", camera.Pos)
+	}
+	if math.IsNaN(float64(camera.XRot)) || math.Abs(float64(camera.YRot)) > math.Atan(idleMaxSlope)+1e-3 {
+		t.Errorf("unexpected orbit rotation %+v", camera)
+	}
+}
+
+func TestNewIdleOrbit(t *testing.T) {
+	config = defaultConfig()
+	if newIdleOrbit(nil) != nil {
+		t.Error("expected the orbit to be disabled by default")
+	}
+
+	config.IdleTimeout = 30
+	if o := newIdleOrbit(nil); o == nil || o.timeout != 30*time.Second || o.period != 60*time.Second {
+		t.Errorf("expected the server defaults, got %+v", o)
+	}
+	if o := newIdleOrbit(&idleSetup{Period: 20}); o == nil || o.timeout != 30*time.Second || o.period != 20*time.Second {
+		t.Errorf("expected the period of the setup, got %+v", o)
+	}
+	if newIdleOrbit(&idleSetup{Timeout: -1}) != nil {
+		t.Error("expected a negative timeout to disable the orbit")
+	}
+
+	for _, setup := range []idleSetup{{Timeout: math.NaN()}, {Period: -1}, {Period: math.Inf(1)}} {
+		if err := setup.validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", setup)
+		}
+	}
+}
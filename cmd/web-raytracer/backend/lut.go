@@ -0,0 +1,51 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+// loadLUT reads the .cube file name from the data directory. No LUT is used if name
+// is empty.
+func loadLUT(name string) (*trace.LUT, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".cube" {
+		return nil, &protocolError{unknownLUTError, "unknown LUT: " + name}
+	}
+
+	fp, err := os.Open(filepath.Join(config.DataDir, name))
+	if os.IsNotExist(err) {
+		return nil, &protocolError{unknownLUTError, "unknown LUT: " + name}
+	} else if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	lut, err := trace.ParseCube(fp)
+	if err == trace.InvalidLUTError {
+		return nil, &protocolError{invalidSetupError, name + ": " + err.Error()}
+	}
+	return lut, err
+}
@@ -0,0 +1,113 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+const invertCube = `TITLE "Invert"
+LUT_3D_SIZE 2
+1 1 1
+0 1 1
+1 0 1
+0 0 1
+1 1 0
+0 1 0
+1 0 0
+0 0 0
+`
+
+func lutFrame(t *testing.T, server *testServer, lut string) []byte {
+	setup := testSetup()
+	setup.Tree = "tree.oct"
+	setup.LUT = lut
+	setup.ClearColor = [4]byte{10, 20, 30, 255}
+	_, ws := dial(server, setup)
+	defer ws.Close()
+
+	var update updateMessage
+	update.Camera.Position = [3]float32{0.25, 0.25, 1}
+	if err := websocket.JSON.Send(ws, update); err != nil {
+		panic(err)
+	}
+
+	var data []byte
+	if err := websocket.Message.Receive(ws, &data); err != nil {
+		t.Fatal(err)
+	}
+	return data[frameHeaderSize:]
+}
+
+func TestLUT(t *testing.T) {
+	dir, err := ioutil.TempDir("", "octatron")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestTree(filepath.Join(dir, "tree.oct"))
+	files := map[string]string{"invert.cube": invertCube, "bad.cube": "LUT_3D_SIZE 2\n0 0 0\n", "invert.txt": invertCube}
+	for name, text := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			panic(err)
+		}
+	}
+
+	server := startTestServer("", 0)
+	defer server.Close()
+	config.DataDir = dir
+	config.Jitter = false
+
+	for lut, code := range map[string]string{"missing.cube": unknownLUTError, "../invert.cube": unknownLUTError, "invert.txt": unknownLUTError, "bad.cube": invalidSetupError} {
+		setup := testSetup()
+		setup.LUT = lut
+		data, ws := dial(server, setup)
+
+		var msg errorMessage
+		if json.Unmarshal(data, &msg); msg.Error != code {
+			t.Errorf("%s: expected %s, got %s", lut, code, msg.Error)
+		}
+		expectClosed(t, ws)
+		ws.Close()
+	}
+
+	plain := lutFrame(t, server, "")
+	inverted := lutFrame(t, server, "invert.cube")
+
+	var hits int
+	for i := 0; i < len(plain); i += 4 {
+		for c := 0; c < 3; c++ {
+			if inverted[i+c] != 255-plain[i+c] {
+				t.Fatalf("pixel %v: %v is not the inverse of %v", i/4, inverted[i:i+3], plain[i:i+3])
+			}
+		}
+		if plain[i] == 255 {
+			hits++
+		}
+	}
+
+	if hits == 0 {
+		t.Error("the tree is not in the frame")
+	}
+}
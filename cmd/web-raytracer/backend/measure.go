@@ -0,0 +1,161 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"image"
+	"math"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+type (
+	// measureRequest asks for the distance between two points of the tree.
+	// Pixels are normalized positions in the view, like the cursor, resolved
+	// with the camera of the update. Points are the camera coordinates of a
+	// measurement made before, sent again to learn if they are still visible.
+	// It is answered with a measureMessage.
+	measureRequest struct {
+		Pixels *[2][2]float32 `pixels`
+		Points *[2][3]float32 `points`
+	}
+
+	// measurePoint is an end of a measurement. Position is in camera
+	// coordinates, to draw the marker, and World in the coordinates of the
+	// tree, of its coordinate reference system if it has one. Visible is false
+	// if leafs are in front of the point. Node and Instance are the leaf and
+	// the tree picked by the pixel, trace.PickMiss and trace.InstanceMiss for
+	// points sent again.
+	measurePoint struct {
+		Position [3]float32 `position`
+		World    [3]float64 `world`
+		Visible  bool       `visible`
+		Node     uint32     `node`
+		Instance uint16     `instance`
+	}
+
+	// measurement holds the points of a measureRequest, nil for pixels that
+	// miss the tree. Distance is set if both points are, in world units.
+	measurement struct {
+		Points   [2]*measurePoint `points`
+		Distance *float64         `distance`
+	}
+
+	measureMessage struct {
+		Measure measurement `measure`
+	}
+)
+
+func (req *measureRequest) validate() error {
+	switch {
+	case (req.Pixels == nil) == (req.Points == nil):
+		return errors.New("measure needs either pixels or points")
+	case req.Pixels != nil:
+		for _, p := range req.Pixels {
+			for _, v := range p {
+				if !(v >= 0 && v <= 1) {
+					return errors.New("measure pixel is outside the view")
+				}
+			}
+		}
+	default:
+		for _, p := range req.Points {
+			for _, v := range p {
+				if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+					return errors.New("measure point is not finite")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// measure resolves req in frame of tree with the camera and field of view in
+// degrees of the view, which is size pixels. Points are converted to world
+// coordinates with the info of the frame.
+func measure(tree *treeData, frame int, req *measureRequest, camera trace.FreeFlightCamera, fov float32, size image.Point) measurement {
+	if frame < 0 || frame >= len(tree.frames) {
+		frame = 0
+	}
+
+	rect := image.Rect(0, 0, 1, 1)
+	raytracer := trace.NewRaytracer(trace.Config{
+		FieldOfViewDegrees: fov,
+		TreeScale:          1,
+		Images:             [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	defer raytracer.Close()
+
+	octree, maxDepth, info := tree.frames[frame], tree.maxDepth, tree.infos[frame]
+	viewDist := float32(config.ViewDistance)
+
+	var m measurement
+	for i := range m.Points {
+		var pos trace.Vec3
+		node, instance := trace.PickMiss, trace.InstanceMiss
+		if req.Pixels != nil {
+			origin, dir := raytracer.PixelRay(&camera, size, req.Pixels[i][0]*float32(size.X), req.Pixels[i][1]*float32(size.Y))
+			hit, ok := raytracer.CastRay(octree, maxDepth, origin, dir, viewDist)
+			if !ok {
+				continue
+			}
+			pos, node, instance = hit.Position, hit.Node, hit.Instance
+		} else {
+			pos = req.Points[i]
+		}
+
+		world := raytracer.WorldPosition(info, pos)
+		m.Points[i] = &measurePoint{
+			Position: pos,
+			World:    [3]float64{world.X, world.Y, world.Z},
+			Visible:  pointVisible(raytracer, octree, maxDepth, camera.Pos, pos, viewDist),
+			Node:     node,
+			Instance: instance,
+		}
+	}
+
+	if a, b := m.Points[0], m.Points[1]; a != nil && b != nil {
+		var sum float64
+		for axis := range a.World {
+			d := a.World[axis] - b.World[axis]
+			sum += d * d
+		}
+		dist := math.Sqrt(sum)
+		m.Distance = &dist
+	}
+	return m
+}
+
+// pointVisible reports if pos is seen from eye. Points on the faces of leafs are
+// visible if the ray to them hits within half a voxel of them.
+func pointVisible(raytracer *trace.Raytracer, octree trace.Octree, maxDepth int, eye, pos trace.Vec3, viewDist float32) bool {
+	dir := trace.Vec3{pos[0] - eye[0], pos[1] - eye[1], pos[2] - eye[2]}
+	dist := float32(math.Sqrt(float64(dir[0]*dir[0] + dir[1]*dir[1] + dir[2]*dir[2])))
+	if dist == 0 {
+		return true
+	} else if dist > viewDist {
+		return false
+	}
+	for axis := range dir {
+		dir[axis] /= dist
+	}
+
+	hit, ok := raytracer.CastRay(octree, maxDepth, eye, dir, viewDist)
+	return !ok || hit.Distance >= dist-0.5/float32(int(1)<<uint(maxDepth))
+}
@@ -0,0 +1,83 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"image"
+	"math"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/pack"
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+func TestMeasure(t *testing.T) {
+	config.ViewDistance = 10
+
+	// The tree is a solid cube covering four world units from x = 10.
+	cube := trace.NewMutableTree(nil, 2)
+	if err := cube.SetVoxel([3]float32{0.5, 0.5, 0.5}, 0, editRed); err != nil {
+		t.Fatal(err)
+	}
+	info := trace.TreeInfo{VoxelsPerAxis: 2, Bounds: pack.Box{Pos: pack.Point{X: 10}, Size: 4}}
+	tree := &treeData{frames: []trace.Octree{cube.Octree()}, infos: []*trace.TreeInfo{&info}, maxDepth: 1}
+
+	camera := trace.FreeFlightCamera{Pos: trace.Vec3{0.5, 0.5, 4}}
+	size := image.Pt(32, 16)
+
+	m := measure(tree, 0, &measureRequest{Pixels: &[2][2]float32{{0.45, 0.4}, {0.55, 0.4}}}, camera, 45, size)
+	a, b := m.Points[0], m.Points[1]
+	if a == nil || b == nil || m.Distance == nil {
+		t.Fatalf("expected both pixels to hit, got %+v", m)
+	}
+	for _, p := range []*measurePoint{a, b} {
+		if math.Abs(float64(p.Position[2])-1) > 1e-4 || !p.Visible {
+			t.Errorf("expected a visible point on the front face, got %+v", p)
+		}
+		if x := 10 + 4*float64(p.Position[0]); math.Abs(p.World[0]-x) > 1e-4 {
+			t.Errorf("expected world x %v, got %v", x, p.World[0])
+		}
+		if p.Node == trace.PickMiss || p.Instance != 0 {
+			t.Errorf("expected the pick to name a leaf of the tree, got node %d of instance %d", p.Node, p.Instance)
+		}
+	}
+	if expected := 4 * math.Abs(float64(b.Position[0]-a.Position[0])); math.Abs(*m.Distance-expected) > 1e-4 {
+		t.Errorf("expected distance %v, got %v", expected, *m.Distance)
+	}
+
+	// A pixel that misses the tree has no point and no distance.
+	m = measure(tree, 0, &measureRequest{Pixels: &[2][2]float32{{0.45, 0.4}, {0.1, 0.4}}}, camera, 45, size)
+	if m.Points[0] == nil || m.Points[1] != nil || m.Distance != nil {
+		t.Errorf("expected the second pixel to miss, got %+v", m)
+	}
+
+	// Points sent again are checked for leafs in front of them.
+	m = measure(tree, 0, &measureRequest{Points: &[2][3]float32{{0.5, 0.4, 1}, {0.5, 0.4, 0}}}, camera, 45, size)
+	if !m.Points[0].Visible || m.Points[1].Visible || m.Distance == nil || math.Abs(*m.Distance-4) > 1e-4 {
+		t.Errorf("expected the back point to be hidden, got %+v, %+v", m.Points[0], m.Points[1])
+	}
+	if p := m.Points[0]; p.Node != trace.PickMiss || p.Instance != trace.InstanceMiss {
+		t.Errorf("expected points sent again to pick nothing, got node %d of instance %d", p.Node, p.Instance)
+	}
+
+	for _, req := range []measureRequest{{}, {Pixels: &[2][2]float32{{0.5, 1.5}}}, {Points: &[2][3]float32{{float32(math.NaN())}}}} {
+		if req.validate() == nil {
+			t.Errorf("expected %+v to be invalid", req)
+		}
+	}
+}
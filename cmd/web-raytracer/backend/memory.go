@@ -0,0 +1,221 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// bufferBytesPerPixel is roughly the memory of a pixel of a client: two RGBA
+	// images and a paletted back buffer at half width, and the encoded frame.
+	bufferBytesPerPixel = 8
+
+	// maxMemoryDowngrades is the number of times the resolution of a new client
+	// is halved to fit the memory budget before it is rejected.
+	maxMemoryDowngrades = 2
+)
+
+// memoryBudget accounts the cached trees and the frame buffers of the clients
+// against the MemoryBudget of the config. Trees are counted while they are in
+// the cache, buffers are reserved by the connections.
+type memoryBudget struct {
+	lock    sync.Mutex
+	buffers int64
+
+	// viewers is the number of connections viewing each tree file, trees
+	// without viewers may be evicted. viewed is when the last viewer left.
+	viewers map[string]int
+	viewed  map[string]time.Time
+}
+
+var memory = newMemoryBudget()
+
+func newMemoryBudget() *memoryBudget {
+	return &memoryBudget{viewers: make(map[string]int), viewed: make(map[string]time.Time)}
+}
+
+// memorySize returns the number of bytes the frames of tree use.
+func (tree *treeData) memorySize() int64 {
+	var size int64
+	for _, info := range tree.infos {
+		size += int64(info.NumNodes) * nodeSize
+	}
+	return size
+}
+
+// bufferSize returns the number of bytes reserved for a client rendering the
+// main view at quality q and the viewports of setup.
+func bufferSize(setup *setupMessage, q quality) int64 {
+	return int64(viewportPixels(q, setup.Viewports)) * bufferBytesPerPixel
+}
+
+// cachedTreeMemory returns the number of bytes used by the cached trees, except
+// the tree loaded from skip.
+func cachedTreeMemory(skip string) int64 {
+	trees.Lock()
+	defer trees.Unlock()
+
+	var size int64
+	for file, tree := range trees.cache {
+		if file != skip {
+			size += tree.memorySize()
+		}
+	}
+	return size
+}
+
+// view records that a connection views the tree in file until unview is called.
+func (m *memoryBudget) view(file string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.viewers[file]++
+}
+
+func (m *memoryBudget) unview(file string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.viewers[file]--; m.viewers[file] <= 0 {
+		delete(m.viewers, file)
+		m.viewed[file] = time.Now()
+	}
+}
+
+// usage returns the number of bytes used by the cached trees and reserved for
+// the buffers of the clients.
+func (m *memoryBudget) usage() (treeBytes, bufferBytes int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return cachedTreeMemory(""), m.buffers
+}
+
+// makeRoomLocked reports if size more bytes fit in the budget, evicting unused
+// trees if they don't. The cached tree of skip is not counted, it is about to be
+// replaced.
+func (m *memoryBudget) makeRoomLocked(size int64, skip string) bool {
+	if config.MemoryBudget <= 0 {
+		return true
+	}
+
+	over := cachedTreeMemory(skip) + m.buffers + size - config.MemoryBudget
+	if over > 0 {
+		over -= m.evictLocked(over, skip)
+	}
+	return over <= 0
+}
+
+// evictLocked removes trees without viewers from the cache, the least recently
+// viewed first, until size bytes are freed. Edited trees are kept, their edits
+// would be lost. The number of bytes freed is returned.
+func (m *memoryBudget) evictLocked(size int64, skip string) int64 {
+	trees.Lock()
+	defer trees.Unlock()
+
+	var unused []string
+	for file, tree := range trees.cache {
+		if file != skip && m.viewers[file] == 0 && tree.editor == nil {
+			unused = append(unused, file)
+		}
+	}
+
+	sort.Slice(unused, func(i, j int) bool {
+		a, b := m.viewed[unused[i]], m.viewed[unused[j]]
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return unused[i] < unused[j]
+	})
+
+	var freed int64
+	for _, file := range unused {
+		if freed >= size {
+			break
+		}
+
+		tree := trees.cache[file]
+		delete(trees.cache, file)
+		delete(m.viewed, file)
+		tree.releaseSnapshots()
+
+		n := tree.memorySize()
+		logv(1, fmt.Sprintf("evicted tree %s, %d bytes freed", file, n))
+		freed += n
+		metrics.addEvicted(1)
+	}
+	return freed
+}
+
+// makeRoom makes room for a tree of size bytes loaded from file, which replaces
+// the cached version of file. The room is not reserved, the tree is counted once
+// it is cached.
+func (m *memoryBudget) makeRoom(file string, size int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.makeRoomLocked(size, file) {
+		metrics.addRejected(1)
+		return &protocolError{serverCapacityError, fmt.Sprintf("server is at capacity, no room for a tree of %v bytes", size)}
+	}
+	return nil
+}
+
+// admit reserves the buffers of a new client rendering at quality q. Unused trees
+// are evicted to make room, and if that is not enough the resolution is lowered.
+// The quality the client fits at and the number of bytes reserved are returned,
+// or a protocol error if it does not fit.
+func (m *memoryBudget) admit(setup *setupMessage, q quality) (quality, int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for i := 0; i <= maxMemoryDowngrades; i++ {
+		if i > 0 {
+			q = q.throttled()
+		}
+
+		size := bufferSize(setup, q)
+		if m.makeRoomLocked(size, "") {
+			if i > 0 {
+				metrics.addDowngraded(1)
+			}
+			m.buffers += size
+			return q, size, nil
+		}
+	}
+
+	metrics.addRejected(1)
+	return q, 0, &protocolError{serverCapacityError, "server is at capacity"}
+}
+
+// resize changes the buffers reserved by a connection from reserved to size bytes.
+// Unused trees are evicted if the buffers grow over the budget. If that is not
+// enough a protocol error is returned and the reservation kept.
+func (m *memoryBudget) resize(reserved *int64, size int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if grow := size - *reserved; grow > 0 && !m.makeRoomLocked(grow, "") {
+		return &protocolError{serverCapacityError, "server is at capacity, the quality is kept"}
+	}
+	m.buffers += size - *reserved
+	*reserved = size
+	return nil
+}
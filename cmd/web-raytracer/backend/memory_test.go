@@ -0,0 +1,120 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	resetServerState("", 0)
+
+	// The default tree uses 32 bytes and is viewed, a client at 64x32 needs
+	// 16384 bytes and 4096 at half the resolution.
+	const (
+		treeBytes = nodeSize
+		fullBytes = 64 * 32 * bufferBytesPerPixel
+		halfBytes = fullBytes / 4
+	)
+	config.MemoryBudget = treeBytes + fullBytes + halfBytes + 100
+	logger := &captureLogger{}
+	config.Logger = logger
+	memory.view(config.treePath())
+
+	trees.cache["unused.oct"] = &treeData{file: "unused.oct", infos: []*trace.TreeInfo{{NumNodes: 200}}}
+	trees.cache["edited.oct"] = &treeData{file: "edited.oct", infos: []*trace.TreeInfo{{NumNodes: 1}}, editor: trace.NewMutableTree(nil, 1)}
+
+	evicted, downgraded, rejected := atomic.LoadInt64(&metrics.evicted), atomic.LoadInt64(&metrics.downgraded), atomic.LoadInt64(&metrics.rejected)
+	var setup setupMessage
+	want := quality{Width: 64, Height: 32, Samples: 2}
+
+	// The unused tree is evicted first.
+	q, first, err := memory.admit(&setup, want)
+	if err != nil || q != want || first != fullBytes {
+		t.Fatalf("first client: %v at %+v with %d bytes", err, q, first)
+	}
+	if _, ok := trees.cache["unused.oct"]; ok || atomic.LoadInt64(&metrics.evicted) != evicted+1 {
+		t.Error("the unused tree was not evicted")
+	}
+	if _, ok := trees.cache["edited.oct"]; !ok {
+		t.Error("the edited tree was evicted")
+	}
+	if _, ok := logger.find("info: evicted tree unused.oct", "bytes freed"); !ok {
+		t.Errorf("eviction not logged: %q", logger.messages)
+	}
+
+	// With nothing left to evict the next client gets half the resolution.
+	q, second, err := memory.admit(&setup, want)
+	if err != nil || q.Width != 32 || q.Height != 16 || second != halfBytes {
+		t.Fatalf("second client: %v at %+v with %d bytes", err, q, second)
+	}
+	if atomic.LoadInt64(&metrics.downgraded) != downgraded+1 || atomic.LoadInt64(&metrics.rejected) != rejected {
+		t.Error("expected one downgraded client")
+	}
+
+	// The third does not fit at any resolution.
+	if _, _, err := memory.admit(&setup, want); err == nil || err.(*protocolError).code != serverCapacityError {
+		t.Fatal("expected the third client to be rejected, got", err)
+	}
+	if atomic.LoadInt64(&metrics.rejected) != rejected+1 {
+		t.Error("expected one rejected client")
+	}
+
+	// Trees that don't fit are rejected before they are loaded, trees replacing
+	// their cached version only need the difference.
+	if err := memory.makeRoom("large.oct", 200); err == nil {
+		t.Error("expected the tree to be rejected")
+	}
+	if err := memory.makeRoom(config.treePath(), treeBytes+50); err != nil {
+		t.Error("could not replace the default tree:", err)
+	}
+
+	// Quality changes that grow the buffers over the budget are refused.
+	if err := memory.resize(&second, fullBytes); err == nil || second != halfBytes {
+		t.Errorf("expected the reservation to be kept, got %d bytes and %v", second, err)
+	}
+
+	memory.resize(&first, 0)
+	memory.resize(&second, 0)
+	if trees, buffers := memory.usage(); trees != 2*treeBytes || buffers != 0 {
+		t.Errorf("expected %d bytes of trees and no buffers, got %d and %d", 2*treeBytes, trees, buffers)
+	}
+}
+
+func TestMemoryBudgetReject(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+	config.MemoryBudget = 256
+
+	data, ws := dial(server, testSetup())
+	defer ws.Close()
+
+	var msg errorMessage
+	if json.Unmarshal(data, &msg); msg.Error != serverCapacityError {
+		t.Errorf("expected %s, got %s", serverCapacityError, data)
+	}
+	expectClosed(t, ws)
+
+	if _, buffers := memory.usage(); buffers != 0 {
+		t.Errorf("rejected client holds %d bytes", buffers)
+	}
+}
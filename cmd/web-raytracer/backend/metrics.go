@@ -0,0 +1,171 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const metricsPath = "/metrics"
+
+// serverMetrics are counters for all connections, served in the Prometheus text format.
+type serverMetrics struct {
+	clients, framesSent, framesDropped int64
+	framesRendered, cacheHits          int64
+	throttled, timedOut                int64
+
+	// renderTime is the time spent rendering frames in nanoseconds.
+	renderTime int64
+
+	// frameRate is the sum of the frame rates of the clients in millihertz.
+	frameRate int64
+
+	// snapshots is the number of tree versions held by the cache or renderers.
+	snapshots int64
+
+	// evicted, downgraded and rejected count the trees and clients shed to stay
+	// within the memory budget.
+	evicted, downgraded, rejected int64
+}
+
+var metrics serverMetrics
+
+func (m *serverMetrics) addClients(n int64) {
+	atomic.AddInt64(&m.clients, n)
+}
+
+func (m *serverMetrics) addSent(n int64) {
+	atomic.AddInt64(&m.framesSent, n)
+}
+
+func (m *serverMetrics) addDropped(n int64) {
+	atomic.AddInt64(&m.framesDropped, n)
+}
+
+func (m *serverMetrics) addRendered(n int64) {
+	atomic.AddInt64(&m.framesRendered, n)
+}
+
+func (m *serverMetrics) addRenderTime(d time.Duration) {
+	atomic.AddInt64(&m.renderTime, int64(d))
+}
+
+func (m *serverMetrics) addCacheHits(n int64) {
+	atomic.AddInt64(&m.cacheHits, n)
+}
+
+func (m *serverMetrics) addThrottled(n int64) {
+	atomic.AddInt64(&m.throttled, n)
+}
+
+func (m *serverMetrics) addTimedOut(n int64) {
+	atomic.AddInt64(&m.timedOut, n)
+}
+
+func (m *serverMetrics) addFrameRate(millihertz int64) {
+	atomic.AddInt64(&m.frameRate, millihertz)
+}
+
+func (m *serverMetrics) addSnapshots(n int64) {
+	atomic.AddInt64(&m.snapshots, n)
+}
+
+func (m *serverMetrics) addEvicted(n int64) {
+	atomic.AddInt64(&m.evicted, n)
+}
+
+func (m *serverMetrics) addDowngraded(n int64) {
+	atomic.AddInt64(&m.downgraded, n)
+}
+
+func (m *serverMetrics) addRejected(n int64) {
+	atomic.AddInt64(&m.rejected, n)
+}
+
+func (m *serverMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP octatron_clients Number of connected render clients.")
+	fmt.Fprintln(w, "# TYPE octatron_clients gauge")
+	fmt.Fprintln(w, "octatron_clients", atomic.LoadInt64(&m.clients))
+
+	fmt.Fprintln(w, "# HELP octatron_frames_sent_total Number of frames sent to clients.")
+	fmt.Fprintln(w, "# TYPE octatron_frames_sent_total counter")
+	fmt.Fprintln(w, "octatron_frames_sent_total", atomic.LoadInt64(&m.framesSent))
+
+	fmt.Fprintln(w, "# HELP octatron_frames_dropped_total Number of frames replaced by a newer frame before they were sent.")
+	fmt.Fprintln(w, "# TYPE octatron_frames_dropped_total counter")
+	fmt.Fprintln(w, "octatron_frames_dropped_total", atomic.LoadInt64(&m.framesDropped))
+
+	fmt.Fprintln(w, "# HELP octatron_frames_rendered_total Number of frames rendered.")
+	fmt.Fprintln(w, "# TYPE octatron_frames_rendered_total counter")
+	fmt.Fprintln(w, "octatron_frames_rendered_total", atomic.LoadInt64(&m.framesRendered))
+
+	fmt.Fprintln(w, "# HELP octatron_render_seconds_total Time spent rendering frames.")
+	fmt.Fprintln(w, "# TYPE octatron_render_seconds_total counter")
+	fmt.Fprintln(w, "octatron_render_seconds_total", time.Duration(atomic.LoadInt64(&m.renderTime)).Seconds())
+
+	fmt.Fprintln(w, "# HELP octatron_render_cache_hits_total Number of frames sent again because the view did not change.")
+	fmt.Fprintln(w, "# TYPE octatron_render_cache_hits_total counter")
+	fmt.Fprintln(w, "octatron_render_cache_hits_total", atomic.LoadInt64(&m.cacheHits))
+
+	fmt.Fprintln(w, "# HELP octatron_throttled_clients Number of clients rendered at a lower quality for going over the render budget.")
+	fmt.Fprintln(w, "# TYPE octatron_throttled_clients gauge")
+	fmt.Fprintln(w, "octatron_throttled_clients", atomic.LoadInt64(&m.throttled))
+
+	fmt.Fprintln(w, "# HELP octatron_frames_timed_out_total Number of frames aborted for rendering longer than the frame timeout.")
+	fmt.Fprintln(w, "# TYPE octatron_frames_timed_out_total counter")
+	fmt.Fprintln(w, "octatron_frames_timed_out_total", atomic.LoadInt64(&m.timedOut))
+
+	fmt.Fprintln(w, "# HELP octatron_frames_per_second Sum of the frame rates achieved by the clients.")
+	fmt.Fprintln(w, "# TYPE octatron_frames_per_second gauge")
+	fmt.Fprintln(w, "octatron_frames_per_second", float64(atomic.LoadInt64(&m.frameRate))/1000)
+
+	fmt.Fprintln(w, "# HELP octatron_tree_snapshots Number of tree versions held by the cache or by renderers.")
+	fmt.Fprintln(w, "# TYPE octatron_tree_snapshots gauge")
+	fmt.Fprintln(w, "octatron_tree_snapshots", atomic.LoadInt64(&m.snapshots))
+
+	treeBytes, bufferBytes := memory.usage()
+
+	fmt.Fprintln(w, "# HELP octatron_memory_budget_bytes Memory the cached trees and client buffers may use, 0 for unlimited.")
+	fmt.Fprintln(w, "# TYPE octatron_memory_budget_bytes gauge")
+	fmt.Fprintln(w, "octatron_memory_budget_bytes", config.MemoryBudget)
+
+	fmt.Fprintln(w, "# HELP octatron_memory_tree_bytes Memory used by the cached trees.")
+	fmt.Fprintln(w, "# TYPE octatron_memory_tree_bytes gauge")
+	fmt.Fprintln(w, "octatron_memory_tree_bytes", treeBytes)
+
+	fmt.Fprintln(w, "# HELP octatron_memory_buffer_bytes Memory reserved for the frame buffers of the clients.")
+	fmt.Fprintln(w, "# TYPE octatron_memory_buffer_bytes gauge")
+	fmt.Fprintln(w, "octatron_memory_buffer_bytes", bufferBytes)
+
+	fmt.Fprintln(w, "# HELP octatron_trees_evicted_total Number of unused trees evicted from the cache to stay within the memory budget.")
+	fmt.Fprintln(w, "# TYPE octatron_trees_evicted_total counter")
+	fmt.Fprintln(w, "octatron_trees_evicted_total", atomic.LoadInt64(&m.evicted))
+
+	fmt.Fprintln(w, "# HELP octatron_clients_downgraded_total Number of clients given a lower resolution to stay within the memory budget.")
+	fmt.Fprintln(w, "# TYPE octatron_clients_downgraded_total counter")
+	fmt.Fprintln(w, "octatron_clients_downgraded_total", atomic.LoadInt64(&m.downgraded))
+
+	fmt.Fprintln(w, "# HELP octatron_memory_rejected_total Number of clients and tree loads rejected for going over the memory budget.")
+	fmt.Fprintln(w, "# TYPE octatron_memory_rejected_total counter")
+	fmt.Fprintln(w, "octatron_memory_rejected_total", atomic.LoadInt64(&m.rejected))
+}
@@ -0,0 +1,94 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+// minimapSize is the width and height of minimaps in pixels.
+const minimapSize = 128
+
+type (
+	// minimap is a top-down view of the tree. Image is a PNG data URL and Bounds
+	// is the area of the XZ plane it covers as min x, min z, max x, max z in
+	// camera coordinates. Rows go from min z to max z.
+	minimap struct {
+		Image  string     `image`
+		Bounds [4]float32 `bounds`
+	}
+
+	minimapMessage struct {
+		Minimap minimap `minimap`
+	}
+)
+
+// renderMinimap renders tree straight from above with one vertical ray per pixel,
+// so pixels map linearly to the XZ plane. Lower leafs are darker and pixels where
+// nothing is hit have the clear color.
+func renderMinimap(tree trace.Octree, maxDepth int, clear color.RGBA, size int) *image.RGBA {
+	rect := image.Rect(0, 0, 1, 1)
+	raytracer := trace.NewRaytracer(trace.Config{
+		TreeScale: 1,
+		Images:    [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	defer raytracer.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	down := trace.Vec3{0, -1, 0}
+
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			origin := trace.Vec3{(float32(x) + 0.5) / float32(size), 2, (float32(y) + 0.5) / float32(size)}
+			hit, ok := raytracer.CastRay(tree, maxDepth, origin, down, 3)
+			if !ok {
+				img.SetRGBA(x, y, clear)
+				continue
+			}
+
+			shade := 0.5 + 0.5*hit.Position[1]
+			if shade > 1 {
+				shade = 1
+			} else if shade < 0.5 {
+				shade = 0.5
+			}
+			c := hit.Color
+			img.SetRGBA(x, y, color.RGBA{uint8(float32(c.R) * shade), uint8(float32(c.G) * shade), uint8(float32(c.B) * shade), 0xFF})
+		}
+	}
+	return img
+}
+
+// newMinimapMessage renders the minimap of frame of tree and encodes it.
+func newMinimapMessage(tree *treeData, frame int, clear color.RGBA) (minimapMessage, error) {
+	img := renderMinimap(tree.frames[frame], tree.maxDepth, clear, minimapSize)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return minimapMessage{}, err
+	}
+
+	// Trees are rendered in the unit cube whatever their world bounds are.
+	url := "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+	return minimapMessage{minimap{url, [4]float32{0, 0, 1, 1}}}, nil
+}
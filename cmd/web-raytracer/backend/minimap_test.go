@@ -0,0 +1,95 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+func TestRenderMinimap(t *testing.T) {
+	tree := trace.NewMutableTree(nil, 2)
+	gray := color.RGBA{200, 200, 200, 255}
+	if err := tree.SetVoxel([3]float32{0.25, 0.75, 0.25}, 1, gray); err != nil {
+		panic(err)
+	}
+	if err := tree.SetVoxel([3]float32{0.75, 0.25, 0.75}, 1, gray); err != nil {
+		panic(err)
+	}
+
+	clear := color.RGBA{0, 0, 255, 255}
+	img := renderMinimap(tree.Octree(), 1, clear, 16)
+
+	// Rows go along z, so the voxels are in the top left and bottom right.
+	high, low := img.RGBAAt(4, 4), img.RGBAAt(12, 12)
+	if high == clear || low == clear {
+		t.Fatalf("expected both voxels to be seen from above, got %v and %v", high, low)
+	}
+	if low.R >= high.R {
+		t.Errorf("expected the lower voxel to be darker, got %v and %v", low, high)
+	}
+	if c := img.RGBAAt(12, 4); c != clear {
+		t.Error("expected clear color where there are no voxels, got:", c)
+	}
+}
+
+func TestMinimapMessage(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+
+	setup := testSetup()
+	setup.Minimap = true
+	_, ws := dial(server, setup)
+	defer ws.Close()
+
+	var data []byte
+	if err := websocket.Message.Receive(ws, &data); err != nil {
+		panic(err)
+	}
+
+	var msg minimapMessage
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Minimap.Image == "" {
+		t.Fatal("expected minimap message, got:", string(data))
+	}
+
+	const prefix = "data:image/png;base64,"
+	if !strings.HasPrefix(msg.Minimap.Image, prefix) || msg.Minimap.Bounds != [4]float32{0, 0, 1, 1} {
+		t.Fatalf("unexpected minimap: %.40s %v", msg.Minimap.Image, msg.Minimap.Bounds)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(msg.Minimap.Image[len(prefix):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != image.Rect(0, 0, minimapSize, minimapSize) {
+		t.Error("unexpected minimap size:", img.Bounds())
+	}
+}
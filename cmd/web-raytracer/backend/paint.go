@@ -0,0 +1,244 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+const (
+	// maxBrushRadius is the largest brush radius in voxels, it bounds the number
+	// of voxels a paint stroke edits.
+	maxBrushRadius = 8
+
+	// maxJournal is the number of edits of a tree that can be undone.
+	maxJournal = 64
+)
+
+// paintRequest edits the voxels of the tree under a brush. The brush is placed
+// where the ray through Pixel, the normalized position in the view like the
+// cursor, or Ray, an origin and direction in camera coordinates, hits the tree.
+// Mode add sets the voxels within Radius voxels of the one in front of the hit to
+// Color, erase clears the ones within Radius of the hit voxel. Voxels are edited
+// at the depth of the tree. Brushes that miss the tree are ignored.
+type paintRequest struct {
+	Pixel  *[2]float32    `pixel`
+	Ray    *[2][3]float32 `ray`
+	Radius float32        `radius`
+	Color  [3]uint8       `color`
+	Mode   string         `mode`
+}
+
+func (req *paintRequest) validate() error {
+	if req.Mode != "add" && req.Mode != "erase" {
+		return errors.New("unknown paint mode: " + req.Mode)
+	}
+	if !(req.Radius >= 0 && req.Radius <= maxBrushRadius) {
+		return fmt.Errorf("brush radius is outside [0, %d]", maxBrushRadius)
+	}
+
+	switch {
+	case (req.Pixel == nil) == (req.Ray == nil):
+		return errors.New("paint needs either a pixel or a ray")
+	case req.Pixel != nil:
+		for _, v := range req.Pixel {
+			if !(v >= 0 && v <= 1) {
+				return errors.New("paint pixel is outside the view")
+			}
+		}
+	default:
+		var length float64
+		for i, v := range append(req.Ray[0][:], req.Ray[1][:]...) {
+			if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+				return errors.New("paint ray is not finite")
+			}
+			if i >= 3 {
+				length += float64(v) * float64(v)
+			}
+		}
+		if length == 0 {
+			return errors.New("paint ray has no direction")
+		}
+	}
+	return nil
+}
+
+// paintTree edits the voxels under the brush of req in the cached version of tree,
+// see changeTree. Pixels are resolved with the camera and field of view in degrees
+// of the view, which is size pixels.
+func paintTree(tree *treeData, req *paintRequest, camera trace.FreeFlightCamera, fov float32, size image.Point) error {
+	return changeTree(tree, false, func(current *treeData) ([]voxelEdit, error) {
+		rect := image.Rect(0, 0, 1, 1)
+		raytracer := trace.NewRaytracer(trace.Config{
+			FieldOfViewDegrees: fov,
+			TreeScale:          1,
+			Images:             [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		})
+		defer raytracer.Close()
+
+		var origin, dir trace.Vec3
+		if req.Pixel != nil {
+			origin, dir = raytracer.PixelRay(&camera, size, req.Pixel[0]*float32(size.X), req.Pixel[1]*float32(size.Y))
+		} else {
+			origin, dir = req.Ray[0], req.Ray[1]
+		}
+
+		frame, maxDepth := current.frames[0], current.maxDepth
+		hit, ok := raytracer.CastRay(frame, maxDepth, origin, dir, float32(config.ViewDistance))
+		if !ok {
+			return nil, nil
+		}
+
+		// The brush is centered on the voxel in front of the hit face when adding
+		// and on the hit voxel when erasing.
+		voxel := 1 / float32(int(1)<<uint(maxDepth))
+		offset := -voxel / 2
+		if req.Mode == "add" {
+			offset = -offset
+		}
+
+		var center [3]int
+		for axis := range center {
+			center[axis] = int(math.Floor(float64((hit.Position[axis] + hit.Normal[axis]*offset) / voxel)))
+		}
+
+		r := int(req.Radius)
+		var edits []voxelEdit
+		for z := center[2] - r; z <= center[2]+r; z++ {
+			for y := center[1] - r; y <= center[1]+r; y++ {
+				for x := center[0] - r; x <= center[0]+r; x++ {
+					dx, dy, dz := float32(x-center[0]), float32(y-center[1]), float32(z-center[2])
+					if dx*dx+dy*dy+dz*dz > req.Radius*req.Radius {
+						continue
+					}
+
+					pos := [3]float32{(float32(x) + 0.5) * voxel, (float32(y) + 0.5) * voxel, (float32(z) + 0.5) * voxel}
+					if !(pos[0] > 0 && pos[0] < 1 && pos[1] > 0 && pos[1] < 1 && pos[2] > 0 && pos[2] < 1) {
+						continue
+					}
+
+					c, filled := frame.VoxelAt(pos, maxDepth)
+					if req.Mode == "erase" && filled {
+						edits = append(edits, voxelEdit{pos: pos, depth: maxDepth, clear: true})
+					} else if req.Mode == "add" && (!filled || c.R != req.Color[0] || c.G != req.Color[1] || c.B != req.Color[2]) {
+						edits = append(edits, voxelEdit{pos: pos, depth: maxDepth, color: color.RGBA{req.Color[0], req.Color[1], req.Color[2], 255}})
+					}
+				}
+			}
+		}
+		return edits, nil
+	})
+}
+
+// undoTree reverts the last edit or paint stroke of tree.
+func undoTree(tree *treeData) error {
+	return changeTree(tree, true, func(current *treeData) ([]voxelEdit, error) {
+		if len(current.journal) == 0 {
+			return nil, &protocolError{invalidUpdateError, "nothing to undo"}
+		}
+		return current.journal[len(current.journal)-1], nil
+	})
+}
+
+// revertEdit returns the edit that restores the voxel changed by edit in tree.
+// Voxels above the leafs are restored as a single voxel of their color.
+func revertEdit(tree trace.Octree, edit voxelEdit) voxelEdit {
+	revert := voxelEdit{pos: edit.pos, depth: edit.depth, clear: true}
+	if c, ok := tree.VoxelAt(edit.pos, edit.depth); ok {
+		revert.clear, revert.color = false, color.RGBA{c.R, c.G, c.B, 255}
+	}
+	return revert
+}
+
+// appendJournal returns journal with reverts added, the oldest edits are dropped
+// once there are more than maxJournal.
+func appendJournal(journal [][]voxelEdit, reverts []voxelEdit) [][]voxelEdit {
+	if len(journal) >= maxJournal {
+		journal = journal[len(journal)-maxJournal+1:]
+	}
+	return append(journal[:len(journal):len(journal)], reverts)
+}
+
+// autosaveName returns the file edited versions of the tree in file are saved to,
+// tree.oct is saved to tree.autosave.oct.
+func autosaveName(file string) string {
+	ext := filepath.Ext(file)
+	return strings.TrimSuffix(file, ext) + ".autosave" + ext
+}
+
+// saveTree writes the current frame of an edited tree to its autosave file. The
+// file is replaced once it is written, so it is never read half written.
+func saveTree(tree *treeData) error {
+	name := autosaveName(tree.file)
+	fp, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	// Saving compacts a new slice, the frame is not changed.
+	info := tree.infos[0]
+	err = trace.NewMutableTreeWithInfo(tree.frames[0], info).SaveWithOptions(fp, info.Format, trace.SaveOptions{Info: info})
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+		return err
+	}
+	return os.Rename(fp.Name(), name)
+}
+
+// autosaveTrees saves the cached trees that were edited since the last save,
+// checking every interval.
+func autosaveTrees(interval time.Duration) {
+	saved := make(map[string]*treeData)
+	for range time.Tick(interval) {
+		autosave(saved)
+	}
+}
+
+// autosave saves the edited trees of the cache that are not in saved, the trees
+// last saved by file.
+func autosave(saved map[string]*treeData) {
+	trees.Lock()
+	var edited []*treeData
+	for file, tree := range trees.cache {
+		if tree.editor != nil && saved[file] != tree {
+			edited = append(edited, tree)
+		}
+	}
+	trees.Unlock()
+
+	for _, tree := range edited {
+		if err := saveTree(tree); err != nil {
+			serverLog().Errorf("could not save edited tree: %v", err)
+			continue
+		}
+		saved[tree.file] = tree
+		logv(1, "saved edited tree:", autosaveName(tree.file))
+	}
+}
@@ -0,0 +1,119 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"sync"
+)
+
+// tileHeaderSize is the size of the header that starts every tile of a progressive
+// frame. It holds tileMagic, the frame number, the image index and the x, y, width
+// and height of the tile in the image, all little-endian. Tiles arrive in any order
+// and the frame is complete when the end-of-frame marker is received.
+const tileHeaderSize = 20
+
+// progressiveTileSize is the tile size used for progressive frames, every tile is
+// sent as its own message.
+const progressiveTileSize = 64
+
+var tileMagic = []byte("TIL\x00")
+
+// tileStream collects the tiles completed by the raytracer workers so the render
+// loop can send them while the rest of the frame is rendering.
+type tileStream struct {
+	lock  sync.Mutex
+	tiles []image.Rectangle
+	ready chan struct{}
+}
+
+func newTileStream() *tileStream {
+	return &tileStream{ready: make(chan struct{}, 1)}
+}
+
+// done is the OnTileDone callback of the raytracer, it never blocks the worker.
+func (s *tileStream) done(frame int, rect image.Rectangle) {
+	s.lock.Lock()
+	s.tiles = append(s.tiles, rect)
+	s.lock.Unlock()
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the tiles completed since the last call, reusing the memory of buf.
+func (s *tileStream) take(buf []image.Rectangle) []image.Rectangle {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	buf = append(buf[:0], s.tiles...)
+	s.tiles = s.tiles[:0]
+	return buf
+}
+
+// stream calls send for the tiles of the frame as they complete, until wait
+// returns. The error of wait is returned once all tiles are sent, or the first
+// error of send.
+func (s *tileStream) stream(wait func() error, send func(rect image.Rectangle) error) (waitErr, sendErr error) {
+	finished := make(chan error, 1)
+	go func() {
+		finished <- wait()
+	}()
+
+	var tiles []image.Rectangle
+	for done := false; !done; {
+		select {
+		case <-s.ready:
+		case waitErr = <-finished:
+			done = true
+		}
+
+		tiles = s.take(tiles)
+		for _, rect := range tiles {
+			if sendErr != nil {
+				break
+			}
+			sendErr = send(rect)
+		}
+	}
+	return waitErr, sendErr
+}
+
+// appendTile appends a tile message to buf. The pixels of rect are copied row by row
+// from pix, which holds an image of the given stride with bpp bytes per pixel.
+func appendTile(buf []byte, frame, img uint32, rect image.Rectangle, pix []byte, stride, bpp int) []byte {
+	var header [tileHeaderSize]byte
+	copy(header[:], tileMagic)
+
+	binary.LittleEndian.PutUint32(header[4:], frame)
+	binary.LittleEndian.PutUint32(header[8:], img)
+	binary.LittleEndian.PutUint16(header[12:], uint16(rect.Min.X))
+	binary.LittleEndian.PutUint16(header[14:], uint16(rect.Min.Y))
+	binary.LittleEndian.PutUint16(header[16:], uint16(rect.Dx()))
+	binary.LittleEndian.PutUint16(header[18:], uint16(rect.Dy()))
+
+	buf = append(buf, header[:]...)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		offset := y*stride + rect.Min.X*bpp
+		buf = append(buf, pix[offset:offset+rect.Dx()*bpp]...)
+	}
+	return buf
+}
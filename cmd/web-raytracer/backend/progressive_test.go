@@ -0,0 +1,145 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestAppendTile(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i)
+	}
+
+	rect := image.Rect(1, 1, 3, 3)
+	data := appendTile(nil, 7, 1, rect, img.Pix, img.Stride, 4)
+
+	if !bytes.HasPrefix(data, tileMagic) || len(data) != tileHeaderSize+2*2*4 {
+		t.Fatalf("unexpected tile of %d bytes", len(data))
+	}
+
+	if frame, image := binary.LittleEndian.Uint32(data[4:]), binary.LittleEndian.Uint32(data[8:]); frame != 7 || image != 1 {
+		t.Errorf("unexpected frame %d and image %d", frame, image)
+	}
+
+	for i, v := range []uint16{1, 1, 2, 2} {
+		if n := binary.LittleEndian.Uint16(data[12+i*2:]); n != v {
+			t.Errorf("rect field %d is %d, expected %d", i, n, v)
+		}
+	}
+
+	pix := data[tileHeaderSize:]
+	if !bytes.Equal(pix[:8], img.Pix[img.PixOffset(1, 1):img.PixOffset(3, 1)]) || !bytes.Equal(pix[8:], img.Pix[img.PixOffset(1, 2):img.PixOffset(3, 2)]) {
+		t.Error("tile pixels differ from the image")
+	}
+}
+
+// receiveTiles requests a frame and assembles its tiles until the end-of-frame
+// marker. The number of pixels received is returned with the image, pixels sent
+// twice or outside of rect fail the test.
+func receiveTiles(t *testing.T, ws *websocket.Conn, rect image.Rectangle) (*image.RGBA, int) {
+	var update updateMessage
+	update.Camera.Position = [3]float32{0.5, 0.5, 2}
+	if err := websocket.JSON.Send(ws, update); err != nil {
+		panic(err)
+	}
+
+	img := image.NewRGBA(rect)
+	numPixels, imageIndex := 0, -1
+
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.HasPrefix(data, endMagic) {
+			if len(data) != frameHeaderSize {
+				t.Errorf("end-of-frame marker has %d bytes", len(data))
+			}
+			if index := int(binary.LittleEndian.Uint32(data[24:])); index != imageIndex {
+				t.Errorf("end-of-frame marker is for image %d, tiles for %d", index, imageIndex)
+			}
+			return img, numPixels
+		}
+
+		if !bytes.HasPrefix(data, tileMagic) {
+			t.Fatal("expected a tile")
+		}
+
+		imageIndex = int(binary.LittleEndian.Uint32(data[8:]))
+		x, y := int(binary.LittleEndian.Uint16(data[12:])), int(binary.LittleEndian.Uint16(data[14:]))
+		w, h := int(binary.LittleEndian.Uint16(data[16:])), int(binary.LittleEndian.Uint16(data[18:]))
+
+		pix := data[tileHeaderSize:]
+		if len(pix) != w*h*4 {
+			t.Fatalf("tile of %dx%d has %d bytes", w, h, len(pix))
+		}
+
+		tile := image.Rect(x, y, x+w, y+h)
+		if !tile.In(rect) {
+			t.Fatalf("tile %v is outside of the image", tile)
+		}
+		for row := 0; row < h; row++ {
+			for i := img.PixOffset(x, y+row); i < img.PixOffset(x+w, y+row); i += 4 {
+				if img.Pix[i+3] != 0 {
+					t.Fatalf("pixel %d,%d was sent twice", (i-img.PixOffset(0, y+row))/4, y+row)
+				}
+			}
+			copy(img.Pix[img.PixOffset(x, y+row):], pix[row*w*4:(row+1)*w*4])
+		}
+		numPixels += w * h
+	}
+}
+
+func TestProgressiveFrames(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+
+	setup := testSetup()
+	setup.Width, setup.Height = 256, 150
+	setup.ClearColor = [4]byte{10, 20, 30, 255}
+	setup.Progressive = true
+	rect := image.Rect(0, 0, setup.Width/2, setup.Height)
+
+	_, ws := dial(server, setup)
+	defer ws.Close()
+
+	// Both images of the jittered frame are rendered, the view is then cached.
+	for i := 0; i < 2; i++ {
+		img, numPixels := receiveTiles(t, ws, rect)
+
+		if expected := rect.Dx() * rect.Dy(); numPixels != expected {
+			t.Errorf("frame %d: expected %d pixels, got %d", i, expected, numPixels)
+		}
+
+		for y := 0; y < rect.Dy(); y++ {
+			for x := 0; x < rect.Dx(); x++ {
+				if img.RGBAAt(x, y).A != 255 {
+					t.Fatalf("frame %d: pixel %d,%d was not sent", i, x, y)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// maxLODBias is the number of levels of detail dropped at detail zero.
+const maxLODBias = 4
+
+type (
+	// qualityRequest asks for a render quality, in the setup message or in an
+	// update. Fields that are set override the preset.
+	qualityRequest struct {
+		Preset      string `preset`
+		Width       int    `width`
+		Height      int    `height`
+		Samples     int    `samples`
+		Jitter      *bool  `jitter`
+		ColorFormat string `color_format`
+		Raster      bool   `raster`
+	}
+
+	// quality is the render quality of a connection after the request is clamped
+	// to the server limits.
+	quality struct {
+		Width       int    `width`
+		Height      int    `height`
+		Samples     int    `samples`
+		Jitter      bool   `jitter`
+		ColorFormat string `color_format`
+
+		// Raster draws the leafs as cubes instead of tracing rays, for clients
+		// that can not afford raytracing. Samples and jitter are not used.
+		Raster bool `raster`
+	}
+
+	// qualityMessage tells the client the quality it is rendered at. It answers
+	// quality updates and setups that use a preset or were clamped, and is sent
+	// when the quality is lowered or raised to the bandwidth of the client.
+	qualityMessage struct {
+		Quality quality `quality`
+	}
+
+	// detailMessage tells the client the level of detail it is rendered at and
+	// the bias it maps to. It answers detail updates.
+	detailMessage struct {
+		Detail  float32 `detail`
+		LODBias float32 `lod_bias`
+	}
+)
+
+// lodBias maps a detail value in [0, 1], one for full detail, to the levels of
+// detail the raytracers drop.
+func lodBias(detail float32) float32 {
+	return (1 - detail) * maxLODBias
+}
+
+// validDetail reports if detail is a value lodBias accepts.
+func validDetail(detail float32) bool {
+	return detail >= 0 && detail <= 1 && !math.IsNaN(float64(detail))
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// qualityPresets are the named qualities. Jitter is left to the server unless the
+// preset needs it.
+var qualityPresets = map[string]qualityRequest{
+	"low":    {Width: 640, Height: 360, Samples: 1, Jitter: boolPtr(true), ColorFormat: "PALETTED"},
+	"medium": {Width: 1280, Height: 720, Samples: 1, ColorFormat: "RGBA"},
+	"high":   {Width: 1920, Height: 1080, Samples: 4, Jitter: boolPtr(false), ColorFormat: "RGBA"},
+	"raster": {Width: 320, Height: 180, Samples: 1, Jitter: boolPtr(false), ColorFormat: "PALETTED", Raster: true},
+}
+
+// resolve returns the quality of the request, clamped to the server limits. The
+// resolution keeps its aspect ratio when it is scaled down.
+func (req *qualityRequest) resolve() (quality, error) {
+	q := quality{Jitter: config.Jitter}
+
+	if req.Preset != "" {
+		preset, ok := qualityPresets[req.Preset]
+		if !ok {
+			return q, errors.New("unknown quality preset: " + req.Preset)
+		}
+		q.apply(&preset)
+	}
+	q.apply(req)
+
+	if q.Width <= 0 || q.Height <= 0 {
+		return q, errors.New("invalid resolution")
+	}
+	if q.Samples < 0 {
+		return q, errors.New("invalid number of samples")
+	}
+
+	if q.Width > config.MaxWidth {
+		q.Height = q.Height * config.MaxWidth / q.Width
+		q.Width = config.MaxWidth
+	}
+	if q.Height > config.MaxHeight {
+		q.Width = q.Width * config.MaxHeight / q.Height
+		q.Height = config.MaxHeight
+	}
+	if q.Width < 2 || q.Height < 1 {
+		return q, errors.New("invalid resolution")
+	}
+	if q.Samples > config.MaxSamples {
+		q.Samples = config.MaxSamples
+	}
+	return q, nil
+}
+
+func (q *quality) apply(req *qualityRequest) {
+	if req.Width != 0 {
+		q.Width = req.Width
+	}
+	if req.Height != 0 {
+		q.Height = req.Height
+	}
+	if req.Samples != 0 {
+		q.Samples = req.Samples
+	}
+	if req.Jitter != nil {
+		q.Jitter = *req.Jitter
+	}
+	if req.ColorFormat != "" {
+		q.ColorFormat = req.ColorFormat
+	}
+	if req.Raster {
+		q.Raster = true
+	}
+}
+
+func (q *quality) paletted() bool {
+	return q.ColorFormat == "PALETTED"
+}
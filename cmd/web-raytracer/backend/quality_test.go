@@ -0,0 +1,259 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/color"
+	"testing"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+func TestQualityResolve(t *testing.T) {
+	config = defaultConfig()
+	config.MaxWidth, config.MaxHeight, config.MaxSamples = 1280, 720, 2
+
+	tests := []struct {
+		req      qualityRequest
+		expected quality
+	}{
+		{qualityRequest{Width: 640, Height: 480, ColorFormat: "RGBA"}, quality{640, 480, 0, true, "RGBA", false}},
+		{qualityRequest{Preset: "low"}, quality{640, 360, 1, true, "PALETTED", false}},
+		{qualityRequest{Preset: "high"}, quality{1280, 720, 2, false, "RGBA", false}},
+		{qualityRequest{Preset: "high", Width: 800, Height: 600, Jitter: boolPtr(true)}, quality{800, 600, 2, true, "RGBA", false}},
+		{qualityRequest{Width: 2560, Height: 1440, Samples: 8}, quality{1280, 720, 2, true, "", false}},
+		{qualityRequest{Width: 1000, Height: 1000}, quality{720, 720, 0, true, "", false}},
+		{qualityRequest{Preset: "raster"}, quality{320, 180, 1, false, "PALETTED", true}},
+	}
+
+	for _, test := range tests {
+		q, err := test.req.resolve()
+		if err != nil {
+			t.Errorf("%+v: %v", test.req, err)
+		} else if q != test.expected {
+			t.Errorf("%+v: expected %+v, got %+v", test.req, test.expected, q)
+		}
+	}
+
+	for _, req := range []qualityRequest{{Preset: "ultra"}, {Width: 640}, {Width: 640, Height: 480, Samples: -1}, {Width: 1, Height: 1}} {
+		if _, err := req.resolve(); err == nil {
+			t.Errorf("%+v: expected error", req)
+		}
+	}
+}
+
+func TestSetupPreset(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+	config.MaxWidth, config.MaxHeight = 64, 32
+
+	data, ws := dial(server, setupMessage{Preset: "high", FieldOfView: 45})
+	defer ws.Close()
+
+	var info infoMessage
+	if err := json.Unmarshal(data, &info); err != nil || info.NumNodes != 1 {
+		t.Fatal("expected tree info, got:", string(data))
+	}
+
+	var msg qualityMessage
+	if err := websocket.JSON.Receive(ws, &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1920x1080 is scaled to the maximum width, then to the maximum height.
+	expected := quality{56, 32, 4, false, "RGBA", false}
+	if msg.Quality != expected {
+		t.Errorf("expected %+v, got %+v", expected, msg.Quality)
+	}
+
+	if frame := nextMessage(ws); frame != nil {
+		t.Error("expected frame, got:", frame)
+	}
+}
+
+func TestRasterPreset(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+
+	_, ws := dial(server, setupMessage{Preset: "raster", FieldOfView: 45})
+	defer ws.Close()
+
+	var msg qualityMessage
+	if err := websocket.JSON.Receive(ws, &msg); err != nil || !msg.Quality.Raster {
+		t.Fatalf("expected raster quality, got %+v: %v", msg.Quality, err)
+	}
+
+	var update updateMessage
+	update.Camera.Position = [3]float32{0.5, 0.5, 2}
+	if err := websocket.JSON.Send(ws, update); err != nil {
+		panic(err)
+	}
+
+	// Skip the palette, the frame is half width and paletted.
+	var data []byte
+	for !bytes.HasPrefix(data, frameMagic) {
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(data) - frameHeaderSize; n != 320/2*180 {
+		t.Errorf("unexpected frame size: %v", n)
+	}
+}
+
+func TestQualitySwitch(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+	config.MaxWidth, config.MaxHeight = 64, 64
+
+	_, ws := handshake(server, "")
+	defer ws.Close()
+
+	if msg := nextMessage(ws); msg != nil {
+		t.Fatal("expected frame, got:", msg)
+	}
+
+	send := func(req qualityRequest) {
+		var update updateMessage
+		update.Quality = &req
+		if err := websocket.JSON.Send(ws, update); err != nil {
+			panic(err)
+		}
+	}
+
+	// Invalid qualities are reported and the quality is kept.
+	send(qualityRequest{Preset: "ultra"})
+	var errMsg errorMessage
+	if err := websocket.JSON.Receive(ws, &errMsg); err != nil || errMsg.Error != invalidUpdateError {
+		t.Fatalf("expected %s, got %+v", invalidUpdateError, errMsg)
+	}
+
+	send(qualityRequest{Width: 128, Height: 64, Samples: 9})
+	var msg qualityMessage
+	if err := websocket.JSON.Receive(ws, &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := quality{64, 32, 4, true, "", false}
+	if msg.Quality != expected {
+		t.Errorf("expected %+v, got %+v", expected, msg.Quality)
+	}
+
+	var update updateMessage
+	update.Camera.Position = [3]float32{0.5, 0.5, 2}
+	if err := websocket.JSON.Send(ws, update); err != nil {
+		panic(err)
+	}
+
+	var data []byte
+	if err := websocket.Message.Receive(ws, &data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Frames are half width.
+	if size := frameHeaderSize + 32*32*4; len(data) != size {
+		t.Errorf("expected frame of %v bytes, got %v", size, len(data))
+	}
+}
+
+func TestDetailVisits(t *testing.T) {
+	config = defaultConfig()
+	config.ViewDistance = 10
+
+	// A solid tree three levels deep, so there is detail to drop.
+	tree := trace.NewMutableTree(nil, 8)
+	for z := 0; z < 8; z++ {
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				pos := [3]float32{(float32(x) + 0.5) / 8, (float32(y) + 0.5) / 8, (float32(z) + 0.5) / 8}
+				if err := tree.SetVoxel(pos, 3, color.RGBA{255, 255, 255, 255}); err != nil {
+					panic(err)
+				}
+			}
+		}
+	}
+	data := &treeData{maxDepth: 4, frames: []trace.Octree{tree.Octree()}}
+
+	setup := testSetup()
+	q, err := setup.validate()
+	if err != nil {
+		panic(err)
+	}
+	q.Jitter = false
+
+	r, err := newRenderer(&setup, q, data, 0, color.RGBA{}, nil, newTileStream())
+	if err != nil {
+		panic(err)
+	}
+	defer r.close()
+
+	camera := trace.FreeFlightCamera{Pos: trace.Vec3{0.5, 0.5, 2}}
+	visits := func(detail float32) uint64 {
+		if err := r.setLODBias(lodBias(detail)); err != nil {
+			t.Fatal(err)
+		}
+		return r.raytracer.Stats(r.raytracer.Trace(&camera, nil, 0)).NodeVisits
+	}
+
+	full, half, coarse := visits(1), visits(0.5), visits(0)
+	if !(half < full && coarse < half) {
+		t.Errorf("expected fewer node visits at lower detail, got %d, %d and %d", full, half, coarse)
+	}
+
+	// The full detail renders as before.
+	if n := visits(1); n != full {
+		t.Errorf("expected %d node visits at full detail again, got %d", full, n)
+	}
+}
+
+func TestDetailUpdate(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+
+	_, ws := handshake(server, "")
+	defer ws.Close()
+
+	send := func(detail float32) {
+		var update updateMessage
+		update.Detail = &detail
+		if err := websocket.JSON.Send(ws, update); err != nil {
+			panic(err)
+		}
+	}
+
+	send(0.5)
+	var msg detailMessage
+	if err := websocket.JSON.Receive(ws, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Detail != 0.5 || msg.LODBias != maxLODBias/2 {
+		t.Errorf("unexpected reply: %+v", msg)
+	}
+
+	// Values outside of the range close the connection.
+	send(2)
+	var errMsg errorMessage
+	if err := websocket.JSON.Receive(ws, &errMsg); err != nil || errMsg.Error != invalidUpdateError {
+		t.Fatalf("expected %s, got %+v", invalidUpdateError, errMsg)
+	}
+	expectClosed(t, ws)
+}
@@ -0,0 +1,271 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+const (
+	// recordQueueSize is the number of frames waiting to be written before new
+	// frames are dropped, so recording never stalls the render loop.
+	recordQueueSize = 8
+
+	recordQuality  = 90
+	recordManifest = "manifest.json"
+	recordVideo    = "session.avi"
+
+	recordJPEG = "jpg"
+	recordPNG  = "png"
+	recordAVI  = "avi"
+)
+
+type (
+	// recordedFrame is the manifest of a recorded frame. It can be decoded as a
+	// trace.RenderManifest to render the frame again.
+	recordedFrame struct {
+		trace.RenderManifest
+		Timestamp time.Time `json:"timestamp"`
+
+		// File is the image of the frame, relative to the manifest. It is empty
+		// when frames are recorded to a video or only piped to the record
+		// command.
+		File string `json:"file,omitempty"`
+	}
+
+	// recordingManifest is written next to the frames when the session ends.
+	// Dropped is the number of frames that were not recorded because the
+	// queue was full. Video is the video file of the session, if it has one.
+	recordingManifest struct {
+		Dropped uint32          `json:"dropped"`
+		Video   string          `json:"video,omitempty"`
+		Frames  []recordedFrame `json:"frames"`
+	}
+
+	// recordJob holds copies of the two images of a frame, the frame is
+	// reconstructed by the writer.
+	recordJob struct {
+		images [2]*image.RGBA
+		frame  recordedFrame
+	}
+
+	// recording archives the frames of a session as numbered images or a
+	// video in dir and pipes them as raw RGBA to the stdin of a command. Frames
+	// are written by their own goroutine, with their time since start.
+	recording struct {
+		dir     string
+		start   time.Time
+		queue   chan recordJob
+		free    chan [2]*image.RGBA
+		dropped uint32
+
+		// sinks are the archive and the command, sequence is the archive when
+		// frames are recorded as images.
+		sinks    []trace.FrameSink
+		sequence *trace.ImageSequence
+		video    string
+
+		// frame and frames are only used by the writer.
+		frame  *image.RGBA
+		frames []recordedFrame
+		done   chan struct{}
+	}
+)
+
+// recordSessions numbers the recorded sessions, so sessions started in the same
+// second get their own directories.
+var recordSessions uint64
+
+// newRecording starts recording a session, if the server records sessions. Each
+// session is recorded in format to its own directory below dir and runs its own
+// instance of command, in that directory if there is one. Size is the frame size
+// given to the command, frames change size with the quality of the session and
+// are scaled to it. Videos and the command get fps frames per second.
+func newRecording(dir, format, command string, size image.Point, fps float64) (*recording, error) {
+	if dir == "" && command == "" {
+		return nil, nil
+	}
+
+	r := &recording{
+		start: time.Now(),
+		queue: make(chan recordJob, recordQueueSize),
+		free:  make(chan [2]*image.RGBA, recordQueueSize+1),
+		done:  make(chan struct{}),
+	}
+
+	if dir != "" {
+		name := fmt.Sprintf("%s-%d", r.start.Format("20060102-150405"), atomic.AddUint64(&recordSessions, 1))
+		r.dir = filepath.Join(dir, name)
+		if err := os.MkdirAll(r.dir, 0755); err != nil {
+			return nil, err
+		}
+
+		if format == recordAVI {
+			video, err := trace.CreateAVI(filepath.Join(r.dir, recordVideo), fps, recordQuality)
+			if err != nil {
+				return nil, err
+			}
+			r.sinks, r.video = append(r.sinks, video), recordVideo
+		} else {
+			pattern := filepath.Join(strings.Replace(r.dir, "%", "%%", -1), "frame%06d."+format)
+			r.sequence = trace.NewImageSequence(pattern, recordQuality)
+			r.sinks = append(r.sinks, r.sequence)
+		}
+	}
+
+	if args := trace.PipeArgs(command, size, fps); len(args) > 0 {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Dir = r.dir
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		pipe, err := trace.StartPipe(cmd, size, fps)
+		if err != nil {
+			r.closeSinks()
+			return nil, err
+		}
+		r.sinks = append(r.sinks, pipe)
+	}
+
+	go r.writeLoop()
+	return r, nil
+}
+
+// add queues the frame the client reconstructs from a and b. Only the images
+// are copied here. The frame is dropped and counted if the queue is full. Nil
+// recordings are ignored.
+func (r *recording) add(a, b *image.RGBA, frame recordedFrame) {
+	if r == nil {
+		return
+	}
+
+	if len(r.queue) == cap(r.queue) {
+		atomic.AddUint32(&r.dropped, 1)
+		return
+	}
+
+	// Buffers of an earlier quality setting are replaced.
+	var images [2]*image.RGBA
+	select {
+	case images = <-r.free:
+	default:
+	}
+	for i, src := range [2]*image.RGBA{a, b} {
+		if images[i] == nil || images[i].Rect != src.Rect {
+			images[i] = image.NewRGBA(src.Rect)
+		}
+		copy(images[i].Pix, src.Pix)
+	}
+
+	frame.Timestamp = time.Now()
+	select {
+	case r.queue <- recordJob{images, frame}:
+	default:
+		atomic.AddUint32(&r.dropped, 1)
+		r.free <- images
+	}
+}
+
+func (r *recording) writeLoop() {
+	defer close(r.done)
+
+	var failed bool
+	for job := range r.queue {
+		if !failed {
+			if err := r.write(&job); err != nil {
+				serverLog().Errorf("recording failed: %v", err)
+				failed = true
+			}
+		}
+
+		select {
+		case r.free <- job.images:
+		default:
+		}
+	}
+}
+
+func (r *recording) write(job *recordJob) error {
+	a, b := job.images[0], job.images[1]
+	if rect := image.Rect(0, 0, a.Rect.Dx()*2, a.Rect.Dy()); r.frame == nil || r.frame.Rect != rect {
+		r.frame = image.NewRGBA(rect)
+	}
+	if err := trace.Reconstruct(a, b, r.frame); err != nil {
+		return err
+	}
+
+	if r.sequence != nil {
+		job.frame.File = filepath.Base(r.sequence.Name(len(r.frames)))
+	}
+
+	ts := job.frame.Timestamp.Sub(r.start)
+	for _, sink := range r.sinks {
+		if err := sink.WriteFrame(r.frame, ts); err != nil {
+			return err
+		}
+	}
+
+	r.frames = append(r.frames, job.frame)
+	return nil
+}
+
+// close waits for the queued frames, writes the manifest and waits for the
+// record command to exit. Nil recordings are ignored.
+func (r *recording) close() error {
+	if r == nil {
+		return nil
+	}
+
+	close(r.queue)
+	<-r.done
+
+	err := r.closeSinks()
+	if r.dir != "" {
+		manifest := recordingManifest{Dropped: atomic.LoadUint32(&r.dropped), Video: r.video, Frames: r.frames}
+		data, merr := json.MarshalIndent(manifest, "", "\t")
+		if merr == nil {
+			merr = ioutil.WriteFile(filepath.Join(r.dir, recordManifest), data, 0644)
+		}
+		if err == nil {
+			err = merr
+		}
+	}
+	return err
+}
+
+// closeSinks closes the sinks and returns the first error.
+func (r *recording) closeSinks() error {
+	var err error
+	for _, sink := range r.sinks {
+		if cerr := sink.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,160 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+// recordTestSession records a session of three frames to dir in format and
+// returns the directory and manifest of the session.
+func recordTestSession(t *testing.T, dir, format string) (string, *recordingManifest) {
+	server := startTestServer("", 0)
+	config.RecordDir = dir
+	config.RecordFormat = format
+
+	_, ws := handshake(server, "")
+	for numFrames, i := 0, 0; numFrames < 3; i++ {
+		var update updateMessage
+		update.Camera.Position = [3]float32{0.5, 0.5, 2 + float32(i)}
+		if err := websocket.JSON.Send(ws, update); err != nil {
+			t.Fatal(err)
+		}
+
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.HasPrefix(data, frameMagic) {
+			numFrames++
+		}
+	}
+
+	// The recording is finished when the session ends.
+	ws.Close()
+	server.Close()
+
+	sessions, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("expected one session directory, got %v", sessions)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(sessions[0], recordManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var manifest recordingManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifest.Frames)+int(manifest.Dropped) != 3 || len(manifest.Frames) == 0 {
+		t.Fatalf("expected three frames, got %d and %d dropped", len(manifest.Frames), manifest.Dropped)
+	}
+	return sessions[0], &manifest
+}
+
+func TestRecordSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	session, manifest := recordTestSession(t, dir, recordJPEG)
+	if manifest.Video != "" {
+		t.Errorf("unexpected video %s", manifest.Video)
+	}
+
+	for i, frame := range manifest.Frames {
+		if frame.Width != 32 || frame.Height != 16 || frame.Config.TreeScale != 1 {
+			t.Errorf("frame %d: unexpected manifest %+v", i, frame.RenderManifest)
+		}
+		if i > 0 {
+			prev := manifest.Frames[i-1]
+			if frame.Frame <= prev.Frame || frame.Timestamp.Before(prev.Timestamp) || reflect.DeepEqual(frame.Camera, prev.Camera) {
+				t.Errorf("frame %d does not follow frame %d", frame.Frame, prev.Frame)
+			}
+		}
+
+		fp, err := os.Open(filepath.Join(session, frame.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := jpeg.Decode(fp)
+		fp.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds() != image.Rect(0, 0, 32, 16) {
+			t.Errorf("frame %d: unexpected size %v", i, img.Bounds())
+		}
+	}
+}
+
+func TestRecordVideo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	session, manifest := recordTestSession(t, dir, recordAVI)
+	if manifest.Video != recordVideo {
+		t.Fatalf("unexpected video %q", manifest.Video)
+	}
+
+	for i, frame := range manifest.Frames {
+		if frame.File != "" {
+			t.Errorf("frame %d: unexpected file %s", i, frame.File)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(session, recordVideo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "AVI " {
+		t.Error("expected an AVI file")
+	}
+}
+
+func TestRecordCommand(t *testing.T) {
+	args := trace.PipeArgs("ffmpeg -f rawvideo -s {width}x{height} -i - out.mp4", image.Pt(640, 360), 30)
+	if expected := []string{"ffmpeg", "-f", "rawvideo", "-s", "640x360", "-i", "-", "out.mp4"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("unexpected arguments %q", args)
+	}
+
+	// Without a directory or command nothing is recorded.
+	if r, err := newRecording("", recordJPEG, "", image.Pt(640, 360), 30); r != nil || err != nil {
+		t.Error("expected no recording")
+	}
+}
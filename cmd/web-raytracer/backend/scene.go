@@ -0,0 +1,109 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/andreas-jonsson/octatron/trace"
+	"github.com/andreas-jonsson/octatron/trace/scene"
+)
+
+// servedScene is the scene of config.Scene, nil without one, and sceneTree the
+// file of its first tree, the one that is served. Trees are rendered in the unit
+// cube, so the ground plane, fog and cameras of the scene are moved into the
+// space of the tree by setupScene.
+var (
+	servedScene *scene.Scene
+	sceneTree   string
+)
+
+// setupScene reads the scene of cfg and serves its first tree. The other trees
+// are not rendered, a warning names them.
+func setupScene(cfg *serverConfig) error {
+	s, err := scene.Read(cfg.Scene)
+	if err != nil {
+		return err
+	}
+
+	first := s.Instances[0]
+	if unplaced := s.Unplaced(); len(unplaced) > 0 {
+		serverLog().Warnf("only the first tree of %s is served, ignoring %s", cfg.Scene, strings.Join(unplaced, ", "))
+	}
+
+	toTree := func(v float32, axis int) float32 {
+		return (v - first.Position[axis]) / first.Scale
+	}
+
+	ground := &s.Config.GroundPlane
+	ground.Height = toTree(ground.Height, 1)
+
+	fog := &s.Config.Fog
+	fog.Start /= first.Scale
+	fog.End /= first.Scale
+
+	for i := range s.Cameras {
+		pos := &s.Cameras[i].Pos
+		for axis := range pos {
+			pos[axis] = toTree(pos[axis], axis)
+		}
+	}
+
+	cfg.DataDir, cfg.Tree = filepath.Dir(first.File), filepath.Base(first.File)
+	servedScene, sceneTree = s, cfg.treePath()
+	return nil
+}
+
+// applyScene sets the ground plane, fog and lights of the served scene on cfg.
+func applyScene(cfg *trace.Config) {
+	if servedScene == nil {
+		return
+	}
+	cfg.GroundPlane = servedScene.Config.GroundPlane
+	cfg.Fog = servedScene.Config.Fog
+	cfg.SurfaceShader = servedScene.Config.SurfaceShader
+}
+
+// addSceneCameras adds the cameras of the served scene to the bookmarks of its
+// tree, without replacing bookmarks of the same name. They are not written to the
+// bookmark file until another bookmark is saved. The first camera is the start
+// bookmark if there is none.
+func addSceneCameras(file string, store *bookmarkStore) {
+	if servedScene == nil || file != sceneTree {
+		return
+	}
+
+	_, hasStart := store.start()
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for i, c := range servedScene.Cameras {
+		if _, ok := store.bookmarks[c.Name]; ok {
+			continue
+		}
+		store.bookmarks[c.Name] = bookmark{
+			Name:     c.Name,
+			Position: c.Pos,
+			XRot:     c.XRot,
+			YRot:     c.YRot,
+			Start:    i == 0 && !hasStart,
+		}
+	}
+}
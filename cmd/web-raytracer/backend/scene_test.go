@@ -0,0 +1,80 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+func TestScene(t *testing.T) {
+	dir, err := ioutil.TempDir("", "octatron")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestTree(filepath.Join(dir, "tree.oct"))
+	file := filepath.Join(dir, "scene.json")
+	if err := ioutil.WriteFile(file, []byte(`{
+		"trees": [{"file": "tree.oct", "position": [2, 0, 2], "scale": 2}, {"file": "tree.oct"}],
+		"ground": {"height": 1, "color": [50, 50, 50]},
+		"fog": {"start": 2, "end": 4},
+		"lights": [{"direction": [0, -1, 0]}],
+		"cameras": [{"name": "front", "position": [4, 2, 6], "look_at": [4, 2, 0]}]
+	}`), 0644); err != nil {
+		panic(err)
+	}
+
+	config = defaultConfig()
+	config.Scene = file
+	defer func() { servedScene, sceneTree = nil, "" }()
+
+	if err := setupScene(&config); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if config.treePath() != filepath.Join(dir, "tree.oct") {
+		t.Errorf("serving %s", config.treePath())
+	}
+
+	// The scene is moved into the unit cube of the first tree.
+	var cfg trace.Config
+	applyScene(&cfg)
+	if cfg.GroundPlane.Height != 0.5 || cfg.Fog.Start != 1 || cfg.Fog.End != 2 || cfg.SurfaceShader == nil {
+		t.Errorf("unexpected scene settings %+v %+v", cfg.GroundPlane, cfg.Fog)
+	}
+
+	tree, err := loadTree(config.treePath(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, ok := tree.bookmarks.start()
+	if !ok || start.Name != "front" || start.Position != [3]float32{1, 1, 2} {
+		t.Errorf("unexpected start bookmark %+v", start)
+	}
+	if _, err := os.Stat(bookmarkFile(config.treePath())); !os.IsNotExist(err) {
+		t.Error("scene cameras were written to the bookmark file")
+	}
+}
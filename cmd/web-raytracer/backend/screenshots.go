@@ -0,0 +1,141 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+const (
+	// screenshotSamples is the number of samples per axis and pixel.
+	screenshotSamples = 2
+
+	// maxScreenshots is the number of screenshots kept in memory. The oldest one
+	// is dropped when a new one is added.
+	maxScreenshots = 64
+
+	screenshotPath = "/screenshots/"
+)
+
+// screenshotStore keeps encoded screenshots in memory and serves them over http.
+type screenshotStore struct {
+	lock   sync.Mutex
+	images map[string][]byte
+	order  []string
+}
+
+var screenshots = newScreenshotStore()
+
+func newScreenshotStore() *screenshotStore {
+	return &screenshotStore{images: make(map[string][]byte)}
+}
+
+func newScreenshotID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+// add encodes img and returns the URL it is served from.
+func (s *screenshotStore) add(img image.Image) (string, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+
+	id, err := newScreenshotID()
+	if err != nil {
+		return "", err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.order) >= maxScreenshots {
+		delete(s.images, s.order[0])
+		s.order = s.order[1:]
+	}
+
+	s.images[id] = buf.Bytes()
+	s.order = append(s.order, id)
+	return screenshotPath + id + ".png", nil
+}
+
+func (s *screenshotStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, screenshotPath), ".png")
+
+	s.lock.Lock()
+	data, ok := s.images[id]
+	s.lock.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+id+".png\"")
+	w.Write(data)
+}
+
+// renderScreenshot renders tree at full resolution with jitter disabled. Every pixel
+// is the average of screenshotSamples^2 samples. The image is opaque.
+func renderScreenshot(tree trace.Octree, maxDepth int, camera trace.Camera, cfg trace.Config, clear color.RGBA, width, height int) *image.RGBA {
+	rect := image.Rect(0, 0, width*screenshotSamples, height*screenshotSamples)
+
+	cfg.Jitter = false
+	cfg.Packets = false
+	cfg.MultiThreaded = true
+	cfg.Images = [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}
+
+	raytracer := trace.NewRaytracer(cfg)
+	defer raytracer.Close()
+
+	raytracer.SetClearColor(clear)
+	src := raytracer.Image(raytracer.Trace(camera, tree, maxDepth))
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	const numSamples = screenshotSamples * screenshotSamples
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var sum [3]int
+			for sy := 0; sy < screenshotSamples; sy++ {
+				for sx := 0; sx < screenshotSamples; sx++ {
+					c := src.RGBAAt(x*screenshotSamples+sx, y*screenshotSamples+sy)
+					sum[0] += int(c.R)
+					sum[1] += int(c.G)
+					sum[2] += int(c.B)
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(sum[0] / numSamples), uint8(sum[1] / numSamples), uint8(sum[2] / numSamples), 0xFF})
+		}
+	}
+	return dst
+}
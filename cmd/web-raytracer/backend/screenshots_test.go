@@ -0,0 +1,128 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+func TestScreenshotHandler(t *testing.T) {
+	store := newScreenshotStore()
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	img.SetRGBA(1, 1, color.RGBA{255, 0, 0, 255})
+
+	url, err := store.add(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(server.URL + url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" {
+		t.Fatal("unexpected response:", resp.Status, resp.Header.Get("Content-Type"))
+	}
+
+	decoded, err := png.Decode(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r, _, _, _ := decoded.At(1, 1).RGBA(); decoded.Bounds() != img.Bounds() || r != 0xFFFF {
+		t.Error("screenshot differs")
+	}
+
+	resp, err = http.Get(server.URL + screenshotPath + "missing.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error("expected not found, got:", resp.Status)
+	}
+}
+
+func TestScreenshotEviction(t *testing.T) {
+	store := newScreenshotStore()
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+
+	first, err := store.add(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < maxScreenshots; i++ {
+		if _, err := store.add(img); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	store.ServeHTTP(rec, httptest.NewRequest("GET", first, nil))
+
+	if rec.Code != http.StatusNotFound || len(store.images) != maxScreenshots {
+		t.Error("oldest screenshot was not evicted")
+	}
+}
+
+func TestRenderScreenshot(t *testing.T) {
+	tree := trace.NewMutableTree(nil, 1)
+	if err := tree.SetVoxel([3]float32{0.5, 0.5, 0.5}, 0, color.RGBA{255, 255, 255, 255}); err != nil {
+		panic(err)
+	}
+
+	cfg := trace.Config{FieldOfViewDegrees: 45, TreeScale: 1, ViewDist: 10}
+	camera := trace.LookAtCamera{Pos: trace.Vec3{0.5, 0.5, 3}, Look: trace.Vec3{0.5, 0.5, 0.5}}
+	clear := color.RGBA{0, 0, 255, 255}
+
+	img := renderScreenshot(tree.Octree(), 1, &camera, cfg, clear, 16, 8)
+	if img.Bounds() != image.Rect(0, 0, 16, 8) {
+		t.Fatal("unexpected size:", img.Bounds())
+	}
+
+	if c := img.RGBAAt(8, 4); c.R == 0 || c.A != 0xFF {
+		t.Error("expected opaque tree in the center, got:", c)
+	}
+
+	if c := img.RGBAAt(0, 0); c != clear {
+		t.Error("expected clear color in the corner, got:", c)
+	}
+
+	// Close up the tree fills the image, the top row included.
+	camera.Pos[2] = 1.2
+	img = renderScreenshot(tree.Octree(), 1, &camera, cfg, clear, 16, 8)
+	for x := 0; x < 16; x++ {
+		if c := img.RGBAAt(x, 0); c.B != 255 || c.R != 255 {
+			t.Fatalf("expected the tree at %d,0, got: %v", x, c)
+		}
+	}
+}
@@ -0,0 +1,771 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+// errDisconnected ends a session that has already told the client why.
+var errDisconnected = errors.New("client was disconnected")
+
+// session is a client connection set up by renderServer. The reader answers
+// the requests of the client and passes the camera updates to the render loop,
+// which renders and sends the frames.
+type session struct {
+	ws    *websocket.Conn
+	addr  string
+	setup setupMessage
+
+	clearColor   color.RGBA
+	lut          *trace.LUT
+	tiles        *tileStream
+	frameTimeout time.Duration
+	recording    *recording
+
+	// reserved is the memory budget held by the renderer.
+	reserved int64
+
+	// The tree and renderer are swapped by the render loop while they are used
+	// to answer requests, treeLock guards them. The node filter is set by the
+	// render loop and used by screenshots. It is the requested filter, unless
+	// the tree can't support it.
+	treeLock        sync.Mutex
+	tree            *treeData
+	render          *renderer
+	filter          func(attrs trace.NodeAttributes) bool
+	requestedFilter func(attrs trace.NodeAttributes) bool
+
+	// updates are the camera updates of the reader, closed when the client
+	// disconnects. done is closed when the render loop has ended.
+	updates        chan updateMessage
+	done           chan struct{}
+	screenshotSlot chan struct{}
+	loader         *treeLoader
+
+	// bandwidth is measured by the writes of the frames and answered to pings.
+	bandwidth bandwidthEstimator
+	sender    *frameSender
+	viewports []*viewport
+	stats     connStats
+
+	currentFrame int
+	numSent      uint32
+	lastSent     int
+	cache        renderCache
+	tileBuf      []byte
+	walk         walker
+	smoother     cameraSmoother
+	idle         *idleOrbit
+	treeName     string
+
+	// wanted is the quality asked for, throttled clients are rendered at a
+	// lower quality.
+	wanted    quality
+	budget    renderBudget
+	throttled bool
+	lastStart time.Time
+
+	// adapt lowers the quality to the bandwidth with AdaptQuality.
+	adapt qualityController
+
+	// pacer limits the frame rate to MaxFPS, frameRate is its measured rate in
+	// millihertz as counted in the metrics.
+	pacer     *trace.FramePacer
+	frameRate int64
+
+	// detail is the level of detail asked for, see lodBias.
+	detail float32
+}
+
+func (s *session) currentTree() *treeData {
+	s.treeLock.Lock()
+	defer s.treeLock.Unlock()
+	return s.tree
+}
+
+func (s *session) currentRenderer() *renderer {
+	s.treeLock.Lock()
+	defer s.treeLock.Unlock()
+	return s.render
+}
+
+func (s *session) currentFilter() func(attrs trace.NodeAttributes) bool {
+	s.treeLock.Lock()
+	defer s.treeLock.Unlock()
+	return s.filter
+}
+
+// read answers the messages of the client until it disconnects. Camera updates
+// are passed on to the render loop.
+func (s *session) read() {
+	// Closing the channel ends the render loop when the client disconnects.
+	defer close(s.updates)
+
+	for {
+		var update updateMessage
+		if err := messageCodec.Receive(s.ws, &update); err != nil {
+			if isSyntaxError(err) {
+				rejectClient(s.ws, s.setup.BinaryErrors, invalidUpdateError, "malformed update message: "+err.Error())
+			} else {
+				serverLog().Errorf("%s: %v", s.addr, err)
+			}
+			return
+		}
+
+		if err := update.validate(); err != nil {
+			rejectClient(s.ws, s.setup.BinaryErrors, invalidUpdateError, err.Error())
+			return
+		}
+
+		var err error
+		switch {
+		case update.Ping != nil:
+			err = websocket.JSON.Send(s.ws, pongMessage{*update.Ping, s.bandwidth.rate()})
+		case update.Screenshot:
+			s.screenshot(update)
+		case update.Bookmark != nil:
+			err = handleBookmark(s.ws, s.currentTree().bookmarks, update)
+		case update.Measure != nil:
+			err = s.measure(&update)
+		case update.Edit != nil || update.Paint != nil || update.Undo:
+			err = s.edit(&update)
+		case update.Tree != nil:
+			logv(1, s.addr, "requested tree:", *update.Tree)
+			s.loader.load(*update.Tree)
+		default:
+			if !s.queue(update) {
+				return
+			}
+		}
+
+		if err != nil {
+			serverLog().Errorf("%s: %v", s.addr, err)
+			return
+		}
+	}
+}
+
+// queue passes a camera update to the render loop, false if the loop has ended.
+func (s *session) queue(update updateMessage) bool {
+	// The render loop is behind, abort the frame in flight since its camera is
+	// already outdated.
+	if len(s.updates) > 0 {
+		s.currentRenderer().raytracer.Abort()
+	}
+
+	update.received = time.Now()
+	select {
+	case s.updates <- update:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// screenshot renders and sends a screenshot in the background. Only one
+// screenshot is rendered at a time per client, requests are dropped while it is.
+func (s *session) screenshot(update updateMessage) {
+	select {
+	case s.screenshotSlot <- struct{}{}:
+		go func(update updateMessage, tree *treeData, r *renderer, filter func(attrs trace.NodeAttributes) bool) {
+			cfg := r.cfg
+			cfg.NodeFilter = filter
+			sendScreenshot(s.ws, tree, update, cfg, s.clearColor, r.quality.Width, r.quality.Height)
+			<-s.screenshotSlot
+		}(update, s.currentTree(), s.currentRenderer(), s.currentFilter())
+	default:
+		logv(1, "screenshot in progress, request dropped")
+	}
+}
+
+// measure answers a measure request.
+func (s *session) measure(update *updateMessage) error {
+	r := s.currentRenderer()
+	m := measure(s.currentTree(), update.Frame, update.Measure, cameraFromUpdate(update), s.setup.FieldOfView, image.Pt(r.quality.Width, r.quality.Height))
+	return websocket.JSON.Send(s.ws, measureMessage{m})
+}
+
+// edit applies an edit, paint or undo request. Failed edits are reported to the
+// client, only the error of sending the report is returned.
+func (s *session) edit(update *updateMessage) error {
+	var err error
+	switch {
+	case update.Edit != nil:
+		err = editTree(s.currentTree(), update.Edit)
+	case update.Paint != nil:
+		r := s.currentRenderer()
+		err = paintTree(s.currentTree(), update.Paint, cameraFromUpdate(update), s.setup.FieldOfView, image.Pt(r.quality.Width, r.quality.Height))
+	default:
+		err = undoTree(s.currentTree())
+	}
+
+	if err != nil {
+		code, message := internalError, "could not edit tree"
+		if perr, ok := err.(*protocolError); ok {
+			code, message = perr.code, perr.message
+		} else {
+			serverLog().Errorf("%s: %v", s.addr, err)
+		}
+		return sendError(s.ws, s.setup.BinaryErrors, code, message)
+	}
+	return nil
+}
+
+// start sends the client what it needs before the first frame, rendered at
+// quality q.
+func (s *session) start(q quality) error {
+	if err := websocket.JSON.Send(s.ws, s.tree.info()); err != nil {
+		return err
+	}
+
+	// The client is told the quality if it differs from what it asked for.
+	setup := &s.setup
+	if setup.Preset != "" || q.Width != setup.Width || q.Height != setup.Height || (setup.Samples != 0 && q.Samples != setup.Samples) {
+		if err := websocket.JSON.Send(s.ws, qualityMessage{q}); err != nil {
+			return err
+		}
+	}
+
+	// Send palette.
+	if s.render.quality.paletted() {
+		serverLog().Debugf("sending palette")
+		if err := streamCodec.Send(s.ws, s.tree.rawPal); err != nil {
+			return err
+		}
+	}
+
+	if camera, ok := s.tree.startCamera(setup.Camera); ok {
+		if err := websocket.JSON.Send(s.ws, cameraMessage{camera}); err != nil {
+			return err
+		}
+	}
+	return s.sendMinimap()
+}
+
+// sendStream sends frame data, counting the bytes for the connection summary.
+func (s *session) sendStream(buf []byte) error {
+	atomic.AddInt64(&s.stats.bytes, int64(len(buf)))
+	start := time.Now()
+	err := streamCodec.Send(s.ws, buf)
+	s.bandwidth.add(len(buf), time.Since(start))
+	return err
+}
+
+// sendMinimap sends the minimap of the current tree if the client asked for it.
+func (s *session) sendMinimap() error {
+	if !s.setup.Minimap {
+		return nil
+	}
+	msg, err := newMinimapMessage(s.tree, s.currentFrame, s.clearColor)
+	if err != nil {
+		return err
+	}
+	return websocket.JSON.Send(s.ws, msg)
+}
+
+// recordFrame records the last frame sent to the client.
+func (s *session) recordFrame(frame uint32, camera trace.Camera) {
+	if s.recording == nil {
+		return
+	}
+	manifest := trace.NewRenderManifest(&s.render.cfg, camera, image.Pt(s.render.quality.Width, s.render.quality.Height))
+	manifest.Frame = int(frame)
+	manifest.Tree = filepath.Base(s.tree.file)
+	s.recording.add(s.render.raytracer.Image(0), s.render.raytracer.Image(1), recordedFrame{RenderManifest: manifest})
+}
+
+// summary releases the metrics of the session and logs its totals.
+func (s *session) summary() {
+	if s.throttled {
+		metrics.addThrottled(-1)
+	}
+	metrics.addFrameRate(-s.frameRate)
+
+	name := s.treeName
+	if name == "" {
+		name = filepath.Base(s.currentTree().file)
+	}
+	logv(1, fmt.Sprintf("%s summary: tree %s, %d frames, %d ms rendering, %d bytes of frames sent",
+		s.addr, name, s.numSent, s.stats.renderTime/time.Millisecond, atomic.LoadInt64(&s.stats.bytes)))
+}
+
+// run is the render loop. It renders a frame for every camera update of the
+// reader and swaps the tree when it is loaded or replaced, until the client
+// disconnects or the server shuts down.
+func (s *session) run() {
+	for {
+		var (
+			update updateMessage
+			err    error
+		)
+		select {
+		case u, ok := <-s.updates:
+			if !ok {
+				return
+			}
+			update = u
+			err = s.update(&update)
+		case res := <-s.loader.ready:
+			err = s.treeLoaded(res)
+		case <-s.tree.replaced:
+			err = s.treeReplaced()
+		case <-sessions.closing:
+			// The frame in flight is done. Closing the connection ends the
+			// reader, which finishes the request it is answering first, and
+			// a screenshot being rendered is waited for.
+			rejectClient(s.ws, s.setup.BinaryErrors, serverRestartingError, "server is restarting")
+			for range s.updates {
+			}
+			s.screenshotSlot <- struct{}{}
+			return
+		}
+
+		if err != nil {
+			if err != errDisconnected {
+				serverLog().Errorf("%s: %v", s.addr, err)
+			}
+			return
+		}
+	}
+}
+
+// treeLoaded switches to a tree requested by the client, or reports why it
+// could not be loaded.
+func (s *session) treeLoaded(res treeResult) error {
+	if res.err != nil {
+		code, message := internalError, "could not load tree"
+		if perr, ok := res.err.(*protocolError); ok {
+			code, message = perr.code, perr.message
+		} else {
+			serverLog().Errorf("%s: %v", s.addr, res.err)
+		}
+		return sendError(s.ws, s.setup.BinaryErrors, code, message)
+	}
+
+	s.currentFrame = 0
+	s.walk.reset()
+	s.smoother = cameraSmoother{}
+	s.treeName = res.name
+
+	logv(1, s.addr, "switched to tree:", res.name)
+	return s.switchTree(res.tree)
+}
+
+// treeReplaced renders the tree again after it was edited, or its file was
+// changed and loaded again. The camera stays.
+func (s *session) treeReplaced() error {
+	tree := cachedTree(s.tree.file)
+	if tree == nil {
+		return nil
+	}
+
+	// Edited trees only send the patches, the client keeps its state.
+	if patches, ok := tree.patchesSince(s.tree); ok {
+		s.treeLock.Lock()
+		s.tree = tree
+		s.treeLock.Unlock()
+
+		s.render.setTree(s.tree, s.currentFrame)
+		for _, patch := range patches {
+			if err := websocket.JSON.Send(s.ws, patchMessage{patch}); err != nil {
+				return err
+			}
+		}
+		return s.sendMinimap()
+	}
+
+	if s.currentFrame >= len(tree.frames) {
+		s.currentFrame = 0
+	}
+
+	logv(1, s.addr, "reloaded tree:", s.treeName)
+	return s.switchTree(tree)
+}
+
+// switchTree renders tree from now on and sends its info to the client.
+func (s *session) switchTree(tree *treeData) error {
+	memory.view(tree.file)
+	memory.unview(s.tree.file)
+
+	s.treeLock.Lock()
+	s.tree = tree
+	s.treeLock.Unlock()
+
+	s.render.setTree(s.tree, s.currentFrame)
+	s.render.backBuffer = image.NewPaletted(s.render.rect, s.tree.pal)
+
+	if err := websocket.JSON.Send(s.ws, treeReadyMessage{s.treeName, s.tree.info()}); err != nil {
+		return err
+	}
+	if err := s.applyFilter(); err != nil {
+		return err
+	}
+	if err := s.sendMinimap(); err != nil {
+		return err
+	}
+
+	if s.render.quality.paletted() {
+		return streamCodec.Send(s.ws, s.tree.rawPal)
+	}
+	return nil
+}
+
+// applyFilter renders the requested filter from the next frame on, or no filter
+// if the tree has no classification codes. The client is sent a notice of the
+// downgrade.
+func (s *session) applyFilter() error {
+	f, downgrades := classFilter(s.requestedFilter, s.tree)
+	s.treeLock.Lock()
+	s.filter = f
+	s.treeLock.Unlock()
+
+	s.render.setFilter(f)
+	for _, vp := range s.viewports {
+		vp.setFilter(f)
+	}
+	if len(downgrades) > 0 {
+		return websocket.JSON.Send(s.ws, newNoticeMessage(downgrades))
+	}
+	return nil
+}
+
+// changeQuality replaces the renderer between frames, with the quality of a
+// request and the error of resolving it. Invalid qualities are reported to the
+// client and the quality is kept.
+func (s *session) changeQuality(q quality, err error) error {
+	var next *renderer
+	if err == nil {
+		err = s.setup.checkPixels(q)
+	}
+	if err == nil {
+		rendered := q
+		if s.throttled {
+			rendered = q.throttled()
+		}
+		rendered = s.adapt.apply(rendered)
+		if err := memory.resize(&s.reserved, bufferSize(&s.setup, rendered)); err != nil {
+			perr := err.(*protocolError)
+			return sendError(s.ws, s.setup.BinaryErrors, perr.code, perr.message)
+		}
+		next, err = newRenderer(&s.setup, rendered, s.tree, s.currentFrame, s.clearColor, s.lut, s.tiles)
+	}
+	if err != nil {
+		return sendError(s.ws, s.setup.BinaryErrors, invalidUpdateError, err.Error())
+	}
+	next.setFilter(s.filter)
+	if err := next.setLODBias(lodBias(s.detail)); err != nil {
+		next.close()
+		return err
+	}
+	s.wanted = q
+
+	s.treeLock.Lock()
+	prev := s.render
+	s.render = next
+	s.treeLock.Unlock()
+	prev.close()
+
+	// Frames of the old quality can't be sent again or alternated with.
+	s.cache = renderCache{}
+	s.lastSent = -1
+
+	if err := websocket.JSON.Send(s.ws, qualityMessage{next.quality}); err != nil {
+		return err
+	}
+	if next.quality.paletted() && !prev.quality.paletted() {
+		return streamCodec.Send(s.ws, s.tree.rawPal)
+	}
+	return nil
+}
+
+// setDetail changes the level of detail and tells the client the bias it maps to.
+func (s *session) setDetail(detail float32) error {
+	s.detail = detail
+	if err := s.render.setLODBias(lodBias(detail)); err != nil {
+		return err
+	}
+	s.cache = renderCache{}
+	return websocket.JSON.Send(s.ws, detailMessage{detail, lodBias(detail)})
+}
+
+// update handles a camera update of the reader. Quality, detail and filter
+// changes are applied, other updates render a frame.
+func (s *session) update(update *updateMessage) error {
+	switch {
+	case update.Quality != nil:
+		logv(1, s.addr, "changed quality")
+		return s.changeQuality(update.Quality.resolve())
+	case update.Detail != nil:
+		logv(1, s.addr, "changed detail")
+		return s.setDetail(*update.Detail)
+	case update.Filter != nil:
+		logv(1, s.addr, "changed filter")
+		s.requestedFilter = update.Filter.compile()
+		if err := s.applyFilter(); err != nil {
+			return err
+		}
+		s.cache = renderCache{}
+		return nil
+	}
+
+	if err := s.limitQuality(); err != nil {
+		return err
+	}
+
+	camera, err := s.camera(update)
+	if err != nil {
+		return err
+	}
+
+	if update.Frame != s.currentFrame && update.Frame >= 0 && update.Frame < len(s.tree.frames) {
+		s.currentFrame = update.Frame
+		s.render.setTree(s.tree, s.currentFrame)
+	}
+
+	// Throttled clients are limited in frame rate as well.
+	if s.throttled {
+		time.Sleep(throttledFrameTime - time.Since(s.lastStart))
+	}
+
+	s.pacer.Wait()
+	if rate := int64(s.pacer.Rate() * 1000); rate != s.frameRate {
+		metrics.addFrameRate(rate - s.frameRate)
+		s.frameRate = rate
+	}
+
+	return s.renderFrame(update, camera)
+}
+
+// limitQuality throttles clients over the render budget, until they have used
+// less than half of it, and adapts the quality to the bandwidth. Clients are
+// disconnected instead of throttled with budgetDisconnect.
+func (s *session) limitQuality() error {
+	if limit := budgetLimit(); limit > 0 {
+		used := s.budget.used(time.Now())
+		if used > limit && config.BudgetAction == budgetDisconnect {
+			rejectClient(s.ws, s.setup.BinaryErrors, renderBudgetError, "render time budget exceeded")
+			return errDisconnected
+		}
+
+		if (used > limit && !s.throttled) || (used < limit/2 && s.throttled) {
+			s.throttled = !s.throttled
+			if s.throttled {
+				logv(1, s.addr, "is throttled")
+				metrics.addThrottled(1)
+			} else {
+				logv(1, s.addr, "is no longer throttled")
+				metrics.addThrottled(-1)
+			}
+
+			if err := s.changeQuality(s.wanted, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	if config.AdaptQuality {
+		base := s.wanted
+		if s.throttled {
+			base = s.wanted.throttled()
+		}
+
+		if s.adapt.update(time.Now(), base, s.bandwidth.rate()) {
+			logv(1, s.addr, "adapted quality to the bandwidth, level", s.adapt.level)
+			return s.changeQuality(s.wanted, nil)
+		}
+	}
+	return nil
+}
+
+// camera returns the camera to render update with, after walking, smoothing
+// and the idle orbit. The client is told when its camera is moved.
+func (s *session) camera(update *updateMessage) (trace.FreeFlightCamera, error) {
+	if s.setup.Walk {
+		pos := s.walk.move(s.tree.frames[s.currentFrame], update.Camera.Position)
+		if pos != update.Camera.Position {
+			update.Camera.Position = pos
+
+			// The client moves its camera on its own and is told where it
+			// ended up.
+			corrected := bookmark{Position: pos, XRot: update.Camera.XRot, YRot: update.Camera.YRot}
+			if err := websocket.JSON.Send(s.ws, cameraMessage{corrected}); err != nil {
+				return trace.FreeFlightCamera{}, err
+			}
+		}
+	}
+
+	camera := cameraFromUpdate(update)
+	if s.setup.Smooth {
+		s.smoother.add(camera, update.received)
+		camera = s.smoother.camera(time.Now())
+	}
+	if s.idle != nil {
+		var left bool
+		if camera, left = s.idle.update(cameraFromUpdate(update), camera, time.Now()); left {
+			// The client takes over from the pose of the orbit it was shown.
+			pose := bookmark{Position: camera.Pos, XRot: camera.XRot, YRot: camera.YRot}
+			if err := websocket.JSON.Send(s.ws, cameraMessage{pose}); err != nil {
+				return camera, err
+			}
+		}
+	}
+	return camera, nil
+}
+
+// renderFrame renders the viewports and the frame of camera and sends them.
+// Frames that are aborted or can't be alternated with are dropped.
+func (s *session) renderFrame(update *updateMessage, camera trace.FreeFlightCamera) error {
+	render := s.render
+
+	view := newRenderView(camera, update.Cursor, s.tree, s.currentFrame)
+	for _, vp := range s.viewports {
+		spent, err := vp.render(view, s.frameTimeout)
+		if err != nil {
+			return err
+		}
+		s.stats.renderTime += spent
+		s.budget.add(time.Now(), spent)
+	}
+
+	start := time.Now()
+	s.lastStart = start
+
+	// With jitter both images are needed for the full resolution frame,
+	// accumulated frames are refined one sample at a time.
+	needed := 1
+	if render.cfg.Jitter {
+		needed = 2
+	} else if render.accumulate {
+		needed = config.Accumulate
+	}
+
+	idx := s.lastSent
+	if s.cache.hit(&view, needed) {
+		// The view is unchanged since the last frames, so the image is sent
+		// again without rendering.
+		metrics.addCacheHits(1)
+	} else {
+		if render.accumulate && s.cache.frames == 0 {
+			render.raytracer.ResetAccumulation()
+		}
+
+		var traced int
+		raster := render.quality.Raster
+		foveated := update.Cursor != nil && len(render.levels) > 0 && !raster
+		if raster {
+			// Rasterized frames are drawn at once into the first image.
+			render.raytracer.RasterizeCubes(&camera, nil, 0, render.surfaces[0])
+		} else if foveated {
+			traced = traceFoveated(render.raytracer, render.levels, &camera, render.rect, *update.Cursor, s.setup.FoveaRadius)
+		} else {
+			traced = render.raytracer.Trace(&camera, nil, 0)
+		}
+		idx = traced
+		if render.cfg.Jitter {
+			// The previous image is sent while the next one renders.
+			idx = (traced + 1) % 2
+		}
+		metrics.addRendered(1)
+
+		var err error
+		if s.setup.Progressive && !foveated && !raster {
+			// Tiles are sent while they are rendered, so this is the frame just
+			// traced rather than the one before it.
+			idx = traced
+
+			var sendErr error
+			err, sendErr = s.tiles.stream(func() error {
+				return waitFrame(render.raytracer, idx, s.frameTimeout, &camera)
+			}, func(r image.Rectangle) error {
+				pix, stride, bpp := render.surfaces[idx].Pix, render.surfaces[idx].Stride, 4
+				if render.quality.paletted() {
+					draw.Draw(render.backBuffer, r, render.surfaces[idx], r.Min, draw.Src)
+					pix, stride, bpp = render.backBuffer.Pix, render.backBuffer.Stride, 1
+				}
+
+				s.tileBuf = appendTile(s.tileBuf[:0], s.numSent, uint32(idx), r, pix, stride, bpp)
+				return s.sendStream(s.tileBuf)
+			})
+
+			if sendErr != nil {
+				return sendErr
+			}
+		} else if !raster {
+			err = waitFrame(render.raytracer, idx, s.frameTimeout, &camera)
+			if s.setup.Progressive {
+				// Foveated frames are sent whole, their tiles are dropped.
+				s.tiles.take(nil)
+			}
+		}
+
+		// Aborted and dropped frames count against the budget as well.
+		spent := time.Since(start)
+		s.stats.renderTime += spent
+		metrics.addRenderTime(spent)
+		s.budget.add(time.Now(), spent)
+
+		// Frames must alternate for the client to reconstruct the image, so
+		// when an aborted or skipped frame is dropped the following frame is
+		// dropped as well.
+		if err != nil || (render.cfg.Jitter && idx == s.lastSent) {
+			return nil
+		}
+		s.lastSent = idx
+		s.cache.rendered()
+
+		if s.setup.Progressive && !foveated && !raster {
+			header := frameHeader{Frame: s.numSent, RenderTime: time.Since(start), Timestamp: time.Now(), Dropped: s.sender.numDropped(), Image: uint32(idx)}
+			s.numSent++
+
+			if err := s.sendStream(header.appendHeader(nil, endMagic)); err != nil {
+				return err
+			}
+			metrics.addSent(1)
+			s.recordFrame(header.Frame, &camera)
+			return nil
+		}
+	}
+
+	pix := render.raytracer.Image(idx).Pix
+	if render.quality.paletted() {
+		draw.Draw(render.backBuffer, render.rect, render.raytracer.Image(idx), image.ZP, draw.Src)
+		pix = render.backBuffer.Pix
+	}
+
+	header := frameHeader{Frame: s.numSent, RenderTime: time.Since(start), Timestamp: time.Now(), Image: uint32(idx)}
+	s.numSent++
+
+	if err := s.sender.push(&header, pix); err != nil {
+		return err
+	}
+	s.recordFrame(header.Frame, &camera)
+	return nil
+}
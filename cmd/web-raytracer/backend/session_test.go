@@ -0,0 +1,53 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueAfterRenderLoop(t *testing.T) {
+	s := &session{updates: make(chan updateMessage), done: make(chan struct{})}
+
+	queued := make(chan bool, 1)
+	go func() { queued <- s.queue(updateMessage{}) }()
+	select {
+	case u := <-s.updates:
+		if u.received.IsZero() {
+			t.Error("expected the update to be stamped with its arrival")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("update was not queued")
+	}
+	if !<-queued {
+		t.Error("expected the update to be passed to the render loop")
+	}
+
+	// Nothing reads the updates once the render loop has ended.
+	close(s.done)
+	go func() { queued <- s.queue(updateMessage{}) }()
+	select {
+	case ok := <-queued:
+		if ok {
+			t.Error("expected the update to be dropped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader is blocked after the render loop ended")
+	}
+}
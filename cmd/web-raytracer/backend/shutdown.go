@@ -0,0 +1,115 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var errDrainTimeout = errors.New("sessions did not finish before the drain timeout")
+
+// drainer tracks the render sessions so they can be finished before the server
+// exits. closing is closed when the sessions should end.
+type drainer struct {
+	lock     sync.Mutex
+	active   sync.WaitGroup
+	closing  chan struct{}
+	draining bool
+}
+
+var sessions = newDrainer()
+
+func newDrainer() *drainer {
+	return &drainer{closing: make(chan struct{})}
+}
+
+// enter registers a new session. False is returned if the server is draining.
+func (d *drainer) enter() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.draining {
+		return false
+	}
+	d.active.Add(1)
+	return true
+}
+
+func (d *drainer) leave() {
+	d.active.Done()
+}
+
+// drain tells the sessions to end and waits for them to return. False is returned
+// if sessions remain after timeout.
+func (d *drainer) drain(timeout time.Duration) bool {
+	d.lock.Lock()
+	if !d.draining {
+		d.draining = true
+		close(d.closing)
+	}
+	d.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// serve runs listen until it fails or a signal is received. The server then stops
+// accepting connections and the render sessions are drained, both within timeout.
+func serve(server *http.Server, listen func() error, signals <-chan os.Signal, timeout time.Duration) error {
+	failed := make(chan error, 1)
+	go func() {
+		failed <- listen()
+	}()
+
+	select {
+	case err := <-failed:
+		return err
+	case sig := <-signals:
+		serverLog().Infof("%v received, draining sessions", sig)
+	}
+
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	// Websockets are hijacked from the server, so Shutdown only closes the
+	// listener and waits for plain requests. The sessions are drained after.
+	if err := server.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	if !sessions.drain(time.Until(deadline)) {
+		return errDrainTimeout
+	}
+	serverLog().Infof("all sessions finished")
+	return nil
+}
@@ -0,0 +1,142 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	const timeout = 5 * time.Second
+
+	resetServerState("", 0)
+	sessions = newDrainer()
+	defer func() { sessions = newDrainer() }()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/render", websocket.Handler(renderServer))
+	server := &http.Server{Handler: mux}
+
+	signals := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(server, func() error { return server.Serve(ln) }, signals, timeout)
+	}()
+
+	url := "ws://" + ln.Addr().String() + "/render"
+	ws, err := websocket.Dial(url, "", "http://localhost/")
+	if err != nil {
+		panic(err)
+	}
+	defer ws.Close()
+
+	if err := websocket.JSON.Send(ws, testSetup()); err != nil {
+		panic(err)
+	}
+
+	var info infoMessage
+	if err := websocket.JSON.Receive(ws, &info); err != nil || info.NumNodes != 1 {
+		t.Fatal("expected tree info:", info, err)
+	}
+
+	// A frame is in flight when the signal arrives.
+	var update updateMessage
+	update.Camera.Position = [3]float32{0.5, 0.5, 2}
+	if err := websocket.JSON.Send(ws, update); err != nil {
+		panic(err)
+	}
+
+	start := time.Now()
+	signals <- syscall.SIGTERM
+
+	// Frames may still arrive before the notice.
+	var notice errorMessage
+	for notice.Error == "" {
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			t.Fatal("no restart notice:", err)
+		}
+		if !bytes.HasPrefix(data, frameMagic) {
+			if err := json.Unmarshal(data, &notice); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if notice.Error != serverRestartingError {
+		t.Errorf("expected %s, got %s: %s", serverRestartingError, notice.Error, notice.Message)
+	}
+	expectClosed(t, ws)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(timeout):
+		t.Fatal("server did not stop within the drain timeout")
+	}
+
+	if elapsed := time.Since(start); elapsed > timeout {
+		t.Error("shutdown took", elapsed)
+	}
+
+	if _, err := websocket.Dial(url, "", "http://localhost/"); err == nil {
+		t.Error("connection accepted after shutdown")
+	}
+
+	// Sessions are not started while the server drains.
+	if sessions.enter() {
+		t.Error("session entered while draining")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	d := newDrainer()
+	if !d.enter() {
+		t.Fatal("session rejected")
+	}
+
+	if d.drain(10 * time.Millisecond) {
+		t.Error("drained with an active session")
+	}
+
+	select {
+	case <-d.closing:
+	default:
+		t.Error("sessions were not told to end")
+	}
+
+	d.leave()
+	if !d.drain(time.Second) {
+		t.Error("not drained after the session left")
+	}
+}
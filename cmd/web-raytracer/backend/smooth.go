@@ -0,0 +1,80 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+// cameraSmoother interpolates between the last two cameras a client sent. Frames are
+// rendered one update interval behind the client, so a frame rendered between
+// updates gets a pose between the last two cameras instead of the newest one,
+// which looks smooth when frames are rendered slower than the client sends them.
+type cameraSmoother struct {
+	start time.Time
+	keys  []trace.CameraKey
+}
+
+// add adds the camera received at now.
+func (s *cameraSmoother) add(camera trace.FreeFlightCamera, now time.Time) {
+	if len(s.keys) == 0 {
+		s.start = now
+	}
+
+	key := trace.CameraKey{Time: float32(now.Sub(s.start).Seconds()), Camera: &camera}
+	if n := len(s.keys); n > 0 && !(key.Time > s.keys[n-1].Time) {
+		// Cameras received at once replace each other.
+		s.keys[n-1] = key
+		return
+	}
+
+	if len(s.keys) == 2 {
+		s.keys = append(s.keys[:0], s.keys[1])
+	}
+	s.keys = append(s.keys, key)
+}
+
+// camera returns the camera to render at now.
+func (s *cameraSmoother) camera(now time.Time) trace.FreeFlightCamera {
+	last := s.keys[len(s.keys)-1]
+	path, err := trace.NewCatmullRomPath(s.keys)
+	if len(s.keys) < 2 || err != nil {
+		return *last.Camera.(*trace.FreeFlightCamera)
+	}
+
+	interval := last.Time - s.keys[0].Time
+	pose := path.Eval(float32(now.Sub(s.start).Seconds()) - interval)
+	return flightCamera(pose.Pos, pose.Forward())
+}
+
+// flightCamera returns the camera at pos looking along forward. Free flight cameras
+// do not roll, their up direction is always the y axis.
+func flightCamera(pos, forward trace.Vec3) trace.FreeFlightCamera {
+	length := math.Sqrt(float64(forward[0]*forward[0] + forward[1]*forward[1] + forward[2]*forward[2]))
+	if !(length > 0) {
+		return trace.FreeFlightCamera{Pos: pos}
+	}
+
+	return trace.FreeFlightCamera{
+		Pos:  pos,
+		XRot: float32(math.Atan2(float64(-forward[0]), float64(-forward[2]))),
+		YRot: float32(math.Asin(math.Max(-1, math.Min(1, float64(forward[1])/length)))),
+	}
+}
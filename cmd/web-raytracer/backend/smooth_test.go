@@ -0,0 +1,67 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+func TestCameraSmoother(t *testing.T) {
+	var s cameraSmoother
+	start := time.Now()
+
+	first := trace.FreeFlightCamera{Pos: trace.Vec3{0, 0, 0}, XRot: 0, YRot: 0.2}
+	s.add(first, start)
+	if c := s.camera(start); c != first {
+		t.Errorf("expected %+v from a single camera, got %+v", first, c)
+	}
+
+	// The camera is rendered one interval behind the updates.
+	last := trace.FreeFlightCamera{Pos: trace.Vec3{1, 0, 0}, XRot: 1, YRot: 0.2}
+	interval := 100 * time.Millisecond
+	s.add(last, start.Add(interval))
+
+	tests := []struct {
+		at       time.Duration
+		expected trace.FreeFlightCamera
+	}{
+		{interval, first},
+		{interval * 3 / 2, trace.FreeFlightCamera{Pos: trace.Vec3{0.5, 0, 0}, XRot: 0.5, YRot: 0.2}},
+		{interval * 2, last},
+		{interval * 5, last},
+	}
+
+	for _, test := range tests {
+		c := s.camera(start.Add(test.at))
+		for i, v := range []float32{c.Pos[0] - test.expected.Pos[0], c.Pos[1], c.Pos[2], c.XRot - test.expected.XRot, c.YRot - test.expected.YRot} {
+			if math.Abs(float64(v)) > 0.01 {
+				t.Errorf("at %v: component %v of %+v is off from %+v", test.at, i, c, test.expected)
+				break
+			}
+		}
+	}
+
+	// Only the last two cameras are kept.
+	s.add(first, start.Add(2*interval))
+	if len(s.keys) != 2 || s.keys[0].Camera.(*trace.FreeFlightCamera).Pos != last.Pos {
+		t.Errorf("expected the last two cameras, got %v", s.keys)
+	}
+}
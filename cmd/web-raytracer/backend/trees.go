@@ -0,0 +1,393 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andreas-jonsson/octatron/pack"
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+// nodeSize is the size in bytes of a node once loaded by the raytracer.
+const nodeSize = 32
+
+type (
+	// treeLoader loads trees in the background for a connection. Starting a load
+	// cancels the load in progress, only the result of the last load is delivered
+	// on ready.
+	treeLoader struct {
+		lock    sync.Mutex
+		cancel  chan struct{}
+		ready   chan treeResult
+		stopped bool
+	}
+
+	treeResult struct {
+		name string
+		tree *treeData
+		err  error
+	}
+
+	// treeStamp identifies a version of a tree file.
+	treeStamp struct {
+		size    int64
+		modTime time.Time
+	}
+
+	// cancelReader fails all reads once cancel is closed.
+	cancelReader struct {
+		io.ReadSeeker
+		cancel <-chan struct{}
+	}
+)
+
+var errLoadCanceled = errors.New("tree load canceled")
+
+// trees caches the loaded trees by file name.
+var trees = struct {
+	sync.Mutex
+	cache map[string]*treeData
+}{cache: make(map[string]*treeData)}
+
+// loadTreeFile loads trees that are not in the cache.
+var loadTreeFile = loadTree
+
+func newTreeLoader() *treeLoader {
+	return &treeLoader{ready: make(chan treeResult, 1)}
+}
+
+// load starts loading the tree with the given name.
+func (l *treeLoader) load(name string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.stopLocked()
+	if l.stopped {
+		return
+	}
+
+	cancel := make(chan struct{})
+	l.cancel = cancel
+
+	go func() {
+		tree, err := openTreeCancel(name, cancel)
+
+		l.lock.Lock()
+		defer l.lock.Unlock()
+
+		// A newer load was started or the loader was stopped.
+		if l.cancel != cancel {
+			return
+		}
+		l.cancel = nil
+		l.ready <- treeResult{name, tree, err}
+	}()
+}
+
+// stop cancels the load in progress and drops results that are not received yet.
+// Later loads are ignored.
+func (l *treeLoader) stop() {
+	l.lock.Lock()
+	l.stopLocked()
+	l.stopped = true
+	l.lock.Unlock()
+}
+
+func (l *treeLoader) stopLocked() {
+	if l.cancel != nil {
+		close(l.cancel)
+		l.cancel = nil
+	}
+
+	select {
+	case <-l.ready:
+	default:
+	}
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.cancel:
+		return 0, errLoadCanceled
+	default:
+		return r.ReadSeeker.Read(p)
+	}
+}
+
+func (tree *treeData) info() infoMessage {
+	info := tree.infos[0]
+	return infoMessage{info.NumNodes, info.NumLeafs, info.VoxelsPerAxis, len(tree.frames)}
+}
+
+// framingDirection is the view direction of cameras framing a tree.
+var framingDirection = trace.Vec3{0, -0.5, -1}
+
+// framingCamera returns a camera that sees the whole tree, if the tree was built with
+// world bounds. Trees are rendered in the unit cube so bookmarks and walking work
+// the same for all of them, the bounds only decide if the camera is sent.
+func (tree *treeData) framingCamera() (bookmark, bool) {
+	if tree.infos[0].Bounds.Size <= 0 {
+		return bookmark{}, false
+	}
+	camera := trace.FrameTree(&trace.TreeInfo{}, framingDirection)
+	return bookmark{Position: camera.Pos, XRot: camera.XRot, YRot: camera.YRot}, true
+}
+
+// startCamera returns the camera a client starts from, false if it keeps camera.
+// Clients without a camera, or with one that is out of reach of the tree, start from
+// the start bookmark. Without one they get the framing camera, clients without a
+// camera only if the tree has world bounds.
+func (tree *treeData) startCamera(camera *bookmark) (bookmark, bool) {
+	if camera != nil && inReach(camera.Position) {
+		return bookmark{}, false
+	}
+	if start, ok := tree.bookmarks.start(); ok {
+		return start, true
+	}
+	if camera == nil {
+		return tree.framingCamera()
+	}
+
+	framing := trace.FrameTree(&trace.TreeInfo{}, framingDirection)
+	return bookmark{Position: framing.Pos, XRot: framing.XRot, YRot: framing.YRot}, true
+}
+
+// inReach reports if a camera at pos is near enough to see the tree. Positions are
+// in reach if they are no further from the unit cube of the tree than the view
+// distance, or than the framing camera which may be further away.
+func inReach(pos [3]float32) bool {
+	framing := trace.FrameTree(&trace.TreeInfo{}, framingDirection)
+	reach := math.Max(config.ViewDistance, cubeDistance(framing.Pos))
+	return cubeDistance(pos) <= reach
+}
+
+// cubeDistance returns the distance from pos to the unit cube, NaN if pos is not
+// finite.
+func cubeDistance(pos [3]float32) float64 {
+	var sum float64
+	for _, v := range pos {
+		d := math.Max(math.Max(-float64(v), float64(v)-1), 0)
+		if math.IsInf(d, 0) || math.IsNaN(float64(v)) {
+			return math.NaN()
+		}
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
+
+// openTree returns the tree with the given name in the data directory, loading it if
+// needed. The default tree is returned if name is empty.
+func openTree(name string) (*treeData, error) {
+	return openTreeCancel(name, nil)
+}
+
+// openTreeCancel works like openTree but the load is aborted if cancel is closed. The
+// cache is not locked during the load so other connections are not blocked, two
+// connections loading the same tree may both read it.
+func openTreeCancel(name string, cancel <-chan struct{}) (*treeData, error) {
+	file := config.treePath()
+	if name != "" {
+		if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+			return nil, &protocolError{unknownTreeError, "unknown tree: " + name}
+		}
+		file = filepath.Join(config.DataDir, name)
+	}
+
+	trees.Lock()
+	tree, ok := trees.cache[file]
+	trees.Unlock()
+
+	if ok {
+		return tree, nil
+	}
+
+	tree, err := loadTreeFile(file, cancel)
+	if err != nil {
+		return nil, err
+	}
+
+	trees.Lock()
+	defer trees.Unlock()
+
+	if cached, ok := trees.cache[file]; ok {
+		return cached, nil
+	}
+	tree.cacheSnapshots()
+	trees.cache[file] = tree
+	return tree, nil
+}
+
+// checkTreeSize verifies that the trees of file are supported and fit in the memory
+// limit, the node limit and the memory budget of the server.
+// The readers are rewound to the start of the tree.
+func checkTreeSize(file string, readers []io.ReadSeeker) error {
+	var size uint64
+	for _, reader := range readers {
+		var header pack.OctreeHeader
+		if err := pack.DecodeHeader(reader, &header); err != nil {
+			return treeError(err)
+		}
+
+		if header.Compressed() {
+			return &protocolError{unsupportedFormatError, "compressed trees are not supported"}
+		}
+
+		if header.NumNodes > config.MaxNodes {
+			return &protocolError{treeTooLargeError, fmt.Sprintf("tree has %v nodes, the limit is %v", header.NumNodes, config.MaxNodes)}
+		}
+
+		if _, err := reader.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		size += header.NumNodes * nodeSize
+	}
+
+	if config.MaxMemory > 0 && size > uint64(config.MaxMemory) {
+		return &protocolError{treeTooLargeError, fmt.Sprintf("tree needs %v bytes, the limit is %v", size, config.MaxMemory)}
+	}
+	return memory.makeRoom(file, int64(size))
+}
+
+func stampOf(info os.FileInfo) treeStamp {
+	return treeStamp{info.Size(), info.ModTime()}
+}
+
+// watchTrees reloads cached trees whose files have changed, checking every interval.
+func watchTrees(interval time.Duration) {
+	pending := make(map[string]treeStamp)
+	for range time.Tick(interval) {
+		reloadTrees(pending)
+	}
+}
+
+// reloadTrees loads the cached trees whose files have changed and replaces them in
+// the cache. A file must be unchanged since the previous check before it is loaded,
+// so trees that are still being written are left alone. Failed loads keep the cached
+// tree and are tried again by the next check. pending holds the changed files seen
+// by the previous check.
+func reloadTrees(pending map[string]treeStamp) {
+	trees.Lock()
+	cached := make([]*treeData, 0, len(trees.cache))
+	for _, tree := range trees.cache {
+		cached = append(cached, tree)
+	}
+	trees.Unlock()
+
+	for _, tree := range cached {
+		file := tree.file
+		info, err := os.Stat(file)
+		if err != nil || stampOf(info) == tree.stamp {
+			delete(pending, file)
+			continue
+		}
+
+		stamp := stampOf(info)
+		if last, ok := pending[file]; !ok || last != stamp {
+			pending[file] = stamp
+			continue
+		}
+
+		loaded, err := loadTreeFile(file, nil)
+		if err != nil {
+			logv(1, "could not reload tree:", err)
+			continue
+		}
+
+		// The file was written again during the load.
+		if info, err := os.Stat(file); err != nil || stampOf(info) != stamp {
+			continue
+		}
+
+		delete(pending, file)
+		loaded.stamp = stamp
+		replaceTree(tree, loaded)
+	}
+}
+
+// replaceTree replaces old with tree in the cache and tells the connections viewing
+// old about it.
+func replaceTree(old, tree *treeData) {
+	trees.Lock()
+	defer trees.Unlock()
+
+	if trees.cache[old.file] != old {
+		return
+	}
+
+	logv(1, "reloaded tree:", old.file)
+	tree.bookmarks = old.bookmarks
+	if tree.replaced == nil {
+		tree.replaced = make(chan struct{})
+	}
+
+	tree.cacheSnapshots()
+	trees.cache[old.file] = tree
+	if old.replaced != nil {
+		close(old.replaced)
+	}
+
+	// The frames of old are freed once the last renderer is done with them.
+	old.releaseSnapshots()
+}
+
+// newSnapshot returns a snapshot of a frame, counted by the snapshot metric until
+// it is released.
+func newSnapshot(frame trace.Octree, maxDepth int) *trace.TreeSnapshot {
+	metrics.addSnapshots(1)
+	return trace.NewTreeSnapshot(frame, maxDepth, func() { metrics.addSnapshots(-1) })
+}
+
+// cacheSnapshots makes the snapshots held by the cache while tree is cached.
+func (tree *treeData) cacheSnapshots() {
+	tree.snapshots = make([]*trace.TreeSnapshot, len(tree.frames))
+	for i, frame := range tree.frames {
+		tree.snapshots[i] = newSnapshot(frame, tree.maxDepth)
+	}
+}
+
+// releaseSnapshots drops the references of the cache once tree is replaced.
+func (tree *treeData) releaseSnapshots() {
+	for _, s := range tree.snapshots {
+		s.Release()
+	}
+}
+
+// snapshot returns the snapshot of a frame with a reference for the caller. Trees
+// that are no longer cached get a new snapshot of the frame.
+func (tree *treeData) snapshot(frame int) *trace.TreeSnapshot {
+	if frame < len(tree.snapshots) && tree.snapshots[frame].Acquire() {
+		return tree.snapshots[frame]
+	}
+	return newSnapshot(tree.frames[frame], tree.maxDepth)
+}
+
+// cachedTree returns the cached version of the tree loaded from file.
+func cachedTree(file string) *treeData {
+	trees.Lock()
+	defer trees.Unlock()
+	return trees.cache[file]
+}
@@ -0,0 +1,338 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/andreas-jonsson/octatron/pack"
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+// slowLoader replaces loadTreeFile with a loader that blocks until the tree is
+// released or the load is canceled. Canceled loads are reported on canceled.
+func slowLoader() (release func(name string), canceled <-chan string) {
+	releases := make(map[string]chan struct{})
+	cancelChan := make(chan string, 8)
+	for _, name := range []string{"a.oct", "b.oct"} {
+		releases[name] = make(chan struct{})
+	}
+
+	loadTreeFile = func(file string, cancel <-chan struct{}) (*treeData, error) {
+		name := filepath.Base(file)
+		select {
+		case <-releases[name]:
+		case <-cancel:
+			cancelChan <- name
+			return nil, errLoadCanceled
+		}
+
+		return &treeData{
+			file:     file,
+			maxDepth: 1,
+			frames:   []trace.Octree{make(trace.Octree, 1)},
+			infos:    []*trace.TreeInfo{{NumNodes: uint64(len(name)), NumLeafs: 1, VoxelsPerAxis: 1, Depth: 1}},
+		}, nil
+	}
+	return func(name string) { close(releases[name]) }, cancelChan
+}
+
+// nextMessage sends a camera update and returns the next message. Frames are reported
+// with a nil message.
+func nextMessage(ws *websocket.Conn) *treeReadyMessage {
+	var update updateMessage
+	update.Camera.Position = [3]float32{0.5, 0.5, 2}
+	if err := websocket.JSON.Send(ws, update); err != nil {
+		panic(err)
+	}
+
+	var data []byte
+	if err := websocket.Message.Receive(ws, &data); err != nil {
+		panic(err)
+	}
+
+	if bytes.HasPrefix(data, frameMagic) {
+		return nil
+	}
+
+	var msg treeReadyMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		panic(err)
+	}
+	return &msg
+}
+
+func TestTreeHotSwap(t *testing.T) {
+	defer func() { loadTreeFile = loadTree }()
+	server := startTestServer("", 0)
+	defer server.Close()
+
+	release, _ := slowLoader()
+	_, ws := handshake(server, "")
+	defer ws.Close()
+
+	if err := websocket.Message.Send(ws, `{"tree": "a.oct"}`); err != nil {
+		panic(err)
+	}
+
+	// Frames of the old tree keep coming while the tree is loaded.
+	for i := 0; i < 3; i++ {
+		if msg := nextMessage(ws); msg != nil {
+			t.Fatal("expected a frame, got:", msg)
+		}
+	}
+
+	release("a.oct")
+	for i := 0; i < 10; i++ {
+		if msg := nextMessage(ws); msg != nil {
+			if msg.TreeReady != "a.oct" || msg.Info.NumNodes != 5 {
+				t.Error("unexpected tree ready message:", msg)
+			}
+			return
+		}
+	}
+	t.Error("tree was never swapped")
+}
+
+func TestTreeLoadCanceled(t *testing.T) {
+	defer func() { loadTreeFile = loadTree }()
+	server := startTestServer("", 0)
+	defer server.Close()
+
+	release, canceled := slowLoader()
+	_, ws := handshake(server, "")
+	defer ws.Close()
+
+	for _, text := range []string{`{"tree": "a.oct"}`, `{"tree": "b.oct"}`} {
+		if err := websocket.Message.Send(ws, text); err != nil {
+			panic(err)
+		}
+	}
+
+	if name := <-canceled; name != "a.oct" {
+		t.Error("expected the first load to be canceled, got:", name)
+	}
+
+	release("a.oct")
+	release("b.oct")
+
+	for i := 0; i < 10; i++ {
+		if msg := nextMessage(ws); msg != nil {
+			if msg.TreeReady != "b.oct" {
+				t.Error("expected the last requested tree, got:", msg.TreeReady)
+			}
+			return
+		}
+	}
+	t.Error("tree was never swapped")
+}
+
+func TestTreeReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "octatron")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "tree.oct")
+	writeTestTree(file)
+
+	server := startTestServer("", 0)
+	defer server.Close()
+	config.DataDir = dir
+
+	setup := testSetup()
+	setup.Tree = "tree.oct"
+	_, ws := dial(server, setup)
+	defer ws.Close()
+
+	original := cachedTree(file)
+	if original == nil {
+		t.Fatal("tree was not loaded")
+	}
+
+	// The new version has a second voxel.
+	tree := trace.NewMutableTree(nil, 2)
+	for _, pos := range [][3]float32{{0.25, 0.25, 0.25}, {0.75, 0.75, 0.75}} {
+		if err := tree.SetVoxel(pos, 1, color.RGBA{0, 255, 0, 255}); err != nil {
+			panic(err)
+		}
+	}
+
+	var data bytes.Buffer
+	if err := tree.Save(&data, pack.MipR8G8B8A8UnpackUI32); err != nil {
+		panic(err)
+	}
+
+	var header pack.OctreeHeader
+	if err := pack.DecodeHeader(bytes.NewReader(data.Bytes()), &header); err != nil {
+		panic(err)
+	}
+
+	pending := make(map[string]treeStamp)
+	reload := func(content []byte) {
+		if err := ioutil.WriteFile(file, content, 0644); err != nil {
+			panic(err)
+		}
+
+		// The first check waits for the file to settle.
+		reloadTrees(pending)
+		if cachedTree(file) != original {
+			t.Fatal("tree was reloaded while it could still be written")
+		}
+		reloadTrees(pending)
+	}
+
+	// A partly written tree fails to load and the current one is kept.
+	reload(data.Bytes()[:data.Len()/2])
+	if cachedTree(file) != original {
+		t.Fatal("partly written tree replaced the current one")
+	}
+
+	if msg := nextMessage(ws); msg != nil {
+		t.Fatal("expected a frame, got:", msg)
+	}
+
+	reload(data.Bytes())
+	if cachedTree(file) == original {
+		t.Fatal("tree was not reloaded")
+	}
+
+	for i := 0; i < 10; i++ {
+		if msg := nextMessage(ws); msg != nil {
+			if msg.TreeReady != "tree.oct" || msg.Info.NumNodes != header.NumNodes {
+				t.Error("unexpected tree ready message:", msg)
+			}
+			return
+		}
+	}
+	t.Error("reloaded tree was never sent")
+}
+
+func TestFramingCamera(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+
+	trees.cache[config.treePath()].infos[0].Bounds = pack.Box{Pos: pack.Point{X: 10, Y: 0, Z: -5}, Size: 4}
+
+	_, ws := handshake(server, "")
+	var data []byte
+	if err := websocket.Message.Receive(ws, &data); err != nil {
+		panic(err)
+	}
+	ws.Close()
+
+	var msg cameraMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal("expected camera message, got:", string(data))
+	}
+
+	expected, _ := trees.cache[config.treePath()].framingCamera()
+	if msg.Goto != expected {
+		t.Errorf("expected %+v, got %+v", expected, msg.Goto)
+	}
+
+	// The tree is rendered in the unit cube, so the camera looks at its center.
+	camera := trace.FreeFlightCamera{Pos: msg.Goto.Position, XRot: msg.Goto.XRot, YRot: msg.Goto.YRot}
+	look := camera.LookAt()
+	if look[2] >= camera.Pos[2] || camera.Pos[2] < 1 {
+		t.Errorf("expected camera in front of the tree, got %+v", msg.Goto)
+	}
+
+	setup := testSetup()
+	setup.Camera = &bookmark{Position: [3]float32{0.5, 0.5, 2}}
+	_, ws = dial(server, setup)
+	defer ws.Close()
+
+	if msg := nextMessage(ws); msg != nil {
+		t.Error("expected frame when the client has a camera, got:", msg)
+	}
+}
+
+func TestStartCamera(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "octatron")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tree := trees.cache[config.treePath()]
+	if tree.bookmarks, err = openBookmarks(bookmarkFile(filepath.Join(dir, "tree.oct"))); err != nil {
+		t.Fatal(err)
+	}
+
+	framing := trace.FrameTree(&trace.TreeInfo{}, framingDirection)
+	framingBookmark := bookmark{Position: framing.Pos, XRot: framing.XRot, YRot: framing.YRot}
+
+	near := &bookmark{Position: [3]float32{0.5, 0.5, 2}}
+	far := &bookmark{Position: [3]float32{0.5, 0.5, 50}}
+	broken := &bookmark{Position: [3]float32{float32(math.NaN()), 0, 0}}
+
+	// Without world bounds clients without a camera keep the default camera.
+	for _, camera := range []*bookmark{nil, near, {Position: framing.Pos}} {
+		if b, ok := tree.startCamera(camera); ok {
+			t.Errorf("expected %+v to be kept, got %+v", camera, b)
+		}
+	}
+	for _, camera := range []*bookmark{far, broken} {
+		if b, ok := tree.startCamera(camera); !ok || b != framingBookmark {
+			t.Errorf("expected the framing camera for %+v, got %+v", camera, b)
+		}
+	}
+
+	home := bookmark{"home", [3]float32{0.5, 2, 0.5}, 0, -1.5, true}
+	if err := tree.bookmarks.saveStart(home); err != nil {
+		t.Fatal(err)
+	}
+	for _, camera := range []*bookmark{nil, far, broken} {
+		if b, ok := tree.startCamera(camera); !ok || b != home {
+			t.Errorf("expected the start bookmark for %+v, got %+v", camera, b)
+		}
+	}
+	if b, ok := tree.startCamera(near); ok {
+		t.Error("expected a camera in reach to be kept, got", b)
+	}
+
+	// The start camera follows the info message.
+	setup := testSetup()
+	setup.Camera = far
+	_, ws := dial(server, setup)
+	defer ws.Close()
+
+	var data []byte
+	if err := websocket.Message.Receive(ws, &data); err != nil {
+		t.Fatal(err)
+	}
+
+	var msg cameraMessage
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Goto != home {
+		t.Errorf("expected the start bookmark, got: %s", data)
+	}
+}
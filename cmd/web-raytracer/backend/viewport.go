@@ -0,0 +1,187 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"time"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+const (
+	// clientCamera makes a viewport follow the camera of the client updates.
+	clientCamera = "client"
+
+	// fixedCamera locks a viewport to its pose, or a view of the whole tree if
+	// the pose is not given.
+	fixedCamera = "fixed"
+
+	// maxViewports is the number of viewports a connection may render, the main
+	// view included.
+	maxViewports = 2
+)
+
+type (
+	// viewportSetup declares a view rendered next to the main view of a connection,
+	// such as a locked overview in a corner of the client. Field of view zero uses
+	// the field of view of the main view.
+	viewportSetup struct {
+		Width       int       `width`
+		Height      int       `height`
+		FieldOfView float32   `field_of_view`
+		Camera      string    `camera`
+		Pose        *bookmark `pose`
+	}
+
+	// viewport renders a viewportSetup. Frames are rendered at full resolution
+	// without jitter after every update of the main view, unless the view is
+	// unchanged, and sent as RGBA by a frame sender of their own so they never
+	// replace a frame of the main view.
+	viewport struct {
+		id        uint32
+		fixed     bool
+		pose      trace.FreeFlightCamera
+		raytracer *trace.Raytracer
+		sender    *frameSender
+		cache     renderCache
+		numSent   uint32
+	}
+)
+
+// validate checks a viewport setup. Errors are protocol errors.
+func (vp *viewportSetup) validate() error {
+	if vp.Width <= 0 || vp.Height <= 0 || vp.Width > config.MaxWidth || vp.Height > config.MaxHeight {
+		return &protocolError{resolutionError, fmt.Sprintf("viewport resolution %vx%v is not within %vx%v", vp.Width, vp.Height, config.MaxWidth, config.MaxHeight)}
+	}
+
+	if vp.FieldOfView != 0 && !(vp.FieldOfView >= 45) {
+		return &protocolError{invalidSetupError, fmt.Sprint("invalid viewport field of view: ", vp.FieldOfView)}
+	}
+
+	switch vp.Camera {
+	case clientCamera:
+		if vp.Pose != nil {
+			return &protocolError{invalidSetupError, "viewports following the client camera have no pose"}
+		}
+	case fixedCamera:
+		if p := vp.Pose; p != nil {
+			for _, v := range []float32{p.Position[0], p.Position[1], p.Position[2], p.XRot, p.YRot} {
+				if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+					return &protocolError{invalidSetupError, "viewport pose is not finite"}
+				}
+			}
+		}
+	default:
+		return &protocolError{invalidSetupError, "unknown viewport camera: " + vp.Camera}
+	}
+	return nil
+}
+
+// viewportPixels returns the number of pixels of the main view and the viewports
+// together, all rendered for every frame. It is limited to the pixels of the
+// largest resolution a single view may have.
+func viewportPixels(q quality, viewports []viewportSetup) int {
+	pixels := q.Width * q.Height
+	for _, vp := range viewports {
+		pixels += vp.Width * vp.Height
+	}
+	return pixels
+}
+
+func newViewport(id uint32, vp *viewportSetup, fieldOfView float32, clear color.RGBA, lut *trace.LUT, send func([]byte) error) (*viewport, error) {
+	if vp.FieldOfView != 0 {
+		fieldOfView = vp.FieldOfView
+	}
+
+	rect := image.Rect(0, 0, vp.Width, vp.Height)
+	cfg := trace.Config{
+		FieldOfViewDegrees: fieldOfView,
+		TreeScale:          1,
+		ViewDist:           float32(config.ViewDistance),
+		Images:             [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		MultiThreaded:      true,
+		LUT:                lut,
+	}
+	applyScene(&cfg)
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	v := &viewport{id: id, fixed: vp.Camera == fixedCamera, raytracer: trace.NewRaytracer(cfg)}
+	v.raytracer.SetClearColor(clear)
+
+	if pose := vp.Pose; pose != nil {
+		v.pose = trace.FreeFlightCamera{Pos: pose.Position, XRot: pose.XRot, YRot: pose.YRot}
+	} else {
+		// Trees are rendered in the unit cube, so the same camera frames all
+		// of them.
+		v.pose = trace.FrameTree(&trace.TreeInfo{}, framingDirection)
+	}
+
+	v.sender = newFrameSender(send)
+	return v, nil
+}
+
+// setFilter hides the leafs rejected by filter from the next frame on.
+func (v *viewport) setFilter(filter func(attrs trace.NodeAttributes) bool) {
+	v.raytracer.SetNodeFilter(filter)
+	v.cache = renderCache{}
+}
+
+// render renders the viewport for the view of the main view and queues the frame.
+// The time spent rendering is returned, zero if the view of the viewport did not
+// change and nothing was rendered.
+func (v *viewport) render(view renderView, timeout time.Duration) (time.Duration, error) {
+	if v.fixed {
+		view.camera = v.pose
+	}
+	view.cursor, view.hasCursor = [2]float32{}, false
+
+	if v.cache.hit(&view, 1) {
+		return 0, nil
+	}
+
+	start := time.Now()
+	camera := view.camera
+	idx := v.raytracer.Trace(&camera, view.tree.frames[view.frame], view.tree.maxDepth)
+
+	// Aborted frames are rendered again with the next update.
+	err := waitFrame(v.raytracer, idx, timeout, &camera)
+	spent := time.Since(start)
+	metrics.addRendered(1)
+	metrics.addRenderTime(spent)
+	if err != nil {
+		v.cache = renderCache{}
+		return spent, nil
+	}
+	v.cache.rendered()
+
+	header := frameHeader{Frame: v.numSent, RenderTime: spent, Timestamp: time.Now(), Viewport: v.id}
+	v.numSent++
+	return spent, v.sender.push(&header, v.raytracer.Image(idx).Pix)
+}
+
+// close stops the sender and releases the raytracer.
+func (v *viewport) close() {
+	v.sender.close()
+	v.raytracer.Close()
+}
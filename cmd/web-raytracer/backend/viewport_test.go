@@ -0,0 +1,111 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestViewportFrames(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+
+	setup := testSetup()
+	setup.Viewports = []viewportSetup{{Width: 12, Height: 8, Camera: fixedCamera}}
+	_, ws := dial(server, setup)
+	defer ws.Close()
+
+	var update updateMessage
+	update.Camera.Position = [3]float32{0.5, 0.5, 2}
+	if err := websocket.JSON.Send(ws, update); err != nil {
+		panic(err)
+	}
+
+	// The frames of the two views are sent by separate senders, in any order.
+	var main, overview []byte
+	for main == nil || overview == nil {
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			t.Fatal(err)
+		}
+
+		switch {
+		case bytes.HasPrefix(data, frameMagic):
+			main = data
+		case bytes.HasPrefix(data, viewportMagic):
+			overview = data
+		}
+	}
+
+	// The main view is half width since the jitter provides the other half.
+	if n := len(main) - frameHeaderSize; n != setup.Width/2*setup.Height*4 {
+		t.Errorf("main view has %d bytes of pixels", n)
+	}
+
+	if id := binary.LittleEndian.Uint32(overview[frameHeaderSize:]); id != 1 {
+		t.Errorf("expected viewport 1, got %d", id)
+	}
+	if n := len(overview) - frameHeaderSize - 4; n != 12*8*4 {
+		t.Errorf("viewport has %d bytes of pixels", n)
+	}
+}
+
+func TestViewportLimits(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+	config.MaxWidth, config.MaxHeight = 64, 32
+
+	tests := []struct {
+		viewports []viewportSetup
+		code      string
+	}{
+		{[]viewportSetup{{Width: 64, Height: 32, Camera: clientCamera}}, resolutionError},
+		{[]viewportSetup{{Width: 0, Height: 8, Camera: clientCamera}}, resolutionError},
+		{[]viewportSetup{{Width: 8, Height: 8, Camera: "orbit"}}, invalidSetupError},
+		{[]viewportSetup{{Width: 8, Height: 8, Camera: clientCamera, Pose: &bookmark{}}}, invalidSetupError},
+		{[]viewportSetup{{Width: 8, Height: 8, Camera: fixedCamera}, {Width: 8, Height: 8, Camera: fixedCamera}}, invalidSetupError},
+	}
+
+	for i, test := range tests {
+		setup := testSetup()
+		setup.Viewports = test.viewports
+		data, ws := dial(server, setup)
+		ws.Close()
+
+		var msg errorMessage
+		if err := json.Unmarshal(data, &msg); err != nil || msg.Error != test.code {
+			t.Errorf("test %d: expected %s, got %s", i, test.code, data)
+		}
+	}
+
+	// The main view and the viewport together are within the limit.
+	setup := testSetup()
+	setup.Viewports = []viewportSetup{{Width: 32, Height: 32, Camera: clientCamera}}
+	data, ws := dial(server, setup)
+	ws.Close()
+
+	var msg errorMessage
+	if err := json.Unmarshal(data, &msg); err == nil && msg.Error != "" {
+		t.Error("expected the setup to be accepted, got:", string(data))
+	}
+}
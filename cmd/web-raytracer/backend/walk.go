@@ -0,0 +1,58 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import "github.com/andreas-jonsson/octatron/trace"
+
+const (
+	// walkRadius is the radius of the camera in walk mode, in tree units.
+	walkRadius = 0.005
+
+	// walkFall is how far the camera falls per update when there is no ground
+	// below it.
+	walkFall = 0.01
+)
+
+// walker keeps the camera of a client in walk mode from moving through leafs and
+// lets it fall until it stands on the ground. The tree is rendered at the origin
+// with scale one.
+type walker struct {
+	pos   trace.Vec3
+	valid bool
+}
+
+// move returns the position the camera ends up at when moving to pos.
+func (w *walker) move(tree trace.Octree, pos trace.Vec3) trace.Vec3 {
+	if w.valid {
+		pos = trace.ClampMovement(tree, trace.Vec3{}, 1, w.pos, pos, walkRadius)
+	}
+
+	if height, ok := trace.GroundHeight(tree, trace.Vec3{}, 1, pos, walkRadius, walkFall); ok {
+		pos[1] = height
+	} else {
+		pos[1] -= walkFall
+	}
+
+	w.pos, w.valid = pos, true
+	return pos
+}
+
+// reset forgets the last position, the next move is not clamped.
+func (w *walker) reset() {
+	w.valid = false
+}
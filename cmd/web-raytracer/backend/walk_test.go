@@ -0,0 +1,82 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+// walkTo sends a camera update and returns the corrected position, or nil if the
+// position was not changed.
+func walkTo(t *testing.T, ws *websocket.Conn, pos [3]float32) *[3]float32 {
+	var update updateMessage
+	update.Camera.Position = pos
+	if err := websocket.JSON.Send(ws, update); err != nil {
+		panic(err)
+	}
+
+	var corrected *[3]float32
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.HasPrefix(data, frameMagic) {
+			return corrected
+		}
+
+		var msg cameraMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		corrected = &msg.Goto.Position
+	}
+}
+
+func TestWalk(t *testing.T) {
+	server := startTestServer("", 0)
+	defer server.Close()
+
+	setup := testSetup()
+	setup.Walk = true
+	_, ws := dial(server, setup)
+	defer ws.Close()
+
+	// The test tree is a single leaf filling the unit cube. There is no ground
+	// in front of it so the camera falls.
+	pos := walkTo(t, ws, [3]float32{0.5, 0.5, 2})
+	if pos == nil || *pos != [3]float32{0.5, 0.5 - walkFall, 2} {
+		t.Fatalf("expected the camera to fall, got %v", pos)
+	}
+
+	pos = walkTo(t, ws, [3]float32{0.5, 0.49, 0.5})
+	if pos == nil || math.Abs(float64(pos[2]-(1+walkRadius))) > 0.0001 {
+		t.Fatalf("expected the camera to stop in front of the tree, got %v", pos)
+	}
+
+	walk := walker{}
+	if p := walk.move(nil, [3]float32{0, 1, 0}); p[1] != 1-walkFall {
+		t.Errorf("expected the camera to fall in an empty tree, got %v", p)
+	}
+}
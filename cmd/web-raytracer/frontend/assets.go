@@ -0,0 +1,36 @@
+//go:build !js
+// +build !js
+
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package frontend embeds the built web frontend, so servers can serve it from
+// their binary. The frontend itself is the js build of this directory, go
+// generate rebuilds frontend.js with GopherJS and records the sources it was
+// built from. The tests fail while the recorded sources differ from these.
+package frontend
+
+//go:generate gopherjs build -m -o frontend.js
+//go:generate rm -f frontend.js.map
+//go:generate go test -run TestBundle -update
+
+import "embed"
+
+// Assets holds index.html and the built frontend.js.
+//
+//go:embed index.html frontend.js
+var Assets embed.FS
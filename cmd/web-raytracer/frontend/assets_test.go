@@ -0,0 +1,91 @@
+//go:build !js
+// +build !js
+
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package frontend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var updateSum = flag.Bool("update", false, "record the sources of frontend.js in frontend.sum")
+
+const sumFile = "frontend.sum"
+
+// bundleSum lists the sha256 of frontend.js and of the sources it is built
+// from, one file per line.
+func bundleSum() ([]byte, error) {
+	sources, err := filepath.Glob("*.go")
+	if err != nil {
+		return nil, err
+	}
+	files := []string{"frontend.js"}
+	for _, name := range sources {
+		if !strings.HasPrefix(name, "assets") {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files[1:])
+
+	var sum bytes.Buffer
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&sum, "%x  %s\n", sha256.Sum256(data), name)
+	}
+	return sum.Bytes(), nil
+}
+
+func TestBundle(t *testing.T) {
+	sum, err := bundleSum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *updateSum {
+		if err := os.WriteFile(sumFile, sum, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recorded, err := os.ReadFile(sumFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sum, recorded) {
+		t.Fatalf("frontend.js is stale, run go generate in this directory:\n%s", sum)
+	}
+
+	js, err := Assets.ReadFile("frontend.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(js, []byte(`"FRM\x00"`)) {
+		t.Error("expected the embedded frontend.js to parse frame headers")
+	}
+}
@@ -20,26 +20,42 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"image/color/palette"
+	"math"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/andreas-jonsson/octatron/trace"
 	"github.com/gopherjs/gopherjs/js"
-	"github.com/gopherjs/websocket"
+	websocket "github.com/gopherjs/websocket/websocketjs"
 )
 
 const (
-	imgWidth      = 320
-	imgHeight     = 180
-	imgScale      = 2
+	maxWidth      = 1280
+	maxHeight     = 720
+	renderScale   = 2
+	foveaRadius   = 48
+	fieldOfView   = 45
 	cameraSpeed   = 0.1
 	frameStacking = 2
+
+	touchRotateSpeed = 0.005
+	touchMoveSpeed   = 0.002
+	doubleTapTime    = 300
+
+	// minimapDisplaySize is the width and height of the minimap on screen.
+	minimapDisplaySize = 128
+
+	// overviewWidth and overviewHeight are the size of the locked overview
+	// rendered by the server in overview mode.
+	overviewWidth, overviewHeight = 160, 120
 )
 
 type (
@@ -49,6 +65,124 @@ type (
 		FieldOfView float32 `field_of_view`
 		ColorFormat string  `color_format`
 		ClearColor  [4]byte `clear_color`
+		FoveaRadius int     `fovea_radius`
+		Token       string  `token`
+
+		Tree         string `tree`
+		BinaryErrors bool   `binary_errors`
+		Stereo       bool   `stereo`
+		Progressive  bool   `progressive`
+		Walk         bool   `walk`
+		Minimap      bool   `minimap`
+
+		// Camera is kept by the server if it is in reach of the tree.
+		Camera *bookmark `camera`
+
+		Viewports []viewportSetup `viewports`
+	}
+
+	// viewportSetup asks the server for a view rendered next to the main view.
+	viewportSetup struct {
+		Width  int    `width`
+		Height int    `height`
+		Camera string `camera`
+	}
+
+	pingMessage struct {
+		Ping float64 `ping`
+	}
+
+	pongMessage struct {
+		Pong      *float64 `pong`
+		Bandwidth float64  `bandwidth`
+	}
+
+	bookmark struct {
+		Name     string     `json:"name"`
+		Position [3]float32 `json:"position"`
+		XRot     float32    `json:"x_rot"`
+		YRot     float32    `json:"y_rot"`
+		Start    bool       `json:"start,omitempty"`
+	}
+
+	bookmarkRequest struct {
+		Action string `action`
+		Name   string `name`
+	}
+
+	// paintRequest edits the voxels under the brush at the normalized pixel,
+	// mode is add or erase.
+	paintRequest struct {
+		Pixel  *[2]float32 `pixel`
+		Radius float32     `radius`
+		Color  [3]uint8    `color`
+		Mode   string      `mode`
+	}
+
+	// minimap is a top-down view of the tree covering Bounds of the XZ plane, as
+	// min x, min z, max x, max z.
+	minimap struct {
+		Image  string     `image`
+		Bounds [4]float32 `bounds`
+	}
+
+	// replyMessage holds the replies to screenshot, bookmark and tree requests,
+	// the minimap and notices. Only the fields of the reply are set.
+	replyMessage struct {
+		Screenshot *string      `screenshot`
+		Bookmarks  *[]bookmark  `bookmarks`
+		Goto       *bookmark    `goto`
+		TreeReady  *string      `tree_ready`
+		Info       *infoMessage `info`
+		Minimap    *minimap     `minimap`
+		Detail     *float32     `detail`
+		LODBias    *float32     `lod_bias`
+		Quality    *quality     `quality`
+		Notices    *[]notice    `notices`
+		Measure    *measurement `measure`
+	}
+
+	// notice tells that a feature was turned off because the tree can not
+	// support it.
+	notice struct {
+		Feature  string `feature`
+		Reason   string `reason`
+		Fallback string `fallback`
+	}
+
+	// quality is the render quality the server chose, which can be lower than
+	// asked for when the bandwidth is too low.
+	quality struct {
+		Width       int    `width`
+		Height      int    `height`
+		ColorFormat string `color_format`
+	}
+
+	errorMessage struct {
+		Error   string `error`
+		Message string `message`
+	}
+
+	infoMessage struct {
+		NumNodes      uint64 `num_nodes`
+		NumLeafs      uint64 `num_leafs`
+		VoxelsPerAxis int    `voxels_per_axis`
+		NumFrames     int    `num_frames`
+	}
+
+	touchPoint struct {
+		x, y float64
+	}
+
+	frameInfo struct {
+		renderTime     float64
+		dropped, image int
+	}
+
+	// tileInfo is a part of a progressive frame.
+	tileInfo struct {
+		image int
+		rect  image.Rectangle
 	}
 
 	updateMessage struct {
@@ -57,20 +191,76 @@ type (
 			XRot     float32    `x_rot`
 			YRot     float32    `y_rot`
 		} "camera"
+		Frame  int         `frame`
+		Cursor *[2]float32 `cursor`
+
+		Screenshot bool             `screenshot`
+		Bookmark   *bookmarkRequest `bookmark`
+		Tree       *string          `tree`
+		Detail     *float32         `detail`
+		Paint      *paintRequest    `paint`
+		Undo       bool             `undo`
+		Measure    *measureRequest  `measure`
 	}
 )
 
 var (
 	keys        = make(map[int]bool)
 	colorFormat = "PALETTED"
-	imgRect     = image.Rect(0, 0, imgWidth/2, imgHeight)
-	palImages   = [2]*image.Paletted{image.NewPaletted(imgRect, palette.Plan9), image.NewPaletted(imgRect, palette.Plan9)}
-	rgbaImages  = [2]*image.RGBA{image.NewRGBA(imgRect), image.NewRGBA(imgRect)}
-	finalImage  = image.NewRGBA(image.Rect(0, 0, imgWidth, imgHeight))
+
+	// The render size is derived from the canvas size when connecting.
+	imgWidth, imgHeight         int
+	displayWidth, displayHeight float64
+	imgRect                     image.Rectangle
+	palImages                   [2]*image.Paletted
+	rgbaImages                  [2]*image.RGBA
+	finalImage                  *image.RGBA
+	resized                     bool
 
 	frameId, numFrames int
-	canvas             *js.Object
+	canvas, status     *js.Object
 	camera             trace.FreeFlightCamera
+	cursor             *[2]float32
+	treeInfo           infoMessage
+
+	// Touch state, double-tap toggles autoForward.
+	lastTouches []touchPoint
+	touchMoved  bool
+	lastTap     float64
+	autoForward bool
+
+	// Bookmarks of the tree, updated by the server.
+	bookmarks []bookmark
+
+	// The minimap is drawn on its own canvas once the server sent it.
+	minimapCanvas, minimapImage *js.Object
+	minimapBounds               [4]float32
+
+	// overviewCanvas shows the overview viewport in overview mode.
+	overviewCanvas *js.Object
+
+	// detailSlider trades detail for speed. A moved slider is sent with the
+	// next update as pendingDetail, detailLabel shows what the server applied.
+	detailSlider, detailLabel *js.Object
+	pendingDetail             *float32
+
+	// In paint mode clicks on the canvas paint with the brush of brushPanel,
+	// shift-clicks erase. A click is sent with the next update as pendingPaint.
+	paintMode                           bool
+	brushPanel, brushColor, brushRadius *js.Object
+	pendingPaint                        *paintRequest
+
+	// Overlay statistics, toggled with the overlay action.
+	overlay                         bool
+	fps, payloadSize, droppedFrames int
+	renderTime, rtt, bandwidth      float64
+
+	// renderFormat is the color format the server renders at, which can differ
+	// from the colorFormat asked for.
+	renderFormat string
+
+	// tileBytes is the payload received for the progressive frame in flight.
+	tileBytes int
 )
 
 func throw(err error) {
@@ -111,7 +301,454 @@ func createPalette(data []byte) color.Palette {
 	return pal
 }
 
+// renderURL returns the websocket address of the backend. It is derived from the
+// location of the page unless the server query parameter is given.
+func renderURL() string {
+	scheme := "ws"
+	if js.Global.Get("location").Get("protocol").String() == "https:" {
+		scheme = "wss"
+	}
+	return fmt.Sprintf("%s://%s/render", scheme, serverHost())
+}
+
+// authToken returns the token given in the URL fragment as #token=SECRET.
+func authToken() string {
+	hash := js.Global.Get("location").Get("hash").String()
+	params := js.Global.Get("URLSearchParams").New(strings.TrimPrefix(hash, "#"))
+	if token := params.Call("get", "token"); token != nil {
+		return token.String()
+	}
+	return ""
+}
+
+// treeName returns the tree requested with the tree query parameter.
+func treeName() string {
+	params := js.Global.Get("URLSearchParams").New(js.Global.Get("location").Get("search"))
+	if tree := params.Call("get", "tree"); tree != nil {
+		return tree.String()
+	}
+	return ""
+}
+
+// progressiveMode reports if progressive frames were requested with the progressive
+// query parameter. Tiles are then drawn as soon as they arrive.
+func progressiveMode() bool {
+	params := js.Global.Get("URLSearchParams").New(js.Global.Get("location").Get("search"))
+	return params.Call("has", "progressive").Bool()
+}
+
+// walkMode reports if walk mode was requested with the walk query parameter. The
+// server keeps the camera out of the tree and on the ground.
+func walkMode() bool {
+	params := js.Global.Get("URLSearchParams").New(js.Global.Get("location").Get("search"))
+	return params.Call("has", "walk").Bool()
+}
+
+// stereoMode reports if side-by-side stereo was requested with the stereo query
+// parameter. The canvas shows both eyes as they are rendered.
+func stereoMode() bool {
+	params := js.Global.Get("URLSearchParams").New(js.Global.Get("location").Get("search"))
+	return params.Call("has", "stereo").Bool()
+}
+
+// overviewMode reports if a locked overview of the tree was requested with the
+// overview query parameter. It is rendered by the server as a second viewport.
+func overviewMode() bool {
+	params := js.Global.Get("URLSearchParams").New(js.Global.Get("location").Get("search"))
+	return params.Call("has", "overview").Bool()
+}
+
+// brushPaint returns the paint request of a click at the normalized position x, y
+// with the brush of the brush panel.
+func brushPaint(x, y float64, erase bool) *paintRequest {
+	req := &paintRequest{Pixel: &[2]float32{float32(x), float32(y)}, Radius: float32(brushRadius.Get("value").Float()), Mode: "add"}
+	if erase {
+		req.Mode = "erase"
+	}
+
+	// Color inputs hold the color as #rrggbb.
+	if c, err := strconv.ParseUint(strings.TrimPrefix(brushColor.Get("value").String(), "#"), 16, 32); err == nil {
+		req.Color = [3]uint8{uint8(c >> 16), uint8(c >> 8), uint8(c)}
+	}
+	return req
+}
+
+func setStatus(text string) {
+	status.Set("textContent", text)
+}
+
+// parseBinaryError decodes the binary variant of the error message.
+func parseBinaryError(data []byte) (*errorMessage, bool) {
+	const magic = "ERR\x00"
+	if len(data) <= len(magic) || string(data[:len(magic)]) != magic {
+		return nil, false
+	}
+
+	data = data[len(magic):]
+	n := int(data[0]) + 1
+	if n > len(data) {
+		return nil, false
+	}
+	return &errorMessage{Error: string(data[1:n]), Message: string(data[n:])}, true
+}
+
+// parseFrameHeader strips the header from an image frame and returns the render time
+// in milliseconds, the number of frames dropped by the server and the image index.
+func parseFrameHeader(data []byte) ([]byte, frameInfo, bool) {
+	return parseHeader(data, "FRM\x00")
+}
+
+// parseEndOfFrame parses the marker sent after the last tile of a progressive frame.
+// It has the same layout as the frame header.
+func parseEndOfFrame(data []byte) (frameInfo, bool) {
+	_, info, ok := parseHeader(data, "END\x00")
+	return info, ok
+}
+
+// parseViewportFrame strips the header from a frame of a viewport other than the main
+// view and returns the RGBA pixels and the viewport id.
+func parseViewportFrame(data []byte) ([]byte, int, bool) {
+	data, _, ok := parseHeader(data, "VPF\x00")
+	if !ok || len(data) < 4 {
+		return data, 0, false
+	}
+	return data[4:], int(binary.LittleEndian.Uint32(data)), true
+}
+
+// drawOverview draws a frame of the overview viewport.
+func drawOverview(pix []byte) {
+	if len(pix) != overviewWidth*overviewHeight*4 {
+		return
+	}
+
+	ctx := overviewCanvas.Call("getContext", "2d")
+	img := ctx.Call("createImageData", overviewWidth, overviewHeight)
+	img.Get("data").Call("set", js.Global.Get("Uint8ClampedArray").New(js.NewArrayBuffer(pix)))
+	ctx.Call("putImageData", img, 0, 0)
+}
+
+func parseHeader(data []byte, magic string) ([]byte, frameInfo, bool) {
+	const headerSize = 28
+
+	if len(data) < headerSize || string(data[:len(magic)]) != magic {
+		return data, frameInfo{}, false
+	}
+
+	info := frameInfo{
+		renderTime: float64(binary.LittleEndian.Uint32(data[8:])) / 1000,
+		dropped:    int(binary.LittleEndian.Uint32(data[20:])),
+		image:      int(binary.LittleEndian.Uint32(data[24:]) % 2),
+	}
+	return data[headerSize:], info, true
+}
+
+// parseTile strips the header from a tile of a progressive frame. The pixels of the
+// tile are returned row by row.
+func parseTile(data []byte) ([]byte, tileInfo, bool) {
+	const (
+		magic      = "TIL\x00"
+		headerSize = 20
+	)
+
+	if len(data) < headerSize || string(data[:len(magic)]) != magic {
+		return data, tileInfo{}, false
+	}
+
+	x, y := int(binary.LittleEndian.Uint16(data[12:])), int(binary.LittleEndian.Uint16(data[14:]))
+	w, h := int(binary.LittleEndian.Uint16(data[16:])), int(binary.LittleEndian.Uint16(data[18:]))
+
+	info := tileInfo{
+		image: int(binary.LittleEndian.Uint32(data[8:]) % 2),
+		rect:  image.Rect(x, y, x+w, y+h),
+	}
+	return data[headerSize:], info, true
+}
+
+// drawTile copies the pixels of a tile into its image and draws the part of the
+// canvas it covers. Tiles can arrive in any order.
+func drawTile(ctx, img *js.Object, data []byte, tile tileInfo) {
+	rect := tile.rect.Intersect(imgRect)
+	if rect.Empty() {
+		return
+	}
+
+	var (
+		imageA, imageB image.Image
+		pix            []byte
+		bpp            int
+	)
+
+	if len(data) == tile.rect.Dx()*tile.rect.Dy()*4 {
+		pix, bpp = rgbaImages[tile.image].Pix, 4
+		imageA, imageB = rgbaImages[0], rgbaImages[1]
+	} else if len(data) == tile.rect.Dx()*tile.rect.Dy() {
+		pix, bpp = palImages[tile.image].Pix, 1
+		imageA, imageB = palImages[0], palImages[1]
+	} else {
+		return
+	}
+
+	stride := imgRect.Dx() * bpp
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		src := data[((y-tile.rect.Min.Y)*tile.rect.Dx()+rect.Min.X-tile.rect.Min.X)*bpp:]
+		copy(pix[y*stride+rect.Min.X*bpp:y*stride+rect.Max.X*bpp], src)
+	}
+
+	assert(trace.ReconstructRect(imageA, imageB, finalImage, rect))
+
+	arrBuf := js.NewArrayBuffer(finalImage.Pix)
+	buf := js.Global.Get("Uint8ClampedArray").New(arrBuf)
+	img.Get("data").Call("set", buf)
+	ctx.Call("putImageData", img, 0, 0, rect.Min.X*2, rect.Min.Y, rect.Dx()*2, rect.Dy())
+}
+
+func now() float64 {
+	return js.Global.Get("Date").Call("now").Float()
+}
+
+func pingLoop(ws *websocket.WebSocket) {
+	for _ = range time.Tick(time.Second) {
+		msg, err := json.Marshal(pingMessage{now()})
+		assert(err)
+
+		if ws.Send(string(msg)) != nil {
+			return
+		}
+	}
+}
+
+func drawOverlay(ctx *js.Object) {
+	lines := []string{
+		fmt.Sprintf("fps: %v", fps),
+		fmt.Sprintf("render: %.1f ms", renderTime),
+		fmt.Sprintf("payload: %.1f KiB", float64(payloadSize)/1024),
+		fmt.Sprintf("latency: %.0f ms", rtt),
+		fmt.Sprintf("bandwidth: %.0f KiB/s", bandwidth/1024),
+		fmt.Sprintf("dropped: %v", droppedFrames),
+		fmt.Sprintf("resolution: %vx%v %s", imgWidth, imgHeight, renderFormat),
+	}
+
+	ctx.Set("fillStyle", "rgba(0, 0, 0, 0.5)")
+	ctx.Call("fillRect", 0, 0, 100, 12*len(lines)+4)
+	ctx.Set("fillStyle", "white")
+	ctx.Set("font", "10px monospace")
+
+	for i, line := range lines {
+		ctx.Call("fillText", line, 4, 12*(i+1))
+	}
+}
+
+// handleError is called when the server rejects the connection. The user is asked for
+// a token if the one given was not accepted.
+func handleError(msg *errorMessage) {
+	if msg.Error == "unauthorized" {
+		if token := js.Global.Call("prompt", "Access token:"); token != nil && token.String() != "" {
+			// Store the token in the fragment and reconnect.
+			location := js.Global.Get("location")
+			location.Set("hash", "token="+js.Global.Call("encodeURIComponent", token).String())
+			location.Call("reload")
+			return
+		}
+	}
+	setStatus(fmt.Sprintf("Error: %s (%s)", msg.Message, msg.Error))
+}
+
+// resizeImages sizes the canvas to the viewport and allocates the images. The render
+// size follows the device pixel ratio but is limited to the max resolution.
+func resizeImages() {
+	window := js.Global.Get("window")
+	displayWidth = window.Get("innerWidth").Float()
+	displayHeight = window.Get("innerHeight").Float()
+
+	ratio := 1.0
+	if dpr := window.Get("devicePixelRatio"); dpr != js.Undefined && dpr.Float() > 0 {
+		ratio = dpr.Float()
+	}
+
+	width := displayWidth * ratio / renderScale
+	height := displayHeight * ratio / renderScale
+
+	if width > maxWidth {
+		height *= maxWidth / width
+		width = maxWidth
+	}
+
+	if height > maxHeight {
+		width *= maxHeight / height
+		height = maxHeight
+	}
+
+	// The width must be even since every frame holds every other column.
+	w, h := int(width)&^1, int(height)
+	if w < 2 {
+		w = 2
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	renderFormat = colorFormat
+	allocateImages(w, h)
+	canvas.Get("style").Set("width", fmt.Sprintf("%vpx", displayWidth))
+	canvas.Get("style").Set("height", fmt.Sprintf("%vpx", displayHeight))
+}
+
+// allocateImages sets the render size and allocates the images and the canvas for
+// it. The canvas is scaled to the display size.
+func allocateImages(width, height int) {
+	imgWidth, imgHeight = width, height
+	imgRect = image.Rect(0, 0, imgWidth/2, imgHeight)
+	palImages = [2]*image.Paletted{image.NewPaletted(imgRect, palette.Plan9), image.NewPaletted(imgRect, palette.Plan9)}
+	rgbaImages = [2]*image.RGBA{image.NewRGBA(imgRect), image.NewRGBA(imgRect)}
+	finalImage = image.NewRGBA(image.Rect(0, 0, imgWidth, imgHeight))
+
+	canvas.Call("setAttribute", "width", strconv.Itoa(imgWidth))
+	canvas.Call("setAttribute", "height", strconv.Itoa(imgHeight))
+}
+
+func touchPoints(e *js.Object) []touchPoint {
+	touches := e.Get("touches")
+	points := make([]touchPoint, touches.Length())
+	for i := range points {
+		t := touches.Index(i)
+		points[i] = touchPoint{t.Get("clientX").Float(), t.Get("clientY").Float()}
+	}
+	return points
+}
+
+// onTouchMove rotates the camera when dragging one finger. Dragging two fingers pans
+// and pinching moves the camera along the view direction.
+func onTouchMove(e *js.Object) {
+	e.Call("preventDefault")
+	points := touchPoints(e)
+
+	if len(points) == len(lastTouches) {
+		switch len(points) {
+		case 1:
+			dx, dy := points[0].x-lastTouches[0].x, points[0].y-lastTouches[0].y
+			camera.XRot -= float32(dx * touchRotateSpeed)
+			camera.YRot -= float32(dy * touchRotateSpeed)
+		case 2:
+			mid := func(p []touchPoint) (float64, float64) { return (p[0].x + p[1].x) / 2, (p[0].y + p[1].y) / 2 }
+			dist := func(p []touchPoint) float64 { return math.Hypot(p[0].x-p[1].x, p[0].y-p[1].y) }
+
+			x, y := mid(points)
+			lastX, lastY := mid(lastTouches)
+			camera.Strafe(float32((x - lastX) * touchMoveSpeed))
+			camera.Lift(float32((y - lastY) * touchMoveSpeed))
+			camera.Move(float32((dist(points) - dist(lastTouches)) * touchMoveSpeed))
+		}
+		touchMoved = true
+	}
+	lastTouches = points
+}
+
+// onTouchEnd toggles auto-forward on double-tap.
+func onTouchEnd(e *js.Object) {
+	e.Call("preventDefault")
+	lastTouches = touchPoints(e)
+
+	if len(lastTouches) > 0 || touchMoved {
+		return
+	}
+
+	if t := now(); t-lastTap < doubleTapTime {
+		autoForward = !autoForward
+		lastTap = 0
+	} else {
+		lastTap = t
+	}
+}
+
+func showScreenshot(url string) {
+	link := js.Global.Get("document").Call("createElement", "a")
+	link.Set("href", url)
+	link.Set("textContent", "Download screenshot")
+	link.Get("style").Set("color", "white")
+
+	status.Set("textContent", "")
+	status.Call("appendChild", link)
+}
+
+// promptBookmark asks for the name of a bookmark. The saved bookmarks are listed if
+// list is set.
+func promptBookmark(text string, list bool) string {
+	if list && len(bookmarks) > 0 {
+		names := make([]string, len(bookmarks))
+		for i, b := range bookmarks {
+			names[i] = b.Name
+		}
+		text += " (" + strings.Join(names, ", ") + ")"
+	}
+
+	if name := js.Global.Call("prompt", text); name != nil {
+		return name.String()
+	}
+	return ""
+}
+
+// showMinimap loads the minimap image sent by the server.
+func showMinimap(m *minimap) {
+	img := js.Global.Get("Image").New()
+	img.Set("onload", func() {
+		minimapImage = img
+		minimapBounds = m.Bounds
+		minimapCanvas.Get("style").Set("display", "block")
+		drawMinimap()
+	})
+	img.Set("src", m.Image)
+}
+
+// drawMinimap draws the minimap with a marker at the camera position, pointing in the
+// view direction.
+func drawMinimap() {
+	if minimapImage == nil {
+		return
+	}
+
+	ctx := minimapCanvas.Call("getContext", "2d")
+	ctx.Call("drawImage", minimapImage, 0, 0, minimapDisplaySize, minimapDisplaySize)
+
+	b := minimapBounds
+	x := float64((camera.Pos[0]-b[0])/(b[2]-b[0])) * minimapDisplaySize
+	y := float64((camera.Pos[2]-b[1])/(b[3]-b[1])) * minimapDisplaySize
+
+	forward := camera.Forward()
+	dx, dy := float64(forward[0]), float64(forward[2])
+	if length := math.Hypot(dx, dy); length > 0 {
+		dx, dy = dx/length, dy/length
+	}
+
+	ctx.Set("strokeStyle", "red")
+	ctx.Set("fillStyle", "red")
+	ctx.Set("lineWidth", 2)
+	ctx.Call("beginPath")
+	ctx.Call("arc", x, y, 3, 0, 2*math.Pi)
+	ctx.Call("fill")
+	ctx.Call("beginPath")
+	ctx.Call("moveTo", x, y)
+	ctx.Call("lineTo", x+dx*10, y+dy*10)
+	ctx.Call("stroke")
+}
+
+// onMinimapClick moves the camera to the clicked XZ position, the height is kept.
+func onMinimapClick(e *js.Object) {
+	if minimapImage == nil {
+		return
+	}
+
+	u := float32(e.Get("offsetX").Float() / minimapDisplaySize)
+	v := float32(e.Get("offsetY").Float() / minimapDisplaySize)
+
+	b := minimapBounds
+	camera.Pos[0] = b[0] + u*(b[2]-b[0])
+	camera.Pos[2] = b[1] + v*(b[3]-b[1])
+	drawMinimap()
+}
+
 func setupConnection() {
+	resizeImages()
+
 	ctx := canvas.Call("getContext", "2d")
 	img := ctx.Call("getImageData", 0, 0, imgWidth, imgHeight)
 
@@ -119,11 +756,12 @@ func setupConnection() {
 		throw(errors.New("data size of images do not match"))
 	}
 
-	document := js.Global.Get("document")
-	location := document.Get("location")
-
-	ws, err := websocket.New(fmt.Sprintf("ws://%s/render", location.Get("host")))
+	ws, err := websocket.New(renderURL())
 	assert(err)
+	connection = ws
+
+	// received is set by the first frame data, after which the server is kept.
+	received := false
 
 	renderChan := make(chan struct{}, frameStacking)
 
@@ -131,9 +769,24 @@ func setupConnection() {
 		setup := setupMessage{
 			Width:       imgWidth,
 			Height:      imgHeight,
-			FieldOfView: 45,
+			FieldOfView: fieldOfView,
 			ColorFormat: colorFormat,
 			ClearColor:  [4]byte{127, 127, 127, 255},
+			FoveaRadius: foveaRadius,
+			Token:       authToken(),
+			Tree:        treeName(),
+			Stereo:      stereoMode(),
+			Progressive: progressiveMode(),
+			Walk:        walkMode(),
+			Minimap:     true,
+		}
+		if cameraKnown {
+			b := currentCamera()
+			setup.Camera = &b
+		}
+		if overviewMode() {
+			setup.Viewports = []viewportSetup{{Width: overviewWidth, Height: overviewHeight, Camera: "fixed"}}
+			overviewCanvas.Get("style").Set("display", "block")
 		}
 
 		msg, err := json.Marshal(setup)
@@ -141,13 +794,139 @@ func setupConnection() {
 
 		assert(ws.Send(string(msg)))
 
+		msg, err = json.Marshal(updateMessage{Bookmark: &bookmarkRequest{Action: "list"}})
+		assert(err)
+		assert(ws.Send(string(msg)))
+
+		// The server starts at full detail.
+		if detail := float32(detailSlider.Get("value").Float()); detail < 1 {
+			pendingDetail = &detail
+		}
+
 		go updateCamera(ws, renderChan)
+		go pingLoop(ws)
 	}
 
 	onMessage := func(ev *js.Object) {
-		idx := frameId % 2
+		if text := ev.Get("data"); text.Get("byteLength") == js.Undefined {
+			var msg errorMessage
+			if err := json.Unmarshal([]byte(text.String()), &msg); err == nil && msg.Error != "" {
+				handleError(&msg)
+				return
+			}
+
+			var pong pongMessage
+			if err := json.Unmarshal([]byte(text.String()), &pong); err == nil && pong.Pong != nil {
+				rtt = now() - *pong.Pong
+				bandwidth = pong.Bandwidth
+				return
+			}
+
+			var reply replyMessage
+			if err := json.Unmarshal([]byte(text.String()), &reply); err == nil {
+				switch {
+				case reply.Screenshot != nil:
+					showScreenshot(*reply.Screenshot)
+					return
+				case reply.Bookmarks != nil:
+					bookmarks = *reply.Bookmarks
+					return
+				case reply.Goto != nil:
+					gotoCamera(*reply.Goto)
+					return
+				case reply.TreeReady != nil && reply.Info != nil:
+					treeInfo = *reply.Info
+					setStatus("")
+
+					saveSession()
+					currentTree = *reply.TreeReady
+					restoreSession(currentTree, false)
+					return
+				case reply.Minimap != nil:
+					showMinimap(reply.Minimap)
+					return
+				case reply.Quality != nil:
+					// The server changed the render size or the color format.
+					// Frames are told apart by their size, the canvas keeps
+					// its display size.
+					q := reply.Quality
+					renderFormat = q.ColorFormat
+					if q.Width != imgWidth || q.Height != imgHeight {
+						allocateImages(q.Width, q.Height)
+						img = ctx.Call("getImageData", 0, 0, imgWidth, imgHeight)
+					}
+					return
+				case reply.Detail != nil && reply.LODBias != nil:
+					detailLabel.Set("textContent", fmt.Sprintf("Detail %.2f (%.1f levels dropped)", *reply.Detail, *reply.LODBias))
+					return
+				case reply.Notices != nil:
+					var text []string
+					for _, n := range *reply.Notices {
+						text = append(text, fmt.Sprintf("%s is off, %s (%s).", n.Feature, n.Reason, n.Fallback))
+					}
+					setStatus(strings.Join(text, " "))
+					return
+				case reply.Measure != nil:
+					showMeasurement(reply.Measure)
+					return
+				}
+			}
+
+			assert(json.Unmarshal([]byte(text.String()), &treeInfo))
+			return
+		}
+
 		data := js.Global.Get("Uint8Array").New(ev.Get("data")).Interface().([]uint8)
 
+		if msg, ok := parseBinaryError(data); ok {
+			handleError(msg)
+			return
+		}
+		received = true
+
+		if pix, id, ok := parseViewportFrame(data); ok {
+			if id == 1 {
+				drawOverview(pix)
+			}
+			return
+		}
+
+		if pix, tile, ok := parseTile(data); ok {
+			drawTile(ctx, img, pix, tile)
+			tileBytes += len(data)
+			return
+		}
+
+		// The end-of-frame marker follows the tiles of a progressive frame.
+		if info, ok := parseEndOfFrame(data); ok {
+			renderTime = info.renderTime
+			droppedFrames = info.dropped
+			payloadSize, tileBytes = tileBytes+len(data), 0
+
+			if overlay {
+				drawOverlay(ctx)
+			}
+
+			numFrames++
+			frameId++
+
+			select {
+			case renderChan <- struct{}{}:
+			default:
+			}
+			return
+		}
+
+		payload := len(data)
+		data, info, isFrame := parseFrameHeader(data)
+
+		// Frames may be dropped by the server so the header tells which image
+		// this is, older servers alternate.
+		idx := frameId % 2
+		if isFrame {
+			idx = info.image
+		}
+
 		if isPalette(data) {
 			pal := createPalette(data)
 			palImages = [2]*image.Paletted{
@@ -179,15 +958,41 @@ func setupConnection() {
 		img.Get("data").Call("set", buf)
 		ctx.Call("putImageData", img, 0, 0)
 
+		if isFrame {
+			renderTime = info.renderTime
+			droppedFrames = info.dropped
+			payloadSize = payload
+		}
+
+		if overlay {
+			drawOverlay(ctx)
+		}
+
 		numFrames++
 		frameId++
 
-		renderChan <- struct{}{}
+		select {
+		case renderChan <- struct{}{}:
+		default:
+		}
 	}
 
 	ws.BinaryType = "arraybuffer"
 	ws.AddEventListener("open", false, onOpen)
 	ws.AddEventListener("message", false, onMessage)
+	ws.AddEventListener("close", false, func(ev *js.Object) {
+		// Servers that fail before the first frame are replaced by the next
+		// one listed by the coordinator.
+		if ws == connection && !received && nextServer() {
+			setStatus("Connecting to " + serverHost() + "...")
+			setupConnection()
+			return
+		}
+
+		if status.Get("textContent").String() == "" {
+			setStatus("Connection closed.")
+		}
+	})
 }
 
 func updateCamera(ws *websocket.WebSocket, renderChan <-chan struct{}) {
@@ -195,30 +1000,39 @@ func updateCamera(ws *websocket.WebSocket, renderChan <-chan struct{}) {
 
 	var msg updateMessage
 	for _ = range time.Tick(tick30hz) {
+		updateInput()
+
 		switch {
-		case keys[38]: // Up
-			camera.YRot += cameraSpeed
-		case keys[40]: // Down
-			camera.YRot -= cameraSpeed
-		case keys[37]: // Left
-			camera.XRot += cameraSpeed
-		case keys[39]: // Right
-			camera.XRot -= cameraSpeed
-		case keys[87]: // W
-			camera.Move(cameraSpeed)
-		case keys[83]: // S
-			camera.Move(-cameraSpeed)
-		case keys[65]: // A
-			camera.Strafe(cameraSpeed)
-		case keys[68]: // D
-			camera.Strafe(-cameraSpeed)
-		case keys[69]: // E
-			camera.Lift(cameraSpeed)
-		case keys[81]: // Q
-			camera.Lift(-cameraSpeed)
-		case keys[67]: // C
-			keys[67] = false
+		case triggered("frame_prev"):
+			if msg.Frame > 0 {
+				msg.Frame--
+			}
+		case triggered("frame_next"):
+			msg.Frame++
+		case triggered("screenshot"):
+			msg.Screenshot = true
+			setStatus("Rendering screenshot...")
+		case triggered("bookmark_save"):
+			if name := promptBookmark("Save bookmark as:", false); name != "" {
+				msg.Bookmark = &bookmarkRequest{"save", name}
+			}
+		case triggered("bookmark_start"):
+			if name := promptBookmark("Save start camera as:", false); name != "" {
+				msg.Bookmark = &bookmarkRequest{"start", name}
+			}
+		case triggered("bookmark_goto"):
+			if name := promptBookmark("Go to bookmark:", true); name != "" {
+				msg.Bookmark = &bookmarkRequest{"goto", name}
+			}
+		case triggered("tree"):
+			if name := js.Global.Call("prompt", "Load tree:"); name != nil && name.String() != "" {
+				tree := name.String()
+				msg.Tree = &tree
+				setStatus("Loading " + tree + "...")
+			}
+		case triggered("color_format"):
 			ws.Close()
+			resized = false
 
 			if colorFormat == "RGBA" {
 				colorFormat = "PALETTED"
@@ -226,25 +1040,80 @@ func updateCamera(ws *websocket.WebSocket, renderChan <-chan struct{}) {
 				colorFormat = "RGBA"
 			}
 
+			frameId = 0
+			setupConnection()
+			return
+		case triggered("paint"):
+			if measureMode {
+				toggleMeasureMode()
+			}
+			paintMode = !paintMode
+			if paintMode {
+				brushPanel.Get("style").Set("display", "block")
+				setStatus("Paint mode, shift-click erases.")
+			} else {
+				brushPanel.Get("style").Set("display", "none")
+				setStatus("")
+			}
+		case triggered("undo"):
+			msg.Undo = true
+		case triggered("measure"):
+			toggleMeasureMode()
+		case pendingPaint != nil:
+			msg.Paint, pendingPaint = pendingPaint, nil
+		case pendingMeasure != nil:
+			msg.Measure, pendingMeasure = pendingMeasure, nil
+		case pendingDetail != nil:
+			msg.Detail, pendingDetail = pendingDetail, nil
+		case resized:
+			// The render size is negotiated on connect.
+			resized = false
+			ws.Close()
 			frameId = 0
 			setupConnection()
 			return
 		}
 
+		if autoForward {
+			camera.Move(float32(input.MoveSpeed) / 2)
+		}
+
 		msg.Camera.Position = camera.Pos
 		msg.Camera.XRot = camera.XRot
 		msg.Camera.YRot = camera.YRot
+		msg.Cursor = cursor
+		cameraKnown = true
+		drawMinimap()
+		drawMeasurement()
 
 		m, err := json.Marshal(msg)
 		assert(err)
 
 		assert(ws.Send(string(m)))
-		<-renderChan
+
+		// Screenshot, bookmark, tree, detail, edit and measure requests are not
+		// answered with a frame.
+		if msg.Screenshot || msg.Bookmark != nil || msg.Tree != nil || msg.Detail != nil || msg.Paint != nil || msg.Undo || msg.Measure != nil {
+			msg.Screenshot = false
+			msg.Bookmark = nil
+			msg.Tree = nil
+			msg.Detail = nil
+			msg.Paint = nil
+			msg.Undo = false
+			msg.Measure = nil
+			continue
+		}
+
+		// The server drops outdated frames, so don't wait forever.
+		select {
+		case <-renderChan:
+		case <-time.After(time.Second / 4):
+		}
 	}
 }
 
 func updateTitle() {
-	title := fmt.Sprintf("AJ's Raytracer - fps: %v", numFrames)
+	title := fmt.Sprintf("AJ's Raytracer - fps: %v, nodes: %v", numFrames, treeInfo.NumNodes)
 	js.Global.Get("document").Set("title", title)
 }
 
@@ -253,26 +1122,119 @@ func load() {
 
 	go func() {
 		for _ = range time.Tick(time.Second) {
+			fps = numFrames
 			updateTitle()
 			numFrames = 0
+			saveSession()
 		}
 	}()
 
-	document.Set("onkeydown", func(e *js.Object) {
-		keys[e.Get("keyCode").Int()] = true
+	loadSettings()
+	document.Set("onkeydown", onKeyDown)
+	document.Set("onkeyup", onKeyUp)
+
+	canvas = document.Call("createElement", "canvas")
+	canvas.Get("style").Set("display", "block")
+	canvas.Get("style").Set("touchAction", "none")
+	document.Get("body").Call("appendChild", canvas)
+
+	status = document.Call("createElement", "div")
+	status.Set("id", "status")
+	status.Get("style").Set("cssText", "position: absolute; left: 8px; bottom: 8px; color: white; font-family: monospace")
+	document.Get("body").Call("appendChild", status)
+
+	minimapCanvas = document.Call("createElement", "canvas")
+	minimapCanvas.Call("setAttribute", "width", strconv.Itoa(minimapDisplaySize))
+	minimapCanvas.Call("setAttribute", "height", strconv.Itoa(minimapDisplaySize))
+	minimapCanvas.Get("style").Set("cssText", "position: absolute; right: 8px; top: 8px; display: none; border: 1px solid white; cursor: crosshair")
+	minimapCanvas.Set("onclick", onMinimapClick)
+	document.Get("body").Call("appendChild", minimapCanvas)
+
+	overviewCanvas = document.Call("createElement", "canvas")
+	overviewCanvas.Call("setAttribute", "width", strconv.Itoa(overviewWidth))
+	overviewCanvas.Call("setAttribute", "height", strconv.Itoa(overviewHeight))
+	overviewCanvas.Get("style").Set("cssText", "position: absolute; left: 8px; top: 8px; display: none; border: 1px solid white")
+	document.Get("body").Call("appendChild", overviewCanvas)
+
+	detail := document.Call("createElement", "div")
+	detail.Get("style").Set("cssText", "position: absolute; right: 8px; bottom: 8px; color: white; font-family: monospace")
+	detailLabel = document.Call("createElement", "div")
+	detailLabel.Set("textContent", "Detail 1.00")
+	detailSlider = document.Call("createElement", "input")
+	detailSlider.Set("type", "range")
+	detailSlider.Set("min", "0")
+	detailSlider.Set("max", "1")
+	detailSlider.Set("step", "0.05")
+	detailSlider.Set("value", "1")
+	detailSlider.Set("onchange", func() {
+		value := float32(detailSlider.Get("value").Float())
+		pendingDetail = &value
 	})
+	detail.Call("appendChild", detailLabel)
+	detail.Call("appendChild", detailSlider)
+	document.Get("body").Call("appendChild", detail)
 
-	document.Set("onkeyup", func(e *js.Object) {
-		keys[e.Get("keyCode").Int()] = false
+	brushPanel = document.Call("createElement", "div")
+	brushPanel.Get("style").Set("cssText", "position: absolute; right: 8px; bottom: 56px; display: none; color: white; font-family: monospace")
+	brushColor = document.Call("createElement", "input")
+	brushColor.Set("type", "color")
+	brushColor.Set("value", "#ff0000")
+	brushRadius = document.Call("createElement", "input")
+	brushRadius.Set("type", "range")
+	brushRadius.Set("min", "0")
+	brushRadius.Set("max", "8")
+	brushRadius.Set("step", "1")
+	brushRadius.Set("value", "1")
+	brushLabel := document.Call("createElement", "div")
+	brushLabel.Set("textContent", "Brush")
+	brushPanel.Call("appendChild", brushLabel)
+	brushPanel.Call("appendChild", brushColor)
+	brushPanel.Call("appendChild", brushRadius)
+	document.Get("body").Call("appendChild", brushPanel)
+
+	createMeasureOverlay(document)
+	createSettingsPanel()
+
+	servers = fetchServers()
+
+	canvas.Set("onmousemove", func(e *js.Object) {
+		x := e.Get("offsetX").Float() / displayWidth
+		y := e.Get("offsetY").Float() / displayHeight
+		cursor = &[2]float32{float32(x), float32(y)}
 	})
 
-	canvas = document.Call("createElement", "canvas")
-	canvas.Call("setAttribute", "width", strconv.Itoa(imgWidth))
-	canvas.Call("setAttribute", "height", strconv.Itoa(imgHeight))
-	canvas.Get("style").Set("width", strconv.Itoa(imgWidth*imgScale)+"px")
-	canvas.Get("style").Set("height", strconv.Itoa(imgHeight*imgScale)+"px")
-	document.Get("body").Call("appendChild", canvas)
+	canvas.Set("onmouseleave", func(e *js.Object) {
+		cursor = nil
+	})
+
+	canvas.Set("onmousedown", func(e *js.Object) {
+		if e.Get("button").Int() != 0 {
+			return
+		}
+		x, y := e.Get("offsetX").Float()/displayWidth, e.Get("offsetY").Float()/displayHeight
+		if paintMode {
+			pendingPaint = brushPaint(x, y, e.Get("shiftKey").Bool())
+		} else if measureMode {
+			onMeasureClick(x, y)
+		}
+	})
+
+	canvas.Set("ontouchstart", func(e *js.Object) {
+		e.Call("preventDefault")
+		lastTouches = touchPoints(e)
+		touchMoved = false
+	})
+	canvas.Set("ontouchmove", onTouchMove)
+	canvas.Set("ontouchend", onTouchEnd)
+	canvas.Set("ontouchcancel", onTouchEnd)
+
+	js.Global.Get("window").Set("onresize", func() {
+		resized = true
+	})
+	js.Global.Get("window").Call("addEventListener", "pagehide", saveSession)
 
+	currentTree = treeName()
+	restoreSession(currentTree, true)
 	setupConnection()
 }
 
@@ -0,0 +1,396 @@
+//go:build js
+// +build js
+
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/andreas-jonsson/octatron/trace"
+	"github.com/gopherjs/gopherjs/js"
+)
+
+const (
+	lookSpeed    = 0.1
+	sprintFactor = 3
+
+	// settingsKey is the localStorage key of the input settings.
+	settingsKey = "octatron.input"
+)
+
+type (
+	// inputAction is an action that can be bound to keys. The name is used
+	// as the key of the binding in the stored settings.
+	inputAction struct {
+		name, label string
+		keys        []int
+	}
+
+	// inputSettings are the key bindings and speeds, stored in localStorage.
+	inputSettings struct {
+		Bindings     map[string][]int `json:"bindings"`
+		MoveSpeed    float64          `json:"move_speed"`
+		LookSpeed    float64          `json:"look_speed"`
+		SprintFactor float64          `json:"sprint_factor"`
+	}
+)
+
+// inputActions are the bindable actions with their default keys, in the order
+// they are listed in the settings panel.
+var inputActions = []inputAction{
+	{"forward", "Move forward", []int{87}},             // W
+	{"back", "Move back", []int{83}},                   // S
+	{"left", "Strafe left", []int{65}},                 // A
+	{"right", "Strafe right", []int{68}},               // D
+	{"up", "Move up", []int{69}},                       // E
+	{"down", "Move down", []int{81}},                   // Q
+	{"sprint", "Sprint", []int{16}},                    // Shift
+	{"look_up", "Look up", []int{38}},                  // Up
+	{"look_down", "Look down", []int{40}},              // Down
+	{"look_left", "Look left", []int{37}},              // Left
+	{"look_right", "Look right", []int{39}},            // Right
+	{"frame_prev", "Previous frame", []int{90}},        // Z
+	{"frame_next", "Next frame", []int{88}},            // X
+	{"screenshot", "Screenshot", []int{80}},            // P
+	{"bookmark_save", "Save bookmark", []int{66}},      // B
+	{"bookmark_start", "Save start camera", []int{72}}, // H
+	{"bookmark_goto", "Go to bookmark", []int{71}},     // G
+	{"tree", "Load tree", []int{84}},                   // T
+	{"color_format", "Toggle color format", []int{67}}, // C
+	{"overlay", "Toggle overlay", []int{70}},           // F
+	{"paint", "Toggle paint mode", []int{86}},          // V
+	{"undo", "Undo edit", []int{85}},                   // U
+	{"measure", "Toggle measure mode", []int{77}},      // M
+	{"settings", "Toggle settings", []int{79}},         // O
+}
+
+var (
+	input = defaultSettings()
+
+	// settingsPanel lists the settings, toggled with the settings action.
+	// rebinding is the action waiting for a key press.
+	settingsPanel *js.Object
+	rebinding     string
+)
+
+func defaultSettings() inputSettings {
+	s := inputSettings{
+		Bindings:     make(map[string][]int, len(inputActions)),
+		MoveSpeed:    cameraSpeed,
+		LookSpeed:    lookSpeed,
+		SprintFactor: sprintFactor,
+	}
+	for _, a := range inputActions {
+		s.Bindings[a.name] = append([]int(nil), a.keys...)
+	}
+	return s
+}
+
+func localStorage() *js.Object {
+	if storage := js.Global.Get("localStorage"); storage != js.Undefined && storage != nil {
+		return storage
+	}
+	return nil
+}
+
+// loadSettings reads the stored settings. Actions missing from the stored
+// bindings keep their defaults and invalid speeds are ignored.
+func loadSettings() {
+	storage := localStorage()
+	if storage == nil {
+		return
+	}
+
+	data := storage.Call("getItem", settingsKey)
+	if data == nil {
+		return
+	}
+
+	var stored inputSettings
+	if json.Unmarshal([]byte(data.String()), &stored) != nil {
+		return
+	}
+
+	for _, a := range inputActions {
+		if keys, ok := stored.Bindings[a.name]; ok {
+			input.Bindings[a.name] = keys
+		}
+	}
+	if stored.MoveSpeed > 0 {
+		input.MoveSpeed = stored.MoveSpeed
+	}
+	if stored.LookSpeed > 0 {
+		input.LookSpeed = stored.LookSpeed
+	}
+	if stored.SprintFactor > 0 {
+		input.SprintFactor = stored.SprintFactor
+	}
+}
+
+func saveSettings() {
+	if storage := localStorage(); storage != nil {
+		data, err := json.Marshal(input)
+		assert(err)
+		storage.Call("setItem", settingsKey, string(data))
+	}
+}
+
+// boundTo returns true if the key code is bound to the action.
+func boundTo(code int, action string) bool {
+	for _, k := range input.Bindings[action] {
+		if k == code {
+			return true
+		}
+	}
+	return false
+}
+
+// active returns true if any key bound to the action is held.
+func active(action string) bool {
+	for _, k := range input.Bindings[action] {
+		if keys[k] {
+			return true
+		}
+	}
+	return false
+}
+
+// triggered is like active but releases the keys, for actions that should
+// only fire once per key press.
+func triggered(action string) bool {
+	if !active(action) {
+		return false
+	}
+	for _, k := range input.Bindings[action] {
+		keys[k] = false
+	}
+	return true
+}
+
+// axis returns 1, -1 or 0 depending on which of the two actions is active.
+func axis(positive, negative string) float32 {
+	var v float32
+	if active(positive) {
+		v++
+	}
+	if active(negative) {
+		v--
+	}
+	return v
+}
+
+func normalize(v trace.Vec3) trace.Vec3 {
+	length := float32(math.Sqrt(float64(v[0]*v[0] + v[1]*v[1] + v[2]*v[2])))
+	if length == 0 {
+		return v
+	}
+	return trace.Vec3{v[0] / length, v[1] / length, v[2] / length}
+}
+
+// updateInput rotates and moves the camera from the active actions. The
+// movement is along the view direction and the strafe direction of the camera,
+// vertical movement is along the world Y axis. Diagonal movement is not faster
+// than moving along a single axis.
+func updateInput() {
+	look := float32(input.LookSpeed)
+	camera.YRot += look * axis("look_up", "look_down")
+	camera.XRot += look * axis("look_left", "look_right")
+
+	forward := normalize(camera.Forward())
+	strafe := normalize(camera.Right())
+	move, side, lift := axis("forward", "back"), axis("left", "right"), axis("up", "down")
+
+	var dir trace.Vec3
+	for i := range dir {
+		dir[i] = forward[i]*move + strafe[i]*side
+	}
+	dir[1] += lift
+
+	speed := float32(input.MoveSpeed)
+	if active("sprint") {
+		speed *= float32(input.SprintFactor)
+	}
+
+	dir = normalize(dir)
+	for i := range camera.Pos {
+		camera.Pos[i] += dir[i] * speed
+	}
+}
+
+// keyName returns a readable name of the key code.
+func keyName(code int) string {
+	switch {
+	case code >= 65 && code <= 90, code >= 48 && code <= 57:
+		return string(rune(code))
+	case code >= 112 && code <= 123:
+		return fmt.Sprintf("F%d", code-111)
+	}
+
+	switch code {
+	case 16:
+		return "Shift"
+	case 17:
+		return "Ctrl"
+	case 18:
+		return "Alt"
+	case 32:
+		return "Space"
+	case 37:
+		return "Left"
+	case 38:
+		return "Up"
+	case 39:
+		return "Right"
+	case 40:
+		return "Down"
+	}
+	return "#" + strconv.Itoa(code)
+}
+
+// onKeyDown records the key. It binds the key instead if an action is waiting
+// for a key press.
+func onKeyDown(e *js.Object) {
+	if tag := e.Get("target").Get("tagName"); tag != js.Undefined && tag.String() == "INPUT" {
+		return
+	}
+
+	code := e.Get("keyCode").Int()
+	if rebinding != "" {
+		e.Call("preventDefault")
+		input.Bindings[rebinding] = []int{code}
+		rebinding = ""
+		saveSettings()
+		updateSettingsPanel()
+		return
+	}
+
+	if !keys[code] {
+		if boundTo(code, "overlay") {
+			overlay = !overlay
+		}
+		if boundTo(code, "settings") {
+			toggleSettingsPanel()
+		}
+	}
+	keys[code] = true
+}
+
+func onKeyUp(e *js.Object) {
+	keys[e.Get("keyCode").Int()] = false
+}
+
+func toggleSettingsPanel() {
+	style := settingsPanel.Get("style")
+	if style.Get("display").String() == "none" {
+		updateSettingsPanel()
+		style.Set("display", "block")
+	} else {
+		rebinding = ""
+		style.Set("display", "none")
+	}
+}
+
+// createSettingsPanel creates the hidden settings panel.
+func createSettingsPanel() {
+	document := js.Global.Get("document")
+	settingsPanel = document.Call("createElement", "div")
+	settingsPanel.Get("style").Set("cssText", "position: absolute; left: 8px; top: 8px; display: none; padding: 8px; background: rgba(0, 0, 0, 0.75); color: white; font: 12px monospace; max-height: 90%; overflow-y: auto")
+	document.Get("body").Call("appendChild", settingsPanel)
+}
+
+// updateSettingsPanel rebuilds the panel from the current settings.
+func updateSettingsPanel() {
+	document := js.Global.Get("document")
+	settingsPanel.Set("textContent", "")
+
+	appendRow := func(label string, control *js.Object) {
+		row := document.Call("createElement", "div")
+		row.Get("style").Set("cssText", "display: flex; justify-content: space-between; margin: 2px 0")
+		text := document.Call("createElement", "span")
+		text.Set("textContent", label)
+		text.Get("style").Set("marginRight", "16px")
+		row.Call("appendChild", text)
+		row.Call("appendChild", control)
+		settingsPanel.Call("appendChild", row)
+	}
+
+	numberInput := func(label string, value *float64) {
+		field := document.Call("createElement", "input")
+		field.Set("type", "number")
+		field.Set("step", "0.01")
+		field.Set("min", "0.01")
+		field.Set("value", strconv.FormatFloat(*value, 'g', -1, 64))
+		field.Get("style").Set("width", "64px")
+		field.Set("onchange", func() {
+			if v, err := strconv.ParseFloat(field.Get("value").String(), 64); err == nil && v > 0 {
+				*value = v
+				saveSettings()
+			}
+		})
+		appendRow(label, field)
+	}
+
+	numberInput("Move speed", &input.MoveSpeed)
+	numberInput("Look sensitivity", &input.LookSpeed)
+	numberInput("Sprint factor", &input.SprintFactor)
+
+	for _, a := range inputActions {
+		name := a.name
+		button := document.Call("createElement", "button")
+		button.Get("style").Set("minWidth", "64px")
+
+		if name == rebinding {
+			button.Set("textContent", "press key")
+		} else {
+			var text string
+			for i, k := range input.Bindings[name] {
+				if i > 0 {
+					text += ", "
+				}
+				text += keyName(k)
+			}
+			if text == "" {
+				text = "none"
+			}
+			button.Set("textContent", text)
+		}
+
+		button.Set("onclick", func() {
+			rebinding = name
+			button.Call("blur")
+			updateSettingsPanel()
+		})
+		appendRow(a.label, button)
+	}
+
+	reset := document.Call("createElement", "button")
+	reset.Set("textContent", "Reset to defaults")
+	reset.Get("style").Set("marginTop", "8px")
+	reset.Set("onclick", func() {
+		input = defaultSettings()
+		rebinding = ""
+		saveSettings()
+		updateSettingsPanel()
+	})
+	settingsPanel.Call("appendChild", reset)
+}
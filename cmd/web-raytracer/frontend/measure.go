@@ -0,0 +1,194 @@
+//go:build js
+// +build js
+
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/andreas-jonsson/octatron/trace"
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// visibilityInterval is the least time in milliseconds between the requests that
+// check if the points of a measurement are still visible.
+const visibilityInterval = 250
+
+type (
+	// measureRequest asks the server for the points under two normalized
+	// pixels and their distance, or if the points of a measurement are still
+	// visible.
+	measureRequest struct {
+		Pixels *[2][2]float32 `json:"pixels,omitempty"`
+		Points *[2][3]float32 `json:"points,omitempty"`
+	}
+
+	measurePoint struct {
+		Position [3]float32 `position`
+		World    [3]float64 `world`
+		Visible  bool       `visible`
+	}
+
+	// measurement is the answer to a measureRequest, points are nil for pixels
+	// that missed the tree.
+	measurement struct {
+		Points   [2]*measurePoint `points`
+		Distance *float64         `distance`
+	}
+)
+
+var (
+	// In measure mode two clicks on the canvas measure the distance between
+	// the points under them. The pixel of the first click is kept in
+	// measureStart and the request is sent with the next update.
+	measureMode    bool
+	measureStart   *[2]float32
+	pendingMeasure *measureRequest
+
+	// measured is the last measurement, drawn as two markers and a label by
+	// drawMeasurement. checkedCamera is the camera its visibility was last
+	// checked from.
+	measured       *measurement
+	measureMarkers [2]*js.Object
+	measureLabel   *js.Object
+	checkedCamera  trace.FreeFlightCamera
+	lastCheck      float64
+)
+
+// createMeasureOverlay adds the markers and label of measurements to the page.
+func createMeasureOverlay(document *js.Object) {
+	for i := range measureMarkers {
+		marker := document.Call("createElement", "div")
+		marker.Get("style").Set("cssText", "position: absolute; width: 10px; height: 10px; margin: -6px 0 0 -6px; border: 1px solid black; border-radius: 50%; display: none; pointer-events: none")
+		document.Get("body").Call("appendChild", marker)
+		measureMarkers[i] = marker
+	}
+
+	measureLabel = document.Call("createElement", "div")
+	measureLabel.Get("style").Set("cssText", "position: absolute; display: none; padding: 2px 4px; background: rgba(0, 0, 0, 0.6); font-family: monospace; pointer-events: none")
+	document.Get("body").Call("appendChild", measureLabel)
+}
+
+// toggleMeasureMode turns measure mode on or off, the measurement is removed when
+// it is turned off.
+func toggleMeasureMode() {
+	measureMode, measureStart = !measureMode, nil
+	if measureMode {
+		paintMode = false
+		brushPanel.Get("style").Set("display", "none")
+		setStatus("Measure mode, click two points.")
+	} else {
+		measured = nil
+		drawMeasurement()
+		setStatus("")
+	}
+}
+
+// onMeasureClick records a click at the normalized position x, y. The second click
+// asks the server for the measurement.
+func onMeasureClick(x, y float64) {
+	pixel := [2]float32{float32(x), float32(y)}
+	if measureStart == nil {
+		measureStart = &pixel
+		setStatus("Click the second point.")
+		return
+	}
+
+	pendingMeasure = &measureRequest{Pixels: &[2][2]float32{*measureStart, pixel}}
+	measureStart = nil
+}
+
+// showMeasurement shows the answer of the server.
+func showMeasurement(m *measurement) {
+	if m.Points[0] == nil || m.Points[1] == nil {
+		measured = nil
+		setStatus("Missed the tree, click two points.")
+	} else {
+		measured = m
+		setStatus(fmt.Sprintf("Distance %.3f", *m.Distance))
+	}
+	drawMeasurement()
+}
+
+// drawMeasurement places the markers and label of the measurement where its points
+// are seen with the current camera. Points that are hidden by leafs or outside the
+// view are grey, points outside are kept at the edge of the view. It also asks
+// the server again if the points are visible once the camera moved.
+func drawMeasurement() {
+	if measured == nil {
+		for _, marker := range measureMarkers {
+			marker.Get("style").Set("display", "none")
+		}
+		measureLabel.Get("style").Set("display", "none")
+		return
+	}
+
+	cfg := trace.Config{FieldOfViewDegrees: fieldOfView}
+	size := image.Pt(imgWidth, imgHeight)
+
+	var center [2]float64
+	for i, p := range measured.Points {
+		x, y, ok := cfg.ProjectPoint(&camera, size, p.Position)
+		sx, sy := float64(x)/float64(imgWidth)*displayWidth, float64(y)/float64(imgHeight)*displayHeight
+		inside := ok && sx >= 0 && sx < displayWidth && sy >= 0 && sy < displayHeight
+		if !ok {
+			sx, sy = displayWidth/2, displayHeight
+		}
+		sx, sy = clampFloat(sx, 0, displayWidth), clampFloat(sy, 0, displayHeight)
+		center[0], center[1] = center[0]+sx/2, center[1]+sy/2
+
+		background := "yellow"
+		if !inside || !p.Visible {
+			background = "grey"
+		}
+
+		style := measureMarkers[i].Get("style")
+		style.Set("left", fmt.Sprintf("%.0fpx", sx))
+		style.Set("top", fmt.Sprintf("%.0fpx", sy))
+		style.Set("background", background)
+		style.Set("display", "block")
+	}
+
+	style := measureLabel.Get("style")
+	style.Set("left", fmt.Sprintf("%.0fpx", center[0]))
+	style.Set("top", fmt.Sprintf("%.0fpx", center[1]))
+	style.Set("color", "white")
+	if !measured.Points[0].Visible || !measured.Points[1].Visible {
+		style.Set("color", "grey")
+	}
+	style.Set("display", "block")
+	measureLabel.Set("textContent", fmt.Sprintf("%.3f", *measured.Distance))
+
+	if camera != checkedCamera && pendingMeasure == nil && now()-lastCheck >= visibilityInterval {
+		checkedCamera, lastCheck = camera, now()
+		points := [2][3]float32{measured.Points[0].Position, measured.Points[1].Position}
+		pendingMeasure = &measureRequest{Points: &points}
+	}
+}
+
+func clampFloat(v, min, max float64) float64 {
+	if v < min {
+		return min
+	} else if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,97 @@
+//go:build js
+// +build js
+
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/gopherjs/gopherjs/js"
+	websocket "github.com/gopherjs/websocket/websocketjs"
+)
+
+// serverInfo is an entry of the server list served by a coordinator.
+type serverInfo struct {
+	Addr string `json:"addr"`
+}
+
+var (
+	// servers are the render servers listed by the coordinator, least loaded
+	// first, and serverIndex the one connected to.
+	servers     []string
+	serverIndex int
+
+	// connection is the current connection. Connections closed when
+	// reconnecting don't move on to the next server.
+	connection *websocket.WebSocket
+)
+
+// fetchServers gets the render servers from the coordinator that served the page.
+// Nil is returned if the page was not served by a coordinator.
+func fetchServers() []string {
+	done := make(chan []string, 1)
+
+	req := js.Global.Get("XMLHttpRequest").New()
+	req.Call("open", "GET", "servers")
+	req.Set("onload", func() {
+		var list []serverInfo
+		if req.Get("status").Int() != 200 || json.Unmarshal([]byte(req.Get("responseText").String()), &list) != nil {
+			done <- nil
+			return
+		}
+
+		var addrs []string
+		for _, s := range list {
+			addrs = append(addrs, s.Addr)
+		}
+		done <- addrs
+	})
+	req.Set("onerror", func() {
+		done <- nil
+	})
+	req.Call("send")
+
+	return <-done
+}
+
+// serverHost returns the host of the render server to connect to. The server
+// query parameter takes priority over the coordinator.
+func serverHost() string {
+	location := js.Global.Get("location")
+	params := js.Global.Get("URLSearchParams").New(location.Get("search"))
+	if server := params.Call("get", "server"); server != nil && server.String() != "" {
+		return server.String()
+	}
+
+	if serverIndex < len(servers) {
+		return servers[serverIndex]
+	}
+	return location.Get("host").String()
+}
+
+// nextServer moves on to the next server in the list. False is returned if
+// there are no more servers to try.
+func nextServer() bool {
+	if serverIndex+1 >= len(servers) {
+		return false
+	}
+	serverIndex++
+	return true
+}
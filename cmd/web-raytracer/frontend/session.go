@@ -0,0 +1,111 @@
+//go:build js
+// +build js
+
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// sessionKeyPrefix is followed by the tree name in the localStorage key of the
+// session of a tree.
+const sessionKeyPrefix = "octatron.session."
+
+// sessionState is the camera and settings of the last session on a tree, so a
+// reload continues where it stopped.
+type sessionState struct {
+	Camera      bookmark `json:"camera"`
+	ColorFormat string   `json:"color_format"`
+	Detail      float32  `json:"detail"`
+}
+
+var (
+	// currentTree is the name of the tree shown, empty for the default tree.
+	currentTree string
+
+	// cameraKnown is set once the camera was restored, placed by the server or
+	// sent. Later setups carry the camera so the server keeps it.
+	cameraKnown bool
+)
+
+func loadSession(tree string) (sessionState, bool) {
+	var state sessionState
+
+	storage := localStorage()
+	if storage == nil {
+		return state, false
+	}
+
+	data := storage.Call("getItem", sessionKeyPrefix+tree)
+	if data == nil || json.Unmarshal([]byte(data.String()), &state) != nil {
+		return state, false
+	}
+	return state, true
+}
+
+// saveSession stores the session of the current tree.
+func saveSession() {
+	storage := localStorage()
+	if storage == nil {
+		return
+	}
+
+	state := sessionState{
+		Camera:      currentCamera(),
+		ColorFormat: colorFormat,
+		Detail:      float32(detailSlider.Get("value").Float()),
+	}
+	data, err := json.Marshal(state)
+	assert(err)
+	storage.Call("setItem", sessionKeyPrefix+currentTree, string(data))
+}
+
+// restoreSession moves the camera to where the last session on tree stopped and
+// restores the detail. The color format is only restored when connecting, since
+// changing it needs a new connection. The server moves cameras that are out of
+// reach of the tree.
+func restoreSession(tree string, connecting bool) {
+	state, ok := loadSession(tree)
+	if !ok {
+		return
+	}
+
+	gotoCamera(state.Camera)
+	if connecting && (state.ColorFormat == "RGBA" || state.ColorFormat == "PALETTED") {
+		colorFormat = state.ColorFormat
+	}
+	if state.Detail >= 0 && state.Detail <= 1 {
+		detailSlider.Set("value", strconv.FormatFloat(float64(state.Detail), 'f', -1, 32))
+		pendingDetail = &state.Detail
+	}
+}
+
+// gotoCamera moves the camera to b.
+func gotoCamera(b bookmark) {
+	camera.Pos = b.Position
+	camera.XRot = b.XRot
+	camera.YRot = b.YRot
+	cameraKnown = true
+}
+
+func currentCamera() bookmark {
+	return bookmark{Position: camera.Pos, XRot: camera.XRot, YRot: camera.YRot}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Pipeline is the shortest path from points to pictures. It generates a point
+// cloud in memory, builds a tree of it with two workers, loads the tree and
+// renders it from three sides to PNG files. No input files are needed.
+//
+//	pipeline -out /tmp/views
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/andreas-jonsson/octatron/pack"
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+const (
+	numPoints     = 40000
+	numWorkers    = 2
+	voxelsPerAxis = 64
+	sphereRadius  = 0.8
+)
+
+var (
+	imageSize  = image.Pt(160, 120)
+	clearColor = color.RGBA{0, 0, 0, 255}
+)
+
+// view is a camera position looking at the center of the tree, which spans
+// zero to one on every axis once it is loaded. The cameras are a little off the
+// axes, rays in the planes between nodes can pass through the gaps.
+type view struct {
+	name string
+	pos  trace.Vec3
+}
+
+var views = []view{
+	{"front.png", trace.Vec3{0.7, 0.8, 2}},
+	{"side.png", trace.Vec3{2, 0.8, 0.3}},
+	{"top.png", trace.Vec3{0.6, 2, 0.7}},
+}
+
+// spherePoint returns point i of n spread evenly over a sphere around the
+// origin, colored by its direction.
+func spherePoint(i, n int) pack.Sample {
+	y := 1 - 2*(float64(i)+0.5)/float64(n)
+	r := math.Sqrt(1 - y*y)
+	a := float64(i) * math.Pi * (3 - math.Sqrt(5))
+	x, z := r*math.Cos(a), r*math.Sin(a)
+
+	return pack.Sample{
+		Pos: pack.Point{X: x * sphereRadius, Y: y * sphereRadius, Z: z * sphereRadius},
+		Col: pack.Color{R: float32(x+1) / 2, G: float32(y+1) / 2, B: float32(z+1) / 2, A: 1},
+	}
+}
+
+// pointWorker sends every numWorkers point of the cloud, starting with first.
+func pointWorker(first int) pack.BuildWorker {
+	return func(samples chan<- pack.Sample) error {
+		for i := first; i < numPoints; i += numWorkers {
+			samples <- spherePoint(i, numPoints)
+		}
+		return nil
+	}
+}
+
+// build returns the encoded tree of the point cloud.
+func build() ([]byte, error) {
+	var buf bytes.Buffer
+	cfg := pack.BuildConfig{
+		Writer:        &buf,
+		Bounds:        pack.Box{Pos: pack.Point{X: -1, Y: -1, Z: -1}, Size: 2},
+		VoxelsPerAxis: voxelsPerAxis,
+		Format:        pack.MipR8G8B8A8UnpackUI32,
+		Parallelism:   numWorkers,
+	}
+	for i := 0; i < numWorkers; i++ {
+		cfg.Workers = append(cfg.Workers, pointWorker(i))
+	}
+
+	if _, err := pack.BuildTree(&cfg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writePNG writes img to the file name. The alpha of node colors is not
+// opacity, so every pixel is made opaque first.
+func writePNG(name string, img *image.RGBA) error {
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+
+	fp, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(fp, img); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// run builds, loads and renders the tree and returns the images written to dir.
+func run(dir string) ([]string, error) {
+	data, err := build()
+	if err != nil {
+		return nil, err
+	}
+
+	tree, vpa, err := trace.LoadOctree(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]trace.RenderJob, len(views))
+	for i, v := range views {
+		jobs[i] = trace.RenderJob{
+			Config: trace.Config{
+				FieldOfViewDegrees: 45,
+				TreeScale:          1,
+				ViewDist:           10,
+				MultiThreaded:      true,
+			},
+			Size:       imageSize,
+			Camera:     &trace.LookAtCamera{Pos: v.pos, Look: trace.Vec3{0.5, 0.5, 0.5}},
+			Tree:       tree,
+			MaxDepth:   trace.TreeWidthToDepth(vpa),
+			ClearColor: &clearColor,
+		}
+	}
+
+	var files []string
+	trace.RenderBatchOrdered(jobs, 0, func(i int, img *image.RGBA, rerr error) {
+		if err != nil {
+			return
+		}
+		if err = rerr; err != nil {
+			return
+		}
+
+		name := filepath.Join(dir, views[i].name)
+		if err = writePNG(name, img); err == nil {
+			files = append(files, name)
+		}
+	})
+	return files, err
+}
+
+func main() {
+	out := flag.String("out", ".", "directory the images are written to")
+	flag.Parse()
+
+	files, err := run(*out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(trace.ExitCode(err))
+	}
+	for _, name := range files {
+		fmt.Println(name)
+	}
+}
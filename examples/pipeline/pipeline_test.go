@@ -0,0 +1,96 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// minCoverage is the part of each image the sphere must cover.
+const minCoverage = 0.15
+
+func TestPipeline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files, err := run(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(views) {
+		t.Fatalf("expected %d images, got %d", len(views), len(files))
+	}
+
+	for _, name := range files {
+		fp, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(fp)
+		fp.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		b := img.Bounds()
+		if b.Size() != imageSize {
+			t.Errorf("%s: unexpected size %v", name, b.Size())
+		}
+
+		var covered int
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, bl, _ := img.At(x, y).RGBA()
+				if r != 0 || g != 0 || bl != 0 {
+					covered++
+				}
+			}
+		}
+		if min := int(minCoverage * float64(b.Dx()*b.Dy())); covered < min {
+			t.Errorf("%s: %d pixels were hit, expected at least %d", filepath.Base(name), covered, min)
+		}
+	}
+}
+
+func Example() {
+	dir, err := ioutil.TempDir("", "pipeline")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files, err := run(dir)
+	if err != nil {
+		panic(err)
+	}
+	for _, name := range files {
+		fmt.Println(filepath.Base(name))
+	}
+	// Output:
+	// front.png
+	// side.png
+	// top.png
+}
@@ -0,0 +1,167 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"sort"
+)
+
+// AtlasRange maps Count consecutive node indices, starting at First, to
+// consecutive texels of a color atlas starting at Texel.
+type AtlasRange struct {
+	First NodeIndex `json:"first"`
+	Count uint32    `json:"count"`
+	Texel uint32    `json:"texel"`
+}
+
+// ColorAtlas describes where the leaf colors of a tree are stored in an atlas
+// written by ExportColorAtlas. It is meant to be stored as JSON next to the
+// atlas image.
+//
+// Texels are numbered in the order the leafs are reached depth first from the
+// root with the children in Morton order. The atlas is made of square tiles of
+// TileSize texels per side, filled left to right, top to bottom, and the texels
+// within a tile are laid out in Morton order as well. Leafs close in the tree
+// therefore end up close in the atlas.
+type ColorAtlas struct {
+	Width    int          `json:"width"`
+	Height   int          `json:"height"`
+	TileSize int          `json:"tile_size"`
+	Ranges   []AtlasRange `json:"ranges"`
+}
+
+// Lookup returns the atlas coordinates of the color of a leaf node, false if
+// the node is not in the atlas.
+func (atlas *ColorAtlas) Lookup(index NodeIndex) (image.Point, bool) {
+	ranges := atlas.Ranges
+	i := sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].First+NodeIndex(ranges[i].Count) > index
+	})
+	if i == len(ranges) || ranges[i].First > index {
+		return image.Point{}, false
+	}
+	return atlas.texelPos(ranges[i].Texel + uint32(index-ranges[i].First)), true
+}
+
+// texelPos returns the atlas coordinates of a texel number.
+func (atlas *ColorAtlas) texelPos(texel uint32) image.Point {
+	tileArea := uint32(atlas.TileSize * atlas.TileSize)
+	tile, offset := int(texel/tileArea), offset2D(texel%tileArea)
+
+	tilesPerRow := atlas.Width / atlas.TileSize
+	return image.Pt((tile%tilesPerRow)*atlas.TileSize+offset.X, (tile/tilesPerRow)*atlas.TileSize+offset.Y)
+}
+
+// offset2D splits a Morton code into the x and y coordinates it interleaves.
+func offset2D(code uint32) image.Point {
+	var x, y int
+	for bit := uint(0); code>>(bit*2) != 0; bit++ {
+		x |= int(code>>(bit*2)&1) << bit
+		y |= int(code>>(bit*2+1)&1) << bit
+	}
+	return image.Pt(x, y)
+}
+
+// ExportColorAtlas writes the leaf colors of a tree as a PNG atlas, one texel per
+// leaf, for renderers that traverse the tree on the GPU. The returned atlas maps
+// node indices to texels. Leafs shared by several parents are only stored once.
+// Tile size must be a power of two.
+func ExportColorAtlas(reader io.ReadSeeker, writer io.Writer, tileSize int) (*ColorAtlas, error) {
+	if tileSize <= 0 || tileSize&(tileSize-1) != 0 || tileSize > 1<<15 {
+		return nil, errInvalidTileSize
+	}
+
+	data, err := decodeTree(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	leafs, err := atlasLeafs(data.Children)
+	if err != nil {
+		return nil, err
+	}
+
+	// The tiles are arranged in a square, or as close to one as the number
+	// of tiles allows.
+	tileArea := tileSize * tileSize
+	numTiles := (len(leafs) + tileArea - 1) / tileArea
+	if numTiles == 0 {
+		numTiles = 1
+	}
+	tilesPerRow := 1
+	for tilesPerRow*tilesPerRow < numTiles {
+		tilesPerRow++
+	}
+
+	atlas := &ColorAtlas{
+		Width:    tilesPerRow * tileSize,
+		Height:   (numTiles + tilesPerRow - 1) / tilesPerRow * tileSize,
+		TileSize: tileSize,
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, atlas.Width, atlas.Height))
+	for texel, index := range leafs {
+		c := data.Colors[index]
+		pos := atlas.texelPos(uint32(texel))
+		img.SetNRGBA(pos.X, pos.Y, color.NRGBA{roundChannel(c.R), roundChannel(c.G), roundChannel(c.B), roundChannel(c.A)})
+
+		if n := len(atlas.Ranges); n > 0 {
+			last := &atlas.Ranges[n-1]
+			if last.First+NodeIndex(last.Count) == index && last.Texel+last.Count == uint32(texel) {
+				last.Count++
+				continue
+			}
+		}
+		atlas.Ranges = append(atlas.Ranges, AtlasRange{First: index, Count: 1, Texel: uint32(texel)})
+	}
+
+	// Lookup searches the ranges by node index.
+	sort.Slice(atlas.Ranges, func(i, j int) bool {
+		return atlas.Ranges[i].First < atlas.Ranges[j].First
+	})
+
+	if err := png.Encode(writer, img); err != nil {
+		return nil, err
+	}
+	return atlas, nil
+}
+
+// atlasLeafs returns the leaf nodes in the order they are reached depth first
+// from the root, with the children in Morton order.
+func atlasLeafs(children [][8]NodeIndex) ([]NodeIndex, error) {
+	if len(children) == 0 {
+		return nil, nil
+	}
+
+	nodes, err := layoutOrder(children, DepthFirstLayout)
+	if err != nil {
+		return nil, err
+	}
+
+	var leafs []NodeIndex
+	for _, index := range nodes {
+		if children[index] == ([8]NodeIndex{}) {
+			leafs = append(leafs, index)
+		}
+	}
+	return leafs, nil
+}
@@ -0,0 +1,169 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func atlasTexel(img image.Image, pos image.Point) color.NRGBA {
+	return color.NRGBAModel.Convert(img.At(pos.X, pos.Y)).(color.NRGBA)
+}
+
+func TestColorAtlas(t *testing.T) {
+	const text = `
+voxels 4
+node 0 color #808080ff children 0 4 0 0 0 2 0 0
+node 2 color #ff0000ff children 5 0 0 0 0 1 0 1
+node 1 color #0000ffff children 0 0 0 0 0 0 0 0
+node 3 color #00ff0080 children 0 0 0 0 0 0 0 0
+node 4 color #404040ff children 3 0 0 6 0 0 0 0
+node 5 color #ffff00ff children 0 0 0 0 0 0 0 0
+node 6 color #00ffffff children 0 0 0 0 0 0 0 0
+`
+
+	var tree bytes.Buffer
+	if err := ParseText(strings.NewReader(text), &tree, MipR8G8B8A8UnpackUI32); err != nil {
+		panic(err)
+	}
+
+	var out bytes.Buffer
+	atlas, err := ExportColorAtlas(bytes.NewReader(tree.Bytes()), &out, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := png.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != image.Rect(0, 0, atlas.Width, atlas.Height) || atlas.Width != 2 || atlas.Height != 2 {
+		t.Fatalf("expected a single 2x2 tile, got %v for %dx%d", img.Bounds(), atlas.Width, atlas.Height)
+	}
+
+	// The atlas is used at runtime through its JSON sidecar.
+	sidecar, err := json.Marshal(atlas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded ColorAtlas
+	if err := json.Unmarshal(sidecar, &loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := decodeTree(bytes.NewReader(tree.Bytes()))
+	if err != nil {
+		panic(err)
+	}
+
+	// Leafs in Morton order, node 1 is shared and stored once.
+	expected := map[NodeIndex]image.Point{3: {0, 0}, 6: {1, 0}, 5: {0, 1}, 1: {1, 1}}
+	for index := NodeIndex(0); index < 8; index++ {
+		pos, ok := loaded.Lookup(index)
+		want, leaf := expected[index]
+		if ok != leaf || pos != want {
+			t.Errorf("node %d: expected %v, %v, got %v, %v", index, want, leaf, pos, ok)
+			continue
+		}
+		if !leaf {
+			continue
+		}
+
+		c := data.Colors[index]
+		if texel := atlasTexel(img, pos); texel != (color.NRGBA{roundChannel(c.R), roundChannel(c.G), roundChannel(c.B), roundChannel(c.A)}) {
+			t.Errorf("node %d: texel %v is %v, expected %v", index, pos, texel, c)
+		}
+	}
+}
+
+func TestColorAtlasTiles(t *testing.T) {
+	var samples []Sample
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 4; y++ {
+			samples = append(samples, Sample{Point{float64(x) + 0.5, float64(y) + 0.5, 0.5}, Color{float32(x) / 3, float32(y) / 3, 0, 1}})
+		}
+	}
+
+	var tree bytes.Buffer
+	cfg := BuildConfig{
+		Worker:        NewFakeWorker(samples),
+		Writer:        &tree,
+		Bounds:        Box{Point{0, 0, 0}, 4},
+		VoxelsPerAxis: 4,
+		Format:        MipR8G8B8A8UnpackUI32,
+	}
+	if _, err := BuildTree(&cfg); err != nil {
+		panic(err)
+	}
+
+	var out bytes.Buffer
+	atlas, err := ExportColorAtlas(bytes.NewReader(tree.Bytes()), &out, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := png.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sixteen leafs in tiles of four texels are laid out as 2x2 tiles.
+	if atlas.Width != 4 || atlas.Height != 4 {
+		t.Fatalf("expected a 4x4 atlas, got %dx%d", atlas.Width, atlas.Height)
+	}
+
+	data, err := decodeTree(bytes.NewReader(tree.Bytes()))
+	if err != nil {
+		panic(err)
+	}
+
+	used := make(map[image.Point]bool)
+	for index, children := range data.Children {
+		pos, ok := atlas.Lookup(NodeIndex(index))
+		if ok != (children == [8]NodeIndex{}) {
+			t.Errorf("node %d: unexpected lookup %v, %v", index, pos, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		if used[pos] {
+			t.Errorf("node %d: texel %v is used twice", index, pos)
+		}
+		used[pos] = true
+
+		c := data.Colors[index]
+		if texel := atlasTexel(img, pos); texel.R != roundChannel(c.R) || texel.G != roundChannel(c.G) {
+			t.Errorf("node %d: texel %v is %v, expected %v", index, pos, texel, c)
+		}
+	}
+	if len(used) != 16 {
+		t.Errorf("expected 16 leafs, got %d", len(used))
+	}
+
+	if _, err := ExportColorAtlas(bytes.NewReader(tree.Bytes()), &out, 3); err != errInvalidTileSize {
+		t.Error("expected a tile size error, got:", err)
+	}
+}
@@ -18,15 +18,26 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package pack
 
 import (
+	"bufio"
 	"encoding/binary"
+	"errors"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"time"
 )
 
 const sampleChannelSize = 256
 
-type BuildWorker func(chan<- Sample) error
+// BuildWorker produces the samples of a tree and sends them on samples, from any
+// number of goroutines. All sends must be done when it returns and it must not
+// close the channel, the builder does that. Nodes are half-open boxes, see
+// CellContains, so a sample on a face shared by two nodes is inserted into the
+// one above it and samples on the max faces of the tree bounds are kept. Samples sent before an error is
+// returned may have been inserted but the build fails with the error. Panics and
+// closing the channel are turned into errors, see VerifyWorker.
+type BuildWorker func(samples chan<- Sample) error
 
 type BuildConfig struct {
 	Worker         BuildWorker
@@ -37,10 +48,166 @@ type BuildConfig struct {
 	Optimize       bool
 	ColorFilter    bool
 	ColorThreshold float32
+
+	// MinExtent is the size Bounds of size zero are grown to, centered on their
+	// position, so samples that all lie on one point still build a tree. 1e-6 if
+	// zero. Bounds that are not finite or have a negative size are rejected.
+	MinExtent float64
+
+	// Coordinates is the convention of Bounds and of the samples of the workers.
+	// They are converted to YUpRightHanded, the layout of every tree, and the
+	// convention is recorded in the header. Cell workers, count hints and color
+	// sources are queried in the convention as well.
+	Coordinates CoordinateSystem
+
+	// OccupancyAlpha stores the fraction of occupied children in the alpha
+	// channel of each node, so sparse cells can be rendered as see-through.
+	OccupancyAlpha bool
+
+	// Palette is the color table of palette formats. Node colors are replaced by
+	// the nearest palette entry.
+	Palette Palette
+
+	// Batches replaces Worker and sends the samples in batches of
+	// SampleBatchSize, 1024 if zero. SampleBatchSize is also used by cell
+	// workers that implement BatchCellWorker.
+	Batches         BatchWorker
+	SampleBatchSize int
+
+	// Workers replaces Worker with up to 64 workers, like the input files of a
+	// scan. The sidecar records which of them sampled each leaf. Parallelism of
+	// them run at once, runtime.NumCPU() if zero, so the list can be longer or
+	// shorter than the number of cores. Each worker is called once, but workers
+	// that share state must guard it. With more than one running, samples arrive
+	// in no fixed order, so the colors of trees can differ in their last bits
+	// between builds. A Parallelism of one runs them one after another.
+	Workers     []BuildWorker
+	Parallelism int
+
+	// Cells replaces Worker and samples the tree one cell at a time. CellLevel is
+	// the depth of the cells below the root, one if zero. If Cells implements
+	// CellHasher, cells are cached in CellCacheDir and restored by later builds
+	// when the fingerprint is unchanged.
+	Cells        CellWorker
+	CellLevel    int
+	CellCacheDir string
+
+	// ColorSource, if set, replaces sample colors before they are accumulated.
+	ColorSource ColorSource
+
+	// ColorVarianceThreshold, if above zero, turns nodes into leafs when all
+	// voxels below them are occupied and the largest per channel variance of
+	// their sample colors, in the range zero to one, is at or below it.
+	ColorVarianceThreshold float32
+
+	// OutlierFilter drops isolated leafs with few samples once all samples are
+	// inserted. It is ignored by dry runs.
+	OutlierFilter OutlierFilter
+
+	// Checksum appends a checksum trailer to the tree, so corruption is detected
+	// when it is loaded. See ChecksumWriter.
+	Checksum bool
+
+	// Source, if set, is polled while the tree is sampled. Cells are also polled
+	// if they implement GenerationWorker. When a generation changes the build is
+	// restarted up to RestartOnChange times, after that it fails with
+	// ErrSourceChanged.
+	Source          GenerationWorker
+	RestartOnChange int
+
+	// Preview, if set, is called every PreviewInterval, once a second if zero,
+	// while the tree is sampled. It gets a snapshot of the tree built so far, a
+	// complete MipR8G8B8A8UnpackUI32 tree, and the build waits for it to return.
+	Preview         func(tree []byte)
+	PreviewInterval time.Duration
+
+	// DedupRadius, if above zero, merges samples closer than it to an earlier
+	// sample in the same leaf into that sample, so overlapping scans of a
+	// surface don't weight the colors towards the most scanned parts. The
+	// merged sample has the average color and counts once. The accepted samples
+	// are kept for the whole build, or for one cell at a time with Cells.
+	DedupRadius float64
+
+	// Sidecar, if set, receives a record per leaf of the finished tree, keyed by
+	// node index, with the number of raw samples inside the leaf and the workers
+	// they came from. Leafs above the voxel level sum the voxels below them. The
+	// tree is not changed by it. See ReadSidecar. Samples of cells restored from
+	// the cache are not counted and dry runs write no sidecar.
+	Sidecar       io.Writer
+	SidecarFormat SidecarFormat
+
+	// Epoch is stored in the sidecar record of every leaf, like the number of
+	// the scan the tree is built from. See MarkChanges.
+	Epoch uint16
+
+	// DryRun estimates the size of the tree instead of building it, Writer is not
+	// used. The top EstimateLevels levels are counted, six if zero, with the
+	// CountHint of Cells if it has one and by streaming the samples otherwise.
+	DryRun         bool
+	EstimateLevels int
+
+	// SampleObserver, if set, is given a copy of one of every SampleObserveRate
+	// inserted samples, 1000 if zero, to learn the distribution of the data. See
+	// SampleStats. Cells restored from the cache are not observed and dry runs
+	// ignore it.
+	SampleObserver    SampleObserver
+	SampleObserveRate int
+
+	// GeoReference, if set, is written to the header so world coordinates can be
+	// converted to a real world coordinate reference system. Workers reading
+	// geo referenced files, like LAS files with their offset and scale, provide
+	// it along with their samples.
+	GeoReference *GeoReference
+
+	// ChunkPath, if set, replaces Writer. The tree is written to chunk files of
+	// ChunkSize bytes, DefaultChunkSize if zero, next to a manifest written to
+	// ChunkPath, see OpenChunked. Chunk i is named like the manifest with its
+	// extension replaced by i in four digits.
+	ChunkPath string
+	ChunkSize int64
+
+	// LevelStats breaks the work of the build down by depth into
+	// BuildStatus.Levels, to find the levels that take the most time. It reads
+	// the clock for every node visited, dry runs ignore it.
+	LevelStats bool
+
+	// Logger receives the progress of the build, cells and parallel workers as
+	// they start and finish at debug level, and the node a tree failed to be
+	// written at. NopLogger is used if nil.
+	Logger Logger
 }
 
 type BuildStatus struct {
-	Status OptStatus
+	Status    OptStatus
+	Transcode TranscodeStats
+
+	// NumCollapsed is the number of nodes turned into leafs by the color
+	// variance threshold.
+	NumCollapsed uint64
+
+	// NumOutliers is the number of leafs dropped by the outlier filter.
+	NumOutliers uint64
+
+	// NumRestarts is the number of times sampling was restarted because a source
+	// changed.
+	NumRestarts int
+
+	// Bounds is the box the tree was built from, in the convention of
+	// BuildConfig.Bounds. GrownBounds is set if it was grown to MinExtent.
+	Bounds      Box
+	GrownBounds bool
+
+	// NumSamples is the number of samples inserted into the tree and NumMerged
+	// the number of them merged into an earlier sample by DedupRadius. Samples
+	// of cells restored from the cache are not counted.
+	NumSamples, NumMerged uint64
+
+	// Estimate is only set by dry runs.
+	Estimate BuildEstimate
+
+	// Levels is the work done at every depth from the root, if
+	// BuildConfig.LevelStats is set.
+	Levels []LevelStats
 }
 
 type Sample struct {
@@ -50,15 +217,100 @@ type Sample struct {
 
 type accNode struct {
 	Color    [5]uint64
-	Children [8]uint32
+	Children [8]NodeIndex
 }
 
-var childPositions = [...]Point{
-	Point{0, 0, 0}, Point{1, 0, 0}, Point{0, 1, 0}, Point{1, 1, 0},
-	Point{0, 0, 1}, Point{1, 0, 1}, Point{0, 1, 1}, Point{1, 1, 1},
+// ChildPositions is the corner of each child slot of a node, relative to the
+// corner of the node with the lowest coordinates and in units of the child size.
+// Slot i has x in bit 0, y in bit 1 and z in bit 2, so the children of a node are
+// numbered in Morton order. The order is part of the file format, builders and
+// tracers all derive their tables from this one.
+var ChildPositions = [8][3]uint8{
+	{0, 0, 0}, {1, 0, 0}, {0, 1, 0}, {1, 1, 0},
+	{0, 0, 1}, {1, 0, 1}, {0, 1, 1}, {1, 1, 1},
+}
+
+var childPositions = func() (positions [8]Point) {
+	for i, p := range ChildPositions {
+		positions[i] = Point{float64(p[0]), float64(p[1]), float64(p[2])}
+	}
+	return
+}()
+
+// defaultMinExtent is the size bounds of size zero are grown to if
+// BuildConfig.MinExtent is zero.
+const defaultMinExtent = 1e-6
+
+// checkBounds verifies that bounds are finite with a size of at least zero. Bounds
+// of size zero are grown to minExtent around their position, the grown bounds are
+// returned with true.
+func checkBounds(bounds Box, minExtent float64) (Box, bool, error) {
+	for _, v := range [...]float64{bounds.Pos.X, bounds.Pos.Y, bounds.Pos.Z, bounds.Size} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return bounds, false, errNonFiniteBounds
+		}
+	}
+
+	if bounds.Size < 0 {
+		return bounds, false, errInvertedBounds
+	}
+
+	if minExtent == 0 {
+		minExtent = defaultMinExtent
+	} else if !(minExtent > 0) || math.IsInf(minExtent, 0) {
+		return bounds, false, errInvalidMinExtent
+	}
+
+	if bounds.Size > 0 {
+		return bounds, false, nil
+	}
+
+	half := minExtent / 2
+	return Box{Point{bounds.Pos.X - half, bounds.Pos.Y - half, bounds.Pos.Z - half}, minExtent}, true, nil
 }
 
 func BuildTree(cfg *BuildConfig) (BuildStatus, error) {
+	if cfg.ChunkPath == "" || cfg.DryRun {
+		return buildTree(cfg, nil)
+	}
+
+	chunks, err := NewChunkWriter(cfg.ChunkPath, cfg.ChunkSize)
+	if err != nil {
+		return BuildStatus{}, err
+	}
+
+	chunked := *cfg
+	chunked.Writer = chunks
+	status, err := buildTree(&chunked, nil)
+	if err != nil {
+		chunks.abort()
+		return status, err
+	}
+	return status, chunks.Close()
+}
+
+// BuildTreeData builds the tree of cfg like BuildTree but returns its nodes instead
+// of writing them, for trees that are rendered where they are built. The nodes,
+// colors and header are those of the tree written in MipR8G8B8A8UnpackUI64 and
+// decoded again. Writer, ChunkPath, Format, Palette and Checksum are ignored, the
+// sidecar is written like by BuildTree.
+func BuildTreeData(cfg *BuildConfig) (*FrameData, BuildStatus, error) {
+	if cfg.DryRun {
+		status, err := buildTree(cfg, nil)
+		return nil, status, err
+	}
+
+	data := &FrameData{}
+	status, err := buildTree(cfg, data)
+	if err != nil {
+		return nil, status, err
+	}
+	return data, status, nil
+}
+
+// buildTree builds the tree of cfg. If memory is not nil the nodes are decoded into
+// it instead of being written to cfg.Writer.
+func buildTree(cfg *BuildConfig, memory *FrameData) (BuildStatus, error) {
 	var status BuildStatus
 
 	vpa := uint64(cfg.VoxelsPerAxis)
@@ -66,61 +318,104 @@ func BuildTree(cfg *BuildConfig) (BuildStatus, error) {
 		return status, errVoxelsPowerOfTwo
 	}
 
-	fp, err := ioutil.TempFile("", "")
+	if cfg.Format.Paletted() && memory == nil {
+		if err := cfg.Palette.validate(); err != nil {
+			return status, err
+		}
+	}
+
+	if len(cfg.Workers) > maxWorkers {
+		return status, errTooManyWorkers
+	}
+
+	if cfg.GeoReference != nil {
+		if err := cfg.GeoReference.validate(); err != nil {
+			return status, err
+		}
+	}
+
+	bounds, grown, err := checkBounds(cfg.Bounds, cfg.MinExtent)
 	if err != nil {
 		return status, err
 	}
+	status.Bounds, status.GrownBounds = bounds, grown
 
-	defer func() {
-		name := fp.Name()
-		fp.Close()
-		os.Remove(name)
-	}()
-
-	var cbErr error
-	errPtr := &cbErr
-	channel := make(chan Sample, sampleChannelSize)
+	if grown {
+		adjusted := *cfg
+		adjusted.Bounds = bounds
+		cfg = &adjusted
+	}
 
-	go func() {
-		*errPtr = cfg.Worker(channel)
-		close(channel)
-	}()
+	if cfg.Coordinates != YUpRightHanded {
+		if !cfg.Coordinates.valid() {
+			return status, errUnknownCoordinates
+		}
+		converted := *cfg
+		converted.Bounds = cfg.Coordinates.ToTreeBox(cfg.Bounds)
+		cfg = &converted
+	}
 
-	header, err := writeOctreeHeader(cfg, fp)
-	if err != nil {
+	if cfg.DryRun {
+		est, err := estimateTree(cfg)
+		status.Estimate = est
 		return status, err
 	}
 
-	header.NumNodes++
-	var rootNode accNode
-	if err := binary.Write(fp, binary.LittleEndian, rootNode); err != nil {
+	fp, err := ioutil.TempFile("", "")
+	if err != nil {
 		return status, err
 	}
 
+	defer func() {
+		name := fp.Name()
+		fp.Close()
+		os.Remove(name)
+	}()
+
+	var (
+		header *OctreeHeader
+		leafs  *leafStats
+		levels *levelStats
+	)
 	for {
-		samp, more := <-channel
-		if more == false {
+		status.NumSamples, status.NumMerged = 0, 0
+		if leafs, err = newLeafStats(cfg); err != nil {
+			return status, err
+		}
+
+		levels = newLevelStats(cfg)
+		obs := newObserver(cfg)
+		header, err = sampleSource(cfg, fp, leafs, levels, obs, &status)
+		if err == nil && obs != nil {
+			cfg.SampleObserver.Merge(obs.SampleObserver)
+		}
+		if !errors.Is(err, ErrSourceChanged) || status.NumRestarts >= cfg.RestartOnChange {
 			break
 		}
 
-		if _, err := fp.Seek(int64(header.Size()), 0); err != nil {
+		if err := fp.Truncate(0); err != nil {
 			return status, err
 		}
-
-		if err := insertSample(cfg, header, fp, samp, cfg.Bounds, cfg.VoxelsPerAxis); err != nil {
+		if _, err := fp.Seek(0, 0); err != nil {
 			return status, err
 		}
+		status.NumRestarts++
+	}
+
+	if err != nil {
+		return status, err
 	}
 
-	if cbErr != nil {
-		return status, cbErr
+	// The levels are written to by the transcoder as well.
+	if levels != nil {
+		status.Levels = levels.levels
 	}
 
 	if _, err := fp.Seek(0, 0); err != nil {
 		return status, err
 	}
 
-	if err := binary.Write(fp, binary.LittleEndian, header); err != nil {
+	if err := EncodeHeader(fp, *header); err != nil {
 		return status, err
 	}
 
@@ -128,73 +423,292 @@ func BuildTree(cfg *BuildConfig) (BuildStatus, error) {
 		return status, err
 	}
 
+	var tree io.ReadSeeker = fp
+	if cfg.OutlierFilter.MinNeighbors > 0 {
+		filteredFp, err := ioutil.TempFile("", "")
+		if err != nil {
+			return status, err
+		}
+
+		defer func() {
+			name := filteredFp.Name()
+			filteredFp.Close()
+			os.Remove(name)
+		}()
+
+		status.NumOutliers, err = filterOutliers(tree, filteredFp, header, cfg.OutlierFilter)
+		if err != nil {
+			return status, err
+		}
+
+		if _, err := filteredFp.Seek(0, 0); err != nil {
+			return status, err
+		}
+		tree = filteredFp
+	}
+
+	if cfg.ColorVarianceThreshold > 0 {
+		collapsedFp, err := ioutil.TempFile("", "")
+		if err != nil {
+			return status, err
+		}
+
+		defer func() {
+			name := collapsedFp.Name()
+			collapsedFp.Close()
+			os.Remove(name)
+		}()
+
+		status.NumCollapsed, err = collapseTree(tree, collapsedFp, header, cfg.ColorVarianceThreshold)
+		if err != nil {
+			return status, err
+		}
+
+		if _, err := collapsedFp.Seek(0, 0); err != nil {
+			return status, err
+		}
+		tree = collapsedFp
+	}
+
+	// The sidecar is keyed by the node indices of the finished tree, so a copy of
+	// it is decoded once it is written.
+	var (
+		writer = cfg.Writer
+		output *os.File
+	)
+	if leafs != nil && memory == nil {
+		if output, err = ioutil.TempFile("", ""); err != nil {
+			return status, err
+		}
+
+		defer func() {
+			name := output.Name()
+			output.Close()
+			os.Remove(name)
+		}()
+		writer = io.MultiWriter(cfg.Writer, output)
+	}
+
+	var input io.Reader = tree
 	if cfg.Optimize == true {
-		status.Status, err = OptimizeTree(fp, cfg.Writer, cfg.Format, cfg.ColorThreshold, cfg.ColorFilter)
+		if !cfg.Format.Paletted() && !cfg.Format.Delta() && !cfg.Checksum && memory == nil {
+			if status.Status, err = OptimizeTree(tree, writer, cfg.Format, cfg.ColorThreshold, cfg.ColorFilter); err != nil {
+				return status, err
+			}
+			return status, leafs.writeSidecar(cfg, output)
+		}
+
+		// The optimizer can not write palette formats or checksums, optimize to
+		// a temporary file and transcode or decode that.
+		optFp, err := ioutil.TempFile("", "")
 		if err != nil {
 			return status, err
 		}
-	} else {
-		if err := TranscodeTree(fp, cfg.Writer, cfg.Format); err != nil {
+
+		defer func() {
+			name := optFp.Name()
+			optFp.Close()
+			os.Remove(name)
+		}()
+
+		status.Status, err = OptimizeTree(tree, optFp, MipR8G8B8A8UnpackUI64, cfg.ColorThreshold, cfg.ColorFilter)
+		if err != nil {
+			return status, err
+		}
+
+		if _, err := optFp.Seek(0, 0); err != nil {
 			return status, err
 		}
+		input = optFp
+	}
+
+	if memory != nil {
+		return status, decodeMemoryTree(cfg, input, memory, leafs)
+	}
+
+	status.Transcode, err = transcodeTree(input, writer, cfg.Format, cfg.Palette, &cfg.Checksum, levels, LoggerOrNop(cfg.Logger))
+	if err != nil {
+		return status, err
+	}
+
+	return status, leafs.writeSidecar(cfg, output)
+}
+
+// decodeMemoryTree decodes the nodes of the finished tree in reader into memory and
+// writes the sidecar of leafs, which is keyed by their indices.
+func decodeMemoryTree(cfg *BuildConfig, reader io.Reader, memory *FrameData, leafs *leafStats) error {
+	data, _, err := decodeTreePalette(bufio.NewReader(reader))
+	if err != nil {
+		return err
+	}
+
+	// Colors are rounded like by the format.
+	for i := range data.Colors {
+		b := data.Colors[i].bytes()
+		data.Colors[i] = Color{float32(b[0]) / 255, float32(b[1]) / 255, float32(b[2]) / 255, float32(b[3]) / 255}
+	}
+	data.Header.Format = MipR8G8B8A8UnpackUI64
+	data.Header.Flags &^= checksumMask | paletteMask
+	*memory = *data
+
+	if leafs == nil {
+		return nil
+	}
+	return WriteSidecar(cfg.Sidecar, leafs.leafRecords(data.Children), cfg.SidecarFormat)
+}
+
+// sampleSource writes the accumulation tree of all samples to fp.
+func sampleSource(cfg *BuildConfig, fp io.ReadWriteSeeker, leafs *leafStats, levels *levelStats, obs *observer, status *BuildStatus) (*OctreeHeader, error) {
+	watch := watchSources(cfg)
+	preview := newPreviewer(cfg)
+
+	header, err := writeOctreeHeader(cfg, fp)
+	if err != nil {
+		return nil, err
+	}
+
+	header.NumNodes++
+	var rootNode accNode
+	if err := binary.Write(fp, binary.LittleEndian, rootNode); err != nil {
+		return nil, err
+	}
+
+	if cfg.Cells != nil {
+		err = buildCells(cfg, fp, header, watch, preview, leafs, levels, obs, status)
+	} else {
+		err = sampleTree(cfg, fp, header, watch, preview, leafs, levels, obs, status)
 	}
 
-	return status, nil
+	if err == nil {
+		err = watch.check()
+	}
+	return header, err
+}
+
+func sampleTree(cfg *BuildConfig, fp io.ReadWriteSeeker, header *OctreeHeader, watch *sourceWatch, preview *previewer, leafs *leafStats, levels *levelStats, obs *observer, status *BuildStatus) error {
+	stream := workerStream(cfg)
+	defer stream.Close()
+	levels.cell(0)
+
+	dedup := newDedupGrid(cfg)
+	if dedup != nil {
+		defer func() { status.NumMerged += dedup.numMerged }()
+	}
+
+	for n := 1; ; n++ {
+		start := levels.start()
+		samp, more := stream.Pop()
+		levels.waited(0, start)
+		if more == false {
+			break
+		}
+
+		if n%generationPollInterval == 0 {
+			if err := watch.check(); err != nil {
+				return err
+			}
+			if err := preview.poll(fp, header); err != nil {
+				return err
+			}
+		}
+
+		if _, err := fp.Seek(int64(header.Size()), 0); err != nil {
+			return err
+		}
+
+		if err := dedup.insert(cfg, header, fp, samp, cfg.Bounds, cfg.VoxelsPerAxis, levels); err != nil {
+			return err
+		}
+		leafs.add(samp.Pos, stream.Source())
+		status.NumSamples++
+		obs.observe(samp)
+	}
+	return stream.Err()
 }
 
 func writeOctreeHeader(cfg *BuildConfig, writer io.Writer) (*OctreeHeader, error) {
-	var header OctreeHeader
-	header.Sign[0] = 0x1b
-	header.Sign[1] = 0x6f
-	header.Sign[2] = 0x63
-	header.Sign[3] = 0x74
-	header.Version = binaryVersion
-	header.Format = mipR64G64B64A64S64UnpackUI32
-	header.Unused = 0x0
-	header.NumNodes = 0
-	header.NumLeafs = 0
-	header.VoxelsPerAxis = uint32(cfg.VoxelsPerAxis)
-	return &header, binary.Write(writer, binary.LittleEndian, header)
-}
-
-func insertSample(cfg *BuildConfig, header *OctreeHeader, readWriter io.ReadWriteSeeker, sample Sample, bounds Box, voxelRes int) error {
+	header := NewOctreeHeader(mipR64G64B64A64S64UnpackUI64, cfg.VoxelsPerAxis)
+	header.Bounds = cfg.Bounds
+	header.Coordinates = cfg.Coordinates
+	header.GeoReference = cfg.GeoReference
+	if cfg.OccupancyAlpha {
+		header.Flags |= coverageMask
+	}
+	return &header, EncodeHeader(writer, header)
+}
+
+// sampleColor returns the color of sample, from the color source if there is one.
+func sampleColor(cfg *BuildConfig, sample Sample) Color {
+	if cfg.ColorSource != nil {
+		pos := cfg.Coordinates.FromTree(sample.Pos)
+		if color, ok := cfg.ColorSource.ColorAt(pos.X, pos.Y, pos.Z); ok {
+			return color
+		}
+	}
+	return sample.Col
+}
+
+// colorSums returns the sums a color adds to the nodes of an accumulation tree.
+func colorSums(color Color) [4]uint64 {
+	return [4]uint64{uint64(color.R * 255), uint64(color.G * 255), uint64(color.B * 255), uint64(color.A * 255)}
+}
+
+func insertSample(cfg *BuildConfig, header *OctreeHeader, readWriter io.ReadWriteSeeker, sample Sample, bounds Box, voxelRes int, levels *levelStats) error {
+	return accumulateSample(cfg, header, readWriter, sample.Pos, colorSums(sampleColor(cfg, sample)), 1, bounds, voxelRes, levels)
+}
+
+// accumulateSample adds color and count to the nodes from the current node of
+// readWriter down to the leaf of pos. Missing nodes are created.
+func accumulateSample(cfg *BuildConfig, header *OctreeHeader, readWriter io.ReadWriteSeeker, pos Point, color [4]uint64, count uint64, bounds Box, voxelRes int, levels *levelStats) error {
+	// Samples outside the tree only contribute to the color of the root.
+	inside := bounds.containsClosed(pos)
+
 	var node accNode
-	for {
+	for depth := levels.levelOf(voxelRes); ; depth++ {
+		start := levels.start()
 		if err := binary.Read(readWriter, binary.LittleEndian, &node); err != nil {
 			return err
 		}
 
-		if _, err := readWriter.Seek(int64(-mipR64G64B64A64S64UnpackUI32.NodeSize()), 1); err != nil {
+		if _, err := readWriter.Seek(int64(-mipR64G64B64A64S64UnpackUI64.NodeSize()), 1); err != nil {
 			return err
 		}
 
-		color := sample.Col
-		node.Color[0] += uint64(color.R * 255)
-		node.Color[1] += uint64(color.G * 255)
-		node.Color[2] += uint64(color.B * 255)
-		node.Color[3] += uint64(color.A * 255)
-		node.Color[4]++
+		for i, c := range color {
+			node.Color[i] += c
+		}
+		node.Color[4] += count
+
+		if cfg.OccupancyAlpha {
+			node.Color[3] = occupancy(&node, pos, bounds, voxelRes) * 255 * node.Color[4] / 8
+		}
 
 		if err := binary.Write(readWriter, binary.LittleEndian, node.Color); err != nil {
 			return err
 		}
 
 		if voxelRes == 1 {
-			header.NumLeafs++
+			header.NumLeafs += count
+			levels.accumulated(depth, count, start)
 			return nil
 		}
 
 		var (
 			childBounds Box
 			newVoxelRes = voxelRes
+			target      = -1
 		)
 
+		if inside {
+			target = childIndex(bounds, pos)
+		}
+
 		for i, child := range node.Children {
 			childBounds.Size = bounds.Size * 0.5
 			childOffset := childPositions[i].scale(childBounds.Size)
 			childBounds.Pos = bounds.Pos.add(&childOffset)
 
-			if childBounds.Intersect(sample.Pos) == true {
+			if i == target {
 				if child == 0 {
 					currentPos, err := readWriter.Seek(0, 1)
 					if err != nil {
@@ -210,7 +724,7 @@ func insertSample(cfg *BuildConfig, header *OctreeHeader, readWriter io.ReadWrit
 						return err
 					}
 
-					node.Children[i] = uint32((newPos - int64(header.Size())) / int64(mipR64G64B64A64S64UnpackUI32.NodeSize()))
+					node.Children[i] = NodeIndex((newPos - int64(header.Size())) / int64(mipR64G64B64A64S64UnpackUI64.NodeSize()))
 					if err := binary.Write(readWriter, binary.LittleEndian, node.Children); err != nil {
 						return err
 					}
@@ -225,11 +739,11 @@ func insertSample(cfg *BuildConfig, header *OctreeHeader, readWriter io.ReadWrit
 						return err
 					}
 
-					if _, err := readWriter.Seek(int64(-mipR64G64B64A64S64UnpackUI32.NodeSize()), 1); err != nil {
+					if _, err := readWriter.Seek(int64(-mipR64G64B64A64S64UnpackUI64.NodeSize()), 1); err != nil {
 						return err
 					}
 				} else {
-					if _, err := readWriter.Seek(int64(int(child)*mipR64G64B64A64S64UnpackUI32.NodeSize()+header.Size()), 0); err != nil {
+					if _, err := readWriter.Seek(int64(child)*int64(mipR64G64B64A64S64UnpackUI64.NodeSize())+int64(header.Size()), 0); err != nil {
 						return err
 					}
 				}
@@ -239,6 +753,7 @@ func insertSample(cfg *BuildConfig, header *OctreeHeader, readWriter io.ReadWrit
 			}
 		}
 
+		levels.accumulated(depth, count, start)
 		if newVoxelRes == voxelRes {
 			return nil
 		} else {
@@ -247,3 +762,20 @@ func insertSample(cfg *BuildConfig, header *OctreeHeader, readWriter io.ReadWrit
 		}
 	}
 }
+
+// occupancy returns the number of occupied children, out of eight, after sample is inserted.
+func occupancy(node *accNode, pos Point, bounds Box, voxelRes int) uint64 {
+	if voxelRes == 1 {
+		return 8
+	}
+
+	var num uint64
+	for i, child := range node.Children {
+		if child != 0 {
+			num++
+		} else if bounds.containsClosed(pos) && childIndex(bounds, pos) == i {
+			num++
+		}
+	}
+	return num
+}
@@ -19,7 +19,9 @@ package pack
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"math"
 	"os"
 	"testing"
 )
@@ -64,7 +66,17 @@ func TestBuildTree(t *testing.T) {
 	}
 
 	bounds := Box{Point{0, 0, 0}, 80}
-	cfg := BuildConfig{parser, outfile, bounds, 8, MipR8G8B8A8UnpackUI32, true, true, 0.25}
+	cfg := BuildConfig{
+		Worker:         parser,
+		Writer:         outfile,
+		Bounds:         bounds,
+		VoxelsPerAxis:  8,
+		Format:         MipR8G8B8A8UnpackUI32,
+		Optimize:       true,
+		ColorFilter:    true,
+		ColorThreshold: 0.25,
+		Coordinates:    YUpRightHanded,
+	}
 
 	status, err := BuildTree(&cfg)
 	if err != nil {
@@ -72,3 +84,384 @@ func TestBuildTree(t *testing.T) {
 	}
 	fmt.Println(status)
 }
+
+func TestOccupancyAlpha(t *testing.T) {
+	positions := []Point{{0.5, 0.5, 0.5}, {1.5, 0.5, 0.5}, {0.5, 1.5, 0.5}, {1.5, 1.5, 0.5}}
+	var samples []Sample
+	for _, p := range positions {
+		samples = append(samples, Sample{p, Color{1, 1, 1, 1}})
+	}
+
+	var buffer bytes.Buffer
+	cfg := BuildConfig{
+		Worker:         NewFakeWorker(samples),
+		Writer:         &buffer,
+		Bounds:         Box{Point{0, 0, 0}, 2},
+		VoxelsPerAxis:  2,
+		Format:         MipR8G8B8A8UnpackUI32,
+		OccupancyAlpha: true,
+	}
+
+	if _, err := BuildTree(&cfg); err != nil {
+		panic(err)
+	}
+
+	var (
+		header   OctreeHeader
+		color    Color
+		children [8]NodeIndex
+	)
+
+	if err := DecodeHeader(&buffer, &header); err != nil {
+		panic(err)
+	}
+
+	if !header.Coverage() {
+		t.Error("coverage flag is not set")
+	}
+
+	if err := DecodeNode(&buffer, header.Format, &color, children[:]); err != nil {
+		panic(err)
+	}
+
+	if a := color.A * 255; a < 127 || a > 128 {
+		t.Errorf("expected root alpha ~128, got %v", a)
+	}
+
+	if err := DecodeNode(&buffer, header.Format, &color, children[:]); err != nil {
+		panic(err)
+	}
+
+	if color.A != 1 {
+		t.Errorf("expected opaque leaf, got %v", color.A)
+	}
+}
+
+func TestColorVarianceThreshold(t *testing.T) {
+	const vpa = 8
+
+	// The lower half along x is red, the upper half a black and white checkerboard.
+	var samples []Sample
+	for z := 0; z < vpa; z++ {
+		for y := 0; y < vpa; y++ {
+			for x := 0; x < vpa; x++ {
+				c := Color{1, 0, 0, 1}
+				if x >= vpa/2 {
+					v := float32((x + y + z) % 2)
+					c = Color{v, v, v, 1}
+				}
+				samples = append(samples, Sample{Point{float64(x) + 0.5, float64(y) + 0.5, float64(z) + 0.5}, c})
+			}
+		}
+	}
+
+	for _, threshold := range []float32{0, 0.01} {
+		var buf bytes.Buffer
+		cfg := BuildConfig{
+			Worker:                 NewFakeWorker(samples),
+			Writer:                 &buf,
+			Bounds:                 Box{Point{0, 0, 0}, vpa},
+			VoxelsPerAxis:          vpa,
+			Format:                 MipR8G8B8A8UnpackUI32,
+			ColorVarianceThreshold: threshold,
+		}
+
+		status, err := BuildTree(&cfg)
+		if err != nil {
+			panic(err)
+		}
+
+		var header OctreeHeader
+		reader := bytes.NewReader(buf.Bytes())
+		if err := DecodeHeader(reader, &header); err != nil {
+			panic(err)
+		}
+
+		nodes := make(map[string]Color)
+		collectNodes(reader, &header, 0, "", nodes)
+
+		depths := make(map[string]int)
+		for path := range nodes {
+			if len(path) > 0 && len(path) > depths[path[:1]] {
+				depths[path[:1]] = len(path)
+			}
+		}
+
+		for _, octant := range "01234567" {
+			expected := 3
+			if threshold > 0 && octant%2 == 0 {
+				expected = 1
+			}
+
+			if d := depths[string(octant)]; d != expected {
+				t.Errorf("threshold %v: expected octant %c to end at depth %v, got %v", threshold, octant, expected, d)
+			}
+		}
+
+		if threshold > 0 {
+			if status.NumCollapsed != 4 {
+				t.Errorf("expected 4 collapsed nodes, got %v", status.NumCollapsed)
+			}
+
+			if c := nodes["0"]; c.R != 1 || c.G != 0 {
+				t.Errorf("expected collapsed node to be red, got %v", c)
+			}
+
+			if header.NumNodes != 1+8+4*8+4*64 {
+				t.Errorf("unexpected number of nodes: %v", header.NumNodes)
+			}
+		}
+	}
+}
+
+func TestOutlierFilter(t *testing.T) {
+	const vpa = 16
+
+	// A dense red cluster with three samples per voxel, three isolated white
+	// points and a pair of adjacent sparse red points that keep each other.
+	var samples []Sample
+	for z := 2; z < 6; z++ {
+		for y := 2; y < 6; y++ {
+			for x := 2; x < 6; x++ {
+				for i := 0; i < 3; i++ {
+					samples = append(samples, Sample{Point{float64(x) + 0.5, float64(y) + 0.5, float64(z) + 0.5}, Color{1, 0, 0, 1}})
+				}
+			}
+		}
+	}
+
+	isolated := []Point{{12.5, 12.5, 12.5}, {14.5, 2.5, 9.5}, {2.5, 13.5, 3.5}}
+	pair := []Point{{10.5, 4.5, 1.5}, {11.5, 5.5, 1.5}}
+	for _, p := range isolated {
+		samples = append(samples, Sample{p, Color{1, 1, 1, 1}})
+	}
+	for _, p := range pair {
+		samples = append(samples, Sample{p, Color{1, 0, 0, 1}})
+	}
+
+	for _, filter := range []OutlierFilter{{}, {MinNeighbors: 2}} {
+		var buf bytes.Buffer
+		cfg := BuildConfig{
+			Worker:        NewFakeWorker(samples),
+			Writer:        &buf,
+			Bounds:        Box{Point{0, 0, 0}, vpa},
+			VoxelsPerAxis: vpa,
+			Format:        MipR8G8B8A8UnpackUI32,
+			OutlierFilter: filter,
+		}
+
+		status, err := BuildTree(&cfg)
+		if err != nil {
+			panic(err)
+		}
+
+		var header OctreeHeader
+		reader := bytes.NewReader(buf.Bytes())
+		if err := DecodeHeader(reader, &header); err != nil {
+			panic(err)
+		}
+
+		nodes := make(map[string]Color)
+		collectNodes(reader, &header, 0, "", nodes)
+
+		leafs := make(map[Point]bool)
+		for path := range nodes {
+			if len(path) != 4 {
+				continue
+			}
+
+			var pos Point
+			for i, c := range path {
+				offset := childPositions[c-'0'].scale(float64(int(vpa) >> uint(i+1)))
+				pos = pos.add(&offset)
+			}
+			leafs[pos.add(&Point{0.5, 0.5, 0.5})] = true
+		}
+
+		expected := 64 + len(pair)
+		if filter.MinNeighbors == 0 {
+			expected += len(isolated)
+		}
+		if len(leafs) != expected {
+			t.Errorf("filter %v: expected %v leafs, got %v", filter, expected, len(leafs))
+		}
+
+		for _, p := range isolated {
+			if leafs[p] != (filter.MinNeighbors == 0) {
+				t.Errorf("filter %v: unexpected leaf at %v", filter, p)
+			}
+		}
+		for _, p := range pair {
+			if !leafs[p] {
+				t.Errorf("filter %v: missing leaf at %v", filter, p)
+			}
+		}
+
+		if filter.MinNeighbors > 0 {
+			if status.NumOutliers != 3 {
+				t.Errorf("expected 3 outliers, got %v", status.NumOutliers)
+			}
+
+			// Nodes without leafs are dropped along with them and the samples
+			// no longer contribute to the colors above.
+			for _, octant := range []string{"2", "5", "7"} {
+				if _, ok := nodes[octant]; ok {
+					t.Errorf("empty node %v was not dropped", octant)
+				}
+			}
+			if c := nodes[""]; c.G != 0 {
+				t.Errorf("expected the root to be red, got %v", c)
+			}
+		}
+	}
+}
+
+func TestDedupRadius(t *testing.T) {
+	var (
+		red   = Color{1, 0, 0, 1}
+		blue  = Color{0, 0, 1, 1}
+		green = Color{0, 1, 0, 1}
+	)
+
+	// The same red point twice in leaf 00, a red point twice and a blue point
+	// further away than the radius in leaf 10 and two green points within the
+	// radius but in different leafs.
+	samples := []Sample{
+		{Point{0.5, 0.5, 0.5}, red},
+		{Point{0.5, 0.5, 0.5}, red},
+		{Point{2.5, 0.5, 0.5}, red},
+		{Point{2.5, 0.5, 0.5}, red},
+		{Point{2.9, 0.5, 0.5}, blue},
+		{Point{1.95, 1.5, 1.5}, green},
+		{Point{2.02, 1.5, 1.5}, green},
+	}
+
+	bounds := Box{Point{0, 0, 0}, 4}
+	workers := map[string]func(cfg *BuildConfig){
+		"samples": func(cfg *BuildConfig) { cfg.Worker = NewFakeWorker(samples) },
+		"cells":   func(cfg *BuildConfig) { cfg.Cells = NewPointStoreWorker(bounds, samples) },
+	}
+
+	for name, setWorker := range workers {
+		for _, radius := range []float64{0, 0.1} {
+			var buf bytes.Buffer
+			cfg := BuildConfig{
+				Writer:        &buf,
+				Bounds:        bounds,
+				VoxelsPerAxis: 4,
+				Format:        MipR8G8B8A8UnpackUI32,
+				DedupRadius:   radius,
+			}
+			setWorker(&cfg)
+
+			status, err := BuildTree(&cfg)
+			if err != nil {
+				panic(err)
+			}
+
+			var header OctreeHeader
+			reader := bytes.NewReader(buf.Bytes())
+			if err := DecodeHeader(reader, &header); err != nil {
+				panic(err)
+			}
+
+			nodes := make(map[string]Color)
+			collectNodes(reader, &header, 0, "", nodes)
+
+			if c := nodes["00"]; c != red {
+				t.Errorf("%s, radius %v: expected the duplicated point to keep its color, got %v", name, radius, c)
+			}
+			_, first := nodes["07"]
+			_, second := nodes["16"]
+			if !first || !second {
+				t.Errorf("%s, radius %v: expected the green points in different leafs to both be kept", name, radius)
+			}
+
+			// Merged, the red points count once against the blue point.
+			expected := Color{170.0 / 255, 0, 85.0 / 255, 1}
+			merged := uint64(0)
+			if radius > 0 {
+				expected = Color{127.0 / 255, 0, 127.0 / 255, 1}
+				merged = 2
+			}
+			if c := nodes["10"]; c.dist(&expected) > 0.01 {
+				t.Errorf("%s, radius %v: expected %v in the mixed leaf, got %v", name, radius, expected, c)
+			}
+
+			if status.NumSamples != uint64(len(samples)) || status.NumMerged != merged {
+				t.Errorf("%s, radius %v: expected %v samples with %v merged, got %v with %v merged", name, radius, len(samples), merged, status.NumSamples, status.NumMerged)
+			}
+		}
+	}
+}
+
+func TestBuildBounds(t *testing.T) {
+	nan, inf := math.NaN(), math.Inf(1)
+	samples := []Sample{{Point{1, 2, 3}, Color{1, 0, 0, 1}}}
+
+	build := func(bounds Box, minExtent float64) (BuildStatus, OctreeHeader, error) {
+		var buf bytes.Buffer
+		cfg := BuildConfig{
+			Worker:        NewFakeWorker(samples),
+			Writer:        &buf,
+			Bounds:        bounds,
+			MinExtent:     minExtent,
+			VoxelsPerAxis: 4,
+			Format:        MipR8G8B8A8UnpackUI32,
+		}
+
+		var header OctreeHeader
+		status, err := BuildTree(&cfg)
+		if err == nil {
+			err = DecodeHeader(&buf, &header)
+		}
+		return status, header, err
+	}
+
+	invalid := []struct {
+		bounds    Box
+		minExtent float64
+		err       error
+	}{
+		{Box{Point{1, 2, 3}, -1}, 0, errInvertedBounds},
+		{Box{Point{nan, 2, 3}, 1}, 0, errNonFiniteBounds},
+		{Box{Point{1, 2, 3}, nan}, 0, errNonFiniteBounds},
+		{Box{Point{1, -inf, 3}, 1}, 0, errNonFiniteBounds},
+		{Box{Point{1, 2, 3}, inf}, 0, errNonFiniteBounds},
+		{Box{Point{1, 2, 3}, 0}, -1, errInvalidMinExtent},
+		{Box{Point{1, 2, 3}, 0}, nan, errInvalidMinExtent},
+	}
+
+	for _, c := range invalid {
+		if _, _, err := build(c.bounds, c.minExtent); err != c.err {
+			t.Errorf("bounds %v: expected %v, got %v", c.bounds, c.err, err)
+		}
+	}
+
+	// Bounds of size zero are grown around the samples, which are all kept.
+	for _, minExtent := range []float64{0, 2} {
+		status, header, err := build(Box{Point{1, 2, 3}, 0}, minExtent)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		size := minExtent
+		if size == 0 {
+			size = defaultMinExtent
+		}
+
+		half := size / 2
+		grown := Box{Point{1 - half, 2 - half, 3 - half}, size}
+		if !status.GrownBounds || status.Bounds != grown || header.Bounds != grown {
+			t.Errorf("expected bounds grown to %v, got %v and %v", grown, status.Bounds, header.Bounds)
+		}
+		if status.NumSamples != 1 || header.NumLeafs != 1 {
+			t.Errorf("expected the sample in a single leaf, got %d samples and %d leafs", status.NumSamples, header.NumLeafs)
+		}
+	}
+
+	status, _, err := build(Box{Point{0, 0, 0}, 4}, 0)
+	if err != nil || status.GrownBounds || status.Bounds.Size != 4 {
+		t.Error("expected the bounds to be kept:", status.Bounds, err)
+	}
+}
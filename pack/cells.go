@@ -0,0 +1,427 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cellCacheVersion is part of every cache key and must change with the layout of
+// the cached subtrees.
+const cellCacheVersion = 2
+
+// CellWorker produces the samples of a tree one cell at a time. The cells are the
+// nodes BuildConfig.CellLevel levels below the root.
+type CellWorker interface {
+	// Region returns a worker for the samples with positions inside cell.
+	Region(cell Box) BuildWorker
+}
+
+// BatchCellWorker is implemented by cell workers that send their samples in
+// batches. RegionBatches is used instead of Region.
+type BatchCellWorker interface {
+	RegionBatches(cell Box) BatchWorker
+}
+
+// CellHasher is implemented by cell workers that can fingerprint the source data
+// of a cell. Cells with a known fingerprint are restored from
+// BuildConfig.CellCacheDir instead of sampled again.
+type CellHasher interface {
+	CellHash(cell Box) ([]byte, bool)
+}
+
+type buildCell struct {
+	bounds Box
+	path   []int
+}
+
+func collectCells(bounds Box, level int, path []int, cells []buildCell) []buildCell {
+	if level == 0 {
+		return append(cells, buildCell{bounds, append([]int(nil), path...)})
+	}
+
+	for i := range childPositions {
+		cells = collectCells(childBox(bounds, i), level-1, append(path, i), cells)
+	}
+	return cells
+}
+
+// CellOf returns the node level levels below a tree with bounds that a sample at
+// pos is inserted into. False is returned if the sample is not part of the tree.
+func CellOf(bounds Box, level int, pos Point) (Box, bool) {
+	if !bounds.containsClosed(pos) {
+		return bounds, false
+	}
+
+	for ; level > 0; level-- {
+		bounds = childBox(bounds, childIndex(bounds, pos))
+	}
+	return bounds, true
+}
+
+// CellContains reports if a sample at pos belongs to cell, a node of a tree with
+// bounds. Nodes are half-open like Box.ContainsPoint, except that samples on the
+// max faces of bounds belong to the nodes touching them. Every sample inside
+// bounds belongs to exactly one node of every level. Cell workers may emit samples
+// outside their cell, the builder skips them, but should use this rule to not
+// miss any.
+func CellContains(bounds, cell Box, pos Point) bool {
+	if cell.Size <= 0 || bounds.Size < cell.Size {
+		return false
+	}
+
+	b, ok := CellOf(bounds, cellLevel(bounds, cell), pos)
+	return ok && b == cell
+}
+
+func cellLevel(bounds, cell Box) int {
+	return int(math.Round(math.Log2(bounds.Size / cell.Size)))
+}
+
+// isNode reports if cell is one of the nodes of a tree with bounds.
+func isNode(bounds, cell Box) bool {
+	if cell.Size <= 0 || bounds.Size < cell.Size {
+		return false
+	}
+
+	half := cell.Size * 0.5
+	center := Point{cell.Pos.X + half, cell.Pos.Y + half, cell.Pos.Z + half}
+	b, ok := CellOf(bounds, cellLevel(bounds, cell), center)
+	return ok && b == cell
+}
+
+func buildCells(cfg *BuildConfig, fp io.ReadWriteSeeker, header *OctreeHeader, watch *sourceWatch, preview *previewer, leafs *leafStats, levels *levelStats, obs *observer, status *BuildStatus) error {
+	level := cfg.CellLevel
+	if level <= 0 {
+		level = 1
+	}
+
+	cellVoxels := cfg.VoxelsPerAxis >> uint(level)
+	if cellVoxels == 0 {
+		return errInvalidCellLevel
+	}
+
+	logger := LoggerOrNop(cfg.Logger)
+	hasher, _ := cfg.Cells.(CellHasher)
+	cells := collectCells(cfg.Bounds, level, nil, nil)
+	for i, cell := range cells {
+		if err := watch.check(); err != nil {
+			return err
+		}
+		if err := preview.poll(fp, header); err != nil {
+			return err
+		}
+
+		var key string
+		if hasher != nil && cfg.CellCacheDir != "" {
+			if hash, ok := hasher.CellHash(cfg.Coordinates.sourceRegion(cell.bounds)); ok {
+				key = cellCacheKey(cfg, cell.bounds, cellVoxels, hash)
+			}
+		}
+
+		if key != "" {
+			if cached, err := os.Open(filepath.Join(cfg.CellCacheDir, key)); err == nil {
+				var cellHeader OctreeHeader
+				err := DecodeHeader(cached, &cellHeader)
+				if err == nil && cellHeader.Format == mipR64G64B64A64S64UnpackUI64 && int(cellHeader.VoxelsPerAxis) == cellVoxels {
+					err = spliceCell(fp, header, cell.path, cached, &cellHeader)
+					cached.Close()
+					if err != nil {
+						return err
+					}
+					logger.Debugf("cell %d of %d at %v restored from the cache", i+1, len(cells), cell.bounds)
+					continue
+				}
+				cached.Close()
+			}
+		}
+
+		cellFp, err := ioutil.TempFile("", "")
+		if err != nil {
+			return err
+		}
+
+		logger.Debugf("cell %d of %d at %v started", i+1, len(cells), cell.bounds)
+		start, numSamples := time.Now(), status.NumSamples
+
+		cellObs := obs.fork()
+		err = sampleCell(cfg, cellFp, cell, cellVoxels, key, watch, leafs, levels, cellObs, status)
+		if err == nil {
+			obs.merge(cellObs)
+			var cellHeader OctreeHeader
+			if _, err = cellFp.Seek(0, 0); err == nil {
+				if err = DecodeHeader(cellFp, &cellHeader); err == nil {
+					err = spliceCell(fp, header, cell.path, cellFp, &cellHeader)
+				}
+			}
+		}
+
+		name := cellFp.Name()
+		cellFp.Close()
+		os.Remove(name)
+
+		if err != nil {
+			return err
+		}
+		logger.Debugf("cell %d of %d finished, %d samples in %v", i+1, len(cells), status.NumSamples-numSamples, time.Since(start))
+	}
+	return nil
+}
+
+func cellCacheKey(cfg *BuildConfig, cell Box, cellVoxels int, hash []byte) string {
+	h := sha1.New()
+	binary.Write(h, binary.LittleEndian, [...]uint64{
+		cellCacheVersion,
+		math.Float64bits(cell.Pos.X),
+		math.Float64bits(cell.Pos.Y),
+		math.Float64bits(cell.Pos.Z),
+		math.Float64bits(cell.Size),
+		uint64(cellVoxels),
+	})
+
+	if cfg.OccupancyAlpha {
+		h.Write([]byte{1})
+	} else {
+		h.Write([]byte{0})
+	}
+
+	// Keys of builds without deduplication are unchanged.
+	if cfg.DedupRadius > 0 {
+		binary.Write(h, binary.LittleEndian, math.Float64bits(cfg.DedupRadius))
+	}
+
+	h.Write(hash)
+	return hex.EncodeToString(h.Sum(nil)) + ".cell"
+}
+
+// sampleCell builds the accumulation tree of a single cell in fp. If key is set
+// the finished tree is also stored in the cache.
+func sampleCell(cfg *BuildConfig, fp *os.File, cell buildCell, cellVoxels int, key string, watch *sourceWatch, leafs *leafStats, levels *levelStats, obs *observer, status *BuildStatus) error {
+	stream := cellStream(cfg, cell.bounds)
+	defer stream.Close()
+	levels.cell(len(cell.path))
+
+	dedup := newDedupGrid(cfg)
+	if dedup != nil {
+		defer func() { status.NumMerged += dedup.numMerged }()
+	}
+
+	header, err := writeOctreeHeader(&BuildConfig{VoxelsPerAxis: cellVoxels, OccupancyAlpha: cfg.OccupancyAlpha}, fp)
+	if err != nil {
+		return err
+	}
+
+	header.NumNodes++
+	var rootNode accNode
+	if err := binary.Write(fp, binary.LittleEndian, rootNode); err != nil {
+		return err
+	}
+
+	for n := 1; ; n++ {
+		start := levels.start()
+		samp, more := stream.Pop()
+		levels.waited(len(cell.path), start)
+		if more == false {
+			break
+		}
+
+		if n%generationPollInterval == 0 {
+			if err := watch.check(); err != nil {
+				return err
+			}
+		}
+
+		if b, ok := CellOf(cfg.Bounds, len(cell.path), samp.Pos); !ok || b != cell.bounds {
+			continue
+		}
+
+		if _, err := fp.Seek(int64(header.Size()), 0); err != nil {
+			return err
+		}
+
+		if err := dedup.insert(cfg, header, fp, samp, cell.bounds, cellVoxels, levels); err != nil {
+			return err
+		}
+		leafs.add(samp.Pos, stream.Source())
+		status.NumSamples++
+		obs.observe(samp)
+	}
+
+	if err := stream.Err(); err != nil {
+		return err
+	}
+
+	if _, err := fp.Seek(0, 0); err != nil {
+		return err
+	}
+
+	if err := EncodeHeader(fp, *header); err != nil {
+		return err
+	}
+
+	// A cell sampled while its source changed must not be cached.
+	if err := watch.check(); err != nil {
+		return err
+	}
+
+	if key == "" {
+		return nil
+	}
+	return storeCell(cfg.CellCacheDir, key, fp)
+}
+
+// storeCell copies a cell tree to the cache. The entry is renamed into place so
+// an interrupted build never leaves a partial entry behind.
+func storeCell(dir, key string, fp *os.File) error {
+	if _, err := fp.Seek(0, 0); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tmp, fp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(dir, key))
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// spliceCell appends the nodes of a cell tree to the tree in fp, with the child
+// offsets rewritten, and accumulates the cell into the nodes on path.
+func spliceCell(fp io.ReadWriteSeeker, header *OctreeHeader, path []int, cell io.ReadSeeker, cellHeader *OctreeHeader) error {
+	nodeSize := int64(mipR64G64B64A64S64UnpackUI64.NodeSize())
+	nodeOffset := func(index NodeIndex) int64 {
+		return int64(header.Size()) + int64(index)*nodeSize
+	}
+
+	var cellRoot accNode
+	if err := binary.Read(cell, binary.LittleEndian, &cellRoot); err != nil {
+		return err
+	}
+
+	// Cells without samples are left out of the tree.
+	if cellRoot.Color[4] == 0 {
+		return nil
+	}
+
+	var (
+		node  accNode
+		index NodeIndex
+	)
+
+	for depth, i := range path {
+		if _, err := fp.Seek(nodeOffset(index), 0); err != nil {
+			return err
+		}
+
+		if err := binary.Read(fp, binary.LittleEndian, &node); err != nil {
+			return err
+		}
+
+		// The cell is appended after the last ancestor is created.
+		child := node.Children[i]
+		if child == 0 {
+			child = NodeIndex(header.NumNodes)
+			node.Children[i] = child
+			header.NumNodes++
+
+			if depth < len(path)-1 {
+				if _, err := fp.Seek(0, 2); err != nil {
+					return err
+				}
+
+				var newNode accNode
+				if err := binary.Write(fp, binary.LittleEndian, newNode); err != nil {
+					return err
+				}
+			}
+		}
+
+		for c := range node.Color {
+			node.Color[c] += cellRoot.Color[c]
+		}
+
+		if header.Coverage() {
+			var num uint64
+			for _, c := range node.Children {
+				if c != 0 {
+					num++
+				}
+			}
+			node.Color[3] = num * 255 * node.Color[4] / 8
+		}
+
+		if _, err := fp.Seek(nodeOffset(index), 0); err != nil {
+			return err
+		}
+
+		if err := binary.Write(fp, binary.LittleEndian, node); err != nil {
+			return err
+		}
+		index = child
+	}
+
+	if _, err := cell.Seek(int64(cellHeader.Size()), 0); err != nil {
+		return err
+	}
+
+	if _, err := fp.Seek(0, 2); err != nil {
+		return err
+	}
+
+	// Cell nodes are numbered from its root, which is now at index.
+	base := index
+	for n := uint64(0); n < cellHeader.NumNodes; n++ {
+		if err := binary.Read(cell, binary.LittleEndian, &node); err != nil {
+			return err
+		}
+
+		for i, c := range node.Children {
+			if c != 0 {
+				node.Children[i] = c + base
+			}
+		}
+
+		if err := binary.Write(fp, binary.LittleEndian, node); err != nil {
+			return err
+		}
+	}
+
+	header.NumNodes += cellHeader.NumNodes - 1
+	header.NumLeafs += cellHeader.NumLeafs
+	return nil
+}
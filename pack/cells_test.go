@@ -0,0 +1,229 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type hashedCells struct {
+	*HeightmapWorker
+	colors  *image.RGBA
+	regions []Box
+}
+
+func newHashedCells() *hashedCells {
+	heights := image.NewGray16(image.Rect(0, 0, 8, 8))
+	colors := image.NewRGBA(heights.Bounds())
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			heights.SetGray16(x, y, color.Gray16{uint16((x + y) * 0xffff / 14)})
+			colors.SetRGBA(x, y, color.RGBA{uint8(x * 32), uint8(y * 32), 128, 255})
+		}
+	}
+	return &hashedCells{HeightmapWorker: NewHeightmapWorker(heights, colors, 7), colors: colors}
+}
+
+func (w *hashedCells) Region(cell Box) BuildWorker {
+	w.regions = append(w.regions, cell)
+	return w.HeightmapWorker.Region(cell)
+}
+
+// CellHash fingerprints the columns that reach into the cell.
+func (w *hashedCells) CellHash(cell Box) ([]byte, bool) {
+	h := sha1.New()
+	for z := int(cell.Pos.Z); z < int(cell.Pos.Z+cell.Size); z++ {
+		for x := int(cell.Pos.X); x < int(cell.Pos.X+cell.Size); x++ {
+			if l := w.level(x, z); l >= int(cell.Pos.Y) {
+				fmt.Fprint(h, x, z, l, w.colors.RGBAAt(x, z))
+			}
+		}
+	}
+	return h.Sum(nil), true
+}
+
+func collectNodes(reader io.ReadSeeker, header *OctreeHeader, index NodeIndex, path string, nodes map[string]Color) {
+	var (
+		color    Color
+		children [8]NodeIndex
+	)
+
+	if err := readNodeAt(reader, header, index, &color, children[:]); err != nil {
+		panic(err)
+	}
+
+	nodes[path] = color
+	for i, child := range children {
+		if child != 0 {
+			collectNodes(reader, header, child, path+string('0'+rune(i)), nodes)
+		}
+	}
+}
+
+func buildCellTest(cfg BuildConfig) (OctreeHeader, map[string]Color) {
+	var buf bytes.Buffer
+	cfg.Writer = &buf
+	cfg.VoxelsPerAxis = 8
+	cfg.Format = MipR8G8B8A8UnpackUI32
+
+	if _, err := BuildTree(&cfg); err != nil {
+		panic(err)
+	}
+
+	var header OctreeHeader
+	reader := bytes.NewReader(buf.Bytes())
+	if err := DecodeHeader(reader, &header); err != nil {
+		panic(err)
+	}
+
+	nodes := make(map[string]Color)
+	collectNodes(reader, &header, 0, "", nodes)
+	return header, nodes
+}
+
+func TestCellCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, occupancy := range []bool{false, true} {
+		worker := newHashedCells()
+		bounds := worker.Bounds()
+		cfg := BuildConfig{Cells: worker, CellCacheDir: dir, Bounds: bounds, OccupancyAlpha: occupancy}
+
+		buildCellTest(cfg)
+		if len(worker.regions) != 8 {
+			t.Fatalf("expected all 8 cells to be sampled, got %v", len(worker.regions))
+		}
+
+		worker.regions = nil
+		buildCellTest(cfg)
+		if len(worker.regions) != 0 {
+			t.Fatalf("expected all cells to be cached, got %v", worker.regions)
+		}
+
+		worker.colors.SetRGBA(1, 2, color.RGBA{255, 0, 0, 255})
+		worker.regions = nil
+		header, nodes := buildCellTest(cfg)
+
+		expected := Box{Point{0, 0, 0}, 4}
+		if len(worker.regions) != 1 || worker.regions[0] != expected {
+			t.Fatalf("expected only cell %v to be sampled, got %v", expected, worker.regions)
+		}
+
+		fullHeader, fullNodes := buildCellTest(BuildConfig{Worker: worker.Work, Bounds: bounds, OccupancyAlpha: occupancy})
+		if header.NumNodes != fullHeader.NumNodes || header.NumLeafs != fullHeader.NumLeafs {
+			t.Errorf("expected %v nodes and %v leafs, got %v and %v", fullHeader.NumNodes, fullHeader.NumLeafs, header.NumNodes, header.NumLeafs)
+		}
+
+		if len(nodes) != len(fullNodes) {
+			t.Fatalf("expected %v reachable nodes, got %v", len(fullNodes), len(nodes))
+		}
+
+		for path, c := range fullNodes {
+			if cc, ok := nodes[path]; !ok || cc != c {
+				t.Errorf("node %q differs: %v != %v", path, cc, c)
+			}
+		}
+	}
+}
+
+func TestCellBoundaries(t *testing.T) {
+	bounds := Box{Point{0, 0, 0}, 4}
+	faces := map[Point]string{
+		{1, 0.5, 0.5}: "01",
+		{2, 2, 2}:     "70",
+		{0.5, 3, 0.5}: "22",
+		{4, 0.5, 0.5}: "11",
+		{4, 4, 4}:     "77",
+	}
+
+	var samples []Sample
+	for pos := range faces {
+		samples = append(samples, Sample{pos, Color{1, 1, 1, 1}})
+	}
+
+	store := NewPointStoreWorker(bounds, samples)
+	configs := map[string]BuildConfig{
+		"worker": {Worker: NewFakeWorker(samples)},
+		"cells":  {Cells: store, CellLevel: 1},
+	}
+
+	for name, cfg := range configs {
+		var buf bytes.Buffer
+		cfg.Writer = &buf
+		cfg.Bounds = bounds
+		cfg.VoxelsPerAxis = 4
+		cfg.Format = MipR8G8B8A8UnpackUI32
+
+		if _, err := BuildTree(&cfg); err != nil {
+			panic(err)
+		}
+
+		var header OctreeHeader
+		reader := bytes.NewReader(buf.Bytes())
+		if err := DecodeHeader(reader, &header); err != nil {
+			panic(err)
+		}
+
+		if header.NumLeafs != uint64(len(samples)) {
+			t.Errorf("%v: expected %v leaf samples, got %v", name, len(samples), header.NumLeafs)
+		}
+
+		nodes := make(map[string]Color)
+		collectNodes(reader, &header, 0, "", nodes)
+
+		leafs := 0
+		for path := range nodes {
+			if len(path) == 2 {
+				leafs++
+			}
+		}
+
+		if leafs != len(faces) {
+			t.Errorf("%v: expected %v leafs, got %v", name, len(faces), leafs)
+		}
+
+		for pos, path := range faces {
+			if _, ok := nodes[path]; !ok {
+				t.Errorf("%v: sample at %v is not in leaf %q", name, pos, path)
+			}
+
+			cell, _ := CellOf(bounds, 1, pos)
+			for i := 0; i < 8; i++ {
+				if other := childBox(bounds, i); other != cell && CellContains(bounds, other, pos) {
+					t.Errorf("%v: sample at %v belongs to %v and %v", name, pos, cell, other)
+				}
+			}
+		}
+	}
+
+	if p := (Point{2, 2, 2}); !(Box{Point{2, 2, 2}, 2}).ContainsPoint(p) || (Box{Point{0, 0, 0}, 2}).ContainsPoint(p) {
+		t.Error("expected boxes to include the min faces and exclude the max faces")
+	}
+}
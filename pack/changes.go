@@ -0,0 +1,111 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bufio"
+	"io"
+)
+
+// ChangeConfig controls how MarkChanges assigns epochs.
+type ChangeConfig struct {
+	// OldRecords are the sidecar records of the old tree, for the epochs of its
+	// leafs. Leafs without a record are from epoch zero.
+	OldRecords map[NodeIndex]LeafRecord
+
+	// Epoch is given to the leafs that first appear in the new tree.
+	Epoch uint16
+
+	// Threshold is the color distance, like for DiffTrees, above which a leaf at
+	// the same position counts as new.
+	Threshold float32
+
+	// Tombstone, if set, keeps the leafs removed in the new tree in this color.
+	// They have no record.
+	Tombstone *Color
+}
+
+// MarkChanges writes the leafs of newTree to out, as a MipR8G8B8A8UnpackUI32
+// tree, and returns their records keyed by the nodes of out. Trees are compared
+// by the position of their leafs, like DiffTrees. Leafs that are also in oldTree
+// keep their epoch, leafs that are new or recolored get cfg.Epoch. Only the
+// epochs of the records are set, write them with WriteSidecar to mark the
+// changes of the next scan against out.
+func MarkChanges(oldTree, newTree io.ReadSeeker, out io.WriteSeeker, cfg *ChangeConfig) (map[NodeIndex]LeafRecord, error) {
+	var trees [2]*FrameData
+	for i, tree := range []io.ReadSeeker{oldTree, newTree} {
+		if _, err := tree.Seek(0, 0); err != nil {
+			return nil, err
+		}
+
+		data, err := decodeTree(bufio.NewReader(tree))
+		if err != nil {
+			return nil, err
+		}
+		trees[i] = data
+	}
+
+	var (
+		levels    [][2]uint64
+		oldColors = make(map[meshCell]Color)
+		oldEpochs = make(map[meshCell]uint16)
+	)
+	err := trees[0].walkLeafs(&levels, 0, func(cell meshCell, index NodeIndex) {
+		oldColors[cell] = trees[0].Colors[index]
+		oldEpochs[cell] = cfg.OldRecords[index].Epoch
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	colors, err := trees[1].leafs(&levels, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	epochs := make(map[meshCell]uint16, len(colors))
+	for cell, col := range colors {
+		epochs[cell] = cfg.Epoch
+		if old, ok := oldColors[cell]; ok && old.dist(&col) <= cfg.Threshold {
+			epochs[cell] = oldEpochs[cell]
+		}
+	}
+
+	if cfg.Tombstone != nil {
+		for cell := range oldColors {
+			if _, ok := colors[cell]; !ok {
+				colors[cell] = *cfg.Tombstone
+			}
+		}
+	}
+
+	data, nodes := cellTree(trees[1].Header, trees[0].Header, colors)
+	w := bufio.NewWriter(out)
+	if err := data.encode(w); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	records := make(map[NodeIndex]LeafRecord, len(epochs))
+	for cell, epoch := range epochs {
+		records[nodes[cell]] = LeafRecord{Epoch: epoch}
+	}
+	return records, nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMarkChanges(t *testing.T) {
+	gray := Color{0.5, 0.5, 0.5, 1}
+	header := NewOctreeHeader(MipR8G8B8A8UnpackUI32, 2)
+
+	// Leafs 1 and 2 of the first scan are from epochs 3 and 4.
+	first := encodeFrameData(&FrameData{
+		Header:   header,
+		Colors:   []Color{gray, gray, gray, gray},
+		Children: [][8]NodeIndex{{1, 2, 3}, {}, {}, {}},
+	})
+	records := map[NodeIndex]LeafRecord{1: {Epoch: 3}, 2: {Epoch: 4}}
+
+	// The second scan recolors the leaf at x 1, removes the one at y 1 and adds
+	// one at z 1.
+	second := encodeFrameData(&FrameData{
+		Header:   header,
+		Colors:   []Color{gray, gray, {0, 0, 1, 1}, gray},
+		Children: [][8]NodeIndex{{1, 2, 0, 0, 3}, {}, {}, {}},
+	})
+
+	tombstone := Color{1, 0, 0, 1}
+	for _, keep := range []bool{false, true} {
+		cfg := ChangeConfig{OldRecords: records, Epoch: 5, Threshold: 0.01}
+		if keep {
+			cfg.Tombstone = &tombstone
+		}
+
+		out, err := ioutil.TempFile("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			out.Close()
+			os.Remove(out.Name())
+		}()
+
+		marked, err := MarkChanges(bytes.NewReader(first), bytes.NewReader(second), out, &cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out.Seek(0, 0)
+		data, err := decodeTree(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[int]uint16{0: 3, 1: 5, 4: 5}
+		epochs := make(map[int]uint16)
+		var tombstones []int
+		for i, child := range data.Children[0] {
+			if child == 0 {
+				continue
+			}
+			if rec, ok := marked[child]; ok {
+				epochs[i] = rec.Epoch
+			} else if data.Colors[child] == tombstone {
+				tombstones = append(tombstones, i)
+			}
+		}
+
+		if len(epochs) != len(expected) || len(marked) != len(expected) {
+			t.Errorf("expected %v, got %v", expected, epochs)
+		}
+		for i, epoch := range expected {
+			if epochs[i] != epoch {
+				t.Errorf("leaf %d: expected epoch %d, got %d", i, epoch, epochs[i])
+			}
+		}
+
+		if keep && (len(tombstones) != 1 || tombstones[0] != 2) {
+			t.Errorf("expected a tombstone at y 1, got %v", tombstones)
+		} else if !keep && (len(tombstones) != 0 || data.Header.NumLeafs != 3) {
+			t.Errorf("removed leafs should be dropped, got %d leafs", data.Header.NumLeafs)
+		}
+	}
+}
+
+func TestSidecarEpochs(t *testing.T) {
+	for _, format := range []SidecarFormat{SidecarBinary, SidecarText} {
+		var tree, sidecar bytes.Buffer
+		cfg := BuildConfig{
+			Worker:        halfWorker(0, 1),
+			Writer:        &tree,
+			Bounds:        Box{Point{0, 0, 0}, 8},
+			VoxelsPerAxis: 8,
+			Format:        MipR8G8B8A8UnpackUI32,
+			Sidecar:       &sidecar,
+			SidecarFormat: format,
+			Epoch:         7,
+		}
+		if _, err := BuildTree(&cfg); err != nil {
+			t.Fatal(err)
+		}
+
+		records, err := ReadSidecar(&sidecar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 4*8*8 {
+			t.Errorf("expected a record per voxel, got %d", len(records))
+		}
+		for node, rec := range records {
+			if rec.Epoch != 7 || rec.Samples != 1 {
+				t.Fatalf("leaf %d: unexpected record %+v", node, rec)
+			}
+		}
+	}
+
+	// Sidecars written before epochs are still read.
+	for _, old := range []string{sidecarMagicV1 + "\x01\x02\x01", sidecarTextHeaderV1 + "\n1,2,1\n"} {
+		records, err := ReadSidecar(bytes.NewReader([]byte(old)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec := records[1]; rec != (LeafRecord{Samples: 2, Sources: 1}) {
+			t.Errorf("unexpected record %+v", rec)
+		}
+	}
+}
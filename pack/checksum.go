@@ -0,0 +1,184 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package pack
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// ChecksumBlockSize is the number of node bytes covered by each block checksum.
+const ChecksumBlockSize = 1 << 20
+
+// ErrChecksumMismatch is returned when the nodes of a tree do not match its
+// checksums. Offset and Size are the byte range of the first damaged block,
+// counted from the first node byte. For compressed trees they refer to the
+// uncompressed nodes. The tree is corrupt, errors.As finds an ErrCorrupt at
+// Offset.
+type ErrChecksumMismatch struct {
+	Offset, Size int64
+}
+
+func (e *ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf("checksum mismatch in node bytes %d to %d", e.Offset, e.Offset+e.Size)
+}
+
+func (e *ErrChecksumMismatch) Unwrap() error {
+	return &ErrCorrupt{Offset: e.Offset, Reason: "checksum mismatch"}
+}
+
+// checksums holds the CRC32 of all bytes and of every ChecksumBlockSize bytes.
+type checksums struct {
+	total  hash.Hash32
+	block  hash.Hash32
+	fill   int
+	blocks []uint32
+}
+
+func newChecksums() checksums {
+	return checksums{total: crc32.NewIEEE(), block: crc32.NewIEEE()}
+}
+
+func (c *checksums) sum(p []byte) {
+	c.total.Write(p)
+	for len(p) > 0 {
+		n := ChecksumBlockSize - c.fill
+		if n > len(p) {
+			n = len(p)
+		}
+
+		c.block.Write(p[:n])
+		c.fill += n
+		p = p[n:]
+
+		if c.fill == ChecksumBlockSize {
+			c.blocks = append(c.blocks, c.block.Sum32())
+			c.block.Reset()
+			c.fill = 0
+		}
+	}
+}
+
+// blockSums returns the checksums of all blocks, the last one may be partial.
+func (c *checksums) blockSums() []uint32 {
+	if c.fill > 0 {
+		return append(c.blocks, c.block.Sum32())
+	}
+	return c.blocks
+}
+
+// ChecksumWriter computes the checksums of the nodes written through it. The
+// trailer, a CRC32 for every ChecksumBlockSize bytes followed by a CRC32 of all
+// bytes, is written to the same writer by WriteTrailer after the last node.
+type ChecksumWriter struct {
+	writer io.Writer
+	sums   checksums
+}
+
+func NewChecksumWriter(writer io.Writer) *ChecksumWriter {
+	return &ChecksumWriter{writer, newChecksums()}
+}
+
+func (w *ChecksumWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.sums.sum(p[:n])
+	return n, err
+}
+
+// WriteTrailer writes the checksums of all bytes written so far.
+func (w *ChecksumWriter) WriteTrailer() error {
+	trailer := append(w.sums.blockSums(), w.sums.total.Sum32())
+	return binary.Write(w.writer, binary.LittleEndian, trailer)
+}
+
+// ChecksumReader computes the checksums of the nodes read through it, to be
+// compared with the trailer by ReadTrailer.
+type ChecksumReader struct {
+	reader io.Reader
+	sums   checksums
+	offset int64
+	verify bool
+}
+
+// NewChecksumReader returns a reader that checksums the nodes read from reader. If
+// verify is false the bytes are only counted, so the trailer can be skipped.
+func NewChecksumReader(reader io.Reader, verify bool) *ChecksumReader {
+	r := &ChecksumReader{reader: reader, verify: verify}
+	if verify {
+		r.sums = newChecksums()
+	}
+	return r
+}
+
+func (r *ChecksumReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.offset += int64(n)
+	if r.verify {
+		r.sums.sum(p[:n])
+	}
+	return n, err
+}
+
+// ReadTrailer reads the trailer that follows the last node and compares it with
+// the bytes read so far. ErrChecksumMismatch is returned for the first block that
+// differs.
+func (r *ChecksumReader) ReadTrailer() error {
+	numBlocks := (r.offset + ChecksumBlockSize - 1) / ChecksumBlockSize
+	trailer := make([]uint32, numBlocks+1)
+	if err := binary.Read(r.reader, binary.LittleEndian, trailer); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	if !r.verify {
+		return nil
+	}
+
+	for i, sum := range r.sums.blockSums() {
+		if sum != trailer[i] {
+			offset := int64(i) * ChecksumBlockSize
+			size := r.offset - offset
+			if size > ChecksumBlockSize {
+				size = ChecksumBlockSize
+			}
+			return &ErrChecksumMismatch{offset, size}
+		}
+	}
+
+	if r.sums.total.Sum32() != trailer[numBlocks] {
+		return &ErrChecksumMismatch{0, r.offset}
+	}
+	return nil
+}
+
+// ValidateTree reads a whole tree and verifies its checksums. Trees without
+// checksums are only checked to be complete. The reader is buffered, so it is not
+// left at the end of the tree.
+func ValidateTree(reader io.Reader) error {
+	var header OctreeHeader
+	buffered := bufio.NewReader(reader)
+	if err := DecodeHeader(buffered, &header); err != nil {
+		return err
+	}
+	return SkipTree(buffered, &header)
+}
@@ -0,0 +1,136 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package pack
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChecksumBlocks(t *testing.T) {
+	header := NewOctreeHeader(MipR8G8B8A8UnpackUI32, 1)
+	header.NumNodes = 40000
+	header.Flags |= checksumMask
+
+	var buf bytes.Buffer
+	if err := EncodeHeader(&buf, header); err != nil {
+		panic(err)
+	}
+
+	writer := NewChecksumWriter(&buf)
+	for i := uint64(0); i < header.NumNodes; i++ {
+		c := Color{float32(i%256) / 255, 0, 0, 1}
+		if err := EncodeNode(writer, header.Format, c, make([]NodeIndex, 8)); err != nil {
+			panic(err)
+		}
+	}
+	if err := writer.WriteTrailer(); err != nil {
+		panic(err)
+	}
+
+	data := buf.Bytes()
+	if err := ValidateTree(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	start := int64(header.Size())
+	numBytes := int64(header.NumNodes) * int64(header.Format.NodeSize())
+
+	for _, offset := range []int64{10, ChecksumBlockSize + 10} {
+		damaged := append([]byte(nil), data...)
+		damaged[start+offset] ^= 1
+
+		blockStart := offset / ChecksumBlockSize * ChecksumBlockSize
+		expected := ErrChecksumMismatch{blockStart, ChecksumBlockSize}
+		if blockStart > 0 {
+			expected.Size = numBytes - blockStart
+		}
+
+		err := ValidateTree(bytes.NewReader(damaged))
+		if e, ok := err.(*ErrChecksumMismatch); !ok || *e != expected {
+			t.Errorf("byte %v: expected %v, got %v", offset, &expected, err)
+		}
+	}
+
+	if err := ValidateTree(bytes.NewReader(data[:len(data)-2])); err == nil {
+		t.Error("expected error for truncated trailer")
+	}
+}
+
+func TestBuildChecksum(t *testing.T) {
+	var samples []Sample
+	for i := 0; i < 4; i++ {
+		samples = append(samples, Sample{Point{float64(i) + 0.5, 0.5, float64(i%2) + 0.5}, Color{1, float32(i) / 4, 0, 1}})
+	}
+
+	for _, format := range []OctreeFormat{MipR8G8B8A8UnpackUI32, MipR8G8B8A8DeltaUI32} {
+		var buf bytes.Buffer
+		cfg := BuildConfig{
+			Worker:        NewFakeWorker(samples),
+			Writer:        &buf,
+			Bounds:        Box{Point{0, 0, 0}, 4},
+			VoxelsPerAxis: 4,
+			Format:        format,
+			Optimize:      true,
+			Checksum:      true,
+		}
+
+		if _, err := BuildTree(&cfg); err != nil {
+			panic(err)
+		}
+
+		var header OctreeHeader
+		if err := DecodeHeader(bytes.NewReader(buf.Bytes()), &header); err != nil {
+			panic(err)
+		}
+		if !header.Checksummed() {
+			t.Fatalf("format %v: checksum flag is not set", format)
+		}
+
+		if err := ValidateTree(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Errorf("format %v: %v", format, err)
+		}
+
+		// Transcoding verifies the input and checksums the output.
+		var transcoded bytes.Buffer
+		if err := TranscodeTree(bytes.NewReader(buf.Bytes()), &transcoded, MipR5G6B5UnpackUI16); err != nil {
+			t.Fatalf("format %v: %v", format, err)
+		}
+		if err := ValidateTree(bytes.NewReader(transcoded.Bytes())); err != nil {
+			t.Errorf("format %v: transcoded tree: %v", format, err)
+		}
+
+		if !format.Delta() {
+			var compressed bytes.Buffer
+			if err := CompressTree(bytes.NewReader(buf.Bytes()), &compressed); err != nil {
+				panic(err)
+			}
+			if err := ValidateTree(bytes.NewReader(compressed.Bytes())); err != nil {
+				t.Errorf("format %v: compressed tree: %v", format, err)
+			}
+		}
+
+		damaged := buf.Bytes()
+		damaged[header.Size()+1] ^= 0x80
+		if _, ok := ValidateTree(bytes.NewReader(damaged)).(*ErrChecksumMismatch); !ok {
+			t.Errorf("format %v: expected checksum mismatch", format)
+		}
+		if err := TranscodeTree(bytes.NewReader(damaged), &transcoded, MipR5G6B5UnpackUI16); err == nil {
+			t.Errorf("format %v: expected transcoding a damaged tree to fail", format)
+		}
+	}
+}
@@ -0,0 +1,405 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultChunkSize is the size of the chunk files of BuildConfig.ChunkPath if
+// ChunkSize is zero.
+const DefaultChunkSize = 1 << 30
+
+// ChunkManifest lists the chunk files of a tree, which are the bytes of the
+// tree file cut in pieces of ChunkSize bytes. The last chunk can be shorter.
+type ChunkManifest struct {
+	Format    string  `json:"format"`
+	NumNodes  uint64  `json:"num_nodes"`
+	Size      int64   `json:"size"`
+	ChunkSize int64   `json:"chunk_size"`
+	Chunks    []Chunk `json:"chunks"`
+}
+
+// Chunk is a chunk file, named relative to the manifest, and the CRC32 of its
+// bytes.
+type Chunk struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	CRC32 uint32 `json:"crc32"`
+}
+
+// ErrChunkMismatch is returned when a chunk file does not have the size or
+// checksum listed in its manifest.
+type ErrChunkMismatch struct {
+	Name string
+}
+
+func (e *ErrChunkMismatch) Error() string {
+	return fmt.Sprintf("chunk %s does not match the manifest", e.Name)
+}
+
+// chunkName returns the name of chunk i of the manifest at manifestPath, the
+// manifest name with its extension replaced by the chunk number.
+func chunkName(manifestPath string, i int) string {
+	base := filepath.Base(manifestPath)
+	return fmt.Sprintf("%s.%04d", strings.TrimSuffix(base, filepath.Ext(base)), i)
+}
+
+// ChunkWriter writes a tree to chunk files of a fixed size and the manifest
+// listing them once it is closed. Trees are written in order, so any writer of
+// trees can be given one.
+type ChunkWriter struct {
+	manifestPath string
+	manifest     ChunkManifest
+
+	file *os.File
+	buf  *bufio.Writer
+	crc  hash.Hash32
+	fill int64
+}
+
+// NewChunkWriter returns a writer of chunks of chunkSize bytes, DefaultChunkSize
+// if zero, next to the manifest at manifestPath.
+func NewChunkWriter(manifestPath string, chunkSize int64) (*ChunkWriter, error) {
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if chunkSize < 0 {
+		return nil, errInvalidChunkSize
+	}
+	return &ChunkWriter{manifestPath: manifestPath, manifest: ChunkManifest{ChunkSize: chunkSize}}, nil
+}
+
+func (w *ChunkWriter) Write(p []byte) (int, error) {
+	var n int
+	for n < len(p) {
+		if w.file == nil || w.fill == w.manifest.ChunkSize {
+			if err := w.next(); err != nil {
+				return n, err
+			}
+		}
+
+		m := len(p) - n
+		if left := w.manifest.ChunkSize - w.fill; int64(m) > left {
+			m = int(left)
+		}
+		if _, err := w.buf.Write(p[n : n+m]); err != nil {
+			return n, err
+		}
+		w.crc.Write(p[n : n+m])
+		w.fill += int64(m)
+		n += m
+	}
+	return n, nil
+}
+
+// next closes the current chunk and creates the next one.
+func (w *ChunkWriter) next() error {
+	if err := w.finish(); err != nil {
+		return err
+	}
+
+	name := chunkName(w.manifestPath, len(w.manifest.Chunks))
+	fp, err := os.Create(filepath.Join(filepath.Dir(w.manifestPath), name))
+	if err != nil {
+		return err
+	}
+
+	w.file, w.buf, w.crc, w.fill = fp, bufio.NewWriter(fp), crc32.NewIEEE(), 0
+	w.manifest.Chunks = append(w.manifest.Chunks, Chunk{Name: name})
+	return nil
+}
+
+// finish closes the current chunk and records it in the manifest.
+func (w *ChunkWriter) finish() error {
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.buf.Flush()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.file = nil
+
+	chunk := &w.manifest.Chunks[len(w.manifest.Chunks)-1]
+	chunk.Size, chunk.CRC32 = w.fill, w.crc.Sum32()
+	w.manifest.Size += w.fill
+	return err
+}
+
+// Close closes the last chunk and writes the manifest. The format and number of
+// nodes are read from the header of the tree written.
+func (w *ChunkWriter) Close() error {
+	if err := w.finish(); err != nil {
+		return err
+	}
+
+	reader, err := openChunks(&w.manifest, func(name string) (io.ReaderAt, error) {
+		return os.Open(filepath.Join(filepath.Dir(w.manifestPath), name))
+	})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	var header OctreeHeader
+	if err := DecodeHeader(io.NewSectionReader(reader, 0, reader.Size()), &header); err != nil {
+		return err
+	}
+	w.manifest.Format = formatNames[header.Format]
+	w.manifest.NumNodes = header.NumNodes
+
+	fp, err := os.Create(w.manifestPath)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(fp)
+	enc.SetIndent("", "\t")
+	err = enc.Encode(&w.manifest)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// abort closes the current chunk without writing the manifest, for failed
+// writes. The chunks written are left in place.
+func (w *ChunkWriter) abort() {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+}
+
+// Manifest returns the manifest, complete once the writer is closed.
+func (w *ChunkWriter) Manifest() ChunkManifest {
+	return w.manifest
+}
+
+// ChunkedReaderAt presents the chunks of a tree as one file, for
+// LoadOctreeParallel or, wrapped in an io.SectionReader of Size bytes, for
+// LoadOctree. Reads may span any number of chunks. It is safe for concurrent use
+// if the chunk readers are, like files and HTTPReaderAt.
+type ChunkedReaderAt struct {
+	manifest ChunkManifest
+	offsets  []int64
+	chunks   []io.ReaderAt
+}
+
+// openChunks opens every chunk of manifest with open. The sizes of the chunks
+// must add up to the size of the manifest.
+func openChunks(manifest *ChunkManifest, open func(name string) (io.ReaderAt, error)) (*ChunkedReaderAt, error) {
+	r := &ChunkedReaderAt{manifest: *manifest}
+
+	var offset int64
+	for _, chunk := range manifest.Chunks {
+		if chunk.Size < 0 || strings.ContainsAny(chunk.Name, `/\`) || chunk.Name == ".." {
+			r.Close()
+			return nil, errInvalidManifest
+		}
+
+		reader, err := open(chunk.Name)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.chunks = append(r.chunks, reader)
+		r.offsets = append(r.offsets, offset)
+		offset += chunk.Size
+	}
+
+	if offset != manifest.Size {
+		r.Close()
+		return nil, errInvalidManifest
+	}
+	return r, nil
+}
+
+func readManifest(reader io.Reader) (*ChunkManifest, error) {
+	var manifest ChunkManifest
+	if err := json.NewDecoder(reader).Decode(&manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// OpenChunked opens the chunks listed by the manifest at manifestPath. The sizes
+// of the chunk files are checked, their checksums only by Verify.
+func OpenChunked(manifestPath string) (*ChunkedReaderAt, error) {
+	fp, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := readManifest(fp)
+	fp.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(manifestPath)
+	return openChunks(manifest, func(name string) (io.ReaderAt, error) {
+		fp, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		if stat, err := fp.Stat(); err != nil || stat.Size() != chunkSize(manifest, name) {
+			fp.Close()
+			return nil, &ErrChunkMismatch{name}
+		}
+		return fp, nil
+	})
+}
+
+// OpenChunkedHTTP opens a chunked tree on a web server, the chunks are read with
+// HTTPReaderAt from next to the manifest. If client is nil http.DefaultClient is
+// used.
+func OpenChunkedHTTP(manifestURL string, client *http.Client) (*ChunkedReaderAt, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	base, err := url.Parse(manifestURL)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Get(manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", manifestURL, resp.Status)
+	}
+
+	manifest, err := readManifest(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return openChunks(manifest, func(name string) (io.ReaderAt, error) {
+		chunkURL := *base
+		chunkURL.Path = path.Join(path.Dir(base.Path), name)
+		chunkURL.RawQuery = ""
+		return NewHTTPReaderAt(chunkURL.String(), client), nil
+	})
+}
+
+// chunkSize returns the size of the named chunk in manifest.
+func chunkSize(manifest *ChunkManifest, name string) int64 {
+	for _, chunk := range manifest.Chunks {
+		if chunk.Name == name {
+			return chunk.Size
+		}
+	}
+	return -1
+}
+
+// Manifest returns the manifest of the chunks.
+func (r *ChunkedReaderAt) Manifest() ChunkManifest {
+	return r.manifest
+}
+
+// Size returns the size of the tree, the sum of the chunk sizes.
+func (r *ChunkedReaderAt) Size() int64 {
+	return r.manifest.Size
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *ChunkedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errInvalidOffset
+	}
+
+	// The chunk holding off is the last one starting at or before it.
+	i := sort.Search(len(r.offsets), func(i int) bool { return r.offsets[i] > off }) - 1
+
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		if i < 0 || pos >= r.manifest.Size {
+			return n, io.EOF
+		}
+
+		start := pos - r.offsets[i]
+		size := r.manifest.Chunks[i].Size
+		if start >= size {
+			i++
+			if i == len(r.chunks) {
+				return n, io.EOF
+			}
+			continue
+		}
+
+		m := len(p) - n
+		if left := size - start; int64(m) > left {
+			m = int(left)
+		}
+		read, err := r.chunks[i].ReadAt(p[n:n+m], start)
+		n += read
+		if read < m {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Verify reads all chunks and compares their checksums with the manifest. The
+// first chunk that differs is returned as an ErrChunkMismatch.
+func (r *ChunkedReaderAt) Verify() error {
+	for i, chunk := range r.manifest.Chunks {
+		crc := crc32.NewIEEE()
+		n, err := io.Copy(crc, io.NewSectionReader(r.chunks[i], 0, chunk.Size))
+		if err == io.ErrUnexpectedEOF || n != chunk.Size || crc.Sum32() != chunk.CRC32 {
+			return &ErrChunkMismatch{chunk.Name}
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the chunk readers that are io.Closers.
+func (r *ChunkedReaderAt) Close() error {
+	var err error
+	for _, chunk := range r.chunks {
+		if c, ok := chunk.(io.Closer); ok {
+			if cerr := c.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	r.chunks = nil
+	return err
+}
@@ -0,0 +1,167 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// buildChunkTestTree builds the same tree to a buffer and, if manifest is set,
+// to chunks of chunkSize bytes.
+func buildChunkTestTree(t *testing.T, manifest string, chunkSize int64) []byte {
+	var samples []Sample
+	for i := 0; i < 40; i++ {
+		samples = append(samples, Sample{Point{float64(i%7) + 0.5, float64(i%5) + 0.5, float64(i%3) + 0.5}, Color{float32(i) / 40, 0.5, 0, 1}})
+	}
+
+	var buf bytes.Buffer
+	cfg := BuildConfig{
+		Worker:        NewFakeWorker(samples),
+		Writer:        &buf,
+		Bounds:        Box{Point{0, 0, 0}, 8},
+		VoxelsPerAxis: 8,
+		Format:        MipR8G8B8A8UnpackUI32,
+		ChunkPath:     manifest,
+		ChunkSize:     chunkSize,
+	}
+	if _, err := BuildTree(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestChunkedTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The chunks are smaller than the header and nodes span them.
+	const chunkSize = 7
+	expected := buildChunkTestTree(t, "", 0)
+	manifestPath := filepath.Join(dir, "tree.json")
+	if buf := buildChunkTestTree(t, manifestPath, chunkSize); len(buf) != 0 {
+		t.Fatal("expected nothing to be written to Writer")
+	}
+
+	reader, err := OpenChunked(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	manifest := reader.Manifest()
+	numChunks := (len(expected) + chunkSize - 1) / chunkSize
+	if manifest.Size != int64(len(expected)) || len(manifest.Chunks) != numChunks || manifest.Format != "MipR8G8B8A8UnpackUI32" {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+	if name := manifest.Chunks[1].Name; name != "tree.0001" {
+		t.Errorf("unexpected chunk name %q", name)
+	}
+
+	var header OctreeHeader
+	if err := DecodeHeader(bytes.NewReader(expected), &header); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.NumNodes != header.NumNodes {
+		t.Errorf("expected %d nodes, got %d", header.NumNodes, manifest.NumNodes)
+	}
+
+	data, err := ioutil.ReadAll(io.NewSectionReader(reader, 0, reader.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Fatal("the chunks differ from the tree")
+	}
+
+	// Reads at any offset and length, across chunk boundaries and past the end.
+	for off := 0; off < len(expected)+3; off += 3 {
+		for _, size := range []int{1, chunkSize - 1, chunkSize, 2*chunkSize + 1, 40} {
+			buf := make([]byte, size)
+			n, err := reader.ReadAt(buf, int64(off))
+
+			want := len(expected) - off
+			if want > size {
+				want = size
+			} else if want < 0 {
+				want = 0
+			}
+			if n != want || (n < size) != (err == io.EOF) || !bytes.Equal(buf[:n], expected[off:off+n]) {
+				t.Fatalf("read of %d bytes at %d: got %d bytes and %v", size, off, n, err)
+			}
+		}
+	}
+
+	if err := reader.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Damaged chunks are found by Verify, chunks of the wrong size when opened.
+	chunk := filepath.Join(dir, manifest.Chunks[2].Name)
+	ioutil.WriteFile(chunk, []byte("damaged"), 0644)
+	if err := reader.Verify(); err == nil {
+		t.Error("expected the damaged chunk to be found")
+	} else if mismatch, ok := err.(*ErrChunkMismatch); !ok || mismatch.Name != manifest.Chunks[2].Name {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	ioutil.WriteFile(chunk, []byte("short"), 0644)
+	if _, err := OpenChunked(manifestPath); err == nil {
+		t.Error("expected a chunk of the wrong size to be rejected")
+	}
+}
+
+func TestChunkedTreeHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	expected := buildChunkTestTree(t, "", 0)
+	buildChunkTestTree(t, filepath.Join(dir, "tree.json"), 100)
+
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+
+	reader, err := OpenChunkedHTTP(server.URL+"/tree.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(io.NewSectionReader(reader, 0, reader.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Error("the chunks differ from the tree")
+	}
+	if err := reader.Verify(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,193 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// collapseStats summarizes the samples below a node of the accumulation tree.
+// Samples are represented by the mean color of their voxel.
+type collapseStats struct {
+	count       float64
+	sum, square [3]float64
+	solid       bool
+}
+
+// variance returns the largest per channel variance of the samples.
+func (s *collapseStats) variance() float64 {
+	var v float64
+	for c := range s.sum {
+		mean := s.sum[c] / s.count
+		if cv := s.square[c]/s.count - mean*mean; cv > v {
+			v = cv
+		}
+	}
+	return v
+}
+
+type treeCollapser struct {
+	reader    io.ReadSeeker
+	header    *OctreeHeader
+	threshold float64
+	collapsed map[NodeIndex]bool
+}
+
+func (tc *treeCollapser) readNode(index NodeIndex, node *accNode) error {
+	offset := int64(tc.header.Size()) + int64(index)*int64(mipR64G64B64A64S64UnpackUI64.NodeSize())
+	if _, err := tc.reader.Seek(offset, 0); err != nil {
+		return err
+	}
+	return binary.Read(tc.reader, binary.LittleEndian, node)
+}
+
+// visit computes the stats of the subtree at index and marks the topmost solid
+// nodes with a color variance below the threshold as collapsed.
+func (tc *treeCollapser) visit(index NodeIndex, voxelRes int) (collapseStats, error) {
+	var (
+		node  accNode
+		stats collapseStats
+	)
+
+	if err := tc.readNode(index, &node); err != nil {
+		return stats, err
+	}
+
+	if voxelRes == 1 {
+		if node.Color[4] == 0 {
+			return stats, nil
+		}
+
+		stats.count = float64(node.Color[4])
+		for c := range stats.sum {
+			mean := float64(node.Color[c]) / stats.count / 255
+			stats.sum[c] = mean * stats.count
+			stats.square[c] = mean * mean * stats.count
+		}
+		stats.solid = true
+		return stats, nil
+	}
+
+	stats.solid = true
+	for _, child := range node.Children {
+		if child == 0 {
+			stats.solid = false
+			continue
+		}
+
+		cs, err := tc.visit(child, voxelRes/2)
+		if err != nil {
+			return stats, err
+		}
+
+		stats.count += cs.count
+		for c := range stats.sum {
+			stats.sum[c] += cs.sum[c]
+			stats.square[c] += cs.square[c]
+		}
+		stats.solid = stats.solid && cs.solid
+	}
+
+	if stats.solid && stats.count > 0 && stats.variance() <= tc.threshold {
+		tc.collapsed[index] = true
+	}
+	return stats, nil
+}
+
+// collapseTree copies the accumulation tree in reader to writer, turning solid
+// nodes whose samples have a color variance at or below threshold into leafs. The
+// collapsed nodes keep the accumulated color of all their samples. The number of
+// collapsed nodes is returned.
+func collapseTree(reader io.ReadSeeker, writer io.WriteSeeker, header *OctreeHeader, threshold float32) (uint64, error) {
+	tc := treeCollapser{
+		reader:    reader,
+		header:    header,
+		threshold: float64(threshold),
+		collapsed: make(map[NodeIndex]bool),
+	}
+
+	out := *header
+	out.NumNodes = 0
+	out.NumLeafs = 0
+
+	// The header is written again when the number of nodes is known.
+	if err := EncodeHeader(writer, out); err != nil {
+		return 0, err
+	}
+
+	if header.NumNodes == 0 {
+		return 0, nil
+	}
+
+	if _, err := tc.visit(0, int(header.VoxelsPerAxis)); err != nil {
+		return 0, err
+	}
+
+	type item struct {
+		index    NodeIndex
+		voxelRes int
+	}
+
+	// Nodes are written in breadth-first order so the index of a child is known
+	// when its parent is written. Unreachable nodes are dropped.
+	var numCollapsed uint64
+	queue := []item{{0, int(header.VoxelsPerAxis)}}
+	for numQueued := NodeIndex(1); len(queue) > 0; queue = queue[1:] {
+		it := queue[0]
+
+		var node accNode
+		if err := tc.readNode(it.index, &node); err != nil {
+			return 0, err
+		}
+
+		leaf := it.voxelRes == 1
+		if tc.collapsed[it.index] {
+			leaf = true
+			numCollapsed++
+		}
+
+		for i, child := range node.Children {
+			if child == 0 {
+				continue
+			}
+
+			if leaf {
+				node.Children[i] = 0
+			} else {
+				queue = append(queue, item{child, it.voxelRes / 2})
+				node.Children[i] = numQueued
+				numQueued++
+			}
+		}
+
+		if leaf {
+			out.NumLeafs += node.Color[4]
+		}
+
+		if err := binary.Write(writer, binary.LittleEndian, node); err != nil {
+			return 0, err
+		}
+		out.NumNodes++
+	}
+
+	if _, err := writer.Seek(0, 0); err != nil {
+		return 0, err
+	}
+	return numCollapsed, EncodeHeader(writer, out)
+}
@@ -0,0 +1,77 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"image"
+	"math"
+)
+
+// ColorSource replaces the color of samples before they are inserted into the tree.
+// Samples keep their own color where ColorAt returns false. It is called for every
+// sample and should not allocate.
+type ColorSource interface {
+	ColorAt(x, y, z float64) (Color, bool)
+}
+
+// ImageColorSource colors samples from an image, like an aerial orthophoto of a
+// scan. Transform maps world to pixel coordinates, the pixel column is
+// Transform[0]*x + Transform[1]*y + Transform[2]*z + Transform[3] and the row is
+// Transform[4]*x + Transform[5]*y + Transform[6]*z + Transform[7]. Samples outside
+// the image or on fully transparent pixels keep their color.
+type ImageColorSource struct {
+	Image     image.Image
+	Transform [8]float64
+}
+
+func (s *ImageColorSource) ColorAt(x, y, z float64) (Color, bool) {
+	t := &s.Transform
+	px := math.Floor(t[0]*x + t[1]*y + t[2]*z + t[3])
+	py := math.Floor(t[4]*x + t[5]*y + t[6]*z + t[7])
+
+	bounds := s.Image.Bounds()
+	if px < float64(bounds.Min.X) || py < float64(bounds.Min.Y) || px >= float64(bounds.Max.X) || py >= float64(bounds.Max.Y) {
+		return Color{}, false
+	}
+
+	// Common image types are read without converting the pixel to a color.Color,
+	// which would allocate.
+	var r, g, b, a uint32
+	ix, iy := int(px), int(py)
+
+	switch img := s.Image.(type) {
+	case *image.RGBA:
+		r, g, b, a = img.RGBAAt(ix, iy).RGBA()
+	case *image.NRGBA:
+		r, g, b, a = img.NRGBAAt(ix, iy).RGBA()
+	case *image.YCbCr:
+		r, g, b, a = img.YCbCrAt(ix, iy).RGBA()
+	case *image.Gray:
+		r, g, b, a = img.GrayAt(ix, iy).RGBA()
+	default:
+		r, g, b, a = img.At(ix, iy).RGBA()
+	}
+
+	if a == 0 {
+		return Color{}, false
+	}
+
+	// Colors are stored without premultiplied alpha.
+	scale := float32(a)
+	return Color{float32(r) / scale, float32(g) / scale, float32(b) / scale, float32(a) / 0xffff}, true
+}
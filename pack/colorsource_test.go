@@ -0,0 +1,118 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func checkerboard(w, h, block int, a, b color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if (x/block+y/block)%2 == 0 {
+				img.SetRGBA(x, y, a)
+			} else {
+				img.SetRGBA(x, y, b)
+			}
+		}
+	}
+	return img
+}
+
+func TestImageColorSource(t *testing.T) {
+	red, blue, white := Color{1, 0, 0, 1}, Color{0, 0, 1, 1}, Color{1, 1, 1, 1}
+
+	// The image covers the first half of the tree along z, pixel columns follow x and rows follow z.
+	source := &ImageColorSource{
+		Image:     checkerboard(8, 4, 2, color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}),
+		Transform: [8]float64{1, 0, 0, 0, 0, 0, 1, 0},
+	}
+
+	var samples []Sample
+	for z := 0; z < 8; z++ {
+		for x := 0; x < 8; x++ {
+			samples = append(samples, Sample{Point{float64(x) + 0.5, 0.5, float64(z) + 0.5}, white})
+		}
+	}
+
+	var buffer bytes.Buffer
+	cfg := BuildConfig{
+		Worker:        NewFakeWorker(samples),
+		Writer:        &buffer,
+		Bounds:        Box{Point{0, 0, 0}, 8},
+		VoxelsPerAxis: 8,
+		Format:        MipR8G8B8A8UnpackUI32,
+		ColorSource:   source,
+	}
+
+	if _, err := BuildTree(&cfg); err != nil {
+		panic(err)
+	}
+
+	data, err := decodeTree(&buffer)
+	if err != nil {
+		panic(err)
+	}
+
+	var levels [][2]uint64
+	leafs, err := data.leafs(&levels, 0)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(leafs) != 64 {
+		t.Fatalf("expected 64 leafs, got %d", len(leafs))
+	}
+
+	for cell, col := range leafs {
+		expected := white
+		if cell.z < 4 {
+			expected = blue
+			if (cell.x/2+cell.z/2)%2 == 0 {
+				expected = red
+			}
+		}
+
+		if col != expected {
+			t.Errorf("leaf %d,%d,%d: expected %v, got %v", cell.x, cell.y, cell.z, expected, col)
+		}
+	}
+}
+
+func TestImageColorSourceAllocs(t *testing.T) {
+	source := &ImageColorSource{
+		Image:     checkerboard(8, 8, 2, color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}),
+		Transform: [8]float64{1, 0, 0, 0, 0, 0, 1, 0},
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		source.ColorAt(3.5, 0, 5.5)
+	})
+
+	if allocs != 0 {
+		t.Errorf("expected no allocations, got %v", allocs)
+	}
+
+	if _, ok := source.ColorAt(8.5, 0, 0.5); ok {
+		t.Error("expected no color outside of the image")
+	}
+}
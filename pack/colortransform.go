@@ -0,0 +1,90 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package pack
+
+// ColorTransform corrects the color of samples, like the white balance of scans
+// captured under different lighting. It is called for every sample and should
+// not allocate.
+type ColorTransform interface {
+	TransformColor(c Color) Color
+}
+
+// ColorGain multiplies the red, green and blue channels of a color.
+type ColorGain [3]float32
+
+func (g ColorGain) TransformColor(c Color) Color {
+	return Color{clampUnit(c.R * g[0]), clampUnit(c.G * g[1]), clampUnit(c.B * g[2]), c.A}
+}
+
+// WhiteBalance returns the gain that turns white, the color of a white surface
+// in a scan, into pure white. Channels that are zero are kept.
+func WhiteBalance(white Color) ColorGain {
+	gain := ColorGain{1, 1, 1}
+	for i, v := range [3]float32{white.R, white.G, white.B} {
+		if v > 0 {
+			gain[i] = 1 / v
+		}
+	}
+	return gain
+}
+
+// ColorMatrix is a row major 3x3 matrix applied to the red, green and blue
+// channels of a color.
+type ColorMatrix [9]float32
+
+func (m *ColorMatrix) TransformColor(c Color) Color {
+	return Color{
+		clampUnit(m[0]*c.R + m[1]*c.G + m[2]*c.B),
+		clampUnit(m[3]*c.R + m[4]*c.G + m[5]*c.B),
+		clampUnit(m[6]*c.R + m[7]*c.G + m[8]*c.B),
+		c.A,
+	}
+}
+
+// TransformWorker returns a worker that sends the samples of worker with their
+// colors corrected by transform. Give every input of a build its own transform
+// to remove tint seams between them.
+func TransformWorker(worker BuildWorker, transform ColorTransform) BuildWorker {
+	return func(samples chan<- Sample) error {
+		in := make(chan Sample, sampleChannelSize)
+		done := make(chan struct{})
+
+		go func() {
+			for s := range in {
+				s.Col = transform.TransformColor(s.Col)
+				samples <- s
+			}
+			close(done)
+		}()
+
+		defer func() {
+			close(in)
+			<-done
+		}()
+		return worker(in)
+	}
+}
+
+func clampUnit(v float32) float32 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
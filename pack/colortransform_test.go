@@ -0,0 +1,141 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package pack
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+// tintedScan returns the samples of a gray floor from x0 to x1, as seen by a
+// scanner with tint.
+func tintedScan(x0, x1 int, tint ColorTransform) []Sample {
+	gray := Color{0.5, 0.5, 0.5, 1}
+
+	var samples []Sample
+	for z := 0; z < 8; z++ {
+		for x := x0; x < x1; x++ {
+			samples = append(samples, Sample{Point{float64(x) + 0.5, 0.5, float64(z) + 0.5}, tint.TransformColor(gray)})
+		}
+	}
+	return samples
+}
+
+func buildLeafColors(worker BuildWorker) map[meshCell]Color {
+	var buffer bytes.Buffer
+	cfg := BuildConfig{
+		Worker:        worker,
+		Writer:        &buffer,
+		Bounds:        Box{Point{0, 0, 0}, 8},
+		VoxelsPerAxis: 8,
+		Format:        MipR8G8B8A8UnpackUI32,
+	}
+
+	if _, err := BuildTree(&cfg); err != nil {
+		panic(err)
+	}
+
+	data, err := decodeTree(&buffer)
+	if err != nil {
+		panic(err)
+	}
+
+	var levels [][2]uint64
+	leafs, err := data.leafs(&levels, 0)
+	if err != nil {
+		panic(err)
+	}
+	return leafs
+}
+
+func colorRange(leafs map[meshCell]Color) float32 {
+	var lo, hi [3]float32
+	lo = [3]float32{1, 1, 1}
+	for _, col := range leafs {
+		for i, v := range [3]float32{col.R, col.G, col.B} {
+			lo[i] = float32(math.Min(float64(lo[i]), float64(v)))
+			hi[i] = float32(math.Max(float64(hi[i]), float64(v)))
+		}
+	}
+	return float32(math.Max(math.Max(float64(hi[0]-lo[0]), float64(hi[1]-lo[1])), float64(hi[2]-lo[2])))
+}
+
+func TestColorTransform(t *testing.T) {
+	// The morning pass is warm and the evening pass is blue, they overlap in the
+	// middle of the floor.
+	warm := ColorGain{1, 0.9, 0.7}
+	blue := &ColorMatrix{0.8, 0, 0, 0, 0.9, 0.1, 0, 0, 1.2}
+
+	morning := tintedScan(0, 5, warm)
+	evening := tintedScan(3, 8, blue)
+
+	join := func(a, b BuildWorker) BuildWorker {
+		return func(samples chan<- Sample) error {
+			if err := a(samples); err != nil {
+				return err
+			}
+			return b(samples)
+		}
+	}
+
+	leafs := buildLeafColors(join(NewFakeWorker(morning), NewFakeWorker(evening)))
+	if len(leafs) != 64 {
+		t.Fatalf("expected 64 leafs, got %d", len(leafs))
+	}
+	if r := colorRange(leafs); r < 0.1 {
+		t.Fatalf("expected visible tint seams without correction, got a range of %v", r)
+	}
+
+	undoWarm := WhiteBalance(warm.TransformColor(Color{1, 1, 1, 1}))
+	undoBlue := &ColorMatrix{1.25, 0, 0, 0, 1 / 0.9, -0.1 / (0.9 * 1.2), 0, 0, 1 / 1.2}
+
+	leafs = buildLeafColors(join(
+		TransformWorker(NewFakeWorker(morning), undoWarm),
+		TransformWorker(NewFakeWorker(evening), undoBlue),
+	))
+	if len(leafs) != 64 {
+		t.Fatalf("expected 64 leafs, got %d", len(leafs))
+	}
+	if r := colorRange(leafs); r > 1.5/255 {
+		t.Errorf("expected uniform color after correction, got a range of %v", r)
+	}
+	for cell, col := range leafs {
+		if math.Abs(float64(col.R-0.5)) > 1.5/255 || math.Abs(float64(col.B-0.5)) > 1.5/255 {
+			t.Errorf("leaf %d,%d,%d: expected gray, got %v", cell.x, cell.y, cell.z, col)
+			break
+		}
+	}
+}
+
+func TestColorTransformClamp(t *testing.T) {
+	c := ColorGain{2, 1, -1}.TransformColor(Color{0.75, 0.5, 0.5, 0.25})
+	if c != (Color{1, 0.5, 0, 0.25}) {
+		t.Errorf("expected clamped channels and unchanged alpha, got %v", c)
+	}
+
+	if g := WhiteBalance(Color{0.5, 0, 0.25, 1}); g != (ColorGain{2, 1, 4}) {
+		t.Errorf("unexpected white balance %v", g)
+	}
+}
+
+func TestTransformWorker(t *testing.T) {
+	worker := TransformWorker(NewFakeWorker(tintedScan(0, 8, ColorGain{1, 1, 1})), ColorGain{1, 1, 1})
+	if n := VerifyWorker(t, worker); n != 64 {
+		t.Errorf("expected 64 samples, got %d", n)
+	}
+}
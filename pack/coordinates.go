@@ -0,0 +1,113 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import "math"
+
+// CoordinateSystem is the axis convention of world coordinates. Trees are always
+// laid out in YUpRightHanded, samples and bounds in other conventions are
+// converted when the tree is built and the convention is recorded in the header.
+type CoordinateSystem byte
+
+const (
+	// YUpRightHanded has x to the right, y up and z towards the viewer.
+	YUpRightHanded CoordinateSystem = iota
+
+	// ZUpRightHanded has x to the right, y away from the viewer and z up.
+	ZUpRightHanded
+
+	// ZUpLeftHanded has x to the right, y towards the viewer and z up. It is
+	// YUpRightHanded with y and z swapped.
+	ZUpLeftHanded
+)
+
+var coordinateNames = [...]string{"y-up-rh", "z-up-rh", "z-up-lh"}
+
+func (c CoordinateSystem) String() string {
+	if !c.valid() {
+		return "unknown"
+	}
+	return coordinateNames[c]
+}
+
+func (c CoordinateSystem) valid() bool {
+	return c <= ZUpLeftHanded
+}
+
+// ParseCoordinateSystem returns the coordinate system named by String.
+func ParseCoordinateSystem(name string) (CoordinateSystem, error) {
+	for i, n := range coordinateNames {
+		if n == name {
+			return CoordinateSystem(i), nil
+		}
+	}
+	return 0, errUnknownCoordinates
+}
+
+// ToTree converts a point or direction in c to tree space.
+func (c CoordinateSystem) ToTree(p Point) Point {
+	switch c {
+	case ZUpRightHanded:
+		return Point{p.X, p.Z, -p.Y}
+	case ZUpLeftHanded:
+		return Point{p.X, p.Z, p.Y}
+	}
+	return p
+}
+
+// FromTree converts a point or direction in tree space to c.
+func (c CoordinateSystem) FromTree(p Point) Point {
+	switch c {
+	case ZUpRightHanded:
+		return Point{p.X, -p.Z, p.Y}
+	case ZUpLeftHanded:
+		return Point{p.X, p.Z, p.Y}
+	}
+	return p
+}
+
+// ToTreeBox converts a box in c to tree space. Axes that are flipped move the
+// corner of the box to the other end.
+func (c CoordinateSystem) ToTreeBox(b Box) Box {
+	max := Point{b.Pos.X + b.Size, b.Pos.Y + b.Size, b.Pos.Z + b.Size}
+	return Box{minPoint(c.ToTree(b.Pos), c.ToTree(max)), b.Size}
+}
+
+// FromTreeBox converts a box in tree space to c.
+func (c CoordinateSystem) FromTreeBox(b Box) Box {
+	max := Point{b.Pos.X + b.Size, b.Pos.Y + b.Size, b.Pos.Z + b.Size}
+	return Box{minPoint(c.FromTree(b.Pos), c.FromTree(max)), b.Size}
+}
+
+// sourceRegion returns a box in c that covers cell of a tree. Conventions that
+// negate an axis swap the closed and open faces of cells, so the box is grown to
+// include the samples on the faces. The builder assigns samples to cells in tree
+// space.
+func (c CoordinateSystem) sourceRegion(cell Box) Box {
+	box := c.FromTreeBox(cell)
+	if c == ZUpRightHanded {
+		margin := cell.Size * 1e-6
+		box.Pos = Point{box.Pos.X - margin, box.Pos.Y - margin, box.Pos.Z - margin}
+		box.Size += 2 * margin
+	}
+	return box
+}
+
+func minPoint(a, b Point) Point {
+	return Point{math.Min(a.X, b.X), math.Min(a.Y, b.Y), math.Min(a.Z, b.Z)}
+}
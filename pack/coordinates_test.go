@@ -0,0 +1,146 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// axisScene is three colored rows of voxels along the axes of a Y-up right-handed
+// 8^3 tree, red along x, green up and blue away from the viewer. The blue samples
+// are on the faces between voxels.
+func axisScene() []Sample {
+	var samples []Sample
+	for i := 0; i < 6; i++ {
+		v := float64(i) + 1.5
+		samples = append(samples,
+			Sample{Point{v, 0.5, 7.5}, Color{1, 0, 0, 1}},
+			Sample{Point{0.5, v, 7.5}, Color{0, 1, 0, 1}},
+			Sample{Point{0.5, 0.5, 7.5 - v}, Color{0, 0, 1, 1}},
+		)
+	}
+	return samples
+}
+
+func TestCoordinateSystem(t *testing.T) {
+	p := Point{1, 2, 3}
+	box := Box{Point{1, 2, 3}, 4}
+	for _, coords := range []CoordinateSystem{YUpRightHanded, ZUpRightHanded, ZUpLeftHanded} {
+		if q := coords.ToTree(coords.FromTree(p)); q != p {
+			t.Errorf("%v: expected %v back, got %v", coords, p, q)
+		}
+		if b := coords.ToTreeBox(coords.FromTreeBox(box)); b != box {
+			t.Errorf("%v: expected %v back, got %v", coords, box, b)
+		}
+
+		parsed, err := ParseCoordinateSystem(coords.String())
+		if err != nil || parsed != coords {
+			t.Errorf("%v: parsed as %v, %v", coords, parsed, err)
+		}
+	}
+
+	if p := ZUpRightHanded.ToTree(Point{0, 0, 1}); p != (Point{0, 1, 0}) {
+		t.Error("expected z up to be y up in tree space, got", p)
+	}
+	if p := ZUpRightHanded.ToTree(Point{0, 1, 0}); p != (Point{0, 0, -1}) {
+		t.Error("expected forward to be -z in tree space, got", p)
+	}
+	if b := ZUpRightHanded.ToTreeBox(Box{Point{0, -8, 0}, 8}); b != (Box{Point{0, 0, 0}, 8}) {
+		t.Error("expected the flipped box to start at the origin, got", b)
+	}
+	if _, err := ParseCoordinateSystem("x-up"); err != errUnknownCoordinates {
+		t.Error("expected errUnknownCoordinates, got", err)
+	}
+}
+
+func TestBuildCoordinates(t *testing.T) {
+	build := func(cfg BuildConfig) (OctreeHeader, []byte) {
+		var tree bytes.Buffer
+		cfg.Writer = &tree
+		cfg.VoxelsPerAxis = 8
+		cfg.Format = MipR8G8B8A8UnpackUI32
+		if _, err := BuildTree(&cfg); err != nil {
+			t.Fatal(err)
+		}
+
+		var header OctreeHeader
+		if err := DecodeHeader(bytes.NewReader(tree.Bytes()), &header); err != nil {
+			t.Fatal(err)
+		}
+		return header, tree.Bytes()
+	}
+
+	bounds := Box{Point{0, 0, 0}, 8}
+	configs := func(coords CoordinateSystem) []BuildConfig {
+		var samples []Sample
+		for _, s := range axisScene() {
+			samples = append(samples, Sample{coords.FromTree(s.Pos), s.Col})
+		}
+		source := coords.FromTreeBox(bounds)
+		return []BuildConfig{
+			{Worker: NewFakeWorker(samples), Bounds: source, Coordinates: coords},
+			{Batches: batchWorker(samples), Bounds: source, Coordinates: coords},
+			{Cells: NewPointStoreWorker(source, samples), CellLevel: 1, Bounds: source, Coordinates: coords},
+		}
+	}
+
+	_, expected := build(configs(YUpRightHanded)[0])
+
+	for _, coords := range []CoordinateSystem{ZUpRightHanded, ZUpLeftHanded} {
+		for i, cfg := range configs(coords) {
+			header, tree := build(cfg)
+			if header.Coordinates != coords {
+				t.Errorf("%v: expected the convention in the header, got %v", coords, header.Coordinates)
+			}
+			if header.Bounds != bounds {
+				t.Errorf("%v: expected bounds %v in tree space, got %v", coords, bounds, header.Bounds)
+			}
+
+			// The order of the nodes depends on the order of the samples.
+			diff, err := DiffTrees(bytes.NewReader(expected), bytes.NewReader(tree), 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !diff.Identical() {
+				t.Errorf("%v: expected the leafs of the Y-up tree from worker %d", coords, i)
+			}
+		}
+	}
+
+	cfg := BuildConfig{Worker: NewFakeWorker(nil), Writer: &bytes.Buffer{}, Bounds: bounds, VoxelsPerAxis: 8, Coordinates: ZUpLeftHanded + 1}
+	if _, err := BuildTree(&cfg); err != errUnknownCoordinates {
+		t.Error("expected errUnknownCoordinates, got", err)
+	}
+}
+
+func TestTextCoordinates(t *testing.T) {
+	text := "coordinates z-up-lh\nnode 0 color #ffffffff children 0 0 0 0 0 0 0 0\n"
+
+	var tree, dump bytes.Buffer
+	if err := ParseText(strings.NewReader(text), &tree, MipR8G8B8A8UnpackUI32); err != nil {
+		t.Fatal(err)
+	}
+	if err := DumpText(&tree, &dump); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dump.String(), "coordinates z-up-lh\n") {
+		t.Errorf("expected the convention in the dump:\n%s", dump.String())
+	}
+}
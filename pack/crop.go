@@ -0,0 +1,197 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import "io"
+
+type cropItem struct {
+	index  NodeIndex
+	bounds Box
+}
+
+func readNodeAt(reader io.ReadSeeker, header *OctreeHeader, index NodeIndex, color *Color, children []NodeIndex) error {
+	if !header.Format.FixedSize() {
+		return ErrUnsupportedFormat
+	}
+
+	offset := int64(header.Size()) + int64(index)*int64(header.Format.NodeSize())
+	if _, err := reader.Seek(offset, 0); err != nil {
+		return err
+	}
+	return DecodeNode(reader, header.Format, color, children)
+}
+
+// childIndex returns the child of bounds that a point inside it belongs to. Points
+// on the split planes belong to the upper child, which makes the children
+// half-open boxes.
+func childIndex(bounds Box, p Point) int {
+	mid := childBox(bounds, 7).Pos
+
+	var i int
+	if p.X >= mid.X {
+		i |= 1
+	}
+	if p.Y >= mid.Y {
+		i |= 2
+	}
+	if p.Z >= mid.Z {
+		i |= 4
+	}
+	return i
+}
+
+func childBox(bounds Box, i int) Box {
+	size := bounds.Size * 0.5
+	offset := childPositions[i].scale(size)
+	return Box{bounds.Pos.add(&offset), size}
+}
+
+// worldBox returns the part of world that b covers, where b is a box of a tree
+// spanning bounds and placed at world.
+func worldBox(b, bounds, world Box) Box {
+	scale := world.Size / bounds.Size
+	return Box{
+		Pos: Point{
+			X: world.Pos.X + (b.Pos.X-bounds.Pos.X)*scale,
+			Y: world.Pos.Y + (b.Pos.Y-bounds.Pos.Y)*scale,
+			Z: world.Pos.Z + (b.Pos.Z-bounds.Pos.Z)*scale,
+		},
+		Size: b.Size * scale,
+	}
+}
+
+// CropTree writes the part of the tree intersecting region to out. The output is
+// re-rooted at the smallest node that contains the whole region and the bounds of
+// that node is returned. Nodes partially inside the region are kept whole. If the
+// tree has world bounds, the header of the output has those of the new root.
+func CropTree(in io.ReadSeeker, out io.WriteSeeker, region Box, treeBounds Box) (Box, error) {
+	var (
+		header   OctreeHeader
+		color    Color
+		children [8]NodeIndex
+	)
+
+	if err := DecodeHeader(in, &header); err != nil {
+		return treeBounds, err
+	}
+
+	if header.Compressed() == true {
+		return treeBounds, errInputIsCompressed
+	}
+
+	if header.NumNodes == 0 || !treeBounds.IntersectBox(region) {
+		return treeBounds, errEmptyRegion
+	}
+
+	// Find the new root.
+	root := cropItem{0, treeBounds}
+	vpa := header.VoxelsPerAxis
+
+	for vpa > 1 {
+		if err := readNodeAt(in, &header, root.index, &color, children[:]); err != nil {
+			return treeBounds, err
+		}
+
+		next := root
+		for i, child := range children {
+			if b := childBox(root.bounds, i); child != 0 && b.Contains(region) {
+				next = cropItem{child, b}
+				break
+			}
+		}
+
+		if next.index == root.index {
+			break
+		}
+
+		root = next
+		vpa /= 2
+	}
+
+	start, err := out.Seek(0, 1)
+	if err != nil {
+		return treeBounds, err
+	}
+
+	outHeader := header
+	outHeader.NumNodes = 0
+	outHeader.NumLeafs = 0
+	outHeader.VoxelsPerAxis = vpa
+	outHeader.Flags &^= checksumMask
+	if header.HasBounds() {
+		outHeader.Bounds = worldBox(root.bounds, treeBounds, header.Bounds)
+	}
+
+	if err := EncodeHeader(out, outHeader); err != nil {
+		return treeBounds, err
+	}
+
+	// Nodes are written in breadth-first order so the index of a child is known
+	// when its parent is written.
+	queue := []cropItem{root}
+	for numQueued := NodeIndex(1); len(queue) > 0; queue = queue[1:] {
+		item := queue[0]
+		if err := readNodeAt(in, &header, item.index, &color, children[:]); err != nil {
+			return treeBounds, err
+		}
+
+		numChildren := 0
+		for i, child := range children {
+			if child == 0 {
+				continue
+			}
+
+			if b := childBox(item.bounds, i); b.IntersectBox(region) {
+				queue = append(queue, cropItem{child, b})
+				children[i] = numQueued
+				numQueued++
+				numChildren++
+			} else {
+				children[i] = 0
+			}
+		}
+
+		if numChildren == 0 {
+			outHeader.NumLeafs++
+		}
+
+		if err := EncodeNodeAt(out, header.Format, NodeIndex(outHeader.NumNodes), color, children[:]); err != nil {
+			return treeBounds, err
+		}
+		outHeader.NumNodes++
+	}
+
+	end, err := out.Seek(0, 1)
+	if err != nil {
+		return treeBounds, err
+	}
+
+	if _, err := out.Seek(start, 0); err != nil {
+		return treeBounds, err
+	}
+
+	if err := EncodeHeader(out, outHeader); err != nil {
+		return treeBounds, err
+	}
+
+	if _, err := out.Seek(end, 0); err != nil {
+		return treeBounds, err
+	}
+
+	return root.bounds, nil
+}
@@ -0,0 +1,123 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func collectLeafs(reader io.ReadSeeker, header *OctreeHeader, index NodeIndex, bounds, region Box, leafs map[Box]Color) {
+	var (
+		color    Color
+		children [8]NodeIndex
+	)
+
+	if err := readNodeAt(reader, header, index, &color, children[:]); err != nil {
+		panic(err)
+	}
+
+	numChildren := 0
+	for i, child := range children {
+		if child != 0 {
+			numChildren++
+			if b := childBox(bounds, i); b.IntersectBox(region) {
+				collectLeafs(reader, header, child, b, region, leafs)
+			}
+		}
+	}
+
+	if numChildren == 0 {
+		leafs[bounds] = color
+	}
+}
+
+func testCrop(t *testing.T, region Box, expectedBounds Box, expectedLeafs int) {
+	treeBounds := Box{Point{0, 0, 0}, 80}
+
+	in, err := os.Open("test.oct")
+	if err != nil {
+		panic(err)
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		out.Close()
+		os.Remove(out.Name())
+	}()
+
+	bounds, err := CropTree(in, out, region, treeBounds)
+	if err != nil {
+		panic(err)
+	}
+
+	if bounds != expectedBounds {
+		t.Fatalf("bounds: %v != %v", bounds, expectedBounds)
+	}
+
+	var inHeader, outHeader OctreeHeader
+	in.Seek(0, 0)
+	out.Seek(0, 0)
+
+	if err := DecodeHeader(in, &inHeader); err != nil {
+		panic(err)
+	}
+
+	if err := DecodeHeader(out, &outHeader); err != nil {
+		panic(err)
+	}
+
+	// The tree was built in treeBounds, so the new root keeps its bounds in
+	// world space.
+	if outHeader.Bounds != expectedBounds {
+		t.Errorf("header bounds: %v != %v", outHeader.Bounds, expectedBounds)
+	}
+
+	if outHeader.NumLeafs != uint64(expectedLeafs) {
+		t.Errorf("leafs: %v != %v", outHeader.NumLeafs, expectedLeafs)
+	}
+
+	fullLeafs := make(map[Box]Color)
+	cropLeafs := make(map[Box]Color)
+	collectLeafs(in, &inHeader, 0, treeBounds, region, fullLeafs)
+	collectLeafs(out, &outHeader, 0, bounds, region, cropLeafs)
+
+	if len(fullLeafs) != len(cropLeafs) {
+		t.Fatalf("leafs in region: %v != %v", len(cropLeafs), len(fullLeafs))
+	}
+
+	for b, c := range fullLeafs {
+		if cc, ok := cropLeafs[b]; !ok || cc != c {
+			t.Errorf("leaf %v differs: %v != %v", b, cc, c)
+		}
+	}
+}
+
+func TestCropTree(t *testing.T) {
+	TestBuildTree(t)
+
+	testCrop(t, Box{Point{40, 0, 0}, 40}, Box{Point{40, 0, 0}, 40}, 3)
+	testCrop(t, Box{Point{41, 1, 1}, 8}, Box{Point{40, 0, 0}, 10}, 1)
+	testCrop(t, Box{Point{5, 0, 0}, 30}, Box{Point{0, 0, 0}, 40}, 4)
+}
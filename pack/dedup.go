@@ -0,0 +1,146 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"io"
+	"math"
+)
+
+type (
+	// dedupSample is a sample accepted by a dedupGrid together with the samples
+	// merged into it. added is what it added to the accumulation tree.
+	dedupSample struct {
+		pos   Point
+		voxel [3]int64
+		count int
+		sum   [4]float64
+		added [4]uint64
+	}
+
+	// dedupGrid merges samples closer than the radius to an accepted sample in
+	// the same leaf into it, so points scanned several times count once. The
+	// accepted samples are hashed by position in cells the size of the radius.
+	dedupGrid struct {
+		radius    float64
+		cells     map[[3]int64][]int
+		samples   []dedupSample
+		numMerged uint64
+	}
+)
+
+// newDedupGrid returns an empty grid, nil if cfg.DedupRadius is not above zero.
+func newDedupGrid(cfg *BuildConfig) *dedupGrid {
+	if !(cfg.DedupRadius > 0) {
+		return nil
+	}
+	return &dedupGrid{radius: cfg.DedupRadius, cells: make(map[[3]int64][]int)}
+}
+
+func (g *dedupGrid) cell(p Point) [3]int64 {
+	return [3]int64{int64(math.Floor(p.X / g.radius)), int64(math.Floor(p.Y / g.radius)), int64(math.Floor(p.Z / g.radius))}
+}
+
+// voxel returns the leaf of p in a tree of bounds with voxelRes voxels per axis.
+func voxel(p Point, bounds Box, voxelRes int) [3]int64 {
+	scale := float64(voxelRes) / bounds.Size
+	clamp := func(v float64) int64 {
+		return int64(math.Min(math.Floor(v*scale), float64(voxelRes-1)))
+	}
+	return [3]int64{clamp(p.X - bounds.Pos.X), clamp(p.Y - bounds.Pos.Y), clamp(p.Z - bounds.Pos.Z)}
+}
+
+// find returns the accepted sample closest to p in the same leaf and closer than
+// the radius, or -1.
+func (g *dedupGrid) find(p Point, voxel [3]int64) int {
+	var (
+		c       = g.cell(p)
+		found   = -1
+		minDist = g.radius * g.radius
+	)
+
+	for x := c[0] - 1; x <= c[0]+1; x++ {
+		for y := c[1] - 1; y <= c[1]+1; y++ {
+			for z := c[2] - 1; z <= c[2]+1; z++ {
+				for _, i := range g.cells[[3]int64{x, y, z}] {
+					s := &g.samples[i]
+					if s.voxel != voxel {
+						continue
+					}
+
+					dx, dy, dz := s.pos.X-p.X, s.pos.Y-p.Y, s.pos.Z-p.Z
+					if d := dx*dx + dy*dy + dz*dz; d < minDist {
+						found, minDist = i, d
+					}
+				}
+			}
+		}
+	}
+	return found
+}
+
+// insert inserts sample into the accumulation tree of readWriter, positioned at
+// the root, like insertSample. A sample close to an accepted one is averaged
+// into it instead, the nodes above it get the change of its color but no extra
+// count. Without a grid all samples are inserted.
+func (g *dedupGrid) insert(cfg *BuildConfig, header *OctreeHeader, readWriter io.ReadWriteSeeker, sample Sample, bounds Box, voxelRes int, levels *levelStats) error {
+	if g == nil {
+		return insertSample(cfg, header, readWriter, sample, bounds, voxelRes, levels)
+	}
+
+	color := sampleColor(cfg, sample)
+	if !bounds.containsClosed(sample.Pos) {
+		return accumulateSample(cfg, header, readWriter, sample.Pos, colorSums(color), 1, bounds, voxelRes, levels)
+	}
+
+	leaf := voxel(sample.Pos, bounds, voxelRes)
+	if i := g.find(sample.Pos, leaf); i >= 0 {
+		s := &g.samples[i]
+		s.count++
+		s.sum[0] += float64(color.R)
+		s.sum[1] += float64(color.G)
+		s.sum[2] += float64(color.B)
+		s.sum[3] += float64(color.A)
+
+		n := float64(s.count)
+		added := colorSums(Color{float32(s.sum[0] / n), float32(s.sum[1] / n), float32(s.sum[2] / n), float32(s.sum[3] / n)})
+
+		// The sums wrap around when a channel gets darker, which subtracts.
+		var change [4]uint64
+		for c := range change {
+			change[c] = added[c] - s.added[c]
+		}
+		s.added = added
+
+		g.numMerged++
+		return accumulateSample(cfg, header, readWriter, s.pos, change, 0, bounds, voxelRes, levels)
+	}
+
+	added := colorSums(color)
+	g.samples = append(g.samples, dedupSample{
+		pos:   sample.Pos,
+		voxel: leaf,
+		count: 1,
+		sum:   [4]float64{float64(color.R), float64(color.G), float64(color.B), float64(color.A)},
+		added: added,
+	})
+
+	c := g.cell(sample.Pos)
+	g.cells[c] = append(g.cells[c], len(g.samples)-1)
+	return accumulateSample(cfg, header, readWriter, sample.Pos, added, 1, bounds, voxelRes, levels)
+}
@@ -0,0 +1,249 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// deltaEscape in the red nibble of a delta color marks that the full color follows.
+const deltaEscape = 0x8
+
+// deltaParents holds the quantized color of the first parent of every node that
+// has not been coded yet. Encoder and decoder build the same map so children
+// can be stored relative to their parent.
+type deltaParents map[NodeIndex][4]byte
+
+func (p deltaParents) add(index NodeIndex, color [4]byte, children []NodeIndex) {
+	for _, child := range children {
+		if child <= index {
+			continue
+		}
+		if _, ok := p[child]; !ok {
+			p[child] = color
+		}
+	}
+}
+
+func (p deltaParents) take(index NodeIndex) ([4]byte, bool) {
+	color, ok := p[index]
+	if ok {
+		delete(p, index)
+	}
+	return color, ok
+}
+
+func decodeDelta(reader io.Reader, parents deltaParents, index NodeIndex, color *Color, children []NodeIndex) error {
+	var packed uint16
+	if err := binary.Read(reader, binary.LittleEndian, &packed); err != nil {
+		return err
+	}
+
+	var col [4]byte
+	parent, ok := parents.take(index)
+
+	if packed>>12 == deltaEscape {
+		if _, err := io.ReadFull(reader, col[:]); err != nil {
+			return err
+		}
+	} else {
+		if !ok {
+			return errInvalidFile
+		}
+		for i := range col {
+			delta := int8(packed>>uint(12-i*4)<<4) >> 4
+			col[i] = parent[i] + byte(delta)
+		}
+	}
+
+	color.R = float32(col[0]) / 255
+	color.G = float32(col[1]) / 255
+	color.B = float32(col[2]) / 255
+	color.A = float32(col[3]) / 255
+
+	if err := readIndices(reader, 4, children); err != nil {
+		return err
+	}
+
+	parents.add(index, col, children)
+	return nil
+}
+
+// encodeDelta encodes a node and returns the number of bytes used for its color.
+func encodeDelta(writer io.Writer, parents deltaParents, index NodeIndex, color Color, children []NodeIndex) (int, error) {
+	col := color.bytes()
+	parent, ok := parents.take(index)
+
+	var packed uint16
+	for i := 0; ok && i < len(col); i++ {
+		delta := int(col[i]) - int(parent[i])
+		if delta < -8 || delta > 7 || (i == 0 && delta == -8) {
+			ok = false
+			break
+		}
+		packed |= uint16(delta&0xf) << uint(12-i*4)
+	}
+
+	size := 2
+	if ok {
+		if err := binary.Write(writer, binary.LittleEndian, packed); err != nil {
+			return 0, err
+		}
+	} else {
+		if err := binary.Write(writer, binary.LittleEndian, uint16(deltaEscape<<12)); err != nil {
+			return 0, err
+		}
+		if _, err := writer.Write(col[:]); err != nil {
+			return 0, err
+		}
+		size += len(col)
+	}
+
+	if err := writeIndices(writer, 4, children); err != nil {
+		return 0, err
+	}
+
+	parents.add(index, col, children)
+	return size, nil
+}
+
+// NodeDecoder decodes the nodes of a tree in index order. Unlike DecodePaletteNodeAt
+// it can decode delta formats, where the color of a node depends on its parent.
+type NodeDecoder struct {
+	reader  io.Reader
+	format  OctreeFormat
+	palette Palette
+	parents deltaParents
+	index   NodeIndex
+}
+
+// NewNodeDecoder returns a decoder that reads nodes, starting at index zero, from
+// reader. The palette is only used by palette formats.
+func NewNodeDecoder(reader io.Reader, format OctreeFormat, palette Palette) *NodeDecoder {
+	return &NodeDecoder{
+		reader:  reader,
+		format:  format,
+		palette: palette,
+		parents: make(deltaParents),
+	}
+}
+
+// Decode decodes the next node. Damaged and truncated nodes fail with an
+// ErrCorrupt, with the offset of the node for formats of fixed size nodes.
+func (d *NodeDecoder) Decode(color *Color, children []NodeIndex) error {
+	index := d.index
+	d.index++
+
+	if d.format.Delta() {
+		return d.corruptAt(index, decodeDelta(d.reader, d.parents, index, color, children))
+	}
+	return d.corruptAt(index, DecodePaletteNodeAt(d.reader, d.format, index, d.palette, color, children))
+}
+
+// corruptAt adds the offset of node index to err if it is a corruption.
+func (d *NodeDecoder) corruptAt(index NodeIndex, err error) error {
+	reason := ""
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *ErrCorrupt:
+		if e.Offset >= 0 {
+			return err
+		}
+		reason = e.Reason
+	default:
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		reason = "tree is truncated"
+	}
+
+	offset := int64(-1)
+	if d.format.FixedSize() {
+		offset = int64(index) * int64(d.format.NodeSize())
+	}
+	return &ErrCorrupt{Offset: offset, Reason: reason}
+}
+
+// TranscodeStats reports how much space node colors used in a transcoded tree.
+type TranscodeStats struct {
+	NumNodes   uint64
+	ColorBytes uint64
+	Escaped    uint64
+}
+
+// ColorRatio returns the size of the stored colors relative to storing every
+// color with 8 bits per channel.
+func (s TranscodeStats) ColorRatio() float64 {
+	if s.NumNodes == 0 {
+		return 0
+	}
+	return float64(s.ColorBytes) / float64(s.NumNodes*4)
+}
+
+// NodeEncoder encodes the nodes of a tree in index order. Unlike EncodePaletteNodeAt
+// it can encode delta formats, which requires parents to be encoded before their
+// children. Children that come first have their full color stored.
+type NodeEncoder struct {
+	writer  io.Writer
+	format  OctreeFormat
+	palette Palette
+	parents deltaParents
+	index   NodeIndex
+	stats   TranscodeStats
+}
+
+// NewNodeEncoder returns an encoder that writes nodes, starting at index zero, to
+// writer. The palette is only used by palette formats.
+func NewNodeEncoder(writer io.Writer, format OctreeFormat, palette Palette) *NodeEncoder {
+	return &NodeEncoder{
+		writer:  writer,
+		format:  format,
+		palette: palette,
+		parents: make(deltaParents),
+	}
+}
+
+// Encode encodes the next node.
+func (e *NodeEncoder) Encode(color Color, children []NodeIndex) error {
+	index := e.index
+	e.index++
+
+	size := e.format.ColorSize()
+	if e.format.Delta() {
+		var err error
+		if size, err = encodeDelta(e.writer, e.parents, index, color, children); err != nil {
+			return err
+		}
+		if size > e.format.ColorSize() {
+			e.stats.Escaped++
+		}
+	} else if err := EncodePaletteNodeAt(e.writer, e.format, index, e.palette, color, children); err != nil {
+		return err
+	}
+
+	e.stats.NumNodes++
+	e.stats.ColorBytes += uint64(size)
+	return nil
+}
+
+// Stats returns statistics for the nodes encoded so far.
+func (e *NodeEncoder) Stats() TranscodeStats {
+	return e.stats
+}
@@ -0,0 +1,341 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// maxDiffDepth guards the traversal against trees with cycles.
+const maxDiffDepth = 32
+
+// LeafDiff is a leaf that differs between two trees. The position is given in
+// nodes at Depth, so the cell covers Position to Position+1 at that depth.
+type LeafDiff struct {
+	Depth   int
+	X, Y, Z int64
+	A, B    Color
+}
+
+// TreeDiff describes how two trees differ. Trees are compared by the position
+// of their leafs, not by node layout.
+type TreeDiff struct {
+	HeaderA, HeaderB OctreeHeader
+	HeaderChanges    []string
+
+	// NodesPerLevel holds the number of nodes reached at each depth in both trees.
+	// Shared nodes of optimized trees are counted once per reference.
+	NodesPerLevel [][2]uint64
+
+	OnlyA, OnlyB, Recolored []LeafDiff
+}
+
+// Identical reports if the trees have the same leafs at the same resolution.
+func (d *TreeDiff) Identical() bool {
+	return d.HeaderA.VoxelsPerAxis == d.HeaderB.VoxelsPerAxis &&
+		len(d.OnlyA) == 0 && len(d.OnlyB) == 0 && len(d.Recolored) == 0
+}
+
+type leafDiffs []LeafDiff
+
+func (l leafDiffs) Len() int      { return len(l) }
+func (l leafDiffs) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+func (l leafDiffs) Less(i, j int) bool {
+	a, b := l[i], l[j]
+	if a.Depth != b.Depth {
+		return a.Depth < b.Depth
+	} else if a.X != b.X {
+		return a.X < b.X
+	} else if a.Y != b.Y {
+		return a.Y < b.Y
+	}
+	return a.Z < b.Z
+}
+
+// decodeTree reads all nodes of a tree. Unlike decodeFrameData it accepts any
+// format and compressed trees.
+func decodeTree(reader io.Reader) (*FrameData, error) {
+	data, _, err := decodeTreePalette(reader)
+	return data, err
+}
+
+// decodeTreePalette works like decodeTree but also returns the palette of the tree.
+func decodeTreePalette(reader io.Reader) (*FrameData, Palette, error) {
+	data := &FrameData{}
+	if err := DecodeHeader(reader, &data.Header); err != nil {
+		return nil, nil, err
+	}
+
+	palette, err := DecodePalette(reader, &data.Header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if data.Header.Compressed() == true {
+		readCloser, err := zlib.NewReader(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer readCloser.Close()
+		reader = readCloser
+	}
+
+	numNodes := data.Header.NumNodes
+	data.Colors = make([]Color, numNodes)
+	data.Children = make([][8]NodeIndex, numNodes)
+
+	decoder := NewNodeDecoder(reader, data.Header.Format, palette)
+	for i := range data.Colors {
+		if err := decoder.Decode(&data.Colors[i], data.Children[i][:]); err != nil {
+			return nil, nil, err
+		}
+
+		for _, child := range data.Children[i] {
+			if uint64(child) >= numNodes {
+				return nil, nil, errInvalidFile
+			}
+		}
+	}
+	return data, palette, nil
+}
+
+// leafs returns the color of every leaf by position and counts the nodes at each depth.
+func (data *FrameData) leafs(levels *[][2]uint64, side int) (map[meshCell]Color, error) {
+	leafs := make(map[meshCell]Color)
+	err := data.walkLeafs(levels, side, func(cell meshCell, index NodeIndex) {
+		leafs[cell] = data.Colors[index]
+	})
+	if err != nil {
+		return nil, err
+	}
+	return leafs, nil
+}
+
+// walkLeafs calls fn with the position and node of every leaf and counts the
+// nodes at each depth.
+func (data *FrameData) walkLeafs(levels *[][2]uint64, side int, fn func(cell meshCell, index NodeIndex)) error {
+	if len(data.Colors) == 0 {
+		return nil
+	}
+
+	type item struct {
+		index NodeIndex
+		cell  meshCell
+	}
+
+	stack := []item{{0, meshCell{}}}
+	for len(stack) > 0 {
+		n := len(stack) - 1
+		it := stack[n]
+		stack = stack[:n]
+
+		if it.cell.depth > maxDiffDepth {
+			return errInvalidFile
+		}
+
+		for len(*levels) <= it.cell.depth {
+			*levels = append(*levels, [2]uint64{})
+		}
+		(*levels)[it.cell.depth][side]++
+
+		leaf := true
+		for i, child := range data.Children[it.index] {
+			if child == 0 {
+				continue
+			}
+
+			leaf = false
+			p := childPositions[i]
+			c := meshCell{it.cell.depth + 1, it.cell.x*2 + int64(p.X), it.cell.y*2 + int64(p.Y), it.cell.z*2 + int64(p.Z)}
+			stack = append(stack, item{child, c})
+		}
+
+		if leaf {
+			fn(it.cell, it.index)
+		}
+	}
+	return nil
+}
+
+func diffHeaders(a, b *OctreeHeader) []string {
+	var changes []string
+	compare := func(name string, x, y interface{}) {
+		if x != y {
+			changes = append(changes, fmt.Sprintf("%s: %v != %v", name, x, y))
+		}
+	}
+
+	compare("Version", a.Version, b.Version)
+	compare("Format", a.Format, b.Format)
+	compare("Flags", a.Flags, b.Flags)
+	compare("Coordinates", a.Coordinates, b.Coordinates)
+	compare("NumNodes", a.NumNodes, b.NumNodes)
+	compare("NumLeafs", a.NumLeafs, b.NumLeafs)
+	compare("VoxelsPerAxis", a.VoxelsPerAxis, b.VoxelsPerAxis)
+	return changes
+}
+
+// DiffTrees compares the leafs of two trees. Leafs whose colors are further apart
+// than threshold are reported as recolored. If diffTree is not nil a tree holding
+// the leafs of both trees is written to it, with differing leafs colored red.
+func DiffTrees(a, b io.Reader, threshold float32, diffTree io.Writer) (*TreeDiff, error) {
+	dataA, err := decodeTree(a)
+	if err != nil {
+		return nil, err
+	}
+
+	dataB, err := decodeTree(b)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &TreeDiff{HeaderA: dataA.Header, HeaderB: dataB.Header}
+	diff.HeaderChanges = diffHeaders(&dataA.Header, &dataB.Header)
+
+	leafsA, err := dataA.leafs(&diff.NodesPerLevel, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	leafsB, err := dataB.leafs(&diff.NodesPerLevel, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for cell, colA := range leafsA {
+		d := LeafDiff{cell.depth, cell.x, cell.y, cell.z, colA, Color{}}
+		if colB, ok := leafsB[cell]; !ok {
+			diff.OnlyA = append(diff.OnlyA, d)
+		} else if colA.dist(&colB) > threshold {
+			d.B = colB
+			diff.Recolored = append(diff.Recolored, d)
+		}
+	}
+
+	for cell, colB := range leafsB {
+		if _, ok := leafsA[cell]; !ok {
+			diff.OnlyB = append(diff.OnlyB, LeafDiff{cell.depth, cell.x, cell.y, cell.z, Color{}, colB})
+		}
+	}
+
+	sort.Sort(leafDiffs(diff.OnlyA))
+	sort.Sort(leafDiffs(diff.OnlyB))
+	sort.Sort(leafDiffs(diff.Recolored))
+
+	if diffTree != nil {
+		if err := writeDiffTree(diffTree, diff, leafsA, leafsB); err != nil {
+			return nil, err
+		}
+	}
+	return diff, nil
+}
+
+// writeDiffTree writes the union of both trees. Interior nodes get the average
+// color of their children.
+func writeDiffTree(writer io.Writer, diff *TreeDiff, leafsA, leafsB map[meshCell]Color) error {
+	red := Color{1, 0, 0, 1}
+	colors := make(map[meshCell]Color, len(leafsA)+len(leafsB))
+
+	for cell, col := range leafsB {
+		colors[cell] = col
+	}
+	for cell, col := range leafsA {
+		colors[cell] = col
+	}
+	for _, list := range [][]LeafDiff{diff.OnlyA, diff.OnlyB, diff.Recolored} {
+		for _, d := range list {
+			colors[meshCell{d.Depth, d.X, d.Y, d.Z}] = red
+		}
+	}
+
+	data, _ := cellTree(diff.HeaderA, diff.HeaderB, colors)
+	return data.encode(writer)
+}
+
+// cellTree returns a MipR8G8B8A8UnpackUI32 tree with a leaf of each color at its
+// cell, at the larger resolution of headers a and b, and the nodes of the leafs.
+// Interior nodes get the average color of their children.
+func cellTree(a, b OctreeHeader, colors map[meshCell]Color) (*FrameData, map[meshCell]NodeIndex) {
+	cells := make(leafDiffs, 0, len(colors))
+	for cell := range colors {
+		cells = append(cells, LeafDiff{Depth: cell.depth, X: cell.x, Y: cell.y, Z: cell.z})
+	}
+	sort.Sort(cells)
+
+	header := a
+	if header.VoxelsPerAxis < b.VoxelsPerAxis {
+		header.VoxelsPerAxis = b.VoxelsPerAxis
+	}
+	header.Format = MipR8G8B8A8UnpackUI32
+	header.Flags = 0
+	header.NumLeafs = 0
+
+	data := &FrameData{Header: header}
+	nodes := make(map[meshCell]NodeIndex, len(cells))
+	if len(cells) > 0 {
+		data.Colors = []Color{{}}
+		data.Children = [][8]NodeIndex{{}}
+	}
+
+	for _, cell := range cells {
+		index := NodeIndex(0)
+		for depth := cell.Depth - 1; depth >= 0; depth-- {
+			shift := uint(depth)
+			slot := (cell.X>>shift)&1 | (cell.Y>>shift)&1<<1 | (cell.Z>>shift)&1<<2
+
+			child := data.Children[index][slot]
+			if child == 0 {
+				child = NodeIndex(len(data.Colors))
+				data.Children[index][slot] = child
+				data.Colors = append(data.Colors, Color{})
+				data.Children = append(data.Children, [8]NodeIndex{})
+			}
+			index = child
+		}
+		key := meshCell{cell.Depth, cell.X, cell.Y, cell.Z}
+		data.Colors[index] = colors[key]
+		nodes[key] = index
+	}
+
+	// Children are always stored after their parent.
+	for i := len(data.Colors) - 1; i >= 0; i-- {
+		var (
+			sum Color
+			num float32
+		)
+
+		for _, child := range data.Children[i] {
+			if child != 0 {
+				c := data.Colors[child]
+				sum = Color{sum.R + c.R, sum.G + c.G, sum.B + c.B, sum.A + c.A}
+				num++
+			}
+		}
+
+		if num > 0 {
+			data.Colors[i] = Color{sum.R / num, sum.G / num, sum.B / num, sum.A / num}
+		} else {
+			data.Header.NumLeafs++
+		}
+	}
+	return data, nodes
+}
@@ -0,0 +1,122 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func encodeFrameData(data *FrameData) []byte {
+	var buffer bytes.Buffer
+	if err := data.encode(&buffer); err != nil {
+		panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestDiffTreesLayout(t *testing.T) {
+	TestBuildTree(t)
+
+	original, err := ioutil.ReadFile("test.oct")
+	if err != nil {
+		panic(err)
+	}
+
+	var relative bytes.Buffer
+	if err := TranscodeTree(bytes.NewReader(original), &relative, MipR8G8B8A8RelativeUI16); err != nil {
+		panic(err)
+	}
+
+	diff, err := DiffTrees(bytes.NewReader(original), &relative, 0, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	if !diff.Identical() {
+		t.Errorf("trees differ: %+v", diff)
+	}
+
+	if len(diff.HeaderChanges) != 1 {
+		t.Errorf("expected a format change: %v", diff.HeaderChanges)
+	}
+}
+
+func TestDiffTrees(t *testing.T) {
+	gray := Color{0.5, 0.5, 0.5, 1}
+	header := NewOctreeHeader(MipR8G8B8A8UnpackUI32, 2)
+
+	a := encodeFrameData(&FrameData{
+		Header:   header,
+		Colors:   []Color{gray, gray, gray, gray},
+		Children: [][8]NodeIndex{{1, 2, 3}, {}, {}, {}},
+	})
+
+	b := encodeFrameData(&FrameData{
+		Header:   header,
+		Colors:   []Color{gray, gray, {0, 0, 1, 1}, gray},
+		Children: [][8]NodeIndex{{1, 2, 0, 0, 3}, {}, {}, {}},
+	})
+
+	var diffTree bytes.Buffer
+	diff, err := DiffTrees(bytes.NewReader(a), bytes.NewReader(b), 0.01, &diffTree)
+	if err != nil {
+		panic(err)
+	}
+
+	if diff.Identical() {
+		t.Error("trees should differ")
+	}
+
+	if len(diff.OnlyA) != 1 || diff.OnlyA[0].X != 0 || diff.OnlyA[0].Y != 1 {
+		t.Errorf("unexpected leafs only in a: %+v", diff.OnlyA)
+	}
+
+	if len(diff.OnlyB) != 1 || diff.OnlyB[0].Z != 1 {
+		t.Errorf("unexpected leafs only in b: %+v", diff.OnlyB)
+	}
+
+	if len(diff.Recolored) != 1 || diff.Recolored[0].X != 1 {
+		t.Errorf("unexpected recolored leafs: %+v", diff.Recolored)
+	}
+
+	if len(diff.NodesPerLevel) != 2 || diff.NodesPerLevel[1] != [2]uint64{3, 3} {
+		t.Errorf("unexpected nodes per level: %v", diff.NodesPerLevel)
+	}
+
+	data, err := decodeTree(&diffTree)
+	if err != nil {
+		panic(err)
+	}
+
+	if data.Header.NumNodes != 5 || data.Header.NumLeafs != 4 {
+		t.Errorf("unexpected diff tree: %+v", data.Header)
+	}
+
+	var red int
+	for i, col := range data.Colors {
+		if i > 0 && col == (Color{1, 0, 0, 1}) {
+			red++
+		}
+	}
+
+	if red != 3 {
+		t.Errorf("expected three red leafs, got %v", red)
+	}
+}
@@ -17,12 +17,137 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
 package pack
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var (
+	// ErrBadMagic is returned when a file does not start with the signature of
+	// its kind, it is most likely some other kind of file.
+	ErrBadMagic = errors.New("bad file signature")
+
+	// ErrUnsupportedFormat is returned for files in a format, version or variant
+	// this package can not read or write. The errors of unsupported versions
+	// match it with errors.Is.
+	ErrUnsupportedFormat = errors.New("unsupported octree-format")
+)
 
 var (
-	errUnsupportedFormat = errors.New("unsupported octree-format")
-	errInvalidFile       = errors.New("invalid file")
-	errOctreeOverflow    = errors.New("octree-format overflow")
-	errVoxelsPowerOfTwo  = errors.New("voxels must be a power of two")
-	errInputIsCompressed = errors.New("input is compressed")
+	errInvalidFile        = corrupt("invalid file")
+	errOctreeOverflow     = errors.New("octree-format overflow")
+	errVoxelsPowerOfTwo   = errors.New("voxels must be a power of two")
+	errInputIsCompressed  = errors.New("input is compressed")
+	errEmptyRegion        = errors.New("region does not intersect tree")
+	errInvalidLayout      = errors.New("invalid layout")
+	errInvalidFrame       = errors.New("invalid frame")
+	errInvalidMeshFormat  = errors.New("invalid mesh format")
+	errInvalidMesh        = errors.New("invalid mesh")
+	errMissingPalette     = errors.New("missing palette")
+	errInvalidPalette     = errors.New("invalid palette")
+	errInvalidCellLevel   = errors.New("cells are smaller than a voxel")
+	errDeltaFormat        = errors.New("delta format must be coded in index order")
+	errUnbufferedReader   = errors.New("compressed trees must be read from an io.ByteReader")
+	errWorkerClosed       = errors.New("worker closed the sample channel")
+	errUnsupportedVersion = unsupported("unsupported octree version")
+	errNodeFlags          = errors.New("invalid node flags")
+	errInvalidVoxFile     = errors.New("invalid vox file")
+	errInvalidOffset      = errors.New("negative offset")
+	errInvalidTileSize    = errors.New("tile size must be a power of two")
+	errTooManyWorkers     = errors.New("too many workers, at most 64")
+	errSidecarDepth       = errors.New("sidecars are limited to trees with at most 2^21 voxels per axis")
+	errInvalidSidecar     = errors.New("invalid sidecar")
+	errUnsupportedSidecar = unsupported("unsupported sidecar format")
+	errUnknownCoordinates = errors.New("unknown coordinate system")
+	errNonFiniteBounds    = errors.New("bounds are not finite")
+	errInvertedBounds     = errors.New("bounds have a negative size, the position is their min corner")
+	errInvalidMinExtent   = errors.New("min extent is not a positive number")
+	errInvalidGeoRef      = errors.New("geo reference has a non-finite origin or a zero scale")
+	errLongCRS            = errors.New("coordinate reference system name is longer than 65535 bytes")
+	errInvalidChunkSize   = errors.New("chunk size is negative")
+	errInvalidManifest    = errors.New("invalid chunk manifest")
+
+	errInvalidTextColor    = errors.New("expected a color like #rrggbbaa")
+	errInvalidTextChildren = errors.New("expected 8 children")
 )
+
+// ErrCorrupt is returned when the data of a file breaks its format. Offset is the
+// byte offset of the node the damage was found in, counted from the first node
+// byte like for ErrChecksumMismatch, or -1 if it is not known. Offsets are only
+// known for formats with nodes of a fixed size.
+type ErrCorrupt struct {
+	Offset int64
+	Reason string
+}
+
+func (e *ErrCorrupt) Error() string {
+	if e.Offset < 0 {
+		return e.Reason
+	}
+	return fmt.Sprintf("%s at node byte %d", e.Reason, e.Offset)
+}
+
+func corrupt(reason string) error {
+	return &ErrCorrupt{Offset: -1, Reason: reason}
+}
+
+// unsupported is an error that is more specific than ErrUnsupportedFormat.
+type unsupported string
+
+func (e unsupported) Error() string {
+	return string(e)
+}
+
+func (e unsupported) Is(target error) bool {
+	return target == ErrUnsupportedFormat
+}
+
+// ErrWorkerFailed is returned by BuildTree when a worker fails. WorkerIndex is the
+// index of the worker in BuildConfig.Workers, zero for builds with a single
+// worker. Err is the error of the worker, or the reason it was stopped if it
+// panicked or closed the sample channel.
+type ErrWorkerFailed struct {
+	WorkerIndex int
+	Err         error
+}
+
+func (e *ErrWorkerFailed) Error() string {
+	return fmt.Sprintf("worker %d failed: %v", e.WorkerIndex, e.Err)
+}
+
+func (e *ErrWorkerFailed) Unwrap() error {
+	return e.Err
+}
+
+// Exit codes of the command line tools, see ExitCode.
+const (
+	ExitFailure = 2 + iota
+	ExitNotFound
+	ExitUnsupported
+	ExitCorrupt
+	ExitWorkerFailed
+)
+
+// ExitCode returns the exit code for a command line tool that failed with err.
+// Missing files, unsupported or corrupt files and failed workers have codes of
+// their own, other errors exit with ExitFailure. Truncated files are corrupt.
+func ExitCode(err error) int {
+	var (
+		corrupt *ErrCorrupt
+		worker  *ErrWorkerFailed
+	)
+
+	switch {
+	case errors.As(err, &worker):
+		return ExitWorkerFailed
+	case errors.Is(err, os.ErrNotExist):
+		return ExitNotFound
+	case errors.Is(err, ErrBadMagic), errors.Is(err, ErrUnsupportedFormat):
+		return ExitUnsupported
+	case errors.As(err, &corrupt), errors.Is(err, io.ErrUnexpectedEOF):
+		return ExitCorrupt
+	}
+	return ExitFailure
+}
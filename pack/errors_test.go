@@ -0,0 +1,99 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestBadMagic(t *testing.T) {
+	var header OctreeHeader
+	if err := DecodeHeader(bytes.NewReader([]byte("not a tree")), &header); !errors.Is(err, ErrBadMagic) || ExitCode(err) != ExitUnsupported {
+		t.Errorf("expected ErrBadMagic, got %v", err)
+	}
+	if _, err := OpenSequence(bytes.NewReader(solidTree())); !errors.Is(err, ErrBadMagic) {
+		t.Errorf("expected ErrBadMagic for a tree opened as a sequence, got %v", err)
+	}
+	if _, _, err := readVox(bytes.NewReader(solidTree())); !errors.Is(err, ErrBadMagic) {
+		t.Errorf("expected ErrBadMagic for a tree read as a vox file, got %v", err)
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	data := solidTree()
+	data[4] = binaryVersion + 1
+
+	var header OctreeHeader
+	err := DecodeHeader(bytes.NewReader(data), &header)
+	if !errors.Is(err, ErrUnsupportedFormat) || err.Error() != "unsupported octree version" {
+		t.Errorf("expected an unsupported version, got %v", err)
+	}
+}
+
+func TestCorruptNodes(t *testing.T) {
+	data := solidTree()
+	format := MipR8G8B8A8UnpackUI32
+	nodeSize := int64(format.NodeSize())
+
+	var header OctreeHeader
+	reader := bytes.NewReader(data[:int64(len(data))-nodeSize*5-1])
+	if err := DecodeHeader(reader, &header); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		color    Color
+		children [8]NodeIndex
+		err      error
+	)
+	decoder := NewNodeDecoder(reader, header.Format, nil)
+	for i := uint64(0); i < header.NumNodes && err == nil; i++ {
+		err = decoder.Decode(&color, children[:])
+	}
+
+	// The fourth node is cut short.
+	var corrupt *ErrCorrupt
+	if !errors.As(err, &corrupt) || corrupt.Offset != 3*nodeSize || ExitCode(err) != ExitCorrupt {
+		t.Fatalf("expected node 3 to be corrupt, got %v", err)
+	}
+
+	mismatch := error(&ErrChecksumMismatch{Offset: 1 << 20, Size: 100})
+	if !errors.As(mismatch, &corrupt) || corrupt.Offset != 1<<20 {
+		t.Errorf("expected checksum mismatches to be corrupt, got %v", corrupt)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	_, err := os.Open("missing.oct")
+	for _, test := range []struct {
+		err  error
+		code int
+	}{
+		{err, ExitNotFound},
+		{errors.New("failed"), ExitFailure},
+		{errInvalidFile, ExitCorrupt},
+		{&ErrWorkerFailed{2, errInvalidFile}, ExitWorkerFailed},
+	} {
+		if code := ExitCode(test.err); code != test.code {
+			t.Errorf("%v: expected exit code %d, got %d", test.err, test.code, code)
+		}
+	}
+}
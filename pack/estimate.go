@@ -0,0 +1,231 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"math"
+	"math/bits"
+)
+
+// defaultEstimateLevels is the number of levels counted by a dry run if
+// BuildConfig.EstimateLevels is zero.
+const defaultEstimateLevels = 6
+
+// maxEstimateLevels keeps the path of a counted node within 64 bits.
+const maxEstimateLevels = 21
+
+// CountHint is implemented by cell workers that can tell how many samples are
+// inside a region without producing them. Dry runs use it to count the occupied
+// nodes of the top levels.
+type CountHint interface {
+	SampleCount(region Box) (uint64, bool)
+}
+
+// BuildEstimate is the result of a dry run. Levels holds the number of nodes of
+// every level, root first. The first Counted levels are counted from the input,
+// the rest are extrapolated from the branching of the last counted level and
+// capped by the number of samples. The estimate is exact for dense volumes and
+// flat surfaces and meant as order of magnitude guidance otherwise. Optimization
+// and compression are not taken into account.
+type BuildEstimate struct {
+	Samples  uint64
+	Levels   []uint64
+	Counted  int
+	NumNodes uint64
+	NumLeafs uint64
+
+	// Bytes is the size of the tree in the requested format. For formats that are
+	// not fixed size it is an upper bound.
+	Bytes uint64
+}
+
+func estimateTree(cfg *BuildConfig) (BuildEstimate, error) {
+	var est BuildEstimate
+
+	depth := bits.TrailingZeros64(uint64(cfg.VoxelsPerAxis))
+	levels := cfg.EstimateLevels
+	if levels <= 0 {
+		levels = defaultEstimateLevels
+	}
+	if levels > maxEstimateLevels {
+		levels = maxEstimateLevels
+	}
+	if levels > depth {
+		levels = depth
+	}
+
+	counts, samples, err := countHinted(cfg, levels)
+	if counts == nil && err == nil {
+		counts, samples, err = countSampled(cfg, levels)
+	}
+	if err != nil {
+		return est, err
+	}
+
+	est.Samples = samples
+	est.Counted = len(counts)
+	est.Levels = extrapolateLevels(counts, depth, samples)
+
+	for _, n := range est.Levels {
+		est.NumNodes += n
+	}
+	est.NumLeafs = est.Levels[depth]
+
+	header := NewOctreeHeader(cfg.Format, cfg.VoxelsPerAxis)
+	est.Bytes = uint64(header.Size()) + est.NumNodes*uint64(cfg.Format.NodeSize())
+	if cfg.Format.Paletted() {
+		est.Bytes += 2 + 4*uint64(len(cfg.Palette))
+	}
+	return est, nil
+}
+
+// countHinted counts the occupied nodes of the top levels by querying the count
+// hint of the cell worker. Nil is returned if there is no hint or it does not
+// know a region.
+func countHinted(cfg *BuildConfig, levels int) ([]uint64, uint64, error) {
+	hint, ok := cfg.Cells.(CountHint)
+	if !ok {
+		return nil, 0, nil
+	}
+
+	samples, ok := hint.SampleCount(cfg.Coordinates.FromTreeBox(cfg.Bounds))
+	if !ok {
+		return nil, 0, nil
+	}
+
+	nodes := []Box{cfg.Bounds}
+	counts := []uint64{1}
+	if samples == 0 {
+		counts[0] = 0
+		nodes = nil
+	}
+
+	for level := 1; level <= levels; level++ {
+		var next []Box
+		for _, node := range nodes {
+			for i := range childPositions {
+				child := childBox(node, i)
+				n, ok := hint.SampleCount(cfg.Coordinates.FromTreeBox(child))
+				if !ok {
+					return nil, 0, nil
+				}
+				if n > 0 {
+					next = append(next, child)
+				}
+			}
+		}
+		nodes = next
+		counts = append(counts, uint64(len(nodes)))
+	}
+	return counts, samples, nil
+}
+
+// countSampled counts the occupied nodes of the top levels by streaming all
+// samples of the build. The nodes are only kept as sets of paths.
+func countSampled(cfg *BuildConfig, levels int) ([]uint64, uint64, error) {
+	occupied := make([]map[uint64]struct{}, levels+1)
+	for i := range occupied {
+		occupied[i] = make(map[uint64]struct{})
+	}
+
+	var samples uint64
+	insert := func(pos Point) {
+		bounds := cfg.Bounds
+		if !bounds.containsClosed(pos) {
+			return
+		}
+
+		samples++
+		var path uint64
+		occupied[0][path] = struct{}{}
+
+		for level := 1; level <= levels; level++ {
+			i := childIndex(bounds, pos)
+			bounds = childBox(bounds, i)
+			path = path<<3 | uint64(i)
+			occupied[level][path] = struct{}{}
+		}
+	}
+
+	consume := func(stream *sampleStream, cell *buildCell) error {
+		defer stream.Close()
+
+		for {
+			samp, more := stream.Pop()
+			if more == false {
+				break
+			}
+
+			// Cell workers may produce samples outside their cell, buildCells skips them.
+			if cell != nil {
+				if b, ok := CellOf(cfg.Bounds, len(cell.path), samp.Pos); !ok || b != cell.bounds {
+					continue
+				}
+			}
+			insert(samp.Pos)
+		}
+		return stream.Err()
+	}
+
+	if cfg.Cells != nil {
+		cellLevel := cfg.CellLevel
+		if cellLevel <= 0 {
+			cellLevel = 1
+		}
+
+		for _, cell := range collectCells(cfg.Bounds, cellLevel, nil, nil) {
+			if err := consume(cellStream(cfg, cell.bounds), &cell); err != nil {
+				return nil, 0, err
+			}
+		}
+	} else if err := consume(workerStream(cfg), nil); err != nil {
+		return nil, 0, err
+	}
+
+	counts := make([]uint64, len(occupied))
+	for i, nodes := range occupied {
+		counts[i] = uint64(len(nodes))
+	}
+	return counts, samples, nil
+}
+
+// extrapolateLevels continues the counted levels down to depth with the branching
+// factor of the last counted level. No level can have more nodes than there are
+// samples or than fit in it.
+func extrapolateLevels(counts []uint64, depth int, samples uint64) []uint64 {
+	levels := make([]uint64, depth+1)
+	copy(levels, counts)
+
+	last := len(counts) - 1
+	branching := 8.0
+	if last > 0 && counts[last-1] > 0 {
+		branching = float64(counts[last]) / float64(counts[last-1])
+	}
+
+	for level := last + 1; level <= depth; level++ {
+		n := math.Round(float64(levels[level-1]) * branching)
+		if full := math.Pow(8, float64(level)); n > full {
+			n = full
+		}
+		if n > float64(samples) {
+			n = float64(samples)
+		}
+		levels[level] = uint64(n)
+	}
+	return levels
+}
@@ -0,0 +1,167 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"testing"
+)
+
+// uniformSamples returns one sample in the center of every voxel of a cube with
+// vpa voxels per axis. If flat is set only the bottom layer is returned.
+func uniformSamples(vpa int, flat bool) []Sample {
+	layers := vpa
+	if flat {
+		layers = 1
+	}
+
+	var samples []Sample
+	for z := 0; z < vpa; z++ {
+		for y := 0; y < layers; y++ {
+			for x := 0; x < vpa; x++ {
+				pos := Point{float64(x) + 0.5, float64(y) + 0.5, float64(z) + 0.5}
+				samples = append(samples, Sample{pos, Color{1, 1, 1, 1}})
+			}
+		}
+	}
+	return samples
+}
+
+// uniformCells is a cell worker over uniformSamples with an exact count hint.
+type uniformCells struct {
+	samples []Sample
+	queries int
+}
+
+func (c *uniformCells) Region(cell Box) BuildWorker {
+	var inside []Sample
+	for _, s := range c.samples {
+		if cell.ContainsPoint(s.Pos) {
+			inside = append(inside, s)
+		}
+	}
+	return NewFakeWorker(inside)
+}
+
+func (c *uniformCells) SampleCount(region Box) (uint64, bool) {
+	c.queries++
+	var n uint64
+	for _, s := range c.samples {
+		if region.ContainsPoint(s.Pos) {
+			n++
+		}
+	}
+	return n, true
+}
+
+func TestBuildEstimate(t *testing.T) {
+	const vpa = 16
+
+	for _, flat := range []bool{false, true} {
+		samples := uniformSamples(vpa, flat)
+
+		var tree bytes.Buffer
+		build := BuildConfig{
+			Worker:        NewFakeWorker(samples),
+			Writer:        &tree,
+			Bounds:        Box{Point{0, 0, 0}, vpa},
+			VoxelsPerAxis: vpa,
+			Format:        MipR8G8B8A8PackUI28,
+		}
+
+		if _, err := BuildTree(&build); err != nil {
+			panic(err)
+		}
+
+		var header OctreeHeader
+		if err := DecodeHeader(bytes.NewReader(tree.Bytes()), &header); err != nil {
+			panic(err)
+		}
+
+		var untouched bytes.Buffer
+		dry := build
+		dry.Worker = NewFakeWorker(samples)
+		dry.Writer = &untouched
+		dry.DryRun = true
+		dry.EstimateLevels = 2
+
+		status, err := BuildTree(&dry)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		est := status.Estimate
+		if untouched.Len() != 0 {
+			t.Error("dry run wrote to the writer")
+		}
+
+		if est.Counted != 3 || len(est.Levels) != 5 {
+			t.Errorf("expected 3 of 5 levels counted, got %v of %v", est.Counted, len(est.Levels))
+		}
+
+		if est.Samples != uint64(len(samples)) {
+			t.Errorf("expected %v samples, got %v", len(samples), est.Samples)
+		}
+
+		if est.NumNodes != header.NumNodes {
+			t.Errorf("flat %v: expected %v nodes, got %v", flat, header.NumNodes, est.NumNodes)
+		}
+
+		if est.NumLeafs != uint64(len(samples)) {
+			t.Errorf("flat %v: expected %v leafs, got %v", flat, len(samples), est.NumLeafs)
+		}
+
+		if est.Bytes != uint64(tree.Len()) {
+			t.Errorf("flat %v: expected %v bytes, got %v", flat, tree.Len(), est.Bytes)
+		}
+	}
+}
+
+func TestBuildEstimateHint(t *testing.T) {
+	const vpa = 8
+
+	cells := &uniformCells{samples: uniformSamples(vpa, false)}
+	cfg := BuildConfig{
+		Cells:          cells,
+		Bounds:         Box{Point{0, 0, 0}, vpa},
+		VoxelsPerAxis:  vpa,
+		Format:         MipR8G8B8A8UnpackUI32,
+		DryRun:         true,
+		EstimateLevels: 1,
+	}
+
+	status, err := BuildTree(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cells.queries != 9 {
+		t.Errorf("expected 9 count queries, got %v", cells.queries)
+	}
+
+	expected := []uint64{1, 8, 64, 512}
+	for i, n := range status.Estimate.Levels {
+		if n != expected[i] {
+			t.Errorf("level %v: expected %v nodes, got %v", i, expected[i], n)
+		}
+	}
+
+	if status.Estimate.NumNodes != 585 {
+		t.Errorf("expected 585 nodes, got %v", status.Estimate.NumNodes)
+	}
+}
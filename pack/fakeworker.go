@@ -0,0 +1,124 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// lateSampleWait is how long VerifyWorker waits for samples sent after the worker
+// has returned.
+const lateSampleWait = 50 * time.Millisecond
+
+// WorkerTester is the part of testing.TB used by VerifyWorker.
+type WorkerTester interface {
+	Errorf(format string, args ...interface{})
+}
+
+// NewFakeWorker returns a worker that sends samples in order. It is meant for tests
+// of code that builds trees.
+func NewFakeWorker(samples []Sample) BuildWorker {
+	return func(out chan<- Sample) error {
+		for _, s := range samples {
+			out <- s
+		}
+		return nil
+	}
+}
+
+// VerifyWorker runs worker once and reports every way it breaks the contract of
+// BuildWorker to t. The samples are received from an unbuffered channel so workers
+// relying on buffering block. Samples must have finite positions and colors in
+// [0, 1]. It returns the number of samples received.
+func VerifyWorker(t WorkerTester, worker BuildWorker) int {
+	var (
+		samples = make(chan Sample)
+		done    = make(chan error, 1)
+	)
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("worker panicked: %v", r)
+			}
+		}()
+		done <- worker(samples)
+	}()
+
+	var (
+		num int
+		err error
+	)
+
+	check := func(s Sample) {
+		num++
+		if !finitePoint(s.Pos) {
+			t.Errorf("sample %d has position %v", num, s.Pos)
+		}
+
+		for _, c := range [...]float32{s.Col.R, s.Col.G, s.Col.B, s.Col.A} {
+			if !(c >= 0 && c <= 1) {
+				t.Errorf("sample %d has color %v outside of [0, 1]", num, s.Col)
+				break
+			}
+		}
+	}
+
+receive:
+	for {
+		select {
+		case s, ok := <-samples:
+			if !ok {
+				t.Errorf("worker closed the sample channel")
+				if err := <-done; err != nil {
+					t.Errorf("worker failed: %v", err)
+				}
+				return num
+			}
+			check(s)
+		case err = <-done:
+			break receive
+		}
+	}
+
+	if err != nil {
+		t.Errorf("worker failed: %v", err)
+	}
+
+	select {
+	case _, ok := <-samples:
+		if ok {
+			t.Errorf("worker sent samples after it returned")
+		} else {
+			t.Errorf("worker closed the sample channel")
+		}
+	case <-time.After(lateSampleWait):
+	}
+	return num
+}
+
+func finitePoint(p Point) bool {
+	for _, v := range [...]float64{p.X, p.Y, p.Z} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// workerReport collects the errors of VerifyWorker.
+type workerReport []string
+
+func (r *workerReport) Errorf(format string, args ...interface{}) {
+	*r = append(*r, fmt.Sprintf(format, args...))
+}
+
+func TestVerifyWorker(t *testing.T) {
+	white := Color{1, 1, 1, 1}
+	samples := []Sample{{Point{0.5, 0.5, 0.5}, white}, {Point{1.5, 0.5, 0.5}, white}}
+
+	if n := VerifyWorker(t, NewFakeWorker(samples)); n != len(samples) {
+		t.Errorf("expected %d samples, got %d", len(samples), n)
+	}
+
+	workers := map[string]BuildWorker{
+		"closed": func(out chan<- Sample) error {
+			out <- samples[0]
+			close(out)
+			return nil
+		},
+		"after it returned": func(out chan<- Sample) error {
+			go func() {
+				time.Sleep(time.Millisecond)
+				out <- samples[0]
+			}()
+			return nil
+		},
+		"panicked": func(out chan<- Sample) error {
+			panic("broken worker")
+		},
+		"position": NewFakeWorker([]Sample{{Point{math.NaN(), 0, 0}, white}}),
+		"color":    NewFakeWorker([]Sample{{Point{}, Color{2, 0, 0, 1}}}),
+	}
+
+	for expected, worker := range workers {
+		var report workerReport
+		VerifyWorker(&report, worker)
+
+		if len(report) != 1 || !strings.Contains(report[0], expected) {
+			t.Errorf("expected an error about %q, got %q", expected, report)
+		}
+	}
+}
+
+func TestBuildTreeBrokenWorker(t *testing.T) {
+	white := Color{1, 1, 1, 1}
+	workers := map[string]BuildWorker{
+		"closed": func(out chan<- Sample) error {
+			out <- Sample{Point{0.5, 0.5, 0.5}, white}
+			close(out)
+			return nil
+		},
+		"closed and sent": func(out chan<- Sample) error {
+			close(out)
+			out <- Sample{Point{0.5, 0.5, 0.5}, white}
+			return nil
+		},
+		"panicked": func(out chan<- Sample) error {
+			panic("broken worker")
+		},
+	}
+
+	for name, worker := range workers {
+		cfg := BuildConfig{
+			Worker:        worker,
+			Writer:        ioutil.Discard,
+			Bounds:        Box{Point{0, 0, 0}, 1},
+			VoxelsPerAxis: 2,
+			Format:        MipR8G8B8A8UnpackUI32,
+		}
+
+		if _, err := BuildTree(&cfg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
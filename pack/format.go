@@ -18,57 +18,156 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package pack
 
 import (
+	"bytes"
 	"compress/zlib"
 	"encoding/binary"
 	"io"
+	"io/ioutil"
 	"math"
 )
 
 type OctreeFormat byte
 
+// Node sizes are given in bytes.
 const (
-	MipR8G8B8A8UnpackUI32 OctreeFormat = iota
-	MipR8G8B8A8UnpackUI16
-	MipR4G4B4A4UnpackUI16
-	MipR5G6B5UnpackUI16
-
-	MipR8G8B8A8PackUI28
-	MipR4G4B4A4PackUI30
-	MipR5G6B5PackUI30
-	MipR3G3B2PackUI31
+	MipR8G8B8A8UnpackUI32 OctreeFormat = iota // 36
+	MipR8G8B8A8UnpackUI16                     // 20
+	MipR4G4B4A4UnpackUI16                     // 18
+	MipR5G6B5UnpackUI16                       // 18
+
+	MipR8G8B8A8PackUI28 // 32
+	MipR4G4B4A4PackUI30 // 32
+	MipR5G6B5PackUI30   // 32
+	MipR3G3B2PackUI31   // 32
+
+	// MipR8G8B8A8RelativeUI16 stores a child mask followed by 16-bit child offsets
+	// relative to the node index. Children that are not within reach are escaped
+	// and stored as absolute 32-bit indices. A node is 5 bytes plus 2 bytes per
+	// child and 4 extra bytes per escaped child, 53 bytes at most. This format
+	// works best on trees stored in depth-first or breadth-first order.
+	MipR8G8B8A8RelativeUI16
+
+	// Palette formats store a one byte index into the color table that follows
+	// the header of the tree.
+	MipP8UnpackUI32 // 33
+	MipP8UnpackUI16 // 17
+
+	// MipR8G8B8A8DeltaUI32 stores colors as signed 4-bit per channel deltas from
+	// the color of the first parent, followed by 32-bit child indices. Colors that
+	// are out of reach, or whose parent is stored after them, are escaped and stored
+	// in full. A node is 34 bytes and 38 bytes when escaped. Trees in this format
+	// must be decoded in index order with a NodeDecoder.
+	MipR8G8B8A8DeltaUI32
+
+	// MipR8G8B8A8UnpackUI64 stores 64-bit child indices, for trees with more
+	// nodes than fit in 32 bits. A node is 68 bytes.
+	MipR8G8B8A8UnpackUI64
+
+	// MipR8G8B8A8FlagsUI32 stores a byte of NodeFlags after the color, followed by
+	// 32-bit child indices. Leafs are marked explicitly instead of being inferred
+	// from their child indices. A node is 37 bytes.
+	MipR8G8B8A8FlagsUI32
 
 	// Internal formats
-	mipR64G64B64A64S64UnpackUI32
+	mipR64G64B64A64S64UnpackUI64
 )
 
 const (
 	maxUint31 = 1<<31 - 1
 	maxUint30 = 1<<30 - 1
 	maxUint28 = 1<<28 - 1
+
+	relativeEscape = 0xffff
 )
 
 var (
-	formatColorSize = [...]int{4, 4, 2, 2, 0, 0, 0, 0, 40}
-	formatIndexSize = [...]int{4, 2, 2, 2, 4, 4, 4, 4, 4}
+	formatColorSize = [...]int{4, 4, 2, 2, 0, 0, 0, 0, 4, 1, 1, 2, 4, 4, 40}
+	formatIndexSize = [...]int{4, 2, 2, 2, 4, 4, 4, 4, 2, 4, 2, 4, 8, 4, 8}
+	formatMaxIndex  = [...]NodeIndex{
+		math.MaxUint32, math.MaxUint16, math.MaxUint16, math.MaxUint16,
+		maxUint28, maxUint30, maxUint30, maxUint31,
+		math.MaxUint32, math.MaxUint32, math.MaxUint16, math.MaxUint32,
+		math.MaxUint64, math.MaxUint32, math.MaxUint64,
+	}
 )
 
+// NodeIndex is the index of a node in the node array of a tree. All code doing
+// index math uses it, formats with narrower indices are checked on encode.
+type NodeIndex uint64
+
+// IndexSize returns the number of bytes used to store a child index. Packed
+// formats share the bytes with the color.
 func (f OctreeFormat) IndexSize() int {
 	return formatIndexSize[f]
 }
 
+// MaxIndex returns the largest child index the format can store.
+func (f OctreeFormat) MaxIndex() NodeIndex {
+	return formatMaxIndex[f]
+}
+
 func (f OctreeFormat) ColorSize() int {
 	return formatColorSize[f]
 }
 
+// NodeSize returns the size of a node in bytes. For formats that are not
+// fixed size this is the maximum size of a node.
 func (f OctreeFormat) NodeSize() int {
+	if f == MipR8G8B8A8RelativeUI16 {
+		return formatColorSize[f] + 1 + (formatIndexSize[f]+4)*8
+	} else if f == MipR8G8B8A8DeltaUI32 {
+		return formatColorSize[f] + 4 + formatIndexSize[f]*8
+	} else if f.HasNodeFlags() {
+		return formatColorSize[f] + 1 + formatIndexSize[f]*8
+	}
 	return formatColorSize[f] + formatIndexSize[f]*8
 }
 
+// MinNodeSize returns the size of the smallest node in bytes. It is the node size
+// of fixed size formats.
+func (f OctreeFormat) MinNodeSize() int {
+	if f == MipR8G8B8A8RelativeUI16 {
+		return formatColorSize[f] + 1
+	} else if f == MipR8G8B8A8DeltaUI32 {
+		return 2 + formatIndexSize[f]*8
+	}
+	return f.NodeSize()
+}
+
+// FixedSize reports if all nodes have the same size. Only trees with fixed size
+// nodes can be accessed randomly.
+func (f OctreeFormat) FixedSize() bool {
+	return f != MipR8G8B8A8RelativeUI16 && f != MipR8G8B8A8DeltaUI32
+}
+
+// Delta reports if node colors are stored relative to the parent node.
+func (f OctreeFormat) Delta() bool {
+	return f == MipR8G8B8A8DeltaUI32
+}
+
+// Paletted reports if nodes store an index into the palette of the tree.
+func (f OctreeFormat) Paletted() bool {
+	return f == MipP8UnpackUI32 || f == MipP8UnpackUI16
+}
+
+// HasAlpha reports if node colors store alpha. Formats without it decode alpha as
+// one.
+func (f OctreeFormat) HasAlpha() bool {
+	return f != MipR5G6B5UnpackUI16 && f != MipR5G6B5PackUI30 && f != MipR3G3B2PackUI31
+}
+
 const (
-	binaryVersion  byte = 0x0
+	// binaryVersion is the version of new trees. Trees of version 1 and later
+	// store their world bounds in the header, formats with node flags need
+	// version 2 and geo references version 3.
+	binaryVersion  byte = 0x3
 	endianMask     byte = 0x1
 	compressedMask byte = 0x2
 	optimizedMask  byte = 0x4
+	coverageMask   byte = 0x8
+	paletteMask    byte = 0x10
+	checksumMask   byte = 0x20
+	geoMask        byte = 0x40
 )
 
 type OctreeHeader struct {
@@ -76,14 +175,60 @@ type OctreeHeader struct {
 	Version       byte
 	Format        OctreeFormat
 	Flags         byte
-	Unused        byte
+	Coordinates   CoordinateSystem // Convention of the samples, see BuildConfig.
 	NumNodes      uint64
 	NumLeafs      uint64
 	VoxelsPerAxis uint32
+
+	// Bounds is the world space box the tree was built from, converted to
+	// YUpRightHanded. It is zero for trees of version 0 and trees not built
+	// from world samples.
+	Bounds Box
+
+	// GeoReference, if set, places the world coordinates in a real world
+	// coordinate reference system. It follows the bounds and the geo reference
+	// flag is set when it is encoded.
+	GeoReference *GeoReference
 }
 
+// octreeSign starts every tree.
+var octreeSign = [4]byte{0x1b, 0x6f, 0x63, 0x74}
+
+// headerV0 is the layout of the header of version 0. Later versions append fields.
+type headerV0 struct {
+	Sign          [4]byte
+	Version       byte
+	Format        OctreeFormat
+	Flags         byte
+	Coordinates   CoordinateSystem
+	NumNodes      uint64
+	NumLeafs      uint64
+	VoxelsPerAxis uint32
+}
+
+func NewOctreeHeader(format OctreeFormat, voxelsPerAxis int) OctreeHeader {
+	return OctreeHeader{
+		Sign:          octreeSign,
+		Version:       binaryVersion,
+		Format:        format,
+		VoxelsPerAxis: uint32(voxelsPerAxis),
+	}
+}
+
+// Size returns the size in bytes of the encoded header.
 func (h *OctreeHeader) Size() int {
-	return 28
+	if h.Version == 0 {
+		return 28
+	}
+	if h.GeoReference != nil {
+		return 28 + 32 + h.GeoReference.size()
+	}
+	return 28 + 32
+}
+
+// HasBounds reports if the world bounds of the tree are known.
+func (h *OctreeHeader) HasBounds() bool {
+	return h.Bounds.Size > 0
 }
 
 func (h *OctreeHeader) BigEndian() bool {
@@ -98,28 +243,102 @@ func (h *OctreeHeader) Optimized() bool {
 	return h.Flags&optimizedMask == optimizedMask
 }
 
+// Coverage reports if the alpha channel stores the fraction of occupied children
+// instead of the sample alpha.
+func (h *OctreeHeader) Coverage() bool {
+	return h.Flags&coverageMask == coverageMask
+}
+
+// Paletted reports if the header is followed by a palette.
+func (h *OctreeHeader) Paletted() bool {
+	return h.Flags&paletteMask == paletteMask
+}
+
+// HasGeoReference reports if the header has a GeoReference.
+func (h *OctreeHeader) HasGeoReference() bool {
+	return h.GeoReference != nil
+}
+
+// Checksummed reports if the nodes are followed by a checksum trailer. See
+// ChecksumWriter.
+func (h *OctreeHeader) Checksummed() bool {
+	return h.Flags&checksumMask == checksumMask
+}
+
 func TranscodeTree(reader io.Reader, writer io.Writer, format OctreeFormat) error {
+	return TranscodeTreePalette(reader, writer, format, nil)
+}
+
+// TranscodeTreePalette works like TranscodeTree but quantizes colors to the nearest
+// palette entry if format is a palette format.
+func TranscodeTreePalette(reader io.Reader, writer io.Writer, format OctreeFormat, palette Palette) error {
+	_, err := TranscodeTreeStats(reader, writer, format, palette)
+	return err
+}
+
+// TranscodeTreeStats works like TranscodeTreePalette and also reports how much
+// space the colors of the output tree use. Checksummed trees are verified and the
+// output is checksummed as well.
+func TranscodeTreeStats(reader io.Reader, writer io.Writer, format OctreeFormat, palette Palette) (TranscodeStats, error) {
+	return transcodeTree(reader, writer, format, palette, nil, nil, NopLogger)
+}
+
+// transcodeTree works like TranscodeTreeStats. If checksum is not nil it decides if
+// the output is checksummed, instead of the input. The nodes written are added to
+// levels. Nodes that can not be read or written are reported to logger.
+func transcodeTree(reader io.Reader, writer io.Writer, format OctreeFormat, palette Palette, checksum *bool, levels *levelStats, logger Logger) (TranscodeStats, error) {
 	var (
 		header   OctreeHeader
 		color    Color
-		children [8]uint32
+		children [8]NodeIndex
+		stats    TranscodeStats
 	)
 
-	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
-		return err
+	if err := DecodeHeader(reader, &header); err != nil {
+		return stats, err
+	}
+
+	inputPalette, err := DecodePalette(reader, &header)
+	if err != nil {
+		return stats, err
 	}
 
 	inputFormat := header.Format
+	inputChecksum := header.Checksummed()
 	header.Format = format
+	if format.HasNodeFlags() {
+		header.Version = binaryVersion
+	}
 
-	if err := binary.Write(writer, binary.LittleEndian, header); err != nil {
-		return err
+	if checksum != nil {
+		header.Flags &^= checksumMask
+		if *checksum {
+			header.Flags |= checksumMask
+		}
+	}
+
+	header.Flags &^= paletteMask
+	if format.Paletted() {
+		if err := palette.validate(); err != nil {
+			return stats, err
+		}
+		header.Flags |= paletteMask
+	}
+
+	if err := EncodeHeader(writer, header); err != nil {
+		return stats, err
+	}
+
+	if format.Paletted() {
+		if err := EncodePalette(writer, palette); err != nil {
+			return stats, err
+		}
 	}
 
 	if header.Compressed() == true {
 		readCloser, err := zlib.NewReader(reader)
 		if err != nil {
-			return err
+			return stats, err
 		}
 		defer readCloser.Close()
 		reader = readCloser
@@ -129,28 +348,413 @@ func TranscodeTree(reader io.Reader, writer io.Writer, format OctreeFormat) erro
 		writer = writeCloser
 	}
 
+	var checkedReader *ChecksumReader
+	if inputChecksum {
+		checkedReader = NewChecksumReader(reader, true)
+		reader = checkedReader
+	}
+
+	var checkedWriter *ChecksumWriter
+	if header.Checksummed() {
+		checkedWriter = NewChecksumWriter(writer)
+		writer = checkedWriter
+	}
+
+	level := levels.writer(writer, header.NumNodes)
+	if level != nil {
+		writer = level
+	}
+
+	decoder := NewNodeDecoder(reader, inputFormat, inputPalette)
+	encoder := NewNodeEncoder(writer, format, palette)
+
 	for i := uint64(0); i < header.NumNodes; i++ {
-		if err := DecodeNode(reader, inputFormat, &color, children[:]); err != nil {
+		flags, err := decoder.DecodeFlags(&color, children[:])
+		if err != nil {
+			logger.Errorf("could not read node %d of %d in format %d: %v", i, header.NumNodes, inputFormat, err)
+			return stats, err
+		}
+
+		// Formats without node flags infer them, inner nodes without children
+		// become leafs.
+		start := level.begin(i)
+		if format.HasNodeFlags() {
+			err = encoder.EncodeFlags(color, children[:], flags)
+		} else {
+			err = encoder.Encode(color, children[:])
+		}
+		if err != nil {
+			logger.Errorf("could not write node %d of %d in format %d, children %v: %v", i, header.NumNodes, format, children, err)
+			return stats, err
+		}
+		level.end(children[:], start)
+	}
+
+	if checkedReader != nil {
+		if err := checkedReader.ReadTrailer(); err != nil {
+			return stats, err
+		}
+	}
+	if checkedWriter != nil {
+		if err := checkedWriter.WriteTrailer(); err != nil {
+			return stats, err
+		}
+	}
+	return encoder.Stats(), nil
+}
+
+// DecodeHeader reads the header of a tree. Files that do not start with the
+// signature of a tree fail with ErrBadMagic.
+func DecodeHeader(reader io.Reader, header *OctreeHeader) error {
+	var sign [4]byte
+	if _, err := io.ReadFull(reader, sign[:]); err != nil {
+		return err
+	}
+	if sign != octreeSign {
+		return ErrBadMagic
+	}
+
+	var base headerV0
+	if err := binary.Read(io.MultiReader(bytes.NewReader(sign[:]), reader), binary.LittleEndian, &base); err != nil {
+		return err
+	}
+
+	if base.Version > binaryVersion {
+		return errUnsupportedVersion
+	}
+
+	if base.Format > mipR64G64B64A64S64UnpackUI64 || (base.Format.HasNodeFlags() && base.Version < 2) {
+		return ErrUnsupportedFormat
+	}
+
+	if base.Flags&geoMask != 0 && base.Version < 3 {
+		return errInvalidFile
+	}
+
+	if !base.Coordinates.valid() {
+		return errUnknownCoordinates
+	}
+
+	*header = OctreeHeader{
+		Sign:          base.Sign,
+		Version:       base.Version,
+		Format:        base.Format,
+		Flags:         base.Flags,
+		Coordinates:   base.Coordinates,
+		NumNodes:      base.NumNodes,
+		NumLeafs:      base.NumLeafs,
+		VoxelsPerAxis: base.VoxelsPerAxis,
+	}
+
+	if base.Version == 0 {
+		return nil
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &header.Bounds); err != nil {
+		return err
+	}
+
+	if base.Flags&geoMask == 0 {
+		return nil
+	}
+	geo, err := decodeGeoReference(reader)
+	header.GeoReference = geo
+	return err
+}
+
+func EncodeHeader(writer io.Writer, header OctreeHeader) error {
+	flags := header.Flags &^ geoMask
+	if header.GeoReference != nil {
+		if header.Version < 3 {
+			return errUnsupportedVersion
+		}
+		flags |= geoMask
+	}
+
+	base := headerV0{
+		Sign:          header.Sign,
+		Version:       header.Version,
+		Format:        header.Format,
+		Flags:         flags,
+		Coordinates:   header.Coordinates,
+		NumNodes:      header.NumNodes,
+		NumLeafs:      header.NumLeafs,
+		VoxelsPerAxis: header.VoxelsPerAxis,
+	}
+
+	if err := binary.Write(writer, binary.LittleEndian, base); err != nil {
+		return err
+	}
+
+	if header.Version == 0 {
+		return nil
+	}
+	if err := binary.Write(writer, binary.LittleEndian, header.Bounds); err != nil {
+		return err
+	}
+
+	if header.GeoReference == nil {
+		return nil
+	}
+	return encodeGeoReference(writer, header.GeoReference)
+}
+
+// SkipTree advances reader from the end of header to the first byte after the tree,
+// so trees can be stored back to back. Node colors are not decoded. Compressed
+// trees can only be skipped exactly if reader is an io.ByteReader, like
+// bytes.Buffer or bufio.Reader. The checksums of checksummed trees are verified.
+func SkipTree(reader io.Reader, header *OctreeHeader) error {
+	if _, err := DecodePalette(reader, header); err != nil {
+		return err
+	}
+
+	if header.Compressed() == true {
+		if _, ok := reader.(io.ByteReader); !ok {
+			return errUnbufferedReader
+		}
+
+		readCloser, err := zlib.NewReader(reader)
+		if err != nil {
 			return err
 		}
+		defer readCloser.Close()
 
-		if err := EncodeNode(writer, format, color, children[:]); err != nil {
+		if err := skipCheckedNodes(readCloser, header); err != nil {
 			return err
 		}
+
+		// The zlib checksum follows the last node.
+		_, err = io.Copy(ioutil.Discard, readCloser)
+		return err
+	}
+	return skipCheckedNodes(reader, header)
+}
+
+// skipCheckedNodes works like skipNodes but also verifies and skips the checksum
+// trailer of checksummed trees.
+func skipCheckedNodes(reader io.Reader, header *OctreeHeader) error {
+	if !header.Checksummed() {
+		return skipNodes(reader, header)
+	}
+
+	checked := NewChecksumReader(reader, true)
+	if err := skipNodes(checked, header); err != nil {
+		return err
 	}
+	return checked.ReadTrailer()
+}
 
+func skipNodes(reader io.Reader, header *OctreeHeader) error {
+	format := header.Format
+	if format.FixedSize() {
+		if header.NumNodes > math.MaxInt64/uint64(format.NodeSize()) {
+			return errInvalidFile
+		}
+
+		size := int64(header.NumNodes) * int64(format.NodeSize())
+		if n, err := io.CopyN(ioutil.Discard, reader, size); err != nil {
+			if n > 0 && err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		return nil
+	}
+
+	var buf [36]byte
+	for i := uint64(0); i < header.NumNodes; i++ {
+		var skip int
+		switch format {
+		case MipR8G8B8A8RelativeUI16:
+			if _, err := io.ReadFull(reader, buf[:5]); err != nil {
+				return err
+			}
+
+			for mask := buf[4]; mask != 0; mask &= mask - 1 {
+				if _, err := io.ReadFull(reader, buf[:2]); err != nil {
+					return err
+				}
+				if binary.LittleEndian.Uint16(buf[:]) == relativeEscape {
+					if _, err := io.ReadFull(reader, buf[:4]); err != nil {
+						return err
+					}
+				}
+			}
+		case MipR8G8B8A8DeltaUI32:
+			if _, err := io.ReadFull(reader, buf[:2]); err != nil {
+				return err
+			}
+
+			skip = 32
+			if binary.LittleEndian.Uint16(buf[:])>>12 == deltaEscape {
+				skip += 4
+			}
+		default:
+			return ErrUnsupportedFormat
+		}
+
+		if _, err := io.ReadFull(reader, buf[:skip]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func DecodeHeader(reader io.Reader, header *OctreeHeader) error {
-	return binary.Read(reader, binary.LittleEndian, header)
+// DecodeNodeAt decodes the node stored at index. The index is needed to resolve
+// child indices of relative formats.
+func DecodeNodeAt(reader io.Reader, format OctreeFormat, index NodeIndex, color *Color, children []NodeIndex) error {
+	if format == MipR8G8B8A8RelativeUI16 {
+		return decodeRelative(reader, index, color, children)
+	}
+	return DecodeNode(reader, format, color, children)
 }
 
-func EncodeHeader(writer io.Writer, header OctreeHeader) error {
-	return binary.Write(writer, binary.LittleEndian, header)
+// EncodeNodeAt encodes the node stored at index. The index is needed to encode
+// child indices of relative formats.
+func EncodeNodeAt(writer io.Writer, format OctreeFormat, index NodeIndex, color Color, children []NodeIndex) error {
+	if format == MipR8G8B8A8RelativeUI16 {
+		return encodeRelative(writer, index, color, children)
+	}
+	return EncodeNode(writer, format, color, children)
+}
+
+func decodeRelative(reader io.Reader, index NodeIndex, color *Color, children []NodeIndex) error {
+	var head [5]byte
+	if _, err := io.ReadFull(reader, head[:]); err != nil {
+		return err
+	}
+
+	color.R = float32(head[0]) / 255
+	color.G = float32(head[1]) / 255
+	color.B = float32(head[2]) / 255
+	color.A = float32(head[3]) / 255
+
+	mask := head[4]
+	for i := range children {
+		children[i] = 0
+		if mask&(1<<uint(i)) == 0 {
+			continue
+		}
+
+		var offset uint16
+		if err := binary.Read(reader, binary.LittleEndian, &offset); err != nil {
+			return err
+		}
+
+		if offset == relativeEscape {
+			var child uint32
+			if err := binary.Read(reader, binary.LittleEndian, &child); err != nil {
+				return err
+			}
+			children[i] = NodeIndex(child)
+		} else {
+			children[i] = index + NodeIndex(offset)
+		}
+	}
+	return nil
+}
+
+func encodeRelative(writer io.Writer, index NodeIndex, color Color, children []NodeIndex) error {
+	var mask byte
+	for i, child := range children {
+		if child != 0 {
+			mask |= 1 << uint(i)
+		}
+	}
+
+	if err := color.writeColor(writer, MipR8G8B8A8UnpackUI32); err != nil {
+		return err
+	}
+
+	if err := binary.Write(writer, binary.LittleEndian, mask); err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		if child == 0 {
+			continue
+		}
+
+		if child > index && child-index < relativeEscape {
+			if err := binary.Write(writer, binary.LittleEndian, uint16(child-index)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := binary.Write(writer, binary.LittleEndian, uint16(relativeEscape)); err != nil {
+			return err
+		}
+
+		if child > math.MaxUint32 {
+			return errOctreeOverflow
+		}
+
+		if err := binary.Write(writer, binary.LittleEndian, uint32(child)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readIndices reads one child index of size bytes for every child.
+func readIndices(reader io.Reader, size int, children []NodeIndex) error {
+	var buf [8 * 8]byte
+	data := buf[:size*len(children)]
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return err
+	}
+
+	for i := range children {
+		b := data[i*size:]
+		switch size {
+		case 2:
+			children[i] = NodeIndex(binary.LittleEndian.Uint16(b))
+		case 4:
+			children[i] = NodeIndex(binary.LittleEndian.Uint32(b))
+		default:
+			children[i] = NodeIndex(binary.LittleEndian.Uint64(b))
+		}
+	}
+	return nil
 }
 
-func DecodeNode(reader io.Reader, format OctreeFormat, color *Color, children []uint32) error {
+// writeIndices writes every child index with size bytes.
+func writeIndices(writer io.Writer, size int, children []NodeIndex) error {
+	var buf [8 * 8]byte
+	data := buf[:size*len(children)]
+
+	for i, child := range children {
+		b := data[i*size:]
+		switch size {
+		case 2:
+			if child > math.MaxUint16 {
+				return errOctreeOverflow
+			}
+			binary.LittleEndian.PutUint16(b, uint16(child))
+		case 4:
+			if child > math.MaxUint32 {
+				return errOctreeOverflow
+			}
+			binary.LittleEndian.PutUint32(b, uint32(child))
+		default:
+			binary.LittleEndian.PutUint64(b, uint64(child))
+		}
+	}
+
+	_, err := writer.Write(data)
+	return err
+}
+
+// readPacked reads the eight 32-bit components of a packed format.
+func readPacked(reader io.Reader) ([8]uint32, error) {
+	var packed [8]uint32
+	err := binary.Read(reader, binary.LittleEndian, &packed)
+	return packed, err
+}
+
+// DecodeNode decodes a node. Relative formats are decoded as if the node is
+// stored at index zero, use DecodeNodeAt for those.
+func DecodeNode(reader io.Reader, format OctreeFormat, color *Color, children []NodeIndex) error {
 	readR8G8B8A8 := func() error {
 		var col [4]byte
 		if err := binary.Read(reader, binary.LittleEndian, &col); err != nil {
@@ -165,23 +769,15 @@ func DecodeNode(reader io.Reader, format OctreeFormat, color *Color, children []
 	}
 
 	readChild16 := func() error {
-		var ch [8]uint16
-		if err := binary.Read(reader, binary.LittleEndian, &ch); err != nil {
-			return err
-		}
-
-		for i := 0; i < 8; i++ {
-			children[i] = uint32(ch[i])
-		}
-		return nil
+		return readIndices(reader, 2, children)
 	}
 
-	if format == MipR8G8B8A8UnpackUI32 {
+	if format == MipR8G8B8A8UnpackUI32 || format == MipR8G8B8A8UnpackUI64 {
 		if err := readR8G8B8A8(); err != nil {
 			return err
 		}
 
-		if err := binary.Read(reader, binary.LittleEndian, children); err != nil {
+		if err := readIndices(reader, format.IndexSize(), children); err != nil {
 			return err
 		}
 	} else if format == MipR8G8B8A8UnpackUI16 {
@@ -220,44 +816,50 @@ func DecodeNode(reader io.Reader, format OctreeFormat, color *Color, children []
 		if err := readChild16(); err != nil {
 			return err
 		}
-	} else if format == mipR64G64B64A64S64UnpackUI32 {
+	} else if format == mipR64G64B64A64S64UnpackUI64 {
 		var col [5]uint64
 		if err := binary.Read(reader, binary.LittleEndian, &col); err != nil {
 			return err
 		}
 
+		if col[4] == 0 {
+			return errInvalidFile
+		}
+
 		color.R = float32((col[0] / col[4])) / 255
 		color.G = float32((col[1] / col[4])) / 255
 		color.B = float32((col[2] / col[4])) / 255
 		color.A = float32((col[3] / col[4])) / 255
 
-		if err := binary.Read(reader, binary.LittleEndian, children); err != nil {
+		if err := readIndices(reader, 8, children); err != nil {
 			return err
 		}
 	} else if format == MipR8G8B8A8PackUI28 {
-		if err := binary.Read(reader, binary.LittleEndian, children); err != nil {
+		packed, err := readPacked(reader)
+		if err != nil {
 			return err
 		}
 
 		var cbits byte
-		for i, component := range children {
+		for i, component := range packed {
 			if i%2 == 0 {
 				cbits = byte(component >> 24)
 			} else {
 				cbits |= byte(component >> 28)
 				color.setComponent(i/2, float32(cbits)/255)
 			}
-			children[i] = component & 0xfffffff
+			children[i] = NodeIndex(component & 0xfffffff)
 		}
 	} else if format == MipR4G4B4A4PackUI30 {
-		if err := binary.Read(reader, binary.LittleEndian, children); err != nil {
+		packed, err := readPacked(reader)
+		if err != nil {
 			return err
 		}
 
 		var cbits uint16
-		for i, component := range children {
+		for i, component := range packed {
 			cbits |= uint16((component & 0xc0000000) >> (16 + byte(i*2)))
-			children[i] = component & 0x3fffffff
+			children[i] = NodeIndex(component & 0x3fffffff)
 		}
 
 		color.R = float32((cbits&0xf000)>>12) / 15
@@ -265,29 +867,40 @@ func DecodeNode(reader io.Reader, format OctreeFormat, color *Color, children []
 		color.B = float32((cbits&0xf0)>>4) / 15
 		color.A = float32(cbits&0xf) / 15
 	} else if format == MipR5G6B5PackUI30 {
-		if err := binary.Read(reader, binary.LittleEndian, children); err != nil {
+		packed, err := readPacked(reader)
+		if err != nil {
 			return err
 		}
 
 		var cbits uint16
-		for i, component := range children {
+		for i, component := range packed {
 			cbits |= uint16((component & 0xc0000000) >> (16 + byte(i*2)))
-			children[i] = component & 0x3fffffff
+			children[i] = NodeIndex(component & 0x3fffffff)
 		}
 
 		color.R = float32((cbits&0xf800)>>11) / 31
 		color.G = float32((cbits&0x7e0)>>5) / 63
 		color.B = float32(cbits&0x1f) / 31
 		color.A = 1
+	} else if format == MipR8G8B8A8RelativeUI16 {
+		return decodeRelative(reader, 0, color, children)
+	} else if format.HasNodeFlags() {
+		_, err := decodeFlagged(reader, color, children)
+		return err
+	} else if format.Delta() {
+		return errDeltaFormat
+	} else if format.Paletted() {
+		return errMissingPalette
 	} else if format == MipR3G3B2PackUI31 {
-		if err := binary.Read(reader, binary.LittleEndian, children); err != nil {
+		packed, err := readPacked(reader)
+		if err != nil {
 			return err
 		}
 
 		var cbits byte
-		for i, component := range children {
+		for i, component := range packed {
 			cbits |= byte((component & 0x80000000) >> (24 + byte(i)))
-			children[i] = component & 0x7fffffff
+			children[i] = NodeIndex(component & 0x7fffffff)
 		}
 
 		color.R = float32((cbits&0xe0)>>5) / 7
@@ -295,24 +908,34 @@ func DecodeNode(reader io.Reader, format OctreeFormat, color *Color, children []
 		color.B = float32(cbits&0x3) / 3
 		color.A = 1
 	} else {
-		return errUnsupportedFormat
+		return ErrUnsupportedFormat
 	}
 	return nil
 }
 
-func EncodeNode(writer io.Writer, format OctreeFormat, color Color, children []uint32) error {
-	if format == MipR8G8B8A8UnpackUI32 {
-		if err := color.writeColor(writer, format); err != nil {
-			return err
+// EncodeNode encodes a node. Relative formats are encoded as if the node is
+// stored at index zero, use EncodeNodeAt for those.
+func EncodeNode(writer io.Writer, format OctreeFormat, color Color, children []NodeIndex) error {
+	for _, child := range children {
+		if child > format.MaxIndex() {
+			return errOctreeOverflow
 		}
+	}
 
-		for _, child := range children {
-			if child > math.MaxUint32 {
-				return errOctreeOverflow
-			}
+	if format == MipR8G8B8A8RelativeUI16 {
+		return encodeRelative(writer, 0, color, children)
+	} else if format.HasNodeFlags() {
+		return encodeFlagged(writer, color, children, InferNodeFlags(children))
+	} else if format.Delta() {
+		return errDeltaFormat
+	} else if format.Paletted() {
+		return errMissingPalette
+	} else if format == MipR8G8B8A8UnpackUI32 || format == MipR8G8B8A8UnpackUI64 {
+		if err := color.writeColor(writer, MipR8G8B8A8UnpackUI32); err != nil {
+			return err
 		}
 
-		if err := binary.Write(writer, binary.LittleEndian, children); err != nil {
+		if err := writeIndices(writer, format.IndexSize(), children); err != nil {
 			return err
 		}
 	} else if format == MipR8G8B8A8PackUI28 {
@@ -320,10 +943,6 @@ func EncodeNode(writer io.Writer, format OctreeFormat, color Color, children []u
 		colors := color.bytes()
 
 		for i, child := range children {
-			if child > maxUint28 {
-				return errOctreeOverflow
-			}
-
 			var colorNib uint32
 			if i%2 == 0 {
 				colorNib = uint32(colors[i/2]&0xf0) << 24
@@ -331,7 +950,7 @@ func EncodeNode(writer io.Writer, format OctreeFormat, color Color, children []u
 				colorNib = uint32(colors[i/2]&0xf) << 28
 			}
 
-			component = colorNib | child
+			component = colorNib | uint32(child)
 			if err := binary.Write(writer, binary.LittleEndian, component); err != nil {
 				return err
 			}
@@ -347,11 +966,7 @@ func EncodeNode(writer io.Writer, format OctreeFormat, color Color, children []u
 		packedColor |= byte(color.B * 3)
 
 		for i, child := range children {
-			if child > maxUint31 {
-				return errOctreeOverflow
-			}
-
-			component = ((uint32(packedColor) << byte(24+i)) & 0x80000000) | child
+			component = ((uint32(packedColor) << byte(24+i)) & 0x80000000) | uint32(child)
 			if err := binary.Write(writer, binary.LittleEndian, component); err != nil {
 				return err
 			}
@@ -367,11 +982,7 @@ func EncodeNode(writer io.Writer, format OctreeFormat, color Color, children []u
 		packedColor |= uint16(color.B * 31)
 
 		for i, child := range children {
-			if child > maxUint30 {
-				return errOctreeOverflow
-			}
-
-			component = ((uint32(packedColor) << byte(16+i*2)) & 0xc0000000) | child
+			component = ((uint32(packedColor) << byte(16+i*2)) & 0xc0000000) | uint32(child)
 			if err := binary.Write(writer, binary.LittleEndian, component); err != nil {
 				return err
 			}
@@ -388,11 +999,7 @@ func EncodeNode(writer io.Writer, format OctreeFormat, color Color, children []u
 		packedColor |= uint16(color.A*15) & 0xf
 
 		for i, child := range children {
-			if child > maxUint30 {
-				return errOctreeOverflow
-			}
-
-			component = ((uint32(packedColor) << byte(16+i*2)) & 0xc0000000) | child
+			component = ((uint32(packedColor) << byte(16+i*2)) & 0xc0000000) | uint32(child)
 			if err := binary.Write(writer, binary.LittleEndian, component); err != nil {
 				return err
 			}
@@ -402,15 +1009,7 @@ func EncodeNode(writer io.Writer, format OctreeFormat, color Color, children []u
 			return err
 		}
 
-		var ch [8]uint16
-		for i, child := range children {
-			if child > math.MaxUint16 {
-				return errOctreeOverflow
-			}
-			ch[i] = uint16(child)
-		}
-
-		if err := binary.Write(writer, binary.LittleEndian, ch); err != nil {
+		if err := writeIndices(writer, 2, children); err != nil {
 			return err
 		}
 	}
@@ -20,19 +20,21 @@ package pack
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"testing"
 )
 
 func testDecode(format OctreeFormat, colorDiff float32) {
 	var (
 		colorIn           Color
-		childIn, childOut [8]uint32
+		childIn, childOut [8]NodeIndex
 		buffer            bytes.Buffer
 	)
 
 	colorOut := Color{0.5, 0.3, 0.7, 1.0}
 	for i := range childOut {
-		childOut[i] = uint32(100*i - 10*i)
+		childOut[i] = NodeIndex(100*i - 10*i)
 	}
 
 	if err := EncodeNode(&buffer, format, colorOut, childOut[:]); err != nil {
@@ -64,4 +66,238 @@ func TestDecodeNode(t *testing.T) {
 	testDecode(MipR4G4B4A4PackUI30, 0.1)
 	testDecode(MipR5G6B5PackUI30, 0.1)
 	testDecode(MipR3G3B2PackUI31, 0.1)
+
+	testDecode(MipR8G8B8A8RelativeUI16, 0.01)
+	testDecode(MipR8G8B8A8UnpackUI64, 0.01)
+	testDecode(MipR8G8B8A8FlagsUI32, 0.01)
+}
+
+func TestWideIndices(t *testing.T) {
+	var (
+		buffer   bytes.Buffer
+		color    Color
+		childIn  [8]NodeIndex
+		childOut = [8]NodeIndex{0, 1 << 32, 0, 0, 0, 0, 0, 1<<40 + 7}
+	)
+
+	if err := EncodeNode(&buffer, MipR8G8B8A8UnpackUI64, Color{1, 0, 0, 1}, childOut[:]); err != nil {
+		panic(err)
+	}
+
+	if buffer.Len() != MipR8G8B8A8UnpackUI64.NodeSize() {
+		t.Errorf("unexpected node size: %v", buffer.Len())
+	}
+
+	if err := DecodeNode(&buffer, MipR8G8B8A8UnpackUI64, &color, childIn[:]); err != nil {
+		panic(err)
+	}
+
+	if childIn != childOut {
+		t.Errorf("%v != %v", childIn, childOut)
+	}
+
+	formats := []OctreeFormat{MipR8G8B8A8UnpackUI32, MipR8G8B8A8PackUI28, MipR8G8B8A8RelativeUI16, MipR5G6B5UnpackUI16}
+	for _, format := range formats {
+		var ch [8]NodeIndex
+		ch[3] = format.MaxIndex() + 1
+		if err := EncodeNodeAt(ioutil.Discard, format, 0, color, ch[:]); err != errOctreeOverflow {
+			t.Errorf("format %v: expected overflow, got %v", format, err)
+		}
+
+		ch[3] = format.MaxIndex()
+		if err := EncodeNodeAt(ioutil.Discard, format, 0, color, ch[:]); err != nil {
+			t.Errorf("format %v: %v", format, err)
+		}
+	}
+}
+
+func TestRelativeEscape(t *testing.T) {
+	var (
+		buffer   bytes.Buffer
+		color    Color
+		childIn  [8]NodeIndex
+		childOut = [8]NodeIndex{0, 50, 101, 0, 0, 0, 0, 200000}
+	)
+
+	if err := EncodeNodeAt(&buffer, MipR8G8B8A8RelativeUI16, 100, Color{1, 0, 0, 1}, childOut[:]); err != nil {
+		panic(err)
+	}
+
+	if buffer.Len() != 5+3*2+2*4 {
+		t.Errorf("unexpected node size: %v", buffer.Len())
+	}
+
+	if err := DecodeNodeAt(&buffer, MipR8G8B8A8RelativeUI16, 100, &color, childIn[:]); err != nil {
+		panic(err)
+	}
+
+	if childIn != childOut {
+		t.Errorf("%v != %v", childIn, childOut)
+	}
+}
+
+func TestTranscodeRelative(t *testing.T) {
+	TestBuildTree(t)
+
+	original, err := ioutil.ReadFile("test.oct")
+	if err != nil {
+		panic(err)
+	}
+
+	var relative, unpacked bytes.Buffer
+	if err := TranscodeTree(bytes.NewReader(original), &relative, MipR8G8B8A8RelativeUI16); err != nil {
+		panic(err)
+	}
+
+	if err := TranscodeTree(&relative, &unpacked, MipR8G8B8A8UnpackUI32); err != nil {
+		panic(err)
+	}
+
+	if !bytes.Equal(original, unpacked.Bytes()) {
+		t.Error("round trip through relative format changed the tree")
+	}
+}
+
+func TestDeltaEscape(t *testing.T) {
+	var (
+		buffer   bytes.Buffer
+		color    Color
+		children [8]NodeIndex
+	)
+
+	nodes := []struct {
+		color    Color
+		children [8]NodeIndex
+	}{
+		{Color{0.5, 0.5, 0.5, 1}, [8]NodeIndex{1, 2}},
+		{Color{0.51, 0.49, 0.5, 1}, [8]NodeIndex{}},
+		{Color{0.9, 0.1, 0.5, 1}, [8]NodeIndex{}},
+	}
+
+	encoder := NewNodeEncoder(&buffer, MipR8G8B8A8DeltaUI32, nil)
+	for _, n := range nodes {
+		if err := encoder.Encode(n.color, n.children[:]); err != nil {
+			panic(err)
+		}
+	}
+
+	stats := encoder.Stats()
+	if stats.Escaped != 2 || stats.ColorBytes != 2*6+2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	if buffer.Len() != 2*MipR8G8B8A8DeltaUI32.NodeSize()+MipR8G8B8A8DeltaUI32.NodeSize()-4 {
+		t.Errorf("unexpected tree size: %v", buffer.Len())
+	}
+
+	decoder := NewNodeDecoder(&buffer, MipR8G8B8A8DeltaUI32, nil)
+	for i, n := range nodes {
+		if err := decoder.Decode(&color, children[:]); err != nil {
+			panic(err)
+		}
+
+		if color.bytes() != n.color.bytes() {
+			t.Errorf("node %v: %v != %v", i, color, n.color)
+		}
+
+		if children != n.children {
+			t.Errorf("node %v: %v != %v", i, children, n.children)
+		}
+	}
+
+	if err := EncodeNode(&buffer, MipR8G8B8A8DeltaUI32, color, children[:]); err != errDeltaFormat {
+		t.Errorf("expected %v, got %v", errDeltaFormat, err)
+	}
+}
+
+func TestTranscodeDelta(t *testing.T) {
+	TestBuildTree(t)
+
+	original, err := ioutil.ReadFile("test.oct")
+	if err != nil {
+		panic(err)
+	}
+
+	var delta, unpacked bytes.Buffer
+	stats, err := TranscodeTreeStats(bytes.NewReader(original), &delta, MipR8G8B8A8DeltaUI32, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	if stats.Escaped == 0 || stats.Escaped == stats.NumNodes {
+		t.Errorf("expected both delta and escaped colors: %+v", stats)
+	}
+	t.Logf("color ratio: %.2f, escaped: %v of %v", stats.ColorRatio(), stats.Escaped, stats.NumNodes)
+
+	if err := TranscodeTree(&delta, &unpacked, MipR8G8B8A8UnpackUI32); err != nil {
+		panic(err)
+	}
+
+	if !bytes.Equal(original, unpacked.Bytes()) {
+		t.Error("round trip through delta format changed the tree")
+	}
+}
+
+func TestSkipTree(t *testing.T) {
+	gray, blue := Color{0.5, 0.5, 0.5, 1}, Color{0, 0, 1, 1}
+	tree := encodeFrameData(&FrameData{
+		Header:   NewOctreeHeader(MipR8G8B8A8UnpackUI32, 2),
+		Colors:   []Color{gray, gray, blue, gray},
+		Children: [][8]NodeIndex{{1, 2, 0, 0, 3}, {}, {}, {}},
+	})
+
+	trees := make(map[string][]byte)
+	for name, format := range map[string]OctreeFormat{
+		"unpack":   MipR8G8B8A8UnpackUI32,
+		"rgb565":   MipR5G6B5UnpackUI16,
+		"relative": MipR8G8B8A8RelativeUI16,
+		"delta":    MipR8G8B8A8DeltaUI32,
+		"palette":  MipP8UnpackUI16,
+	} {
+		var buffer bytes.Buffer
+		if err := TranscodeTreePalette(bytes.NewReader(tree), &buffer, format, Palette{gray, blue}); err != nil {
+			panic(err)
+		}
+		trees[name] = buffer.Bytes()
+	}
+
+	var compressed bytes.Buffer
+	if err := CompressTree(bytes.NewReader(tree), &compressed); err != nil {
+		panic(err)
+	}
+	trees["compressed"] = compressed.Bytes()
+
+	for name, data := range trees {
+		var header OctreeHeader
+		reader := bytes.NewBuffer(append(append([]byte(nil), data...), "next"...))
+
+		if err := DecodeHeader(reader, &header); err != nil {
+			panic(err)
+		}
+
+		if err := SkipTree(reader, &header); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if rest := reader.String(); rest != "next" {
+			t.Errorf("%s: expected to stop after the tree, %q is left", name, rest)
+		}
+	}
+
+	var header OctreeHeader
+	reader := struct{ io.Reader }{bytes.NewReader(trees["compressed"])}
+	if err := DecodeHeader(reader, &header); err != nil {
+		panic(err)
+	}
+
+	if err := SkipTree(reader, &header); err != errUnbufferedReader {
+		t.Errorf("expected errUnbufferedReader, got %v", err)
+	}
+
+	truncated := bytes.NewReader(trees["unpack"][:len(trees["unpack"])-1])
+	if err := DecodeHeader(truncated, &header); err != nil {
+		panic(err)
+	}
+
+	if err := SkipTree(truncated, &header); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF for a truncated tree, got %v", err)
+	}
 }
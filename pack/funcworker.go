@@ -0,0 +1,43 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package pack
+
+// VoxelFunc returns the color of voxel x, y, z of a grid, or false if the voxel is
+// empty.
+type VoxelFunc func(x, y, z int) (Color, bool)
+
+// NewFuncWorker returns a worker that sends a sample at the center of every voxel
+// of a grid with voxelsPerAxis voxels per axis covering bounds, for which fn
+// returns true. Voxels are visited with x changing fastest and z slowest, so
+// workers of functions without other state send the same samples in the same
+// order every time.
+func NewFuncWorker(bounds Box, voxelsPerAxis int, fn VoxelFunc) BuildWorker {
+	return func(samples chan<- Sample) error {
+		size := bounds.Size / float64(voxelsPerAxis)
+		for z := 0; z < voxelsPerAxis; z++ {
+			for y := 0; y < voxelsPerAxis; y++ {
+				for x := 0; x < voxelsPerAxis; x++ {
+					if c, ok := fn(x, y, z); ok {
+						pos := Point{bounds.Pos.X + (float64(x)+0.5)*size, bounds.Pos.Y + (float64(y)+0.5)*size, bounds.Pos.Z + (float64(z)+0.5)*size}
+						samples <- Sample{pos, c}
+					}
+				}
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,68 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package pack
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFuncWorker(t *testing.T) {
+	// A diagonal line of voxels through a grid of four voxels per axis.
+	diagonal := func(x, y, z int) (Color, bool) {
+		return Color{float32(x) / 3, 0, 0, 1}, x == y && y == z
+	}
+	worker := NewFuncWorker(Box{Point{2, 0, 0}, 8}, 4, diagonal)
+
+	if n := VerifyWorker(t, worker); n != 4 {
+		t.Errorf("expected 4 samples, got %d", n)
+	}
+
+	samples := make(chan Sample, 4)
+	if err := worker(samples); err != nil {
+		t.Fatal(err)
+	}
+	close(samples)
+
+	i := 0
+	for s := range samples {
+		center := float64(i)*2 + 1
+		if s.Pos != (Point{2 + center, center, center}) || s.Col.R != float32(i)/3 {
+			t.Errorf("sample %d: unexpected %v", i, s)
+		}
+		i++
+	}
+
+	build := func() []byte {
+		var buffer bytes.Buffer
+		cfg := BuildConfig{
+			Worker:        worker,
+			Writer:        &buffer,
+			Bounds:        Box{Point{2, 0, 0}, 8},
+			VoxelsPerAxis: 4,
+			Format:        MipR8G8B8A8UnpackUI32,
+		}
+		if _, err := BuildTree(&cfg); err != nil {
+			panic(err)
+		}
+		return buffer.Bytes()
+	}
+
+	if !bytes.Equal(build(), build()) {
+		t.Error("expected the same tree from every build")
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package pack
+
+import (
+	"bytes"
+	"testing"
+)
+
+// fuzzFormats are the formats stored in tree files, including the internal format
+// of the builder.
+const fuzzFormats = mipR64G64B64A64S64UnpackUI64 + 1
+
+func FuzzDecodeHeader(f *testing.F) {
+	f.Add(solidTree())
+
+	header := NewOctreeHeader(MipR8G8B8A8DeltaUI32, 4)
+	header.Version = 0
+	var buf bytes.Buffer
+	if err := EncodeHeader(&buf, header); err != nil {
+		panic(err)
+	}
+	f.Add(buf.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var header OctreeHeader
+		if err := DecodeHeader(bytes.NewReader(data), &header); err != nil {
+			return
+		}
+		if header.Format >= fuzzFormats {
+			t.Fatalf("decoded unsupported format %v", header.Format)
+		}
+
+		var buf bytes.Buffer
+		if err := EncodeHeader(&buf, header); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data[:header.Size()]) {
+			t.Errorf("header does not encode to the decoded bytes")
+		}
+	})
+}
+
+func FuzzDecodeNode(f *testing.F) {
+	palette := Palette{{1, 0, 0, 1}, {0, 1, 0, 1}}
+	children := []NodeIndex{1, 2, 0, 0, 70000, 0, 0, 8}
+
+	for format := OctreeFormat(0); format < fuzzFormats; format++ {
+		var buf bytes.Buffer
+		encoder := NewNodeEncoder(&buf, format, palette)
+		if err := encoder.Encode(Color{0.5, 0.25, 1, 1}, children); err != nil {
+			continue
+		}
+		f.Add(byte(format), buf.Bytes())
+	}
+
+	f.Fuzz(func(t *testing.T, format byte, data []byte) {
+		var (
+			color    Color
+			children [8]NodeIndex
+		)
+
+		decoder := NewNodeDecoder(bytes.NewReader(data), OctreeFormat(format), palette)
+		for decoder.Decode(&color, children[:]) == nil {
+		}
+		DecodeNode(bytes.NewReader(data), OctreeFormat(format), &color, children[:])
+	})
+}
+
+func FuzzValidateTree(f *testing.F) {
+	f.Add(solidTree())
+
+	var buf bytes.Buffer
+	if err := TranscodeTree(bytes.NewReader(solidTree()), &buf, MipR8G8B8A8RelativeUI16); err != nil {
+		panic(err)
+	}
+	f.Add(buf.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ValidateTree(bytes.NewReader(data))
+	})
+}
@@ -0,0 +1,89 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package pack
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"os"
+)
+
+// generationPollInterval is the number of samples inserted between polls of the
+// source generations.
+const generationPollInterval = 1024
+
+// ErrSourceChanged is returned by BuildTree when the generation of a source
+// changes while the tree is sampled.
+var ErrSourceChanged = errors.New("source changed during build")
+
+// GenerationWorker is implemented by sources whose data can change while a tree
+// is built. The generation must change whenever the data does, BuildTree polls it
+// between nodes and samples and fails or restarts the build when it changes. See
+// BuildConfig.Source.
+type GenerationWorker interface {
+	Generation() uint64
+}
+
+// FileSource is the generation of a list of files, taken from their sizes and
+// modification times. Missing files are part of the generation, so a file that is
+// created or removed also changes it.
+type FileSource []string
+
+func (s FileSource) Generation() uint64 {
+	h := fnv.New64a()
+	for _, file := range s {
+		var stamp [2]int64
+		if info, err := os.Stat(file); err == nil {
+			stamp = [2]int64{info.Size(), info.ModTime().UnixNano()}
+		}
+		binary.Write(h, binary.LittleEndian, stamp)
+	}
+	return h.Sum64()
+}
+
+// sourceWatch holds the generations of the sources of a build when sampling
+// started.
+type sourceWatch struct {
+	sources     []GenerationWorker
+	generations []uint64
+}
+
+func watchSources(cfg *BuildConfig) *sourceWatch {
+	w := &sourceWatch{}
+	if cfg.Source != nil {
+		w.sources = append(w.sources, cfg.Source)
+	}
+	if gen, ok := cfg.Cells.(GenerationWorker); ok {
+		w.sources = append(w.sources, gen)
+	}
+
+	for _, s := range w.sources {
+		w.generations = append(w.generations, s.Generation())
+	}
+	return w
+}
+
+// check returns ErrSourceChanged if any source has a new generation.
+func (w *sourceWatch) check() error {
+	for i, s := range w.sources {
+		if s.Generation() != w.generations[i] {
+			return ErrSourceChanged
+		}
+	}
+	return nil
+}
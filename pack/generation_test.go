@@ -0,0 +1,182 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package pack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// changingSource is a worker that changes its generation after sending the first
+// samples, the given number of times.
+type changingSource struct {
+	samples    []Sample
+	generation uint64
+	changes    int32
+}
+
+func (s *changingSource) Generation() uint64 {
+	return atomic.LoadUint64(&s.generation)
+}
+
+func (s *changingSource) Work(samples chan<- Sample) error {
+	for i, samp := range s.samples {
+		if i == 100 && atomic.AddInt32(&s.changes, -1) >= 0 {
+			atomic.AddUint64(&s.generation, 1)
+		}
+		samples <- samp
+	}
+	return nil
+}
+
+func TestSourceChanged(t *testing.T) {
+	var samples []Sample
+	for i := 0; i < 3*generationPollInterval; i++ {
+		x, y, z := i%8, i/8%8, i/64%8
+		samples = append(samples, Sample{Point{float64(x) + 0.5, float64(y) + 0.5, float64(z) + 0.5}, Color{float32(x) / 8, float32(y) / 8, float32(z) / 8, 1}})
+	}
+
+	build := func(changes int32, restarts int) ([]byte, BuildStatus, error) {
+		source := &changingSource{samples: samples, changes: changes}
+
+		var buf bytes.Buffer
+		cfg := BuildConfig{
+			Worker:          source.Work,
+			Writer:          &buf,
+			Bounds:          Box{Point{0, 0, 0}, 8},
+			VoxelsPerAxis:   8,
+			Format:          MipR8G8B8A8UnpackUI32,
+			Source:          source,
+			RestartOnChange: restarts,
+		}
+
+		status, err := BuildTree(&cfg)
+		return buf.Bytes(), status, err
+	}
+
+	expected, _, err := build(0, 0)
+	if err != nil {
+		panic(err)
+	}
+
+	if _, _, err := build(1, 0); err != ErrSourceChanged {
+		t.Error("expected ErrSourceChanged, got:", err)
+	}
+
+	if _, status, err := build(3, 2); err != ErrSourceChanged || status.NumRestarts != 2 {
+		t.Errorf("expected ErrSourceChanged after 2 restarts, got %v after %v", err, status.NumRestarts)
+	}
+
+	tree, status, err := build(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.NumRestarts != 1 {
+		t.Error("expected one restart, got:", status.NumRestarts)
+	}
+	if !bytes.Equal(tree, expected) {
+		t.Error("restarted build differs from an unchanged build")
+	}
+}
+
+// changingCells changes its generation when the second cell is sampled.
+type changingCells struct {
+	*PointStore
+	generation uint64
+	cells      int32
+}
+
+func (c *changingCells) Generation() uint64 {
+	return atomic.LoadUint64(&c.generation)
+}
+
+func (c *changingCells) Region(cell Box) BuildWorker {
+	if atomic.AddInt32(&c.cells, 1) == 2 {
+		atomic.AddUint64(&c.generation, 1)
+	}
+	return c.PointStore.Region(cell)
+}
+
+func TestSourceChangedCells(t *testing.T) {
+	bounds := Box{Point{0, 0, 0}, 2}
+	samples := []Sample{{Point{0.5, 0.5, 0.5}, Color{1, 0, 0, 1}}, {Point{1.5, 1.5, 1.5}, Color{0, 1, 0, 1}}}
+
+	cfg := BuildConfig{
+		Cells:         &changingCells{PointStore: NewPointStoreWorker(bounds, samples)},
+		Writer:        ioutil.Discard,
+		Bounds:        bounds,
+		VoxelsPerAxis: 2,
+		Format:        MipR8G8B8A8UnpackUI32,
+	}
+
+	if _, err := BuildTree(&cfg); err != ErrSourceChanged {
+		t.Error("expected ErrSourceChanged, got:", err)
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "cloud.xyz")
+	source := FileSource{file}
+	missing := source.Generation()
+
+	if err := ioutil.WriteFile(file, []byte("0 0 0 0 255 255 255\n"), 0644); err != nil {
+		panic(err)
+	}
+
+	created := source.Generation()
+	if created == missing {
+		t.Error("generation did not change when the file was created")
+	}
+	if source.Generation() != created {
+		t.Error("generation changed without a change to the file")
+	}
+
+	fp, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		panic(err)
+	}
+	fp.Write([]byte("1 1 1 0 255 255 255\n"))
+	fp.Close()
+
+	if source.Generation() == created {
+		t.Error("generation did not change when the file was appended to")
+	}
+
+	// Rewriting the file with the same size is detected by the modification time.
+	appended := source.Generation()
+	if err := ioutil.WriteFile(file, []byte("2 2 2 0 255 255 255\n1 1 1 0 255 255 255\n"), 0644); err != nil {
+		panic(err)
+	}
+	mtime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		panic(err)
+	}
+	if source.Generation() == appended {
+		t.Error("generation did not change when the file was rewritten")
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// GeoReference places the world coordinates of a tree, those of its samples and
+// BuildConfig.Bounds in the convention of the header, in a real world coordinate
+// reference system. A point p is at Origin + Scale*p per axis in the CRS, like
+// the integer coordinates of a LAS file with its offset and scale.
+type GeoReference struct {
+	// CRS identifies the coordinate reference system, like "EPSG:32633" for UTM
+	// zone 33N, or holds its WKT.
+	CRS    string
+	Origin [3]float64
+	Scale  [3]float64
+}
+
+func (g *GeoReference) validate() error {
+	if len(g.CRS) > math.MaxUint16 {
+		return errLongCRS
+	}
+	for i := range g.Origin {
+		o, s := g.Origin[i], g.Scale[i]
+		if math.IsNaN(o) || math.IsInf(o, 0) || math.IsNaN(s) || math.IsInf(s, 0) || s == 0 {
+			return errInvalidGeoRef
+		}
+	}
+	return nil
+}
+
+// ToCRS converts a world point in the convention of the tree to the CRS.
+func (g *GeoReference) ToCRS(p Point) Point {
+	return Point{
+		g.Origin[0] + g.Scale[0]*p.X,
+		g.Origin[1] + g.Scale[1]*p.Y,
+		g.Origin[2] + g.Scale[2]*p.Z,
+	}
+}
+
+// FromCRS converts a point in the CRS to world coordinates in the convention of
+// the tree.
+func (g *GeoReference) FromCRS(p Point) Point {
+	return Point{
+		(p.X - g.Origin[0]) / g.Scale[0],
+		(p.Y - g.Origin[1]) / g.Scale[1],
+		(p.Z - g.Origin[2]) / g.Scale[2],
+	}
+}
+
+// size returns the size in bytes of the encoded geo reference.
+func (g *GeoReference) size() int {
+	return 2 + len(g.CRS) + 6*8
+}
+
+func decodeGeoReference(reader io.Reader) (*GeoReference, error) {
+	var n uint16
+	if err := binary.Read(reader, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+
+	crs := make([]byte, n)
+	if _, err := io.ReadFull(reader, crs); err != nil {
+		return nil, err
+	}
+
+	g := &GeoReference{CRS: string(crs)}
+	if err := binary.Read(reader, binary.LittleEndian, &g.Origin); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &g.Scale); err != nil {
+		return nil, err
+	}
+	if err := g.validate(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func encodeGeoReference(writer io.Writer, g *GeoReference) error {
+	if err := g.validate(); err != nil {
+		return err
+	}
+	if err := binary.Write(writer, binary.LittleEndian, uint16(len(g.CRS))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(writer, g.CRS); err != nil {
+		return err
+	}
+	if err := binary.Write(writer, binary.LittleEndian, g.Origin); err != nil {
+		return err
+	}
+	return binary.Write(writer, binary.LittleEndian, g.Scale)
+}
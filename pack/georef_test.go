@@ -0,0 +1,159 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testGeoReference = GeoReference{
+	CRS:    "EPSG:32633",
+	Origin: [3]float64{512345.67, 6543210.89, 102.5},
+	Scale:  [3]float64{0.01, 0.01, 0.001},
+}
+
+func TestGeoReferenceHeader(t *testing.T) {
+	geo := testGeoReference
+	header := NewOctreeHeader(MipR8G8B8A8UnpackUI32, 16)
+	header.Bounds = Box{Point{-1, 2, -3}, 4}
+	header.GeoReference = &geo
+
+	var buf bytes.Buffer
+	if err := EncodeHeader(&buf, header); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != header.Size() {
+		t.Errorf("encoded %d bytes, expected %d", buf.Len(), header.Size())
+	}
+
+	var decoded OctreeHeader
+	if err := DecodeHeader(bytes.NewReader(buf.Bytes()), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.HasGeoReference() || !reflect.DeepEqual(*decoded.GeoReference, geo) {
+		t.Errorf("unexpected geo reference %+v", decoded.GeoReference)
+	}
+	if decoded.Bounds != header.Bounds || decoded.Size() != header.Size() {
+		t.Errorf("unexpected header %+v", decoded)
+	}
+
+	// Older versions have no geo references.
+	old := append([]byte(nil), buf.Bytes()...)
+	old[4] = 2
+	if err := DecodeHeader(bytes.NewReader(old), &decoded); err != errInvalidFile {
+		t.Errorf("expected errInvalidFile, got %v", err)
+	}
+
+	header.Version = 2
+	if err := EncodeHeader(&buf, header); err != errUnsupportedVersion {
+		t.Errorf("expected errUnsupportedVersion, got %v", err)
+	}
+}
+
+func TestGeoReferenceConversion(t *testing.T) {
+	geo := testGeoReference
+	p := Point{1234.5678, -42.25, 7.125}
+
+	q := geo.ToCRS(p)
+	if q.X != geo.Origin[0]+p.X*geo.Scale[0] || q.Z != geo.Origin[2]+p.Z*geo.Scale[2] {
+		t.Errorf("unexpected CRS position %v", q)
+	}
+
+	back := geo.FromCRS(q)
+	for i, d := range [3]float64{back.X - p.X, back.Y - p.Y, back.Z - p.Z} {
+		if math.Abs(d) > 1e-6 {
+			t.Errorf("axis %d: round trip is off by %g", i, d)
+		}
+	}
+}
+
+func TestBuildGeoReference(t *testing.T) {
+	build := func(geo GeoReference) (OctreeHeader, error) {
+		var (
+			buf    bytes.Buffer
+			header OctreeHeader
+		)
+		cfg := BuildConfig{
+			Worker:        NewFakeWorker([]Sample{{Point{0.5, 0.5, 0.5}, Color{1, 0, 0, 1}}}),
+			Writer:        &buf,
+			Bounds:        Box{Point{0, 0, 0}, 1},
+			VoxelsPerAxis: 4,
+			Format:        MipR8G8B8A8UnpackUI32,
+			GeoReference:  &geo,
+		}
+		_, err := BuildTree(&cfg)
+		if err == nil {
+			err = DecodeHeader(&buf, &header)
+		}
+		return header, err
+	}
+
+	header, err := build(testGeoReference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.GeoReference == nil || *header.GeoReference != testGeoReference {
+		t.Errorf("unexpected geo reference %+v", header.GeoReference)
+	}
+
+	invalid := testGeoReference
+	invalid.Scale[1] = 0
+	if _, err := build(invalid); err != errInvalidGeoRef {
+		t.Errorf("expected errInvalidGeoRef, got %v", err)
+	}
+
+	invalid = testGeoReference
+	invalid.CRS = strings.Repeat("x", math.MaxUint16+1)
+	if _, err := build(invalid); err != errLongCRS {
+		t.Errorf("expected errLongCRS, got %v", err)
+	}
+}
+
+func TestGeoReferenceText(t *testing.T) {
+	const text = `voxels 1
+crs "PROJCS[\"WGS 84 / UTM zone 33N\"]"
+origin 512345.67 6543210.89 102.5
+node 0 color #ff0000ff children 0 0 0 0 0 0 0 0
+`
+
+	var tree bytes.Buffer
+	if err := ParseText(strings.NewReader(text), &tree, MipR8G8B8A8UnpackUI32); err != nil {
+		t.Fatal(err)
+	}
+
+	var header OctreeHeader
+	if err := DecodeHeader(bytes.NewReader(tree.Bytes()), &header); err != nil {
+		t.Fatal(err)
+	}
+	expected := GeoReference{`PROJCS["WGS 84 / UTM zone 33N"]`, [3]float64{512345.67, 6543210.89, 102.5}, [3]float64{1, 1, 1}}
+	if header.GeoReference == nil || *header.GeoReference != expected {
+		t.Fatalf("unexpected geo reference %+v", header.GeoReference)
+	}
+
+	var dump bytes.Buffer
+	if err := DumpText(bytes.NewReader(tree.Bytes()), &dump); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dump.String(), "crs \"PROJCS[\\\"WGS 84 / UTM zone 33N\\\"]\"\norigin 512345.67 6543210.89 102.5\nscale 1 1 1\n") {
+		t.Errorf("geo reference missing from dump:\n%s", dump.String())
+	}
+}
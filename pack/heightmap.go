@@ -0,0 +1,172 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// HeightmapWorker treats a grayscale image as a heightfield. Each texel becomes a
+// column of unit sized voxels, with x and y of the image mapped to X and Z.
+type HeightmapWorker struct {
+	// Shell emits only the voxels of a column that are not hidden by its neighbors.
+	Shell bool
+
+	heightImg, colorImg image.Image
+	verticalScale       float64
+	levels              []int
+	width, depth        int
+}
+
+// NewHeightmapWorker creates a worker from heightImg and verticalScale, the height
+// in voxels of a white texel. If colorImg is nil the height is used as color.
+func NewHeightmapWorker(heightImg, colorImg image.Image, verticalScale float64) *HeightmapWorker {
+	rect := heightImg.Bounds()
+	w := &HeightmapWorker{
+		heightImg:     heightImg,
+		colorImg:      colorImg,
+		verticalScale: verticalScale,
+		width:         rect.Dx(),
+		depth:         rect.Dy(),
+	}
+
+	w.levels = make([]int, w.width*w.depth)
+	for z := 0; z < w.depth; z++ {
+		for x := 0; x < w.width; x++ {
+			g := color.Gray16Model.Convert(heightImg.At(rect.Min.X+x, rect.Min.Y+z)).(color.Gray16)
+			w.levels[z*w.width+x] = int(math.Floor(float64(g.Y) / math.MaxUint16 * verticalScale))
+		}
+	}
+	return w
+}
+
+func (w *HeightmapWorker) level(x, z int) int {
+	if x < 0 || z < 0 || x >= w.width || z >= w.depth {
+		return -1
+	}
+	return w.levels[z*w.width+x]
+}
+
+// Bounds returns the smallest power of two sized cube at the origin that contains
+// the heightfield. Using its size as VoxelsPerAxis maps every texel to a voxel.
+func (w *HeightmapWorker) Bounds() Box {
+	max := w.width
+	if w.depth > max {
+		max = w.depth
+	}
+
+	for _, l := range w.levels {
+		if l+1 > max {
+			max = l + 1
+		}
+	}
+
+	size := 1
+	for size < max {
+		size *= 2
+	}
+	return Box{Point{0, 0, 0}, float64(size)}
+}
+
+func (w *HeightmapWorker) texelColor(x, z int) Color {
+	img := w.colorImg
+	if img == nil {
+		img = w.heightImg
+	}
+
+	rect := img.Bounds()
+	cx := rect.Min.X + x*rect.Dx()/w.width
+	cz := rect.Min.Y + z*rect.Dy()/w.depth
+
+	r, g, b, _ := img.At(cx, cz).RGBA()
+	return Color{float32(r) / math.MaxUint16, float32(g) / math.MaxUint16, float32(b) / math.MaxUint16, 1}
+}
+
+// voxelRange returns the voxels, with centers at i+0.5, in [start, start+size).
+// Adjacent ranges never share a voxel.
+func voxelRange(start, size float64, max int) (int, int) {
+	from := int(math.Ceil(start - 0.5))
+	to := int(math.Ceil(start + size - 0.5))
+
+	if from < 0 {
+		from = 0
+	}
+
+	if to > max {
+		to = max
+	}
+	return from, to
+}
+
+// Work emits samples for the whole heightfield.
+func (w *HeightmapWorker) Work(samples chan<- Sample) error {
+	w.emit(samples, w.Bounds())
+	return nil
+}
+
+// Region returns a worker that only emits the samples with centers inside region.
+// Regions that share a face will not emit the same sample.
+func (w *HeightmapWorker) Region(region Box) BuildWorker {
+	return func(samples chan<- Sample) error {
+		w.emit(samples, region)
+		return nil
+	}
+}
+
+func (w *HeightmapWorker) emit(samples chan<- Sample, region Box) {
+	x0, x1 := voxelRange(region.Pos.X, region.Size, w.width)
+	z0, z1 := voxelRange(region.Pos.Z, region.Size, w.depth)
+	y0, y1 := voxelRange(region.Pos.Y, region.Size, math.MaxInt32)
+
+	for z := z0; z < z1; z++ {
+		for x := x0; x < x1; x++ {
+			top := w.level(x, z)
+			bottom := 0
+
+			if w.Shell {
+				// Voxels below the lowest neighbor are hidden.
+				bottom = top
+				for _, n := range [4][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+					if l := w.level(x+n[0], z+n[1]) + 1; l < bottom {
+						bottom = l
+					}
+				}
+			}
+
+			from, to := bottom, top+1
+			if from < y0 {
+				from = y0
+			}
+
+			if to > y1 {
+				to = y1
+			}
+
+			if from >= to {
+				continue
+			}
+
+			c := w.texelColor(x, z)
+			for y := from; y < to; y++ {
+				samples <- Sample{Point{float64(x) + 0.5, float64(y) + 0.5, float64(z) + 0.5}, c}
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func gradientImage() *image.Gray16 {
+	img := image.NewGray16(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			img.SetGray16(x, y, color.Gray16{uint16(x * 0xffff / 3)})
+		}
+	}
+	return img
+}
+
+func collectSamples(worker BuildWorker) []Sample {
+	samples := make(chan Sample)
+	go func() {
+		worker(samples)
+		close(samples)
+	}()
+
+	var result []Sample
+	for s := range samples {
+		result = append(result, s)
+	}
+	return result
+}
+
+func TestHeightmapWorker(t *testing.T) {
+	worker := NewHeightmapWorker(gradientImage(), nil, 3)
+
+	if b := worker.Bounds(); b.Size != 4 {
+		t.Errorf("unexpected bounds: %v", b)
+	}
+
+	VerifyWorker(t, worker.Work)
+
+	samples := collectSamples(worker.Work)
+	if len(samples) != (1+2+3+4)*4 {
+		t.Fatalf("unexpected number of samples: %v", len(samples))
+	}
+
+	min, max := samples[0].Pos.Y, samples[0].Pos.Y
+	for _, s := range samples {
+		if s.Pos.Y < min {
+			min = s.Pos.Y
+		}
+		if s.Pos.Y > max {
+			max = s.Pos.Y
+		}
+
+		// The column at x has its top voxel at level x.
+		if s.Pos.Y > s.Pos.X {
+			t.Errorf("sample above surface: %v", s.Pos)
+		}
+	}
+
+	if min != 0.5 || max != 3.5 {
+		t.Errorf("expected heights in [0.5, 3.5], got [%v, %v]", min, max)
+	}
+
+	worker.Shell = true
+	shell := collectSamples(worker.Work)
+	if len(shell) >= len(samples) {
+		t.Errorf("shell should emit fewer samples, got %v", len(shell))
+	}
+}
+
+func TestHeightmapRegions(t *testing.T) {
+	worker := NewHeightmapWorker(gradientImage(), nil, 3)
+	whole := collectSamples(worker.Work)
+
+	// Tiles with edges at texel centers as well as texel borders.
+	for _, size := range []float64{1.25, 1.5, 2} {
+		seen := make(map[Point]bool)
+		for z := 0.0; z < 4; z += size {
+			for y := 0.0; y < 4; y += size {
+				for x := 0.0; x < 4; x += size {
+					for _, s := range collectSamples(worker.Region(Box{Point{x, y, z}, size})) {
+						if seen[s.Pos] {
+							t.Errorf("sample emitted twice: %v", s.Pos)
+						}
+						seen[s.Pos] = true
+					}
+				}
+			}
+		}
+
+		if len(seen) != len(whole) {
+			t.Errorf("expected %v samples with tile size %v, got %v", len(whole), size, len(seen))
+		}
+	}
+}
@@ -0,0 +1,234 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package pack
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// httpBlockSize is the size of the blocks fetched by HTTPReaderAt.
+	httpBlockSize = 1 << 20
+
+	// httpCacheBlocks is the number of blocks kept by HTTPReaderAt.
+	httpCacheBlocks = 64
+)
+
+// HTTPReaderAt reads a remote file with HTTP range requests, so only the parts
+// that are used are downloaded, like the frames read from a Sequence. Reads are
+// served from blocks of 1MB and the most recently used 64 blocks are cached. If
+// the server does not support range requests the whole file is downloaded by the
+// first read. It is safe for concurrent use, as LoadOctreeParallel does.
+type HTTPReaderAt struct {
+	url    string
+	client *http.Client
+
+	lock   sync.Mutex
+	size   int64
+	full   []byte
+	blocks map[int64]*list.Element
+	lru    *list.List
+	stats  HTTPStats
+}
+
+// HTTPStats counts the requests made by an HTTPReaderAt and the blocks found in
+// its cache.
+type HTTPStats struct {
+	Requests, CacheHits int
+}
+
+type httpBlock struct {
+	index int64
+	data  []byte
+	err   error
+	ready chan struct{}
+}
+
+// NewHTTPReaderAt returns a reader of the file at url. If client is nil
+// http.DefaultClient is used.
+func NewHTTPReaderAt(url string, client *http.Client) *HTTPReaderAt {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &HTTPReaderAt{
+		url:    url,
+		client: client,
+		size:   -1,
+		blocks: make(map[int64]*list.Element),
+		lru:    list.New(),
+	}
+}
+
+// Stats returns the requests made so far.
+func (r *HTTPReaderAt) Stats() HTTPStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.stats
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *HTTPReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errInvalidOffset
+	}
+
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		index := pos / httpBlockSize
+
+		data, err := r.block(index)
+		if err != nil {
+			return n, err
+		}
+
+		start := pos - index*httpBlockSize
+		if start >= int64(len(data)) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], data[start:])
+	}
+	return n, nil
+}
+
+// block returns the data of a block, which is shorter than httpBlockSize for the
+// last block of the file and empty past its end.
+func (r *HTTPReaderAt) block(index int64) ([]byte, error) {
+	r.lock.Lock()
+	if r.full != nil {
+		defer r.lock.Unlock()
+		return fullBlock(r.full, index), nil
+	}
+
+	if r.size >= 0 && index*httpBlockSize >= r.size {
+		r.lock.Unlock()
+		return nil, nil
+	}
+
+	if elem, ok := r.blocks[index]; ok {
+		r.lru.MoveToFront(elem)
+		r.stats.CacheHits++
+		r.lock.Unlock()
+
+		b := elem.Value.(*httpBlock)
+		<-b.ready
+		return b.data, b.err
+	}
+
+	b := &httpBlock{index: index, ready: make(chan struct{})}
+	r.blocks[index] = r.lru.PushFront(b)
+	for r.lru.Len() > httpCacheBlocks {
+		oldest := r.lru.Back()
+		delete(r.blocks, oldest.Value.(*httpBlock).index)
+		r.lru.Remove(oldest)
+	}
+	r.stats.Requests++
+	r.lock.Unlock()
+
+	b.data, b.err = r.fetch(index)
+	close(b.ready)
+
+	// Failed blocks are fetched again by the next read.
+	if b.err != nil {
+		r.lock.Lock()
+		if elem, ok := r.blocks[index]; ok && elem.Value == b {
+			delete(r.blocks, index)
+			r.lru.Remove(elem)
+		}
+		r.lock.Unlock()
+	}
+	return b.data, b.err
+}
+
+func fullBlock(data []byte, index int64) []byte {
+	start := index * httpBlockSize
+	if start >= int64(len(data)) {
+		return nil
+	}
+
+	end := start + httpBlockSize
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	return data[start:end]
+}
+
+func (r *HTTPReaderAt) fetch(index int64) ([]byte, error) {
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	start := index * httpBlockSize
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+httpBlockSize-1))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		data, err := ioutil.ReadAll(io.LimitReader(resp.Body, httpBlockSize))
+		if err != nil {
+			return nil, err
+		}
+
+		if size, ok := contentRangeSize(resp.Header.Get("Content-Range")); ok {
+			r.lock.Lock()
+			r.size = size
+			r.lock.Unlock()
+		}
+		return data, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		return nil, nil
+	case http.StatusOK:
+		// The range was ignored and the whole file is sent.
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		r.lock.Lock()
+		r.full = data
+		r.size = int64(len(data))
+		r.lock.Unlock()
+		return fullBlock(data, index), nil
+	}
+	return nil, fmt.Errorf("could not fetch %s: %s", r.url, resp.Status)
+}
+
+// contentRangeSize returns the complete length from a Content-Range header like
+// "bytes 0-1023/4096". False is returned if the length is unknown.
+func contentRangeSize(contentRange string) (int64, bool) {
+	slash := strings.LastIndexByte(contentRange, '/')
+	if !strings.HasPrefix(contentRange, "bytes ") || slash < 0 {
+		return 0, false
+	}
+
+	size, err := strconv.ParseInt(contentRange[slash+1:], 10, 64)
+	return size, err == nil && size >= 0
+}
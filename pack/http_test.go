@@ -0,0 +1,157 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package pack
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func httpTestData() []byte {
+	data := make([]byte, 2*httpBlockSize+httpBlockSize/2)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func TestHTTPReaderAt(t *testing.T) {
+	data := httpTestData()
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("Range") == "" {
+			t.Error("expected a range request")
+		}
+		http.ServeContent(w, r, "tree.oct", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	reader := NewHTTPReaderAt(server.URL, nil)
+	read := func(off int64, n int) ([]byte, error) {
+		buf := make([]byte, n)
+		n, err := reader.ReadAt(buf, off)
+		return buf[:n], err
+	}
+
+	// A read inside the second block only fetches that block.
+	off := int64(httpBlockSize + 100)
+	if buf, err := read(off, 1000); err != nil || !bytes.Equal(buf, data[off:off+1000]) {
+		t.Fatal("unexpected data from the second block:", err)
+	}
+	if stats := reader.Stats(); stats.Requests != 1 || stats.CacheHits != 0 {
+		t.Errorf("expected one request, got %+v", stats)
+	}
+
+	// Reads across the first two blocks fetch the first and reuse the second.
+	off = httpBlockSize - 10
+	if buf, err := read(off, 20); err != nil || !bytes.Equal(buf, data[off:off+20]) {
+		t.Fatal("unexpected data across blocks:", err)
+	}
+	if stats := reader.Stats(); stats.Requests != 2 || stats.CacheHits != 1 {
+		t.Errorf("expected a second request and a cache hit, got %+v", stats)
+	}
+
+	// The last block is short.
+	off = int64(len(data)) - 10
+	if buf, err := read(off, 20); err != io.EOF || !bytes.Equal(buf, data[off:]) {
+		t.Errorf("expected the end of the file and EOF, got %v bytes: %v", len(buf), err)
+	}
+	if buf, err := read(int64(len(data))+httpBlockSize, 20); err != io.EOF || len(buf) != 0 {
+		t.Errorf("expected EOF past the end of the file, got %v bytes: %v", len(buf), err)
+	}
+
+	if stats := reader.Stats(); int(atomic.LoadInt32(&requests)) != stats.Requests || stats.Requests != 3 {
+		t.Errorf("expected 3 requests, got %+v and %v served", stats, requests)
+	}
+}
+
+func TestHTTPReaderAtNoRanges(t *testing.T) {
+	data := httpTestData()
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	reader := NewHTTPReaderAt(server.URL, nil)
+	for _, off := range []int64{10, 2 * httpBlockSize, httpBlockSize - 5} {
+		buf := make([]byte, 100)
+		if _, err := reader.ReadAt(buf, off); err != nil || !bytes.Equal(buf, data[off:off+100]) {
+			t.Fatalf("unexpected data at %v: %v", off, err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected the file to be downloaded once, got %v requests", n)
+	}
+}
+
+func TestHTTPReaderAtError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	reader := NewHTTPReaderAt(server.URL, nil)
+	if _, err := reader.ReadAt(make([]byte, 10), 0); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+
+	// Failed blocks are not cached.
+	reader.ReadAt(make([]byte, 10), 0)
+	if stats := reader.Stats(); stats.Requests != 2 || stats.CacheHits != 0 {
+		t.Errorf("expected the block to be requested again, got %+v", stats)
+	}
+}
+
+func TestHTTPReaderAtConcurrent(t *testing.T) {
+	data := httpTestData()
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(50 * time.Millisecond)
+		http.ServeContent(w, r, "tree.oct", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	// Concurrent reads of a block wait for the same request.
+	reader := NewHTTPReaderAt(server.URL, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			buf := make([]byte, 100)
+			if _, err := reader.ReadAt(buf, off); err != nil || !bytes.Equal(buf, data[off:off+100]) {
+				t.Errorf("unexpected data at %v: %v", off, err)
+			}
+		}(int64(i) * 1000)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected one request, got %v", n)
+	}
+}
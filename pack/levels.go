@@ -0,0 +1,159 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package pack
+
+import (
+	"io"
+	"math/bits"
+	"time"
+)
+
+// LevelStats is the work a build spent on the nodes of one depth below the root,
+// see BuildConfig.LevelStats. Durations are wall time.
+type LevelStats struct {
+	// NumCells is the number of nodes of the level that were sampled as a
+	// stream of their own, the root without Cells and the cells at CellLevel
+	// with them, and WorkerTime the time spent waiting for the samples of
+	// their workers. Cells restored from the cache are not counted.
+	NumCells   uint64
+	WorkerTime time.Duration
+
+	// NumSamples is the number of samples accumulated into the nodes of the
+	// level and SampleTime the time it took. Samples outside the bounds only
+	// reach the root.
+	NumSamples uint64
+	SampleTime time.Duration
+
+	// NumNodes is the number of nodes of the level in the tree written,
+	// NumBytes their size before compression and WriteTime the time spent
+	// encoding them. Trees written by the optimizer, see BuildConfig.Optimize,
+	// are only counted if they are transcoded afterwards, for palette and delta
+	// formats and checksums.
+	NumNodes  uint64
+	NumBytes  uint64
+	WriteTime time.Duration
+}
+
+// levelStats collects the LevelStats of one attempt of a build. Nil collectors
+// ignore the work, so the builder only reads the clock if the stats are asked for.
+type levelStats struct {
+	levels []LevelStats
+	depth  int
+}
+
+func newLevelStats(cfg *BuildConfig) *levelStats {
+	if !cfg.LevelStats {
+		return nil
+	}
+	depth := bits.TrailingZeros64(uint64(cfg.VoxelsPerAxis))
+	return &levelStats{levels: make([]LevelStats, depth+1), depth: depth}
+}
+
+// start returns the time work on a level starts, zero for nil collectors.
+func (s *levelStats) start() time.Time {
+	if s == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// levelOf returns the depth of the nodes of a tree with cfg.VoxelsPerAxis that
+// are voxelRes voxels wide.
+func (s *levelStats) levelOf(voxelRes int) int {
+	if s == nil {
+		return 0
+	}
+	return s.depth - bits.TrailingZeros64(uint64(voxelRes))
+}
+
+// waited adds the time since start spent waiting for the worker of a cell at depth.
+func (s *levelStats) waited(depth int, start time.Time) {
+	if s != nil {
+		s.levels[depth].WorkerTime += time.Since(start)
+	}
+}
+
+// cell counts a cell sampled at depth.
+func (s *levelStats) cell(depth int) {
+	if s != nil {
+		s.levels[depth].NumCells++
+	}
+}
+
+// accumulated adds count samples accumulated into a node at depth since start.
+func (s *levelStats) accumulated(depth int, count uint64, start time.Time) {
+	if s != nil {
+		s.levels[depth].NumSamples += count
+		s.levels[depth].SampleTime += time.Since(start)
+	}
+}
+
+// levelWriter counts the bytes the node encoder writes and attributes them to the
+// level of the node being encoded. Nil level writers ignore the nodes.
+type levelWriter struct {
+	io.Writer
+	stats  *levelStats
+	depths []uint8
+	node   uint64
+}
+
+// writer returns the writer the nodes of a tree of numNodes nodes are encoded
+// to, nil for nil collectors.
+func (s *levelStats) writer(w io.Writer, numNodes uint64) *levelWriter {
+	if s == nil {
+		return nil
+	}
+	return &levelWriter{Writer: w, stats: s, depths: make([]uint8, numNodes)}
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.stats.levels[w.depths[w.node]].NumBytes += uint64(n)
+	return n, err
+}
+
+// begin is called before node index is encoded and returns the time it started.
+func (w *levelWriter) begin(index uint64) time.Time {
+	if w == nil {
+		return time.Time{}
+	}
+	w.node = index
+	return time.Now()
+}
+
+// end attributes the node encoded since start to its level. Children are placed
+// one level below it. Nodes are encoded after their first parent, children that
+// come before it, which only optimized trees have, keep the level they have.
+func (w *levelWriter) end(children []NodeIndex, start time.Time) {
+	if w == nil {
+		return
+	}
+
+	depth := w.depths[w.node]
+	level := &w.stats.levels[depth]
+	level.WriteTime += time.Since(start)
+	level.NumNodes++
+
+	if int(depth) == w.stats.depth {
+		return
+	}
+	for _, c := range children {
+		if i := uint64(c); i > w.node && i < uint64(len(w.depths)) && w.depths[i] == 0 {
+			w.depths[i] = depth + 1
+		}
+	}
+}
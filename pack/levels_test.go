@@ -0,0 +1,65 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLevelStats(t *testing.T) {
+	// Two samples in opposite corners reach two nodes on every level below the
+	// root of a tree of three levels.
+	samples := []Sample{
+		{Point{0.1, 0.1, 0.1}, Color{1, 0, 0, 1}},
+		{Point{0.9, 0.9, 0.9}, Color{0, 1, 0, 1}},
+	}
+
+	var buf bytes.Buffer
+	cfg := BuildConfig{
+		Worker:        NewFakeWorker(samples),
+		Writer:        &buf,
+		Bounds:        Box{Point{0, 0, 0}, 1},
+		VoxelsPerAxis: 4,
+		Format:        MipR8G8B8A8UnpackUI32,
+		LevelStats:    true,
+	}
+
+	status, err := BuildTree(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Levels) != 3 {
+		t.Fatalf("expected 3 levels, got %d", len(status.Levels))
+	}
+
+	nodeSize := uint64(MipR8G8B8A8UnpackUI32.NodeSize())
+	for depth, expected := range []struct{ cells, nodes uint64 }{{1, 1}, {0, 2}, {0, 2}} {
+		l := status.Levels[depth]
+		if l.NumCells != expected.cells || l.NumSamples != 2 || l.NumNodes != expected.nodes || l.NumBytes != expected.nodes*nodeSize {
+			t.Errorf("level %d: unexpected stats %+v", depth, l)
+		}
+	}
+
+	cfg.LevelStats = false
+	cfg.Worker = NewFakeWorker(samples)
+	buf.Reset()
+	if status, err := BuildTree(&cfg); err != nil || status.Levels != nil {
+		t.Errorf("unexpected levels %v: %v", status.Levels, err)
+	}
+}
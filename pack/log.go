@@ -0,0 +1,116 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"fmt"
+	"log"
+)
+
+// LogLevel is the severity of a log message.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warning"
+	case LogError:
+		return "error"
+	}
+	return fmt.Sprintf("level %d", int(l))
+}
+
+// Logger receives the diagnostics of builds, raytracers and the servers. It is
+// called from several goroutines at once. Messages are only formatted for levels
+// it reports as enabled, callers on hot paths check Enabled before they collect
+// the arguments.
+type Logger interface {
+	Enabled(level LogLevel) bool
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// NopLogger discards every message. It is used where no Logger is set.
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Enabled(level LogLevel) bool               { return false }
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+func (nopLogger) Warnf(format string, args ...interface{})  {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+
+// LoggerOrNop returns l, or NopLogger if l is nil.
+func LoggerOrNop(l Logger) Logger {
+	if l == nil {
+		return NopLogger
+	}
+	return l
+}
+
+// stdLogger adapts a *log.Logger, see StdLogger.
+type stdLogger struct {
+	logger *log.Logger
+	level  LogLevel
+}
+
+// StdLogger returns a Logger that writes messages of level and above to logger,
+// or to the standard logger if it is nil. Messages other than info are prefixed
+// by their level.
+func StdLogger(logger *log.Logger, level LogLevel) Logger {
+	return &stdLogger{logger, level}
+}
+
+func (l *stdLogger) Enabled(level LogLevel) bool {
+	return level >= l.level
+}
+
+func (l *stdLogger) logf(level LogLevel, format string, args []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	if level != LogInfo {
+		msg = level.String() + ": " + msg
+	}
+	if l.logger == nil {
+		log.Output(3, msg)
+	} else {
+		l.logger.Output(3, msg)
+	}
+}
+
+func (l *stdLogger) Debugf(format string, args ...interface{}) { l.logf(LogDebug, format, args) }
+func (l *stdLogger) Infof(format string, args ...interface{})  { l.logf(LogInfo, format, args) }
+func (l *stdLogger) Warnf(format string, args ...interface{})  { l.logf(LogWarn, format, args) }
+func (l *stdLogger) Errorf(format string, args ...interface{}) { l.logf(LogError, format, args) }
@@ -0,0 +1,187 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// captureLogger records the messages of the levels from level up.
+type captureLogger struct {
+	lock     sync.Mutex
+	level    LogLevel
+	messages []string
+}
+
+func (l *captureLogger) Enabled(level LogLevel) bool {
+	return level >= l.level
+}
+
+func (l *captureLogger) logf(level LogLevel, format string, args []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.messages = append(l.messages, level.String()+": "+fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) Debugf(format string, args ...interface{}) { l.logf(LogDebug, format, args) }
+func (l *captureLogger) Infof(format string, args ...interface{})  { l.logf(LogInfo, format, args) }
+func (l *captureLogger) Warnf(format string, args ...interface{})  { l.logf(LogWarn, format, args) }
+func (l *captureLogger) Errorf(format string, args ...interface{}) { l.logf(LogError, format, args) }
+
+// count returns the number of messages containing all of parts.
+func (l *captureLogger) count(parts ...string) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	num := 0
+next:
+	for _, msg := range l.messages {
+		for _, part := range parts {
+			if !strings.Contains(msg, part) {
+				continue next
+			}
+		}
+		num++
+	}
+	return num
+}
+
+func (l *captureLogger) reset() {
+	l.lock.Lock()
+	l.messages = nil
+	l.lock.Unlock()
+}
+
+// failingWriter fails once more than n bytes are written.
+type failingWriter struct {
+	n int
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		written := w.n
+		w.n = 0
+		return written, errWriteFailed
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := StdLogger(log.New(&buf, "", 0), LogWarn)
+
+	if logger.Enabled(LogInfo) || !logger.Enabled(LogWarn) || !logger.Enabled(LogError) {
+		t.Error("unexpected levels enabled")
+	}
+
+	logger.Debugf("debug %d", 1)
+	logger.Infof("info %d", 2)
+	logger.Warnf("warn %d", 3)
+	logger.Errorf("error %d", 4)
+	if expected := "warning: warn 3\nerror: error 4\n"; buf.String() != expected {
+		t.Errorf("unexpected log %q", buf.String())
+	}
+
+	buf.Reset()
+	StdLogger(log.New(&buf, "", 0), LogDebug).Infof("loaded %s", "tree")
+	if buf.String() != "loaded tree\n" {
+		t.Errorf("unexpected info message %q", buf.String())
+	}
+
+	if LoggerOrNop(nil) != NopLogger || LoggerOrNop(logger) != logger || NopLogger.Enabled(LogError) {
+		t.Error("unexpected default logger")
+	}
+}
+
+func TestBuildLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := &captureLogger{level: LogDebug}
+	worker := newHashedCells()
+	cfg := BuildConfig{Cells: worker, CellCacheDir: dir, Bounds: worker.Bounds(), Logger: logger}
+
+	buildCellTest(cfg)
+	if started, finished := logger.count("debug: cell", "started"), logger.count("debug: cell", "finished"); started != 8 || finished != 8 {
+		t.Errorf("%d cells reported as started and %d as finished, expected 8", started, finished)
+	}
+
+	logger.reset()
+	buildCellTest(cfg)
+	if n := logger.count("restored from the cache"); n != 8 {
+		t.Errorf("%d cells reported as restored, expected 8", n)
+	}
+
+	// Debug messages are not formatted when the level is disabled.
+	logger = &captureLogger{level: LogInfo}
+	cfg.Logger, cfg.CellCacheDir = logger, ""
+	buildCellTest(cfg)
+	if len(logger.messages) != 0 {
+		t.Errorf("unexpected messages %q", logger.messages)
+	}
+
+	logger = &captureLogger{level: LogDebug}
+	bounds := Box{Point{0, 0, 0}, 8}
+	solid := func(x, y, z int) (Color, bool) { return Color{1, 1, 1, 1}, x == y }
+	buildCellTest(BuildConfig{
+		Workers:     []BuildWorker{NewFuncWorker(bounds, 8, solid), NewFuncWorker(bounds, 8, solid), NewFuncWorker(bounds, 8, solid)},
+		Parallelism: 2,
+		Bounds:      bounds,
+		Logger:      logger,
+	})
+	if started, finished := logger.count("debug: worker", "started"), logger.count("debug: worker", "of 3 finished"); started != 3 || finished != 3 {
+		t.Errorf("%d workers reported as started and %d as finished, expected 3", started, finished)
+	}
+
+	// A failed write is reported with the node it failed at.
+	var tree bytes.Buffer
+	if _, err := BuildTree(&BuildConfig{Worker: NewFuncWorker(bounds, 8, solid), Writer: &tree, Bounds: bounds, VoxelsPerAxis: 8, Format: MipR8G8B8A8UnpackUI32}); err != nil {
+		t.Fatal(err)
+	}
+
+	var header OctreeHeader
+	if err := DecodeHeader(bytes.NewReader(tree.Bytes()), &header); err != nil {
+		t.Fatal(err)
+	}
+
+	logger.reset()
+	output := &failingWriter{header.Size() + 3*MipR8G8B8A8UnpackUI32.NodeSize()}
+	if _, err := transcodeTree(bytes.NewReader(tree.Bytes()), output, MipR8G8B8A8UnpackUI32, nil, nil, nil, logger); !errors.Is(err, errWriteFailed) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if n := logger.count("error: could not write node 3 of", "write failed"); n != 1 {
+		t.Errorf("failed write not reported: %q", logger.messages)
+	}
+}
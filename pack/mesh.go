@@ -0,0 +1,249 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type MeshFormat int
+
+const (
+	// OBJMesh writes Wavefront OBJ with the vertex color extension, "v x y z r g b".
+	OBJMesh MeshFormat = iota
+
+	// PLYMesh writes binary little-endian PLY with per-vertex color.
+	PLYMesh
+)
+
+type (
+	meshCell struct {
+		depth   int
+		x, y, z int64
+	}
+
+	meshLeaf struct {
+		cell  meshCell
+		color Color
+	}
+
+	meshFace struct {
+		leaf, side int
+	}
+)
+
+var (
+	meshNeighbors = [6][3]int64{
+		{-1, 0, 0}, {1, 0, 0}, {0, -1, 0}, {0, 1, 0}, {0, 0, -1}, {0, 0, 1},
+	}
+
+	// Corners of each side in counter-clockwise order seen from the outside.
+	meshCorners = [6][4][3]float32{
+		{{0, 0, 0}, {0, 0, 1}, {0, 1, 1}, {0, 1, 0}},
+		{{1, 0, 0}, {1, 1, 0}, {1, 1, 1}, {1, 0, 1}},
+		{{0, 0, 0}, {1, 0, 0}, {1, 0, 1}, {0, 0, 1}},
+		{{0, 1, 0}, {0, 1, 1}, {1, 1, 1}, {1, 1, 0}},
+		{{0, 0, 0}, {0, 1, 0}, {1, 1, 0}, {1, 0, 0}},
+		{{0, 0, 1}, {1, 0, 1}, {1, 1, 1}, {0, 1, 1}},
+	}
+)
+
+func colorByte(v float32) uint8 {
+	if v <= 0 {
+		return 0
+	} else if v >= 1 {
+		return 255
+	}
+	return uint8(v*255 + 0.5)
+}
+
+// ExportMesh writes a cube for each leaf of the tree. Nodes at maxDepth are treated
+// as leafs, a negative maxDepth exports the full tree. Faces shared between adjacent
+// leafs at the same depth are culled. Coordinates are given in voxels.
+func ExportMesh(reader io.ReadSeeker, writer io.Writer, format MeshFormat, maxDepth int) error {
+	var (
+		header   OctreeHeader
+		color    Color
+		children [8]NodeIndex
+		leafs    []meshLeaf
+	)
+
+	if format != OBJMesh && format != PLYMesh {
+		return errInvalidMeshFormat
+	}
+
+	if err := DecodeHeader(reader, &header); err != nil {
+		return err
+	}
+
+	if header.Compressed() == true {
+		return errInputIsCompressed
+	}
+
+	// Position to node lookup used for face culling.
+	occupied := make(map[meshCell]bool)
+
+	if header.NumNodes > 0 {
+		type item struct {
+			index NodeIndex
+			cell  meshCell
+		}
+
+		stack := []item{{0, meshCell{}}}
+		for len(stack) > 0 {
+			n := len(stack) - 1
+			it := stack[n]
+			stack = stack[:n]
+
+			if err := readNodeAt(reader, &header, it.index, &color, children[:]); err != nil {
+				return err
+			}
+
+			leaf := it.cell.depth == maxDepth
+			if !leaf {
+				leaf = true
+				for i, child := range children {
+					if child == 0 {
+						continue
+					}
+
+					leaf = false
+					p := childPositions[i]
+					c := meshCell{it.cell.depth + 1, it.cell.x*2 + int64(p.X), it.cell.y*2 + int64(p.Y), it.cell.z*2 + int64(p.Z)}
+					stack = append(stack, item{child, c})
+				}
+			}
+
+			if leaf {
+				leafs = append(leafs, meshLeaf{it.cell, color})
+				occupied[it.cell] = true
+			}
+		}
+	}
+
+	var faces []meshFace
+	for i, leaf := range leafs {
+		for side, n := range meshNeighbors {
+			c := leaf.cell
+			c.x, c.y, c.z = c.x+n[0], c.y+n[1], c.z+n[2]
+
+			if !occupied[c] {
+				faces = append(faces, meshFace{i, side})
+			}
+		}
+	}
+
+	buffered := bufio.NewWriter(writer)
+	var err error
+
+	if format == OBJMesh {
+		err = writeOBJ(buffered, &header, leafs, faces)
+	} else {
+		err = writePLY(buffered, &header, leafs, faces)
+	}
+
+	if err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+func faceVertices(header *OctreeHeader, leaf *meshLeaf, side int) [4][3]float32 {
+	var (
+		vertices [4][3]float32
+		size     = float32(header.VoxelsPerAxis) / float32(int64(1)<<uint(leaf.cell.depth))
+		pos      = [3]float32{float32(leaf.cell.x), float32(leaf.cell.y), float32(leaf.cell.z)}
+	)
+
+	for i, corner := range meshCorners[side] {
+		for axis := range corner {
+			vertices[i][axis] = (pos[axis] + corner[axis]) * size
+		}
+	}
+	return vertices
+}
+
+func writeOBJ(writer io.Writer, header *OctreeHeader, leafs []meshLeaf, faces []meshFace) error {
+	if _, err := fmt.Fprintf(writer, "# octatron mesh, %v faces\n", len(faces)); err != nil {
+		return err
+	}
+
+	for _, face := range faces {
+		leaf := &leafs[face.leaf]
+		c := leaf.color
+
+		for _, v := range faceVertices(header, leaf, face.side) {
+			if _, err := fmt.Fprintf(writer, "v %v %v %v %v %v %v\n", v[0], v[1], v[2], c.R, c.G, c.B); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := range faces {
+		base := i*4 + 1
+		if _, err := fmt.Fprintf(writer, "f %v %v %v %v\n", base, base+1, base+2, base+3); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writePLY(writer io.Writer, header *OctreeHeader, leafs []meshLeaf, faces []meshFace) error {
+	const plyHeader = "ply\nformat binary_little_endian 1.0\n" +
+		"element vertex %v\nproperty float x\nproperty float y\nproperty float z\n" +
+		"property uchar red\nproperty uchar green\nproperty uchar blue\n" +
+		"element face %v\nproperty list uchar int vertex_indices\nend_header\n"
+
+	if _, err := fmt.Fprintf(writer, plyHeader, len(faces)*4, len(faces)); err != nil {
+		return err
+	}
+
+	type plyVertex struct {
+		Pos [3]float32
+		Col [3]uint8
+	}
+
+	for _, face := range faces {
+		leaf := &leafs[face.leaf]
+		c := leaf.color
+
+		for _, v := range faceVertices(header, leaf, face.side) {
+			vertex := plyVertex{v, [3]uint8{colorByte(c.R), colorByte(c.G), colorByte(c.B)}}
+			if err := binary.Write(writer, binary.LittleEndian, vertex); err != nil {
+				return err
+			}
+		}
+	}
+
+	type plyFace struct {
+		Num     uint8
+		Indices [4]int32
+	}
+
+	for i := range faces {
+		base := int32(i * 4)
+		face := plyFace{4, [4]int32{base, base + 1, base + 2, base + 3}}
+		if err := binary.Write(writer, binary.LittleEndian, face); err != nil {
+			return err
+		}
+	}
+	return nil
+}
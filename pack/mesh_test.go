@@ -0,0 +1,121 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func solidTree() []byte {
+	var buffer bytes.Buffer
+	format := MipR8G8B8A8UnpackUI32
+
+	header := NewOctreeHeader(format, 2)
+	header.NumNodes = 9
+	header.NumLeafs = 8
+
+	if err := EncodeHeader(&buffer, header); err != nil {
+		panic(err)
+	}
+
+	color := Color{1, 0, 0, 1}
+	children := []NodeIndex{1, 2, 3, 4, 5, 6, 7, 8}
+
+	if err := EncodeNode(&buffer, format, color, children); err != nil {
+		panic(err)
+	}
+
+	for i := 0; i < 8; i++ {
+		if err := EncodeNode(&buffer, format, color, make([]NodeIndex, 8)); err != nil {
+			panic(err)
+		}
+	}
+	return buffer.Bytes()
+}
+
+func countPrefix(text, prefix string) int {
+	num := 0
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			num++
+		}
+	}
+	return num
+}
+
+func TestExportOBJ(t *testing.T) {
+	tree := solidTree()
+
+	for maxDepth, numFaces := range map[int]int{-1: 24, 0: 6, 1: 24} {
+		var buffer bytes.Buffer
+		if err := ExportMesh(bytes.NewReader(tree), &buffer, OBJMesh, maxDepth); err != nil {
+			panic(err)
+		}
+
+		text := buffer.String()
+		if n := countPrefix(text, "f "); n != numFaces {
+			t.Errorf("expected %v faces at depth %v, got %v", numFaces, maxDepth, n)
+		}
+
+		if n := countPrefix(text, "v "); n != numFaces*4 {
+			t.Errorf("expected %v vertices at depth %v, got %v", numFaces*4, maxDepth, n)
+		}
+
+		// No face may be inside the cube.
+		for _, line := range strings.Split(text, "\n") {
+			var x, y, z, r, g, b float32
+			if n, _ := fmt.Sscan(strings.TrimPrefix(line, "v "), &x, &y, &z, &r, &g, &b); n != 6 || !strings.HasPrefix(line, "v ") {
+				continue
+			}
+
+			if x != 0 && x != 2 && y != 0 && y != 2 && z != 0 && z != 2 {
+				t.Fatalf("interior vertex: %v", line)
+			}
+
+			if r != 1 || g != 0 || b != 0 {
+				t.Fatalf("invalid vertex color: %v", line)
+			}
+		}
+	}
+}
+
+func TestExportPLY(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := ExportMesh(bytes.NewReader(solidTree()), &buffer, PLYMesh, -1); err != nil {
+		panic(err)
+	}
+
+	data := buffer.Bytes()
+	end := bytes.Index(data, []byte("end_header\n"))
+	if end < 0 {
+		t.Fatal("missing ply header")
+	}
+
+	header := string(data[:end])
+	if !strings.Contains(header, "element vertex 96\n") || !strings.Contains(header, "element face 24\n") {
+		t.Errorf("unexpected ply header: %v", header)
+	}
+
+	const vertexSize, faceSize = 15, 17
+	if size := len(data) - end - len("end_header\n"); size != 96*vertexSize+24*faceSize {
+		t.Errorf("unexpected body size: %v", size)
+	}
+}
@@ -0,0 +1,347 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type meshVertex struct {
+	pos      [3]float64
+	col      Color
+	hasColor bool
+}
+
+type (
+	plyProperty struct {
+		name, typ, countType string
+		list                 bool
+	}
+
+	plyElement struct {
+		name       string
+		count      int
+		properties []plyProperty
+	}
+)
+
+func meshIndex(token string, numVertices int) (int, error) {
+	if i := strings.IndexByte(token, '/'); i >= 0 {
+		token = token[:i]
+	}
+
+	idx, err := strconv.Atoi(token)
+	if err != nil {
+		return 0, err
+	}
+
+	if idx < 0 {
+		idx += numVertices
+	} else {
+		idx--
+	}
+
+	if idx < 0 || idx >= numVertices {
+		return 0, errInvalidMesh
+	}
+	return idx, nil
+}
+
+// loadOBJ reads vertices and faces from a Wavefront OBJ file. Vertex colors
+// are read from the "v x y z r g b" extension. Polygons are triangulated as fans.
+func loadOBJ(reader io.Reader) ([]meshVertex, [][3]int, error) {
+	var (
+		vertices  []meshVertex
+		triangles [][3]int
+		scanner   = bufio.NewScanner(reader)
+	)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "v":
+			if len(fields) != 4 && len(fields) != 7 {
+				return nil, nil, errInvalidMesh
+			}
+
+			var values [6]float64
+			for i, f := range fields[1:] {
+				v, err := strconv.ParseFloat(f, 64)
+				if err != nil {
+					return nil, nil, err
+				}
+				values[i] = v
+			}
+
+			vertex := meshVertex{pos: [3]float64{values[0], values[1], values[2]}}
+			if len(fields) == 7 {
+				vertex.col = Color{float32(values[3]), float32(values[4]), float32(values[5]), 1}
+				vertex.hasColor = true
+			}
+			vertices = append(vertices, vertex)
+		case "f":
+			if len(fields) < 4 {
+				return nil, nil, errInvalidMesh
+			}
+
+			indices := make([]int, len(fields)-1)
+			for i, f := range fields[1:] {
+				idx, err := meshIndex(f, len(vertices))
+				if err != nil {
+					return nil, nil, err
+				}
+				indices[i] = idx
+			}
+
+			for i := 2; i < len(indices); i++ {
+				triangles = append(triangles, [3]int{indices[0], indices[i-1], indices[i]})
+			}
+		}
+	}
+	return vertices, triangles, scanner.Err()
+}
+
+func plyTypeSize(typ string) int {
+	switch typ {
+	case "char", "uchar", "int8", "uint8":
+		return 1
+	case "short", "ushort", "int16", "uint16":
+		return 2
+	case "int", "uint", "float", "int32", "uint32", "float32":
+		return 4
+	case "double", "float64":
+		return 8
+	}
+	return 0
+}
+
+func plyIsFloat(typ string) bool {
+	switch typ {
+	case "float", "double", "float32", "float64":
+		return true
+	}
+	return false
+}
+
+func readPLYBinary(reader io.Reader, order binary.ByteOrder, typ string) (float64, error) {
+	var buf [8]byte
+	size := plyTypeSize(typ)
+	if size == 0 {
+		return 0, errInvalidMesh
+	}
+
+	if _, err := io.ReadFull(reader, buf[:size]); err != nil {
+		return 0, err
+	}
+
+	switch typ {
+	case "char", "int8":
+		return float64(int8(buf[0])), nil
+	case "uchar", "uint8":
+		return float64(buf[0]), nil
+	case "short", "int16":
+		return float64(int16(order.Uint16(buf[:]))), nil
+	case "ushort", "uint16":
+		return float64(order.Uint16(buf[:])), nil
+	case "int", "int32":
+		return float64(int32(order.Uint32(buf[:]))), nil
+	case "uint", "uint32":
+		return float64(order.Uint32(buf[:])), nil
+	case "float", "float32":
+		return float64(math.Float32frombits(order.Uint32(buf[:]))), nil
+	default:
+		return math.Float64frombits(order.Uint64(buf[:])), nil
+	}
+}
+
+// loadPLY reads vertices and faces from an ascii or binary PLY file.
+func loadPLY(reader io.Reader) ([]meshVertex, [][3]int, error) {
+	var (
+		elements []plyElement
+		order    binary.ByteOrder
+		buffered = bufio.NewReader(reader)
+	)
+
+	for first := true; ; first = false {
+		line, err := buffered.ReadString('\n')
+		if err != nil {
+			return nil, nil, err
+		}
+
+		fields := strings.Fields(line)
+		if first {
+			if len(fields) != 1 || fields[0] != "ply" {
+				return nil, nil, errInvalidMesh
+			}
+			continue
+		}
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "end_header" {
+			break
+		}
+
+		switch fields[0] {
+		case "format":
+			if len(fields) < 2 {
+				return nil, nil, errInvalidMesh
+			}
+
+			switch fields[1] {
+			case "ascii":
+			case "binary_little_endian":
+				order = binary.LittleEndian
+			case "binary_big_endian":
+				order = binary.BigEndian
+			default:
+				return nil, nil, errInvalidMesh
+			}
+		case "element":
+			if len(fields) != 3 {
+				return nil, nil, errInvalidMesh
+			}
+
+			count, err := strconv.Atoi(fields[2])
+			if err != nil || count < 0 {
+				return nil, nil, errInvalidMesh
+			}
+			elements = append(elements, plyElement{name: fields[1], count: count})
+		case "property":
+			if len(elements) == 0 {
+				return nil, nil, errInvalidMesh
+			}
+
+			e := &elements[len(elements)-1]
+			if len(fields) == 5 && fields[1] == "list" {
+				e.properties = append(e.properties, plyProperty{name: fields[4], typ: fields[3], countType: fields[2], list: true})
+			} else if len(fields) == 3 {
+				e.properties = append(e.properties, plyProperty{name: fields[2], typ: fields[1]})
+			} else {
+				return nil, nil, errInvalidMesh
+			}
+		}
+	}
+
+	var words *bufio.Scanner
+	if order == nil {
+		words = bufio.NewScanner(buffered)
+		words.Split(bufio.ScanWords)
+	}
+
+	read := func(typ string) (float64, error) {
+		if order != nil {
+			return readPLYBinary(buffered, order, typ)
+		}
+
+		if !words.Scan() {
+			if err := words.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.ErrUnexpectedEOF
+		}
+		return strconv.ParseFloat(words.Text(), 64)
+	}
+
+	var (
+		vertices  []meshVertex
+		triangles [][3]int
+	)
+
+	for _, e := range elements {
+		for i := 0; i < e.count; i++ {
+			var (
+				vertex  meshVertex
+				indices []int
+			)
+
+			for _, p := range e.properties {
+				if p.list {
+					n, err := read(p.countType)
+					if err != nil {
+						return nil, nil, err
+					}
+
+					for j := 0; j < int(n); j++ {
+						v, err := read(p.typ)
+						if err != nil {
+							return nil, nil, err
+						}
+						indices = append(indices, int(v))
+					}
+					continue
+				}
+
+				v, err := read(p.typ)
+				if err != nil {
+					return nil, nil, err
+				}
+
+				c := float32(v)
+				if !plyIsFloat(p.typ) {
+					c /= 255
+				}
+
+				switch p.name {
+				case "x":
+					vertex.pos[0] = v
+				case "y":
+					vertex.pos[1] = v
+				case "z":
+					vertex.pos[2] = v
+				case "red":
+					vertex.col.R, vertex.hasColor = c, true
+				case "green":
+					vertex.col.G = c
+				case "blue":
+					vertex.col.B = c
+				}
+			}
+
+			switch e.name {
+			case "vertex":
+				vertex.col.A = 1
+				vertices = append(vertices, vertex)
+			case "face":
+				for j := 2; j < len(indices); j++ {
+					triangles = append(triangles, [3]int{indices[0], indices[j-1], indices[j]})
+				}
+			}
+		}
+	}
+
+	for _, t := range triangles {
+		for _, idx := range t {
+			if idx < 0 || idx >= len(vertices) {
+				return nil, nil, errInvalidMesh
+			}
+		}
+	}
+	return vertices, triangles, nil
+}
@@ -0,0 +1,168 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import "io"
+
+// NodeFlags are stored with every node of formats with node flags, see
+// OctreeFormat.HasNodeFlags. Bits that are not defined are reserved for later
+// revisions, like contour, palette and occupancy data, and must be zero.
+type NodeFlags uint8
+
+const (
+	// NodeLeaf marks a node without children. The child indices of leafs are
+	// stored as zero and ignored when decoded.
+	NodeLeaf NodeFlags = 1 << iota
+
+	nodeFlagsDefined = NodeLeaf
+)
+
+// Leaf reports if the node is a leaf.
+func (f NodeFlags) Leaf() bool {
+	return f&NodeLeaf != 0
+}
+
+// HasNodeFlags reports if nodes store NodeFlags. Formats without them mark
+// nodes as leafs if all their child indices are zero, see InferNodeFlags.
+func (f OctreeFormat) HasNodeFlags() bool {
+	return f == MipR8G8B8A8FlagsUI32
+}
+
+// InferNodeFlags returns the flags of a node of a format without node flags.
+// Child index zero is the root and never a child, so nodes that only store
+// zero have no children.
+func InferNodeFlags(children []NodeIndex) NodeFlags {
+	for _, child := range children {
+		if child != 0 {
+			return 0
+		}
+	}
+	return NodeLeaf
+}
+
+// DecodeNodeFlags works like DecodeNodeAt and also returns the flags of the node.
+// Flags are inferred from the children for formats without node flags.
+func DecodeNodeFlags(reader io.Reader, format OctreeFormat, index NodeIndex, color *Color, children []NodeIndex) (NodeFlags, error) {
+	if format.HasNodeFlags() {
+		return decodeFlagged(reader, color, children)
+	}
+	if err := DecodeNodeAt(reader, format, index, color, children); err != nil {
+		return 0, err
+	}
+	return InferNodeFlags(children), nil
+}
+
+// EncodeNodeFlags works like EncodeNodeAt but stores flags with formats with
+// node flags. Other formats can not store them and fail with an error if the
+// flags differ from those inferred from the children.
+func EncodeNodeFlags(writer io.Writer, format OctreeFormat, index NodeIndex, color Color, children []NodeIndex, flags NodeFlags) error {
+	if !format.HasNodeFlags() {
+		if flags != InferNodeFlags(children) {
+			return errNodeFlags
+		}
+		return EncodeNodeAt(writer, format, index, color, children)
+	}
+
+	for _, child := range children {
+		if child > format.MaxIndex() {
+			return errOctreeOverflow
+		}
+	}
+	return encodeFlagged(writer, color, children, flags)
+}
+
+func decodeFlagged(reader io.Reader, color *Color, children []NodeIndex) (NodeFlags, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(reader, head[:]); err != nil {
+		return 0, err
+	}
+
+	flags := NodeFlags(head[4])
+	if flags&^nodeFlagsDefined != 0 {
+		return 0, errNodeFlags
+	}
+
+	color.R = float32(head[0]) / 255
+	color.G = float32(head[1]) / 255
+	color.B = float32(head[2]) / 255
+	color.A = float32(head[3]) / 255
+
+	if err := readIndices(reader, 4, children); err != nil {
+		return 0, err
+	}
+
+	if flags.Leaf() {
+		for i := range children {
+			children[i] = 0
+		}
+	}
+	return flags, nil
+}
+
+func encodeFlagged(writer io.Writer, color Color, children []NodeIndex, flags NodeFlags) error {
+	if flags&^nodeFlagsDefined != 0 {
+		return errNodeFlags
+	}
+
+	var head [5]byte
+	col := color.bytes()
+	copy(head[:], col[:])
+	head[4] = byte(flags)
+	if _, err := writer.Write(head[:]); err != nil {
+		return err
+	}
+
+	if flags.Leaf() {
+		var none [8]NodeIndex
+		children = none[:len(children)]
+	}
+	return writeIndices(writer, 4, children)
+}
+
+// DecodeFlags works like Decode and also returns the flags of the node.
+func (d *NodeDecoder) DecodeFlags(color *Color, children []NodeIndex) (NodeFlags, error) {
+	if !d.format.HasNodeFlags() {
+		if err := d.Decode(color, children); err != nil {
+			return 0, err
+		}
+		return InferNodeFlags(children), nil
+	}
+
+	d.index++
+	flags, err := decodeFlagged(d.reader, color, children)
+	return flags, d.corruptAt(d.index-1, err)
+}
+
+// EncodeFlags works like Encode but stores flags with formats with node flags.
+// See EncodeNodeFlags.
+func (e *NodeEncoder) EncodeFlags(color Color, children []NodeIndex, flags NodeFlags) error {
+	if !e.format.HasNodeFlags() {
+		if flags != InferNodeFlags(children) {
+			return errNodeFlags
+		}
+		return e.Encode(color, children)
+	}
+
+	if err := EncodeNodeFlags(e.writer, e.format, e.index, color, children, flags); err != nil {
+		return err
+	}
+	e.index++
+	e.stats.NumNodes++
+	e.stats.ColorBytes += uint64(e.format.ColorSize())
+	return nil
+}
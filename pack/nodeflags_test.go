@@ -0,0 +1,140 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestNodeFlags(t *testing.T) {
+	var (
+		buffer   bytes.Buffer
+		color    Color
+		childIn  [8]NodeIndex
+		childOut = [8]NodeIndex{0, 3, 0, 0, 9, 0, 0, 0}
+	)
+
+	// The leaf flag wins over stale child indices.
+	if err := EncodeNodeFlags(&buffer, MipR8G8B8A8FlagsUI32, 0, Color{1, 0, 0, 1}, childOut[:], NodeLeaf); err != nil {
+		panic(err)
+	}
+	if buffer.Len() != MipR8G8B8A8FlagsUI32.NodeSize() || buffer.Len() != 37 {
+		t.Errorf("unexpected node size: %v", buffer.Len())
+	}
+
+	flags, err := DecodeNodeFlags(bytes.NewReader(buffer.Bytes()), MipR8G8B8A8FlagsUI32, 0, &color, childIn[:])
+	if err != nil {
+		panic(err)
+	}
+	if !flags.Leaf() || childIn != [8]NodeIndex{} || color != (Color{1, 0, 0, 1}) {
+		t.Errorf("unexpected leaf %v %v %v", flags, childIn, color)
+	}
+
+	// Inner nodes keep their children.
+	buffer.Reset()
+	if err := EncodeNodeFlags(&buffer, MipR8G8B8A8FlagsUI32, 0, Color{1, 0, 0, 1}, childOut[:], 0); err != nil {
+		panic(err)
+	}
+	if flags, err := DecodeNodeFlags(&buffer, MipR8G8B8A8FlagsUI32, 0, &color, childIn[:]); err != nil || flags != 0 || childIn != childOut {
+		t.Errorf("unexpected inner node %v %v %v", flags, childIn, err)
+	}
+
+	// Reserved bits are rejected.
+	if err := EncodeNodeFlags(ioutil.Discard, MipR8G8B8A8FlagsUI32, 0, color, childOut[:], 0x80); err != errNodeFlags {
+		t.Errorf("expected reserved bits to fail, got %v", err)
+	}
+	node := make([]byte, MipR8G8B8A8FlagsUI32.NodeSize())
+	node[4] = 0x2
+	if _, err := DecodeNodeFlags(bytes.NewReader(node), MipR8G8B8A8FlagsUI32, 0, &color, childIn[:]); err != errNodeFlags {
+		t.Errorf("expected reserved bits to fail, got %v", err)
+	}
+
+	// Formats without node flags can only store the inferred flags.
+	if err := EncodeNodeFlags(ioutil.Discard, MipR8G8B8A8UnpackUI32, 0, color, childOut[:], NodeLeaf); err != errNodeFlags {
+		t.Errorf("expected a leaf with children to fail, got %v", err)
+	}
+	if err := EncodeNodeFlags(ioutil.Discard, MipR8G8B8A8UnpackUI32, 0, color, childOut[:], 0); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestLegacyNodeFlags transcodes a tree without node flags, where a node only
+// references index zero, and back.
+func TestLegacyNodeFlags(t *testing.T) {
+	const text = `version 1
+voxels 2
+node 0 color #ffffffff children 1 0 2 0 0 0 0 0
+node 1 color #ff0000ff children 0 0 0 0 0 0 0 0
+node 2 color #00ff00ff children 0 0 0 0 0 0 0 0
+`
+
+	var legacy bytes.Buffer
+	if err := ParseText(strings.NewReader(text), &legacy, MipR8G8B8A8UnpackUI32); err != nil {
+		t.Fatal(err)
+	}
+
+	var flagged, unpacked bytes.Buffer
+	if err := TranscodeTree(bytes.NewReader(legacy.Bytes()), &flagged, MipR8G8B8A8FlagsUI32); err != nil {
+		t.Fatal(err)
+	}
+
+	var header OctreeHeader
+	reader := bytes.NewReader(flagged.Bytes())
+	if err := DecodeHeader(reader, &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != binaryVersion {
+		t.Errorf("expected version %d, got %d", binaryVersion, header.Version)
+	}
+
+	var (
+		color    Color
+		children [8]NodeIndex
+	)
+	decoder := NewNodeDecoder(reader, header.Format, nil)
+	for i, expected := range []NodeFlags{0, NodeLeaf, NodeLeaf} {
+		flags, err := decoder.DecodeFlags(&color, children[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flags != expected {
+			t.Errorf("node %d: expected flags %v, got %v", i, expected, flags)
+		}
+	}
+
+	if err := TranscodeTree(bytes.NewReader(flagged.Bytes()), &unpacked, MipR8G8B8A8UnpackUI32); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the version differs.
+	expected := legacy.Bytes()
+	expected[4] = binaryVersion
+	if !bytes.Equal(unpacked.Bytes(), expected) {
+		t.Error("round trip through node flags changed the tree")
+	}
+
+	// Node flags need version 2.
+	old := append([]byte(nil), flagged.Bytes()...)
+	old[4] = 1
+	if err := DecodeHeader(bytes.NewReader(old), &header); err != ErrUnsupportedFormat {
+		t.Errorf("expected version 1 to fail, got %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// defaultObserveRate is the fraction of samples observed if
+// BuildConfig.SampleObserveRate is zero.
+const defaultObserveRate = 1000
+
+// SampleObserver receives copies of a fraction of the samples of a build, see
+// BuildConfig.SampleObserver. Every stream of samples, the whole build or one cell,
+// is observed by its own fork that is merged back when the stream is done, so
+// observers need no locking. Samples are in the convention of BuildConfig.Bounds
+// with the colors of the workers.
+type SampleObserver interface {
+	Fork() SampleObserver
+	Observe(sample Sample)
+	Merge(fork SampleObserver)
+}
+
+// observer passes one of every rate inserted samples of a stream to a
+// SampleObserver. The count is carried over from stream to stream, so small cells
+// are observed at the same rate. Nil observers ignore samples.
+type observer struct {
+	SampleObserver
+	coords CoordinateSystem
+	rate   int
+	n      int
+}
+
+// newObserver returns the observer of one attempt of a build, nil without a
+// SampleObserver. It is merged into BuildConfig.SampleObserver when the attempt
+// succeeds, samples of restarted attempts are not counted.
+func newObserver(cfg *BuildConfig) *observer {
+	if cfg.SampleObserver == nil {
+		return nil
+	}
+
+	rate := cfg.SampleObserveRate
+	if rate <= 0 {
+		rate = defaultObserveRate
+	}
+	return &observer{cfg.SampleObserver.Fork(), cfg.Coordinates, rate, 0}
+}
+
+func (o *observer) fork() *observer {
+	if o == nil {
+		return nil
+	}
+	return &observer{o.SampleObserver.Fork(), o.coords, o.rate, o.n}
+}
+
+func (o *observer) merge(fork *observer) {
+	if o == nil {
+		return
+	}
+	o.SampleObserver.Merge(fork.SampleObserver)
+	o.n = fork.n
+}
+
+// observe counts an inserted sample in tree space.
+func (o *observer) observe(sample Sample) {
+	if o == nil {
+		return
+	}
+
+	if o.n++; o.n%o.rate == 0 {
+		sample.Pos = o.coords.FromTree(sample.Pos)
+		o.SampleObserver.Observe(sample)
+	}
+}
+
+// SampleStats is a SampleObserver that collects the distribution of the observed
+// samples, to choose color filters and outlier thresholds. It is written as JSON
+// with WriteJSON.
+type SampleStats struct {
+	// Samples is the number of samples observed.
+	Samples uint64 `json:"samples"`
+
+	// Histograms holds the number of samples of each 8-bit value of the red,
+	// green, blue and alpha channels.
+	Histograms [4][256]uint64 `json:"histograms"`
+
+	// Min and Max are the extent of the positions, set if there are samples.
+	Min Point `json:"min"`
+	Max Point `json:"max"`
+
+	// Cells is the number of samples of each voxel, keyed by its "x,y,z"
+	// coordinates. Samples outside the bounds are not counted.
+	Cells map[string]uint64 `json:"cells"`
+
+	bounds Box
+	depth  int
+}
+
+// NewSampleStats returns stats that count the samples of the voxels of a tree with
+// bounds and voxelsPerAxis, which must be a power of two.
+func NewSampleStats(bounds Box, voxelsPerAxis int) *SampleStats {
+	return &SampleStats{
+		Cells:  make(map[string]uint64),
+		bounds: bounds,
+		depth:  bits.TrailingZeros64(uint64(voxelsPerAxis)),
+	}
+}
+
+func (s *SampleStats) Fork() SampleObserver {
+	return &SampleStats{Cells: make(map[string]uint64), bounds: s.bounds, depth: s.depth}
+}
+
+func (s *SampleStats) Observe(sample Sample) {
+	c := sample.Col
+	for i, v := range [4]float32{c.R, c.G, c.B, c.A} {
+		s.Histograms[i][channelByte(v)]++
+	}
+	s.extend(sample.Pos, sample.Pos)
+	s.Samples++
+
+	// Voxels are found like the builder inserts samples, so samples on faces
+	// shared by two voxels are counted by the same one.
+	pos := sample.Pos
+	if !s.bounds.containsClosed(pos) {
+		return
+	}
+
+	var x, y, z int
+	bounds := s.bounds
+	for level := 0; level < s.depth; level++ {
+		i := childIndex(bounds, pos)
+		bounds = childBox(bounds, i)
+
+		p := ChildPositions[i]
+		x, y, z = x<<1|int(p[0]), y<<1|int(p[1]), z<<1|int(p[2])
+	}
+	s.Cells[fmt.Sprintf("%d,%d,%d", x, y, z)]++
+}
+
+func (s *SampleStats) Merge(fork SampleObserver) {
+	f := fork.(*SampleStats)
+	if f.Samples == 0 {
+		return
+	}
+
+	for i := range s.Histograms {
+		for j, n := range f.Histograms[i] {
+			s.Histograms[i][j] += n
+		}
+	}
+	for cell, n := range f.Cells {
+		s.Cells[cell] += n
+	}
+	s.extend(f.Min, f.Max)
+	s.Samples += f.Samples
+}
+
+// extend grows the extent to include min and max.
+func (s *SampleStats) extend(min, max Point) {
+	if s.Samples == 0 {
+		s.Min, s.Max = min, max
+		return
+	}
+
+	s.Min = Point{math.Min(s.Min.X, min.X), math.Min(s.Min.Y, min.Y), math.Min(s.Min.Z, min.Z)}
+	s.Max = Point{math.Max(s.Max.X, max.X), math.Max(s.Max.Y, max.Y), math.Max(s.Max.Z, max.Z)}
+}
+
+// WriteJSON writes the stats as indented JSON.
+func (s *SampleStats) WriteJSON(writer io.Writer) error {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "\t")
+	return encoder.Encode(s)
+}
+
+// channelByte returns the 8-bit value of a color channel in the range zero to one.
+func channelByte(v float32) uint8 {
+	switch {
+	case !(v > 0):
+		return 0
+	case v >= 1:
+		return 255
+	}
+	return uint8(v*255 + 0.5)
+}
@@ -0,0 +1,105 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package pack
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSampleStats(t *testing.T) {
+	var samples []Sample
+	for i := 0; i < 1000; i++ {
+		x := float64(i%10) + 0.5
+		samples = append(samples, Sample{Point{x, 1, 2}, Color{float32(i%2) * 0.5, 1, 0, 1}})
+	}
+
+	bounds := Box{Point{0, 0, 0}, 16}
+	for _, rate := range []int{1, 10} {
+		stats := NewSampleStats(bounds, 4)
+		cfg := BuildConfig{
+			Worker:            NewFakeWorker(samples),
+			Writer:            &bytes.Buffer{},
+			Bounds:            bounds,
+			VoxelsPerAxis:     4,
+			Format:            MipR8G8B8A8UnpackUI32,
+			SampleObserver:    stats,
+			SampleObserveRate: rate,
+		}
+		if _, err := BuildTree(&cfg); err != nil {
+			t.Fatal(err)
+		}
+
+		n := uint64(1000 / rate)
+		if stats.Samples != n {
+			t.Fatalf("rate %d: expected %d samples, got %d", rate, n, stats.Samples)
+		}
+		if h := stats.Histograms[1][255]; h != n {
+			t.Errorf("rate %d: expected %d samples of full green, got %d", rate, n, h)
+		}
+		if h := stats.Histograms[0][0] + stats.Histograms[0][128]; h != n {
+			t.Errorf("rate %d: expected %d samples of zero or half red, got %d", rate, n, h)
+		}
+
+		var cells uint64
+		for _, c := range stats.Cells {
+			cells += c
+		}
+		if cells != n {
+			t.Errorf("rate %d: expected %d samples in cells, got %d", rate, n, cells)
+		}
+
+		if rate == 1 {
+			if stats.Min != (Point{0.5, 1, 2}) || stats.Max != (Point{9.5, 1, 2}) {
+				t.Errorf("unexpected extent %v to %v", stats.Min, stats.Max)
+			}
+			if c := stats.Cells["0,0,0"]; c != 400 {
+				t.Errorf("expected 400 samples in the first voxel, got %d", c)
+			}
+		}
+	}
+}
+
+func TestSampleStatsCells(t *testing.T) {
+	worker := newHashedCells()
+	bounds := worker.Bounds()
+
+	plain := NewSampleStats(bounds, 8)
+	buildCellTest(BuildConfig{Worker: worker.Work, Bounds: bounds, SampleObserver: plain, SampleObserveRate: 1})
+
+	cells := NewSampleStats(bounds, 8)
+	buildCellTest(BuildConfig{Cells: worker, Bounds: bounds, SampleObserver: cells, SampleObserveRate: 1})
+
+	if plain.Samples == 0 || !reflect.DeepEqual(plain, cells) {
+		t.Errorf("expected the stats of cells to be merged into those of a plain build")
+	}
+
+	var buf bytes.Buffer
+	if err := cells.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded SampleStats
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Samples != cells.Samples || !reflect.DeepEqual(decoded.Cells, cells.Cells) {
+		t.Error("expected the stats to survive a JSON round trip")
+	}
+}
@@ -19,7 +19,6 @@ package pack
 
 import (
 	"compress/zlib"
-	"encoding/binary"
 	"io"
 	"io/ioutil"
 	"math"
@@ -28,6 +27,13 @@ import (
 
 const leafThreshold = 0 // Should perhaps move this to be controlled by the user.
 
+// optNoChild marks missing children in the per level files of the optimizer, where
+// zero is a valid index. The files use 64-bit indices so no level overflows.
+const (
+	optNoChild = NodeIndex(math.MaxUint64)
+	optFormat  = MipR8G8B8A8UnpackUI64
+)
+
 type OptStatus struct {
 	NumMerged uint32
 	MemMap    []int64
@@ -44,7 +50,7 @@ type optInput struct {
 
 func CompressTree(reader io.Reader, writer io.Writer) error {
 	var header OctreeHeader
-	err := binary.Read(reader, binary.LittleEndian, &header)
+	err := DecodeHeader(reader, &header)
 	if err != nil {
 		return err
 	}
@@ -52,9 +58,9 @@ func CompressTree(reader io.Reader, writer io.Writer) error {
 	if header.Compressed() == true {
 		return errInputIsCompressed
 	}
-	header.Flags = header.Flags & compressedMask
+	header.Flags |= compressedMask
 
-	err = binary.Write(writer, binary.LittleEndian, header)
+	err = EncodeHeader(writer, header)
 	if err != nil {
 		return err
 	}
@@ -62,21 +68,40 @@ func CompressTree(reader io.Reader, writer io.Writer) error {
 	zip := zlib.NewWriter(writer)
 	defer zip.Close()
 
+	// The checksums cover the uncompressed nodes, the trailer is compressed with
+	// them.
+	var (
+		out           io.Writer = zip
+		checkedReader *ChecksumReader
+		checkedWriter *ChecksumWriter
+	)
+	if header.Checksummed() {
+		checkedReader = NewChecksumReader(reader, true)
+		checkedWriter = NewChecksumWriter(zip)
+		reader, out = checkedReader, checkedWriter
+	}
+
 	var (
 		color    Color
-		children [8]uint32
+		children [8]NodeIndex
 	)
 
-	for i := uint64(0); i < header.NumNodes; i++ {
-		if err := DecodeNode(reader, header.Format, &color, children[:]); err != nil {
+	for i := NodeIndex(0); i < NodeIndex(header.NumNodes); i++ {
+		if err := DecodeNodeAt(reader, header.Format, i, &color, children[:]); err != nil {
 			return err
 		}
 
-		if err := EncodeNode(zip, header.Format, color, children[:]); err != nil {
+		if err := EncodeNodeAt(out, header.Format, i, color, children[:]); err != nil {
 			return err
 		}
 	}
 
+	if checkedReader != nil {
+		if err := checkedReader.ReadTrailer(); err != nil {
+			return err
+		}
+		return checkedWriter.WriteTrailer()
+	}
 	return nil
 }
 
@@ -86,7 +111,7 @@ func OptimizeTree(reader io.ReadSeeker, writer io.Writer, outputFormat OctreeFor
 		status OptStatus
 	)
 
-	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+	if err := DecodeHeader(reader, &header); err != nil {
 		return status, err
 	}
 
@@ -94,6 +119,10 @@ func OptimizeTree(reader io.ReadSeeker, writer io.Writer, outputFormat OctreeFor
 		return status, errInputIsCompressed
 	}
 
+	if !header.Format.FixedSize() {
+		return status, ErrUnsupportedFormat
+	}
+
 	maxLevels := 0
 	for i := 1; i <= int(header.VoxelsPerAxis); i *= 2 {
 		maxLevels++
@@ -119,7 +148,8 @@ func OptimizeTree(reader io.ReadSeeker, writer io.Writer, outputFormat OctreeFor
 
 	header.NumLeafs = 0
 	header.NumNodes = 0
-	header.Flags &= optimizedMask
+	header.Flags |= optimizedMask
+	header.Flags &^= checksumMask
 
 	args := optInput{reader, tempFiles, &header, colorThreshold, colorFilter, &status}
 	_, err := optNode(&args, 0, 0, Color{})
@@ -128,11 +158,11 @@ func OptimizeTree(reader io.ReadSeeker, writer io.Writer, outputFormat OctreeFor
 	}
 
 	header.Format = outputFormat
-	if err := binary.Write(writer, binary.LittleEndian, header); err != nil {
+	if err := EncodeHeader(writer, header); err != nil {
 		return status, err
 	}
 
-	header.Format = MipR8G8B8A8UnpackUI32
+	header.Format = optFormat
 	err = mergeAndPatch(writer, tempFiles, &header, outputFormat, &status)
 	if err != nil {
 		return status, err
@@ -146,7 +176,7 @@ func mergeAndPatch(writer io.Writer, files []*os.File, header *OctreeHeader, out
 	for lv, fp := range files {
 		var (
 			color    Color
-			children [8]uint32
+			children [8]NodeIndex
 		)
 
 		end, err := fp.Seek(0, 2)
@@ -169,14 +199,14 @@ func mergeAndPatch(writer io.Writer, files []*os.File, header *OctreeHeader, out
 			}
 
 			for j, child := range children {
-				if child == math.MaxUint32 {
+				if child == optNoChild {
 					children[j] = 0
 				} else {
-					children[j] = uint32(nextLevelStart) + child
+					children[j] = NodeIndex(nextLevelStart) + child
 				}
 			}
 
-			if err := EncodeNode(writer, outputFormat, color, children[:]); err != nil {
+			if err := EncodeNodeAt(writer, outputFormat, NodeIndex(numNodes+i), color, children[:]); err != nil {
 				return err
 			}
 		}
@@ -187,16 +217,16 @@ func mergeAndPatch(writer io.Writer, files []*os.File, header *OctreeHeader, out
 	return nil
 }
 
-func optNode(in *optInput, nodeIndex, level uint32, parentColor Color) (int64, error) {
+func optNode(in *optInput, nodeIndex NodeIndex, level int, parentColor Color) (int64, error) {
 	var (
 		color    Color
-		children [8]uint32
+		children [8]NodeIndex
 	)
 
-	nodeSize := in.header.Format.NodeSize()
-	headerSize := uint32(in.header.Size())
+	nodeSize := int64(in.header.Format.NodeSize())
+	headerSize := int64(in.header.Size())
 
-	if _, err := in.reader.Seek(int64(nodeIndex*uint32(nodeSize)+headerSize), 0); err != nil {
+	if _, err := in.reader.Seek(int64(nodeIndex)*nodeSize+headerSize, 0); err != nil {
 		return 0, err
 	}
 
@@ -207,13 +237,13 @@ func optNode(in *optInput, nodeIndex, level uint32, parentColor Color) (int64, e
 	merge := true
 	for _, child := range children {
 		if child > 0 {
-			if _, err := in.reader.Seek(int64(child*uint32(nodeSize)+headerSize), 0); err != nil {
+			if _, err := in.reader.Seek(int64(child)*nodeSize+headerSize, 0); err != nil {
 				return 0, err
 			}
 
 			var (
 				childColor    Color
-				grandChildren [8]uint32
+				grandChildren [8]NodeIndex
 			)
 
 			if err := DecodeNode(in.reader, in.header.Format, &childColor, grandChildren[:]); err != nil {
@@ -250,16 +280,16 @@ func optNode(in *optInput, nodeIndex, level uint32, parentColor Color) (int64, e
 				if err != nil {
 					return 0, err
 				}
-				children[i] = uint32(p)
+				children[i] = NodeIndex(p)
 				numChildren++
 			} else {
-				children[i] = math.MaxUint32
+				children[i] = optNoChild
 			}
 		}
 	} else {
 		in.status.NumMerged++
 		for i := range children {
-			children[i] = math.MaxUint32
+			children[i] = optNoChild
 		}
 	}
 
@@ -275,12 +305,15 @@ func optNode(in *optInput, nodeIndex, level uint32, parentColor Color) (int64, e
 		in.header.NumLeafs++
 		if in.colorFilter == true {
 			newColor = parentColor
+			if in.header.Coverage() {
+				newColor.A = color.A
+			}
 		}
 	}
 
-	if err := EncodeNode(fp, MipR8G8B8A8UnpackUI32, newColor, children[:]); err != nil {
+	if err := EncodeNode(fp, optFormat, newColor, children[:]); err != nil {
 		return 0, err
 	}
 
-	return pos / int64(MipR8G8B8A8UnpackUI32.NodeSize()), nil
+	return pos / int64(optFormat.NodeSize()), nil
 }
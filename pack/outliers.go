@@ -0,0 +1,258 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package pack
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// OutlierFilter removes isolated leafs, like the specks left by scanner noise. A
+// leaf with fewer than MinNeighbors samples is dropped if no other leaf is within
+// Radius voxels of it, measured between the voxel centers. A Radius of zero checks
+// the 26 adjacent voxels. The filter is disabled if MinNeighbors is zero.
+type OutlierFilter struct {
+	MinNeighbors int
+	Radius       float32
+}
+
+type (
+	voxelPos [3]int64
+
+	outlierFilterer struct {
+		reader  io.ReadSeeker
+		header  *OctreeHeader
+		filter  OutlierFilter
+		leafs   map[voxelPos]uint64
+		removed map[NodeIndex][5]uint64
+		empty   map[NodeIndex]bool
+
+		numRemoved uint64
+	}
+)
+
+// neighbors returns the offsets of the voxels within the filter radius.
+func (f *OutlierFilter) neighbors() []voxelPos {
+	radius := float64(f.Radius)
+	if radius <= 0 {
+		radius = math.Sqrt(3)
+	}
+
+	var offsets []voxelPos
+	n := int64(radius)
+	for z := -n; z <= n; z++ {
+		for y := -n; y <= n; y++ {
+			for x := -n; x <= n; x++ {
+				if d := float64(x*x + y*y + z*z); d > 0 && d <= radius*radius {
+					offsets = append(offsets, voxelPos{x, y, z})
+				}
+			}
+		}
+	}
+	return offsets
+}
+
+func (of *outlierFilterer) readNode(index NodeIndex, node *accNode) error {
+	offset := int64(of.header.Size()) + int64(index)*int64(mipR64G64B64A64S64UnpackUI64.NodeSize())
+	if _, err := of.reader.Seek(offset, 0); err != nil {
+		return err
+	}
+	return binary.Read(of.reader, binary.LittleEndian, node)
+}
+
+// collect records the number of samples of every leaf below index.
+func (of *outlierFilterer) collect(index NodeIndex, pos voxelPos, voxelRes int) error {
+	var node accNode
+	if err := of.readNode(index, &node); err != nil {
+		return err
+	}
+
+	if voxelRes == 1 {
+		if node.Color[4] > 0 {
+			of.leafs[pos] = node.Color[4]
+		}
+		return nil
+	}
+
+	half := int64(voxelRes / 2)
+	for i, child := range node.Children {
+		if child == 0 {
+			continue
+		}
+
+		p := childPositions[i]
+		childPos := voxelPos{pos[0] + int64(p.X)*half, pos[1] + int64(p.Y)*half, pos[2] + int64(p.Z)*half}
+		if err := of.collect(child, childPos, voxelRes/2); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isolated reports if the leaf at pos is sparse and has no neighbors.
+func (of *outlierFilterer) isolated(pos voxelPos, offsets []voxelPos) bool {
+	if of.leafs[pos] >= uint64(of.filter.MinNeighbors) {
+		return false
+	}
+
+	for _, o := range offsets {
+		if _, ok := of.leafs[voxelPos{pos[0] + o[0], pos[1] + o[1], pos[2] + o[2]}]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// prune marks the dropped leafs and the nodes left without leafs as empty, and
+// records the accumulated color removed from every node. It returns the color
+// removed from the subtree at index.
+func (of *outlierFilterer) prune(index NodeIndex, pos voxelPos, voxelRes int, offsets []voxelPos) ([5]uint64, error) {
+	var (
+		node    accNode
+		removed [5]uint64
+	)
+
+	if err := of.readNode(index, &node); err != nil {
+		return removed, err
+	}
+
+	if voxelRes == 1 {
+		if node.Color[4] > 0 && of.isolated(pos, offsets) {
+			of.empty[index] = true
+			of.numRemoved++
+			return node.Color, nil
+		}
+		return removed, nil
+	}
+
+	half := int64(voxelRes / 2)
+	numChildren := 0
+	for i, child := range node.Children {
+		if child == 0 {
+			continue
+		}
+
+		p := childPositions[i]
+		childPos := voxelPos{pos[0] + int64(p.X)*half, pos[1] + int64(p.Y)*half, pos[2] + int64(p.Z)*half}
+		r, err := of.prune(child, childPos, voxelRes/2, offsets)
+		if err != nil {
+			return removed, err
+		}
+
+		for c := range removed {
+			removed[c] += r[c]
+		}
+		if !of.empty[child] {
+			numChildren++
+		}
+	}
+
+	if removed[4] > 0 {
+		of.removed[index] = removed
+		if numChildren == 0 {
+			of.empty[index] = true
+		}
+	}
+	return removed, nil
+}
+
+// filterOutliers copies the accumulation tree in reader to writer without the
+// leafs dropped by filter. Their samples are removed from the colors of the nodes
+// above them and nodes left without children are dropped too, except for the root.
+// The number of dropped leafs is returned.
+func filterOutliers(reader io.ReadSeeker, writer io.WriteSeeker, header *OctreeHeader, filter OutlierFilter) (uint64, error) {
+	of := outlierFilterer{
+		reader:  reader,
+		header:  header,
+		filter:  filter,
+		leafs:   make(map[voxelPos]uint64),
+		removed: make(map[NodeIndex][5]uint64),
+		empty:   make(map[NodeIndex]bool),
+	}
+
+	out := *header
+	out.NumNodes = 0
+	out.NumLeafs = 0
+
+	// The header is written again when the number of nodes is known.
+	if err := EncodeHeader(writer, out); err != nil {
+		return 0, err
+	}
+
+	if header.NumNodes == 0 {
+		return 0, nil
+	}
+
+	vpa := int(header.VoxelsPerAxis)
+	if err := of.collect(0, voxelPos{}, vpa); err != nil {
+		return 0, err
+	}
+	if _, err := of.prune(0, voxelPos{}, vpa, filter.neighbors()); err != nil {
+		return 0, err
+	}
+
+	type item struct {
+		index    NodeIndex
+		voxelRes int
+	}
+
+	// Nodes are written in breadth-first order so the index of a child is known
+	// when its parent is written.
+	queue := []item{{0, vpa}}
+	for numQueued := NodeIndex(1); len(queue) > 0; queue = queue[1:] {
+		it := queue[0]
+
+		var node accNode
+		if err := of.readNode(it.index, &node); err != nil {
+			return 0, err
+		}
+
+		removed := of.removed[it.index]
+		for c := range removed {
+			node.Color[c] -= removed[c]
+		}
+
+		for i, child := range node.Children {
+			if child == 0 {
+				continue
+			}
+
+			if of.empty[child] {
+				node.Children[i] = 0
+			} else {
+				queue = append(queue, item{child, it.voxelRes / 2})
+				node.Children[i] = numQueued
+				numQueued++
+			}
+		}
+
+		if it.voxelRes == 1 {
+			out.NumLeafs += node.Color[4]
+		}
+
+		if err := binary.Write(writer, binary.LittleEndian, node); err != nil {
+			return 0, err
+		}
+		out.NumNodes++
+	}
+
+	if _, err := writer.Seek(0, 0); err != nil {
+		return 0, err
+	}
+	return of.numRemoved, EncodeHeader(writer, out)
+}
@@ -0,0 +1,134 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+const maxPaletteSize = 256
+
+// Palette is the color table of trees stored in a palette format. It is written
+// after the header as a 16-bit entry count followed by 8-bit RGBA colors.
+type Palette []Color
+
+func (p Palette) validate() error {
+	if len(p) == 0 || len(p) > maxPaletteSize {
+		return errInvalidPalette
+	}
+	return nil
+}
+
+// Nearest returns the index of the palette entry closest to color.
+func (p Palette) Nearest(color Color) byte {
+	var (
+		index int
+		best  = float32(math.MaxFloat32)
+	)
+
+	for i := range p {
+		if d := p[i].dist(&color); d < best {
+			index, best = i, d
+		}
+	}
+	return byte(index)
+}
+
+// DecodePalette reads the palette that follows the header. A nil palette is returned
+// if the tree has none.
+func DecodePalette(reader io.Reader, header *OctreeHeader) (Palette, error) {
+	if !header.Paletted() {
+		return nil, nil
+	}
+
+	var num uint16
+	if err := binary.Read(reader, binary.LittleEndian, &num); err != nil {
+		return nil, err
+	}
+
+	if num == 0 || num > maxPaletteSize {
+		return nil, errInvalidPalette
+	}
+
+	data := make([][4]byte, num)
+	if err := binary.Read(reader, binary.LittleEndian, data); err != nil {
+		return nil, err
+	}
+
+	palette := make(Palette, num)
+	for i, c := range data {
+		palette[i] = Color{float32(c[0]) / 255, float32(c[1]) / 255, float32(c[2]) / 255, float32(c[3]) / 255}
+	}
+	return palette, nil
+}
+
+// EncodePalette writes palette, it should follow a header with the palette flag set.
+func EncodePalette(writer io.Writer, palette Palette) error {
+	if err := palette.validate(); err != nil {
+		return err
+	}
+
+	data := make([][4]byte, len(palette))
+	for i := range palette {
+		data[i] = palette[i].bytes()
+	}
+
+	if err := binary.Write(writer, binary.LittleEndian, uint16(len(palette))); err != nil {
+		return err
+	}
+	return binary.Write(writer, binary.LittleEndian, data)
+}
+
+// DecodePaletteNodeAt works like DecodeNodeAt but resolves the color of palette formats.
+func DecodePaletteNodeAt(reader io.Reader, format OctreeFormat, index NodeIndex, palette Palette, color *Color, children []NodeIndex) error {
+	if !format.Paletted() {
+		return DecodeNodeAt(reader, format, index, color, children)
+	}
+
+	var entry [1]byte
+	if _, err := io.ReadFull(reader, entry[:]); err != nil {
+		return err
+	}
+
+	if int(entry[0]) >= len(palette) {
+		return errInvalidPalette
+	}
+	*color = palette[entry[0]]
+
+	return readIndices(reader, format.IndexSize(), children)
+}
+
+// EncodePaletteNodeAt works like EncodeNodeAt but stores the nearest palette entry
+// for palette formats.
+func EncodePaletteNodeAt(writer io.Writer, format OctreeFormat, index NodeIndex, palette Palette, color Color, children []NodeIndex) error {
+	if !format.Paletted() {
+		return EncodeNodeAt(writer, format, index, color, children)
+	}
+
+	if err := palette.validate(); err != nil {
+		return err
+	}
+
+	if err := binary.Write(writer, binary.LittleEndian, palette.Nearest(color)); err != nil {
+		return err
+	}
+
+	return writeIndices(writer, format.IndexSize(), children)
+}
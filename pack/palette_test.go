@@ -0,0 +1,155 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"testing"
+)
+
+var testPalette = Palette{
+	{0.2, 0.2, 0.2, 1}, // Road
+	{0.8, 0.4, 0.3, 1}, // Building
+	{0.1, 0.6, 0.1, 1}, // Vegetation
+}
+
+func TestPaletteNode(t *testing.T) {
+	for _, format := range []OctreeFormat{MipP8UnpackUI32, MipP8UnpackUI16} {
+		var (
+			buffer   bytes.Buffer
+			color    Color
+			childIn  [8]NodeIndex
+			childOut = [8]NodeIndex{0, 1, 2, 3, 0, 0, 700, 65535}
+		)
+
+		if err := EncodePaletteNodeAt(&buffer, format, 0, testPalette, Color{0.75, 0.45, 0.35, 1}, childOut[:]); err != nil {
+			panic(err)
+		}
+
+		if buffer.Len() != format.NodeSize() {
+			t.Errorf("unexpected node size: %v", buffer.Len())
+		}
+
+		if err := DecodePaletteNodeAt(&buffer, format, 0, testPalette, &color, childIn[:]); err != nil {
+			panic(err)
+		}
+
+		if color != testPalette[1] {
+			t.Errorf("expected nearest palette color %v, got %v", testPalette[1], color)
+		}
+
+		if childIn != childOut {
+			t.Errorf("%v != %v", childIn, childOut)
+		}
+
+		if err := DecodeNode(bytes.NewReader(make([]byte, format.NodeSize())), format, &color, childIn[:]); err != errMissingPalette {
+			t.Error("expected missing palette error, got:", err)
+		}
+	}
+}
+
+func buildPaletteTest(format OctreeFormat, palette Palette) []byte {
+	var samples []Sample
+	for z := 0; z < 8; z++ {
+		for x := 0; x < 8; x++ {
+			// A road, a building and trees on a flat ground.
+			samples = append(samples, Sample{Point{float64(x) + 0.5, 0.5, float64(z) + 0.5}, testPalette[x%3]})
+		}
+	}
+
+	var buffer bytes.Buffer
+	cfg := BuildConfig{
+		Worker:        NewFakeWorker(samples),
+		Writer:        &buffer,
+		Bounds:        Box{Point{0, 0, 0}, 8},
+		VoxelsPerAxis: 8,
+		Format:        format,
+		Palette:       palette,
+	}
+
+	if _, err := BuildTree(&cfg); err != nil {
+		panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestBuildPaletteTree(t *testing.T) {
+	rgba := buildPaletteTest(MipR8G8B8A8UnpackUI32, nil)
+	paletted := buildPaletteTest(MipP8UnpackUI32, testPalette)
+
+	if len(paletted) >= len(rgba) {
+		t.Errorf("expected palette tree to be smaller, %d >= %d bytes", len(paletted), len(rgba))
+	}
+	t.Logf("RGBA: %d bytes, palette: %d bytes", len(rgba), len(paletted))
+
+	var header OctreeHeader
+	reader := bytes.NewReader(paletted)
+	if err := DecodeHeader(reader, &header); err != nil {
+		panic(err)
+	}
+
+	palette, err := DecodePalette(reader, &header)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(palette) != len(testPalette) {
+		t.Fatal("unexpected palette:", palette)
+	}
+
+	// Transcoding back gives the same tree, every color is a palette entry.
+	var unpacked bytes.Buffer
+	if err := TranscodeTree(bytes.NewReader(paletted), &unpacked, MipR8G8B8A8UnpackUI32); err != nil {
+		panic(err)
+	}
+
+	if !bytes.Equal(rgba[:header.Size()], unpacked.Bytes()[:header.Size()]) {
+		t.Error("headers differ after transcoding")
+	}
+
+	var (
+		color, expected       Color
+		children, childrenRGB [8]NodeIndex
+	)
+
+	rgbaReader := bytes.NewReader(rgba[header.Size():])
+	for i := uint64(0); i < header.NumNodes; i++ {
+		if err := DecodePaletteNodeAt(reader, header.Format, NodeIndex(i), palette, &color, children[:]); err != nil {
+			panic(err)
+		}
+
+		if err := DecodeNode(rgbaReader, MipR8G8B8A8UnpackUI32, &expected, childrenRGB[:]); err != nil {
+			panic(err)
+		}
+
+		if children != childrenRGB {
+			t.Fatalf("node %d: %v != %v", i, children, childrenRGB)
+		}
+
+		// The RGBA tree is rounded to 8 bits so mipmapped colors close to the middle
+		// of two entries may go either way.
+		nearest := palette[palette.Nearest(expected)]
+		if color.dist(&expected) > nearest.dist(&expected)+0.01 {
+			t.Errorf("node %d: expected %v, got %v", i, nearest, color)
+		}
+	}
+
+	if reader.Len() != 0 {
+		t.Error("unexpected trailing data")
+	}
+}
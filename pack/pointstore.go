@@ -0,0 +1,209 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"math"
+	"sync"
+)
+
+// pointsPerBucket is the average number of samples per grid bucket a new store
+// is sized for.
+const pointsPerBucket = 16
+
+// PointStore keeps samples in memory in a uniform grid over the tree bounds, so
+// the samples of a cell are found without scanning all of them. It implements
+// CellWorker and CellHasher and can be mutated between builds, with only the
+// cells of the changed samples sampled again.
+type PointStore struct {
+	lock       sync.RWMutex
+	bounds     Box
+	res        int
+	bucketSize float64
+	buckets    [][]Sample
+	num        int
+}
+
+// NewPointStoreWorker creates a store for a tree with bounds. The grid resolution
+// is a power of two picked from the number of points, so buckets align with the
+// tree nodes. Points outside of bounds are dropped.
+func NewPointStoreWorker(bounds Box, points []Sample) *PointStore {
+	res := 1
+	for res < 256 && res*res*res*pointsPerBucket < len(points) {
+		res *= 2
+	}
+
+	s := &PointStore{
+		bounds:     bounds,
+		res:        res,
+		bucketSize: bounds.Size / float64(res),
+		buckets:    make([][]Sample, res*res*res),
+	}
+
+	for _, p := range points {
+		s.add(p)
+	}
+	return s
+}
+
+// Len returns the number of points in the store.
+func (s *PointStore) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.num
+}
+
+// Add inserts a point and returns false if it is outside the store bounds.
+func (s *PointStore) Add(p Sample) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.add(p)
+}
+
+func (s *PointStore) add(p Sample) bool {
+	if !s.bounds.containsClosed(p.Pos) {
+		return false
+	}
+
+	i := s.bucket(p.Pos)
+	s.buckets[i] = append(s.buckets[i], p)
+	s.num++
+	return true
+}
+
+// Remove deletes all points at pos and returns how many there were.
+func (s *PointStore) Remove(pos Point) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.bounds.containsClosed(pos) {
+		return 0
+	}
+
+	i := s.bucket(pos)
+	bucket := s.buckets[i]
+	n := 0
+	for _, p := range bucket {
+		if p.Pos != pos {
+			bucket[n] = p
+			n++
+		}
+	}
+
+	removed := len(bucket) - n
+	s.buckets[i] = bucket[:n]
+	s.num -= removed
+	return removed
+}
+
+// Cell returns the tree node level levels below the root that a point at pos
+// belongs to. These are the cells to rebuild after the point is added or removed.
+func (s *PointStore) Cell(pos Point, level int) (Box, bool) {
+	return CellOf(s.bounds, level, pos)
+}
+
+// Work emits all points.
+func (s *PointStore) Work(samples chan<- Sample) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, bucket := range s.buckets {
+		for _, p := range bucket {
+			samples <- p
+		}
+	}
+	return nil
+}
+
+// Region returns a worker that emits the points inside cell. The store must not
+// be mutated while the worker runs.
+func (s *PointStore) Region(cell Box) BuildWorker {
+	return func(samples chan<- Sample) error {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+
+		s.visit(cell, func(p *Sample) {
+			samples <- *p
+		})
+		return nil
+	}
+}
+
+// CellHash fingerprints the points inside cell.
+func (s *PointStore) CellHash(cell Box) ([]byte, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	h := sha1.New()
+	s.visit(cell, func(p *Sample) {
+		binary.Write(h, binary.LittleEndian, p)
+	})
+	return h.Sum(nil), true
+}
+
+// visit calls fn for the points inside cell. Cells that are nodes of the tree
+// follow the rule of the builder, see CellContains, other regions are half-open.
+func (s *PointStore) visit(cell Box, fn func(p *Sample)) {
+	contains := cell.ContainsPoint
+	if isNode(s.bounds, cell) {
+		contains = func(p Point) bool {
+			return CellContains(s.bounds, cell, p)
+		}
+	}
+
+	x0, x1 := s.bucketRange(cell.Pos.X-s.bounds.Pos.X, cell.Size)
+	y0, y1 := s.bucketRange(cell.Pos.Y-s.bounds.Pos.Y, cell.Size)
+	z0, z1 := s.bucketRange(cell.Pos.Z-s.bounds.Pos.Z, cell.Size)
+
+	for z := z0; z <= z1; z++ {
+		for y := y0; y <= y1; y++ {
+			for x := x0; x <= x1; x++ {
+				bucket := s.buckets[(z*s.res+y)*s.res+x]
+				for i := range bucket {
+					if contains(bucket[i].Pos) {
+						fn(&bucket[i])
+					}
+				}
+			}
+		}
+	}
+}
+
+func (s *PointStore) bucketRange(pos, size float64) (int, int) {
+	return s.clamp(pos / s.bucketSize), s.clamp((pos + size) / s.bucketSize)
+}
+
+func (s *PointStore) clamp(v float64) int {
+	i := int(math.Floor(v))
+	if i < 0 {
+		return 0
+	}
+	if i >= s.res {
+		return s.res - 1
+	}
+	return i
+}
+
+func (s *PointStore) bucket(pos Point) int {
+	x := s.clamp((pos.X - s.bounds.Pos.X) / s.bucketSize)
+	y := s.clamp((pos.Y - s.bounds.Pos.Y) / s.bucketSize)
+	z := s.clamp((pos.Z - s.bounds.Pos.Z) / s.bucketSize)
+	return (z*s.res+y)*s.res + x
+}
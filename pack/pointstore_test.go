@@ -0,0 +1,221 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func randomPoints(rnd *rand.Rand, bounds Box, n int) []Sample {
+	points := make([]Sample, n)
+	for i := range points {
+		points[i] = Sample{
+			Pos: Point{
+				bounds.Pos.X + rnd.Float64()*bounds.Size,
+				bounds.Pos.Y + rnd.Float64()*bounds.Size,
+				bounds.Pos.Z + rnd.Float64()*bounds.Size,
+			},
+			Col: Color{rnd.Float32(), rnd.Float32(), rnd.Float32(), 1},
+		}
+	}
+	return points
+}
+
+// sliceRegion is the naive worker that scans all points for every cell.
+func sliceRegion(points []Sample, cell Box) BuildWorker {
+	return func(samples chan<- Sample) error {
+		for _, p := range points {
+			if cell.Intersect(p.Pos) {
+				samples <- p
+			}
+		}
+		return nil
+	}
+}
+
+func sameSamples(a, b []Sample) bool {
+	count := make(map[Sample]int)
+	for _, s := range a {
+		count[s]++
+	}
+
+	for _, s := range b {
+		count[s]--
+	}
+
+	for _, n := range count {
+		if n != 0 {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
+
+func TestPointStore(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	bounds := Box{Point{-4, 2, 0}, 8}
+	points := randomPoints(rnd, bounds, 5000)
+	store := NewPointStoreWorker(bounds, points)
+
+	if store.Len() != len(points) {
+		t.Fatalf("expected %v points, got %v", len(points), store.Len())
+	}
+
+	if n := VerifyWorker(t, store.Work); n != len(points) {
+		t.Errorf("expected the worker to send %v points, got %v", len(points), n)
+	}
+
+	for i := 0; i < 50; i++ {
+		size := bounds.Size * (0.05 + rnd.Float64()*0.6)
+		cell := Box{Point{
+			bounds.Pos.X - 1 + rnd.Float64()*bounds.Size,
+			bounds.Pos.Y - 1 + rnd.Float64()*bounds.Size,
+			bounds.Pos.Z - 1 + rnd.Float64()*bounds.Size,
+		}, size}
+
+		if !sameSamples(collectSamples(store.Region(cell)), collectSamples(sliceRegion(points, cell))) {
+			t.Fatalf("region %v differs from a full scan", cell)
+		}
+	}
+
+	if store.Add(Sample{Pos: Point{100, 0, 0}}) {
+		t.Error("expected point outside bounds to be rejected")
+	}
+
+	p := Sample{Point{-2.5, 3.5, 1.5}, Color{1, 0, 0, 1}}
+	store.Add(p)
+	store.Add(p)
+
+	cell, ok := store.Cell(p.Pos, 3)
+	if !ok || !cell.Intersect(p.Pos) || cell.Size != 1 {
+		t.Fatalf("unexpected cell %v for %v", cell, p.Pos)
+	}
+
+	before, _ := store.CellHash(cell)
+	if n := store.Remove(p.Pos); n != 2 {
+		t.Errorf("expected 2 points to be removed, got %v", n)
+	}
+
+	if store.Len() != len(points) {
+		t.Errorf("expected %v points, got %v", len(points), store.Len())
+	}
+
+	if after, _ := store.CellHash(cell); string(after) == string(before) {
+		t.Error("expected cell hash to change")
+	}
+
+	if !sameSamples(collectSamples(store.Region(cell)), collectSamples(sliceRegion(points, cell))) {
+		t.Error("removed points are still emitted")
+	}
+}
+
+type countingStore struct {
+	*PointStore
+	regions []Box
+}
+
+func (s *countingStore) Region(cell Box) BuildWorker {
+	s.regions = append(s.regions, cell)
+	return s.PointStore.Region(cell)
+}
+
+func TestPointStoreRebuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bounds := Box{Point{0, 0, 0}, 8}
+	store := &countingStore{PointStore: NewPointStoreWorker(bounds, randomPoints(rand.New(rand.NewSource(2)), bounds, 2000))}
+	cfg := BuildConfig{Cells: store, CellLevel: 2, CellCacheDir: dir, Bounds: bounds}
+
+	buildCellTest(cfg)
+	if len(store.regions) != 64 {
+		t.Fatalf("expected all 64 cells to be sampled, got %v", len(store.regions))
+	}
+
+	p := Sample{Point{5.5, 1.25, 6.75}, Color{0, 1, 0, 1}}
+	store.Add(p)
+	store.regions = nil
+	header, nodes := buildCellTest(cfg)
+
+	if cell, _ := store.Cell(p.Pos, 2); len(store.regions) != 1 || store.regions[0] != cell {
+		t.Fatalf("expected only cell %v to be sampled, got %v", cell, store.regions)
+	}
+
+	fullHeader, fullNodes := buildCellTest(BuildConfig{Worker: store.Work, Bounds: bounds})
+	if header.NumNodes != fullHeader.NumNodes || len(nodes) != len(fullNodes) {
+		t.Fatalf("expected %v nodes, got %v", fullHeader.NumNodes, header.NumNodes)
+	}
+
+	for path, c := range fullNodes {
+		if cc, ok := nodes[path]; !ok || cc != c {
+			t.Errorf("node %q differs: %v != %v", path, cc, c)
+		}
+	}
+}
+
+const benchmarkPoints = 10000000
+
+var benchmarkStore struct {
+	points []Sample
+	store  *PointStore
+}
+
+func benchmarkRegion(b *testing.B, region func(cell Box) BuildWorker) {
+	bounds := Box{Point{0, 0, 0}, 1}
+	if benchmarkStore.points == nil {
+		benchmarkStore.points = randomPoints(rand.New(rand.NewSource(3)), bounds, benchmarkPoints)
+		benchmarkStore.store = NewPointStoreWorker(bounds, benchmarkStore.points)
+	}
+
+	// Cells three levels down, as in a rebuild of a small region.
+	cells := collectCells(bounds, 3, nil, nil)
+	samples := make(chan Sample, sampleChannelSize)
+	done := make(chan struct{})
+	go func() {
+		for range samples {
+		}
+		close(done)
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		region(cells[i%len(cells)].bounds)(samples)
+	}
+
+	b.StopTimer()
+	close(samples)
+	<-done
+}
+
+func BenchmarkPointStoreRegion(b *testing.B) {
+	benchmarkRegion(b, func(cell Box) BuildWorker {
+		return benchmarkStore.store.Region(cell)
+	})
+}
+
+func BenchmarkSliceRegion(b *testing.B) {
+	benchmarkRegion(b, func(cell Box) BuildWorker {
+		return sliceRegion(benchmarkStore.points, cell)
+	})
+}
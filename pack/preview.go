@@ -0,0 +1,87 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package pack
+
+import (
+	"bytes"
+	"io"
+	"time"
+)
+
+// defaultPreviewInterval is the time between previews if
+// BuildConfig.PreviewInterval is zero.
+const defaultPreviewInterval = time.Second
+
+// previewer hands snapshots of the accumulation tree to BuildConfig.Preview. It
+// must only be polled between inserted samples or cells, when all child indices
+// of the tree refer to written nodes.
+type previewer struct {
+	cfg  *BuildConfig
+	last time.Time
+}
+
+func newPreviewer(cfg *BuildConfig) *previewer {
+	return &previewer{cfg: cfg, last: time.Now()}
+}
+
+// poll calls the preview hook if the interval has passed. The position of fp is
+// left undefined.
+func (p *previewer) poll(fp io.ReadSeeker, header *OctreeHeader) error {
+	if p.cfg.Preview == nil {
+		return nil
+	}
+
+	interval := p.cfg.PreviewInterval
+	if interval == 0 {
+		interval = defaultPreviewInterval
+	}
+	if time.Since(p.last) < interval {
+		return nil
+	}
+
+	tree, err := snapshotTree(fp, header)
+	if err != nil {
+		return err
+	}
+
+	p.cfg.Preview(tree)
+	p.last = time.Now()
+	return nil
+}
+
+// snapshotTree transcodes the nodes written so far to a MipR8G8B8A8UnpackUI32
+// tree.
+func snapshotTree(fp io.ReadSeeker, header *OctreeHeader) ([]byte, error) {
+	var headerBuf bytes.Buffer
+	if err := EncodeHeader(&headerBuf, *header); err != nil {
+		return nil, err
+	}
+
+	if _, err := fp.Seek(int64(header.Size()), 0); err != nil {
+		return nil, err
+	}
+
+	var (
+		nodes  = io.LimitReader(fp, int64(header.NumNodes)*int64(mipR64G64B64A64S64UnpackUI64.NodeSize()))
+		output bytes.Buffer
+	)
+
+	if _, err := transcodeTree(io.MultiReader(&headerBuf, nodes), &output, MipR8G8B8A8UnpackUI32, nil, nil, nil, NopLogger); err != nil {
+		return nil, err
+	}
+	return output.Bytes(), nil
+}
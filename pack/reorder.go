@@ -0,0 +1,208 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import "io"
+
+type Layout int
+
+const (
+	// DepthFirstLayout stores nodes in pre-order with children visited in
+	// Morton order, so the first child always follows its parent.
+	DepthFirstLayout Layout = iota
+
+	// BreadthFirstLayout stores the tree level by level so all children of
+	// a node are adjacent.
+	BreadthFirstLayout
+)
+
+type ReorderStatus struct {
+	// Average distance, in nodes, between a parent and its children.
+	DistanceBefore float64
+	DistanceAfter  float64
+}
+
+func averageChildDistance(children [][8]NodeIndex, remap []NodeIndex) float64 {
+	var sum, num float64
+	for parent, ch := range children {
+		for _, child := range ch {
+			if child == 0 {
+				continue
+			}
+
+			p, c := int64(parent), int64(child)
+			if remap != nil {
+				if remap[parent] == 0 && parent != 0 {
+					break
+				}
+				p, c = int64(remap[parent]), int64(remap[child])
+			}
+
+			d := c - p
+			if d < 0 {
+				d = -d
+			}
+			sum += float64(d)
+			num++
+		}
+	}
+
+	if num == 0 {
+		return 0
+	}
+	return sum / num
+}
+
+func layoutOrder(children [][8]NodeIndex, order Layout) ([]NodeIndex, error) {
+	var (
+		nodes   []NodeIndex
+		queue   = []NodeIndex{0}
+		visited = make([]bool, len(children))
+	)
+
+	// Shared nodes are only stored once.
+	visit := func(idx NodeIndex) bool {
+		if visited[idx] {
+			return false
+		}
+		visited[idx] = true
+		return true
+	}
+
+	switch order {
+	case DepthFirstLayout:
+		for len(queue) > 0 {
+			n := len(queue) - 1
+			idx := queue[n]
+			queue = queue[:n]
+
+			if !visit(idx) {
+				continue
+			}
+			nodes = append(nodes, idx)
+
+			for i := 7; i >= 0; i-- {
+				if child := children[idx][i]; child != 0 {
+					queue = append(queue, child)
+				}
+			}
+		}
+	case BreadthFirstLayout:
+		for ; len(queue) > 0; queue = queue[1:] {
+			idx := queue[0]
+			if !visit(idx) {
+				continue
+			}
+			nodes = append(nodes, idx)
+
+			for _, child := range children[idx] {
+				if child != 0 {
+					queue = append(queue, child)
+				}
+			}
+		}
+	default:
+		return nil, errInvalidLayout
+	}
+	return nodes, nil
+}
+
+// ReorderTree rewrites the nodes of a tree in the given layout and remaps all child
+// indices. Nodes not reachable from the root are dropped.
+func ReorderTree(in io.ReadSeeker, out io.WriteSeeker, order Layout) (ReorderStatus, error) {
+	var (
+		header OctreeHeader
+		status ReorderStatus
+	)
+
+	if err := DecodeHeader(in, &header); err != nil {
+		return status, err
+	}
+
+	if header.Compressed() == true {
+		return status, errInputIsCompressed
+	}
+
+	// The trailer is not rewritten.
+	header.Flags &^= checksumMask
+
+	colors := make([]Color, header.NumNodes)
+	children := make([][8]NodeIndex, header.NumNodes)
+
+	for i := range colors {
+		if err := DecodeNodeAt(in, header.Format, NodeIndex(i), &colors[i], children[i][:]); err != nil {
+			return status, err
+		}
+
+		for _, child := range children[i] {
+			if uint64(child) >= header.NumNodes {
+				return status, errInvalidFile
+			}
+		}
+	}
+
+	if len(colors) == 0 {
+		return status, EncodeHeader(out, header)
+	}
+
+	nodes, err := layoutOrder(children, order)
+	if err != nil {
+		return status, err
+	}
+
+	remap := make([]NodeIndex, header.NumNodes)
+	for newIdx, oldIdx := range nodes {
+		remap[oldIdx] = NodeIndex(newIdx)
+	}
+
+	status.DistanceBefore = averageChildDistance(children, nil)
+	status.DistanceAfter = averageChildDistance(children, remap)
+
+	header.NumNodes = uint64(len(nodes))
+	header.NumLeafs = 0
+	for _, idx := range nodes {
+		leaf := true
+		for _, child := range children[idx] {
+			if child != 0 {
+				leaf = false
+				break
+			}
+		}
+
+		if leaf {
+			header.NumLeafs++
+		}
+	}
+
+	if err := EncodeHeader(out, header); err != nil {
+		return status, err
+	}
+
+	var ch [8]NodeIndex
+	for newIdx, idx := range nodes {
+		for i, child := range children[idx] {
+			ch[i] = remap[child]
+		}
+
+		if err := EncodeNodeAt(out, header.Format, NodeIndex(newIdx), colors[idx], ch[:]); err != nil {
+			return status, err
+		}
+	}
+
+	return status, nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func testReorder(t *testing.T, order Layout) {
+	treeBounds := Box{Point{0, 0, 0}, 80}
+
+	in, err := os.Open("test.oct")
+	if err != nil {
+		panic(err)
+	}
+	defer in.Close()
+
+	var files [2]*os.File
+	for i := range files {
+		if files[i], err = ioutil.TempFile("", ""); err != nil {
+			panic(err)
+		}
+		defer func(fp *os.File) {
+			fp.Close()
+			os.Remove(fp.Name())
+		}(files[i])
+	}
+
+	if _, err := ReorderTree(in, files[0], order); err != nil {
+		panic(err)
+	}
+
+	files[0].Seek(0, 0)
+	status, err := ReorderTree(files[0], files[1], order)
+	if err != nil {
+		panic(err)
+	}
+
+	if status.DistanceBefore != status.DistanceAfter {
+		t.Errorf("reordering is not stable: %+v", status)
+	}
+
+	var inHeader, outHeader OctreeHeader
+	in.Seek(0, 0)
+	files[1].Seek(0, 0)
+
+	if err := DecodeHeader(in, &inHeader); err != nil {
+		panic(err)
+	}
+
+	if err := DecodeHeader(files[1], &outHeader); err != nil {
+		panic(err)
+	}
+
+	if inHeader.NumNodes != outHeader.NumNodes || inHeader.NumLeafs != outHeader.NumLeafs {
+		t.Errorf("header mismatch: %+v != %+v", outHeader, inHeader)
+	}
+
+	inLeafs := make(map[Box]Color)
+	outLeafs := make(map[Box]Color)
+	collectLeafs(in, &inHeader, 0, treeBounds, treeBounds, inLeafs)
+	collectLeafs(files[1], &outHeader, 0, treeBounds, treeBounds, outLeafs)
+
+	if len(inLeafs) != len(outLeafs) {
+		t.Fatalf("leaf count: %v != %v", len(outLeafs), len(inLeafs))
+	}
+
+	for b, c := range inLeafs {
+		if cc, ok := outLeafs[b]; !ok || cc != c {
+			t.Errorf("leaf %v differs: %v != %v", b, cc, c)
+		}
+	}
+}
+
+func TestReorderTree(t *testing.T) {
+	TestBuildTree(t)
+
+	testReorder(t, DepthFirstLayout)
+	testReorder(t, BreadthFirstLayout)
+}
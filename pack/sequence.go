@@ -0,0 +1,571 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+)
+
+var sequenceSign = [4]byte{0x1b, 0x6f, 0x73, 0x71}
+
+const (
+	sequenceEntrySize = 24
+	deltaFrameFlag    = 0x1
+)
+
+const (
+	deltaRecolor uint8 = iota
+	deltaAdd
+	deltaRemove
+)
+
+// Parent index used by delta operations that target the root node.
+const deltaRootParent = math.MaxUint32
+
+type SequenceHeader struct {
+	Sign      [4]byte
+	Version   byte
+	Unused    [3]byte
+	NumFrames uint32
+}
+
+type sequenceEntry struct {
+	Offset, Size  uint64
+	Flags, Unused uint32
+}
+
+// Sequence gives random access to the frames of a sequence file.
+type Sequence struct {
+	reader io.ReaderAt
+	header SequenceHeader
+	index  []sequenceEntry
+}
+
+// FrameData is the decoded node array of a frame. A child index of zero means
+// there is no child.
+type FrameData struct {
+	Header   OctreeHeader
+	Colors   []Color
+	Children [][8]NodeIndex
+}
+
+type (
+	deltaOp struct {
+		Parent     uint32
+		Slot, Kind uint8
+	}
+
+	deltaEntry struct {
+		deltaOp
+		color    Color
+		colors   []Color
+		children [][8]NodeIndex
+	}
+)
+
+func (h *SequenceHeader) Size() int {
+	return 12
+}
+
+func decodeFrameData(reader io.Reader) (*FrameData, error) {
+	data := &FrameData{}
+	if err := DecodeHeader(reader, &data.Header); err != nil {
+		return nil, err
+	}
+
+	if data.Header.Compressed() == true {
+		return nil, errInputIsCompressed
+	}
+
+	// Frames are written without a trailer.
+	data.Header.Flags &^= checksumMask
+
+	numNodes := data.Header.NumNodes
+	data.Colors = make([]Color, numNodes)
+	data.Children = make([][8]NodeIndex, numNodes)
+
+	for i := range data.Colors {
+		if err := DecodeNodeAt(reader, data.Header.Format, NodeIndex(i), &data.Colors[i], data.Children[i][:]); err != nil {
+			return nil, err
+		}
+
+		for _, child := range data.Children[i] {
+			if uint64(child) >= numNodes {
+				return nil, errInvalidFile
+			}
+		}
+	}
+	return data, nil
+}
+
+func (data *FrameData) encode(writer io.Writer) error {
+	header := data.Header
+	header.NumNodes = uint64(len(data.Colors))
+
+	if err := EncodeHeader(writer, header); err != nil {
+		return err
+	}
+
+	for i := range data.Colors {
+		if err := EncodeNodeAt(writer, header.Format, NodeIndex(i), data.Colors[i], data.Children[i][:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractSubtree copies the nodes reachable from root. Indices are local to
+// the subtree with the root at index zero.
+func extractSubtree(data *FrameData, root NodeIndex) ([]Color, [][8]NodeIndex) {
+	var (
+		colors   []Color
+		children [][8]NodeIndex
+		queue    = []NodeIndex{root}
+		local    = map[NodeIndex]NodeIndex{root: 0}
+	)
+
+	for ; len(queue) > 0; queue = queue[1:] {
+		idx := queue[0]
+		var ch [8]NodeIndex
+
+		for i, child := range data.Children[idx] {
+			if child == 0 {
+				continue
+			}
+
+			l, ok := local[child]
+			if !ok {
+				l = NodeIndex(len(local))
+				local[child] = l
+				queue = append(queue, child)
+			}
+			ch[i] = l
+		}
+
+		colors = append(colors, data.Colors[idx])
+		children = append(children, ch)
+	}
+	return colors, children
+}
+
+// diffFrames returns the operations that turn prev into cur. False is returned if
+// the frames can't be delta encoded, in which case cur has to be stored as a keyframe.
+func diffFrames(prev, cur *FrameData) ([]deltaEntry, bool) {
+	if len(prev.Colors) == 0 || len(cur.Colors) == 0 {
+		return nil, false
+	}
+
+	var (
+		ops     []deltaEntry
+		visited = make([]bool, len(prev.Colors))
+		walk    func(p, c NodeIndex) bool
+	)
+
+	if prev.Colors[0] != cur.Colors[0] {
+		ops = append(ops, deltaEntry{deltaOp: deltaOp{deltaRootParent, 0, deltaRecolor}, color: cur.Colors[0]})
+	}
+
+	walk = func(p, c NodeIndex) bool {
+		// Shared nodes can't be patched in place and delta operations store 32-bit parents.
+		if visited[p] || p >= deltaRootParent {
+			return false
+		}
+		visited[p] = true
+
+		for i := range prev.Children[p] {
+			pc, cc := prev.Children[p][i], cur.Children[c][i]
+			op := deltaOp{uint32(p), uint8(i), 0}
+
+			switch {
+			case pc == 0 && cc == 0:
+			case cc == 0:
+				op.Kind = deltaRemove
+				ops = append(ops, deltaEntry{deltaOp: op})
+			case pc == 0:
+				op.Kind = deltaAdd
+				colors, children := extractSubtree(cur, cc)
+				ops = append(ops, deltaEntry{deltaOp: op, colors: colors, children: children})
+			default:
+				if prev.Colors[pc] != cur.Colors[cc] {
+					op.Kind = deltaRecolor
+					ops = append(ops, deltaEntry{deltaOp: op, color: cur.Colors[cc]})
+				}
+
+				if !walk(pc, cc) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	if !walk(0, 0) {
+		return nil, false
+	}
+	return ops, true
+}
+
+// applyDelta patches data in place. New subtrees are appended to the node array and
+// removed subtrees are left unreferenced until the next keyframe.
+func applyDelta(data *FrameData, ops []deltaEntry) error {
+	numNodes := NodeIndex(len(data.Colors))
+	for _, op := range ops {
+		if op.Parent == deltaRootParent {
+			if op.Kind != deltaRecolor || numNodes == 0 {
+				return errInvalidFile
+			}
+			data.Colors[0] = op.color
+			continue
+		}
+
+		if NodeIndex(op.Parent) >= numNodes || op.Slot >= 8 {
+			return errInvalidFile
+		}
+		slot := &data.Children[op.Parent][op.Slot]
+
+		switch op.Kind {
+		case deltaRecolor:
+			if *slot == 0 {
+				return errInvalidFile
+			}
+			data.Colors[*slot] = op.color
+		case deltaRemove:
+			*slot = 0
+		case deltaAdd:
+			base := NodeIndex(len(data.Colors))
+			for i, ch := range op.children {
+				for j, child := range ch {
+					if child >= NodeIndex(len(op.colors)) {
+						return errInvalidFile
+					}
+					if child != 0 {
+						ch[j] = base + child
+					}
+				}
+				data.Colors = append(data.Colors, op.colors[i])
+				data.Children = append(data.Children, ch)
+			}
+			data.Children[op.Parent][op.Slot] = base
+		default:
+			return errInvalidFile
+		}
+	}
+	return nil
+}
+
+func writeDelta(writer io.Writer, header OctreeHeader, ops []deltaEntry) error {
+	if err := EncodeHeader(writer, header); err != nil {
+		return err
+	}
+
+	if err := binary.Write(writer, binary.LittleEndian, uint32(len(ops))); err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		if err := binary.Write(writer, binary.LittleEndian, op.deltaOp); err != nil {
+			return err
+		}
+
+		switch op.Kind {
+		case deltaRecolor:
+			if err := binary.Write(writer, binary.LittleEndian, op.color); err != nil {
+				return err
+			}
+		case deltaAdd:
+			if err := binary.Write(writer, binary.LittleEndian, uint32(len(op.colors))); err != nil {
+				return err
+			}
+
+			if err := binary.Write(writer, binary.LittleEndian, op.colors); err != nil {
+				return err
+			}
+
+			// Subtree indices are local and stored with 32 bits.
+			children := make([][8]uint32, len(op.children))
+			for i, ch := range op.children {
+				for j, child := range ch {
+					if child > math.MaxUint32 {
+						return errOctreeOverflow
+					}
+					children[i][j] = uint32(child)
+				}
+			}
+
+			if err := binary.Write(writer, binary.LittleEndian, children); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readDelta(reader io.Reader) (OctreeHeader, []deltaEntry, error) {
+	var (
+		header OctreeHeader
+		numOps uint32
+	)
+
+	if err := DecodeHeader(reader, &header); err != nil {
+		return header, nil, err
+	}
+
+	if err := binary.Read(reader, binary.LittleEndian, &numOps); err != nil {
+		return header, nil, err
+	}
+
+	var ops []deltaEntry
+	for i := uint32(0); i < numOps; i++ {
+		var op deltaEntry
+		if err := binary.Read(reader, binary.LittleEndian, &op.deltaOp); err != nil {
+			return header, nil, err
+		}
+
+		switch op.Kind {
+		case deltaRecolor:
+			if err := binary.Read(reader, binary.LittleEndian, &op.color); err != nil {
+				return header, nil, err
+			}
+		case deltaAdd:
+			var numNodes uint32
+			if err := binary.Read(reader, binary.LittleEndian, &numNodes); err != nil {
+				return header, nil, err
+			}
+
+			if numNodes == 0 || numNodes > maxUint28 {
+				return header, nil, errInvalidFile
+			}
+
+			op.colors = make([]Color, numNodes)
+			op.children = make([][8]NodeIndex, numNodes)
+			children := make([][8]uint32, numNodes)
+
+			if err := binary.Read(reader, binary.LittleEndian, op.colors); err != nil {
+				return header, nil, err
+			}
+
+			if err := binary.Read(reader, binary.LittleEndian, children); err != nil {
+				return header, nil, err
+			}
+
+			for i, ch := range children {
+				for j, child := range ch {
+					op.children[i][j] = NodeIndex(child)
+				}
+			}
+		}
+		ops = append(ops, op)
+	}
+	return header, ops, nil
+}
+
+// WriteSequence writes all frames, each a complete octree file, into a single
+// sequence file with an index table. With a keyframeInterval above one, every
+// frame that is not a keyframe is stored as the difference to the previous frame.
+// Delta encoding requires uncompressed frames.
+func WriteSequence(writer io.Writer, frames []io.Reader, keyframeInterval int) error {
+	fp, err := ioutil.TempFile("", "")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		name := fp.Name()
+		fp.Close()
+		os.Remove(name)
+	}()
+
+	header := SequenceHeader{Sign: sequenceSign, Version: binaryVersion, NumFrames: uint32(len(frames))}
+	index := make([]sequenceEntry, len(frames))
+	offset := uint64(header.Size() + len(index)*sequenceEntrySize)
+
+	var state *FrameData
+	for i, frame := range frames {
+		entry := &index[i]
+		entry.Offset = offset
+
+		if keyframeInterval <= 1 {
+			n, err := io.Copy(fp, frame)
+			if err != nil {
+				return err
+			}
+
+			entry.Size = uint64(n)
+			offset += entry.Size
+			continue
+		}
+
+		cur, err := decodeFrameData(frame)
+		if err != nil {
+			return err
+		}
+
+		var (
+			ops   []deltaEntry
+			delta bool
+		)
+
+		if state != nil && i%keyframeInterval != 0 {
+			ops, delta = diffFrames(state, cur)
+		}
+
+		start, err := fp.Seek(0, 1)
+		if err != nil {
+			return err
+		}
+
+		if delta {
+			if err := applyDelta(state, ops); err != nil {
+				return err
+			}
+
+			state.Header = cur.Header
+			entry.Flags = deltaFrameFlag
+
+			if err := writeDelta(fp, cur.Header, ops); err != nil {
+				return err
+			}
+		} else {
+			state = cur
+			if err := cur.encode(fp); err != nil {
+				return err
+			}
+		}
+
+		end, err := fp.Seek(0, 1)
+		if err != nil {
+			return err
+		}
+
+		entry.Size = uint64(end - start)
+		offset += entry.Size
+	}
+
+	if err := binary.Write(writer, binary.LittleEndian, header); err != nil {
+		return err
+	}
+
+	if err := binary.Write(writer, binary.LittleEndian, index); err != nil {
+		return err
+	}
+
+	if _, err := fp.Seek(0, 0); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, fp)
+	return err
+}
+
+// OpenSequence reads the index table of a sequence file. Other files fail with
+// ErrBadMagic.
+func OpenSequence(reader io.ReaderAt) (*Sequence, error) {
+	seq := &Sequence{reader: reader}
+	headerReader := io.NewSectionReader(reader, 0, int64(seq.header.Size()))
+
+	if err := binary.Read(headerReader, binary.LittleEndian, &seq.header); err != nil {
+		return nil, err
+	}
+
+	if seq.header.Sign != sequenceSign {
+		return nil, ErrBadMagic
+	}
+
+	seq.index = make([]sequenceEntry, seq.header.NumFrames)
+	indexReader := io.NewSectionReader(reader, int64(seq.header.Size()), int64(len(seq.index)*sequenceEntrySize))
+
+	if err := binary.Read(indexReader, binary.LittleEndian, seq.index); err != nil {
+		return nil, err
+	}
+
+	if len(seq.index) > 0 && seq.index[0].Flags&deltaFrameFlag != 0 {
+		return nil, errInvalidFile
+	}
+
+	return seq, nil
+}
+
+func (s *Sequence) NumFrames() int {
+	return len(s.index)
+}
+
+func (s *Sequence) section(n int) *io.SectionReader {
+	e := s.index[n]
+	return io.NewSectionReader(s.reader, int64(e.Offset), int64(e.Size))
+}
+
+// DecodeFrame reconstructs the node array of frame n by applying deltas from the
+// nearest keyframe.
+func (s *Sequence) DecodeFrame(n int) (*FrameData, error) {
+	if n < 0 || n >= len(s.index) {
+		return nil, errInvalidFrame
+	}
+
+	key := n
+	for s.index[key].Flags&deltaFrameFlag != 0 {
+		key--
+	}
+
+	data, err := decodeFrameData(s.section(key))
+	if err != nil {
+		return nil, err
+	}
+
+	for i := key + 1; i <= n; i++ {
+		header, ops, err := readDelta(s.section(i))
+		if err != nil {
+			return nil, err
+		}
+
+		if err := applyDelta(data, ops); err != nil {
+			return nil, err
+		}
+		data.Header = header
+	}
+
+	data.Header.NumNodes = uint64(len(data.Colors))
+	return data, nil
+}
+
+// Frame returns a reader for the octree of frame n. Delta frames are reconstructed
+// and encoded in memory.
+func (s *Sequence) Frame(n int) (io.ReadSeeker, error) {
+	if n < 0 || n >= len(s.index) {
+		return nil, errInvalidFrame
+	}
+
+	if s.index[n].Flags&deltaFrameFlag == 0 {
+		return s.section(n), nil
+	}
+
+	data, err := s.DecodeFrame(n)
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	if err := data.encode(&buffer); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(buffer.Bytes()), nil
+}
@@ -0,0 +1,227 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSequence(t *testing.T) {
+	TestBuildTree(t)
+
+	original, err := ioutil.ReadFile("test.oct")
+	if err != nil {
+		panic(err)
+	}
+
+	var transcoded bytes.Buffer
+	if err := TranscodeTree(bytes.NewReader(original), &transcoded, MipR5G6B5UnpackUI16); err != nil {
+		panic(err)
+	}
+
+	frames := [][]byte{original, transcoded.Bytes(), original}
+	readers := make([]io.Reader, len(frames))
+	for i, f := range frames {
+		readers[i] = bytes.NewReader(f)
+	}
+
+	var buffer bytes.Buffer
+	if err := WriteSequence(&buffer, readers, 1); err != nil {
+		panic(err)
+	}
+
+	seq, err := OpenSequence(bytes.NewReader(buffer.Bytes()))
+	if err != nil {
+		panic(err)
+	}
+
+	if seq.NumFrames() != len(frames) {
+		t.Fatalf("expected %v frames, got %v", len(frames), seq.NumFrames())
+	}
+
+	for i := len(frames) - 1; i >= 0; i-- {
+		reader, err := seq.Frame(i)
+		if err != nil {
+			panic(err)
+		}
+
+		var header OctreeHeader
+		if err := DecodeHeader(reader, &header); err != nil {
+			panic(err)
+		}
+
+		reader.Seek(0, 0)
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			panic(err)
+		}
+
+		if !bytes.Equal(data, frames[i]) {
+			t.Errorf("frame %v differs", i)
+		}
+	}
+
+	if _, err := seq.Frame(len(frames)); err == nil {
+		t.Error("expected error for invalid frame")
+	}
+
+	if _, err := OpenSequence(bytes.NewReader(original)); err == nil {
+		t.Error("expected error when opening a tree as a sequence")
+	}
+}
+
+func reachableNodes(data *FrameData, index NodeIndex, path string, nodes map[string]Color) {
+	nodes[path] = data.Colors[index]
+	for i, child := range data.Children[index] {
+		if child != 0 {
+			reachableNodes(data, child, path+string(rune('0'+i)), nodes)
+		}
+	}
+}
+
+func cloneFrame(data *FrameData) *FrameData {
+	return &FrameData{
+		Header:   data.Header,
+		Colors:   append([]Color(nil), data.Colors...),
+		Children: append([][8]NodeIndex(nil), data.Children...),
+	}
+}
+
+func TestSequenceDelta(t *testing.T) {
+	TestBuildTree(t)
+
+	original, err := ioutil.ReadFile("test.oct")
+	if err != nil {
+		panic(err)
+	}
+
+	first, err := decodeFrameData(bytes.NewReader(original))
+	if err != nil {
+		panic(err)
+	}
+
+	// Recolor one leaf.
+	second := cloneFrame(first)
+	leaf := -1
+	for i := 1; i < len(second.Children) && leaf < 0; i++ {
+		if second.Children[i] == [8]NodeIndex{} {
+			leaf = i
+		}
+	}
+	second.Colors[leaf] = Color{1, 0, 1, 1}
+
+	// Remove one subtree and add a new leaf.
+	third := cloneFrame(second)
+	removed, added := false, false
+	for i := range third.Children {
+		for j, child := range third.Children[i] {
+			if child != 0 && !removed && child != NodeIndex(leaf) {
+				third.Children[i][j] = 0
+				removed = true
+			} else if child == 0 && !added && third.Children[i] != [8]NodeIndex{} {
+				third.Colors = append(third.Colors, Color{0, 1, 0, 1})
+				third.Children = append(third.Children, [8]NodeIndex{})
+				third.Children[i][j] = NodeIndex(len(third.Colors) - 1)
+				added = true
+			}
+		}
+	}
+
+	frames := []*FrameData{first, second, third, first}
+	readers := make([]io.Reader, len(frames))
+	for i, f := range frames {
+		var buffer bytes.Buffer
+		if err := f.encode(&buffer); err != nil {
+			panic(err)
+		}
+		readers[i] = &buffer
+	}
+
+	var buffer bytes.Buffer
+	if err := WriteSequence(&buffer, readers, 3); err != nil {
+		panic(err)
+	}
+
+	seq, err := OpenSequence(bytes.NewReader(buffer.Bytes()))
+	if err != nil {
+		panic(err)
+	}
+
+	for i, flags := range []uint32{0, deltaFrameFlag, deltaFrameFlag, 0} {
+		if seq.index[i].Flags != flags {
+			t.Errorf("unexpected flags for frame %v: %v", i, seq.index[i].Flags)
+		}
+	}
+
+	// Both frames start with a header, which is not part of the saving.
+	headerSize := uint64(first.Header.Size())
+	if (seq.index[1].Size-headerSize)*10 > seq.index[0].Size-headerSize {
+		t.Errorf("delta frame is too large: %v bytes, keyframe is %v bytes", seq.index[1].Size, seq.index[0].Size)
+	}
+
+	decoded0, err := seq.DecodeFrame(0)
+	if err != nil {
+		panic(err)
+	}
+
+	decoded1, err := seq.DecodeFrame(1)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(decoded0.Colors) != len(decoded1.Colors) {
+		t.Fatalf("node count differs: %v != %v", len(decoded0.Colors), len(decoded1.Colors))
+	}
+
+	for i := range decoded0.Colors {
+		if diff := decoded0.Colors[i] != decoded1.Colors[i] || decoded0.Children[i] != decoded1.Children[i]; diff != (i == leaf) {
+			t.Errorf("unexpected difference at node %v", i)
+		}
+	}
+
+	for i, f := range frames {
+		reader, err := seq.Frame(i)
+		if err != nil {
+			panic(err)
+		}
+
+		data, err := decodeFrameData(reader)
+		if err != nil {
+			panic(err)
+		}
+
+		expected, got := make(map[string]Color), make(map[string]Color)
+		reachableNodes(f, 0, "", expected)
+		reachableNodes(data, 0, "", got)
+
+		if len(expected) != len(got) {
+			t.Errorf("frame %v has %v nodes, expected %v", i, len(got), len(expected))
+			continue
+		}
+
+		for path, c := range expected {
+			if got[path] != c {
+				t.Errorf("frame %v differs at %q", i, path)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,296 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// SidecarFormat is the encoding of the leaf records of BuildConfig.Sidecar.
+type SidecarFormat int
+
+const (
+	// SidecarBinary is sidecarMagic followed by a record per leaf in node order,
+	// the node index as the difference to the previous record, the sample count,
+	// the source mask and the epoch, all as uvarints.
+	SidecarBinary SidecarFormat = iota
+
+	// SidecarText is sidecarTextHeader followed by a line per leaf in node
+	// order, with the node index, sample count, source mask in hex and epoch
+	// separated by commas.
+	SidecarText
+)
+
+const (
+	sidecarMagic      = "OCTSIDE2"
+	sidecarTextHeader = "node,samples,sources,epoch"
+
+	// sidecarMagicV1 and sidecarTextHeaderV1 start the sidecars written before
+	// records had an epoch, which read as epoch zero.
+	sidecarMagicV1      = "OCTSIDE1"
+	sidecarTextHeaderV1 = "node,samples,sources"
+
+	// maxSidecarDepth is the deepest tree the voxel paths of the sidecar fit in.
+	maxSidecarDepth = 21
+
+	// maxWorkers is the number of bits of the source mask.
+	maxWorkers = 64
+)
+
+// LeafRecord describes the samples inside a leaf.
+type LeafRecord struct {
+	Samples uint64
+
+	// Sources has bit i set if worker i of BuildConfig.Workers sampled the leaf.
+	// Builds without Workers only set bit zero.
+	Sources uint64
+
+	// Epoch is BuildConfig.Epoch of the build, or the epoch the leaf first
+	// appeared in for trees written by MarkChanges.
+	Epoch uint16
+}
+
+// leafStats counts the samples of each voxel of a build, keyed by the path of
+// child indices from the root like the levels of estimateTree.
+type leafStats struct {
+	bounds Box
+	depth  int
+	epoch  uint16
+	voxels map[uint64]LeafRecord
+}
+
+// newLeafStats returns the statistics of a build with a sidecar, nil otherwise.
+func newLeafStats(cfg *BuildConfig) (*leafStats, error) {
+	if cfg.Sidecar == nil {
+		return nil, nil
+	}
+
+	depth := bits.TrailingZeros64(uint64(cfg.VoxelsPerAxis))
+	if depth > maxSidecarDepth {
+		return nil, errSidecarDepth
+	}
+	return &leafStats{bounds: cfg.Bounds, depth: depth, epoch: cfg.Epoch, voxels: make(map[uint64]LeafRecord)}, nil
+}
+
+// add counts a sample of worker source. Samples outside the tree only add to the
+// color of the root and are not counted. Nil stats are ignored.
+func (s *leafStats) add(pos Point, source int) {
+	if s == nil || !s.bounds.containsClosed(pos) {
+		return
+	}
+
+	var path uint64
+	bounds := s.bounds
+	for level := 0; level < s.depth; level++ {
+		i := childIndex(bounds, pos)
+		bounds = childBox(bounds, i)
+		path = path<<3 | uint64(i)
+	}
+
+	rec := s.voxels[path]
+	rec.Samples++
+	rec.Sources |= 1 << uint(source)
+	s.voxels[path] = rec
+}
+
+// leafRecords returns the record of each leaf of a tree. The voxels below a leaf
+// are a contiguous range of paths, so leafs above the voxel level are summed
+// with a binary search of the sorted paths. Leafs shared by several parents sum
+// the voxels of every parent.
+func (s *leafStats) leafRecords(children [][8]NodeIndex) map[NodeIndex]LeafRecord {
+	paths := make([]uint64, 0, len(s.voxels))
+	for path := range s.voxels {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i] < paths[j] })
+
+	type visit struct {
+		index NodeIndex
+		depth int
+		path  uint64
+	}
+
+	records := make(map[NodeIndex]LeafRecord)
+	if len(children) == 0 {
+		return records
+	}
+
+	for stack := []visit{{}}; len(stack) > 0; {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		leaf := true
+		for i, child := range children[v.index] {
+			if child != 0 {
+				leaf = false
+				stack = append(stack, visit{child, v.depth + 1, v.path<<3 | uint64(i)})
+			}
+		}
+		if !leaf {
+			continue
+		}
+
+		shift := uint(3 * (s.depth - v.depth))
+		first, last := v.path<<shift, (v.path+1)<<shift
+		rec := records[v.index]
+		rec.Epoch = s.epoch
+		for i := sort.Search(len(paths), func(i int) bool { return paths[i] >= first }); i < len(paths) && paths[i] < last; i++ {
+			voxel := s.voxels[paths[i]]
+			rec.Samples += voxel.Samples
+			rec.Sources |= voxel.Sources
+		}
+		records[v.index] = rec
+	}
+	return records
+}
+
+// writeSidecar writes the leaf records of tree, a copy of the finished tree, to
+// the sidecar. Nil stats are ignored.
+func (s *leafStats) writeSidecar(cfg *BuildConfig, tree io.ReadSeeker) error {
+	if s == nil {
+		return nil
+	}
+
+	if _, err := tree.Seek(0, 0); err != nil {
+		return err
+	}
+
+	data, _, err := decodeTreePalette(bufio.NewReader(tree))
+	if err != nil {
+		return err
+	}
+	return WriteSidecar(cfg.Sidecar, s.leafRecords(data.Children), cfg.SidecarFormat)
+}
+
+// WriteSidecar writes records in format, in node order.
+func WriteSidecar(writer io.Writer, records map[NodeIndex]LeafRecord, format SidecarFormat) error {
+	nodes := make([]NodeIndex, 0, len(records))
+	for node := range records {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i] < nodes[j] })
+
+	w := bufio.NewWriter(writer)
+	switch format {
+	case SidecarBinary:
+		w.WriteString(sidecarMagic)
+
+		var (
+			buf  [4 * binary.MaxVarintLen64]byte
+			prev NodeIndex
+		)
+		for _, node := range nodes {
+			rec := records[node]
+			n := binary.PutUvarint(buf[:], uint64(node-prev))
+			n += binary.PutUvarint(buf[n:], rec.Samples)
+			n += binary.PutUvarint(buf[n:], rec.Sources)
+			n += binary.PutUvarint(buf[n:], uint64(rec.Epoch))
+			w.Write(buf[:n])
+			prev = node
+		}
+	case SidecarText:
+		fmt.Fprintln(w, sidecarTextHeader)
+		for _, node := range nodes {
+			rec := records[node]
+			fmt.Fprintf(w, "%d,%d,%x,%d\n", node, rec.Samples, rec.Sources, rec.Epoch)
+		}
+	default:
+		return errUnsupportedSidecar
+	}
+	return w.Flush()
+}
+
+// ReadSidecar reads the leaf records of a sidecar in either format, keyed by the
+// node index of the leaf. Sidecars without epochs are also read.
+func ReadSidecar(reader io.Reader) (map[NodeIndex]LeafRecord, error) {
+	r := bufio.NewReader(reader)
+	magic, err := r.Peek(len(sidecarMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	records := make(map[NodeIndex]LeafRecord)
+	if version := string(magic); version == sidecarMagic || version == sidecarMagicV1 {
+		r.Discard(len(sidecarMagic))
+
+		var node NodeIndex
+		for first := true; ; first = false {
+			delta, err := binary.ReadUvarint(r)
+			if err == io.EOF {
+				return records, nil
+			} else if err != nil {
+				return nil, errInvalidSidecar
+			}
+
+			// Records are in node order, only the first can be node zero.
+			if delta == 0 && !first {
+				return nil, errInvalidSidecar
+			}
+			node += NodeIndex(delta)
+
+			var rec LeafRecord
+			if rec.Samples, err = binary.ReadUvarint(r); err != nil {
+				return nil, errInvalidSidecar
+			}
+			if rec.Sources, err = binary.ReadUvarint(r); err != nil {
+				return nil, errInvalidSidecar
+			}
+			if version == sidecarMagic {
+				epoch, err := binary.ReadUvarint(r)
+				if err != nil || epoch > math.MaxUint16 {
+					return nil, errInvalidSidecar
+				}
+				rec.Epoch = uint16(epoch)
+			}
+			records[node] = rec
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		return nil, errInvalidSidecar
+	}
+	header := scanner.Text()
+	if header != sidecarTextHeader && header != sidecarTextHeaderV1 {
+		return nil, errInvalidSidecar
+	}
+
+	for scanner.Scan() {
+		var (
+			node NodeIndex
+			rec  LeafRecord
+			err  error
+		)
+		if header == sidecarTextHeader {
+			_, err = fmt.Sscanf(scanner.Text(), "%d,%d,%x,%d", &node, &rec.Samples, &rec.Sources, &rec.Epoch)
+		} else {
+			_, err = fmt.Sscanf(scanner.Text(), "%d,%d,%x", &node, &rec.Samples, &rec.Sources)
+		}
+		if err != nil {
+			return nil, errInvalidSidecar
+		}
+		records[node] = rec
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,150 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"testing"
+)
+
+// halfWorker samples every voxel of an 8^3 tree with x in [x0, x0+4), n times.
+func halfWorker(x0, n int) BuildWorker {
+	var samples []Sample
+	for i := 0; i < 4*8*8; i++ {
+		x, y, z := x0+i%4, i/4%8, i/32
+		for j := 0; j < n; j++ {
+			samples = append(samples, Sample{Point{float64(x) + 0.5, float64(y) + 0.5, float64(z) + 0.5}, Color{float32(x0) / 8, 0.5, 0.5, 1}})
+		}
+	}
+	return NewFakeWorker(samples)
+}
+
+func TestSidecar(t *testing.T) {
+	for _, format := range []SidecarFormat{SidecarBinary, SidecarText} {
+		var tree, sidecar bytes.Buffer
+		cfg := BuildConfig{
+			Workers:       []BuildWorker{halfWorker(0, 2), halfWorker(4, 1)},
+			Writer:        &tree,
+			Bounds:        Box{Point{0, 0, 0}, 8},
+			VoxelsPerAxis: 8,
+			Format:        MipR8G8B8A8UnpackUI32,
+			Sidecar:       &sidecar,
+			SidecarFormat: format,
+		}
+
+		status, err := BuildTree(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.NumSamples != 3*4*8*8 {
+			t.Errorf("expected the samples of both workers, got %d", status.NumSamples)
+		}
+
+		records, err := ReadSidecar(&sidecar)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, _, err := decodeTreePalette(&tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Leafs are at the voxel level, child bit 0 of the first level is the
+		// half of x.
+		var numLeafs int
+		var walk func(index NodeIndex, depth int, high bool)
+		walk = func(index NodeIndex, depth int, high bool) {
+			if depth == 3 {
+				numLeafs++
+				expected := LeafRecord{Samples: 2, Sources: 1}
+				if high {
+					expected = LeafRecord{Samples: 1, Sources: 2}
+				}
+				if rec, ok := records[index]; !ok || rec != expected {
+					t.Errorf("leaf %d: expected %+v, got %+v", index, expected, rec)
+				}
+				return
+			}
+			for i, child := range data.Children[index] {
+				if child != 0 {
+					walk(child, depth+1, high || depth == 0 && i&1 != 0)
+				}
+			}
+		}
+		walk(0, 0, false)
+
+		if numLeafs != 512 || len(records) != numLeafs {
+			t.Errorf("expected 512 leafs and records, got %d and %d", numLeafs, len(records))
+		}
+	}
+}
+
+func TestSidecarOptimized(t *testing.T) {
+	var tree, sidecar bytes.Buffer
+	cfg := BuildConfig{
+		Workers:       []BuildWorker{halfWorker(0, 1), halfWorker(4, 1)},
+		Writer:        &tree,
+		Bounds:        Box{Point{0, 0, 0}, 8},
+		VoxelsPerAxis: 8,
+		Format:        MipR8G8B8A8DeltaUI32,
+		Optimize:      true,
+		Checksum:      true,
+		Sidecar:       &sidecar,
+
+		// Both halves are solid and single colored, so they collapse into leafs at
+		// the first level.
+		ColorVarianceThreshold: 0.01,
+	}
+
+	status, err := BuildTree(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := ReadSidecar(&sidecar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var samples, sources uint64
+	for _, rec := range records {
+		samples += rec.Samples
+		sources |= rec.Sources
+		if rec.Sources != 1 && rec.Sources != 2 {
+			t.Errorf("leaf sampled by both workers, sources %b", rec.Sources)
+		}
+	}
+	if samples != status.NumSamples || sources != 3 {
+		t.Errorf("expected %d samples from both workers, got %d from %b", status.NumSamples, samples, sources)
+	}
+	if status.NumCollapsed == 0 || len(records) > 8 {
+		t.Errorf("expected collapsed leafs, got %d records", len(records))
+	}
+}
+
+func TestSidecarWorkers(t *testing.T) {
+	cfg := BuildConfig{Workers: make([]BuildWorker, 65), VoxelsPerAxis: 8}
+	if _, err := BuildTree(&cfg); err != errTooManyWorkers {
+		t.Errorf("expected errTooManyWorkers, got %v", err)
+	}
+
+	if _, err := ReadSidecar(bytes.NewReader([]byte("node,count\n"))); err != errInvalidSidecar {
+		t.Errorf("expected errInvalidSidecar, got %v", err)
+	}
+}
@@ -0,0 +1,435 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package pack
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+const (
+	// defaultSampleBatchSize is the batch size of batch workers if
+	// BuildConfig.SampleBatchSize is zero.
+	defaultSampleBatchSize = 1024
+
+	// batchChannelSize is the number of batches buffered by the builder.
+	batchChannelSize = 16
+)
+
+// BatchWorker is a BuildWorker that sends its samples in batches, which is much
+// cheaper than a channel operation per sample for workers that produce millions
+// of them. Batches should hold batchSize samples, except the last, and should be
+// taken from NewSampleBatch. A batch that is sent belongs to the builder, which
+// reuses it for later batches. Empty batches are skipped. Otherwise the contract
+// of BuildWorker applies.
+type BatchWorker func(batchSize int, batches chan<- []Sample) error
+
+var sampleBatchPool sync.Pool
+
+// NewSampleBatch returns an empty batch with room for size samples. Batches the
+// builder is done with are reused.
+func NewSampleBatch(size int) []Sample {
+	if b, ok := sampleBatchPool.Get().([]Sample); ok && cap(b) >= size {
+		return b[:0]
+	}
+	return make([]Sample, 0, size)
+}
+
+// sampleStream runs a worker in its own goroutine and hands the samples to the
+// builder. Close must be called when the builder stops early, or the worker is
+// left blocked on a full channel. The channel is never closed by the stream, so a
+// worker that closes it or panics fails with an error instead of crashing.
+type sampleStream struct {
+	samples   chan Sample
+	batches   chan []Sample
+	batch     []Sample
+	next      int
+	done      chan struct{}
+	err       error
+	closed    bool
+	closeOnce sync.Once
+
+	// sources are the workers of BuildConfig.Workers that have not been started
+	// and source is the index of the running one.
+	sources []BuildWorker
+	source  int
+
+	// tagged receives the samples of workers that run at once, with the index of
+	// their worker. errSource is the index of the worker that failed and stop is
+	// closed by Close, so no more workers are started.
+	tagged    chan taggedSample
+	errSource int
+	stop      chan struct{}
+
+	// coords is the convention of the samples, they are converted to tree
+	// space when popped.
+	coords CoordinateSystem
+}
+
+// taggedSample is a sample of worker source of a parallel stream.
+type taggedSample struct {
+	Sample
+	source int
+}
+
+func startSampleStream(worker BuildWorker) *sampleStream {
+	s := &sampleStream{samples: make(chan Sample, sampleChannelSize)}
+	s.run(func() error {
+		return worker(s.samples)
+	})
+	return s
+}
+
+func startBatchStream(worker BatchWorker, batchSize int) *sampleStream {
+	if batchSize <= 0 {
+		batchSize = defaultSampleBatchSize
+	}
+
+	s := &sampleStream{batches: make(chan []Sample, batchChannelSize)}
+	s.run(func() error {
+		return worker(batchSize, s.batches)
+	})
+	return s
+}
+
+// startSourceStream runs workers one after another on the same stream. The next
+// worker is started when the samples of the previous one are consumed, so Source
+// is exact.
+func startSourceStream(workers []BuildWorker) *sampleStream {
+	s := startSampleStream(workers[0])
+	s.sources = workers[1:]
+	return s
+}
+
+// startParallelStream runs up to parallelism workers at once. Every worker sends
+// to a channel of its own, whose samples are tagged with the index of the worker,
+// so Source is exact. The next worker is started when one returns, unless a
+// worker failed or the stream was closed. Workers are reported to logger as they
+// start and finish.
+func startParallelStream(workers []BuildWorker, parallelism int, logger Logger) *sampleStream {
+	s := &sampleStream{
+		tagged: make(chan taggedSample, sampleChannelSize),
+		done:   make(chan struct{}),
+		stop:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(s.done)
+
+		var (
+			wg    sync.WaitGroup
+			lock  sync.Mutex
+			slots = make(chan struct{}, parallelism)
+		)
+		failed := func(source int, err error) bool {
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil && s.err == nil {
+				s.err, s.errSource = err, source
+			}
+			return s.err != nil
+		}
+
+	start:
+		for i, worker := range workers {
+			select {
+			case slots <- struct{}{}:
+			case <-s.stop:
+				break start
+			}
+
+			select {
+			case <-s.stop:
+				break start
+			default:
+			}
+			if failed(i, nil) {
+				break
+			}
+
+			wg.Add(1)
+			go func(i int, worker BuildWorker) {
+				defer wg.Done()
+				logger.Debugf("worker %d of %d started", i+1, len(workers))
+				err := s.runTagged(i, worker)
+				if err != nil {
+					logger.Debugf("worker %d of %d failed: %v", i+1, len(workers), err)
+				} else {
+					logger.Debugf("worker %d of %d finished", i+1, len(workers))
+				}
+				failed(i, err)
+				<-slots
+			}(i, worker)
+		}
+		wg.Wait()
+	}()
+	return s
+}
+
+// runTagged runs worker source of a parallel stream and returns its error.
+func (s *sampleStream) runTagged(source int, worker BuildWorker) (err error) {
+	samples := make(chan Sample, sampleChannelSize)
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for samp := range samples {
+			s.tagged <- taggedSample{samp, source}
+		}
+	}()
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("worker panicked: %v", r)
+			}
+		}()
+		err = worker(samples)
+	}()
+
+	// The channel is closed here unless the worker closed it.
+	func() {
+		defer func() {
+			if recover() != nil && err == nil {
+				err = errWorkerClosed
+			}
+		}()
+		close(samples)
+	}()
+	<-forwarded
+	return err
+}
+
+// workerParallelism returns the number of BuildConfig.Workers that run at once.
+func workerParallelism(cfg *BuildConfig) int {
+	if cfg.Parallelism == 0 {
+		return runtime.NumCPU()
+	}
+	return cfg.Parallelism
+}
+
+// workerStream starts the worker of a build, Batches if set, Workers if set and
+// Worker otherwise.
+func workerStream(cfg *BuildConfig) *sampleStream {
+	var s *sampleStream
+	if cfg.Batches != nil {
+		s = startBatchStream(cfg.Batches, cfg.SampleBatchSize)
+	} else if parallelism := workerParallelism(cfg); len(cfg.Workers) > 1 && parallelism > 1 {
+		s = startParallelStream(cfg.Workers, parallelism, LoggerOrNop(cfg.Logger))
+	} else if len(cfg.Workers) > 0 {
+		s = startSourceStream(cfg.Workers)
+	} else {
+		s = startSampleStream(cfg.Worker)
+	}
+	s.coords = cfg.Coordinates
+	return s
+}
+
+// cellStream starts the worker of a cell, batched if Cells implements
+// BatchCellWorker.
+func cellStream(cfg *BuildConfig, cell Box) *sampleStream {
+	var s *sampleStream
+	region := cfg.Coordinates.sourceRegion(cell)
+	if batched, ok := cfg.Cells.(BatchCellWorker); ok {
+		s = startBatchStream(batched.RegionBatches(region), cfg.SampleBatchSize)
+	} else {
+		s = startSampleStream(cfg.Cells.Region(region))
+	}
+	s.coords = cfg.Coordinates
+	return s
+}
+
+func (s *sampleStream) run(worker func() error) {
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		defer func() {
+			if r := recover(); r != nil {
+				s.err = fmt.Errorf("worker panicked: %v", r)
+			}
+		}()
+		s.err = worker()
+	}()
+}
+
+// Pop returns the next sample in tree space, false when the worker has returned
+// and all samples are consumed.
+func (s *sampleStream) Pop() (Sample, bool) {
+	samp, ok := s.pop()
+	samp.Pos = s.coords.ToTree(samp.Pos)
+	return samp, ok
+}
+
+func (s *sampleStream) pop() (Sample, bool) {
+	if s.batches != nil {
+		return s.popBatch()
+	} else if s.tagged != nil {
+		return s.popTagged()
+	}
+
+	for {
+		if samp, ok := s.popSample(); ok || !s.nextSource() {
+			return samp, ok
+		}
+	}
+}
+
+// Source returns the index in BuildConfig.Workers of the worker that sent the
+// last sample, zero for streams of a single worker.
+func (s *sampleStream) Source() int {
+	return s.source
+}
+
+// nextSource starts the next worker of a source stream once the running one has
+// returned without error.
+func (s *sampleStream) nextSource() bool {
+	if len(s.sources) == 0 || s.err != nil || s.closed {
+		return false
+	}
+
+	worker := s.sources[0]
+	s.sources = s.sources[1:]
+	s.source++
+	s.run(func() error {
+		return worker(s.samples)
+	})
+	return true
+}
+
+func (s *sampleStream) popSample() (Sample, bool) {
+	select {
+	case samp, ok := <-s.samples:
+		if ok {
+			return samp, true
+		}
+		s.closed = true
+		<-s.done
+		return Sample{}, false
+	case <-s.done:
+	}
+
+	// The samples sent before the worker returned may still be buffered.
+	select {
+	case samp, ok := <-s.samples:
+		if ok {
+			return samp, true
+		}
+		s.closed = true
+	default:
+	}
+	return Sample{}, false
+}
+
+func (s *sampleStream) popTagged() (Sample, bool) {
+	select {
+	case samp := <-s.tagged:
+		s.source = samp.source
+		return samp.Sample, true
+	case <-s.done:
+	}
+
+	select {
+	case samp := <-s.tagged:
+		s.source = samp.source
+		return samp.Sample, true
+	default:
+	}
+	return Sample{}, false
+}
+
+func (s *sampleStream) popBatch() (Sample, bool) {
+	for s.next >= len(s.batch) {
+		if s.batch != nil {
+			sampleBatchPool.Put(s.batch[:0])
+			s.batch = nil
+		}
+
+		batch, ok := s.nextBatch()
+		if !ok {
+			return Sample{}, false
+		}
+		s.batch, s.next = batch, 0
+	}
+
+	s.next++
+	return s.batch[s.next-1], true
+}
+
+func (s *sampleStream) nextBatch() ([]Sample, bool) {
+	select {
+	case batch, ok := <-s.batches:
+		if ok {
+			return batch, true
+		}
+		s.closed = true
+		<-s.done
+		return nil, false
+	case <-s.done:
+	}
+
+	select {
+	case batch, ok := <-s.batches:
+		if ok {
+			return batch, true
+		}
+		s.closed = true
+	default:
+	}
+	return nil, false
+}
+
+// Err returns the error of the worker as an ErrWorkerFailed. It must only be
+// called after Pop returned false.
+func (s *sampleStream) Err() error {
+	<-s.done
+	if s.tagged != nil && s.err != nil {
+		return &ErrWorkerFailed{s.errSource, s.err}
+	} else if s.err == nil && s.closed {
+		return &ErrWorkerFailed{s.source, errWorkerClosed}
+	} else if s.err != nil {
+		return &ErrWorkerFailed{s.source, s.err}
+	}
+	return nil
+}
+
+// Close discards the remaining samples so the worker can return. It does not wait
+// for the worker and can be called any number of times, also after the stream is
+// consumed.
+func (s *sampleStream) Close() {
+	s.closeOnce.Do(func() {
+		if s.stop != nil {
+			close(s.stop)
+		}
+		go func() {
+			for {
+				select {
+				case _, ok := <-s.samples:
+					if !ok {
+						return
+					}
+				case _, ok := <-s.batches:
+					if !ok {
+						return
+					}
+				case <-s.tagged:
+				case <-s.done:
+					return
+				}
+			}
+		}()
+	})
+}
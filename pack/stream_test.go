@@ -0,0 +1,392 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSampleStream(t *testing.T) {
+	const producers, perProducer = 4, 1000
+
+	stream := startSampleStream(func(samples chan<- Sample) error {
+		var wg sync.WaitGroup
+		wg.Add(producers)
+		for i := 0; i < producers; i++ {
+			go func(i int) {
+				for j := 0; j < perProducer; j++ {
+					samples <- Sample{Pos: Point{float64(i), float64(j), 0}}
+				}
+				wg.Done()
+			}(i)
+		}
+		wg.Wait()
+		return nil
+	})
+
+	seen := make(map[Point]bool)
+	for {
+		samp, more := stream.Pop()
+		if !more {
+			break
+		}
+		seen[samp.Pos] = true
+	}
+
+	if len(seen) != producers*perProducer {
+		t.Errorf("expected %v samples, got %v", producers*perProducer, len(seen))
+	}
+
+	if err := stream.Err(); err != nil {
+		t.Error(err)
+	}
+
+	stream.Close()
+	stream.Close()
+
+	if _, more := stream.Pop(); more {
+		t.Error("expected no samples after the stream is consumed")
+	}
+}
+
+func TestSampleStreamClose(t *testing.T) {
+	returned := make(chan struct{})
+	stream := startSampleStream(func(samples chan<- Sample) error {
+		defer close(returned)
+		for i := 0; i < 100000; i++ {
+			samples <- Sample{}
+		}
+		return nil
+	})
+
+	for i := 0; i < 3; i++ {
+		stream.Pop()
+	}
+
+	stream.Close()
+	stream.Close()
+
+	select {
+	case <-returned:
+	case <-time.After(10 * time.Second):
+		t.Fatal("worker is still blocked after close")
+	}
+}
+
+func TestBuildTreeWorkerError(t *testing.T) {
+	workerErr := errors.New("worker failed")
+	cfg := BuildConfig{
+		Worker: func(samples chan<- Sample) error {
+			samples <- Sample{Pos: Point{0.5, 0.5, 0.5}, Col: Color{1, 1, 1, 1}}
+			return workerErr
+		},
+		Writer:        ioutil.Discard,
+		Bounds:        Box{Point{0, 0, 0}, 1},
+		VoxelsPerAxis: 2,
+		Format:        MipR8G8B8A8UnpackUI32,
+	}
+
+	var failed *ErrWorkerFailed
+	if _, err := BuildTree(&cfg); !errors.Is(err, workerErr) || !errors.As(err, &failed) || failed.WorkerIndex != 0 {
+		t.Errorf("expected the worker error, got %v", err)
+	}
+
+	// The failed worker of several is reported by its index, whether they run
+	// one after another or at once.
+	ok := func(samples chan<- Sample) error { return nil }
+	cfg.Worker, cfg.Workers = nil, []BuildWorker{ok, cfg.Worker, ok}
+	for _, parallelism := range []int{1, 3} {
+		cfg.Parallelism = parallelism
+		if _, err := BuildTree(&cfg); !errors.As(err, &failed) || failed.WorkerIndex != 1 || ExitCode(err) != ExitWorkerFailed {
+			t.Errorf("parallelism %d: expected worker 1 to fail, got %v", parallelism, err)
+		}
+	}
+}
+
+func TestParallelStream(t *testing.T) {
+	const numWorkers, perWorker, parallelism = 8, 1000, 3
+
+	var running, maxRunning int32
+	workers := make([]BuildWorker, numWorkers)
+	for i := range workers {
+		i := i
+		workers[i] = func(samples chan<- Sample) error {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+
+			for j := 0; j < perWorker; j++ {
+				samples <- Sample{Pos: Point{float64(i), float64(j), 0}}
+			}
+			return nil
+		}
+	}
+
+	stream := startParallelStream(workers, parallelism, NopLogger)
+	counts := make([]int, numWorkers)
+	for {
+		samp, more := stream.Pop()
+		if !more {
+			break
+		}
+		if int(samp.Pos.X) != stream.Source() {
+			t.Fatalf("sample of worker %v reported from worker %v", samp.Pos.X, stream.Source())
+		}
+		counts[stream.Source()]++
+	}
+	if err := stream.Err(); err != nil {
+		t.Error(err)
+	}
+	stream.Close()
+
+	for i, n := range counts {
+		if n != perWorker {
+			t.Errorf("worker %d: expected %d samples, got %d", i, perWorker, n)
+		}
+	}
+	if max := atomic.LoadInt32(&maxRunning); max > parallelism {
+		t.Errorf("%d workers ran at once", max)
+	}
+
+	// Workers that are not started when the stream is closed never are.
+	var started int32
+	blocking := func(samples chan<- Sample) error {
+		atomic.AddInt32(&started, 1)
+		for i := 0; i < 100000; i++ {
+			samples <- Sample{}
+		}
+		return nil
+	}
+	stream = startParallelStream([]BuildWorker{blocking, blocking, blocking, blocking}, 2, NopLogger)
+	stream.Pop()
+	stream.Close()
+
+	select {
+	case <-stream.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("workers are still blocked after close")
+	}
+	if n := atomic.LoadInt32(&started); n != 2 {
+		t.Errorf("expected 2 workers to start, got %d", n)
+	}
+}
+
+// batchWorker sends samples in batches of batchSize, with an empty batch between
+// every batch.
+func batchWorker(samples []Sample) BatchWorker {
+	return func(batchSize int, batches chan<- []Sample) error {
+		batch := NewSampleBatch(batchSize)
+		for _, samp := range samples {
+			batch = append(batch, samp)
+			if len(batch) == batchSize {
+				batches <- batch
+				batches <- nil
+				batch = NewSampleBatch(batchSize)
+			}
+		}
+
+		if len(batch) > 0 {
+			batches <- batch
+		}
+		return nil
+	}
+}
+
+func TestBatchStream(t *testing.T) {
+	var samples []Sample
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, Sample{Pos: Point{float64(i), 0, 0}})
+	}
+
+	for _, batchSize := range []int{0, 1, 7, 2000} {
+		stream := startBatchStream(batchWorker(samples), batchSize)
+
+		var n int
+		for {
+			samp, more := stream.Pop()
+			if !more {
+				break
+			}
+
+			if samp.Pos.X != float64(n) {
+				t.Fatalf("batch size %v: expected sample %v, got %v", batchSize, n, samp.Pos.X)
+			}
+			n++
+		}
+
+		if n != len(samples) {
+			t.Errorf("batch size %v: expected %v samples, got %v", batchSize, len(samples), n)
+		}
+
+		if err := stream.Err(); err != nil {
+			t.Error(err)
+		}
+		stream.Close()
+	}
+}
+
+func TestBatchStreamClose(t *testing.T) {
+	returned := make(chan struct{})
+	stream := startBatchStream(func(batchSize int, batches chan<- []Sample) error {
+		defer close(returned)
+		for i := 0; i < 100000; i++ {
+			batches <- append(NewSampleBatch(batchSize), Sample{})
+		}
+		return nil
+	}, 4)
+
+	for i := 0; i < 3; i++ {
+		stream.Pop()
+	}
+	stream.Close()
+
+	select {
+	case <-returned:
+	case <-time.After(10 * time.Second):
+		t.Fatal("worker is still blocked after close")
+	}
+
+	stream = startBatchStream(func(batchSize int, batches chan<- []Sample) error {
+		close(batches)
+		return nil
+	}, 4)
+
+	for {
+		if _, more := stream.Pop(); !more {
+			break
+		}
+	}
+	if err := stream.Err(); !errors.Is(err, errWorkerClosed) {
+		t.Error("expected an error when the worker closes the channel")
+	}
+}
+
+func TestBuildTreeBatches(t *testing.T) {
+	var samples []Sample
+	for i := 0; i < 512; i++ {
+		x, y, z := i%8, i/8%8, i/64
+		samples = append(samples, Sample{Point{float64(x) + 0.5, float64(y) + 0.5, float64(z) + 0.5}, Color{float32(x) / 8, float32(y) / 8, float32(z) / 8, 1}})
+	}
+
+	build := func(cfg BuildConfig) []byte {
+		var buf bytes.Buffer
+		cfg.Writer = &buf
+		cfg.Bounds = Box{Point{0, 0, 0}, 8}
+		cfg.VoxelsPerAxis = 8
+		cfg.Format = MipR8G8B8A8UnpackUI32
+
+		if _, err := BuildTree(&cfg); err != nil {
+			panic(err)
+		}
+		return buf.Bytes()
+	}
+
+	expected := build(BuildConfig{Worker: NewFakeWorker(samples)})
+	if tree := build(BuildConfig{Batches: batchWorker(samples), SampleBatchSize: 100}); !bytes.Equal(tree, expected) {
+		t.Error("batched build differs from the sample build")
+	}
+}
+
+// benchmarkSamples is the number of samples streamed by every benchmark
+// iteration.
+const benchmarkSamples = 10000000
+
+func BenchmarkSampleStream(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		stream := startSampleStream(func(samples chan<- Sample) error {
+			for j := 0; j < benchmarkSamples; j++ {
+				samples <- Sample{Pos: Point{float64(j), 0, 0}}
+			}
+			return nil
+		})
+
+		for {
+			if _, more := stream.Pop(); !more {
+				break
+			}
+		}
+	}
+}
+
+// benchmarkWorkers streams benchmarkSamples split over numWorkers workers.
+func benchmarkWorkers(b *testing.B, numWorkers, parallelism int) {
+	workers := make([]BuildWorker, numWorkers)
+	for i := range workers {
+		workers[i] = func(samples chan<- Sample) error {
+			for j := 0; j < benchmarkSamples/numWorkers; j++ {
+				samples <- Sample{Pos: Point{float64(j), 0, 0}}
+			}
+			return nil
+		}
+	}
+
+	for i := 0; i < b.N; i++ {
+		stream := workerStream(&BuildConfig{Workers: workers, Parallelism: parallelism})
+		for {
+			if _, more := stream.Pop(); !more {
+				break
+			}
+		}
+	}
+}
+
+// BenchmarkWorkersOversubscribed runs many more workers than there are cores.
+func BenchmarkWorkersOversubscribed(b *testing.B) {
+	b.Run("serial", func(b *testing.B) { benchmarkWorkers(b, 48, 1) })
+	b.Run("parallel", func(b *testing.B) { benchmarkWorkers(b, 48, 0) })
+}
+
+// BenchmarkWorkersUndersubscribed runs fewer workers than there are cores.
+func BenchmarkWorkersUndersubscribed(b *testing.B) {
+	b.Run("serial", func(b *testing.B) { benchmarkWorkers(b, 2, 1) })
+	b.Run("parallel", func(b *testing.B) { benchmarkWorkers(b, 2, 0) })
+}
+
+func BenchmarkBatchStream(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		stream := startBatchStream(func(batchSize int, batches chan<- []Sample) error {
+			batch := NewSampleBatch(batchSize)
+			for j := 0; j < benchmarkSamples; j++ {
+				batch = append(batch, Sample{Pos: Point{float64(j), 0, 0}})
+				if len(batch) == batchSize {
+					batches <- batch
+					batch = NewSampleBatch(batchSize)
+				}
+			}
+			batches <- batch
+			return nil
+		}, 0)
+
+		for {
+			if _, more := stream.Pop(); !more {
+				break
+			}
+		}
+	}
+}
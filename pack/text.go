@@ -0,0 +1,359 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package pack
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var formatNames = [...]string{
+	"MipR8G8B8A8UnpackUI32", "MipR8G8B8A8UnpackUI16", "MipR4G4B4A4UnpackUI16", "MipR5G6B5UnpackUI16",
+	"MipR8G8B8A8PackUI28", "MipR4G4B4A4PackUI30", "MipR5G6B5PackUI30", "MipR3G3B2PackUI31",
+	"MipR8G8B8A8RelativeUI16", "MipP8UnpackUI32", "MipP8UnpackUI16", "MipR8G8B8A8DeltaUI32",
+	"MipR8G8B8A8UnpackUI64", "MipR8G8B8A8FlagsUI32", "mipR64G64B64A64S64UnpackUI64",
+}
+
+// textNode is where a node was first reached from the root.
+type textNode struct {
+	cell    meshCell
+	reached int
+}
+
+// DumpText writes a tree as text, for debugging. The header fields come first,
+// followed by one line per node in index order:
+//
+//	node 3 depth 2 pos 1,0,1 color #ff8000ff children 0 0 9 0 0 0 0 0
+//
+// Depth and pos are the level and the cell at that level of the node, the same
+// cells octdiff reports, found by walking the tree breadth first from the root.
+// Nodes reached more than once, in optimized trees, are marked shared and have
+// the cell where they were first reached. Nodes that can not be reached from the
+// root are marked orphan. Colors are rounded to eight bits per channel.
+func DumpText(reader io.Reader, writer io.Writer) error {
+	data, err := decodeTree(reader)
+	if err != nil {
+		return err
+	}
+
+	nodes := make([]textNode, len(data.Colors))
+	if len(nodes) > 0 {
+		nodes[0].reached = 1
+		queue := []NodeIndex{0}
+		for len(queue) > 0 {
+			index := queue[0]
+			queue = queue[1:]
+
+			cell := nodes[index].cell
+			for i, child := range data.Children[index] {
+				if child == 0 {
+					continue
+				}
+
+				nodes[child].reached++
+				if nodes[child].reached > 1 {
+					continue
+				}
+
+				p := childPositions[i]
+				nodes[child].cell = meshCell{cell.depth + 1, cell.x*2 + int64(p.X), cell.y*2 + int64(p.Y), cell.z*2 + int64(p.Z)}
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	h := &data.Header
+	out := bufio.NewWriter(writer)
+	fmt.Fprintf(out, "format %s\n", formatNames[h.Format])
+	fmt.Fprintf(out, "version %d\n", h.Version)
+	fmt.Fprintf(out, "flags %#x\n", h.Flags)
+	fmt.Fprintf(out, "voxels %d\n", h.VoxelsPerAxis)
+	if h.Coordinates != YUpRightHanded {
+		fmt.Fprintf(out, "coordinates %s\n", h.Coordinates)
+	}
+	fmt.Fprintf(out, "bounds %v %v %v %v\n", h.Bounds.Pos.X, h.Bounds.Pos.Y, h.Bounds.Pos.Z, h.Bounds.Size)
+	if g := h.GeoReference; g != nil {
+		fmt.Fprintf(out, "crs %q\n", g.CRS)
+		// Coordinates of a CRS are printed without exponent, like 6543210.89.
+		f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+		fmt.Fprintf(out, "origin %s %s %s\n", f(g.Origin[0]), f(g.Origin[1]), f(g.Origin[2]))
+		fmt.Fprintf(out, "scale %s %s %s\n", f(g.Scale[0]), f(g.Scale[1]), f(g.Scale[2]))
+	}
+	fmt.Fprintf(out, "leafs %d\n", h.NumLeafs)
+
+	for index, n := range nodes {
+		fmt.Fprintf(out, "node %d", index)
+		if n.reached == 0 {
+			fmt.Fprint(out, " orphan")
+		} else {
+			fmt.Fprintf(out, " depth %d pos %d,%d,%d", n.cell.depth, n.cell.x, n.cell.y, n.cell.z)
+			if n.reached > 1 {
+				fmt.Fprint(out, " shared")
+			}
+		}
+
+		c := &data.Colors[index]
+		fmt.Fprintf(out, " color #%02x%02x%02x%02x children", roundChannel(c.R), roundChannel(c.G), roundChannel(c.B), roundChannel(c.A))
+		for _, child := range data.Children[index] {
+			fmt.Fprintf(out, " %d", child)
+		}
+		fmt.Fprintln(out)
+	}
+	return out.Flush()
+}
+
+// ParseText reads a tree written by DumpText and encodes it in format, which
+// can not be a palette format. Nodes can be listed in any order but every index
+// below the largest one must be present. Depth, pos and the shared and orphan
+// marks are ignored, so hand written trees only need the color and children of
+// every node:
+//
+//	voxels 2
+//	node 0 color #ffffffff children 1 0 0 0 0 0 0 0
+//	node 1 color #ff0000ff children 0 0 0 0 0 0 0 0
+//
+// Missing header fields are zero, except leafs which is the number of nodes
+// without children and the scale of a geo reference, which is one. A geo
+// reference is added by any of crs, origin and scale. The compressed, palette
+// and checksum flags are cleared.
+func ParseText(reader io.Reader, writer io.Writer, format OctreeFormat) error {
+	if format.Paletted() || format >= mipR64G64B64A64S64UnpackUI64 {
+		return ErrUnsupportedFormat
+	}
+
+	var (
+		colors   []Color
+		children [][8]NodeIndex
+		present  []bool
+		leafs    = -1
+	)
+
+	header := NewOctreeHeader(format, 0)
+	scanner := bufio.NewScanner(reader)
+
+	// geo returns the geo reference of the header, a new one with a scale of
+	// one if there is none yet.
+	geo := func() *GeoReference {
+		if header.GeoReference == nil {
+			header.GeoReference = &GeoReference{Scale: [3]float64{1, 1, 1}}
+		}
+		return header.GeoReference
+	}
+
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+
+		var err error
+		switch fields[0] {
+		case "format":
+			// The tree is encoded in format.
+		case "version":
+			var v uint64
+			v, err = textUint(fields, 8)
+			header.Version = byte(v)
+			if err == nil && header.Version > binaryVersion {
+				err = errUnsupportedVersion
+			}
+		case "flags":
+			var v uint64
+			v, err = textUint(fields, 8)
+			header.Flags = byte(v) &^ (compressedMask | paletteMask | checksumMask)
+		case "voxels":
+			var v uint64
+			v, err = textUint(fields, 32)
+			header.VoxelsPerAxis = uint32(v)
+		case "coordinates":
+			if len(fields) != 2 {
+				err = errInvalidFile
+				break
+			}
+			header.Coordinates, err = ParseCoordinateSystem(fields[1])
+		case "leafs":
+			var v uint64
+			v, err = textUint(fields, 63)
+			leafs = int(v)
+		case "bounds":
+			b := &header.Bounds
+			if len(fields) != 5 {
+				err = errInvalidFile
+				break
+			}
+			for i, p := range []*float64{&b.Pos.X, &b.Pos.Y, &b.Pos.Z, &b.Size} {
+				if *p, err = strconv.ParseFloat(fields[i+1], 64); err != nil {
+					break
+				}
+			}
+		case "crs":
+			var crs string
+			if crs, err = strconv.Unquote(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(scanner.Text()), "crs"))); err != nil {
+				break
+			}
+			geo().CRS = crs
+		case "origin":
+			err = textFloats(fields, geo().Origin[:])
+		case "scale":
+			err = textFloats(fields, geo().Scale[:])
+		case "node":
+			var (
+				index NodeIndex
+				color Color
+				nodes [8]NodeIndex
+			)
+			if index, color, nodes, err = parseTextNode(fields); err != nil {
+				break
+			}
+
+			for NodeIndex(len(colors)) <= index {
+				colors = append(colors, Color{})
+				children = append(children, [8]NodeIndex{})
+				present = append(present, false)
+			}
+			if present[index] {
+				err = fmt.Errorf("node %d listed twice", index)
+				break
+			}
+			colors[index], children[index], present[index] = color, nodes, true
+		default:
+			err = fmt.Errorf("unknown field %q", fields[0])
+		}
+
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	numLeafs := 0
+	for index, ok := range present {
+		if !ok {
+			return fmt.Errorf("node %d is missing", index)
+		}
+
+		leaf := true
+		for _, child := range children[index] {
+			if uint64(child) >= uint64(len(colors)) {
+				return fmt.Errorf("node %d: child %d is out of range", index, child)
+			}
+			leaf = leaf && child == 0
+		}
+		if leaf {
+			numLeafs++
+		}
+	}
+
+	header.NumNodes = uint64(len(colors))
+	header.NumLeafs = uint64(numLeafs)
+	if leafs >= 0 {
+		header.NumLeafs = uint64(leafs)
+	}
+
+	if err := EncodeHeader(writer, header); err != nil {
+		return err
+	}
+
+	encoder := NewNodeEncoder(writer, format, nil)
+	for index := range colors {
+		if err := encoder.Encode(colors[index], children[index][:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseTextNode parses a node line of DumpText.
+func parseTextNode(fields []string) (index NodeIndex, color Color, children [8]NodeIndex, err error) {
+	if len(fields) < 2 {
+		return index, color, children, errInvalidFile
+	}
+
+	var v uint64
+	if v, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+		return
+	}
+	index = NodeIndex(v)
+
+	hasColor, hasChildren := false, false
+	for i := 2; i < len(fields); i++ {
+		switch fields[i] {
+		case "color":
+			if i+1 >= len(fields) || len(fields[i+1]) != 9 || fields[i+1][0] != '#' {
+				return index, color, children, errInvalidTextColor
+			}
+			if v, err = strconv.ParseUint(fields[i+1][1:], 16, 32); err != nil {
+				return
+			}
+			color = Color{float32(v>>24) / 255, float32(v>>16&0xff) / 255, float32(v>>8&0xff) / 255, float32(v&0xff) / 255}
+			hasColor = true
+			i++
+		case "children":
+			if len(fields)-i-1 < 8 {
+				return index, color, children, errInvalidTextChildren
+			}
+			for j := range children {
+				if v, err = strconv.ParseUint(fields[i+1+j], 10, 64); err != nil {
+					return
+				}
+				children[j] = NodeIndex(v)
+			}
+			hasChildren = true
+			i += 8
+		}
+	}
+
+	if !hasColor || !hasChildren {
+		return index, color, children, fmt.Errorf("node %d needs a color and children", index)
+	}
+	return
+}
+
+// textUint parses the value of a header field.
+func textUint(fields []string, bits int) (uint64, error) {
+	if len(fields) != 2 {
+		return 0, errInvalidFile
+	}
+	return strconv.ParseUint(fields[1], 0, bits)
+}
+
+// textFloats parses the values following the name of a field.
+func textFloats(fields []string, values []float64) error {
+	if len(fields) != len(values)+1 {
+		return errInvalidFile
+	}
+	for i := range values {
+		v, err := strconv.ParseFloat(fields[i+1], 64)
+		if err != nil {
+			return err
+		}
+		values[i] = v
+	}
+	return nil
+}
+
+// roundChannel returns a color channel in eight bits, rounded to nearest so
+// channels decoded from eight bit formats are printed exactly.
+func roundChannel(v float32) byte {
+	return byte(math.Round(math.Max(0, math.Min(1, float64(v))) * 255))
+}
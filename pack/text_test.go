@@ -0,0 +1,132 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package pack
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTextRoundTrip(t *testing.T) {
+	var samples []Sample
+	for i := 0; i < 8; i++ {
+		p := childPositions[i]
+		samples = append(samples, Sample{Point{p.X*2 + 0.5, p.Y*2 + 0.5, p.Z*2 + 0.5}, Color{float32(i) / 7, 0.5, 1 - float32(i)/7, 1}})
+	}
+
+	for _, format := range []OctreeFormat{MipR8G8B8A8UnpackUI32, MipR4G4B4A4UnpackUI16, MipR8G8B8A8RelativeUI16, MipR8G8B8A8DeltaUI32, MipR8G8B8A8FlagsUI32} {
+		var tree bytes.Buffer
+		cfg := BuildConfig{
+			Worker:        NewFakeWorker(samples),
+			Writer:        &tree,
+			Bounds:        Box{Point{0, 0, 0}, 4},
+			VoxelsPerAxis: 4,
+			Format:        format,
+		}
+		if _, err := BuildTree(&cfg); err != nil {
+			panic(err)
+		}
+
+		var text bytes.Buffer
+		if err := DumpText(bytes.NewReader(tree.Bytes()), &text); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(text.String(), "node 0 depth 0 pos 0,0,0 ") {
+			t.Errorf("%s: expected the root at depth zero:\n%s", formatNames[format], text.String())
+		}
+
+		var parsed bytes.Buffer
+		if err := ParseText(bytes.NewReader(text.Bytes()), &parsed, format); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(parsed.Bytes(), tree.Bytes()) {
+			t.Errorf("%s: the parsed tree differs from the original", formatNames[format])
+		}
+	}
+}
+
+func TestTextOrphan(t *testing.T) {
+	const text = `
+voxels 2
+// The root has one child in slot 5, node 3 is not referenced.
+node 0 color #808080ff children 0 0 0 0 0 2 0 0
+node 3 color #00ff00ff children 0 0 0 0 0 0 0 0
+node 2 color #ff0000ff children 0 0 0 0 0 1 0 1
+node 1 color #0000ffff children 0 0 0 0 0 0 0 0
+`
+
+	var tree bytes.Buffer
+	if err := ParseText(strings.NewReader(text), &tree, MipR8G8B8A8UnpackUI32); err != nil {
+		t.Fatal(err)
+	}
+
+	var header OctreeHeader
+	if err := DecodeHeader(bytes.NewReader(tree.Bytes()), &header); err != nil {
+		panic(err)
+	}
+	if header.NumNodes != 4 || header.NumLeafs != 2 || header.VoxelsPerAxis != 2 {
+		t.Errorf("unexpected header %+v", header)
+	}
+
+	var dump bytes.Buffer
+	if err := DumpText(bytes.NewReader(tree.Bytes()), &dump); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		"node 0 depth 0 pos 0,0,0 color #808080ff children 0 0 0 0 0 2 0 0",
+		"node 1 depth 2 pos 3,0,3 shared color #0000ffff children 0 0 0 0 0 0 0 0",
+		"node 2 depth 1 pos 1,0,1 color #ff0000ff children 0 0 0 0 0 1 0 1",
+		"node 3 orphan color #00ff00ff children 0 0 0 0 0 0 0 0",
+	} {
+		if !strings.Contains(dump.String(), line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, dump.String())
+		}
+	}
+
+	var again bytes.Buffer
+	if err := ParseText(bytes.NewReader(dump.Bytes()), &again, MipR8G8B8A8UnpackUI32); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Bytes(), tree.Bytes()) {
+		t.Error("the dump of the orphan tree did not parse back to the same tree")
+	}
+}
+
+func TestParseTextErrors(t *testing.T) {
+	for _, text := range []string{
+		"node 1 color #ffffffff children 0 0 0 0 0 0 0 0",
+		"node 0 color #ffffffff children 1 0 0 0 0 0 0 0",
+		"node 0 color #ffffff children 0 0 0 0 0 0 0 0",
+		"node 0 color #ffffffff children 0 0 0",
+		"node 0 color #ffffffff children 0 0 0 0 0 0 0 0\nnode 0 color #ffffffff children 0 0 0 0 0 0 0 0",
+		"depth 3",
+	} {
+		var tree bytes.Buffer
+		if err := ParseText(strings.NewReader(text), &tree, MipR8G8B8A8UnpackUI32); err == nil {
+			t.Errorf("expected an error for %q", text)
+		}
+	}
+
+	var tree bytes.Buffer
+	if err := ParseText(strings.NewReader(""), &tree, MipP8UnpackUI32); err != ErrUnsupportedFormat {
+		t.Errorf("expected ErrUnsupportedFormat for a palette format, got %v", err)
+	}
+}
@@ -91,7 +91,7 @@ func (color *Color) writeColor(writer io.Writer, format OctreeFormat) error {
 		err := binary.Write(writer, binary.LittleEndian, r<<11|g<<5|b)
 		return err
 	default:
-		return errUnsupportedFormat
+		return ErrUnsupportedFormat
 	}
 }
 
@@ -112,6 +112,8 @@ type Box struct {
 	Size float64
 }
 
+// Intersect reports if p is strictly inside the box, points on the faces are
+// not. Use ContainsPoint to assign points to nodes.
 func (b Box) Intersect(p Point) bool {
 	max := Point{b.Pos.X + b.Size, b.Pos.Y + b.Size, b.Pos.Z + b.Size}
 	if b.Pos.X < p.X && b.Pos.Y < p.Y && b.Pos.Z < p.Z {
@@ -121,3 +123,32 @@ func (b Box) Intersect(p Point) bool {
 	}
 	return false
 }
+
+// ContainsPoint reports if p is inside the half-open box, the min faces are
+// included and the max faces excluded. A point inside a box is contained in
+// exactly one of its children.
+func (b Box) ContainsPoint(p Point) bool {
+	return b.Pos.X <= p.X && p.X < b.Pos.X+b.Size &&
+		b.Pos.Y <= p.Y && p.Y < b.Pos.Y+b.Size &&
+		b.Pos.Z <= p.Z && p.Z < b.Pos.Z+b.Size
+}
+
+// containsClosed reports if p is inside the box or on any of its faces. This is
+// the rule for the bounds of a tree.
+func (b Box) containsClosed(p Point) bool {
+	return b.Pos.X <= p.X && p.X <= b.Pos.X+b.Size &&
+		b.Pos.Y <= p.Y && p.Y <= b.Pos.Y+b.Size &&
+		b.Pos.Z <= p.Z && p.Z <= b.Pos.Z+b.Size
+}
+
+func (b Box) IntersectBox(o Box) bool {
+	return b.Pos.X < o.Pos.X+o.Size && o.Pos.X < b.Pos.X+b.Size &&
+		b.Pos.Y < o.Pos.Y+o.Size && o.Pos.Y < b.Pos.Y+b.Size &&
+		b.Pos.Z < o.Pos.Z+o.Size && o.Pos.Z < b.Pos.Z+b.Size
+}
+
+func (b Box) Contains(o Box) bool {
+	return b.Pos.X <= o.Pos.X && o.Pos.X+o.Size <= b.Pos.X+b.Size &&
+		b.Pos.Y <= o.Pos.Y && o.Pos.Y+o.Size <= b.Pos.Y+b.Size &&
+		b.Pos.Z <= o.Pos.Z && o.Pos.Z+o.Size <= b.Pos.Z+b.Size
+}
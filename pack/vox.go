@@ -0,0 +1,505 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package pack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+const (
+	// maxVoxChunkSize limits the memory used for a single chunk of a .vox file.
+	maxVoxChunkSize = 1 << 28
+
+	// maxVoxModelSize is the largest model dimension accepted.
+	maxVoxModelSize = 2048
+)
+
+type (
+	// ErrVoxModelsSkipped is returned by ImportVox for files with more than one
+	// model. The first model is imported, Sizes holds the dimensions of the
+	// others in file order.
+	ErrVoxModelsSkipped struct {
+		Sizes [][3]int
+	}
+
+	voxModel struct {
+		size   [3]int
+		voxels []byte
+	}
+
+	voxNode struct {
+		sum      [4]float64
+		count    int
+		children [8]NodeIndex
+	}
+)
+
+func (e *ErrVoxModelsSkipped) Error() string {
+	models := make([]string, len(e.Sizes))
+	for i, s := range e.Sizes {
+		models[i] = fmt.Sprintf("%d (%dx%dx%d)", i+1, s[0], s[1], s[2])
+	}
+	return "imported the first model, skipped models " + strings.Join(models, ", ")
+}
+
+// ImportVox converts the first model of a MagicaVoxel .vox file to a tree. The
+// tree is the smallest power of two that contains the model, with every voxel of
+// unit size and the model in the lower corner. The z axis of the model, which is
+// up in MagicaVoxel, becomes Y. Palette formats use the palette of the file, which
+// must have an RGBA chunk. A *ErrVoxModelsSkipped is returned after the tree is
+// written if the file has more models.
+func ImportVox(r io.Reader, w io.WriteSeeker, format OctreeFormat) error {
+	models, palette, err := readVox(r)
+	if err != nil {
+		return err
+	}
+
+	model := &models[0]
+	vpa := 1
+	for _, s := range model.size {
+		for vpa < s {
+			vpa *= 2
+		}
+	}
+
+	nodes, numLeafs := buildVoxTree(model, palette, vpa)
+
+	header := NewOctreeHeader(format, vpa)
+	header.NumNodes = uint64(len(nodes))
+	header.NumLeafs = numLeafs
+	header.Bounds = Box{Point{0, 0, 0}, float64(vpa)}
+	if format.Paletted() {
+		header.Flags |= paletteMask
+	}
+
+	if err := EncodeHeader(w, header); err != nil {
+		return err
+	}
+	if format.Paletted() {
+		if err := EncodePalette(w, palette); err != nil {
+			return err
+		}
+	}
+
+	encoder := NewNodeEncoder(w, format, palette)
+	for i := range nodes {
+		n := &nodes[i]
+		c := Color{float32(n.sum[0] / float64(n.count)), float32(n.sum[1] / float64(n.count)), float32(n.sum[2] / float64(n.count)), float32(n.sum[3] / float64(n.count))}
+		if err := encoder.Encode(c, n.children[:]); err != nil {
+			return err
+		}
+	}
+
+	if len(models) > 1 {
+		skipped := &ErrVoxModelsSkipped{}
+		for _, m := range models[1:] {
+			skipped.Sizes = append(skipped.Sizes, m.size)
+		}
+		return skipped
+	}
+	return nil
+}
+
+// buildVoxTree returns the nodes of the tree in the order they were created, so
+// parents come before their children. Node colors are the sums of the voxels below
+// them. Later voxels replace earlier ones at the same position.
+func buildVoxTree(model *voxModel, palette Palette, vpa int) ([]voxNode, uint64) {
+	type voxel struct{ x, y, z int }
+	colors := make(map[voxel]byte)
+	var order []voxel
+
+	for i := 0; i+4 <= len(model.voxels); i += 4 {
+		v := model.voxels[i : i+4]
+		// The z axis of the model is up.
+		pos := voxel{int(v[0]), int(v[2]), int(v[1])}
+		if _, ok := colors[pos]; !ok {
+			order = append(order, pos)
+		}
+		colors[pos] = v[3]
+	}
+
+	nodes := []voxNode{{}}
+	var numLeafs uint64
+
+	for _, pos := range order {
+		c := palette[colors[pos]-1]
+		index := NodeIndex(0)
+
+		for size := vpa; ; size /= 2 {
+			n := &nodes[index]
+			n.sum[0] += float64(c.R)
+			n.sum[1] += float64(c.G)
+			n.sum[2] += float64(c.B)
+			n.sum[3] += float64(c.A)
+			n.count++
+
+			if size == 1 {
+				if n.count == 1 {
+					numLeafs++
+				}
+				break
+			}
+
+			half := size / 2
+			child := 0
+			if pos.x&half != 0 {
+				child |= 1
+			}
+			if pos.y&half != 0 {
+				child |= 2
+			}
+			if pos.z&half != 0 {
+				child |= 4
+			}
+
+			if n.children[child] == 0 {
+				n.children[child] = NodeIndex(len(nodes))
+				nodes = append(nodes, voxNode{})
+			}
+			index = nodes[index].children[child]
+		}
+	}
+
+	if numLeafs == 0 {
+		return nil, 0
+	}
+	return nodes, numLeafs
+}
+
+// readVox reads the models and the palette of a .vox file. The palette holds the
+// colors of the voxel color indices 1 to 255, at entries 0 to 254.
+func readVox(r io.Reader) ([]voxModel, Palette, error) {
+	var magic [8]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, nil, err
+	}
+	if string(magic[:4]) != "VOX " {
+		return nil, nil, ErrBadMagic
+	}
+
+	id, content, childrenSize, err := readVoxChunk(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if id != "MAIN" || len(content) != 0 {
+		return nil, nil, errInvalidVoxFile
+	}
+
+	var (
+		models  []voxModel
+		palette Palette
+		size    *[3]int
+	)
+
+	children := io.LimitReader(r, int64(childrenSize))
+	for {
+		id, content, childrenSize, err := readVoxChunk(children)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		// Scene graph, material and other chunks are skipped, as are their
+		// children.
+		if _, err := io.CopyN(ioutil.Discard, children, int64(childrenSize)); err != nil {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+
+		switch id {
+		case "SIZE":
+			if len(content) < 12 {
+				return nil, nil, errInvalidVoxFile
+			}
+			var s [3]int
+			for i := range s {
+				s[i] = int(int32(binary.LittleEndian.Uint32(content[i*4:])))
+				if s[i] <= 0 || s[i] > maxVoxModelSize {
+					return nil, nil, errInvalidVoxFile
+				}
+			}
+			size = &s
+		case "XYZI":
+			if size == nil || len(content) < 4 {
+				return nil, nil, errInvalidVoxFile
+			}
+			num := binary.LittleEndian.Uint32(content)
+			voxels := content[4:]
+			if uint64(num)*4 > uint64(len(voxels)) {
+				return nil, nil, errInvalidVoxFile
+			}
+			voxels = voxels[:num*4]
+
+			for i := 0; i < len(voxels); i += 4 {
+				if int(voxels[i]) >= size[0] || int(voxels[i+1]) >= size[1] || int(voxels[i+2]) >= size[2] || voxels[i+3] == 0 {
+					return nil, nil, errInvalidVoxFile
+				}
+			}
+			models = append(models, voxModel{*size, voxels})
+			size = nil
+		case "RGBA":
+			if len(content) < 4*255 {
+				return nil, nil, errInvalidVoxFile
+			}
+			palette = make(Palette, 255)
+			for i := range palette {
+				c := content[i*4:]
+				palette[i] = Color{float32(c[0]) / 255, float32(c[1]) / 255, float32(c[2]) / 255, float32(c[3]) / 255}
+			}
+		}
+	}
+
+	if len(models) == 0 {
+		return nil, nil, errInvalidVoxFile
+	}
+	if palette == nil {
+		return nil, nil, errMissingPalette
+	}
+	return models, palette, nil
+}
+
+// readVoxChunk reads the id and content of a chunk, leaving r at its children.
+func readVoxChunk(r io.Reader) (string, []byte, uint32, error) {
+	var head [12]byte
+	if n, err := io.ReadFull(r, head[:]); err != nil {
+		if n > 0 {
+			return "", nil, 0, io.ErrUnexpectedEOF
+		}
+		return "", nil, 0, err
+	}
+
+	contentSize := binary.LittleEndian.Uint32(head[4:])
+	childrenSize := binary.LittleEndian.Uint32(head[8:])
+	if contentSize > maxVoxChunkSize {
+		return "", nil, 0, errInvalidVoxFile
+	}
+
+	content := make([]byte, contentSize)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return "", nil, 0, io.ErrUnexpectedEOF
+	}
+	return string(head[:4]), content, childrenSize, nil
+}
+
+// maxVoxDepth is the deepest level that fits in a model, MagicaVoxel models are at
+// most 256 voxels per axis.
+const maxVoxDepth = 8
+
+type voxColorBox [][4]byte
+
+// ExportVox writes the leafs of a tree as a single MagicaVoxel model, with the
+// tree cut at maxDepth. Nodes at maxDepth are written with their average color and
+// leafs above it fill all voxels they cover. The colors are reduced to the 255
+// entries of a .vox palette with median cut. Y of the tree becomes the z axis of
+// the model, which is up in MagicaVoxel.
+func ExportVox(r io.ReadSeeker, w io.Writer, maxDepth int) error {
+	data, err := decodeTree(r)
+	if err != nil {
+		return err
+	}
+
+	type item struct {
+		index NodeIndex
+		cell  meshCell
+	}
+
+	var (
+		leafs []item
+		depth int
+		stack []item
+	)
+
+	if len(data.Colors) > 0 {
+		stack = append(stack, item{0, meshCell{}})
+	}
+
+	for len(stack) > 0 {
+		n := len(stack) - 1
+		it := stack[n]
+		stack = stack[:n]
+
+		if it.cell.depth > maxDiffDepth {
+			return errInvalidFile
+		}
+
+		leaf := true
+		if it.cell.depth < maxDepth {
+			for i, child := range data.Children[it.index] {
+				if child == 0 {
+					continue
+				}
+
+				leaf = false
+				p := childPositions[i]
+				c := meshCell{it.cell.depth + 1, it.cell.x*2 + int64(p.X), it.cell.y*2 + int64(p.Y), it.cell.z*2 + int64(p.Z)}
+				stack = append(stack, item{child, c})
+			}
+		}
+
+		if leaf {
+			leafs = append(leafs, it)
+			if it.cell.depth > depth {
+				depth = it.cell.depth
+			}
+		}
+	}
+
+	if depth > maxVoxDepth {
+		return fmt.Errorf("tree is %d voxels per axis at depth %d, .vox models are at most %d, use a depth of %d or lower", 1<<uint(depth), depth, 1<<maxVoxDepth, maxVoxDepth)
+	}
+
+	colors := make([][4]byte, len(leafs))
+	for i, it := range leafs {
+		c := data.Colors[it.index]
+		colors[i] = [4]byte{byte(c.R*255 + 0.5), byte(c.G*255 + 0.5), byte(c.B*255 + 0.5), byte(c.A*255 + 0.5)}
+	}
+	palette, lookup := medianCut(colors, 255)
+
+	var (
+		voxels []byte
+		size   = [3]int32{1, 1, 1}
+	)
+
+	for i, it := range leafs {
+		scale := int64(1) << uint(depth-it.cell.depth)
+		x0, y0, z0 := it.cell.x*scale, it.cell.y*scale, it.cell.z*scale
+
+		for x := x0; x < x0+scale; x++ {
+			for y := y0; y < y0+scale; y++ {
+				for z := z0; z < z0+scale; z++ {
+					// The z axis of the model is up.
+					voxels = append(voxels, byte(x), byte(z), byte(y), lookup[colors[i]]+1)
+				}
+			}
+		}
+
+		end := [3]int32{int32(x0 + scale), int32(z0 + scale), int32(y0 + scale)}
+		for j := range size {
+			if end[j] > size[j] {
+				size[j] = end[j]
+			}
+		}
+	}
+
+	var rgba [256][4]byte
+	copy(rgba[:], palette)
+
+	write := func(v ...interface{}) error {
+		for _, d := range v {
+			if err := binary.Write(w, binary.LittleEndian, d); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	xyziSize := 4 + len(voxels)
+	childrenSize := 3*12 + 12 + xyziSize + len(rgba)*4
+
+	if err := write([]byte("VOX "), int32(150), []byte("MAIN"), uint32(0), uint32(childrenSize)); err != nil {
+		return err
+	}
+	if err := write([]byte("SIZE"), uint32(12), uint32(0), size); err != nil {
+		return err
+	}
+	if err := write([]byte("XYZI"), uint32(xyziSize), uint32(0), uint32(len(voxels)/4), voxels); err != nil {
+		return err
+	}
+	return write([]byte("RGBA"), uint32(len(rgba)*4), uint32(0), rgba)
+}
+
+// medianCut reduces colors to at most n, by splitting the box with the widest
+// channel at the median until there are n boxes. It returns the average color of
+// each box and the box of every input color.
+func medianCut(colors [][4]byte, n int) ([][4]byte, map[[4]byte]byte) {
+	unique := make(map[[4]byte]bool)
+	var box voxColorBox
+	for _, c := range colors {
+		if !unique[c] {
+			unique[c] = true
+			box = append(box, c)
+		}
+	}
+
+	var boxes []voxColorBox
+	if len(box) > 0 {
+		boxes = append(boxes, box)
+	}
+
+	for len(boxes) < n {
+		best, bestChannel, bestRange := -1, 0, 0
+		for i, b := range boxes {
+			if len(b) < 2 {
+				continue
+			}
+			if channel, r := b.widest(); r > bestRange {
+				best, bestChannel, bestRange = i, channel, r
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		b := boxes[best]
+		sort.Slice(b, func(i, j int) bool { return b[i][bestChannel] < b[j][bestChannel] })
+		mid := len(b) / 2
+		boxes[best] = b[:mid]
+		boxes = append(boxes, b[mid:])
+	}
+
+	palette := make([][4]byte, len(boxes))
+	lookup := make(map[[4]byte]byte)
+
+	for i, b := range boxes {
+		var sum [4]int
+		for _, c := range b {
+			lookup[c] = byte(i)
+			for j := range sum {
+				sum[j] += int(c[j])
+			}
+		}
+		for j := range sum {
+			palette[i][j] = byte((sum[j] + len(b)/2) / len(b))
+		}
+	}
+	return palette, lookup
+}
+
+// widest returns the channel with the largest range of values and that range.
+func (b voxColorBox) widest() (int, int) {
+	var channel, width int
+	for j := 0; j < 4; j++ {
+		min, max := 255, 0
+		for _, c := range b {
+			if v := int(c[j]); v < min {
+				min = v
+			}
+			if v := int(c[j]); v > max {
+				max = v
+			}
+		}
+		if max-min > width {
+			channel, width = j, max-min
+		}
+	}
+	return channel, width
+}
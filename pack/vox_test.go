@@ -0,0 +1,293 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package pack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func voxChunk(id string, content []byte, children ...[]byte) []byte {
+	var child []byte
+	for _, c := range children {
+		child = append(child, c...)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(id)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(content)))
+	binary.Write(&buf, binary.LittleEndian, uint32(len(child)))
+	buf.Write(content)
+	buf.Write(child)
+	return buf.Bytes()
+}
+
+func voxModelChunks(size [3]uint32, voxels ...[4]byte) [][]byte {
+	var sizeData, xyzi bytes.Buffer
+	binary.Write(&sizeData, binary.LittleEndian, size)
+	binary.Write(&xyzi, binary.LittleEndian, uint32(len(voxels)))
+	binary.Write(&xyzi, binary.LittleEndian, voxels)
+	return [][]byte{voxChunk("SIZE", sizeData.Bytes()), voxChunk("XYZI", xyzi.Bytes())}
+}
+
+func voxFile(models ...[][]byte) []byte {
+	palette := make([]byte, 256*4)
+	for i := 0; i < 256; i++ {
+		copy(palette[i*4:], []byte{byte(i), 255 - byte(i), 0, 255})
+	}
+
+	var children [][]byte
+	for _, m := range models {
+		children = append(children, m...)
+	}
+	children = append(children, voxChunk("RGBA", palette))
+
+	data := []byte("VOX \x96\x00\x00\x00")
+	return append(data, voxChunk("MAIN", nil, children...)...)
+}
+
+func importVox(data []byte, format OctreeFormat) (*os.File, error) {
+	out, err := ioutil.TempFile("", "")
+	if err != nil {
+		panic(err)
+	}
+	err = ImportVox(bytes.NewReader(data), out, format)
+	out.Seek(0, 0)
+	return out, err
+}
+
+func TestImportVox(t *testing.T) {
+	data := voxFile(voxModelChunks([3]uint32{3, 2, 1}, [4]byte{0, 0, 0, 1}, [4]byte{2, 1, 0, 200}))
+
+	out, err := importVox(data, MipR8G8B8A8UnpackUI32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		out.Close()
+		os.Remove(out.Name())
+	}()
+
+	var header OctreeHeader
+	if err := DecodeHeader(out, &header); err != nil {
+		panic(err)
+	}
+	if header.VoxelsPerAxis != 4 || header.NumLeafs != 2 {
+		t.Errorf("unexpected header: %+v", header)
+	}
+
+	bounds := Box{Point{0, 0, 0}, 4}
+	if header.Bounds != bounds {
+		t.Errorf("bounds: %v != %v", header.Bounds, bounds)
+	}
+
+	leafs := make(map[Box]Color)
+	collectLeafs(out, &header, 0, bounds, bounds, leafs)
+
+	// Color index i is palette entry i-1 and the model z axis is up.
+	expected := map[Box]Color{
+		Box{Point{0, 0, 0}, 1}: Color{0, 1, 0, 1},
+		Box{Point{2, 0, 1}, 1}: Color{199.0 / 255, 56.0 / 255, 0, 1},
+	}
+	if len(leafs) != len(expected) {
+		t.Fatalf("unexpected leafs: %v", leafs)
+	}
+	for b, c := range expected {
+		if leafs[b] != c {
+			t.Errorf("leaf %v: %v != %v", b, leafs[b], c)
+		}
+	}
+}
+
+func TestImportVoxPalette(t *testing.T) {
+	data := voxFile(voxModelChunks([3]uint32{1, 1, 1}, [4]byte{0, 0, 0, 5}))
+
+	out, err := importVox(data, MipP8UnpackUI16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		out.Close()
+		os.Remove(out.Name())
+	}()
+
+	var header OctreeHeader
+	if err := DecodeHeader(out, &header); err != nil {
+		panic(err)
+	}
+	palette, err := DecodePalette(out, &header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(palette) != 255 || palette[4] != (Color{4.0 / 255, 251.0 / 255, 0, 1}) {
+		t.Errorf("unexpected palette: %v", palette[:5])
+	}
+
+	var (
+		color    Color
+		children [8]NodeIndex
+	)
+	if err := DecodeNode(out, header.Format, &color, children[:]); err != errMissingPalette {
+		t.Error("expected the node to need the palette:", err)
+	}
+}
+
+func TestImportVoxModels(t *testing.T) {
+	data := voxFile(
+		voxModelChunks([3]uint32{1, 1, 1}, [4]byte{0, 0, 0, 1}),
+		voxModelChunks([3]uint32{8, 2, 3}, [4]byte{7, 1, 2, 1}),
+		voxModelChunks([3]uint32{2, 2, 2}),
+	)
+
+	out, err := importVox(data, MipR8G8B8A8UnpackUI16)
+	defer func() {
+		out.Close()
+		os.Remove(out.Name())
+	}()
+
+	skipped, ok := err.(*ErrVoxModelsSkipped)
+	if !ok {
+		t.Fatal("expected skipped models:", err)
+	}
+	if len(skipped.Sizes) != 2 || skipped.Sizes[0] != [3]int{8, 2, 3} || skipped.Sizes[1] != [3]int{2, 2, 2} {
+		t.Errorf("unexpected sizes: %v", skipped.Sizes)
+	}
+
+	var header OctreeHeader
+	if err := DecodeHeader(out, &header); err != nil {
+		panic(err)
+	}
+	if header.VoxelsPerAxis != 1 || header.NumNodes != 1 {
+		t.Errorf("unexpected header: %+v", header)
+	}
+}
+
+func TestImportVoxInvalid(t *testing.T) {
+	valid := voxFile(voxModelChunks([3]uint32{2, 2, 2}, [4]byte{1, 1, 1, 1}))
+	outside := voxFile(voxModelChunks([3]uint32{2, 2, 2}, [4]byte{2, 1, 1, 1}))
+
+	for _, data := range [][]byte{[]byte("VOY "), outside, valid[:len(valid)-10]} {
+		out, err := importVox(data, MipR8G8B8A8UnpackUI32)
+		out.Close()
+		os.Remove(out.Name())
+
+		if err == nil {
+			t.Error("expected an error")
+		}
+	}
+}
+
+func voxLeafs(file *os.File) map[Box]Color {
+	var header OctreeHeader
+	if err := DecodeHeader(file, &header); err != nil {
+		panic(err)
+	}
+
+	leafs := make(map[Box]Color)
+	collectLeafs(file, &header, 0, header.Bounds, header.Bounds, leafs)
+	return leafs
+}
+
+func TestExportVox(t *testing.T) {
+	data := voxFile(voxModelChunks([3]uint32{5, 3, 7},
+		[4]byte{0, 0, 0, 1}, [4]byte{4, 2, 6, 20}, [4]byte{1, 2, 3, 255}, [4]byte{3, 0, 5, 20}))
+
+	in, err := importVox(data, MipR8G8B8A8UnpackUI32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		in.Close()
+		os.Remove(in.Name())
+	}()
+
+	var exported bytes.Buffer
+	if err := ExportVox(in, &exported, 8); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := importVox(exported.Bytes(), MipR8G8B8A8UnpackUI32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		out.Close()
+		os.Remove(out.Name())
+	}()
+
+	in.Seek(0, 0)
+	a, b := voxLeafs(in), voxLeafs(out)
+	if len(a) != 4 || len(a) != len(b) {
+		t.Fatalf("unexpected leafs: %v, %v", a, b)
+	}
+	for box, c := range a {
+		if b[box] != c {
+			t.Errorf("leaf %v: %v != %v", box, b[box], c)
+		}
+	}
+}
+
+func TestExportVoxDepth(t *testing.T) {
+	data := voxFile(voxModelChunks([3]uint32{512, 1, 1}, [4]byte{0, 0, 0, 1}, [4]byte{255, 0, 0, 2}))
+
+	in, err := importVox(data, MipR8G8B8A8UnpackUI32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		in.Close()
+		os.Remove(in.Name())
+	}()
+
+	if err := ExportVox(in, ioutil.Discard, 9); err == nil {
+		t.Error("expected the tree to be too large")
+	}
+
+	in.Seek(0, 0)
+	if err := ExportVox(in, ioutil.Discard, 8); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMedianCut(t *testing.T) {
+	var colors [][4]byte
+	for i := 0; i < 1000; i++ {
+		colors = append(colors, [4]byte{byte(i), byte(i / 4), byte(i * 7), 255})
+	}
+
+	palette, lookup := medianCut(colors, 255)
+	if len(palette) != 255 {
+		t.Fatalf("unexpected palette size: %v", len(palette))
+	}
+
+	for _, c := range colors {
+		p := palette[lookup[c]]
+		for j := range c {
+			if d := int(c[j]) - int(p[j]); d < -32 || d > 32 {
+				t.Errorf("%v is far from %v", c, p)
+			}
+		}
+	}
+
+	palette, _ = medianCut(colors[:10], 255)
+	if len(palette) != 10 {
+		t.Errorf("expected exact colors: %v", palette)
+	}
+}
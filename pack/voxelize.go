@@ -0,0 +1,330 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const bvhLeafSize = 4
+
+type (
+	meshTriangle struct {
+		vertices [3][3]float64
+		color    Color
+	}
+
+	bvhNode struct {
+		min, max     [3]float64
+		left, right  int32
+		start, count int32
+	}
+
+	// MeshWorker voxelizes a triangle mesh. Pass Work as the Worker and Bounds as the
+	// Bounds of a BuildConfig with VoxelsPerAxis set to the same resolution.
+	MeshWorker struct {
+		// Color is used for meshes without vertex colors.
+		Color Color
+
+		path       string
+		triangles  []meshTriangle
+		order      []int32
+		nodes      []bvhNode
+		bounds     Box
+		resolution int
+		hasColor   bool
+	}
+)
+
+// NewMeshWorker loads an OBJ or PLY triangle mesh. The bounds are the smallest
+// cube, aligned to the lower corner of the mesh, that contains all triangles.
+func NewMeshWorker(path string, resolution int) (*MeshWorker, error) {
+	if resolution <= 0 || (resolution&(resolution-1)) != 0 {
+		return nil, errVoxelsPowerOfTwo
+	}
+
+	load := loadOBJ
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".obj":
+	case ".ply":
+		load = loadPLY
+	default:
+		return nil, errInvalidMeshFormat
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	vertices, triangles, err := load(fp)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &MeshWorker{Color: Color{1, 1, 1, 1}, path: path, resolution: resolution}
+	for _, v := range vertices {
+		if v.hasColor {
+			w.hasColor = true
+			break
+		}
+	}
+
+	min := [3]float64{math.MaxFloat64, math.MaxFloat64, math.MaxFloat64}
+	max := [3]float64{-math.MaxFloat64, -math.MaxFloat64, -math.MaxFloat64}
+
+	for _, t := range triangles {
+		var tri meshTriangle
+		for i, idx := range t {
+			v := &vertices[idx]
+			tri.vertices[i] = v.pos
+
+			tri.color.R += v.col.R / 3
+			tri.color.G += v.col.G / 3
+			tri.color.B += v.col.B / 3
+
+			for axis := range min {
+				min[axis] = math.Min(min[axis], v.pos[axis])
+				max[axis] = math.Max(max[axis], v.pos[axis])
+			}
+		}
+
+		tri.color.A = 1
+		w.triangles = append(w.triangles, tri)
+	}
+
+	if len(w.triangles) == 0 {
+		return nil, errInvalidMesh
+	}
+
+	size := math.Max(max[0]-min[0], math.Max(max[1]-min[1], max[2]-min[2]))
+	if size == 0 {
+		size = 1
+	}
+
+	w.bounds = Box{Point{min[0], min[1], min[2]}, size}
+	w.buildBVH()
+	return w, nil
+}
+
+func (w *MeshWorker) Bounds() Box {
+	return w.bounds
+}
+
+// Generation changes when the mesh file does. Pass the worker as the Source of a
+// BuildConfig to detect a mesh that is rewritten during the build.
+func (w *MeshWorker) Generation() uint64 {
+	return FileSource{w.path}.Generation()
+}
+
+func (t *meshTriangle) centroid(axis int) float64 {
+	return (t.vertices[0][axis] + t.vertices[1][axis] + t.vertices[2][axis]) / 3
+}
+
+func (w *MeshWorker) buildBVH() {
+	w.order = make([]int32, len(w.triangles))
+	for i := range w.order {
+		w.order[i] = int32(i)
+	}
+	w.nodes = w.nodes[:0]
+	w.buildNode(0, int32(len(w.order)))
+}
+
+func (w *MeshWorker) buildNode(start, end int32) int32 {
+	node := bvhNode{
+		min:   [3]float64{math.MaxFloat64, math.MaxFloat64, math.MaxFloat64},
+		max:   [3]float64{-math.MaxFloat64, -math.MaxFloat64, -math.MaxFloat64},
+		left:  -1,
+		right: -1,
+		start: start,
+		count: end - start,
+	}
+
+	for _, idx := range w.order[start:end] {
+		for _, v := range w.triangles[idx].vertices {
+			for axis := range v {
+				node.min[axis] = math.Min(node.min[axis], v[axis])
+				node.max[axis] = math.Max(node.max[axis], v[axis])
+			}
+		}
+	}
+
+	index := int32(len(w.nodes))
+	w.nodes = append(w.nodes, node)
+
+	if node.count <= bvhLeafSize {
+		return index
+	}
+
+	// Split at the median of the longest axis.
+	axis := 0
+	for i := 1; i < 3; i++ {
+		if node.max[i]-node.min[i] > node.max[axis]-node.min[axis] {
+			axis = i
+		}
+	}
+
+	order := w.order[start:end]
+	sort.Slice(order, func(i, j int) bool {
+		return w.triangles[order[i]].centroid(axis) < w.triangles[order[j]].centroid(axis)
+	})
+
+	mid := start + node.count/2
+	left := w.buildNode(start, mid)
+	right := w.buildNode(mid, end)
+
+	w.nodes[index].left = left
+	w.nodes[index].right = right
+	w.nodes[index].count = 0
+	return index
+}
+
+// query calls fn for all triangles overlapping the box. Iteration stops when fn
+// returns true, in which case query returns true as well.
+func (w *MeshWorker) query(center, half [3]float64, fn func(t *meshTriangle) bool) bool {
+	stack := []int32{0}
+	for len(stack) > 0 {
+		n := len(stack) - 1
+		node := &w.nodes[stack[n]]
+		stack = stack[:n]
+
+		outside := false
+		for axis := range center {
+			if node.min[axis] > center[axis]+half[axis] || node.max[axis] < center[axis]-half[axis] {
+				outside = true
+				break
+			}
+		}
+
+		if outside {
+			continue
+		}
+
+		if node.left >= 0 {
+			stack = append(stack, node.left, node.right)
+			continue
+		}
+
+		for _, idx := range w.order[node.start : node.start+node.count] {
+			t := &w.triangles[idx]
+			if triangleOverlapsBox(center, half, &t.vertices) && fn(t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func cross(a, b [3]float64) [3]float64 {
+	return [3]float64{a[1]*b[2] - a[2]*b[1], a[2]*b[0] - a[0]*b[2], a[0]*b[1] - a[1]*b[0]}
+}
+
+func dot(a, b [3]float64) float64 {
+	return a[0]*b[0] + a[1]*b[1] + a[2]*b[2]
+}
+
+func sub(a, b [3]float64) [3]float64 {
+	return [3]float64{a[0] - b[0], a[1] - b[1], a[2] - b[2]}
+}
+
+// separated reports if the projections of the triangle and the box onto axis are disjoint.
+func separated(axis, half [3]float64, v *[3][3]float64) bool {
+	p0, p1, p2 := dot(axis, v[0]), dot(axis, v[1]), dot(axis, v[2])
+	r := half[0]*math.Abs(axis[0]) + half[1]*math.Abs(axis[1]) + half[2]*math.Abs(axis[2])
+	return math.Min(p0, math.Min(p1, p2)) > r || math.Max(p0, math.Max(p1, p2)) < -r
+}
+
+// triangleOverlapsBox is the separating axis test by Akenine-Möller. Touching counts
+// as overlapping so the voxelization is conservative.
+func triangleOverlapsBox(center, half [3]float64, tri *[3][3]float64) bool {
+	v := [3][3]float64{sub(tri[0], center), sub(tri[1], center), sub(tri[2], center)}
+	edges := [3][3]float64{sub(v[1], v[0]), sub(v[2], v[1]), sub(v[0], v[2])}
+	units := [3][3]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+
+	for _, u := range units {
+		if separated(u, half, &v) {
+			return false
+		}
+	}
+
+	for _, e := range edges {
+		for _, u := range units {
+			if separated(cross(u, e), half, &v) {
+				return false
+			}
+		}
+	}
+
+	return !separated(cross(edges[0], edges[1]), half, &v)
+}
+
+// Work emits a sample at the center of every voxel that overlaps a triangle. Cells
+// without triangles are skipped as a whole.
+func (w *MeshWorker) Work(samples chan<- Sample) error {
+	w.voxelize(samples, w.bounds.Pos, w.bounds.Size, 1)
+	return nil
+}
+
+func (w *MeshWorker) voxelize(samples chan<- Sample, pos Point, size float64, cells int) {
+	h := size * 0.5
+	center := [3]float64{pos.X + h, pos.Y + h, pos.Z + h}
+	half := [3]float64{h, h, h}
+
+	if cells < w.resolution {
+		found := w.query(center, half, func(t *meshTriangle) bool {
+			return true
+		})
+
+		if found {
+			for _, p := range childPositions {
+				offset := p.scale(h)
+				w.voxelize(samples, pos.add(&offset), h, cells*2)
+			}
+		}
+		return
+	}
+
+	var (
+		col Color
+		n   float32
+	)
+
+	w.query(center, half, func(t *meshTriangle) bool {
+		col.R += t.color.R
+		col.G += t.color.G
+		col.B += t.color.B
+		n++
+		return false
+	})
+
+	if n == 0 {
+		return
+	}
+
+	if w.hasColor {
+		col = Color{col.R / n, col.G / n, col.B / n, 1}
+	} else {
+		col = w.Color
+	}
+	samples <- Sample{Point{center[0], center[1], center[2]}, col}
+}
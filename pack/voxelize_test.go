@@ -0,0 +1,142 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const unitCubeOBJ = `v 0 0 0
+v 1 0 0
+v 0 1 0
+v 1 1 0
+v 0 0 1
+v 1 0 1
+v 0 1 1
+v 1 1 1
+f 1 3 4 2
+f 5 6 8 7
+f 1 2 6 5
+f 3 7 8 4
+f 1 5 7 3
+f 2 4 8 6
+`
+
+func voxelizeMesh(path string, resolution int) (OctreeHeader, []byte) {
+	worker, err := NewMeshWorker(path, resolution)
+	if err != nil {
+		panic(err)
+	}
+
+	var buffer bytes.Buffer
+	cfg := BuildConfig{
+		Worker:        worker.Work,
+		Writer:        &buffer,
+		Bounds:        worker.Bounds(),
+		VoxelsPerAxis: resolution,
+		Format:        MipR8G8B8A8UnpackUI32,
+	}
+
+	if _, err := BuildTree(&cfg); err != nil {
+		panic(err)
+	}
+
+	var header OctreeHeader
+	if err := DecodeHeader(bytes.NewReader(buffer.Bytes()), &header); err != nil {
+		panic(err)
+	}
+	return header, buffer.Bytes()
+}
+
+func TestVoxelizeOBJ(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cube.obj")
+	if err := ioutil.WriteFile(path, []byte(unitCubeOBJ), 0644); err != nil {
+		panic(err)
+	}
+
+	// Only the shell of the cube is voxelized.
+	for resolution, numLeafs := range map[int]uint64{1: 1, 2: 8, 4: 56, 8: 296} {
+		if header, _ := voxelizeMesh(path, resolution); header.NumLeafs != numLeafs {
+			t.Errorf("expected %v leafs at resolution %v, got %v", numLeafs, resolution, header.NumLeafs)
+		}
+	}
+}
+
+func TestVoxelizePLY(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mesh bytes.Buffer
+	if err := ExportMesh(bytes.NewReader(solidTree()), &mesh, PLYMesh, -1); err != nil {
+		panic(err)
+	}
+
+	path := filepath.Join(dir, "cube.ply")
+	if err := ioutil.WriteFile(path, mesh.Bytes(), 0644); err != nil {
+		panic(err)
+	}
+
+	header, tree := voxelizeMesh(path, 2)
+	if header.NumLeafs != 8 {
+		t.Fatalf("expected 8 leafs, got %v", header.NumLeafs)
+	}
+
+	var (
+		color    Color
+		children [8]NodeIndex
+	)
+
+	reader := bytes.NewReader(tree)
+	if err := readNodeAt(reader, &header, 1, &color, children[:]); err != nil {
+		panic(err)
+	}
+
+	if color.R != 1 || color.G != 0 || color.B != 0 {
+		t.Errorf("expected vertex color, got %v", color)
+	}
+}
+
+func TestTriangleOverlapsBox(t *testing.T) {
+	tri := [3][3]float64{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}}
+	half := [3]float64{0.1, 0.1, 0.1}
+
+	if !triangleOverlapsBox([3]float64{0.2, 0.2, 0}, half, &tri) {
+		t.Error("expected overlap")
+	}
+
+	if triangleOverlapsBox([3]float64{0.8, 0.8, 0}, half, &tri) {
+		t.Error("box beyond the hypotenuse should not overlap")
+	}
+
+	if triangleOverlapsBox([3]float64{0.2, 0.2, 0.5}, half, &tri) {
+		t.Error("box above the plane should not overlap")
+	}
+}
@@ -0,0 +1,204 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"compress/zlib"
+	"io"
+)
+
+// WasteReport describes the nodes of a tree that can not be reached from the root.
+// Such nodes are left behind by aborted and resumed builds and only inflate the file.
+type WasteReport struct {
+	NumNodes    uint64
+	Reachable   uint64
+	Unreachable uint64
+
+	// Shared counts reachable nodes referenced by more than one parent. Shared
+	// nodes are reachable, they are stored once and kept by CompactFile.
+	Shared uint64
+
+	// WastedBytes is the encoded size of the unreachable nodes. For compressed
+	// trees it is the size before compression.
+	WastedBytes uint64
+}
+
+// byteCounter is a writer that only counts the bytes written to it.
+type byteCounter uint64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// markReachable marks the nodes reachable from the root and counts the parents
+// referencing each of them.
+func markReachable(children [][8]NodeIndex) ([]bool, []uint32) {
+	reachable := make([]bool, len(children))
+	refs := make([]uint32, len(children))
+	if len(children) == 0 {
+		return reachable, refs
+	}
+
+	reachable[0] = true
+	for stack := []NodeIndex{0}; len(stack) > 0; {
+		n := len(stack) - 1
+		idx := stack[n]
+		stack = stack[:n]
+
+		for _, child := range children[idx] {
+			if child == 0 {
+				continue
+			}
+
+			refs[child]++
+			if !reachable[child] {
+				reachable[child] = true
+				stack = append(stack, child)
+			}
+		}
+	}
+	return reachable, refs
+}
+
+// analyzeWaste computes the waste report of a decoded tree.
+func analyzeWaste(data *FrameData, palette Palette, reachable []bool, refs []uint32) (WasteReport, error) {
+	report := WasteReport{NumNodes: data.Header.NumNodes}
+	for i, r := range reachable {
+		if r {
+			report.Reachable++
+			if refs[i] > 1 {
+				report.Shared++
+			}
+		}
+	}
+	report.Unreachable = report.NumNodes - report.Reachable
+
+	format := data.Header.Format
+	if format.FixedSize() || report.Unreachable == 0 {
+		report.WastedBytes = report.Unreachable * uint64(format.NodeSize())
+		return report, nil
+	}
+
+	// The size of variable sized nodes depends on their index and parent, so the
+	// nodes are encoded again to measure them.
+	var counter byteCounter
+	encoder := NewNodeEncoder(&counter, format, palette)
+	for i := range data.Colors {
+		before := counter
+		if err := encoder.Encode(data.Colors[i], data.Children[i][:]); err != nil {
+			return report, err
+		}
+
+		if !reachable[i] {
+			report.WastedBytes += uint64(counter - before)
+		}
+	}
+	return report, nil
+}
+
+// AnalyzeWaste reads a tree and reports the nodes that are not reachable from the
+// root, and the bytes they use.
+func AnalyzeWaste(reader io.Reader) (WasteReport, error) {
+	data, palette, err := decodeTreePalette(reader)
+	if err != nil {
+		return WasteReport{}, err
+	}
+
+	reachable, refs := markReachable(data.Children)
+	return analyzeWaste(data, palette, reachable, refs)
+}
+
+// CompactFile rewrites a tree without the nodes that are not reachable from the root.
+// Unlike ReorderTree the remaining nodes keep their order, format, palette and
+// compression. The report describes the input tree.
+func CompactFile(in io.Reader, out io.Writer) (WasteReport, error) {
+	data, palette, err := decodeTreePalette(in)
+	if err != nil {
+		return WasteReport{}, err
+	}
+
+	reachable, refs := markReachable(data.Children)
+	report, err := analyzeWaste(data, palette, reachable, refs)
+	if err != nil {
+		return report, err
+	}
+
+	remap := make([]NodeIndex, len(reachable))
+	header := data.Header
+	header.NumNodes = 0
+	header.NumLeafs = 0
+
+	for i, r := range reachable {
+		if !r {
+			continue
+		}
+
+		remap[i] = NodeIndex(header.NumNodes)
+		header.NumNodes++
+
+		if data.Children[i] == [8]NodeIndex{} {
+			header.NumLeafs++
+		}
+	}
+
+	if err := EncodeHeader(out, header); err != nil {
+		return report, err
+	}
+
+	if header.Paletted() {
+		if err := EncodePalette(out, palette); err != nil {
+			return report, err
+		}
+	}
+
+	writer := out
+	if header.Compressed() == true {
+		writeCloser := zlib.NewWriter(writer)
+		defer writeCloser.Close()
+		writer = writeCloser
+	}
+
+	var checkedWriter *ChecksumWriter
+	if header.Checksummed() {
+		checkedWriter = NewChecksumWriter(writer)
+		writer = checkedWriter
+	}
+
+	var ch [8]NodeIndex
+	encoder := NewNodeEncoder(writer, header.Format, palette)
+
+	for i, r := range reachable {
+		if !r {
+			continue
+		}
+
+		for j, child := range data.Children[i] {
+			ch[j] = remap[child]
+		}
+
+		if err := encoder.Encode(data.Colors[i], ch[:]); err != nil {
+			return report, err
+		}
+	}
+
+	if checkedWriter != nil {
+		return report, checkedWriter.WriteTrailer()
+	}
+	return report, nil
+}
@@ -0,0 +1,84 @@
+/*
+Copyright (C) 2015-2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pack
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Nodes 3 and 6 are orphans left by an aborted build, node 6 references the
+// reachable node 5. Node 5 is shared by node 2 and node 4.
+const orphanText = `
+voxels 4
+node 0 color #808080ff children 0 4 0 0 0 2 0 0
+node 1 color #0000ffff children 0 0 0 0 0 0 0 0
+node 2 color #ff0000ff children 5 0 0 0 0 1 0 0
+node 3 color #00ff0080 children 0 0 0 0 0 0 0 0
+node 4 color #404040ff children 5 0 0 0 0 0 0 0
+node 5 color #ffff00ff children 0 0 0 0 0 0 0 0
+node 6 color #00ffffff children 0 5 0 0 0 0 0 0
+`
+
+func TestCompactFile(t *testing.T) {
+	for _, format := range []OctreeFormat{MipR8G8B8A8UnpackUI32, MipR8G8B8A8RelativeUI16, MipR8G8B8A8DeltaUI32} {
+		var tree bytes.Buffer
+		if err := ParseText(strings.NewReader(orphanText), &tree, format); err != nil {
+			panic(err)
+		}
+
+		report, err := AnalyzeWaste(bytes.NewReader(tree.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.NumNodes != 7 || report.Reachable != 5 || report.Unreachable != 2 || report.Shared != 1 {
+			t.Errorf("format %d: unexpected report %+v", format, report)
+		}
+		if report.WastedBytes < 2*uint64(format.MinNodeSize()) || report.WastedBytes > 2*uint64(format.NodeSize()) {
+			t.Errorf("format %d: %d wasted bytes is not the size of two nodes", format, report.WastedBytes)
+		}
+
+		var compact bytes.Buffer
+		if _, err := CompactFile(bytes.NewReader(tree.Bytes()), &compact); err != nil {
+			t.Fatal(err)
+		}
+		if size := uint64(tree.Len() - compact.Len()); size != report.WastedBytes {
+			t.Errorf("format %d: compaction saved %d bytes, expected %d", format, size, report.WastedBytes)
+		}
+
+		report, err = AnalyzeWaste(bytes.NewReader(compact.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.NumNodes != 5 || report.Unreachable != 0 || report.WastedBytes != 0 {
+			t.Errorf("format %d: compacted tree has waste %+v", format, report)
+		}
+
+		diff, err := DiffTrees(bytes.NewReader(tree.Bytes()), bytes.NewReader(compact.Bytes()), 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !diff.Identical() {
+			t.Errorf("format %d: compaction changed the leafs: %+v", format, diff)
+		}
+		if diff.HeaderB.NumLeafs != 2 {
+			t.Errorf("format %d: expected 2 leaf nodes, got %d", format, diff.HeaderB.NumLeafs)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"image/color"
+)
+
+// halton returns element i of the Halton sequence with base, in [0, 1).
+func halton(i, base int) float32 {
+	var (
+		f = float32(1)
+		r float32
+	)
+
+	for ; i > 0; i /= base {
+		f /= float32(base)
+		r += f * float32(i%base)
+	}
+	return r
+}
+
+// sampleOffset returns the offset in pixels of sample i from the pixel corner.
+// The first sample is the ray through the corner used without sampling, the
+// following are spread over the pixel around it.
+func sampleOffset(i int) (float32, float32) {
+	if i == 0 {
+		return 0, 0
+	}
+	return halton(i, 2) - 0.5, halton(i, 3) - 0.5
+}
+
+func addSample(sum *[4]float32, c color.RGBA) {
+	sum[0] += float32(c.R)
+	sum[1] += float32(c.G)
+	sum[2] += float32(c.B)
+	sum[3] += float32(c.A)
+}
+
+// writeSamples stores the average of the samples of a pixel. Accumulating frames
+// add the samples to those of the previous frames first.
+func (rt *Raytracer) writeSamples(img *image.RGBA, x, y int, job *rtJob, sum *[4]float32) {
+	i := img.PixOffset(x, y)
+	n := float32(job.samples)
+
+	if job.accumulate {
+		acc := rt.accum[i : i+4]
+		for c := range acc {
+			if job.sample == 0 {
+				acc[c] = sum[c]
+			} else {
+				acc[c] += sum[c]
+			}
+			sum[c] = acc[c]
+		}
+		n = float32(job.sample + job.samples)
+	}
+
+	for c := 0; c < 4; c++ {
+		img.Pix[i+c] = uint8(sum[c]/n + 0.5)
+	}
+}
+
+// ResetAccumulation starts the averaging over, the next frame only has its own
+// samples. It is called when the camera or tree changes.
+func (rt *Raytracer) ResetAccumulation() {
+	rt.traceLock.Lock()
+	defer rt.traceLock.Unlock()
+
+	rt.wait(0)
+	rt.wait(1)
+	rt.numSamples = 0
+}
+
+// Samples returns the number of samples per pixel of the last frame, including the
+// accumulated samples.
+func (rt *Raytracer) Samples() int {
+	rt.traceLock.Lock()
+	defer rt.traceLock.Unlock()
+
+	if rt.accum != nil && !rt.cfg.Jitter {
+		return rt.numSamples
+	}
+	if rt.cfg.Samples > 1 {
+		return rt.cfg.Samples
+	}
+	return 1
+}
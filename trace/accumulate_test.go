@@ -0,0 +1,119 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+func accumulateTest(tree *MutableTree, cfg Config, frames int) (*image.RGBA, int) {
+	rect := image.Rect(0, 0, 48, 32)
+	cfg.FieldOfView = 0.8
+	cfg.TreeScale = 1
+	cfg.ViewDist = 5
+	cfg.MultiThreaded = true
+	cfg.Images = [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}
+
+	rt := NewRaytracer(cfg)
+	defer rt.Close()
+	rt.SetTree(tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis()))
+
+	camera := LookAtCamera{Pos: Vec3{0.3, 0.6, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	var idx int
+	for i := 0; i < frames; i++ {
+		idx = rt.Trace(&camera, nil, 0)
+	}
+
+	if err := rt.Wait(idx); err != nil {
+		panic(err)
+	}
+	return rt.Image(idx), rt.Samples()
+}
+
+func TestAccumulate(t *testing.T) {
+	tree := testSphere(4)
+
+	for _, precise := range []bool{false, true} {
+		single, _ := accumulateTest(tree, Config{HighPrecision: precise}, 1)
+		multi, n := accumulateTest(tree, Config{HighPrecision: precise, Samples: 8}, 1)
+		if n != 8 {
+			t.Errorf("expected 8 samples, got %v", n)
+		}
+
+		accumulated, n := accumulateTest(tree, Config{HighPrecision: precise, Accumulate: true, DoubleBuffer: true}, 8)
+		if n != 8 {
+			t.Errorf("expected 8 accumulated samples, got %v", n)
+		}
+
+		if !bytes.Equal(accumulated.Pix, multi.Pix) {
+			t.Error("8 accumulated frames differ from a single frame with 8 samples")
+		}
+
+		if bytes.Equal(single.Pix, multi.Pix) {
+			t.Error("expected samples to change the edges")
+		}
+
+		// The first accumulated frame is the same as a frame without sampling.
+		first, _ := accumulateTest(tree, Config{HighPrecision: precise, Accumulate: true}, 1)
+		if !bytes.Equal(first.Pix, single.Pix) {
+			t.Error("the first accumulated frame differs from a single sample frame")
+		}
+	}
+}
+
+func TestResetAccumulation(t *testing.T) {
+	rect := image.Rect(0, 0, 32, 32)
+	tree := testSphere(4)
+	rt := NewRaytracer(Config{
+		FieldOfView: 0.8,
+		TreeScale:   1,
+		ViewDist:    5,
+		Accumulate:  true,
+		Samples:     2,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	defer rt.Close()
+	rt.SetTree(tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis()))
+
+	near := LookAtCamera{Pos: Vec3{0.5, 0.5, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	far := LookAtCamera{Pos: Vec3{0.5, 0.5, 4}, Look: Vec3{0.5, 0.5, 0.5}}
+
+	rt.Wait(rt.Trace(&near, nil, 0))
+	expected := append([]byte(nil), rt.Image(0).Pix...)
+
+	for i := 0; i < 3; i++ {
+		rt.Wait(rt.Trace(&far, nil, 0))
+	}
+
+	if n := rt.Samples(); n != 8 {
+		t.Errorf("expected 8 samples, got %v", n)
+	}
+
+	rt.ResetAccumulation()
+	rt.Wait(rt.Trace(&near, nil, 0))
+
+	if n := rt.Samples(); n != 2 {
+		t.Errorf("expected 2 samples after reset, got %v", n)
+	}
+
+	if !bytes.Equal(expected, rt.Image(0).Pix) {
+		t.Error("samples from before the reset are still in the image")
+	}
+}
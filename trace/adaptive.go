@@ -0,0 +1,101 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package trace
+
+import (
+	"image"
+	"image/color"
+	"sync/atomic"
+)
+
+// AdaptiveAA configures edge anti-aliasing. Pixels whose color differs from a
+// neighbor in the same tile by more than Threshold, in any of red, green and blue
+// as a fraction of full intensity, are traced again with MaxSamples-1 extra samples
+// spread over the pixel and given the average. MaxSamples below two disables it.
+type AdaptiveAA struct {
+	Threshold  float32
+	MaxSamples int
+}
+
+func (aa *AdaptiveAA) enabled(cfg *Config) bool {
+	return aa.MaxSamples > 1 && !cfg.Jitter && !cfg.Checkerboard && !cfg.Depth && cfg.Projection != Panorama
+}
+
+// contrast returns the largest difference of a color channel between a and b.
+func contrast(a, b color.RGBA) float32 {
+	diff := func(x, y uint8) float32 {
+		if x > y {
+			return float32(x - y)
+		}
+		return float32(y - x)
+	}
+
+	c := diff(a.R, b.R)
+	if d := diff(a.G, b.G); d > c {
+		c = d
+	}
+	if d := diff(a.B, b.B); d > c {
+		c = d
+	}
+	return c / 255
+}
+
+// refineEdges adds samples to the pixels of the traced tile that exceed the
+// contrast threshold. Only neighbors inside the tile are compared, as the pixels of
+// other tiles may still be written. trace returns the color of one sample at
+// scan position w, h for image pixel dx, dy.
+func (rt *Raytracer) refineEdges(job *rtJob, img *image.RGBA, size image.Point, trace func(w, h, dx, dy int, ox, oy float32) color.RGBA) {
+	aa := &rt.cfg.AdaptiveAA
+
+	// The scan-lines of the job are written to these rows, see scanRow.
+	tile := job.rect.Intersect(image.Rect(job.rect.Min.X, size.Y-job.to, job.rect.Max.X, size.Y-job.from))
+	if tile.Empty() {
+		return
+	}
+
+	var edges []image.Point
+	for dy := tile.Min.Y; dy < tile.Max.Y; dy++ {
+		for dx := tile.Min.X; dx < tile.Max.X; dx++ {
+			c := img.RGBAAt(dx, dy)
+			for _, n := range [...]image.Point{{dx - 1, dy}, {dx + 1, dy}, {dx, dy - 1}, {dx, dy + 1}} {
+				if n.In(tile) && contrast(c, img.RGBAAt(n.X, n.Y)) > aa.Threshold {
+					edges = append(edges, image.Point{dx, dy})
+					break
+				}
+			}
+		}
+	}
+
+	// The colors are only replaced when all edges are found, so every pixel is
+	// compared to the single sample of its neighbors.
+	for _, p := range edges {
+		var sum [4]float32
+		addSample(&sum, img.RGBAAt(p.X, p.Y))
+		for s := 1; s < aa.MaxSamples; s++ {
+			ox, oy := sampleOffset(s)
+			addSample(&sum, trace(p.X, scanRow(p.Y, size.Y), p.X, p.Y, ox, oy))
+		}
+
+		i := img.PixOffset(p.X, p.Y)
+		for c := 0; c < 4; c++ {
+			img.Pix[i+c] = uint8(sum[c]/float32(aa.MaxSamples) + 0.5)
+		}
+	}
+
+	atomic.AddUint64(&rt.refined[job.idx], uint64(len(edges)))
+	atomic.AddUint64(&rt.traced[job.idx], uint64(tile.Dx()*tile.Dy()))
+}
@@ -0,0 +1,93 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package trace
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func adaptiveTest(cfg Config) (*image.RGBA, FrameStats) {
+	tree := NewMutableTree(nil, 2)
+	if err := tree.SetVoxel([3]float32{.25, .25, .25}, 1, color.RGBA{255, 255, 255, 255}); err != nil {
+		panic(err)
+	}
+
+	rect := image.Rect(0, 0, 48, 32)
+	cfg.FieldOfView = 0.8
+	cfg.TreeScale = 1
+	cfg.ViewDist = 5
+	cfg.TileSize = 8
+	cfg.MultiThreaded = true
+	cfg.Images = [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}
+
+	rt := NewRaytracer(cfg)
+	defer rt.Close()
+	rt.SetTree(tree.Octree(), 1)
+
+	camera := LookAtCamera{Pos: Vec3{0.3, 0.4, 1.5}, Look: Vec3{0.25, 0.25, 0.25}}
+	idx := rt.Trace(&camera, nil, 0)
+	if err := rt.Wait(idx); err != nil {
+		panic(err)
+	}
+	return rt.Image(idx), rt.Stats(idx)
+}
+
+func TestAdaptiveAA(t *testing.T) {
+	for _, precise := range []bool{false, true} {
+		single, stats := adaptiveTest(Config{HighPrecision: precise})
+		if stats.Refined != 0 {
+			t.Error("pixels refined without AdaptiveAA:", stats.Refined)
+		}
+
+		multi, _ := adaptiveTest(Config{HighPrecision: precise, Samples: 8})
+		adaptive, stats := adaptiveTest(Config{HighPrecision: precise, AdaptiveAA: AdaptiveAA{0.1, 8}})
+
+		if stats.Refined <= 0 || stats.Refined >= 0.5 {
+			t.Error("unexpected fraction of refined pixels:", stats.Refined)
+		}
+
+		var smoothed int
+		bounds := single.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := single.RGBAAt(x, y)
+				flat := true
+				for _, n := range []image.Point{{x - 1, y}, {x + 1, y}, {x, y - 1}, {x, y + 1}} {
+					if n.In(bounds) && single.RGBAAt(n.X, n.Y) != c {
+						flat = false
+					}
+				}
+
+				// Refined pixels have the same samples as full supersampling.
+				switch a := adaptive.RGBAAt(x, y); {
+				case flat && a != c:
+					t.Errorf("flat pixel %v,%v was refined", x, y)
+				case a != c && a != multi.RGBAAt(x, y):
+					t.Errorf("pixel %v,%v: %v differs from %v", x, y, a, multi.RGBAAt(x, y))
+				case a != c:
+					smoothed++
+				}
+			}
+		}
+
+		if smoothed == 0 {
+			t.Error("no edge pixels were smoothed")
+		}
+	}
+}
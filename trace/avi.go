@@ -0,0 +1,322 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+const (
+	aviHasIndex  = 0x10
+	aviKeyframe  = 0x10
+	aviRateScale = 1000
+
+	// aviHeaderSize is the size of everything before the first frame, up to
+	// and including the movi fourcc.
+	aviHeaderSize = 224
+)
+
+type (
+	aviMainHeader struct {
+		MicroSecPerFrame    uint32
+		MaxBytesPerSec      uint32
+		PaddingGranularity  uint32
+		Flags               uint32
+		TotalFrames         uint32
+		InitialFrames       uint32
+		Streams             uint32
+		SuggestedBufferSize uint32
+		Width               uint32
+		Height              uint32
+		Reserved            [4]uint32
+	}
+
+	aviStreamHeader struct {
+		Type                [4]byte
+		Handler             [4]byte
+		Flags               uint32
+		Priority            uint16
+		Language            uint16
+		InitialFrames       uint32
+		Scale               uint32
+		Rate                uint32
+		Start               uint32
+		Length              uint32
+		SuggestedBufferSize uint32
+		Quality             int32
+		SampleSize          uint32
+		Frame               [4]int16
+	}
+
+	aviBitmapInfo struct {
+		Size          uint32
+		Width         int32
+		Height        int32
+		Planes        uint16
+		BitCount      uint16
+		Compression   [4]byte
+		SizeImage     uint32
+		XPelsPerMeter int32
+		YPelsPerMeter int32
+		ClrUsed       uint32
+		ClrImportant  uint32
+	}
+
+	aviIndexEntry struct {
+		ID     [4]byte
+		Flags  uint32
+		Offset uint32
+		Size   uint32
+	}
+)
+
+// AVIWriter is a sink writing Motion JPEG in an AVI file. AVI streams have a
+// constant rate, a frame is shown from the slot of its timestamp and the slots
+// between frames hold empty chunks that repeat the previous frame. Frames that
+// arrive before their slot is due are dropped.
+//
+// The size of the video is the size of the first frame, later frames of another
+// size are scaled to it.
+type AVIWriter struct {
+	fp      *os.File
+	w       *bufio.Writer
+	fps     float64
+	quality int
+
+	size  image.Point
+	buf   *image.RGBA
+	jpeg  bytes.Buffer
+	index []aviIndexEntry
+
+	// offset is the offset of the next chunk from the movi fourcc.
+	offset   uint32
+	maxChunk uint32
+	first    time.Duration
+	err      error
+}
+
+// CreateAVI creates the file and returns a writer for a video at fps frames per
+// second. Quality is the JPEG quality of the frames.
+func CreateAVI(file string, fps float64, quality int) (*AVIWriter, error) {
+	if !(fps > 0) {
+		return nil, errors.New("invalid frame rate")
+	}
+
+	fp, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	return &AVIWriter{fp: fp, w: bufio.NewWriter(fp), fps: fps, quality: quality, offset: 4}, nil
+}
+
+// NumFrames returns the number of frames in the stream so far, including the
+// repeated ones.
+func (a *AVIWriter) NumFrames() int {
+	return len(a.index)
+}
+
+func (a *AVIWriter) WriteFrame(img image.Image, ts time.Duration) error {
+	if a.err != nil {
+		return a.err
+	}
+
+	if len(a.index) == 0 {
+		a.size, a.first = img.Bounds().Size(), ts
+		if a.size.X <= 0 || a.size.Y <= 0 {
+			return errors.New("empty frame")
+		}
+
+		// The header is written again with the final counts on close.
+		if a.err = a.writeHeader(); a.err != nil {
+			return a.err
+		}
+	}
+
+	slot := frameSlot(ts-a.first, a.fps)
+	if slot < len(a.index) {
+		return nil
+	}
+
+	for len(a.index) < slot {
+		if a.err = a.writeChunk(nil, 0); a.err != nil {
+			return a.err
+		}
+	}
+
+	a.jpeg.Reset()
+	frame := fitFrame(img, a.size, a.buf)
+	if frame != img {
+		a.buf = frame
+	}
+	if a.err = jpeg.Encode(&a.jpeg, frame, &jpeg.Options{Quality: a.quality}); a.err != nil {
+		return a.err
+	}
+	a.err = a.writeChunk(a.jpeg.Bytes(), aviKeyframe)
+	return a.err
+}
+
+// writeChunk appends a 00dc chunk to the movi list and its entry to the index.
+func (a *AVIWriter) writeChunk(data []byte, flags uint32) error {
+	entry := aviIndexEntry{[4]byte{'0', '0', 'd', 'c'}, flags, a.offset, uint32(len(data))}
+	a.index = append(a.index, entry)
+
+	if _, err := a.w.Write(entry.ID[:]); err != nil {
+		return err
+	}
+	if err := binary.Write(a.w, binary.LittleEndian, entry.Size); err != nil {
+		return err
+	}
+	if _, err := a.w.Write(data); err != nil {
+		return err
+	}
+
+	// Chunks are padded to an even size.
+	size := 8 + uint32(len(data))
+	if len(data)%2 == 1 {
+		if err := a.w.WriteByte(0); err != nil {
+			return err
+		}
+		size++
+	}
+
+	if entry.Size > a.maxChunk {
+		a.maxChunk = entry.Size
+	}
+	a.offset += size
+	return nil
+}
+
+// writeHeader writes the RIFF, hdrl and movi headers. The sizes of the lists
+// cover the frames written so far.
+func (a *AVIWriter) writeHeader() error {
+	var (
+		numFrames = uint32(len(a.index))
+		moviSize  = a.offset
+		usec      = uint32(math.Floor(1e6/a.fps + 0.5))
+	)
+
+	header := aviMainHeader{
+		MicroSecPerFrame:    usec,
+		MaxBytesPerSec:      uint32(math.Min(float64(a.maxChunk)*a.fps, math.MaxUint32)),
+		Flags:               aviHasIndex,
+		TotalFrames:         numFrames,
+		Streams:             1,
+		SuggestedBufferSize: a.maxChunk,
+		Width:               uint32(a.size.X),
+		Height:              uint32(a.size.Y),
+	}
+
+	stream := aviStreamHeader{
+		Type:                [4]byte{'v', 'i', 'd', 's'},
+		Handler:             [4]byte{'M', 'J', 'P', 'G'},
+		Scale:               aviRateScale,
+		Rate:                uint32(math.Floor(a.fps*aviRateScale + 0.5)),
+		Length:              numFrames,
+		SuggestedBufferSize: a.maxChunk,
+		Quality:             -1,
+		Frame:               [4]int16{0, 0, int16(a.size.X), int16(a.size.Y)},
+	}
+
+	format := aviBitmapInfo{
+		Size:        40,
+		Width:       int32(a.size.X),
+		Height:      int32(a.size.Y),
+		Planes:      1,
+		BitCount:    24,
+		Compression: [4]byte{'M', 'J', 'P', 'G'},
+		SizeImage:   uint32(a.size.X * a.size.Y * 3),
+	}
+
+	var buf bytes.Buffer
+	chunk := func(id string, size uint32) {
+		buf.WriteString(id)
+		binary.Write(&buf, binary.LittleEndian, size)
+	}
+
+	fileSize := uint32(aviHeaderSize-8) + moviSize - 4 + 8 + 16*numFrames
+	chunk("RIFF", fileSize)
+	buf.WriteString("AVI ")
+	chunk("LIST", 192)
+	buf.WriteString("hdrl")
+	chunk("avih", 56)
+	binary.Write(&buf, binary.LittleEndian, header)
+	chunk("LIST", 116)
+	buf.WriteString("strl")
+	chunk("strh", 56)
+	binary.Write(&buf, binary.LittleEndian, stream)
+	chunk("strf", 40)
+	binary.Write(&buf, binary.LittleEndian, format)
+	chunk("LIST", moviSize)
+	buf.WriteString("movi")
+
+	if buf.Len() != aviHeaderSize {
+		panic("invalid avi header")
+	}
+	_, err := a.w.Write(buf.Bytes())
+	return err
+}
+
+// Close writes the index, updates the headers and closes the file.
+func (a *AVIWriter) Close() error {
+	if a.fp == nil {
+		return errSinkClosed
+	}
+
+	err := a.err
+	if err == nil && len(a.index) > 0 {
+		err = a.finish()
+	}
+
+	if cerr := a.fp.Close(); err == nil {
+		err = cerr
+	}
+	a.fp = nil
+	return err
+}
+
+func (a *AVIWriter) finish() error {
+	if _, err := a.w.WriteString("idx1"); err != nil {
+		return err
+	}
+	if err := binary.Write(a.w, binary.LittleEndian, uint32(16*len(a.index))); err != nil {
+		return err
+	}
+	if err := binary.Write(a.w, binary.LittleEndian, a.index); err != nil {
+		return err
+	}
+	if err := a.w.Flush(); err != nil {
+		return err
+	}
+
+	if _, err := a.fp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := a.writeHeader(); err != nil {
+		return err
+	}
+	return a.w.Flush()
+}
@@ -0,0 +1,214 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// parsedAVI is what parseAVI found in a file.
+type parsedAVI struct {
+	header aviMainHeader
+	stream aviStreamHeader
+	frames [][]byte
+	index  []aviIndexEntry
+}
+
+// parseAVI walks the chunks of an AVI file and checks their sizes.
+func parseAVI(t *testing.T, data []byte) *parsedAVI {
+	var avi parsedAVI
+
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "AVI " {
+		t.Fatal("not an AVI file")
+	}
+	if size := binary.LittleEndian.Uint32(data[4:]); int(size) != len(data)-8 {
+		t.Fatalf("RIFF size is %d, expected %d", size, len(data)-8)
+	}
+
+	var movi int
+	var walk func(data []byte, base int)
+	walk = func(data []byte, base int) {
+		for pos := 0; pos < len(data); {
+			if pos+8 > len(data) {
+				t.Fatal("truncated chunk header")
+			}
+
+			id, size := string(data[pos:pos+4]), int(binary.LittleEndian.Uint32(data[pos+4:]))
+			body := pos + 8
+			if body+size > len(data) {
+				t.Fatalf("chunk %s at %d overruns its list", id, base+pos)
+			}
+			chunk := data[body : body+size]
+
+			switch id {
+			case "LIST":
+				if string(chunk[:4]) == "movi" {
+					movi = base + body
+				}
+				walk(chunk[4:], base+body+4)
+			case "avih":
+				binary.Read(bytes.NewReader(chunk), binary.LittleEndian, &avi.header)
+			case "strh":
+				binary.Read(bytes.NewReader(chunk), binary.LittleEndian, &avi.stream)
+			case "00dc":
+				avi.frames = append(avi.frames, chunk)
+			case "idx1":
+				avi.index = make([]aviIndexEntry, size/16)
+				binary.Read(bytes.NewReader(chunk), binary.LittleEndian, avi.index)
+			}
+			pos = body + size + size%2
+		}
+	}
+	walk(data[12:], 12)
+
+	// Index offsets are relative to the movi fourcc.
+	for i, entry := range avi.index {
+		pos := movi + int(entry.Offset)
+		if string(data[pos:pos+4]) != "00dc" || binary.LittleEndian.Uint32(data[pos+4:]) != entry.Size {
+			t.Errorf("index entry %d does not point at its chunk", i)
+		}
+	}
+	return &avi
+}
+
+func TestAVIWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "avi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "test.avi")
+	w, err := CreateAVI(file, 25, 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const numFrames = 10
+	for i := 0; i < numFrames; i++ {
+		img := image.NewRGBA(image.Rect(0, 0, 33, 17))
+		for j := range img.Pix {
+			img.Pix[j] = uint8(i * 25)
+		}
+		if err := w.WriteFrame(img, time.Duration(i)*40*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	avi := parseAVI(t, data)
+
+	if avi.header.TotalFrames != numFrames || avi.stream.Length != numFrames || len(avi.frames) != numFrames || len(avi.index) != numFrames {
+		t.Fatalf("expected %d frames, got %d, %d, %d chunks and %d index entries", numFrames, avi.header.TotalFrames, avi.stream.Length, len(avi.frames), len(avi.index))
+	}
+	if avi.header.Width != 33 || avi.header.Height != 17 || avi.header.MicroSecPerFrame != 40000 {
+		t.Errorf("unexpected header %+v", avi.header)
+	}
+	if avi.stream.Rate/avi.stream.Scale != 25 || string(avi.stream.Handler[:]) != "MJPG" {
+		t.Errorf("unexpected stream header %+v", avi.stream)
+	}
+
+	for i, frame := range avi.frames {
+		img, err := jpeg.Decode(bytes.NewReader(frame))
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if img.Bounds() != image.Rect(0, 0, 33, 17) {
+			t.Errorf("frame %d: unexpected size %v", i, img.Bounds())
+		}
+		if r, _, _, _ := img.At(16, 8).RGBA(); int(r>>8) < i*25-4 || int(r>>8) > i*25+4 {
+			t.Errorf("frame %d: unexpected color %d", i, r>>8)
+		}
+	}
+}
+
+func TestAVIVariableRate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "avi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "test.avi")
+	w, err := CreateAVI(file, 10, 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The frames are shown from the slots 0, 1, 4 and 5, the one at 410ms is
+	// dropped. Frames of another size are scaled.
+	small := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	large := image.NewGray(image.Rect(0, 0, 16, 16))
+	for _, f := range []struct {
+		img image.Image
+		ms  int
+	}{{small, 1000}, {small, 1100}, {large, 1390}, {small, 1410}, {small, 1500}} {
+		if err := w.WriteFrame(f.img, time.Duration(f.ms)*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := w.NumFrames(); n != 6 {
+		t.Errorf("expected 6 frames, got %d", n)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	avi := parseAVI(t, data)
+
+	if avi.header.TotalFrames != 6 || len(avi.frames) != 6 || len(avi.index) != 6 {
+		t.Fatalf("expected 6 frames, got %d, %d chunks and %d index entries", avi.header.TotalFrames, len(avi.frames), len(avi.index))
+	}
+
+	for i, frame := range avi.frames {
+		empty := i == 2 || i == 3
+		if (len(frame) == 0) != empty || (avi.index[i].Flags == aviKeyframe) == empty {
+			t.Errorf("frame %d: unexpected chunk of %d bytes with flags %x", i, len(frame), avi.index[i].Flags)
+		}
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(avi.frames[4]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != small.Rect {
+		t.Errorf("unexpected size %v", img.Bounds())
+	}
+	if c := color.GrayModel.Convert(img.At(4, 4)).(color.Gray); c.Y > 4 {
+		t.Errorf("unexpected color %v", c)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"image/color"
+	"runtime"
+	"sync"
+)
+
+// RenderJob is a frame rendered by RenderBatch. Jobs may share the tree.
+type RenderJob struct {
+	// Config of the raytracer rendering the frame. If it has neither images nor
+	// a target, an image of Size is allocated for the frame.
+	Config Config
+	Size   image.Point
+
+	Camera   Camera
+	Tree     Octree
+	MaxDepth int
+
+	// ClearColor replaces the default clear color if it is not nil.
+	ClearColor *color.RGBA
+}
+
+// render renders the frame of the job with a raytracer of its own.
+func (job *RenderJob) render() (*image.RGBA, error) {
+	cfg := job.Config
+	if cfg.Target == nil && cfg.Images[0] == nil && cfg.Images[1] == nil {
+		if job.Size.X <= 0 || job.Size.Y <= 0 {
+			return nil, InvalidSizeError
+		}
+		img := image.NewRGBA(image.Rectangle{Max: job.Size})
+		cfg.Images = [2]*image.RGBA{img, img}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Target == nil {
+		if err := checkImages(cfg.Images); err != nil {
+			return nil, err
+		}
+	}
+
+	rt := NewRaytracer(cfg)
+	defer rt.Close()
+
+	if job.ClearColor != nil {
+		rt.SetClearColor(*job.ClearColor)
+	}
+
+	frame := rt.Trace(job.Camera, job.Tree, job.MaxDepth)
+	if err := rt.Wait(frame); err != nil {
+		return nil, err
+	}
+	return rt.Image(frame), nil
+}
+
+// RenderBatch renders the jobs on up to parallel raytracers at a time and passes
+// each frame, or the error that stopped it, to out. The calls to out run on
+// goroutines of their own, so encoding and writing a frame overlaps rendering
+// the next ones, and may happen in any order. At most twice parallel frames are
+// rendered or wait for out at a time, which bounds the memory held by frames. If
+// parallel is not positive, one raytracer per CPU is used. RenderBatch returns
+// when out has returned for every job.
+func RenderBatch(jobs []RenderJob, parallel int, out func(i int, img *image.RGBA, err error)) {
+	renderBatch(jobs, parallel, false, out)
+}
+
+// RenderBatchOrdered works like RenderBatch but calls out from a single goroutine
+// in the order of the jobs.
+func RenderBatchOrdered(jobs []RenderJob, parallel int, out func(i int, img *image.RGBA, err error)) {
+	renderBatch(jobs, parallel, true, out)
+}
+
+type batchResult struct {
+	img *image.RGBA
+	err error
+}
+
+func renderBatch(jobs []RenderJob, parallel int, ordered bool, out func(i int, img *image.RGBA, err error)) {
+	if parallel <= 0 {
+		parallel = runtime.NumCPU()
+	}
+
+	var (
+		// window bounds the frames that are rendered or waiting for out.
+		window  = make(chan struct{}, 2*parallel)
+		queue   = make(chan int)
+		results = make([]chan batchResult, len(jobs))
+		wg      sync.WaitGroup
+	)
+
+	for i := range results {
+		results[i] = make(chan batchResult, 1)
+	}
+
+	deliver := func(i int, res batchResult) {
+		out(i, res.img, res.err)
+		<-window
+		wg.Done()
+	}
+
+	for n := 0; n < parallel; n++ {
+		go func() {
+			for i := range queue {
+				img, err := jobs[i].render()
+				if ordered {
+					results[i] <- batchResult{img, err}
+				} else {
+					go deliver(i, batchResult{img, err})
+				}
+			}
+		}()
+	}
+
+	wg.Add(len(jobs))
+	go func() {
+		for i := range jobs {
+			window <- struct{}{}
+			queue <- i
+		}
+		close(queue)
+	}()
+
+	if ordered {
+		for i, res := range results {
+			deliver(i, <-res)
+		}
+	}
+	wg.Wait()
+}
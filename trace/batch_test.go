@@ -0,0 +1,156 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"sync"
+	"testing"
+)
+
+func batchJobs(tree Octree, vpa, n int) []RenderJob {
+	jobs := make([]RenderJob, n)
+	for i := range jobs {
+		angle := 2 * math.Pi * float64(i) / float64(n)
+		jobs[i] = RenderJob{
+			Config: Config{
+				FieldOfView:   1,
+				TreeScale:     1,
+				ViewDist:      10,
+				MultiThreaded: true,
+			},
+			Size: image.Pt(48, 32),
+			Camera: &LookAtCamera{
+				Pos:  Vec3{0.5 + 1.5*float32(math.Sin(angle)), 1.2, 0.5 + 1.5*float32(math.Cos(angle))},
+				Look: Vec3{0.5, 0.5, 0.5},
+			},
+			Tree:       tree,
+			MaxDepth:   TreeWidthToDepth(vpa),
+			ClearColor: &testClearColor,
+		}
+	}
+	return jobs
+}
+
+func TestRenderBatchOrdered(t *testing.T) {
+	sphere := testSphere(4)
+	jobs := batchJobs(sphere.Octree(), sphere.VoxelsPerAxis(), 12)
+
+	next := 0
+	RenderBatchOrdered(jobs, 3, func(i int, img *image.RGBA, err error) {
+		if i != next {
+			t.Errorf("frame %d delivered before frame %d", i, next)
+		}
+		next = i + 1
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		expected, err := jobs[i].render()
+		if err != nil {
+			panic(err)
+		}
+		if !bytes.Equal(img.Pix, expected.Pix) {
+			t.Errorf("frame %d differs from a frame rendered alone", i)
+		}
+	})
+
+	if next != len(jobs) {
+		t.Errorf("expected %d frames, got %d", len(jobs), next)
+	}
+}
+
+func TestRenderBatchErrors(t *testing.T) {
+	sphere := testSphere(3)
+	jobs := batchJobs(sphere.Octree(), sphere.VoxelsPerAxis(), 6)
+
+	nan := float32(math.NaN())
+	jobs[1].Config.FieldOfView = 0
+	jobs[2].Camera = &LookAtCamera{Pos: Vec3{nan, 0, 0}}
+	jobs[4].Size = image.Point{}
+
+	expected := map[int]error{1: InvalidFieldOfViewError, 2: InvalidCameraError, 4: InvalidSizeError}
+
+	var (
+		lock      sync.Mutex
+		delivered = make(map[int]int)
+	)
+
+	RenderBatch(jobs, 2, func(i int, img *image.RGBA, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		delivered[i]++
+
+		if !errors.Is(err, expected[i]) {
+			t.Errorf("frame %d: expected error %v, got %v", i, expected[i], err)
+		}
+		if (err == nil) != (img != nil) {
+			t.Errorf("frame %d: got image %v with error %v", i, img != nil, err)
+		}
+	})
+
+	for i := range jobs {
+		if delivered[i] != 1 {
+			t.Errorf("frame %d was delivered %d times", i, delivered[i])
+		}
+	}
+}
+
+func encodeFrame(img *image.RGBA) {
+	if err := png.Encode(ioutil.Discard, img); err != nil {
+		panic(err)
+	}
+}
+
+func BenchmarkRenderSequential(b *testing.B) {
+	sphere := testSphere(6)
+	jobs := batchJobs(sphere.Octree(), sphere.VoxelsPerAxis(), 16)
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		for i := range jobs {
+			img, err := jobs[i].render()
+			if err != nil {
+				panic(err)
+			}
+			encodeFrame(img)
+		}
+	}
+}
+
+func BenchmarkRenderBatch(b *testing.B) {
+	sphere := testSphere(6)
+	jobs := batchJobs(sphere.Octree(), sphere.VoxelsPerAxis(), 16)
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		RenderBatch(jobs, 0, func(i int, img *image.RGBA, err error) {
+			if err != nil {
+				panic(err)
+			}
+			encodeFrame(img)
+		})
+	}
+}
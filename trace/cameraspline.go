@@ -0,0 +1,264 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package trace
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/andreas-jonsson/octatron/go3d/quaternion"
+	"github.com/andreas-jonsson/octatron/go3d/vec3"
+)
+
+var InvalidPathError = errors.New("invalid camera path")
+
+// CameraKey is a keyframe of a camera path, the pose of Camera at Time.
+type CameraKey struct {
+	Time   float32
+	Camera Camera
+}
+
+// PathCamera is a pose evaluated from a camera path. Orientation rotates the
+// forward direction (0, 0, -1) and the up direction (0, 1, 0) of the camera, Dist
+// is the distance to the look-at point.
+type PathCamera struct {
+	Pos         Vec3
+	Orientation quaternion.T
+	Dist        float32
+}
+
+func (c *PathCamera) Position() Vec3 {
+	return c.Pos
+}
+
+func (c *PathCamera) Forward() Vec3 {
+	return Vec3(c.Orientation.RotatedVec3(&vec3.T{0, 0, -1}))
+}
+
+func (c *PathCamera) LookAt() Vec3 {
+	forward := vec3.T(c.Forward())
+	forward.Scale(c.Dist)
+	position := vec3.T(c.Pos)
+	return Vec3(vec3.Add(&position, &forward))
+}
+
+func (c *PathCamera) Up() Vec3 {
+	return Vec3(c.Orientation.RotatedVec3(&vec3.T{0, 1, 0}))
+}
+
+// CatmullRomPath interpolates keyframed camera poses. Positions follow a Catmull-Rom
+// spline through the keys, parameterized by time so the speed is continuous at the
+// keys. Orientations are slerped between keys, so the view turns at a constant rate
+// and the up direction stays perpendicular to the view, also when a key looks
+// straight along its up direction.
+type CatmullRomPath struct {
+	keys []PathCamera
+	time []float32
+}
+
+// NewCatmullRomPath returns the path through keys, which must be sorted by time and
+// have distinct times. Cameras that look along their up direction keep the up
+// direction of the key before them.
+func NewCatmullRomPath(keys []CameraKey) (*CatmullRomPath, error) {
+	if len(keys) == 0 {
+		return nil, InvalidPathError
+	}
+
+	path := &CatmullRomPath{
+		keys: make([]PathCamera, len(keys)),
+		time: make([]float32, len(keys)),
+	}
+
+	for i, key := range keys {
+		if !finiteCamera(key.Camera) || math.IsInf(float64(key.Time), 0) || math.IsNaN(float64(key.Time)) {
+			return nil, InvalidPathError
+		}
+		if i > 0 && !(key.Time > keys[i-1].Time) {
+			return nil, InvalidPathError
+		}
+
+		position := vec3.T(key.Camera.Position())
+		lookAt := vec3.T(key.Camera.LookAt())
+		forward := vec3.Sub(&lookAt, &position)
+
+		dist := forward.Length()
+		if !(dist > 0) {
+			return nil, InvalidPathError
+		}
+		forward.Scale(1 / dist)
+
+		var prev *quaternion.T
+		if i > 0 {
+			prev = &path.keys[i-1].Orientation
+		}
+
+		path.time[i] = key.Time
+		path.keys[i] = PathCamera{
+			Pos:         Vec3(position),
+			Orientation: orientation(forward, vec3.T(key.Camera.Up()), prev),
+			Dist:        dist,
+		}
+	}
+	return path, nil
+}
+
+// Start returns the time of the first key.
+func (p *CatmullRomPath) Start() float32 {
+	return p.time[0]
+}
+
+// Duration returns the time between the first and last key.
+func (p *CatmullRomPath) Duration() float32 {
+	return p.time[len(p.time)-1] - p.time[0]
+}
+
+// Eval returns the pose at time t. Times before the first and after the last key
+// return the pose of that key.
+func (p *CatmullRomPath) Eval(t float32) PathCamera {
+	last := len(p.keys) - 1
+	if !(t > p.time[0]) {
+		return p.keys[0]
+	} else if t >= p.time[last] {
+		return p.keys[last]
+	}
+
+	// The segment from key i to i+1 holds t.
+	i := sort.Search(len(p.time), func(i int) bool { return p.time[i] > t }) - 1
+	a, b := &p.keys[i], &p.keys[i+1]
+
+	dt := p.time[i+1] - p.time[i]
+	s := (t - p.time[i]) / dt
+
+	// Hermite basis of the segment, the tangents are given per unit of time.
+	s2, s3 := s*s, s*s*s
+	h00 := 2*s3 - 3*s2 + 1
+	h10 := s3 - 2*s2 + s
+	h01 := -2*s3 + 3*s2
+	h11 := s3 - s2
+
+	ma, mb := p.tangent(i), p.tangent(i+1)
+
+	var pos Vec3
+	for axis := range pos {
+		pos[axis] = h00*a.Pos[axis] + h10*dt*ma[axis] + h01*b.Pos[axis] + h11*dt*mb[axis]
+	}
+
+	return PathCamera{
+		Pos:         pos,
+		Orientation: slerp(&a.Orientation, &b.Orientation, s),
+		Dist:        a.Dist + (b.Dist-a.Dist)*s,
+	}
+}
+
+// tangent returns the velocity of the path at key i. End keys use the velocity
+// towards their neighbour.
+func (p *CatmullRomPath) tangent(i int) Vec3 {
+	prev, next := i-1, i+1
+	if prev < 0 {
+		prev = i
+	}
+	if next >= len(p.keys) {
+		next = i
+	}
+
+	var m Vec3
+	if prev == next {
+		return m
+	}
+
+	dt := p.time[next] - p.time[prev]
+	for axis := range m {
+		m[axis] = (p.keys[next].Pos[axis] - p.keys[prev].Pos[axis]) / dt
+	}
+	return m
+}
+
+// orientation returns the rotation of a camera looking along forward, which must be
+// unit length. If up is parallel to forward the up direction of prev is used, or
+// any direction perpendicular to forward if prev is nil.
+func orientation(forward, up vec3.T, prev *quaternion.T) quaternion.T {
+	const epsilon = 1e-4
+
+	right := vec3.Cross(&forward, &up)
+	if right.Length() < epsilon*up.Length() || up.Length() == 0 {
+		candidates := []vec3.T{{0, 1, 0}, {0, 0, 1}, {1, 0, 0}}
+		if prev != nil {
+			candidates = append([]vec3.T{prev.RotatedVec3(&vec3.T{0, 1, 0})}, candidates...)
+		}
+
+		for _, up = range candidates {
+			if right = vec3.Cross(&forward, &up); right.Length() >= epsilon {
+				break
+			}
+		}
+	}
+	right.Normalize()
+	up = vec3.Cross(&right, &forward)
+
+	// The columns of the rotation matrix are right, up and back.
+	var (
+		m00, m01, m02 = right[0], up[0], -forward[0]
+		m10, m11, m12 = right[1], up[1], -forward[1]
+		m20, m21, m22 = right[2], up[2], -forward[2]
+		q             quaternion.T
+	)
+
+	if trace := m00 + m11 + m22; trace > 0 {
+		s := float32(math.Sqrt(float64(trace)+1)) * 2
+		q = quaternion.T{(m21 - m12) / s, (m02 - m20) / s, (m10 - m01) / s, s / 4}
+	} else if m00 > m11 && m00 > m22 {
+		s := float32(math.Sqrt(float64(1+m00-m11-m22))) * 2
+		q = quaternion.T{s / 4, (m01 + m10) / s, (m02 + m20) / s, (m21 - m12) / s}
+	} else if m11 > m22 {
+		s := float32(math.Sqrt(float64(1+m11-m00-m22))) * 2
+		q = quaternion.T{(m01 + m10) / s, s / 4, (m12 + m21) / s, (m02 - m20) / s}
+	} else {
+		s := float32(math.Sqrt(float64(1+m22-m00-m11))) * 2
+		q = quaternion.T{(m02 + m20) / s, (m12 + m21) / s, s / 4, (m10 - m01) / s}
+	}
+	q.Normalize()
+
+	// Keys on the same hemisphere are slerped the short way.
+	if prev != nil && quaternion.Dot(prev, &q) < 0 {
+		q.Negate()
+	}
+	return q
+}
+
+// slerp interpolates unit quaternions. Unlike quaternion.Slerp it handles equal
+// and nearly equal rotations.
+func slerp(a, b *quaternion.T, t float32) quaternion.T {
+	d := float64(quaternion.Dot(a, b))
+	if d > 1 {
+		d = 1
+	}
+
+	ta, tb := float64(1-t), float64(t)
+	if d < 0.9995 {
+		angle := math.Acos(d)
+		sin := math.Sin(angle)
+		ta = math.Sin(angle*ta) / sin
+		tb = math.Sin(angle*tb) / sin
+	}
+
+	var q quaternion.T
+	for i := range q {
+		q[i] = float32(ta*float64(a[i]) + tb*float64(b[i]))
+	}
+	return q.Normalized()
+}
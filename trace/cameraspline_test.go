@@ -0,0 +1,160 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package trace
+
+import (
+	"math"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/go3d/vec3"
+)
+
+func vecDist(a, b Vec3) float32 {
+	d := vec3.T{a[0] - b[0], a[1] - b[1], a[2] - b[2]}
+	return d.Length()
+}
+
+func dot(a, b Vec3) float32 {
+	return a[0]*b[0] + a[1]*b[1] + a[2]*b[2]
+}
+
+func testPath() []CameraKey {
+	return []CameraKey{
+		{0, &LookAtCamera{Vec3{0, 0, 2}, Vec3{0, 0, 0}}},
+		{1, &LookAtCamera{Vec3{2, 1, 0}, Vec3{0, 0, 0}}},
+		{3, &FreeFlightCamera{Vec3{0, 2, -2}, 1, -0.5}},
+		{3.5, &LookAtCamera{Vec3{-1, 0.5, 0}, Vec3{0, 0.5, 0}}},
+	}
+}
+
+func TestCatmullRomPathKeys(t *testing.T) {
+	keys := testPath()
+	path, err := NewCatmullRomPath(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Duration() != 3.5 {
+		t.Errorf("expected duration 3.5, got %v", path.Duration())
+	}
+
+	for _, key := range keys {
+		pose := path.Eval(key.Time)
+		if d := vecDist(pose.Position(), key.Camera.Position()); d > 1e-5 {
+			t.Errorf("time %v: position is %v off", key.Time, d)
+		}
+		if d := vecDist(pose.LookAt(), key.Camera.LookAt()); d > 1e-4 {
+			t.Errorf("time %v: look-at is %v off", key.Time, d)
+		}
+		if d := dot(pose.Up(), key.Camera.Up()); d < 0.5 {
+			t.Errorf("time %v: up %v is far from %v", key.Time, pose.Up(), key.Camera.Up())
+		}
+	}
+
+	// Times outside the keys are clamped.
+	if pose := path.Eval(-1); pose != path.Eval(0) {
+		t.Error("expected first pose before the path")
+	}
+	if pose := path.Eval(10); pose != path.Eval(3.5) {
+		t.Error("expected last pose after the path")
+	}
+}
+
+func TestCatmullRomPathContinuity(t *testing.T) {
+	keys := testPath()
+	path, err := NewCatmullRomPath(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const h = 1e-3
+	for _, key := range keys[1 : len(keys)-1] {
+		before, at, after := path.Eval(key.Time-h), path.Eval(key.Time), path.Eval(key.Time+h)
+
+		// Position and look direction are continuous.
+		if d := vecDist(before.Pos, after.Pos); d > 10*h {
+			t.Errorf("time %v: position jumps %v", key.Time, d)
+		}
+		if d := dot(before.Forward(), after.Forward()); d < 0.999 {
+			t.Errorf("time %v: view turns %v", key.Time, math.Acos(float64(d)))
+		}
+
+		// So is the velocity.
+		var in, out Vec3
+		for axis := range in {
+			in[axis] = (at.Pos[axis] - before.Pos[axis]) / h
+			out[axis] = (after.Pos[axis] - at.Pos[axis]) / h
+		}
+		if d := vecDist(in, out); d > 0.05 {
+			t.Errorf("time %v: velocity changes from %v to %v", key.Time, in, out)
+		}
+	}
+}
+
+func TestCatmullRomPathPole(t *testing.T) {
+	// The middle key looks straight down, along the up direction of LookAtCamera.
+	path, err := NewCatmullRomPath([]CameraKey{
+		{0, &LookAtCamera{Vec3{0, 1, 1}, Vec3{0, 0, 0}}},
+		{1, &LookAtCamera{Vec3{0, 1, 0}, Vec3{0, 0, 0}}},
+		{2, &LookAtCamera{Vec3{0, 1, -1}, Vec3{0, 0, 0}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := path.Eval(0)
+	prevUp := first.Up()
+	for i := 0; i <= 200; i++ {
+		pose := path.Eval(float32(i) / 100)
+		up, forward := pose.Up(), pose.Forward()
+
+		if !finiteCamera(&pose) {
+			t.Fatalf("step %v: camera is not finite", i)
+		}
+		if l := vecDist(up, Vec3{}); math.Abs(float64(l)-1) > 1e-3 {
+			t.Errorf("step %v: up has length %v", i, l)
+		}
+		if d := dot(up, forward); math.Abs(float64(d)) > 1e-3 {
+			t.Errorf("step %v: up is not perpendicular to the view", i)
+		}
+		if d := dot(up, prevUp); d < 0.99 {
+			t.Errorf("step %v: up flips from %v to %v", i, prevUp, up)
+		}
+		prevUp = up
+	}
+
+	// Looking straight down the up direction follows the view over the pole.
+	pole := path.Eval(1)
+	if up := pole.Up(); up[2] > -0.99 {
+		t.Errorf("expected up towards -z at the pole, got %v", up)
+	}
+}
+
+func TestInvalidCatmullRomPath(t *testing.T) {
+	camera := &LookAtCamera{Vec3{0, 0, 1}, Vec3{0, 0, 0}}
+	for _, keys := range [][]CameraKey{
+		nil,
+		{{0, camera}, {0, camera}},
+		{{1, camera}, {0, camera}},
+		{{0, &LookAtCamera{Vec3{1, 1, 1}, Vec3{1, 1, 1}}}},
+		{{float32(math.NaN()), camera}},
+		{{0, &LookAtCamera{Vec3{0, float32(math.Inf(1)), 0}, Vec3{0, 0, 0}}}},
+	} {
+		if _, err := NewCatmullRomPath(keys); err != InvalidPathError {
+			t.Errorf("%v: expected %v, got %v", keys, InvalidPathError, err)
+		}
+	}
+}
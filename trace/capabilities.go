@@ -0,0 +1,137 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"strings"
+)
+
+// Capabilities are the features of a tree that depend on its format and on how it
+// was built, see TreeInfo.Capabilities.
+type Capabilities uint
+
+const (
+	// HasAlpha is set if node colors store alpha, see pack.OctreeFormat.HasAlpha.
+	// It is opacity, or a classification code of opaque trees, see
+	// NodeAttributes.Class, unless AlphaIsCoverage is set.
+	HasAlpha Capabilities = 1 << iota
+
+	// HasPalette is set if node colors are indices into a palette of at most 256
+	// colors.
+	HasPalette
+
+	// AlphaIsCoverage is set if alpha is the part of the node filled by leafs, see
+	// pack.OctreeHeader.Coverage.
+	AlphaIsCoverage
+
+	// HasBounds is set if the tree knows the world bounds it was built from, see
+	// Config.FitTree.
+	HasBounds
+
+	// HasGeoReference is set if the world is placed in a coordinate reference
+	// system, see TreeToWorld.
+	HasGeoReference
+)
+
+var capabilityNames = [...]string{"alpha", "palette", "coverage", "bounds", "geo-reference"}
+
+func (c Capabilities) String() string {
+	var names []string
+	for i, name := range capabilityNames {
+		if c&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// Capabilities returns the features the tree supports.
+func (info *TreeInfo) Capabilities() Capabilities {
+	var c Capabilities
+	if info.Format.HasAlpha() {
+		c |= HasAlpha
+	}
+	if info.Format.Paletted() {
+		c |= HasPalette
+	}
+	if info.Coverage {
+		c |= AlphaIsCoverage
+	}
+	if info.Bounds.Size > 0 {
+		c |= HasBounds
+	}
+	if info.GeoReference != nil {
+		c |= HasGeoReference
+	}
+	return c
+}
+
+// Downgrade describes a feature a tree can not support and what is rendered
+// instead.
+type Downgrade struct {
+	// Feature is the setting that was turned off, like the Config field.
+	Feature  string
+	Reason   string
+	Fallback string
+}
+
+func (d Downgrade) String() string {
+	return d.Feature + ": " + d.Reason + ", " + d.Fallback
+}
+
+// DowngradeError is returned by CheckTree with Config.Strict, instead of
+// downgrading the features.
+type DowngradeError struct {
+	Downgrades []Downgrade
+}
+
+func (e *DowngradeError) Error() string {
+	msgs := make([]string, len(e.Downgrades))
+	for i, d := range e.Downgrades {
+		msgs[i] = d.String()
+	}
+	return "tree does not support " + strings.Join(msgs, "; ")
+}
+
+// CheckTree compares the features cfg asks for with the capabilities of a tree
+// and turns off those the tree can not support, which would render wrong
+// images. The downgrades are returned so they can be shown to the user. With
+// Strict cfg is left unchanged and a *DowngradeError is returned instead.
+//
+// Transparency needs alpha and falls back to Opaque.
+func (cfg *Config) CheckTree(info *TreeInfo) ([]Downgrade, error) {
+	var (
+		caps       = info.Capabilities()
+		downgrades []Downgrade
+		checked    = *cfg
+	)
+
+	if checked.Transparency != Opaque && caps&HasAlpha == 0 {
+		checked.Transparency = Opaque
+		downgrades = append(downgrades, Downgrade{"Transparency", "the format stores no alpha", "rendered opaque"})
+	}
+
+	if len(downgrades) > 0 && cfg.Strict {
+		return nil, &DowngradeError{downgrades}
+	}
+	*cfg = checked
+	return downgrades, nil
+}
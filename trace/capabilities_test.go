@@ -0,0 +1,84 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"bytes"
+	"image/color"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+func TestCapabilities(t *testing.T) {
+	for _, test := range []struct {
+		info     TreeInfo
+		expected Capabilities
+	}{
+		{TreeInfo{Format: pack.MipR8G8B8A8UnpackUI32}, HasAlpha},
+		{TreeInfo{Format: pack.MipR5G6B5PackUI30, Coverage: true}, AlphaIsCoverage},
+		{TreeInfo{Format: pack.MipP8UnpackUI16, Bounds: pack.Box{Size: 2}}, HasAlpha | HasPalette | HasBounds},
+		{TreeInfo{Format: pack.MipR3G3B2PackUI31, GeoReference: &pack.GeoReference{CRS: "EPSG:32633"}}, HasGeoReference},
+	} {
+		if caps := test.info.Capabilities(); caps != test.expected {
+			t.Errorf("%v: expected %v, got %v", test.info.Format, test.expected, caps)
+		}
+	}
+
+	if s := (HasAlpha | AlphaIsCoverage).String(); s != "alpha|coverage" {
+		t.Errorf("unexpected name %q", s)
+	}
+}
+
+func TestCheckTree(t *testing.T) {
+	tree := NewMutableTree(nil, 2)
+	if err := tree.SetVoxel([3]float32{0.25, 0.25, 0.25}, 1, color.RGBA{255, 0, 0, 128}); err != nil {
+		t.Fatal(err)
+	}
+
+	load := func(format pack.OctreeFormat) *TreeInfo {
+		var buf bytes.Buffer
+		if err := tree.Save(&buf, format); err != nil {
+			t.Fatal(err)
+		}
+		_, info, err := LoadOctreeWithInfo(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	// Trees without alpha are rendered opaque.
+	cfg := Config{Transparency: Composite}
+	downgrades, err := cfg.CheckTree(load(pack.MipR5G6B5UnpackUI16))
+	if err != nil || len(downgrades) != 1 || downgrades[0].Feature != "Transparency" || cfg.Transparency != Opaque {
+		t.Errorf("unexpected downgrades %v: %v, transparency %v", downgrades, err, cfg.Transparency)
+	}
+
+	cfg = Config{Transparency: Stochastic, Strict: true}
+	if _, err := cfg.CheckTree(load(pack.MipR3G3B2PackUI31)); err == nil {
+		t.Error("expected an error in strict mode")
+	} else if e, ok := err.(*DowngradeError); !ok || len(e.Downgrades) != 1 || cfg.Transparency != Stochastic {
+		t.Errorf("unexpected error %v, transparency %v", err, cfg.Transparency)
+	}
+
+	cfg = Config{Transparency: Composite, Strict: true}
+	if downgrades, err := cfg.CheckTree(load(pack.MipR4G4B4A4UnpackUI16)); err != nil || downgrades != nil || cfg.Transparency != Composite {
+		t.Errorf("unexpected downgrades %v: %v", downgrades, err)
+	}
+}
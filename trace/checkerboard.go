@@ -0,0 +1,103 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"sync/atomic"
+	"time"
+)
+
+// splitPhases copies the tiles in rt.jobs, the first phase of a Checkerboard
+// frame, for the second phase and returns the number of tiles of both.
+func (rt *Raytracer) splitPhases(idx int) int {
+	rt.phaseJobs[idx] = rt.phaseJobs[idx][:0]
+	for _, job := range rt.jobs {
+		job.phase = 1
+		rt.phaseJobs[idx] = append(rt.phaseJobs[idx], job)
+	}
+
+	atomic.StoreInt32(&rt.phasePending[idx], int32(len(rt.jobs)))
+	rt.phaseStart[idx] = time.Now()
+	rt.phaseTimes[idx] = [2]time.Duration{}
+	return 2 * len(rt.jobs)
+}
+
+// firstPhaseDone is called for every tile of the first phase and starts the
+// second phase after the last of them. Tiles of aborted frames are scheduled as
+// well, so the frame is completed.
+func (rt *Raytracer) firstPhaseDone(idx int) {
+	if atomic.AddInt32(&rt.phasePending[idx], -1) != 0 {
+		return
+	}
+
+	rt.phaseTimes[idx][0] = time.Since(rt.phaseStart[idx])
+	if rt.cfg.OnPhaseDone != nil && !rt.isAborted(idx) {
+		rt.cfg.OnPhaseDone(idx, 0)
+	}
+	rt.schedule(rt.phaseJobs[idx])
+}
+
+// lastPhaseDone is called when the last tile of a Checkerboard frame is traced.
+func (rt *Raytracer) lastPhaseDone(idx int) {
+	rt.phaseTimes[idx][1] = time.Since(rt.phaseStart[idx]) - rt.phaseTimes[idx][0]
+	if rt.cfg.OnPhaseDone != nil && !rt.isAborted(idx) {
+		rt.cfg.OnPhaseDone(idx, 1)
+	}
+}
+
+// FillCheckerboard fills the pixels of rect that are not in the Checkerboard
+// phase traced with the average of their neighbors above, below, left and right
+// inside img, which are. Phases are relative to the corner of img, like those of
+// the raytracer. The result is a usable image of a frame that only finished its
+// first phase.
+func FillCheckerboard(img *image.RGBA, rect image.Rectangle, traced int) {
+	bounds := img.Bounds()
+	rect = rect.Intersect(bounds)
+
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		x := rect.Min.X
+		if (x-bounds.Min.X+y-bounds.Min.Y+traced)%2 == 0 {
+			x++
+		}
+
+		for ; x < rect.Max.X; x += 2 {
+			var sum [4]int
+			n := 0
+			for _, d := range [4]image.Point{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+				p := image.Point{x + d.X, y + d.Y}
+				if !p.In(bounds) {
+					continue
+				}
+
+				i := img.PixOffset(p.X, p.Y)
+				for c := range sum {
+					sum[c] += int(img.Pix[i+c])
+				}
+				n++
+			}
+
+			if n > 0 {
+				i := img.PixOffset(x, y)
+				for c := range sum {
+					img.Pix[i+c] = uint8((sum[c] + n/2) / n)
+				}
+			}
+		}
+	}
+}
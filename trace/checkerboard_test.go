@@ -0,0 +1,145 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"sync"
+	"testing"
+)
+
+func TestCheckerboard(t *testing.T) {
+	tree := testSphere(4)
+	camera := LookAtCamera{Pos: Vec3{0.3, 0.6, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	rect := image.Rect(0, 0, 37, 29)
+
+	cfg := Config{
+		FieldOfView: 0.8,
+		TreeScale:   1,
+		ViewDist:    5,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+	reference, _ := renderTestFrame(tree, cfg, &camera)
+
+	var (
+		lock     sync.Mutex
+		numTiles int
+		phases   []int
+		first    *image.RGBA
+	)
+
+	cfg.Workers = 3
+	cfg.TileSize = 8
+	cfg.Checkerboard = true
+	cfg.Images = [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}
+	cfg.OnTileDone = func(frame int, r image.Rectangle) {
+		lock.Lock()
+		numTiles++
+		lock.Unlock()
+	}
+	cfg.OnPhaseDone = func(frame, phase int) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		phases = append(phases, phase)
+		if phase == 0 {
+			img := cfg.Images[frame]
+			first = image.NewRGBA(rect)
+			copy(first.Pix, img.Pix)
+		}
+	}
+
+	rt := NewRaytracer(cfg)
+	defer rt.Close()
+
+	idx := rt.Trace(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis()))
+	if err := rt.Wait(idx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The finished frame is the frame traced without phases.
+	if !bytes.Equal(reference.Pix, rt.Image(idx).Pix) {
+		t.Error("checkerboard frame differs from the full frame")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if expected := 2 * len(splitTiles(nil, rtJob{rect: rect}, rect.Max, 8)); numTiles != expected {
+		t.Errorf("expected %d tiles, got %d", expected, numTiles)
+	}
+	if len(phases) != 2 || phases[0] != 0 || phases[1] != 1 {
+		t.Fatalf("expected both phases in order, got %v", phases)
+	}
+
+	// Only the pixels of the first phase were written when it was done.
+	var missing int
+	for y := 0; y < rect.Dy(); y++ {
+		for x := 0; x < rect.Dx(); x++ {
+			c, expected := first.RGBAAt(x, y), reference.RGBAAt(x, y)
+			if (x+y)%2 == 0 && c != expected {
+				t.Fatalf("pixel %d,%d of the first phase is %v, expected %v", x, y, c, expected)
+			}
+			if (x+y)%2 == 1 && c != expected {
+				missing++
+			}
+		}
+	}
+	if missing == 0 {
+		t.Error("second phase was traced with the first")
+	}
+
+	if stats := rt.Stats(idx); stats.PhaseTimes[0] <= 0 || stats.PhaseTimes[1] <= 0 {
+		t.Errorf("expected the times of both phases, got %v", stats.PhaseTimes)
+	}
+
+	if err := (&Config{Checkerboard: true, Jitter: true, FieldOfView: 1}).Validate(); !errors.Is(err, CheckerboardError) {
+		t.Errorf("expected CheckerboardError, got %v", err)
+	}
+}
+
+func TestFillCheckerboard(t *testing.T) {
+	img := image.NewRGBA(image.Rect(10, 20, 13, 23))
+	white := color.RGBA{255, 255, 255, 255}
+	gray := color.RGBA{100, 100, 100, 255}
+
+	// The first phase has the corners and the center.
+	for _, p := range []image.Point{{0, 0}, {2, 0}, {1, 1}, {0, 2}, {2, 2}} {
+		img.SetRGBA(10+p.X, 20+p.Y, white)
+	}
+	img.SetRGBA(11, 21, gray)
+
+	FillCheckerboard(img, img.Bounds(), 0)
+
+	// Edge pixels average the two corners and the center.
+	if c := img.RGBAAt(11, 20); c != (color.RGBA{203, 203, 203, 255}) {
+		t.Errorf("unexpected edge pixel %v", c)
+	}
+	if c := img.RGBAAt(11, 21); c != gray {
+		t.Errorf("traced pixel was changed to %v", c)
+	}
+
+	// Filling the other phase averages the four edges around the center.
+	FillCheckerboard(img, image.Rect(11, 21, 12, 22), 1)
+	if c := img.RGBAAt(11, 21); c != (color.RGBA{203, 203, 203, 255}) {
+		t.Errorf("unexpected center pixel %v", c)
+	}
+}
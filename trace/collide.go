@@ -0,0 +1,115 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import "github.com/andreas-jonsson/octatron/go3d/vec3"
+
+// collideRefine is the number of bisection steps used to find the contact point
+// once a collision is found.
+const collideRefine = 8
+
+// sphereCollides reports if a sphere intersects any leaf of the tree.
+func sphereCollides(tree Octree, nodePos vec3.T, nodeScale float32, nodeIndex uint32, center *vec3.T, radius float32) bool {
+	// Squared distance from the center to the closest point of the node.
+	var dist float32
+	for i, c := range center {
+		if min := nodePos[i]; c < min {
+			dist += (min - c) * (min - c)
+		} else if max := nodePos[i] + nodeScale; c > max {
+			dist += (c - max) * (c - max)
+		}
+	}
+
+	if dist >= radius*radius {
+		return false
+	}
+
+	node := &tree[nodeIndex]
+	if node.leaf() {
+		return true
+	}
+
+	childScale := nodeScale * 0.5
+	for i := range node {
+		if child := node.getChild(i); child != 0 {
+			offset := childPositions[i].Scaled(childScale)
+			if sphereCollides(tree, vec3.Add(&nodePos, &offset), childScale, child, center, radius) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ClampMovement moves a sphere of radius along the segment from from to to and
+// returns the furthest position where it does not intersect any leaf of the tree.
+// The sphere is moved in steps of half its radius so it can not pass through thin
+// walls. If the sphere already intersects the tree at from it is not moved.
+func ClampMovement(tree Octree, treePos Vec3, treeScale float32, from, to Vec3, radius float32) Vec3 {
+	if len(tree) == 0 || radius <= 0 {
+		return to
+	}
+
+	nodePos := vec3.T(treePos)
+	start, end := vec3.T(from), vec3.T(to)
+	delta := vec3.Sub(&end, &start)
+
+	collides := func(t float32) bool {
+		d := delta.Scaled(t)
+		center := vec3.Add(&start, &d)
+		return sphereCollides(tree, nodePos, treeScale, 0, &center, radius)
+	}
+
+	if collides(0) {
+		return from
+	}
+
+	steps := int(delta.Length()/(radius*0.5)) + 1
+	free := float32(0)
+	for i := 1; i <= steps; i++ {
+		t := float32(i) / float32(steps)
+		if !collides(t) {
+			free = t
+			continue
+		}
+
+		// Bisect between the last free and the colliding position.
+		hit := t
+		for j := 0; j < collideRefine; j++ {
+			mid := (free + hit) * 0.5
+			if collides(mid) {
+				hit = mid
+			} else {
+				free = mid
+			}
+		}
+		break
+	}
+
+	d := delta.Scaled(free)
+	return Vec3(vec3.Add(&start, &d))
+}
+
+// GroundHeight drops a sphere of radius from pos along the negative y axis by at
+// most maxDrop and returns the height where it comes to rest. False is returned
+// if there is no ground within maxDrop.
+func GroundHeight(tree Octree, treePos Vec3, treeScale float32, pos Vec3, radius, maxDrop float32) (float32, bool) {
+	to := Vec3{pos[0], pos[1] - maxDrop, pos[2]}
+	rest := ClampMovement(tree, treePos, treeScale, pos, to, radius)
+	return rest[1], rest[1] > to[1]
+}
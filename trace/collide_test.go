@@ -0,0 +1,84 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image/color"
+	"math"
+	"testing"
+)
+
+// wallTree returns a tree of 8 voxels per axis with a wall at x in [0.5, 0.625) and
+// a floor at y in [0, 0.125).
+func wallTree() *MutableTree {
+	tree := NewMutableTree(nil, 8)
+	c := color.RGBA{255, 255, 255, 255}
+
+	for a := 0; a < 8; a++ {
+		for b := 0; b < 8; b++ {
+			u, v := (float32(a)+0.5)/8, (float32(b)+0.5)/8
+			if err := tree.SetVoxel([3]float32{0.5625, u, v}, 3, c); err != nil {
+				panic(err)
+			}
+			if err := tree.SetVoxel([3]float32{u, 0.0625, v}, 3, c); err != nil {
+				panic(err)
+			}
+		}
+	}
+	return tree
+}
+
+func TestClampMovement(t *testing.T) {
+	tree := wallTree().Octree()
+
+	pos := ClampMovement(tree, Vec3{}, 1, Vec3{0.1, 0.5, 0.5}, Vec3{0.9, 0.5, 0.5}, 0.05)
+	if math.Abs(float64(pos[0]-0.45)) > 0.001 || pos[1] != 0.5 || pos[2] != 0.5 {
+		t.Errorf("expected movement to stop at the wall, got %v", pos)
+	}
+
+	// Movement that does not reach the wall is not changed.
+	to := Vec3{0.3, 0.5, 0.5}
+	if pos := ClampMovement(tree, Vec3{}, 1, Vec3{0.1, 0.5, 0.5}, to, 0.05); pos != to {
+		t.Errorf("expected %v, got %v", to, pos)
+	}
+
+	// Steps longer than the wall is thick do not pass through it.
+	pos = ClampMovement(tree, Vec3{1, 0, 0}, 2, Vec3{1.2, 1, 1}, Vec3{5, 1, 1}, 0.1)
+	if math.Abs(float64(pos[0]-1.9)) > 0.002 {
+		t.Errorf("expected movement to stop at the transformed wall, got %v", pos)
+	}
+
+	// A sphere inside the wall can not move.
+	from := Vec3{0.55, 0.5, 0.5}
+	if pos := ClampMovement(tree, Vec3{}, 1, from, Vec3{0.1, 0.5, 0.5}, 0.05); pos != from {
+		t.Errorf("expected %v, got %v", from, pos)
+	}
+}
+
+func TestGroundHeight(t *testing.T) {
+	tree := wallTree().Octree()
+
+	height, ok := GroundHeight(tree, Vec3{}, 1, Vec3{0.25, 0.5, 0.5}, 0.05, 1)
+	if !ok || math.Abs(float64(height-0.175)) > 0.001 {
+		t.Errorf("expected ground at 0.175, got %v, %v", height, ok)
+	}
+
+	if _, ok := GroundHeight(tree, Vec3{}, 1, Vec3{0.25, 0.5, 0.5}, 0.05, 0.1); ok {
+		t.Error("expected no ground within the drop")
+	}
+}
@@ -0,0 +1,55 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import "github.com/andreas-jonsson/octatron/pack"
+
+// convertedCamera is a camera converted to tree space.
+type convertedCamera struct {
+	position, lookAt, up Vec3
+}
+
+func (c *convertedCamera) Position() Vec3 {
+	return c.position
+}
+
+func (c *convertedCamera) LookAt() Vec3 {
+	return c.lookAt
+}
+
+func (c *convertedCamera) Up() Vec3 {
+	return c.up
+}
+
+// treeCamera converts camera from coords to tree space. The conversions only swap
+// and negate axes, so points and directions convert alike.
+func treeCamera(camera Camera, coords pack.CoordinateSystem) Camera {
+	if coords == pack.YUpRightHanded {
+		return camera
+	}
+	return &convertedCamera{
+		toTreeSpace(coords, camera.Position()),
+		toTreeSpace(coords, camera.LookAt()),
+		toTreeSpace(coords, camera.Up()),
+	}
+}
+
+func toTreeSpace(coords pack.CoordinateSystem, v Vec3) Vec3 {
+	p := coords.ToTree(pack.Point{X: float64(v[0]), Y: float64(v[1]), Z: float64(v[2])})
+	return Vec3{float32(p.X), float32(p.Y), float32(p.Z)}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+// buildAxisTree builds three colored rows of voxels along the axes of a Y-up
+// right-handed 8^3 world, given to the builder in coords.
+func buildAxisTree(t *testing.T, coords pack.CoordinateSystem) (Octree, *TreeInfo) {
+	var samples []pack.Sample
+	for i := 0; i < 6; i++ {
+		v := float64(i) + 1.5
+		for _, s := range []pack.Sample{
+			{Pos: pack.Point{X: v, Y: 0.5, Z: 7.5}, Col: pack.Color{R: 1, A: 1}},
+			{Pos: pack.Point{X: 0.5, Y: v, Z: 7.5}, Col: pack.Color{G: 1, A: 1}},
+			{Pos: pack.Point{X: 0.5, Y: 0.5, Z: 7.5 - v}, Col: pack.Color{B: 1, A: 1}},
+		} {
+			s.Pos = coords.FromTree(s.Pos)
+			samples = append(samples, s)
+		}
+	}
+
+	var buf bytes.Buffer
+	cfg := pack.BuildConfig{
+		Worker:        pack.NewFakeWorker(samples),
+		Writer:        &buf,
+		Bounds:        coords.FromTreeBox(pack.Box{Size: 8}),
+		Coordinates:   coords,
+		VoxelsPerAxis: 8,
+		Format:        pack.MipR8G8B8A8UnpackUI32,
+	}
+	if _, err := pack.BuildTree(&cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, info, err := LoadOctreeWithInfo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree, info
+}
+
+func TestCoordinates(t *testing.T) {
+	render := func(tree Octree, info *TreeInfo, coords pack.CoordinateSystem, camera Camera) *image.RGBA {
+		rect := image.Rect(0, 0, 48, 32)
+		cfg := Config{
+			FieldOfViewDegrees: 60,
+			Coordinates:        coords,
+			Images:             [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		}
+		cfg.FitTree(info)
+		cfg.ViewDist = 100
+
+		rt := NewRaytracer(cfg)
+		defer rt.Close()
+		rt.SetClearColor(testClearColor)
+		return rt.Image(rt.Trace(camera, tree, info.Depth))
+	}
+
+	// The camera looks at the corner of the rows from the front, up and to the
+	// right, with y up.
+	pos, look, up := Vec3{14, 10, 16}, Vec3{2, 2, 6}, Vec3{0, 1, 0}
+
+	tree, info := buildAxisTree(t, pack.YUpRightHanded)
+	expected := render(tree, info, pack.YUpRightHanded, &convertedCamera{pos, look, up})
+	if countDiff(expected, render(tree, info, pack.YUpRightHanded, &LookAtCamera{pos, look})) != 0 {
+		t.Fatal("expected the camera to render like a LookAtCamera")
+	}
+
+	var colors [3]bool
+	for i := 0; i < len(expected.Pix); i += 4 {
+		for c := range colors {
+			colors[c] = colors[c] || expected.Pix[i+c] > 100
+		}
+	}
+	if colors != [3]bool{true, true, true} {
+		t.Fatal("expected all three rows in the image")
+	}
+
+	for _, coords := range []pack.CoordinateSystem{pack.ZUpRightHanded, pack.ZUpLeftHanded} {
+		tree, info := buildAxisTree(t, coords)
+		if info.Coordinates != coords {
+			t.Errorf("%v: expected the convention in the tree info, got %v", coords, info.Coordinates)
+		}
+
+		camera := &convertedCamera{fromTreeSpace(coords, pos), fromTreeSpace(coords, look), fromTreeSpace(coords, up)}
+		if n := countDiff(expected, render(tree, info, coords, camera)); n != 0 {
+			t.Errorf("%v: expected the image of the Y-up tree, %d pixels differ", coords, n)
+		}
+
+		// Without the convention the camera is somewhere else.
+		if countDiff(expected, render(tree, info, pack.YUpRightHanded, camera)) == 0 {
+			t.Errorf("%v: expected the camera to be converted", coords)
+		}
+	}
+
+	cfg := Config{FieldOfViewDegrees: 60, Coordinates: pack.ZUpLeftHanded + 1}
+	if err := cfg.Validate(); !errors.Is(err, InvalidCoordinatesError) {
+		t.Error("expected InvalidCoordinatesError, got", err)
+	}
+}
+
+func fromTreeSpace(coords pack.CoordinateSystem, v Vec3) Vec3 {
+	p := coords.FromTree(pack.Point{X: float64(v[0]), Y: float64(v[1]), Z: float64(v[2])})
+	return Vec3{float32(p.X), float32(p.Y), float32(p.Z)}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image/color"
+	"image/draw"
+	"math/bits"
+)
+
+// costPalette colors the number of visited nodes on a log scale, entry i is used
+// for up to 2^i-1 visits. The colors are boxed once so writing them does not
+// allocate.
+var costPalette = [...]color.Color{
+	color.RGBA{0, 0, 0, 255},
+	color.RGBA{0, 0, 96, 255},
+	color.RGBA{0, 0, 192, 255},
+	color.RGBA{0, 96, 255, 255},
+	color.RGBA{0, 192, 255, 255},
+	color.RGBA{0, 255, 160, 255},
+	color.RGBA{0, 255, 0, 255},
+	color.RGBA{160, 255, 0, 255},
+	color.RGBA{255, 255, 0, 255},
+	color.RGBA{255, 160, 0, 255},
+	color.RGBA{255, 0, 0, 255},
+	color.RGBA{255, 0, 160, 255},
+	color.RGBA{255, 255, 255, 255},
+}
+
+func costLevel(visits uint64) int {
+	level := bits.Len64(visits)
+	if level >= len(costPalette) {
+		level = len(costPalette) - 1
+	}
+	return level
+}
+
+// writeCost stores the traversal cost of the pixel at dx, dy of the frame buffers.
+func (rt *Raytracer) writeCost(img draw.Image, dx, dy int, visits uint64) {
+	img.Set(dx+rt.origin.X, dy+rt.origin.Y, costPalette[costLevel(visits)])
+}
+
+// SetCostImage replaces Config.CostImage. Frames in flight are completed first.
+func (rt *Raytracer) SetCostImage(img draw.Image) {
+	rt.traceLock.Lock()
+	defer rt.traceLock.Unlock()
+
+	rt.wait(0)
+	rt.wait(1)
+	rt.cfg.CostImage = img
+}
@@ -0,0 +1,65 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"testing"
+)
+
+func costAt(img *image.RGBA, x, y int) int {
+	c := img.RGBAAt(x, y)
+	for i, p := range costPalette {
+		if p == c {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestCostImage(t *testing.T) {
+	tree := testSphere(5)
+	rect := image.Rect(0, 0, 32, 32)
+	cost := image.NewRGBA(rect)
+
+	cfg := Config{
+		FieldOfView: 0.8,
+		TreeScale:   1,
+		ViewDist:    10,
+		Packets:     true,
+		CostImage:   cost,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+
+	// The sphere covers the center of the image, the corners look past the tree.
+	camera := LookAtCamera{Pos: Vec3{0.5, 0.5, 4}, Look: Vec3{0.5, 0.5, 0.5}}
+	renderTestFrame(tree, cfg, &camera)
+
+	empty, hit := costAt(cost, 1, 1), costAt(cost, 16, 16)
+	if empty < 0 || hit < 0 {
+		t.Fatalf("cost image has colors outside of the palette: %v, %v", cost.RGBAAt(1, 1), cost.RGBAAt(16, 16))
+	}
+
+	if hit <= empty {
+		t.Errorf("expected a ray hitting a leaf to cost more than one through empty space, got %d and %d", hit, empty)
+	}
+
+	if level := costLevel(1 << 40); level != len(costPalette)-1 {
+		t.Errorf("expected large costs to use the last color, got %d", level)
+	}
+}
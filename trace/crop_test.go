@@ -0,0 +1,131 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+// buildGradientTree encodes a solid tree filling bounds, with the color of every
+// voxel given by its position.
+func buildGradientTree(bounds pack.Box, vpa int) []byte {
+	var samples []pack.Sample
+	step := bounds.Size / float64(vpa)
+	for z := 0; z < vpa; z++ {
+		for y := 0; y < vpa; y++ {
+			for x := 0; x < vpa; x++ {
+				pos := pack.Point{
+					X: bounds.Pos.X + (float64(x)+0.5)*step,
+					Y: bounds.Pos.Y + (float64(y)+0.5)*step,
+					Z: bounds.Pos.Z + (float64(z)+0.5)*step,
+				}
+				col := pack.Color{R: float32(x) / float32(vpa), G: float32(y) / float32(vpa), B: float32(z) / float32(vpa), A: 1}
+				samples = append(samples, pack.Sample{Pos: pos, Col: col})
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	cfg := pack.BuildConfig{
+		Worker:        pack.NewFakeWorker(samples),
+		Writer:        &buf,
+		Bounds:        bounds,
+		VoxelsPerAxis: vpa,
+		Format:        pack.MipR8G8B8A8UnpackUI32,
+	}
+	if _, err := pack.BuildTree(&cfg); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCropTreeRender(t *testing.T) {
+	bounds := pack.Box{Pos: pack.Point{X: 0, Y: 0, Z: 0}, Size: 16}
+	data := buildGradientTree(bounds, 8)
+	full, fullInfo, err := LoadOctreeWithInfo(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fp, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		fp.Close()
+		os.Remove(fp.Name())
+	}()
+
+	// The region is the front octant of the lower right, which hides the rest
+	// of the tree behind it.
+	region := pack.Box{Pos: pack.Point{X: 9, Y: 1, Z: 9}, Size: 6}
+	if _, err := pack.CropTree(bytes.NewReader(data), fp, region, bounds); err != nil {
+		t.Fatal(err)
+	}
+	fp.Seek(0, 0)
+	cropped, croppedInfo, err := LoadOctreeWithInfo(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (pack.Box{Pos: pack.Point{X: 8, Y: 0, Z: 8}, Size: 8}); croppedInfo.Bounds != expected {
+		t.Fatalf("expected the cropped tree to cover %+v, got %+v", expected, croppedInfo.Bounds)
+	}
+
+	// Both trees are placed by their bounds and seen by a camera framing the
+	// cropped tree.
+	camera := FrameTree(croppedInfo, Vec3{0, 0, -1})
+	render := func(tree Octree, info *TreeInfo) *image.RGBA {
+		rect := image.Rect(0, 0, 32, 32)
+		cfg := Config{
+			FieldOfViewDegrees: 45,
+			ViewDist:           1000,
+			Images:             [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		}
+		cfg.FitTree(info)
+
+		rt := NewRaytracer(cfg)
+		defer rt.Close()
+		rt.SetClearColor(testClearColor)
+		return rt.Image(rt.Trace(&camera, tree, info.Depth))
+	}
+	fullImage, croppedImage := render(full, fullInfo), render(cropped, croppedInfo)
+
+	// The alpha of the pixels is the class of the nodes.
+	hits := 0
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			c := croppedImage.RGBAAt(x, y)
+			if c == testClearColor {
+				continue
+			}
+			hits++
+			if f := fullImage.RGBAAt(x, y); c.R != f.R || c.G != f.G || c.B != f.B {
+				t.Errorf("pixel %d,%d of the cropped tree is %v, the full tree %v", x, y, c, f)
+			}
+		}
+	}
+	if hits < 16*16 {
+		t.Errorf("expected the cropped tree to cover the center of the image, it covers %d pixels", hits)
+	}
+}
@@ -0,0 +1,540 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image/color"
+	"io"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+// MutableTree wraps an Octree and allows voxels to be added and removed.
+// Positions are given in tree space where the root node covers [0,1) on all axis.
+//
+// Optimized trees share nodes between parents. Their nodes are copied before they
+// are edited, so the other parents keep the old subtree.
+type MutableTree struct {
+	tree Octree
+	free []uint32
+	vpa  int
+
+	// refs is the number of parents of every node when dag is set, computed on
+	// the first edit.
+	dag  bool
+	refs []uint32
+
+	// frozen is set when the nodes are shared with a snapshot, they are copied
+	// before the next edit.
+	frozen bool
+}
+
+// NewMutableTree wraps tree, which must not share nodes. Optimized trees are
+// loaded with LoadMutableTree.
+func NewMutableTree(tree Octree, voxelsPerAxis int) *MutableTree {
+	return &MutableTree{tree: tree, vpa: voxelsPerAxis}
+}
+
+// LoadMutableTree reads a tree for editing like LoadOctreeWithInfo. Shared nodes
+// of optimized trees are copied when they are edited.
+func LoadMutableTree(reader io.Reader) (*MutableTree, *TreeInfo, error) {
+	tree, info, err := LoadOctreeWithInfo(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewMutableTreeWithInfo(tree, info), info, nil
+}
+
+// NewMutableTreeWithInfo wraps tree, loaded with the info returned by
+// LoadOctreeWithInfo. Shared nodes of optimized trees are copied when they are
+// edited.
+func NewMutableTreeWithInfo(tree Octree, info *TreeInfo) *MutableTree {
+	t := NewMutableTree(tree, info.VoxelsPerAxis)
+	t.dag = info.Optimized
+	return t
+}
+
+// Octree returns the current tree. It can be passed directly to Raytracer.Trace, but
+// is changed by the next edit. Frames rendered while the tree is edited should use
+// a Snapshot.
+func (t *MutableTree) Octree() Octree {
+	return t.tree
+}
+
+func (t *MutableTree) VoxelsPerAxis() int {
+	return t.vpa
+}
+
+func (n *octreeNode) setChild(i int, child uint32) {
+	n[i] = (n[i] &^ maxUint28) | child
+}
+
+// setRGBA sets the color of the node and clears its classification code.
+func (n *octreeNode) setRGBA(c color.RGBA) {
+	n.setRawColor(color.RGBA{c.R, c.G, c.B, 0})
+}
+
+func (n *octreeNode) numChildren() int {
+	num := 0
+	for i := range n {
+		if n.getChild(i) != 0 {
+			num++
+		}
+	}
+	return num
+}
+
+func octant(pos *[3]float32, scale float32) (int, [3]float32) {
+	var (
+		idx int
+		p   = *pos
+	)
+
+	for axis := 0; axis < 3; axis++ {
+		if p[axis] >= scale {
+			idx |= 1 << uint(axis)
+			p[axis] -= scale
+		}
+	}
+	return idx, p
+}
+
+func (t *MutableTree) alloc() (uint32, error) {
+	if n := len(t.free); n > 0 {
+		idx := t.free[n-1]
+		t.free = t.free[:n-1]
+		if t.refs != nil {
+			t.refs[idx] = 1
+		}
+		return idx, nil
+	}
+
+	idx := len(t.tree)
+	if idx > maxUint28 {
+		return 0, Uint28OverflowError
+	}
+
+	t.tree = append(t.tree, octreeNode{})
+	if t.refs != nil {
+		t.refs = append(t.refs, 1)
+	}
+	return uint32(idx), nil
+}
+
+// countRefs computes the number of parents of every node of a shared tree. A
+// node listed twice by the same parent has two references.
+func (t *MutableTree) countRefs() error {
+	if !t.dag || t.refs != nil || len(t.tree) == 0 {
+		return nil
+	}
+
+	// Nodes are on the stack while their subtree is walked, a child found on
+	// the stack is its own ancestor.
+	const (
+		unvisited = iota
+		onStack
+		visited
+	)
+
+	type frame struct {
+		idx  uint32
+		slot int
+	}
+
+	refs := make([]uint32, len(t.tree))
+	state := make([]uint8, len(t.tree))
+	stack := []frame{{0, 0}}
+	refs[0], state[0] = 1, onStack
+
+	for len(stack) > 0 {
+		f := &stack[len(stack)-1]
+		if f.slot == 8 {
+			state[f.idx] = visited
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		child := t.tree[f.idx].getChild(f.slot)
+		f.slot++
+		if child == 0 {
+			continue
+		}
+		if int64(child) >= int64(len(t.tree)) {
+			return OutOfBoundsError
+		}
+
+		refs[child]++
+		switch state[child] {
+		case onStack:
+			return CyclicTreeError
+		case unvisited:
+			state[child] = onStack
+			stack = append(stack, frame{child, 0})
+		}
+	}
+
+	t.refs = refs
+	return nil
+}
+
+// own returns the child of parent at slot, which is copied first if it has other
+// parents. The children of the copy are shared with the original.
+func (t *MutableTree) own(parent uint32, slot int) (uint32, error) {
+	child := t.tree[parent].getChild(slot)
+	if t.refs == nil || child == 0 || t.refs[child] <= 1 {
+		return child, nil
+	}
+
+	idx, err := t.alloc()
+	if err != nil {
+		return 0, err
+	}
+
+	t.tree[idx] = t.tree[child]
+	node := &t.tree[idx]
+	for i := range node {
+		if c := node.getChild(i); c != 0 {
+			t.refs[c]++
+		}
+	}
+
+	t.refs[child]--
+	t.tree[parent].setChild(slot, idx)
+	return idx, nil
+}
+
+// release frees the node and its subtree. Nodes of shared trees are only freed
+// when they lose their last parent.
+func (t *MutableTree) release(idx uint32) {
+	if t.refs != nil {
+		if t.refs[idx]--; t.refs[idx] > 0 {
+			return
+		}
+	}
+
+	node := &t.tree[idx]
+	for i := range node {
+		if child := node.getChild(i); child != 0 {
+			t.release(child)
+		}
+	}
+
+	*node = octreeNode{}
+	t.free = append(t.free, idx)
+}
+
+func (t *MutableTree) updateColors(path []uint32) {
+	for i := len(path) - 1; i >= 0; i-- {
+		node := &t.tree[path[i]]
+
+		var r, g, b, n int
+		for j := range node {
+			if child := node.getChild(j); child != 0 {
+				c := t.tree[child].getColor()
+				r += int(c.R)
+				g += int(c.G)
+				b += int(c.B)
+				n++
+			}
+		}
+
+		if n > 0 {
+			node.setRGBA(color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), 255})
+		}
+	}
+}
+
+func (t *MutableTree) split(idx uint32) error {
+	c := t.tree[idx].getColor()
+	for i := 0; i < 8; i++ {
+		child, err := t.alloc()
+		if err != nil {
+			return err
+		}
+
+		t.tree[child].setRGBA(c)
+		t.tree[idx].setChild(i, child)
+	}
+	return nil
+}
+
+// SetVoxel sets the color of the voxel containing pos at depth. Intermediate nodes are
+// created as needed and existing leafs along the path are subdivided.
+func (t *MutableTree) SetVoxel(pos [3]float32, depth int, c color.RGBA) error {
+	if !insideUnitCube(pos) {
+		return OutOfBoundsError
+	}
+
+	if err := t.countRefs(); err != nil {
+		return err
+	}
+
+	t.thaw()
+	created := len(t.tree) == 0
+	if created {
+		t.tree = append(t.tree, octreeNode{})
+	}
+
+	var (
+		idx   uint32
+		path  []uint32
+		scale float32 = 0.5
+	)
+
+	for d := 0; d < depth; d++ {
+		node := &t.tree[idx]
+		if !created && node.numChildren() == 0 {
+			if err := t.split(idx); err != nil {
+				return err
+			}
+			node = &t.tree[idx]
+		}
+
+		var i int
+		i, pos = octant(&pos, scale)
+		path = append(path, idx)
+
+		child, err := t.own(idx, i)
+		if err != nil {
+			return err
+		}
+		created = child == 0
+
+		if created {
+			if child, err = t.alloc(); err != nil {
+				return err
+			}
+			t.tree[idx].setChild(i, child)
+		}
+
+		idx = child
+		scale *= 0.5
+	}
+
+	node := &t.tree[idx]
+	for i := range node {
+		if child := node.getChild(i); child != 0 {
+			t.release(child)
+			node.setChild(i, 0)
+		}
+	}
+
+	node.setRGBA(c)
+	t.updateColors(path)
+	return nil
+}
+
+// ClearVoxel removes the voxel containing pos at depth. Nodes left without children are
+// removed as well.
+func (t *MutableTree) ClearVoxel(pos [3]float32, depth int) error {
+	if !insideUnitCube(pos) {
+		return OutOfBoundsError
+	}
+
+	if len(t.tree) == 0 {
+		return nil
+	}
+
+	if err := t.countRefs(); err != nil {
+		return err
+	}
+
+	t.thaw()
+	var (
+		idx   uint32
+		path  []uint32
+		slots []int
+		scale float32 = 0.5
+	)
+
+	for d := 0; d < depth; d++ {
+		if t.tree[idx].numChildren() == 0 {
+			if err := t.split(idx); err != nil {
+				return err
+			}
+		}
+
+		var i int
+		i, pos = octant(&pos, scale)
+		path = append(path, idx)
+		slots = append(slots, i)
+
+		child := t.tree[idx].getChild(i)
+		if child == 0 {
+			return nil
+		}
+
+		// The voxel is released, only the nodes above it are edited.
+		if d < depth-1 {
+			var err error
+			if child, err = t.own(idx, i); err != nil {
+				return err
+			}
+		}
+
+		idx = child
+		scale *= 0.5
+	}
+
+	if len(path) == 0 {
+		t.tree = t.tree[:0]
+		t.free = t.free[:0]
+		t.refs = nil
+		return nil
+	}
+
+	t.release(idx)
+	for i := len(path) - 1; i >= 0; i-- {
+		parent := &t.tree[path[i]]
+		parent.setChild(slots[i], 0)
+
+		if parent.numChildren() > 0 {
+			t.updateColors(path[:i+1])
+			return nil
+		}
+
+		if i > 0 {
+			t.release(path[i])
+		}
+	}
+
+	// The whole tree was removed.
+	t.tree = t.tree[:0]
+	t.free = t.free[:0]
+	t.refs = nil
+	return nil
+}
+
+func insideUnitCube(pos [3]float32) bool {
+	for _, v := range pos {
+		if !(v >= 0 && v < 1) {
+			return false
+		}
+	}
+	return true
+}
+
+// Compact moves the nodes reachable from the root to a new dense slice in
+// breadth-first order and returns the number of nodes reclaimed. The previous
+// slice is left as it was, so frames in flight keep rendering it, but the new
+// Octree must be given to the raytracer before the tree is edited again since
+// node indices change.
+func (t *MutableTree) Compact() int {
+	t.free = nil
+	if len(t.tree) == 0 {
+		return 0
+	}
+
+	// Shared nodes are kept shared, they are only added to the order once.
+	order := []uint32{0}
+	seen := make([]bool, len(t.tree))
+	seen[0] = true
+	for i := 0; i < len(order); i++ {
+		node := &t.tree[order[i]]
+		for j := range node {
+			if child := node.getChild(j); child != 0 && !seen[child] {
+				seen[child] = true
+				order = append(order, child)
+			}
+		}
+	}
+
+	remap := make([]uint32, len(t.tree))
+	for i, idx := range order {
+		remap[idx] = uint32(i)
+	}
+
+	if t.refs != nil {
+		refs := make([]uint32, len(order))
+		for i, idx := range order {
+			refs[i] = t.refs[idx]
+		}
+		t.refs = refs
+	}
+
+	tree := make(Octree, len(order))
+	for i, idx := range order {
+		node := t.tree[idx]
+		for j := range node {
+			if child := node.getChild(j); child != 0 {
+				node.setChild(j, remap[child])
+			}
+		}
+		tree[i] = node
+	}
+
+	reclaimed := len(t.tree) - len(tree)
+	t.tree, t.frozen = tree, false
+	return reclaimed
+}
+
+// SaveOptions changes how MutableTree.SaveWithOptions writes a tree.
+type SaveOptions struct {
+	// NoCompact writes the nodes as they are, including the ones released by
+	// edits, and keeps the node indices.
+	NoCompact bool
+
+	// Info, if set, is the info the tree was loaded with. Its coordinate system,
+	// bounds and geo reference are written to the header.
+	Info *TreeInfo
+}
+
+// Save writes the tree using the pack encoder. The tree is compacted first.
+func (t *MutableTree) Save(writer io.Writer, format pack.OctreeFormat) error {
+	return t.SaveWithOptions(writer, format, SaveOptions{})
+}
+
+// SaveWithOptions works like Save with options.
+func (t *MutableTree) SaveWithOptions(writer io.Writer, format pack.OctreeFormat, opts SaveOptions) error {
+	if !opts.NoCompact {
+		t.Compact()
+	}
+
+	header := pack.NewOctreeHeader(format, t.vpa)
+	header.NumNodes = uint64(len(t.tree))
+	if info := opts.Info; info != nil {
+		header.Coordinates, header.Bounds, header.GeoReference = info.Coordinates, info.Bounds, info.GeoReference
+	}
+
+	for i := range t.tree {
+		if t.tree[i].numChildren() == 0 {
+			header.NumLeafs++
+		}
+	}
+	header.NumLeafs -= uint64(len(t.free))
+
+	if err := pack.EncodeHeader(writer, header); err != nil {
+		return err
+	}
+
+	var children [8]pack.NodeIndex
+	for i := range t.tree {
+		node := &t.tree[i]
+		for j := range children {
+			children[j] = pack.NodeIndex(node.getChild(j))
+		}
+
+		c := node.getColor()
+		col := pack.Color{R: float32(c.R) / 255, G: float32(c.G) / 255, B: float32(c.B) / 255, A: 1}
+
+		if err := pack.EncodeNodeAt(writer, format, pack.NodeIndex(i), col, children[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
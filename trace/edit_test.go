@@ -0,0 +1,436 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+var testClearColor = color.RGBA{1, 2, 3, 255}
+
+func solidCube(depth int, c color.RGBA) *MutableTree {
+	tree := NewMutableTree(nil, 1<<uint(depth))
+	res := 1 << uint(depth)
+	size := 1 / float32(res)
+
+	for z := 0; z < res; z++ {
+		for y := 0; y < res; y++ {
+			for x := 0; x < res; x++ {
+				pos := [3]float32{(float32(x) + 0.5) * size, (float32(y) + 0.5) * size, (float32(z) + 0.5) * size}
+				if err := tree.SetVoxel(pos, depth, c); err != nil {
+					panic(err)
+				}
+			}
+		}
+	}
+	return tree
+}
+
+func renderCenter(tree Octree, vpa int, pos, look Vec3) color.RGBA {
+	rect := image.Rect(0, 0, 8, 8)
+	cfg := Config{
+		FieldOfView: 0.2,
+		TreeScale:   1,
+		ViewDist:    10,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+
+	rt := NewRaytracer(cfg)
+	defer rt.Close()
+	rt.SetClearColor(testClearColor)
+
+	camera := LookAtCamera{Pos: pos, Look: look}
+	idx := rt.Trace(&camera, tree, TreeWidthToDepth(vpa))
+	return rt.Image(idx).RGBAAt(4, 4)
+}
+
+func TestCarveHole(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	tree := solidCube(2, red)
+
+	if n := len(tree.Octree()); n != 1+8+64 {
+		t.Fatalf("unexpected number of nodes: %v", n)
+	}
+
+	eye, look := Vec3{0.375, 0.375, 2}, Vec3{0.375, 0.375, 0}
+	if c := renderCenter(tree.Octree(), tree.VoxelsPerAxis(), eye, look); c.R != red.R || c.G != red.G || c.B != red.B {
+		t.Fatalf("expected hit, got %v", c)
+	}
+
+	for z := 0; z < 4; z++ {
+		if err := tree.ClearVoxel([3]float32{0.375, 0.375, float32(z)*0.25 + 0.1}, 2); err != nil {
+			panic(err)
+		}
+	}
+
+	if c := renderCenter(tree.Octree(), tree.VoxelsPerAxis(), eye, look); c != testClearColor {
+		t.Fatalf("expected miss, got %v", c)
+	}
+
+	var buf bytes.Buffer
+	if err := tree.Save(&buf, pack.MipR8G8B8A8UnpackUI32); err != nil {
+		panic(err)
+	}
+
+	loaded, vpa, err := LoadOctree(&buf)
+	if err != nil {
+		panic(err)
+	}
+
+	if c := renderCenter(loaded, vpa, eye, look); c != testClearColor {
+		t.Fatalf("expected miss in saved tree, got %v", c)
+	}
+
+	if c := renderCenter(loaded, vpa, Vec3{0.875, 0.875, 2}, Vec3{0.875, 0.875, 0}); c.R != red.R {
+		t.Fatalf("expected hit in saved tree, got %v", c)
+	}
+}
+
+func TestClearSubdividesLeaf(t *testing.T) {
+	tree := solidCube(1, color.RGBA{0, 255, 0, 255})
+	if err := tree.ClearVoxel([3]float32{0.1, 0.1, 0.1}, 2); err != nil {
+		panic(err)
+	}
+
+	root := tree.Octree()[0]
+	first := tree.Octree()[root.getChild(0)]
+	if n := first.numChildren(); n != 7 {
+		t.Fatalf("expected 7 children, got %v", n)
+	}
+
+	for z := 0; z < 2; z++ {
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 2; x++ {
+				pos := [3]float32{float32(x)*0.5 + 0.25, float32(y)*0.5 + 0.25, float32(z)*0.5 + 0.25}
+				if err := tree.ClearVoxel(pos, 1); err != nil {
+					panic(err)
+				}
+			}
+		}
+	}
+
+	if n := len(tree.Octree()); n != 0 {
+		t.Fatalf("expected empty tree, got %v nodes", n)
+	}
+}
+
+func renderImage(tree Octree, vpa int) []byte {
+	rect := image.Rect(0, 0, 32, 32)
+	rt := NewRaytracer(Config{
+		FieldOfView: 1,
+		TreeScale:   1,
+		ViewDist:    10,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	defer rt.Close()
+	rt.SetClearColor(testClearColor)
+
+	camera := LookAtCamera{Pos: Vec3{1.4, 1.2, 1.6}, Look: Vec3{0.5, 0.5, 0.5}}
+	return rt.Image(rt.Trace(&camera, tree, TreeWidthToDepth(vpa))).Pix
+}
+
+func reachable(tree Octree, idx uint32) int {
+	n := 1
+	for i := range tree[idx] {
+		if child := tree[idx].getChild(i); child != 0 {
+			n += reachable(tree, child)
+		}
+	}
+	return n
+}
+
+func TestCompact(t *testing.T) {
+	const depth = 3
+	tree := solidCube(depth, color.RGBA{200, 100, 50, 255})
+	size := float32(1) / (1 << depth)
+
+	// Carve and refill voxels so released nodes are reused and left over.
+	for i := 0; i < 200; i++ {
+		x, y, z := (i*7)%8, (i*3)%8, (i*5)%8
+		pos := [3]float32{(float32(x) + 0.5) * size, (float32(y) + 0.5) * size, (float32(z) + 0.5) * size}
+		if err := tree.ClearVoxel(pos, depth); err != nil {
+			panic(err)
+		}
+		if i%3 == 0 {
+			if err := tree.SetVoxel(pos, depth, color.RGBA{50, 100, 200, 255}); err != nil {
+				panic(err)
+			}
+		}
+	}
+	if err := tree.ClearVoxel([3]float32{0.7, 0.7, 0.7}, 1); err != nil {
+		panic(err)
+	}
+
+	before := tree.Octree()
+	live := reachable(before, 0)
+	if live == len(before) {
+		t.Fatal("edits left no garbage")
+	}
+
+	var uncompacted bytes.Buffer
+	if err := tree.SaveWithOptions(&uncompacted, pack.MipR8G8B8A8UnpackUI32, SaveOptions{NoCompact: true}); err != nil {
+		panic(err)
+	}
+	if len(tree.Octree()) != len(before) {
+		t.Error("tree compacted with NoCompact")
+	}
+
+	img := renderImage(before, tree.VoxelsPerAxis())
+
+	if n := tree.Compact(); n != len(before)-live {
+		t.Errorf("reclaimed %d nodes, expected %d", n, len(before)-live)
+	}
+
+	after := tree.Octree()
+	if len(after) != live || reachable(after, 0) != live {
+		t.Errorf("%d nodes after compaction, %d reachable", len(after), live)
+	}
+	if !bytes.Equal(img, renderImage(after, tree.VoxelsPerAxis())) {
+		t.Error("compaction changed the render")
+	}
+
+	// The previous slice is untouched, frames in flight can keep using it.
+	if !bytes.Equal(img, renderImage(before, tree.VoxelsPerAxis())) {
+		t.Error("compaction changed the previous tree")
+	}
+
+	if n := tree.Compact(); n != 0 {
+		t.Errorf("compacted tree reclaimed %d nodes", n)
+	}
+
+	// Edits keep working on the compacted tree.
+	if err := tree.SetVoxel([3]float32{0.9, 0.9, 0.9}, depth, color.RGBA{255, 255, 255, 255}); err != nil {
+		panic(err)
+	}
+
+	var compacted bytes.Buffer
+	if err := tree.Save(&compacted, pack.MipR8G8B8A8UnpackUI32); err != nil {
+		panic(err)
+	}
+
+	loaded, vpa, err := LoadOctree(&compacted)
+	if err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(renderImage(loaded, vpa), renderImage(tree.Octree(), tree.VoxelsPerAxis())) {
+		t.Error("saved tree renders differently")
+	}
+
+	old, _, err := LoadOctree(&uncompacted)
+	if err != nil {
+		panic(err)
+	}
+	if len(old) != len(before) || len(loaded) >= len(old) {
+		t.Errorf("saved %d nodes compacted and %d uncompacted", len(loaded), len(old))
+	}
+}
+
+// optimizedFlag returns the header flag of trees written by the optimizer.
+func optimizedFlag() byte {
+	var buf, optimized bytes.Buffer
+	if err := solidCube(1, color.RGBA{255, 0, 0, 255}).Save(&buf, pack.MipR8G8B8A8UnpackUI32); err != nil {
+		panic(err)
+	}
+	if _, err := pack.OptimizeTree(bytes.NewReader(buf.Bytes()), &optimized, pack.MipR8G8B8A8UnpackUI32, 0, false); err != nil {
+		panic(err)
+	}
+
+	var plain, header pack.OctreeHeader
+	if err := pack.DecodeHeader(bytes.NewReader(buf.Bytes()), &plain); err != nil {
+		panic(err)
+	}
+	if err := pack.DecodeHeader(&optimized, &header); err != nil {
+		panic(err)
+	}
+	return header.Flags &^ plain.Flags
+}
+
+// sharedTree returns an optimized tree where octant zero and one of the root
+// share their subtree, a green voxel next to a blue one.
+func sharedTree() *MutableTree {
+	octree := make(Octree, 4)
+	octree[0].setChild(0, 1)
+	octree[0].setChild(1, 1)
+	octree[1].setChild(0, 2)
+	octree[1].setChild(1, 3)
+	octree[2].setRGBA(color.RGBA{0, 255, 0, 255})
+	octree[3].setRGBA(color.RGBA{0, 0, 255, 255})
+
+	tree := NewMutableTree(octree, 4)
+	tree.updateColors([]uint32{0, 1})
+
+	var buf bytes.Buffer
+	if err := tree.SaveWithOptions(&buf, pack.MipR8G8B8A8UnpackUI32, SaveOptions{NoCompact: true}); err != nil {
+		panic(err)
+	}
+
+	// Mark the tree as optimized.
+	var header pack.OctreeHeader
+	if err := pack.DecodeHeader(&buf, &header); err != nil {
+		panic(err)
+	}
+	header.Flags |= optimizedFlag()
+
+	var optimized bytes.Buffer
+	if err := pack.EncodeHeader(&optimized, header); err != nil {
+		panic(err)
+	}
+	optimized.Write(buf.Bytes())
+
+	shared, info, err := LoadMutableTree(&optimized)
+	if err != nil {
+		panic(err)
+	}
+	if !info.Optimized {
+		panic("tree is not optimized")
+	}
+	return shared
+}
+
+// rgbAt returns the color of the deepest node of tree at pos.
+func rgbAt(tree Octree, pos [3]float32) [3]uint8 {
+	idx, _, ok := tree.NodeAt(pos, [3]float32{}, 1, 8)
+	if !ok {
+		return [3]uint8{}
+	}
+	c := tree[idx].getColor()
+	return [3]uint8{c.R, c.G, c.B}
+}
+
+func TestEditSharedTree(t *testing.T) {
+	var (
+		red   = color.RGBA{255, 0, 0, 255}
+		green = [3]uint8{0, 255, 0}
+		blue  = [3]uint8{0, 0, 255}
+	)
+
+	tree := sharedTree()
+	if err := tree.SetVoxel([3]float32{0.125, 0.125, 0.125}, 2, red); err != nil {
+		t.Fatal(err)
+	}
+
+	octree := tree.Octree()
+	if c := rgbAt(octree, [3]float32{0.125, 0.125, 0.125}); c != [3]uint8{255, 0, 0} {
+		t.Errorf("edited voxel is %v", c)
+	}
+	if c := rgbAt(octree, [3]float32{0.625, 0.125, 0.125}); c != green {
+		t.Errorf("voxel of the other instance changed to %v", c)
+	}
+	if c := rgbAt(octree, [3]float32{0.375, 0.125, 0.125}); c != blue {
+		t.Errorf("copied sibling is %v", c)
+	}
+
+	if err := tree.ClearVoxel([3]float32{0.875, 0.125, 0.125}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if c := rgbAt(tree.Octree(), [3]float32{0.375, 0.125, 0.125}); c != blue {
+		t.Errorf("clearing the other instance changed the voxel to %v", c)
+	}
+
+	// The same voxels set in a tree without shared nodes render the same.
+	reference := NewMutableTree(nil, 4)
+	for _, v := range []struct {
+		pos [3]float32
+		c   color.RGBA
+	}{
+		{[3]float32{0.125, 0.125, 0.125}, red},
+		{[3]float32{0.375, 0.125, 0.125}, color.RGBA{0, 0, 255, 255}},
+		{[3]float32{0.625, 0.125, 0.125}, color.RGBA{0, 255, 0, 255}},
+	} {
+		if err := reference.SetVoxel(v.pos, 2, v.c); err != nil {
+			panic(err)
+		}
+	}
+
+	for _, camera := range goldenCameras[:2] {
+		a := renderGolden(tree, camera.camera, 1, func(cfg *Config) {})
+		b := renderGolden(reference, camera.camera, 1, func(cfg *Config) {})
+		if n := countChanged(a, b, goldenTolerance); n > 0 {
+			t.Errorf("%s: %d pixels differ from the reference", camera.name, n)
+		}
+	}
+
+	// The blue voxel is still shared, compaction keeps it that way.
+	tree.Compact()
+	if n := len(tree.Octree()); n != 6 {
+		t.Errorf("expected 6 nodes after compaction, got %d", n)
+	}
+	if err := tree.SetVoxel([3]float32{0.625, 0.125, 0.125}, 2, red); err != nil {
+		t.Fatal(err)
+	}
+	if c := rgbAt(tree.Octree(), [3]float32{0.125, 0.125, 0.125}); c != [3]uint8{255, 0, 0} {
+		t.Errorf("edit after compaction changed the other instance to %v", c)
+	}
+}
+
+func TestEditDuplicateChildren(t *testing.T) {
+	// The root lists the same leaf twice.
+	octree := make(Octree, 2)
+	octree[0].setChild(0, 1)
+	octree[0].setChild(1, 1)
+	octree[1].setRGBA(color.RGBA{0, 255, 0, 255})
+
+	tree := NewMutableTree(octree, 2)
+	tree.dag = true
+
+	if err := tree.SetVoxel([3]float32{0.25, 0.25, 0.25}, 1, color.RGBA{255, 0, 0, 255}); err != nil {
+		t.Fatal(err)
+	}
+	if c := rgbAt(tree.Octree(), [3]float32{0.75, 0.25, 0.25}); c != [3]uint8{0, 255, 0} {
+		t.Errorf("other slot changed to %v", c)
+	}
+
+	// A node listing itself never ends.
+	octree = make(Octree, 2)
+	octree[0].setChild(0, 1)
+	octree[1].setChild(3, 1)
+
+	tree = NewMutableTree(octree, 4)
+	tree.dag = true
+	if err := tree.SetVoxel([3]float32{0.75, 0.75, 0.75}, 2, color.RGBA{255, 0, 0, 255}); err != CyclicTreeError {
+		t.Errorf("expected CyclicTreeError, got %v", err)
+	}
+}
+
+func TestSaveInfo(t *testing.T) {
+	info := &TreeInfo{
+		VoxelsPerAxis: 4,
+		Coordinates:   pack.ZUpRightHanded,
+		Bounds:        pack.Box{Pos: pack.Point{X: 10, Y: 20, Z: 30}, Size: 8},
+		GeoReference:  &pack.GeoReference{CRS: "EPSG:3006", Origin: [3]float64{1, 2, 3}, Scale: [3]float64{1, 1, 1}},
+	}
+
+	var buf bytes.Buffer
+	tree := NewMutableTreeWithInfo(solidCube(2, color.RGBA{255, 0, 0, 255}).Octree(), info)
+	if err := tree.SaveWithOptions(&buf, pack.MipR8G8B8A8UnpackUI32, SaveOptions{Info: info}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, loaded, err := LoadOctreeWithInfo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Coordinates != info.Coordinates || loaded.Bounds != info.Bounds || loaded.GeoReference == nil || *loaded.GeoReference != *info.GeoReference {
+		t.Errorf("info was not saved, got %+v", loaded)
+	}
+}
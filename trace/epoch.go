@@ -0,0 +1,71 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+// DefaultEpochRamp colors the oldest epoch blue and the newest red.
+var DefaultEpochRamp = []color.RGBA{
+	{0, 64, 255, 255},
+	{0, 200, 120, 255},
+	{255, 220, 0, 255},
+	{255, 32, 0, 255},
+}
+
+// EpochShader returns a surface shader that colors the leafs by the epoch of
+// their sidecar record, see pack.MarkChanges, to show what changed between
+// scans. Epochs from first to last are spread evenly over ramp, epochs outside
+// of them are clamped, and DefaultEpochRamp is used if ramp is empty. Nodes
+// without a record, like the tombstones of removed leafs, misses and the ground
+// plane keep their color.
+func EpochShader(records map[pack.NodeIndex]pack.LeafRecord, first, last uint16, ramp []color.RGBA) SurfaceShader {
+	if len(ramp) == 0 {
+		ramp = DefaultEpochRamp
+	}
+
+	return func(p image.Point, info HitInfo) [3]float32 {
+		c := info.Base
+		if rec, ok := records[pack.NodeIndex(info.Node)]; ok && info.Node != PickMiss {
+			c = epochColor(rec.Epoch, first, last, ramp)
+		}
+		return [3]float32{float32(c.R) / 255, float32(c.G) / 255, float32(c.B) / 255}
+	}
+}
+
+// epochColor interpolates the color of epoch in ramp.
+func epochColor(epoch, first, last uint16, ramp []color.RGBA) color.RGBA {
+	if len(ramp) == 1 || last <= first || epoch <= first {
+		return ramp[0]
+	} else if epoch >= last {
+		return ramp[len(ramp)-1]
+	}
+
+	t := float32(epoch-first) / float32(last-first) * float32(len(ramp)-1)
+	i := int(t)
+	f := t - float32(i)
+	a, b := ramp[i], ramp[i+1]
+	mix := func(x, y uint8) uint8 {
+		return uint8(float32(x) + (float32(y)-float32(x))*f + 0.5)
+	}
+	return color.RGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), a.A}
+}
@@ -0,0 +1,68 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+func TestEpochShader(t *testing.T) {
+	ramp := []color.RGBA{{0, 0, 0, 255}, {200, 100, 0, 255}}
+	for _, c := range []struct {
+		epoch    uint16
+		expected color.RGBA
+	}{
+		{1, color.RGBA{0, 0, 0, 255}},
+		{2, color.RGBA{0, 0, 0, 255}},
+		{3, color.RGBA{100, 50, 0, 255}},
+		{4, color.RGBA{200, 100, 0, 255}},
+		{9, color.RGBA{200, 100, 0, 255}},
+	} {
+		if col := epochColor(c.epoch, 2, 4, ramp); col != c.expected {
+			t.Errorf("epoch %d: expected %v, got %v", c.epoch, c.expected, col)
+		}
+	}
+
+	rect := image.Rect(0, 0, 16, 16)
+	for _, records := range []map[pack.NodeIndex]pack.LeafRecord{{0: {Epoch: 4}}, {}} {
+		rt := NewRaytracer(Config{
+			FieldOfView:   0.8,
+			TreeScale:     1,
+			ViewDist:      10,
+			Images:        [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+			SurfaceShader: EpochShader(records, 2, 4, ramp),
+		})
+
+		camera := LookAtCamera{Pos: Vec3{0.5, 0.5, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+		img := rt.Image(rt.Trace(&camera, unitLeaf().Octree(), 0))
+		rt.Close()
+
+		// Nodes without a record keep their color.
+		expected := color.RGBA{200, 100, 50, 0}
+		if len(records) > 0 {
+			expected = color.RGBA{200, 100, 0, 0}
+		}
+		if c := img.RGBAAt(8, 8); c.R != expected.R || c.G != expected.G || c.B != expected.B {
+			t.Errorf("expected %v at the center, got %v", expected, c)
+		}
+	}
+}
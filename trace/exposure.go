@@ -0,0 +1,112 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package trace
+
+import (
+	"image/color"
+	"math"
+	"sync/atomic"
+)
+
+const (
+	// exposureTarget is the luminance auto exposure moves the median to.
+	exposureTarget = 0.5
+
+	defaultExposureRate = 0.1
+	minExposure         = 1.0 / 64
+	maxExposure         = 64
+)
+
+func (cfg *Config) validateExposure() error {
+	if !(cfg.Exposure >= 0 && cfg.Exposure <= maxExposure) || !(cfg.ExposureRate >= 0 && cfg.ExposureRate <= 1) {
+		return InvalidExposureError
+	}
+	return nil
+}
+
+// exposureEnabled reports if colors are scaled by the exposure.
+func (cfg *Config) exposureEnabled() bool {
+	return cfg.AutoExposure || (cfg.Exposure != 0 && cfg.Exposure != 1)
+}
+
+// Exposure returns the exposure of the next frame. It is Config.Exposure unless
+// AutoExposure has changed it.
+func (rt *Raytracer) Exposure() float32 {
+	return math.Float32frombits(atomic.LoadUint32(&rt.exposure))
+}
+
+func (rt *Raytracer) setExposure(e float32) {
+	atomic.StoreUint32(&rt.exposure, math.Float32bits(e))
+}
+
+// expose scales the channels of c by the exposure, the alpha is kept.
+func (rt *Raytracer) expose(c color.RGBA) color.RGBA {
+	e := rt.Exposure()
+	scale := func(v uint8) uint8 {
+		return uint8(math.Min(float64(v)*float64(e)+0.5, 255))
+	}
+	return color.RGBA{scale(c.R), scale(c.G), scale(c.B), c.A}
+}
+
+// meterExposure adjusts the exposure from the luminance histogram of the pixels
+// traced by frame idx, which must be complete. The median is moved towards
+// exposureTarget by ExposureRate of the difference, measured in stops, so the
+// exposure adapts smoothly to changes in brightness.
+func (rt *Raytracer) meterExposure(idx int) {
+	img := rt.cfg.Images[idx]
+	rect := rt.exposureRect[idx].Intersect(img.Bounds())
+
+	// Row zero is not traced.
+	if rect.Min.Y < 1 {
+		rect.Min.Y = 1
+	}
+	if rect.Empty() {
+		return
+	}
+
+	wr, wb := uint32(54), uint32(19)
+	if rt.bgra {
+		wr, wb = wb, wr
+	}
+
+	var histogram [256]int
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(rect.Min.X, y):img.PixOffset(rect.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			histogram[(wr*uint32(row[i])+183*uint32(row[i+1])+wb*uint32(row[i+2]))>>8]++
+		}
+	}
+
+	half, median := rect.Dx()*rect.Dy()/2, 0
+	for n := histogram[0]; n <= half && median < 255; {
+		median++
+		n += histogram[median]
+	}
+
+	// A black frame gives no measure of how dark it is, the exposure is raised as
+	// if the median was just above black.
+	measured := math.Max(float64(median), 0.5) / 255
+
+	rate := rt.cfg.ExposureRate
+	if rate == 0 {
+		rate = defaultExposureRate
+	}
+
+	e := float64(rt.Exposure())
+	e *= math.Pow(exposureTarget/measured, float64(rate))
+	rt.setExposure(float32(math.Max(minExposure, math.Min(e, maxExposure))))
+}
@@ -0,0 +1,179 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package trace
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// medianGray returns the median of the red channel of the traced rows of img.
+func medianGray(img *image.RGBA) int {
+	var histogram [256]int
+	bounds := img.Bounds()
+	for y := bounds.Min.Y + 1; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			histogram[img.RGBAAt(x, y).R]++
+		}
+	}
+
+	n, half := 0, bounds.Dx()*(bounds.Dy()-1)/2
+	for v, count := range histogram {
+		if n += count; n > half {
+			return v
+		}
+	}
+	return 255
+}
+
+func TestAutoExposure(t *testing.T) {
+	// The camera is inside the gray cube, every pixel hits it.
+	camera := LookAtCamera{Pos: Vec3{0.4, 0.45, 0.6}, Look: Vec3{0.4, 0.45, 0}}
+
+	for _, jitter := range []bool{false, true} {
+		rect := image.Rect(0, 0, 16, 12)
+		cfg := Config{
+			FieldOfView:  1,
+			TreeScale:    1,
+			ViewDist:     5,
+			Jitter:       jitter,
+			AutoExposure: true,
+			ExposureRate: 0.5,
+			Images:       [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		}
+		if err := cfg.Validate(); err != nil {
+			panic(err)
+		}
+
+		rt := NewRaytracer(cfg)
+
+		// The interior is dark at first, then four times brighter, like stepping
+		// outside.
+		for _, g := range []struct {
+			gray     uint8
+			exposure float32
+		}{{32, 4}, {128, 1}} {
+			tree := solidCube(1, color.RGBA{g.gray, g.gray, g.gray, 255})
+
+			const frames = 12
+			for i := 0; i < frames; i++ {
+				idx := rt.Trace(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis()))
+				if err := rt.Wait(idx); err != nil {
+					panic(err)
+				}
+			}
+
+			if e := rt.Exposure(); e < g.exposure*0.95 || e > g.exposure*1.05 {
+				t.Errorf("jitter %v, gray %d: expected an exposure near %v after %d frames, got %v", jitter, g.gray, g.exposure, frames, e)
+			}
+
+			img := rt.Image(rt.Trace(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis())))
+			if m := medianGray(img); m < 122 || m > 134 {
+				t.Errorf("jitter %v, gray %d: expected a median near 128, got %d", jitter, g.gray, m)
+			}
+		}
+		rt.Close()
+	}
+}
+
+func TestAutoExposureRate(t *testing.T) {
+	camera := LookAtCamera{Pos: Vec3{0.4, 0.45, 0.6}, Look: Vec3{0.4, 0.45, 0}}
+	tree := solidCube(1, color.RGBA{32, 32, 32, 255})
+
+	rect := image.Rect(0, 0, 16, 12)
+	cfg := Config{
+		FieldOfView:  1,
+		TreeScale:    1,
+		ViewDist:     5,
+		AutoExposure: true,
+		Images:       [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+
+	rt := NewRaytracer(cfg)
+	defer rt.Close()
+
+	// The first frame is not exposed and the default rate moves a tenth of the
+	// two stops to the target.
+	idx := rt.Trace(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis()))
+	if c := rt.Image(idx).RGBAAt(8, 6); c.R != 32 {
+		t.Errorf("expected the first frame to be unexposed, got %v", c)
+	}
+	if e := rt.Exposure(); e < 1.14 || e > 1.16 {
+		t.Errorf("expected an exposure of 1.15 after one frame, got %v", e)
+	}
+}
+
+func TestAutoExposureRect(t *testing.T) {
+	camera := LookAtCamera{Pos: Vec3{0.4, 0.45, 0.6}, Look: Vec3{0.4, 0.45, 0}}
+	tree := solidCube(1, color.RGBA{64, 64, 64, 255})
+
+	rect := image.Rect(0, 0, 16, 12)
+	cfg := Config{
+		FieldOfView:  1,
+		TreeScale:    1,
+		ViewDist:     5,
+		AutoExposure: true,
+		ExposureRate: 1,
+		Images:       [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+
+	// Pixels outside of the traced rect are white and must not be metered.
+	for i := range cfg.Images[0].Pix {
+		cfg.Images[0].Pix[i] = 255
+	}
+
+	rt := NewRaytracer(cfg)
+	defer rt.Close()
+
+	rt.Wait(rt.TraceRect(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis()), image.Rect(4, 4, 8, 8)))
+	if e := rt.Exposure(); e < 1.9 || e > 2.1 {
+		t.Errorf("expected an exposure of 2 from the traced pixels, got %v", e)
+	}
+}
+
+func TestExposure(t *testing.T) {
+	camera := LookAtCamera{Pos: Vec3{0.4, 0.45, 0.6}, Look: Vec3{0.4, 0.45, 0}}
+	tree := solidCube(1, color.RGBA{100, 50, 200, 255})
+
+	rect := image.Rect(0, 0, 16, 12)
+	cfg := Config{
+		FieldOfView: 1,
+		TreeScale:   1,
+		ViewDist:    5,
+		Exposure:    1.5,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+
+	rt := NewRaytracer(cfg)
+	defer rt.Close()
+
+	c := rt.Image(rt.Trace(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis()))).RGBAAt(8, 6)
+	if c.R != 150 || c.G != 75 || c.B != 255 {
+		t.Errorf("expected scaled and clamped channels, got %v", c)
+	}
+	if e := rt.Exposure(); e != 1.5 {
+		t.Errorf("expected the exposure to stay 1.5 without AutoExposure, got %v", e)
+	}
+
+	for _, cfg := range []Config{{FieldOfView: 1, Exposure: -1}, {FieldOfView: 1, ExposureRate: 2}} {
+		if err := cfg.Validate(); !errors.Is(err, InvalidExposureError) {
+			t.Errorf("expected InvalidExposureError for %+v, got %v", cfg, err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image/color"
+
+	"github.com/andreas-jonsson/octatron/go3d/vec3"
+)
+
+// NodeAttributes describe a node to Config.NodeFilter.
+type NodeAttributes struct {
+	// Index is the index of the node in the tree.
+	Index uint32
+
+	// Color is the opaque color of the node.
+	Color color.RGBA
+
+	// Class is the alpha byte of the stored node color. Alpha is not used for
+	// shading unless Config.Transparency is set, so trees can store a
+	// classification code in it, like the point classes of a LIDAR scan.
+	Class uint8
+}
+
+func (n *octreeNode) attributes(index uint32) NodeAttributes {
+	c := n.getColor()
+	c.A = 255
+	return NodeAttributes{index, c, n.getClass()}
+}
+
+// intersectFiltered is intersectTree for trees with a Config.NodeFilter. Nodes
+// where the traversal ends, leafs and nodes cut by the level of detail, are
+// treated as empty if the filter rejects them, so the ray continues behind them.
+// It is a separate function so intersectTree does not check for a filter on
+// every node.
+func (rt *Raytracer) intersectFiltered(tree []octreeNode, masks []uint8, ray *infiniteRay, nodePos *vec3.T, nodeScale, length, maxDepth float32, nodeIndex, treeDepth uint32, visits *uint64) (float32, uint32, uint32, bool) {
+	var (
+		node = &tree[nodeIndex]
+
+		// Declare this here to avoid runtime allocation.
+		pos vec3.T
+	)
+
+	*visits++
+
+	box := vec3.Box{Min: *nodePos, Max: vec3.T{nodePos[0] + nodeScale, nodePos[1] + nodeScale, nodePos[2] + nodeScale}}
+	boxDist := intersectBox(ray, length, &box, rt.epsilon*nodeScale)
+
+	if boxDist == length {
+		return length, 0, 0, false
+	}
+
+	d := boxDist / rt.cfg.ViewDist
+	if node.leaf() || treeDepth > uint32(maxDepth*(1-d*d)) {
+		if !rt.cfg.NodeFilter(node.attributes(nodeIndex)) {
+			return length, 0, 0, false
+		}
+		return boxDist, nodeIndex, treeDepth, true
+	}
+
+	mask := nodeMask(tree, masks, nodeIndex)
+	childScale := nodeScale * 0.5
+	childDepth := treeDepth + 1
+	order := childOrder(&ray[1])
+
+	for k := 0; k < 8; k++ {
+		i := k ^ order
+		if mask&(1<<uint(i)) == 0 {
+			continue
+		}
+
+		scaled := childPositions[i].Scaled(childScale)
+		pos = vec3.Add(nodePos, &scaled)
+
+		if ln, idx, depth, ok := rt.intersectFiltered(tree, masks, ray, &pos, childScale, length, maxDepth, node.getChild(i), childDepth, visits); ok && ln < length {
+			return ln, idx, depth, true
+		}
+	}
+	return length, 0, 0, false
+}
+
+// intersector returns the traversal of the recursive float32 rays,
+// intersectFiltered if there is a node filter and intersectTree otherwise.
+func (rt *Raytracer) intersector() func(tree []octreeNode, masks []uint8, ray *infiniteRay, nodePos *vec3.T, nodeScale, length, maxDepth float32, nodeIndex, treeDepth uint32, visits *uint64) (float32, uint32, uint32, bool) {
+	if rt.cfg.NodeFilter != nil {
+		return rt.intersectFiltered
+	}
+	return rt.intersectTree
+}
+
+// filtered reports if the node is rejected by the node filter.
+func (rt *Raytracer) filtered(tree []octreeNode, index uint32) bool {
+	return rt.cfg.NodeFilter != nil && !rt.cfg.NodeFilter(tree[index].attributes(index))
+}
+
+// SetNodeFilter replaces Config.NodeFilter, nil renders all nodes. Frames in
+// flight are completed first and accumulation starts over.
+func (rt *Raytracer) SetNodeFilter(filter func(attrs NodeAttributes) bool) {
+	rt.traceLock.Lock()
+	defer rt.traceLock.Unlock()
+
+	rt.wait(0)
+	rt.wait(1)
+	rt.cfg.NodeFilter = filter
+	rt.numSamples = 0
+}
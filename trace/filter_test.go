@@ -0,0 +1,121 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+// layeredTree returns a tree of one level where the back half along z is green
+// leafs of class 1 and the front half red leafs of class 2.
+func layeredTree() *MutableTree {
+	tree := make(Octree, 9)
+	children := make([]pack.NodeIndex, 8)
+	for i := range children {
+		children[i] = pack.NodeIndex(i + 1)
+	}
+	if err := tree[0].setNode(&pack.Color{R: 0.5, G: 0.5, A: 1}, children); err != nil {
+		panic(err)
+	}
+
+	empty := make([]pack.NodeIndex, 8)
+	for i := 0; i < 8; i++ {
+		c := pack.Color{G: 1, A: 1.0 / 255}
+		if childPositions[i][2] == 1 {
+			c = pack.Color{R: 1, A: 2.0 / 255}
+		}
+		if err := tree[i+1].setNode(&c, empty); err != nil {
+			panic(err)
+		}
+	}
+	return NewMutableTree(tree, 2)
+}
+
+func TestNodeFilter(t *testing.T) {
+	tree := layeredTree()
+	if class := tree.Octree()[8].getClass(); class != 2 {
+		t.Fatalf("expected the front leafs to be of class 2, got %d", class)
+	}
+
+	rect := image.Rect(0, 0, 32, 32)
+	camera := LookAtCamera{Pos: Vec3{0.5, 0.5, 3}, Look: Vec3{0.5, 0.5, 0}}
+	clear := color.RGBA{0, 0, 255, 255}
+
+	hideClass := func(class uint8) func(NodeAttributes) bool {
+		return func(attrs NodeAttributes) bool { return attrs.Class != class }
+	}
+
+	tests := []struct {
+		name   string
+		filter func(NodeAttributes) bool
+		setup  func(cfg *Config)
+		color  color.RGBA
+	}{
+		{"none", nil, func(cfg *Config) {}, color.RGBA{255, 0, 0, 255}},
+		{"front", hideClass(2), func(cfg *Config) {}, color.RGBA{0, 255, 0, 255}},
+		{"back", hideClass(1), func(cfg *Config) {}, color.RGBA{255, 0, 0, 255}},
+		{"all", func(NodeAttributes) bool { return false }, func(cfg *Config) {}, clear},
+		{"packets", hideClass(2), func(cfg *Config) { cfg.Packets = true }, color.RGBA{0, 255, 0, 255}},
+		{"marching", hideClass(2), func(cfg *Config) { cfg.Traversal = Marching }, color.RGBA{0, 255, 0, 255}},
+		{"precise", hideClass(2), func(cfg *Config) { cfg.HighPrecision = true }, color.RGBA{0, 255, 0, 255}},
+		{"ground", hideClass(2), func(cfg *Config) { cfg.GroundPlane = GroundPlane{Enabled: true, Height: -1, Color: clear} }, color.RGBA{0, 255, 0, 255}},
+	}
+
+	for _, test := range tests {
+		cfg := Config{
+			FieldOfView: 0.3,
+			TreeScale:   1,
+			ViewDist:    10,
+			NodeFilter:  test.filter,
+			Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		}
+		test.setup(&cfg)
+
+		rt := NewRaytracer(cfg)
+		rt.SetClearColor(clear)
+		img := rt.Image(rt.Trace(&camera, tree.Octree(), 1))
+
+		if c := img.RGBAAt(12, 12); c.R != test.color.R || c.G != test.color.G || c.B != test.color.B {
+			t.Errorf("%s: expected %v at the center, got %v", test.name, test.color, c)
+		}
+
+		raster := image.NewRGBA(rect)
+		rt.RasterizeCubes(&camera, tree.Octree(), 1, raster)
+		if c := raster.RGBAAt(12, 12); c.R != test.color.R || c.G != test.color.G || c.B != test.color.B {
+			t.Errorf("%s: expected %v at the center of the rasterized cubes, got %v", test.name, test.color, c)
+		}
+		rt.Close()
+	}
+
+	// SetNodeFilter changes the filter between frames.
+	rt := NewRaytracer(Config{FieldOfView: 0.3, TreeScale: 1, ViewDist: 10, Images: [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}})
+	defer rt.Close()
+
+	rt.SetNodeFilter(hideClass(2))
+	if c := rt.Image(rt.Trace(&camera, tree.Octree(), 1)).RGBAAt(12, 12); c.G != 255 {
+		t.Errorf("expected the back leafs behind the filtered front, got %v", c)
+	}
+	rt.SetNodeFilter(nil)
+	if c := rt.Image(rt.Trace(&camera, tree.Octree(), 1)).RGBAAt(12, 12); c.R != 255 {
+		t.Errorf("expected the front leafs without a filter, got %v", c)
+	}
+}
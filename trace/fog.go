@@ -0,0 +1,70 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import "image/color"
+
+// Fog blends pixels toward Color by their distance along the ray, linearly from no
+// fog at Start to only fog at End and beyond. Misses are fogged as if they were at
+// ViewDist, so the clear color fades into the fog like distant geometry.
+type Fog struct {
+	Enabled    bool
+	Color      color.RGBA
+	Start, End float32
+}
+
+func (f *Fog) validate() error {
+	if f.Enabled && !(f.Start >= 0 && f.End > f.Start) {
+		return InvalidFogError
+	}
+	return nil
+}
+
+// factor returns how much of the fog color is used at dist, in [0, 1].
+func (f *Fog) factor(dist, viewDist float32, hit bool) float32 {
+	if !f.Enabled {
+		return 0
+	}
+	if !hit {
+		dist = viewDist
+	}
+
+	t := (dist - f.Start) / (f.End - f.Start)
+	if t <= 0 {
+		return 0
+	} else if t >= 1 || t != t {
+		return 1
+	}
+	return t
+}
+
+// blend mixes c with the fog color, the alpha of c is kept.
+func (f *Fog) blend(c color.RGBA, t float32) color.RGBA {
+	mix := func(a, b uint8) uint8 {
+		return uint8(float32(a) + (float32(b)-float32(a))*t + 0.5)
+	}
+	return color.RGBA{mix(c.R, f.Color.R), mix(c.G, f.Color.G), mix(c.B, f.Color.B), c.A}
+}
+
+// blendRGB mixes shader output, with channels in [0, 1], with the fog color.
+func (f *Fog) blendRGB(rgb *[3]float32, t float32) {
+	fog := [3]uint8{f.Color.R, f.Color.G, f.Color.B}
+	for i := range rgb {
+		rgb[i] += (float32(fog[i])/255 - rgb[i]) * t
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func renderFog(tree *MutableTree, fog Fog, shader Shader, camera Camera) color.RGBA {
+	rect := image.Rect(0, 0, 8, 8)
+	cfg := Config{
+		FieldOfView: 0.05,
+		TreeScale:   1,
+		ViewDist:    20,
+		Fog:         fog,
+		Shader:      shader,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+	if err := cfg.Validate(); err != nil {
+		panic(err)
+	}
+
+	rt := NewRaytracer(cfg)
+	defer rt.Close()
+	rt.SetClearColor(testClearColor)
+
+	return rt.Image(rt.Trace(camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis()))).RGBAAt(4, 4)
+}
+
+func closeColor(a, b color.RGBA) bool {
+	d := func(x, y uint8) bool {
+		return int(x)-int(y) <= 2 && int(y)-int(x) <= 2
+	}
+	return d(a.R, b.R) && d(a.G, b.G) && d(a.B, b.B)
+}
+
+func TestFog(t *testing.T) {
+	base := color.RGBA{200, 40, 40, 255}
+	cube := solidCube(1, base)
+	fog := Fog{Enabled: true, Color: color.RGBA{100, 150, 250, 255}, Start: 2, End: 6}
+
+	passThrough := func(p image.Point, c color.RGBA, dist float32, hit bool) [3]float32 {
+		return [3]float32{float32(c.R) / 255, float32(c.G) / 255, float32(c.B) / 255}
+	}
+
+	golden := []struct {
+		dist     float32
+		expected color.RGBA
+	}{
+		{1, base},
+		{4, color.RGBA{150, 95, 145, 255}},
+		{8, color.RGBA{100, 150, 250, 255}},
+	}
+
+	for _, shader := range []Shader{nil, passThrough} {
+		for _, g := range golden {
+			camera := LookAtCamera{Pos: Vec3{0.3, 0.3, 1 + g.dist}, Look: Vec3{0.3, 0.3, 0}}
+			if c := renderFog(cube, fog, shader, &camera); !closeColor(c, g.expected) {
+				t.Errorf("at distance %v with shader %v: expected %v, got %v", g.dist, shader != nil, g.expected, c)
+			}
+		}
+	}
+
+	// Misses are fogged at the view distance, which is past the end of the fog.
+	away := LookAtCamera{Pos: Vec3{0.5, 0.5, 2}, Look: Vec3{0.5, 0.5, 3}}
+	if c := renderFog(cube, fog, nil, &away); c != (color.RGBA{100, 150, 250, testClearColor.A}) {
+		t.Errorf("expected fog color for a miss, got %v", c)
+	}
+
+	fog.Enabled = false
+	if c := renderFog(cube, fog, nil, &away); c != testClearColor {
+		t.Errorf("expected clear color without fog, got %v", c)
+	}
+}
+
+func TestFogValidate(t *testing.T) {
+	for _, fog := range []Fog{{Enabled: true, Start: 2, End: 2}, {Enabled: true, Start: -1, End: 2}} {
+		cfg := Config{FieldOfView: 1, Fog: fog}
+		if err := cfg.Validate(); !errors.Is(err, InvalidFogError) {
+			t.Errorf("expected InvalidFogError for %+v, got %v", fog, err)
+		}
+	}
+
+	cfg := Config{FieldOfView: 1, Fog: Fog{Start: 2, End: 2}}
+	if err := cfg.Validate(); err != nil {
+		t.Error("expected disabled fog to be ignored, got", err)
+	}
+}
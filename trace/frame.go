@@ -0,0 +1,67 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import "math"
+
+// frameHalfAngle is half the smallest field of view FrameTree accounts for.
+const frameHalfAngle = 22.5 * math.Pi / 180
+
+func treeBounds(info *TreeInfo) (Vec3, float32) {
+	if info.Bounds.Size > 0 {
+		p := info.Bounds.Pos
+		return Vec3{float32(p.X), float32(p.Y), float32(p.Z)}, float32(info.Bounds.Size)
+	}
+	return Vec3{}, 1
+}
+
+// FitTree sets TreePosition and TreeScale so the tree covers the world bounds it
+// was built from. Trees without bounds are placed in the unit cube and false is
+// returned. Bounds far from the origin lose precision in float32, enable
+// HighPrecision for those.
+func (cfg *Config) FitTree(info *TreeInfo) bool {
+	cfg.TreePosition, cfg.TreeScale = treeBounds(info)
+	return info.Bounds.Size > 0
+}
+
+// FrameTree returns a camera looking along direction at the center of the tree,
+// far enough back to see all of it with a field of view of at least 45 degrees.
+// The tree is expected to be placed by FitTree. A zero direction looks along -z.
+func FrameTree(info *TreeInfo, direction Vec3) FreeFlightCamera {
+	pos, scale := treeBounds(info)
+
+	dx, dy, dz := float64(direction[0]), float64(direction[1]), float64(direction[2])
+	length := math.Sqrt(dx*dx + dy*dy + dz*dz)
+	if !(length > 0) || math.IsInf(length, 0) {
+		dx, dy, dz, length = 0, 0, -1, 1
+	}
+	dx, dy, dz = dx/length, dy/length, dz/length
+
+	half := float64(scale) / 2
+	distance := half * math.Sqrt(3) / math.Sin(frameHalfAngle)
+
+	return FreeFlightCamera{
+		Pos: Vec3{
+			float32(float64(pos[0]) + half - dx*distance),
+			float32(float64(pos[1]) + half - dy*distance),
+			float32(float64(pos[2]) + half - dz*distance),
+		},
+		XRot: float32(math.Atan2(-dx, -dz)),
+		YRot: float32(math.Asin(dy)),
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"bytes"
+	"image"
+	"math"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+func buildBoundedTree(bounds pack.Box, vpa int) (Octree, *TreeInfo) {
+	var samples []pack.Sample
+	step := bounds.Size / float64(vpa)
+	for z := 0; z < vpa; z++ {
+		for y := 0; y < vpa; y++ {
+			for x := 0; x < vpa; x++ {
+				dx, dy, dz := float64(x)+0.5-float64(vpa)/2, float64(y)+0.5-float64(vpa)/2, float64(z)+0.5-float64(vpa)/2
+				if dx*dx+dy*dy+dz*dz > float64(vpa*vpa)/4 {
+					continue
+				}
+				pos := pack.Point{
+					X: bounds.Pos.X + (float64(x)+0.5)*step,
+					Y: bounds.Pos.Y + (float64(y)+0.5)*step,
+					Z: bounds.Pos.Z + (float64(z)+0.5)*step,
+				}
+				samples = append(samples, pack.Sample{Pos: pos, Col: pack.Color{R: 1, G: 0.5, B: 0.25, A: 1}})
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	cfg := pack.BuildConfig{
+		Worker:        pack.NewFakeWorker(samples),
+		Writer:        &buf,
+		Bounds:        bounds,
+		VoxelsPerAxis: vpa,
+		Format:        pack.MipR8G8B8A8UnpackUI32,
+	}
+	if _, err := pack.BuildTree(&cfg); err != nil {
+		panic(err)
+	}
+
+	tree, info, err := LoadOctreeWithInfo(&buf)
+	if err != nil {
+		panic(err)
+	}
+	return tree, info
+}
+
+func TestFrameTree(t *testing.T) {
+	bounds := pack.Box{Pos: pack.Point{X: 100, Y: -20, Z: 50}, Size: 16}
+	tree, info := buildBoundedTree(bounds, 8)
+	if info.Bounds != bounds {
+		t.Fatalf("expected bounds %+v, got %+v", bounds, info.Bounds)
+	}
+
+	rect := image.Rect(0, 0, 32, 32)
+	cfg := Config{
+		FieldOfViewDegrees: 45,
+		ViewDist:           1000,
+		Images:             [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+	if !cfg.FitTree(info) {
+		t.Fatal("expected tree with bounds")
+	}
+	if cfg.TreeScale != 16 || cfg.TreePosition != (Vec3{100, -20, 50}) {
+		t.Errorf("unexpected placement %v at %v", cfg.TreeScale, cfg.TreePosition)
+	}
+
+	for _, dir := range []Vec3{{0, 0, -1}, {1, -1, 1}, {-1, 0.5, 0}, {}} {
+		camera := FrameTree(info, dir)
+
+		rt := NewRaytracer(cfg)
+		rt.SetClearColor(testClearColor)
+		img := rt.Image(rt.Trace(&camera, tree, info.Depth))
+		rt.Close()
+
+		hits := 0
+		for y := 14; y < 18; y++ {
+			for x := 14; x < 18; x++ {
+				if img.RGBAAt(x, y) != testClearColor {
+					hits++
+				}
+			}
+		}
+		if hits == 0 {
+			t.Errorf("expected tree at the image center looking along %v", dir)
+		}
+		if c := img.RGBAAt(1, 1); c != testClearColor {
+			t.Errorf("expected background in the corner looking along %v, got %v", dir, c)
+		}
+	}
+}
+
+func TestFrameTreeDirection(t *testing.T) {
+	info := &TreeInfo{}
+	for _, dir := range []Vec3{{0, 0, -1}, {1, 0, 0}, {0.3, -0.8, 0.5}, {-2, 1, -1}} {
+		camera := FrameTree(info, dir)
+		forward := camera.Forward()
+
+		length := math.Sqrt(float64(dir[0]*dir[0] + dir[1]*dir[1] + dir[2]*dir[2]))
+		for i := range dir {
+			if d := math.Abs(float64(forward[i]) - float64(dir[i])/length); d > 1e-5 {
+				t.Errorf("expected forward %v along %v", forward, dir)
+				break
+			}
+		}
+	}
+
+	var cfg Config
+	if cfg.FitTree(info) || cfg.TreeScale != 1 || cfg.TreePosition != (Vec3{}) {
+		t.Error("expected unit cube for a tree without bounds")
+	}
+}
@@ -0,0 +1,64 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import "github.com/andreas-jonsson/octatron/pack"
+
+// TreeToWorld converts a position in the tree, in the unit cube it fills with a
+// TreePosition of zero and a TreeScale of one, to world coordinates. Those are
+// the coordinates of the samples the tree was built from, in their convention,
+// or of the coordinate reference system of the GeoReference if the tree has
+// one. Trees without bounds fill the unit cube of the world.
+func (info *TreeInfo) TreeToWorld(p [3]float64) pack.Point {
+	pos, size := info.worldBox()
+	q := info.Coordinates.FromTree(pack.Point{X: pos.X + p[0]*size, Y: pos.Y + p[1]*size, Z: pos.Z + p[2]*size})
+	if info.GeoReference != nil {
+		q = info.GeoReference.ToCRS(q)
+	}
+	return q
+}
+
+// WorldToTree is the inverse of TreeToWorld.
+func (info *TreeInfo) WorldToTree(p pack.Point) [3]float64 {
+	if info.GeoReference != nil {
+		p = info.GeoReference.FromCRS(p)
+	}
+	q := info.Coordinates.ToTree(p)
+	pos, size := info.worldBox()
+	return [3]float64{(q.X - pos.X) / size, (q.Y - pos.Y) / size, (q.Z - pos.Z) / size}
+}
+
+// worldBox returns the min corner and size of the tree in world coordinates,
+// converted to YUpRightHanded.
+func (info *TreeInfo) worldBox() (pack.Point, float64) {
+	if info.Bounds.Size > 0 {
+		return info.Bounds.Pos, info.Bounds.Size
+	}
+	return pack.Point{}, 1
+}
+
+// WorldPosition converts pos, in the space of the raytracer like Hit.Position,
+// to world coordinates of the tree described by info. Picks made with CastRay are
+// reported in real coordinates by it.
+func (rt *Raytracer) WorldPosition(info *TreeInfo, pos Vec3) pack.Point {
+	var p [3]float64
+	for i := range p {
+		p[i] = (float64(pos[i]) - float64(rt.cfg.TreePosition[i])) / float64(rt.cfg.TreeScale)
+	}
+	return info.TreeToWorld(p)
+}
@@ -0,0 +1,148 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+// buildGeoTree builds a Z-up tree of one red voxel at sample position 5, 6, 1,
+// with the samples stored in centimeters relative to a UTM origin.
+func buildGeoTree(t *testing.T, format pack.OctreeFormat, crs string) []byte {
+	var buf bytes.Buffer
+	cfg := pack.BuildConfig{
+		Worker:        pack.NewFakeWorker([]pack.Sample{{Pos: pack.Point{X: 5, Y: 6, Z: 1}, Col: pack.Color{R: 1, A: 1}}}),
+		Writer:        &buf,
+		Bounds:        pack.Box{Pos: pack.Point{X: 4, Y: 4, Z: 0}, Size: 4},
+		Coordinates:   pack.ZUpRightHanded,
+		VoxelsPerAxis: 4,
+		Format:        format,
+		GeoReference: &pack.GeoReference{
+			CRS:    crs,
+			Origin: [3]float64{512345.67, 6543210.89, 102.5},
+			Scale:  [3]float64{0.01, 0.01, 0.01},
+		},
+	}
+	if _, err := pack.BuildTree(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTreeToWorld(t *testing.T) {
+	_, info, err := LoadOctreeWithInfo(bytes.NewReader(buildGeoTree(t, pack.MipR8G8B8A8UnpackUI32, "EPSG:32633")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.GeoReference == nil || info.GeoReference.CRS != "EPSG:32633" {
+		t.Fatalf("unexpected geo reference %+v", info.GeoReference)
+	}
+
+	// The min corner of the tree is at sample position 4, 4, 0. Z-up samples
+	// have their y axis along -z of the tree, so the corner is at tree z one.
+	corner := info.TreeToWorld([3]float64{0, 0, 1})
+	expected := pack.Point{X: 512345.71, Y: 6543210.93, Z: 102.5}
+	for i, d := range [3]float64{corner.X - expected.X, corner.Y - expected.Y, corner.Z - expected.Z} {
+		if math.Abs(d) > 1e-8 {
+			t.Errorf("axis %d: corner is off by %g", i, d)
+		}
+	}
+
+	// Doubles resolve about a nanometer at the northing of the origin, which is
+	// 2.5e-8 of the tree.
+	for _, p := range [][3]float64{{0, 0, 0}, {0.25, 0.5, 0.75}, {1, 1, 1}, {0.123456789, 0.987654321, 0.5}} {
+		back := info.WorldToTree(info.TreeToWorld(p))
+		for i := range p {
+			if math.Abs(back[i]-p[i]) > 1e-7 {
+				t.Errorf("%v: round trip is off by %g on axis %d", p, back[i]-p[i], i)
+			}
+		}
+	}
+
+	// Picks are reported in CRS coordinates. The ray hits the top of the voxel
+	// of the sample, at sample position 5.5, 5.5, 2.
+	rect := image.Rect(0, 0, 1, 1)
+	cfg := Config{ViewDist: 10, Images: [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}}
+	cfg.FitTree(info)
+	rt := NewRaytracer(cfg)
+	defer rt.Close()
+
+	tree, _, err := LoadOctreeWithInfo(bytes.NewReader(buildGeoTree(t, pack.MipR8G8B8A8UnpackUI32, "EPSG:32633")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hit, ok := rt.CastRay(tree, info.Depth, Vec3{5.5, 20, -5.5}, Vec3{0, -1, 0}, 100)
+	if !ok {
+		t.Fatal("expected a hit")
+	}
+	pos := rt.WorldPosition(info, hit.Position)
+	if math.Abs(pos.X-512345.725) > 0.006 || math.Abs(pos.Y-6543210.945) > 0.006 || math.Abs(pos.Z-102.52) > 1e-6 {
+		t.Errorf("unexpected pick position %+v", pos)
+	}
+}
+
+func TestLoadGeoTreeMapped(t *testing.T) {
+	// The odd length of the CRS leaves the nodes unaligned, so they are copied.
+	data := buildGeoTree(t, pack.MipR8G8B8A8PackUI28, "EPSG:4326")
+	expected, _, err := LoadOctreeWithInfo(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fp, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fp.Name())
+	fp.Write(data)
+	fp.Close()
+
+	mapped, err := LoadOctreeMapped(fp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mapped.Close()
+
+	if mapped.Mapped() {
+		t.Error("expected unaligned nodes to be copied")
+	}
+	if info := mapped.Info(); info.GeoReference == nil || info.GeoReference.CRS != "EPSG:4326" {
+		t.Errorf("unexpected info %+v", info)
+	}
+
+	tree, ok := mapped.Acquire()
+	if !ok {
+		t.Fatal("expected open tree")
+	}
+	defer mapped.Release()
+	if len(tree) != len(expected) {
+		t.Fatalf("expected %d nodes, got %d", len(expected), len(tree))
+	}
+	for i := range tree {
+		if tree[i] != expected[i] {
+			t.Fatalf("node %d differs", i)
+		}
+	}
+}
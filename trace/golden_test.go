@@ -0,0 +1,350 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package trace
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// goldenTolerance is the largest difference of a color channel from the golden
+// image that is not counted as a changed pixel.
+const goldenTolerance = 2
+
+// mengerSponge is the deterministic tree of the golden tests, a level three
+// Menger sponge of 27 voxels per axis, centered in a tree of 32, with colors from
+// the position of every voxel.
+func mengerSponge() *MutableTree {
+	const (
+		depth  = 5
+		res    = 1 << depth
+		offset = 2
+	)
+
+	tree := NewMutableTree(nil, res)
+	size := 1 / float32(res)
+
+	for z := 0; z < 27; z++ {
+		for y := 0; y < 27; y++ {
+			for x := 0; x < 27; x++ {
+				// A voxel is removed if two of its base three digits are one
+				// at any level.
+				solid := true
+				for a, b, c := x, y, z; a > 0 || b > 0 || c > 0; a, b, c = a/3, b/3, c/3 {
+					ones := 0
+					for _, digit := range []int{a % 3, b % 3, c % 3} {
+						if digit == 1 {
+							ones++
+						}
+					}
+					if ones >= 2 {
+						solid = false
+						break
+					}
+				}
+				if !solid {
+					continue
+				}
+
+				pos := [3]float32{(float32(x+offset) + 0.5) * size, (float32(y+offset) + 0.5) * size, (float32(z+offset) + 0.5) * size}
+				c := color.RGBA{uint8(40 + x*8), uint8(40 + y*8), uint8(40 + z*8), 255}
+				if err := tree.SetVoxel(pos, depth, c); err != nil {
+					panic(err)
+				}
+			}
+		}
+	}
+	return tree
+}
+
+var goldenCameras = []struct {
+	name   string
+	camera LookAtCamera
+}{
+	{"front", LookAtCamera{Pos: Vec3{0.47, 0.53, 2.2}, Look: Vec3{0.5, 0.5, 0.5}}},
+	{"corner", LookAtCamera{Pos: Vec3{1.6, 1.4, 1.8}, Look: Vec3{0.5, 0.5, 0.5}}},
+	{"inside", LookAtCamera{Pos: Vec3{0.48, 0.49, 0.47}, Look: Vec3{0.1, 0.2, 0.3}}},
+}
+
+// goldenConfigs are the features covered by the golden images. New features of
+// the raytracer should be added here.
+var goldenConfigs = []struct {
+	name   string
+	frames int
+	setup  func(cfg *Config)
+}{
+	{"plain", 1, func(cfg *Config) {}},
+	{"jitter", 2, func(cfg *Config) { cfg.Jitter = true }},
+	{"lod", 1, func(cfg *Config) { cfg.ViewDist = 2.5 }},
+	{"samples", 1, func(cfg *Config) { cfg.Samples = 4 }},
+	{"adaptive", 1, func(cfg *Config) { cfg.AdaptiveAA = AdaptiveAA{Threshold: 0.1, MaxSamples: 4} }},
+	{"marching", 1, func(cfg *Config) { cfg.Traversal = Marching }},
+	{"flipx", 1, func(cfg *Config) { cfg.FlipX = true }},
+	{"flipy", 1, func(cfg *Config) { cfg.FlipY = true }},
+	{"flipxy", 1, func(cfg *Config) { cfg.FlipX, cfg.FlipY = true, true }},
+	{"highlight", 1, func(cfg *Config) {
+		cfg.Highlight = Highlight{NodeIndex: 0, Color: color.RGBA{255, 255, 0, 160}, Mode: Outline}
+	}},
+	{"exposure", 4, func(cfg *Config) {
+		cfg.AutoExposure = true
+		cfg.ExposureRate = 0.5
+	}},
+	{"shaded", 1, func(cfg *Config) {
+		cfg.Shader = func(p image.Point, base color.RGBA, dist float32, hit bool) [3]float32 {
+			light := 1 / (1 + dist*dist)
+			return [3]float32{float32(base.R) * light, float32(base.G) * light, float32(base.B) * light}
+		}
+		cfg.Fog = Fog{Enabled: true, Color: color.RGBA{200, 210, 230, 255}, Start: 1, End: 3}
+	}},
+}
+
+func renderGolden(tree *MutableTree, camera LookAtCamera, frames int, setup func(cfg *Config)) *image.RGBA {
+	rect := image.Rect(0, 0, 64, 48)
+	cfg := Config{
+		FieldOfView: 1,
+		TreeScale:   1,
+		ViewDist:    5,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+	setup(&cfg)
+
+	rt := NewRaytracer(cfg)
+	defer rt.Close()
+	rt.SetClearColor(color.RGBA{0, 0, 0, 255})
+
+	var idx int
+	for i := 0; i < frames; i++ {
+		idx = rt.Trace(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis()))
+	}
+	img := rt.Image(idx)
+	opaque(img)
+	return img
+}
+
+// opaque sets the alpha of every pixel of img. Node colors are not premultiplied,
+// this makes the image survive PNG encoding.
+func opaque(img *image.RGBA) {
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+}
+
+// loadGolden returns the golden image in file, or writes img to it and returns
+// img when the tests run with -update.
+func loadGolden(file string, img *image.RGBA) *image.RGBA {
+	if *updateGolden {
+		fp, err := os.Create(file)
+		if err != nil {
+			panic(err)
+		}
+		defer fp.Close()
+
+		if err := png.Encode(fp, img); err != nil {
+			panic(err)
+		}
+		return img
+	}
+
+	fp, err := os.Open(file)
+	if err != nil {
+		panic(err)
+	}
+	defer fp.Close()
+
+	decoded, err := png.Decode(fp)
+	if err != nil {
+		panic(err)
+	}
+
+	golden := image.NewRGBA(decoded.Bounds())
+	draw.Draw(golden, golden.Bounds(), decoded, image.ZP, draw.Src)
+	return golden
+}
+
+// countChanged returns the number of pixels with a channel that differs by more
+// than tolerance.
+func countChanged(a, b *image.RGBA, tolerance int) int {
+	num := 0
+	for i := 0; i < len(a.Pix); i += 4 {
+		for c := 0; c < 4; c++ {
+			if d := int(a.Pix[i+c]) - int(b.Pix[i+c]); d > tolerance || d < -tolerance {
+				num++
+				break
+			}
+		}
+	}
+	return num
+}
+
+func TestGoldenImages(t *testing.T) {
+	tree := mengerSponge()
+
+	for _, cfg := range goldenConfigs {
+		for _, camera := range goldenCameras {
+			file := filepath.Join("testdata", "golden", fmt.Sprintf("%s_%s.png", cfg.name, camera.name))
+			img := renderGolden(tree, camera.camera, cfg.frames, cfg.setup)
+			golden := loadGolden(file, img)
+
+			if golden.Bounds() != img.Bounds() {
+				t.Errorf("unexpected size of %s: %v", file, golden.Bounds())
+				continue
+			}
+
+			// Allow a few edge pixels to differ with the floating point rounding of the platform.
+			if n := countChanged(golden, img, goldenTolerance); n > len(img.Pix)/4/100 {
+				t.Errorf("%d pixels differ from %s", n, file)
+			}
+		}
+	}
+}
+
+// TestJitterConverges reconstructs the two frames of a jittered render, which must
+// match a plain render of the full width. Images of odd height start the phases
+// on the other scan column.
+func TestJitterConverges(t *testing.T) {
+	tree := mengerSponge()
+	camera := goldenCameras[1].camera
+
+	for _, height := range []int{48, 47} {
+		render := func(width, frames int, jitter bool) *image.RGBA {
+			rect := image.Rect(0, 0, width, height)
+			rt := NewRaytracer(Config{
+				FieldOfView: 1,
+				TreeScale:   1,
+				ViewDist:    5,
+				Jitter:      jitter,
+				Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+			})
+			defer rt.Close()
+			rt.SetClearColor(color.RGBA{0, 0, 0, 255})
+
+			for i := 0; i < frames; i++ {
+				rt.Wait(rt.Trace(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis())))
+			}
+			if !jitter {
+				return rt.Image(0)
+			}
+
+			out := image.NewRGBA(image.Rect(0, 0, width*2, height))
+			if err := Reconstruct(rt.Image(0), rt.Image(1), out); err != nil {
+				t.Fatal(err)
+			}
+			return out
+		}
+
+		reference, img := render(64, 1, false), render(32, 2, true)
+		if n := countChanged(reference, img, goldenTolerance); n > len(img.Pix)/4/100 {
+			t.Errorf("height %d: %d pixels of the reconstructed frames differ from the plain render", height, n)
+		}
+	}
+}
+
+// precisionWall returns a wall of 64 by 64 voxels at the center of a twelve level
+// tree, a single voxel thick.
+func precisionWall() *MutableTree {
+	const depth = 12
+
+	tree := NewMutableTree(nil, 1<<depth)
+	size := 1 / float32(1<<depth)
+
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			pos := [3]float32{(float32(2048+x) + 0.5) * size, (float32(2048+y) + 0.5) * size, (2048 + 0.5) * size}
+			c := color.RGBA{uint8(64 + x*2), uint8(64 + y*2), 160, 255}
+			if err := tree.SetVoxel(pos, depth, c); err != nil {
+				panic(err)
+			}
+		}
+	}
+	return tree
+}
+
+// countSpeckles returns the number of pixels with the clear color surrounded by
+// pixels without it.
+func countSpeckles(img *image.RGBA, clear color.RGBA) int {
+	num := 0
+	b := img.Bounds()
+	for y := b.Min.Y + 1; y < b.Max.Y-1; y++ {
+		for x := b.Min.X + 1; x < b.Max.X-1; x++ {
+			if img.RGBAAt(x, y) != clear {
+				continue
+			}
+			if img.RGBAAt(x-1, y) != clear && img.RGBAAt(x+1, y) != clear && img.RGBAAt(x, y-1) != clear && img.RGBAAt(x, y+1) != clear {
+				num++
+			}
+		}
+	}
+	return num
+}
+
+// TestPrecisionGolden renders the voxel wall close-up in a tree of scale 10000,
+// where the nodes are small compared to their distance from the origin.
+func TestPrecisionGolden(t *testing.T) {
+	tree := precisionWall()
+	clear := color.RGBA{0, 0, 0, 255}
+
+	render := func(epsilon float32) *image.RGBA {
+		rect := image.Rect(0, 0, 96, 64)
+		rt := NewRaytracer(Config{
+			FieldOfView:  1,
+			TreeScale:    10000.3,
+			TreePosition: Vec3{0.37, 0.71, 0.13},
+			ViewDist:     1e5,
+			Epsilon:      epsilon,
+			Images:       [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		})
+		defer rt.Close()
+		rt.SetClearColor(clear)
+
+		camera := LookAtCamera{Pos: Vec3{5010, 5030, 4996}, Look: Vec3{5013, 5032, 5002}}
+		return rt.Image(rt.Trace(&camera, tree.Octree(), 12))
+	}
+
+	for _, epsilon := range []float32{1, float32(math.NaN())} {
+		cfg := Config{FieldOfView: 1, Epsilon: epsilon}
+		if err := cfg.Validate(); !errors.Is(err, InvalidEpsilonError) {
+			t.Errorf("epsilon %v: %v", epsilon, err)
+		}
+	}
+
+	exact := render(-1)
+	img := render(0)
+
+	before, after := countSpeckles(exact, clear), countSpeckles(img, clear)
+	if after > before || after != 0 {
+		t.Errorf("%d speckles with epsilon, %d without", after, before)
+	}
+	if n := countChanged(exact, img, goldenTolerance); n > len(img.Pix)/4/100 {
+		t.Errorf("epsilon changes %d pixels", n)
+	}
+
+	opaque(img)
+
+	file := filepath.Join("testdata", "golden", "precision_closeup.png")
+	golden := loadGolden(file, img)
+	if n := countChanged(golden, img, goldenTolerance); n > len(img.Pix)/4/100 {
+		t.Errorf("%d pixels differ from %s", n, file)
+	}
+}
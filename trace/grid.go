@@ -0,0 +1,122 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image/color"
+	"math"
+)
+
+// GridPlane is the axis plane a GridOverlay is drawn on.
+type GridPlane int
+
+const (
+	// GridXZ is the horizontal plane at the height of GroundPlane, which is
+	// zero without a ground plane.
+	GridXZ GridPlane = iota
+	// GridXY is the plane at z = 0.
+	GridXY
+	// GridYZ is the plane at x = 0.
+	GridYZ
+)
+
+// gridLineWidth is the width of the grid lines in pixels.
+const gridLineWidth = 1
+
+// GridOverlay draws lines Spacing apart on an axis plane, where rays that miss
+// the tree cross it, to line up voxels with the world. The grid is seen from
+// both sides of the plane and is drawn over the ground plane. Lines closer than four
+// pixels apart are left out, far away they would fill the plane. The alpha of
+// Color is the strength of the lines.
+type GridOverlay struct {
+	Enabled bool
+	Spacing float32
+	Color   color.RGBA
+	Plane   GridPlane
+}
+
+func (g *GridOverlay) validate() error {
+	if g.Enabled && (!(g.Spacing > 0) || math.IsInf(float64(g.Spacing), 0) || g.Plane < GridXZ || g.Plane > GridYZ) {
+		return InvalidGridError
+	}
+	return nil
+}
+
+// plane returns the axis of the grid plane and its offset along it.
+func (g *GridOverlay) plane(ground *GroundPlane) (int, float32) {
+	switch g.Plane {
+	case GridXY:
+		return 2, 0
+	case GridYZ:
+		return 0, 0
+	default:
+		return 1, ground.Height
+	}
+}
+
+// onGridLine reports if x is within width of a multiple of spacing.
+func onGridLine(x, spacing, width float32) bool {
+	d := x - spacing*float32(math.Floor(float64(x/spacing)+0.5))
+	return d < width && d > -width
+}
+
+// onGrid reports if ray crosses a grid line before length. The ray starts at
+// near from the eye and the lines are pixel wide at unit distance.
+func (rt *Raytracer) onGrid(ray *infiniteRay, near, length, pixel float32) bool {
+	g := &rt.cfg.GridOverlay
+	axis, offset := g.plane(&rt.cfg.GroundPlane)
+
+	dist, ok := rayPlane(ray, axis, offset)
+	if !ok || !(dist < length) {
+		return false
+	}
+
+	width := (dist + near) * pixel * gridLineWidth
+	if width*4 > g.Spacing {
+		return false
+	}
+
+	for i := range ray[0] {
+		if i != axis && onGridLine(ray[0][i]+ray[1][i]*dist, g.Spacing, width) {
+			return true
+		}
+	}
+	return false
+}
+
+// grid blends the grid color over c, which is in the channel order of the
+// images.
+func (rt *Raytracer) grid(c color.RGBA) color.RGBA {
+	return rt.blend(c, rt.cfg.GridOverlay.Color)
+}
+
+// SetGridOverlay replaces Config.GridOverlay. Frames in flight are completed
+// first.
+func (rt *Raytracer) SetGridOverlay(g GridOverlay) error {
+	if err := g.validate(); err != nil {
+		return invalidConfig("GridOverlay", err)
+	}
+
+	rt.traceLock.Lock()
+	defer rt.traceLock.Unlock()
+
+	rt.wait(0)
+	rt.wait(1)
+	rt.cfg.GridOverlay = g
+	return nil
+}
@@ -0,0 +1,92 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+)
+
+func TestGridOverlay(t *testing.T) {
+	lines := color.RGBA{255, 255, 255, 255}
+	empty := NewMutableTree(nil, 32)
+	camera := LookAtCamera{Pos: Vec3{0.5, 1.2, 2}, Look: Vec3{0.5, 0, 0}}
+
+	render := func(tree *MutableTree, setup func(cfg *Config)) *image.RGBA {
+		return renderGolden(tree, camera, 1, setup)
+	}
+	grid := GridOverlay{Enabled: true, Spacing: 0.25, Color: lines}
+
+	if n := countColor(render(empty, func(cfg *Config) {}), lines); n != 0 {
+		t.Errorf("%d grid pixels when disabled", n)
+	}
+
+	// The lines run toward the horizon and fade out where they would be closer
+	// than four pixels.
+	img := render(empty, func(cfg *Config) { cfg.GridOverlay = grid })
+	file := filepath.Join("testdata", "golden", "grid_empty.png")
+	golden := loadGolden(file, img)
+	if n := countChanged(golden, img, goldenTolerance); n > len(img.Pix)/4/100 {
+		t.Errorf("%d pixels differ from %s", n, file)
+	}
+
+	numLines := countColor(img, lines)
+	if numLines == 0 || countColor(img, color.RGBA{0, 0, 0, 255}) == 0 {
+		t.Fatalf("%d grid pixels in the empty scene", numLines)
+	}
+	for x := 0; x < img.Bounds().Dx(); x++ {
+		if c := img.RGBAAt(x, 0); c == lines {
+			t.Errorf("grid line at %d above the horizon", x)
+		}
+	}
+
+	// The tree hides the grid behind it, the ground plane does not.
+	cube := solidCube(0, color.RGBA{96, 96, 96, 255})
+	if n := countColor(render(cube, func(cfg *Config) { cfg.GridOverlay = grid }), lines); n >= numLines {
+		t.Errorf("%d grid pixels behind the cube, %d without it", n, numLines)
+	}
+	onGround := render(empty, func(cfg *Config) {
+		cfg.GridOverlay = grid
+		cfg.GroundPlane = GroundPlane{Enabled: true, Color: color.RGBA{0, 0, 128, 255}}
+	})
+	if n := countColor(onGround, lines); n != numLines {
+		t.Errorf("%d grid pixels on the ground plane, expected %d", n, numLines)
+	}
+
+	vertical := grid
+	vertical.Plane = GridXY
+	if n := countColor(render(empty, func(cfg *Config) { cfg.GridOverlay = vertical }), lines); n == 0 || n == numLines {
+		t.Errorf("%d grid pixels on the xy plane", n)
+	}
+
+	for _, g := range []GridOverlay{{Enabled: true}, {Enabled: true, Spacing: 1, Plane: GridYZ + 1}} {
+		cfg := Config{FieldOfView: 1, GridOverlay: g}
+		if err := cfg.Validate(); !errors.Is(err, InvalidGridError) {
+			t.Errorf("%+v: %v", g, err)
+		}
+	}
+
+	rt := NewRaytracer(Config{FieldOfView: 1, TreeScale: 1, ViewDist: 5, Images: [2]*image.RGBA{image.NewRGBA(image.Rect(0, 0, 64, 48)), image.NewRGBA(image.Rect(0, 0, 64, 48))}})
+	defer rt.Close()
+	if err := rt.SetGridOverlay(GridOverlay{Enabled: true, Spacing: -1}); !errors.Is(err, InvalidGridError) {
+		t.Errorf("SetGridOverlay accepted a negative spacing: %v", err)
+	}
+}
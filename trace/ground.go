@@ -0,0 +1,89 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image/color"
+
+	"github.com/andreas-jonsson/octatron/go3d/vec3"
+)
+
+// GroundPlane is an infinite horizontal plane at y = Height, seen from above. Rays
+// that miss the tree but hit the plane are reflected back toward the tree, and
+// the reflection is blended with Color by Reflectivity. The reflected ray sees
+// the clear color if it misses the tree too.
+type GroundPlane struct {
+	Enabled      bool
+	Height       float32
+	Color        color.RGBA
+	Reflectivity float32
+}
+
+func (g *GroundPlane) validate() error {
+	if g.Enabled && !(g.Reflectivity >= 0 && g.Reflectivity <= 1) {
+		return InvalidGroundPlaneError
+	}
+	return nil
+}
+
+// rayPlane returns the distance along ray to the plane where the axis coordinate
+// is offset. The last value is false if the ray is parallel to the plane or points
+// away from it.
+func rayPlane(ray *infiniteRay, axis int, offset float32) (float32, bool) {
+	if ray[1][axis] == 0 {
+		return 0, false
+	}
+	dist := (offset - ray[0][axis]) / ray[1][axis]
+	return dist, dist > 0
+}
+
+// traceGround returns the color of the ground plane where ray hits it, and the
+// distance to the hit. The last value is false if the plane is not hit within
+// length.
+func (rt *Raytracer) traceGround(tree []octreeNode, masks []uint8, ray *infiniteRay, nodePos *vec3.T, nodeScale, length, maxDepth float32, visits *uint64) (color.RGBA, float32, bool) {
+	g := &rt.cfg.GroundPlane
+	origin, dir := &ray[0], &ray[1]
+
+	if origin[1] <= g.Height {
+		return color.RGBA{}, length, false
+	}
+
+	dist, ok := rayPlane(ray, 1, g.Height)
+	if !ok || !(dist < length) {
+		return color.RGBA{}, length, false
+	}
+
+	reflected := rt.clear
+	if len(tree) > 0 {
+		hitPos := dir.Scaled(dist)
+		hitPos = vec3.Add(origin, &hitPos)
+		// Lift the reflected ray off the plane by the tolerance so rounding of
+		// the hit position can not start it below the plane.
+		hitPos[1] = g.Height + rt.epsilon*nodeScale
+
+		mirror := infiniteRay{hitPos, vec3.T{dir[0], -dir[1], dir[2]}}
+		_, index, _, hit := rt.intersector()(tree, masks, &mirror, nodePos, nodeScale, length-dist, maxDepth, 0, 0, visits)
+		reflected = rt.nodeColor(tree, index, hit)
+	}
+
+	mix := func(a, b uint8) uint8 {
+		return uint8(float32(a) + (float32(b)-float32(a))*g.Reflectivity + 0.5)
+	}
+	c := color.RGBA{mix(g.Color.R, reflected.R), mix(g.Color.G, reflected.G), mix(g.Color.B, reflected.B), g.Color.A}
+	return c, dist, true
+}
@@ -0,0 +1,96 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func renderGround(plane GroundPlane, highPrecision bool) *image.RGBA {
+	tree := NewMutableTree(nil, 4)
+	if err := tree.SetVoxel([3]float32{0.625, 0.375, 0.375}, 2, color.RGBA{250, 50, 50, 255}); err != nil {
+		panic(err)
+	}
+
+	rect := image.Rect(0, 0, 32, 32)
+	cfg := Config{
+		FieldOfView:   0.8,
+		TreeScale:     1,
+		ViewDist:      10,
+		Packets:       true,
+		HighPrecision: highPrecision,
+		GroundPlane:   plane,
+		Images:        [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+	if err := cfg.Validate(); err != nil {
+		panic(err)
+	}
+
+	rt := NewRaytracer(cfg)
+	defer rt.Close()
+	rt.SetClearColor(testClearColor)
+
+	// The camera is level with the leaf, so the plane at the bottom of the tree
+	// fills the lower half of the image.
+	camera := LookAtCamera{Pos: Vec3{0.625, 0.375, 3}, Look: Vec3{0.625, 0.375, 0}}
+	return rt.Image(rt.Trace(&camera, tree.Octree(), TreeWidthToDepth(4)))
+}
+
+func TestGroundPlane(t *testing.T) {
+	leaf := color.RGBA{250, 50, 50, 1}
+	plane := GroundPlane{Enabled: true, Color: color.RGBA{50, 50, 250, 255}, Reflectivity: 0.5}
+
+	without := renderGround(GroundPlane{}, false)
+	if c := without.RGBAAt(16, 16); c != leaf {
+		t.Fatalf("expected leaf at the image center, got %v", c)
+	}
+
+	// The mirror image of the leaf center is 0.75 below the camera at a distance
+	// of 2.625, which projects to row 27.
+	mirrored, floor := image.Point{16, 27}, image.Point{16, 30}
+	if c := without.RGBAAt(mirrored.X, mirrored.Y); c != testClearColor {
+		t.Errorf("expected clear color below the leaf without a plane, got %v", c)
+	}
+
+	for _, highPrecision := range []bool{false, true} {
+		img := renderGround(plane, highPrecision)
+
+		if c := img.RGBAAt(16, 16); c != leaf {
+			t.Errorf("expected leaf at the image center, got %v", c)
+		}
+		if c := img.RGBAAt(mirrored.X, mirrored.Y); c != (color.RGBA{150, 50, 150, 255}) {
+			t.Errorf("expected leaf mirrored in the plane, got %v", c)
+		}
+		if c := img.RGBAAt(floor.X, floor.Y); c != (color.RGBA{26, 26, 127, 255}) {
+			t.Errorf("expected clear color mirrored in the plane, got %v", c)
+		}
+		if c := img.RGBAAt(16, 2); c != testClearColor {
+			t.Errorf("expected clear color above the horizon, got %v", c)
+		}
+	}
+}
+
+func TestGroundPlaneValidate(t *testing.T) {
+	cfg := Config{FieldOfView: 1, GroundPlane: GroundPlane{Enabled: true, Reflectivity: 1.5}}
+	if err := cfg.Validate(); !errors.Is(err, InvalidGroundPlaneError) {
+		t.Error("expected InvalidGroundPlaneError, got", err)
+	}
+}
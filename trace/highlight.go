@@ -0,0 +1,210 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/andreas-jonsson/octatron/go3d/vec3"
+)
+
+// HighlightMode selects how Config.Highlight marks the selection.
+type HighlightMode int
+
+const (
+	// Tint blends the highlight color over every pixel of the selection.
+	Tint HighlightMode = iota
+
+	// Outline blends the highlight color over the pixels of the selection with
+	// a neighbor outside of it.
+	Outline
+)
+
+// NoHighlight is the Highlight.NodeIndex that disables highlighting. It equals
+// PickMiss, so a value from the pick buffer can be used as is.
+const NoHighlight = PickMiss
+
+// Highlight marks a node and the nodes below it, like the node under the cursor
+// read from the pick buffer. The alpha of Color is the strength of the highlight,
+// so the zero value does nothing.
+type Highlight struct {
+	NodeIndex uint32
+	Color     color.RGBA
+	Mode      HighlightMode
+}
+
+// selection is the node of a highlight with its position in the tree.
+type selection struct {
+	index uint32
+	pos   vec3.T
+	scale float32
+	depth uint32
+}
+
+// selectionKey is what a cached selection was found for.
+type selectionKey struct {
+	tree   *octreeNode
+	size   int
+	index  uint32
+	pos    Vec3
+	scale  float32
+	cached *selection
+}
+
+func (h *Highlight) enabled() bool {
+	return h.NodeIndex != NoHighlight && h.Color.A > 0
+}
+
+func (h *Highlight) validate() error {
+	if h.Mode != Tint && h.Mode != Outline {
+		return InvalidHighlightError
+	}
+	return nil
+}
+
+// findSelection returns the node index of tree with its position, or nil if the
+// node is not reachable from the root.
+func findSelection(tree Octree, index uint32, pos vec3.T, scale float32) *selection {
+	if int64(index) >= int64(len(tree)) {
+		return nil
+	}
+
+	// Depth is bounded so malformed trees with cycles end the search.
+	const maxSearchDepth = 64
+
+	stack := []selection{{0, pos, scale, 0}}
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if s.index == index {
+			return &s
+		}
+		if s.depth >= maxSearchDepth {
+			continue
+		}
+
+		node := &tree[s.index]
+		childScale := s.scale * 0.5
+		for i := range node {
+			if child := node.getChild(i); child != 0 {
+				offset := childPositions[i].Scaled(childScale)
+				stack = append(stack, selection{child, vec3.Add(&s.pos, &offset), childScale, s.depth + 1})
+			}
+		}
+	}
+	return nil
+}
+
+// selection returns the highlighted node of tree, or nil if nothing is
+// highlighted. The search is only done again when the tree or highlight changes.
+func (rt *Raytracer) selection(tree Octree) *selection {
+	h := &rt.cfg.Highlight
+	if !h.enabled() || len(tree) == 0 {
+		return nil
+	}
+
+	key := selectionKey{&tree[0], len(tree), h.NodeIndex, rt.cfg.TreePosition, rt.cfg.TreeScale, nil}
+	if c := rt.selected; c.cached != nil && c.tree == key.tree && c.size == key.size && c.index == key.index && c.pos == key.pos && c.scale == key.scale {
+		return c.cached
+	}
+
+	key.cached = findSelection(tree, h.NodeIndex, vec3.T(rt.cfg.TreePosition), rt.cfg.TreeScale)
+	rt.selected = key
+	return key.cached
+}
+
+// inSelection reports if the node index hit by ray is the selected node or below
+// it. The subtree is traced on its own, its closest hit is the node hit in the
+// whole tree only if that node belongs to it.
+func (rt *Raytracer) inSelection(tree []octreeNode, masks []uint8, sel *selection, ray *infiniteRay, length, maxDepth float32, index uint32, visits *uint64) bool {
+	_, idx, _, hit := rt.intersector()(tree, masks, ray, &sel.pos, sel.scale, length, maxDepth, sel.index, sel.depth, visits)
+	return hit && idx == index
+}
+
+// highlight blends the highlight color over c, which is in the channel order of
+// the images.
+func (rt *Raytracer) highlight(c color.RGBA) color.RGBA {
+	return rt.blend(c, rt.cfg.Highlight.Color)
+}
+
+// blend blends h over c by the alpha of h. The color c is in the channel order of
+// the images, h is RGBA.
+func (rt *Raytracer) blend(c, h color.RGBA) color.RGBA {
+	if rt.bgra {
+		h.R, h.B = h.B, h.R
+	}
+
+	a := uint32(h.A)
+	mix := func(x, y uint8) uint8 {
+		return uint8((uint32(x)*(255-a) + uint32(y)*a + 127) / 255)
+	}
+	return color.RGBA{mix(c.R, h.R), mix(c.G, h.G), mix(c.B, h.B), c.A}
+}
+
+// Values of the selection mask of a job.
+const (
+	maskUnknown = iota
+	maskSelected
+	maskUnselected
+)
+
+// outlineSelection highlights the pixels of rect that are selected but have a
+// neighbor that is not. mask holds the pixels of rect traced by the job, the
+// others are looked up with selectedAt.
+func (rt *Raytracer) outlineSelection(img *image.RGBA, rect image.Rectangle, mask []uint8, selectedAt func(dx, dy int) bool) {
+	bounds := img.Bounds()
+	isSelected := func(dx, dy int) bool {
+		if !(image.Point{dx, dy}.In(bounds)) {
+			return false
+		}
+		if (image.Point{dx, dy}.In(rect)) {
+			if m := mask[(dy-rect.Min.Y)*rect.Dx()+dx-rect.Min.X]; m != maskUnknown {
+				return m == maskSelected
+			}
+		}
+		return selectedAt(dx, dy)
+	}
+
+	for dy := rect.Min.Y; dy < rect.Max.Y; dy++ {
+		for dx := rect.Min.X; dx < rect.Max.X; dx++ {
+			if mask[(dy-rect.Min.Y)*rect.Dx()+dx-rect.Min.X] != maskSelected {
+				continue
+			}
+			if !isSelected(dx-1, dy) || !isSelected(dx+1, dy) || !isSelected(dx, dy-1) || !isSelected(dx, dy+1) {
+				img.SetRGBA(dx, dy, rt.highlight(img.RGBAAt(dx, dy)))
+			}
+		}
+	}
+}
+
+// SetHighlight replaces Config.Highlight. Frames in flight are completed first.
+func (rt *Raytracer) SetHighlight(h Highlight) error {
+	if err := h.validate(); err != nil {
+		return invalidConfig("Highlight", err)
+	}
+
+	rt.traceLock.Lock()
+	defer rt.traceLock.Unlock()
+
+	rt.wait(0)
+	rt.wait(1)
+	rt.cfg.Highlight = h
+	return nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestHighlight(t *testing.T) {
+	tree := NewMutableTree(nil, 2)
+	for _, pos := range [][3]float32{{0.25, 0.25, 0.25}, {0.75, 0.25, 0.25}} {
+		if err := tree.SetVoxel(pos, 1, color.RGBA{200, 100, 50, 255}); err != nil {
+			panic(err)
+		}
+	}
+
+	rect := image.Rect(0, 0, 32, 32)
+	camera := LookAtCamera{Pos: Vec3{0.5, 0.25, 3}, Look: Vec3{0.5, 0.25, 0.25}}
+
+	rt := newTestRaytracer(Vec3{}, 1)
+	defer rt.Close()
+	leaf, ok := rt.CastRay(tree.Octree(), 1, Vec3{0.75, 0.25, 3}, Vec3{0, 0, -1}, 10)
+	if !ok {
+		t.Fatal("expected the ray through the leaf to hit it")
+	}
+
+	render := func(h Highlight, tileSize int) (*image.RGBA, []uint32) {
+		pick := make([]uint32, rect.Dx()*rect.Dy())
+		cfg := Config{
+			FieldOfView: 0.6,
+			TreeScale:   1,
+			ViewDist:    10,
+			TileSize:    tileSize,
+			PickBuffer:  pick,
+			Highlight:   h,
+			Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		img, _ := renderTestFrame(tree, cfg, &camera)
+		return img, pick
+	}
+
+	yellow := color.RGBA{255, 255, 0, 128}
+	reference, pick := render(Highlight{NodeIndex: NoHighlight, Color: yellow}, 0)
+
+	// compare returns the number of changed pixels, failing for changed pixels
+	// that are not picked as a node of the selection.
+	compare := func(name string, img *image.RGBA, inside func(node uint32) bool) (int, int) {
+		changed, selected := 0, 0
+		for y := 0; y < rect.Dy(); y++ {
+			for x := 0; x < rect.Dx(); x++ {
+				node := pick[y*rect.Dx()+x]
+				in := node != PickMiss && inside(node)
+				if in {
+					selected++
+				}
+
+				if img.RGBAAt(x, y) != reference.RGBAAt(x, y) {
+					changed++
+					if !in {
+						t.Errorf("%s: pixel %d,%d outside the selection changed", name, x, y)
+					}
+				}
+			}
+		}
+		return changed, selected
+	}
+
+	isLeaf := func(node uint32) bool { return node == leaf.Node }
+
+	for _, tileSize := range []int{0, 8} {
+		img, _ := render(Highlight{NodeIndex: leaf.Node, Color: yellow, Mode: Tint}, tileSize)
+		if changed, selected := compare("tint", img, isLeaf); changed != selected || selected == 0 {
+			t.Errorf("tint with tiles of %d: %d of %d selected pixels changed", tileSize, changed, selected)
+		}
+
+		img, _ = render(Highlight{NodeIndex: leaf.Node, Color: yellow, Mode: Outline}, tileSize)
+		if changed, selected := compare("outline", img, isLeaf); changed == 0 || changed >= selected {
+			t.Errorf("outline with tiles of %d: %d of %d selected pixels changed", tileSize, changed, selected)
+		}
+	}
+
+	// Selecting the root highlights both leafs.
+	img, _ := render(Highlight{NodeIndex: 0, Color: yellow}, 0)
+	all := func(node uint32) bool { return true }
+	if changed, selected := compare("subtree", img, all); changed != selected || selected == 0 {
+		t.Errorf("subtree: %d of %d selected pixels changed", changed, selected)
+	}
+
+	// The zero value and the sentinel do nothing.
+	for _, h := range []Highlight{{}, {NodeIndex: NoHighlight, Color: yellow}} {
+		img, _ := render(h, 0)
+		if changed, _ := compare("disabled", img, all); changed != 0 {
+			t.Errorf("%+v changed %d pixels", h, changed)
+		}
+	}
+
+	cfg := Config{FieldOfView: 0.6, Highlight: Highlight{Mode: 2}}
+	if err := cfg.Validate(); !errors.Is(err, InvalidHighlightError) {
+		t.Errorf("expected an invalid mode to be rejected, got %v", err)
+	}
+}
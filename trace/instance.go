@@ -0,0 +1,135 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"math"
+
+	"github.com/andreas-jonsson/octatron/go3d/vec3"
+)
+
+// InstanceMiss is written to Config.InstanceBuffer for pixels where no tree was
+// hit.
+const InstanceMiss uint16 = 0xFFFF
+
+// TreeInstance places a tree in the frames next to the traced tree, see
+// Config.Instances.
+type TreeInstance struct {
+	// Tree is drawn to MaxDepth levels, the traced tree and its depth if nil.
+	Tree     Octree
+	MaxDepth int
+
+	Position Vec3
+	Scale    float32
+}
+
+// placedTree is a tree of a frame with its position and scale.
+type placedTree struct {
+	tree     []octreeNode
+	masks    []uint8
+	maxDepth float32
+	pos      vec3.T
+	scale    float32
+}
+
+func (cfg *Config) validateInstances() error {
+	if len(cfg.Instances) >= int(InstanceMiss) {
+		return InvalidInstanceError
+	}
+	for _, inst := range cfg.Instances {
+		if !(inst.Scale > 0) || math.IsInf(float64(inst.Scale), 0) || !finite(inst.Position) {
+			return InvalidInstanceError
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) validateInstanceBuffer() error {
+	if cfg.InstanceBuffer == nil || cfg.Images[0] == nil {
+		return nil
+	}
+	size := cfg.Images[0].Bounds().Size()
+	if len(cfg.InstanceBuffer) < size.X*size.Y {
+		return InvalidSizeError
+	}
+	return nil
+}
+
+// placeInstances returns the instances of cfg for a frame of tree, drawn to
+// maxDepth. The depths of the other trees are lowered by bias.
+func (cfg *Config) placeInstances(tree Octree, masks []uint8, maxDepth, bias float32) []placedTree {
+	if len(cfg.Instances) == 0 {
+		return nil
+	}
+
+	placed := make([]placedTree, len(cfg.Instances))
+	for i, inst := range cfg.Instances {
+		placed[i] = placedTree{tree, masks, maxDepth, vec3.T(inst.Position), inst.Scale}
+		if inst.Tree != nil {
+			placed[i].tree, placed[i].masks = inst.Tree, nil
+			placed[i].maxDepth = float32(math.Max(float64(inst.MaxDepth)-float64(bias), 0))
+		}
+	}
+	return placed
+}
+
+// placement returns the position and scale of instance i, zero being the traced
+// tree.
+func (cfg *Config) placement(i uint16) (vec3.T, float32) {
+	if i == 0 || i == InstanceMiss {
+		return vec3.T(cfg.TreePosition), cfg.TreeScale
+	}
+	inst := &cfg.Instances[i-1]
+	return vec3.T(inst.Position), inst.Scale
+}
+
+// treeOf returns the tree of instance i of the frame of job.
+func (job *rtJob) treeOf(i uint16) []octreeNode {
+	if i == 0 || i == InstanceMiss {
+		return job.tree
+	}
+	return job.instances[i-1].tree
+}
+
+// writeInstance stores the instance hit by the pixel at dx, dy of img, which
+// starts at the origin, like writePick.
+func writeInstance(buf []uint16, img *image.RGBA, dx, dy int, instance uint16, hit bool) {
+	if !hit {
+		instance = InstanceMiss
+	}
+	if i := dy*img.Rect.Dx() + dx; i < len(buf) {
+		buf[i] = instance
+	}
+}
+
+// SetInstanceBuffer replaces Config.InstanceBuffer. Frames in flight are
+// completed first. InvalidSizeError is returned if it is smaller than the images.
+func (rt *Raytracer) SetInstanceBuffer(buf []uint16) error {
+	rt.traceLock.Lock()
+	defer rt.traceLock.Unlock()
+
+	rt.wait(0)
+	rt.wait(1)
+
+	if size := rt.cfg.Images[0].Bounds().Size(); buf != nil && len(buf) < size.X*size.Y {
+		return invalidConfig("InstanceBuffer", InvalidSizeError)
+	}
+	rt.cfg.InstanceBuffer = buf
+	return nil
+}
@@ -0,0 +1,131 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestInstanceBuffer(t *testing.T) {
+	red := solidCube(2, color.RGBA{255, 0, 0, 255})
+	blue := solidCube(2, color.RGBA{0, 0, 255, 255})
+
+	// The instance is right of the traced tree, the boundary at x = 1 projects
+	// between the columns 16 and 17 of the odd width.
+	rect := image.Rect(0, 0, 33, 17)
+	camera := LookAtCamera{Pos: Vec3{1, 0.5, 4}, Look: Vec3{1, 0.5, 0}}
+
+	for _, test := range []struct {
+		name     string
+		instance Octree
+		colors   bool
+	}{
+		{"tree", blue.Octree(), false},
+		{"copy", nil, false},
+		{"shaded", nil, true},
+	} {
+		instances := make([]uint16, rect.Dx()*rect.Dy())
+		pick := make([]uint32, len(instances))
+
+		cfg := Config{
+			FieldOfView:    0.8,
+			TreeScale:      1,
+			ViewDist:       10,
+			Packets:        true,
+			Instances:      []TreeInstance{{Tree: test.instance, MaxDepth: 2, Position: Vec3{1, 0, 0}, Scale: 1}},
+			InstanceBuffer: instances,
+			PickBuffer:     pick,
+			Images:         [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		}
+		if test.colors {
+			cfg.SurfaceShader = func(p image.Point, info HitInfo) [3]float32 {
+				switch info.Instance {
+				case 0:
+					return [3]float32{0, 1, 0}
+				case 1:
+					return [3]float32{1, 1, 0}
+				}
+				return [3]float32{}
+			}
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		img, _ := renderTestFrame(red, cfg, &camera)
+
+		for y := 0; y < rect.Dy(); y++ {
+			for x := 0; x < rect.Dx(); x++ {
+				i := y*rect.Dx() + x
+				switch inst := instances[i]; {
+				case inst == InstanceMiss:
+					if pick[i] != PickMiss {
+						t.Errorf("%s: pixel %d,%d missed but picked node %d", test.name, x, y, pick[i])
+					}
+				case inst == 0 && x > 16, inst == 1 && x < 17, inst > 1:
+					t.Errorf("%s: pixel %d,%d hit instance %d", test.name, x, y, inst)
+				}
+			}
+		}
+
+		center := 8 * rect.Dx()
+		if instances[center+16] != 0 || instances[center+17] != 1 {
+			t.Errorf("%s: expected the center row to split between columns 16 and 17, got %v", test.name, instances[center:center+rect.Dx()])
+		}
+
+		expected := [2]color.RGBA{{255, 0, 0, 255}, {0, 0, 255, 255}}
+		switch {
+		case test.colors:
+			expected = [2]color.RGBA{{0, 255, 0, 255}, {255, 255, 0, 255}}
+		case test.instance == nil:
+			expected[1] = expected[0]
+		}
+		// The alpha of the pixels is the class of the nodes.
+		if c := img.RGBAAt(10, 8); c.R != expected[0].R || c.G != expected[0].G || c.B != expected[0].B {
+			t.Errorf("%s: expected the traced tree to be %v, got %v", test.name, expected[0], c)
+		}
+		if c := img.RGBAAt(22, 8); c.R != expected[1].R || c.G != expected[1].G || c.B != expected[1].B {
+			t.Errorf("%s: expected the instance to be %v, got %v", test.name, expected[1], c)
+		}
+	}
+
+	rt := newTestRaytracer(Vec3{}, 1)
+	defer rt.Close()
+	rt.cfg.Instances = []TreeInstance{{Tree: blue.Octree(), MaxDepth: 2, Position: Vec3{1, 0, 0}, Scale: 1}}
+
+	hit, ok := rt.CastRay(red.Octree(), 2, Vec3{1.4, 0.45, 4}, Vec3{0, 0, -1}, 10)
+	if !ok || hit.Instance != 1 || hit.Color.B != 255 || !near(hit.Position, Vec3{1.4, 0.45, 1}) {
+		t.Errorf("expected the ray to hit the front of the instance, got %+v", hit)
+	}
+	hit, ok = rt.CastRay(red.Octree(), 2, Vec3{0.4, 0.45, 4}, Vec3{0, 0, -1}, 10)
+	if !ok || hit.Instance != 0 || hit.Color.R != 255 {
+		t.Errorf("expected the ray to hit the traced tree, got %+v", hit)
+	}
+
+	for _, cfg := range []Config{
+		{FieldOfView: 0.8, Images: [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}, InstanceBuffer: make([]uint16, 10)},
+		{FieldOfView: 0.8, Images: [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}, Instances: []TreeInstance{{Scale: 0}}},
+	} {
+		err := cfg.Validate()
+		if !errors.Is(err, InvalidSizeError) && !errors.Is(err, InvalidInstanceError) {
+			t.Errorf("expected the config to be rejected, got %v", err)
+		}
+	}
+}
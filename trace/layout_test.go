@@ -0,0 +1,145 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+func reorderedSphere(depth int, order pack.Layout) (Octree, int) {
+	var files [2]*os.File
+	for i := range files {
+		fp, err := ioutil.TempFile("", "")
+		if err != nil {
+			panic(err)
+		}
+		defer func() {
+			fp.Close()
+			os.Remove(fp.Name())
+		}()
+		files[i] = fp
+	}
+
+	if err := testSphere(depth).Save(files[0], pack.MipR8G8B8A8UnpackUI32); err != nil {
+		panic(err)
+	}
+
+	files[0].Seek(0, 0)
+	if _, err := pack.ReorderTree(files[0], files[1], order); err != nil {
+		panic(err)
+	}
+
+	files[1].Seek(0, 0)
+	tree, vpa, err := LoadOctree(files[1])
+	if err != nil {
+		panic(err)
+	}
+	return tree, vpa
+}
+
+// TestCompactFileRender appends orphaned nodes to a saved tree, as an aborted
+// build would, and checks that compaction drops them without changing the image.
+func TestCompactFileRender(t *testing.T) {
+	const orphans = 5
+
+	var saved bytes.Buffer
+	if err := testSphere(4).Save(&saved, pack.MipR8G8B8A8UnpackUI32); err != nil {
+		panic(err)
+	}
+
+	var header pack.OctreeHeader
+	if err := pack.DecodeHeader(bytes.NewReader(saved.Bytes()), &header); err != nil {
+		panic(err)
+	}
+
+	nodes := saved.Bytes()[header.Size():]
+	header.NumNodes += orphans
+
+	var orphaned bytes.Buffer
+	if err := pack.EncodeHeader(&orphaned, header); err != nil {
+		panic(err)
+	}
+	orphaned.Write(nodes)
+	for i := 0; i < orphans; i++ {
+		orphaned.Write(nodes[:header.Format.NodeSize()])
+	}
+
+	var compact bytes.Buffer
+	report, err := pack.CompactFile(bytes.NewReader(orphaned.Bytes()), &compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Unreachable != orphans || report.WastedBytes != uint64(orphans*header.Format.NodeSize()) {
+		t.Errorf("expected %d orphans, got %+v", orphans, report)
+	}
+	if !bytes.Equal(compact.Bytes(), saved.Bytes()) {
+		t.Error("compaction did not restore the saved tree")
+	}
+
+	load := func(data []byte) []byte {
+		tree, vpa, err := LoadOctree(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return renderImage(tree, vpa)
+	}
+	if !bytes.Equal(load(orphaned.Bytes()), load(compact.Bytes())) {
+		t.Error("compaction changed the rendered image")
+	}
+}
+
+func benchmarkLayout(b *testing.B, tree Octree, vpa int) {
+	camera := LookAtCamera{Pos: Vec3{0.3, 0.6, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	rect := image.Rect(0, 0, 128, 128)
+
+	rt := NewRaytracer(Config{
+		FieldOfView: 0.8,
+		TreeScale:   1,
+		ViewDist:    5,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	defer rt.Close()
+
+	maxDepth := TreeWidthToDepth(vpa)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		rt.Image(rt.Trace(&camera, tree, maxDepth))
+	}
+}
+
+func BenchmarkLayoutUnordered(b *testing.B) {
+	tree := testSphere(6)
+	benchmarkLayout(b, tree.Octree(), tree.VoxelsPerAxis())
+}
+
+func BenchmarkLayoutDepthFirst(b *testing.B) {
+	tree, vpa := reorderedSphere(6, pack.DepthFirstLayout)
+	benchmarkLayout(b, tree, vpa)
+}
+
+func BenchmarkLayoutBreadthFirst(b *testing.B) {
+	tree, vpa := reorderedSphere(6, pack.BreadthFirstLayout)
+	benchmarkLayout(b, tree, vpa)
+}
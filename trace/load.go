@@ -0,0 +1,276 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+const (
+	// loadChunkNodes is the smallest number of nodes decoded by one worker at a time.
+	loadChunkNodes = 1 << 16
+
+	// loadChunksPerWorker splits the tree in more chunks than workers so a slow
+	// worker doesn't hold up the load.
+	loadChunksPerWorker = 4
+
+	// maxUncheckedNodes is the most nodes allocated up front for a tree read from a
+	// reader of unknown length. Larger trees grow as their nodes are decoded, so a
+	// damaged header can not allocate memory for nodes that are not there.
+	maxUncheckedNodes = 1 << 20
+)
+
+// remainingBytes returns the number of unread bytes of reader, if it can tell.
+func remainingBytes(reader io.Reader) (int64, bool) {
+	switch r := reader.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len()), true
+	case io.Seeker:
+		pos, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false
+		}
+		end, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, false
+		}
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			return 0, false
+		}
+		return end - pos, true
+	}
+	return 0, false
+}
+
+// readerAtSize returns the size of reader, if it can tell.
+func readerAtSize(reader io.ReaderAt) (int64, bool) {
+	switch r := reader.(type) {
+	case interface{ Size() int64 }:
+		return r.Size(), true
+	case *os.File:
+		stat, err := r.Stat()
+		if err != nil {
+			return 0, false
+		}
+		return stat.Size(), true
+	}
+	return 0, false
+}
+
+// NodeCountError is returned for trees with more nodes than a load allows, or than
+// the rest of the reader can hold.
+type NodeCountError struct {
+	NumNodes uint64
+
+	// Limit is the most nodes the load allows or, if Truncated is set, the most
+	// nodes that fit in the rest of the reader.
+	Limit     uint64
+	Truncated bool
+}
+
+func (e *NodeCountError) Error() string {
+	if e.Truncated {
+		return fmt.Sprintf("tree has %v nodes but the rest of the file holds at most %v", e.NumNodes, e.Limit)
+	}
+	return fmt.Sprintf("tree has %v nodes, the limit is %v", e.NumNodes, e.Limit)
+}
+
+// nodeCapacity returns the number of nodes to allocate before the nodes of header
+// are read from reader. Trees with more nodes than fit in the rest of reader fail
+// with a NodeCountError.
+func nodeCapacity(header *pack.OctreeHeader, reader io.Reader) (uint64, error) {
+	size, ok := remainingBytes(reader)
+	if !ok {
+		if header.NumNodes > maxUncheckedNodes {
+			return maxUncheckedNodes, nil
+		}
+		return header.NumNodes, nil
+	}
+
+	if fit := uint64(size) / uint64(header.Format.MinNodeSize()); header.NumNodes > fit {
+		return 0, &NodeCountError{header.NumNodes, fit, true}
+	}
+	return header.NumNodes, nil
+}
+
+// LoadOctreeParallel works like LoadOctreeWithInfo but decodes the nodes with several
+// workers. Nodes of fixed size formats are found by offset, so every worker reads
+// its own chunk of reader. If workers is zero one worker per CPU is used. Formats
+// with variable size nodes, compressed trees and checksummed trees, which are
+// verified, are loaded sequentially. So are large trees if the size of reader is
+// unknown, readers with a Size method and files are checked up front.
+func LoadOctreeParallel(reader io.ReaderAt, workers int) (Octree, *TreeInfo, error) {
+	var header pack.OctreeHeader
+
+	section := io.NewSectionReader(reader, 0, 1<<63-1)
+	buffered := bufio.NewReader(section)
+
+	if err := pack.DecodeHeader(buffered, &header); err != nil {
+		return nil, nil, err
+	}
+
+	if err := checkNumNodes(&header); err != nil {
+		return nil, nil, err
+	}
+
+	palette, err := pack.DecodePalette(buffered, &header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	offset := int64(header.Size())
+	if palette != nil {
+		offset += 2 + 4*int64(len(palette))
+	}
+
+	// Trees are only allocated up front if reader is known to hold all nodes.
+	size, known := readerAtSize(reader)
+	if known {
+		fit := (size - offset) / int64(header.Format.MinNodeSize())
+		if fit < 0 {
+			fit = 0
+		}
+		if header.NumNodes > uint64(fit) {
+			return nil, nil, &NodeCountError{header.NumNodes, uint64(fit), true}
+		}
+	}
+
+	if !header.Format.FixedSize() || header.Compressed() || header.Checksummed() || (!known && header.NumNodes > maxUncheckedNodes) {
+		return LoadOctreeWithInfo(bufio.NewReader(io.NewSectionReader(reader, 0, 1<<63-1)))
+	}
+
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	numNodes := header.NumNodes
+	chunkNodes := numNodes/uint64(workers*loadChunksPerWorker) + 1
+	if chunkNodes < loadChunkNodes {
+		chunkNodes = loadChunkNodes
+	}
+	numChunks := (numNodes + chunkNodes - 1) / chunkNodes
+	if uint64(workers) > numChunks {
+		workers = int(numChunks)
+	}
+
+	var (
+		data      = make([]octreeNode, numNodes)
+		nodeSize  = int64(header.Format.NodeSize())
+		nextChunk uint64
+		errOnce   sync.Once
+		loadErr   error
+		wg        sync.WaitGroup
+	)
+
+	decodeChunk := func(start, end uint64) error {
+		var (
+			color    pack.Color
+			children [8]pack.NodeIndex
+		)
+
+		chunk := io.NewSectionReader(reader, offset+int64(start)*nodeSize, int64(end-start)*nodeSize)
+		chunkReader := bufio.NewReader(chunk)
+
+		for i := start; i < end; i++ {
+			if err := pack.DecodePaletteNodeAt(chunkReader, header.Format, pack.NodeIndex(i), palette, &color, children[:]); err != nil {
+				return err
+			}
+			if err := data[i].setNode(&color, children[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				chunk := atomic.AddUint64(&nextChunk, 1) - 1
+				if chunk >= numChunks {
+					return
+				}
+
+				start := chunk * chunkNodes
+				end := start + chunkNodes
+				if end > numNodes {
+					end = numNodes
+				}
+
+				if err := decodeChunk(start, end); err != nil {
+					errOnce.Do(func() { loadErr = err })
+					atomic.StoreUint64(&nextChunk, numChunks)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if loadErr != nil {
+		return nil, nil, loadErr
+	}
+	return data, newTreeInfo(&header), nil
+}
+
+// NewOctree returns the tree of data in the layout LoadOctree creates, without
+// encoding it. Data is most likely from pack.BuildTreeData. Children out of range
+// fail with InvalidTreeError.
+func NewOctree(data *pack.FrameData) (Octree, *TreeInfo, error) {
+	header := data.Header
+	header.NumNodes = uint64(len(data.Colors))
+	if err := checkNumNodes(&header); err != nil {
+		return nil, nil, err
+	}
+	if len(data.Children) != len(data.Colors) {
+		return nil, nil, InvalidTreeError
+	}
+
+	tree := make(Octree, len(data.Colors))
+	for i := range tree {
+		for _, child := range data.Children[i] {
+			if int(child) >= len(tree) {
+				return nil, nil, InvalidTreeError
+			}
+		}
+		if err := tree[i].setNode(&data.Colors[i], data.Children[i][:]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return tree, newTreeInfo(&header), nil
+}
+
+// BuildOctree builds the tree of cfg in memory, see pack.BuildTreeData.
+func BuildOctree(cfg *pack.BuildConfig) (Octree, *TreeInfo, pack.BuildStatus, error) {
+	data, status, err := pack.BuildTreeData(cfg)
+	if err != nil {
+		return nil, nil, status, err
+	}
+
+	tree, info, err := NewOctree(data)
+	return tree, info, status, err
+}
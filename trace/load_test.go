@@ -0,0 +1,612 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+func TestLoadOctreeParallel(t *testing.T) {
+	var source bytes.Buffer
+	if err := testSphere(5).Save(&source, pack.MipR8G8B8A8UnpackUI32); err != nil {
+		panic(err)
+	}
+
+	palette := pack.Palette{{R: 0, G: 0, B: 0, A: 1}, {R: 1, G: 0.5, B: 0, A: 1}, {R: 0, G: 0.5, B: 1, A: 1}}
+	formats := []pack.OctreeFormat{
+		pack.MipR8G8B8A8UnpackUI32,
+		pack.MipR5G6B5UnpackUI16,
+		pack.MipR8G8B8A8RelativeUI16,
+		pack.MipR8G8B8A8DeltaUI32,
+		pack.MipP8UnpackUI32,
+		pack.MipR8G8B8A8UnpackUI64,
+		pack.MipR8G8B8A8FlagsUI32,
+	}
+
+	for _, format := range formats {
+		var buf bytes.Buffer
+		if err := pack.TranscodeTreePalette(bytes.NewReader(source.Bytes()), &buf, format, palette); err != nil {
+			panic(err)
+		}
+
+		expected, expectedInfo, err := LoadOctreeWithInfo(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			panic(err)
+		}
+
+		for _, workers := range []int{0, 1, 3} {
+			tree, info, err := LoadOctreeParallel(bytes.NewReader(buf.Bytes()), workers)
+			if err != nil {
+				t.Fatalf("format %v: %v", format, err)
+			}
+			if *info != *expectedInfo {
+				t.Errorf("format %v: expected %+v, got %+v", format, *expectedInfo, *info)
+			}
+			if !reflect.DeepEqual(tree, expected) {
+				t.Errorf("format %v with %v workers: tree differs from sequential load", format, workers)
+			}
+		}
+
+		// A truncated tree fails like the sequential load.
+		truncated := buf.Bytes()[:buf.Len()-1]
+		if _, _, err := LoadOctreeParallel(bytes.NewReader(truncated), 2); err == nil {
+			t.Errorf("format %v: expected error for truncated tree", format)
+		}
+	}
+}
+
+func TestLoadChunked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sphere := testSphere(5)
+	var source bytes.Buffer
+	if err := sphere.Save(&source, pack.MipR8G8B8A8PackUI28); err != nil {
+		t.Fatal(err)
+	}
+
+	// Chunks of an odd size split the nodes at every offset.
+	manifest := filepath.Join(dir, "sphere.json")
+	chunks, err := pack.NewChunkWriter(manifest, 1001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sphere.Save(chunks, pack.MipR8G8B8A8PackUI28); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunks.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := pack.OpenChunked(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	expected, _, err := LoadOctreeWithInfo(bytes.NewReader(source.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parallel, info, err := LoadOctreeParallel(reader, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parallel, expected) || info.NumNodes != uint64(len(expected)) {
+		t.Error("the tree loaded in parallel from chunks differs")
+	}
+
+	streamed, _, err := LoadOctreeWithInfo(io.NewSectionReader(reader, 0, reader.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(streamed, expected) {
+		t.Error("the tree streamed from chunks differs")
+	}
+}
+
+func TestLoadWideIndices(t *testing.T) {
+	header := pack.NewOctreeHeader(pack.MipR8G8B8A8UnpackUI64, 2)
+	header.NumNodes = 2
+
+	var buf bytes.Buffer
+	if err := pack.EncodeHeader(&buf, header); err != nil {
+		panic(err)
+	}
+
+	white := pack.Color{R: 1, G: 1, B: 1, A: 1}
+	root := []pack.NodeIndex{1, 0, 0, 0, 0, 0, 0, 0}
+	if err := pack.EncodeNode(&buf, header.Format, white, root); err != nil {
+		panic(err)
+	}
+
+	// The leaf points past what nodes in memory can address.
+	leaf := []pack.NodeIndex{0, 0, 0, 0, 0, 0, 0, maxUint28 + 1}
+	if err := pack.EncodeNode(&buf, header.Format, white, leaf); err != nil {
+		panic(err)
+	}
+
+	if _, _, err := LoadOctreeWithInfo(bytes.NewReader(buf.Bytes())); err != Uint28OverflowError {
+		t.Errorf("expected overflow error, got %v", err)
+	}
+
+	if _, _, err := LoadOctreeParallel(bytes.NewReader(buf.Bytes()), 1); err != Uint28OverflowError {
+		t.Errorf("expected overflow error from parallel load, got %v", err)
+	}
+
+	header.NumNodes = maxUint28 + 2
+	buf.Reset()
+	if err := pack.EncodeHeader(&buf, header); err != nil {
+		panic(err)
+	}
+
+	if _, _, err := LoadOctreeWithInfo(bytes.NewReader(buf.Bytes())); err != Uint28OverflowError {
+		t.Errorf("expected overflow error for node count, got %v", err)
+	}
+}
+
+// TestLoadNodeFlags loads a legacy tree where a node only references index zero,
+// and the same tree with explicit leaf flags where the leaf stores stale
+// children.
+func TestLoadNodeFlags(t *testing.T) {
+	white := pack.Color{R: 1, G: 1, B: 1, A: 1}
+	root := []pack.NodeIndex{1, 0, 0, 0, 0, 0, 0, 0}
+	stale := []pack.NodeIndex{0, 0, 7, 0, 0, 0, 0, 0}
+
+	for _, format := range []pack.OctreeFormat{pack.MipR8G8B8A8UnpackUI32, pack.MipR8G8B8A8FlagsUI32} {
+		header := pack.NewOctreeHeader(format, 2)
+		header.NumNodes = 2
+		header.NumLeafs = 1
+
+		var buf bytes.Buffer
+		if err := pack.EncodeHeader(&buf, header); err != nil {
+			panic(err)
+		}
+		if err := pack.EncodeNodeFlags(&buf, format, 0, white, root, 0); err != nil {
+			panic(err)
+		}
+
+		var err error
+		if format.HasNodeFlags() {
+			err = pack.EncodeNodeFlags(&buf, format, 1, white, stale, pack.NodeLeaf)
+		} else {
+			err = pack.EncodeNodeFlags(&buf, format, 1, white, make([]pack.NodeIndex, 8), pack.NodeLeaf)
+		}
+		if err != nil {
+			panic(err)
+		}
+
+		tree, _, err := LoadOctree(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("format %v: %v", format, err)
+		}
+		if tree[0].leaf() || !tree[1].leaf() || tree[1].childMask() != 0 {
+			t.Errorf("format %v: unexpected leafs", format)
+		}
+
+		var leafs int
+		tree.Walk(func(index uint32, depth int, pos [3]float32, scale float32, leaf bool) bool {
+			if leaf {
+				leafs++
+			}
+			return true
+		})
+		if leafs != 1 {
+			t.Errorf("format %v: expected one leaf, walked %d", format, leafs)
+		}
+	}
+}
+
+func TestLoadChecksum(t *testing.T) {
+	var samples []pack.Sample
+	for i := 0; i < 4; i++ {
+		samples = append(samples, pack.Sample{Pos: pack.Point{X: float64(i) + 0.5, Y: 0.5, Z: 0.5}, Col: pack.Color{R: 1, A: 1}})
+	}
+
+	var buf bytes.Buffer
+	cfg := pack.BuildConfig{
+		Worker:        pack.NewFakeWorker(samples),
+		Writer:        &buf,
+		Bounds:        pack.Box{Size: 4},
+		VoxelsPerAxis: 4,
+		Format:        pack.MipR8G8B8A8UnpackUI32,
+		Checksum:      true,
+	}
+	if _, err := pack.BuildTree(&cfg); err != nil {
+		panic(err)
+	}
+
+	// Trees stored back to back are loaded one after the other.
+	data := append(append([]byte(nil), buf.Bytes()...), buf.Bytes()...)
+	reader := bytes.NewReader(data)
+	for i := 0; i < 2; i++ {
+		if _, _, err := LoadOctreeWithInfo(reader); err != nil {
+			t.Fatalf("tree %v: %v", i, err)
+		}
+	}
+
+	var header pack.OctreeHeader
+	if err := pack.DecodeHeader(bytes.NewReader(data), &header); err != nil {
+		panic(err)
+	}
+	data[header.Size()+header.Format.NodeSize()+1] ^= 0x40
+
+	if _, _, err := LoadOctreeWithInfo(bytes.NewReader(data)); err == nil {
+		t.Error("expected checksum mismatch")
+	} else if _, ok := err.(*pack.ErrChecksumMismatch); !ok {
+		t.Error("expected checksum mismatch, got:", err)
+	} else if corrupt := new(pack.ErrCorrupt); !errors.As(err, &corrupt) {
+		t.Error("expected checksum mismatches to be corrupt")
+	}
+
+	if _, _, err := LoadOctreeParallel(bytes.NewReader(data), 2); err == nil {
+		t.Error("expected checksum mismatch from parallel load")
+	}
+
+	reader = bytes.NewReader(data)
+	for i := 0; i < 2; i++ {
+		if _, _, err := LoadOctreeWithOptions(reader, LoadOctreeOptions{SkipChecksum: true}); err != nil {
+			t.Errorf("tree %v: expected load without verification, got: %v", i, err)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for name, load := range map[string]func(data []byte) error{
+		"sequential": func(data []byte) error {
+			_, _, err := LoadOctreeWithInfo(struct{ io.Reader }{bytes.NewReader(data)})
+			return err
+		},
+		"parallel": func(data []byte) error {
+			_, _, err := LoadOctreeParallel(bytes.NewReader(data), 2)
+			return err
+		},
+	} {
+		if err := load([]byte("not a tree")); !errors.Is(err, pack.ErrBadMagic) || ExitCode(err) != pack.ExitUnsupported {
+			t.Errorf("%s: expected pack.ErrBadMagic, got %v", name, err)
+		}
+
+		data := generatedTree(10)
+		data[4]++
+		if err := load(data); !errors.Is(err, pack.ErrUnsupportedFormat) {
+			t.Errorf("%s: expected pack.ErrUnsupportedFormat, got %v", name, err)
+		}
+	}
+
+	// The ninth node is cut short. The size of the reader is unknown, so the
+	// tree is not rejected before it is read.
+	data := generatedTree(10)
+	_, _, err := LoadOctreeWithInfo(struct{ io.Reader }{bytes.NewReader(data[:len(data)-40])})
+
+	var corrupt *pack.ErrCorrupt
+	if nodeSize := int64(pack.MipR8G8B8A8UnpackUI32.NodeSize()); !errors.As(err, &corrupt) || corrupt.Offset != 8*nodeSize {
+		t.Errorf("expected node 8 to be corrupt, got %v", err)
+	}
+	if code := ExitCode(err); code != pack.ExitCorrupt {
+		t.Errorf("expected exit code %d, got %d", pack.ExitCorrupt, code)
+	}
+}
+
+// generatedTree returns a tree of numNodes nodes with random colors and children.
+func generatedTree(numNodes int) []byte {
+	rnd := rand.New(rand.NewSource(1))
+	header := pack.NewOctreeHeader(pack.MipR8G8B8A8UnpackUI32, 1<<10)
+	header.NumNodes = uint64(numNodes)
+
+	var buf bytes.Buffer
+	buf.Grow(header.Size() + numNodes*header.Format.NodeSize())
+	if err := pack.EncodeHeader(&buf, header); err != nil {
+		panic(err)
+	}
+
+	var node [9]uint32
+	for i := 0; i < numNodes; i++ {
+		node[0] = rnd.Uint32() | 0xff
+		for j := 1; j < len(node); j++ {
+			node[j] = uint32(rnd.Intn(numNodes))
+		}
+		binary.Write(&buf, binary.LittleEndian, node)
+	}
+	return buf.Bytes()
+}
+
+func benchmarkLoad(b *testing.B, load func(r *bytes.Reader) error) {
+	data := generatedTree(4 << 20)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := load(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLoadOctree(b *testing.B) {
+	benchmarkLoad(b, func(r *bytes.Reader) error {
+		_, _, err := LoadOctreeWithInfo(r)
+		return err
+	})
+}
+
+func BenchmarkLoadOctreeParallel(b *testing.B) {
+	benchmarkLoad(b, func(r *bytes.Reader) error {
+		_, _, err := LoadOctreeParallel(r, 0)
+		return err
+	})
+}
+
+func TestBuildPreview(t *testing.T) {
+	const vpa = 16
+
+	// A 16x16x16 cube filled in scan order, so every preview has more of it.
+	var samples []pack.Sample
+	for z := 0; z < vpa; z++ {
+		for y := 0; y < vpa; y++ {
+			for x := 0; x < vpa; x++ {
+				pos := pack.Point{X: float64(x) + 0.5, Y: float64(y) + 0.5, Z: float64(z) + 0.5}
+				samples = append(samples, pack.Sample{Pos: pos, Col: pack.Color{R: 1, G: 0.5, B: 0.25, A: 1}})
+			}
+		}
+	}
+
+	var previews [][]byte
+	cfg := pack.BuildConfig{
+		Worker:          pack.NewFakeWorker(samples),
+		Writer:          &bytes.Buffer{},
+		Bounds:          pack.Box{Size: vpa},
+		VoxelsPerAxis:   vpa,
+		Format:          pack.MipR8G8B8A8UnpackUI32,
+		Preview:         func(tree []byte) { previews = append(previews, tree) },
+		PreviewInterval: time.Nanosecond,
+	}
+	if _, err := pack.BuildTree(&cfg); err != nil {
+		panic(err)
+	}
+
+	// Previews are taken before the first of every 1024 samples is inserted.
+	if len(previews) != 4 {
+		t.Fatalf("expected a preview at every quarter of the samples, got %v", len(previews))
+	}
+
+	rect := image.Rect(0, 0, 32, 32)
+	var numNodes []uint64
+	for i, preview := range previews {
+		tree, info, err := LoadOctreeWithInfo(bytes.NewReader(preview))
+		if err != nil {
+			t.Fatalf("preview %v: %v", i, err)
+		}
+		numNodes = append(numNodes, info.NumNodes)
+
+		rtCfg := Config{
+			FieldOfViewDegrees: 45,
+			Images:             [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		}
+		rtCfg.FitTree(info)
+		rtCfg.ViewDist = 4 * rtCfg.TreeScale
+
+		// The half built tree is the back half of the cube.
+		camera := FrameTree(info, Vec3{0, 0, -1})
+		rt := NewRaytracer(rtCfg)
+		rt.SetClearColor(testClearColor)
+		img := rt.Image(rt.Trace(&camera, tree, info.Depth))
+		rt.Close()
+
+		if i == 1 && img.RGBAAt(15, 15) == testClearColor {
+			t.Error("expected the half built tree at the image center")
+		}
+	}
+
+	if !(numNodes[0] < numNodes[1] && numNodes[1] < numNodes[2] && numNodes[2] < numNodes[3]) {
+		t.Error("expected the previews to grow, got node counts:", numNodes)
+	}
+}
+
+// TestBuildOctree builds the same samples to a file and in memory, with and without
+// optimizing. Both trees and their sidecars must match and render the same.
+func TestBuildOctree(t *testing.T) {
+	const vpa = 16
+
+	rnd := rand.New(rand.NewSource(7))
+	var samples []pack.Sample
+	for i := 0; i < 2000; i++ {
+		pos := pack.Point{X: rnd.Float64() * vpa, Y: rnd.Float64() * vpa / 2, Z: rnd.Float64() * vpa}
+		col := pack.Color{R: rnd.Float32(), G: rnd.Float32(), B: rnd.Float32(), A: 1}
+		samples = append(samples, pack.Sample{Pos: pos, Col: col})
+	}
+
+	for _, optimize := range []bool{false, true} {
+		var file, fileSidecar, memorySidecar bytes.Buffer
+		cfg := pack.BuildConfig{
+			Worker:        pack.NewFakeWorker(samples),
+			Writer:        &file,
+			Bounds:        pack.Box{Size: vpa},
+			VoxelsPerAxis: vpa,
+			Format:        pack.MipR8G8B8A8UnpackUI64,
+			Optimize:      optimize,
+			Sidecar:       &fileSidecar,
+		}
+		if _, err := pack.BuildTree(&cfg); err != nil {
+			t.Fatal(err)
+		}
+		loaded, loadedInfo, err := LoadOctreeWithInfo(&file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cfg.Worker, cfg.Writer, cfg.Sidecar = pack.NewFakeWorker(samples), nil, &memorySidecar
+		tree, info, status, err := BuildOctree(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(tree, loaded) || !reflect.DeepEqual(info, loadedInfo) {
+			t.Errorf("optimize %v: the tree built in memory differs from the loaded one", optimize)
+		}
+		if !bytes.Equal(memorySidecar.Bytes(), fileSidecar.Bytes()) {
+			t.Errorf("optimize %v: sidecars differ", optimize)
+		}
+		if status.NumSamples != uint64(len(samples)) {
+			t.Errorf("optimize %v: expected %d samples, got %d", optimize, len(samples), status.NumSamples)
+		}
+
+		render := func(tree Octree) *image.RGBA {
+			rect := image.Rect(0, 0, 32, 32)
+			rtCfg := Config{
+				FieldOfViewDegrees: 45,
+				Images:             [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+			}
+			rtCfg.FitTree(info)
+			rtCfg.ViewDist = 4 * rtCfg.TreeScale
+
+			camera := FrameTree(info, Vec3{-1, -1, -1})
+			rt := NewRaytracer(rtCfg)
+			defer rt.Close()
+			return rt.Image(rt.Trace(&camera, tree, info.Depth))
+		}
+		if !bytes.Equal(render(tree).Pix, render(loaded).Pix) {
+			t.Errorf("optimize %v: the trees render differently", optimize)
+		}
+	}
+
+	data := &pack.FrameData{Colors: make([]pack.Color, 1), Children: [][8]pack.NodeIndex{{1}}}
+	if _, _, err := NewOctree(data); err != InvalidTreeError {
+		t.Errorf("expected a child out of range to fail, got %v", err)
+	}
+}
+
+// hugeTree returns a tree header that claims the most nodes a tree can have,
+// followed by a single node.
+func hugeTree() []byte {
+	data := generatedTree(1)
+	binary.LittleEndian.PutUint64(data[8:], maxUint28+1)
+	return data
+}
+
+// onlyReader hides all methods but Read, so the length of the data is unknown.
+type onlyReader struct {
+	io.Reader
+}
+
+func TestLoadNodeGuard(t *testing.T) {
+	data := hugeTree()
+
+	expected := NodeCountError{maxUint28 + 1, 1, true}
+	if _, _, err := LoadOctreeWithInfo(bytes.NewReader(data)); !reflect.DeepEqual(err, &expected) {
+		t.Errorf("expected %v, got %v", &expected, err)
+	}
+	if _, _, err := LoadOctreeParallel(bytes.NewReader(data), 0); !reflect.DeepEqual(err, &expected) {
+		t.Errorf("parallel: expected %v, got %v", &expected, err)
+	}
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	allocated := stats.TotalAlloc
+
+	if _, _, err := LoadOctreeWithInfo(onlyReader{bytes.NewReader(data)}); err == nil {
+		t.Error("expected error for unknown length")
+	}
+
+	runtime.ReadMemStats(&stats)
+	if n := stats.TotalAlloc - allocated; n > 64<<20 {
+		t.Errorf("allocated %v bytes for a tree of one node", n)
+	}
+}
+
+func TestLoadMaxNodes(t *testing.T) {
+	data := generatedTree(9)
+
+	if _, _, err := LoadOctreeWithOptions(bytes.NewReader(data), LoadOctreeOptions{MaxNodes: 9}); err != nil {
+		t.Error(err)
+	}
+
+	expected := NodeCountError{9, 8, false}
+	_, _, err := LoadOctreeWithOptions(bytes.NewReader(data), LoadOctreeOptions{MaxNodes: 8})
+	if !reflect.DeepEqual(err, &expected) {
+		t.Errorf("expected %v, got %v", &expected, err)
+	}
+
+	// Forged headers are rejected before the nodes are read.
+	forged := func(numNodes uint64) io.Reader {
+		header := pack.NewOctreeHeader(pack.MipR8G8B8A8UnpackUI32, 2)
+		header.NumNodes = numNodes
+
+		var buf bytes.Buffer
+		if err := pack.EncodeHeader(&buf, header); err != nil {
+			panic(err)
+		}
+		return onlyReader{&buf}
+	}
+
+	_, _, err = LoadOctreeWithOptions(forged(1<<32), LoadOctreeOptions{MaxNodes: 8})
+	if err != Uint28OverflowError {
+		t.Errorf("expected %v, got %v", Uint28OverflowError, err)
+	}
+
+	_, _, err = LoadOctreeWithOptions(forged(1000), LoadOctreeOptions{MaxNodes: 8})
+	if e, ok := err.(*NodeCountError); !ok || e.NumNodes != 1000 || e.Truncated {
+		t.Errorf("expected node count error, got %v", err)
+	}
+}
+
+func FuzzLoadOctree(f *testing.F) {
+	f.Add(generatedTree(9))
+	f.Add(hugeTree())
+
+	var buf bytes.Buffer
+	if err := pack.TranscodeTree(bytes.NewReader(generatedTree(9)), &buf, pack.MipR8G8B8A8DeltaUI32); err != nil {
+		panic(err)
+	}
+	f.Add(buf.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tree, info, err := LoadOctreeWithInfo(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if uint64(len(tree)) != info.NumNodes {
+			t.Fatalf("loaded %v nodes, header has %v", len(tree), info.NumNodes)
+		}
+
+		parallel, _, err := LoadOctreeParallel(bytes.NewReader(data), 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tree, parallel) {
+			t.Error("parallel load differs")
+		}
+	})
+}
@@ -0,0 +1,237 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package trace
+
+import (
+	"bufio"
+	"errors"
+	"image/color"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxLUT1DSize = 65536
+	maxLUT3DSize = 256
+)
+
+var InvalidLUTError = errors.New("invalid cube LUT")
+
+// LUT is a color grading lookup table, applied to the final colors of every pixel
+// when set in Config. A 1D table maps the channels independently, a 3D table maps
+// colors with trilinear interpolation. Alpha is left unchanged.
+type LUT struct {
+	Title string
+
+	// Size is the number of entries of a 1D table or the number of entries per
+	// axis of a 3D table.
+	Size int
+	Is3D bool
+
+	// DomainMin and DomainMax are the input values mapped to the first and last
+	// entry, inputs outside of them are clamped.
+	DomainMin, DomainMax Vec3
+
+	// curves is the output of a 1D table for every 8-bit input.
+	curves [3][256]uint8
+
+	// table holds the RGB entries of a 3D table with red changing fastest.
+	// index and weight give the offset into table of the lower entry and the
+	// interpolation weight of the next one, for every 8-bit input of a channel.
+	table  []float32
+	index  [3][256]int32
+	weight [3][256]float32
+}
+
+// ParseCube reads a LUT in the .cube format.
+func ParseCube(r io.Reader) (*LUT, error) {
+	lut := &LUT{DomainMax: Vec3{1, 1, 1}}
+	var entries []float32
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "TITLE":
+			lut.Title = strings.Trim(strings.TrimSpace(line[len("TITLE"):]), "\"")
+		case "LUT_1D_SIZE", "LUT_3D_SIZE":
+			if lut.Size != 0 || len(fields) != 2 {
+				return nil, InvalidLUTError
+			}
+
+			lut.Is3D = fields[0] == "LUT_3D_SIZE"
+			max := maxLUT1DSize
+			if lut.Is3D {
+				max = maxLUT3DSize
+			}
+
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n < 2 || n > max {
+				return nil, InvalidLUTError
+			}
+			lut.Size = n
+		case "DOMAIN_MIN", "DOMAIN_MAX":
+			v, err := parseFloats(fields[1:], 3)
+			if err != nil {
+				return nil, err
+			}
+
+			domain := &lut.DomainMin
+			if fields[0] == "DOMAIN_MAX" {
+				domain = &lut.DomainMax
+			}
+			copy(domain[:], v)
+		case "LUT_1D_INPUT_RANGE", "LUT_3D_INPUT_RANGE":
+			v, err := parseFloats(fields[1:], 2)
+			if err != nil {
+				return nil, err
+			}
+			lut.DomainMin = Vec3{v[0], v[0], v[0]}
+			lut.DomainMax = Vec3{v[1], v[1], v[1]}
+		default:
+			if lut.Size == 0 {
+				return nil, InvalidLUTError
+			}
+			v, err := parseFloats(fields, 3)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, v...)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range lut.DomainMin {
+		if !(lut.DomainMin[i] < lut.DomainMax[i]) {
+			return nil, InvalidLUTError
+		}
+	}
+
+	n := lut.Size
+	if lut.Is3D {
+		n = n * n * n
+	}
+	if n == 0 || len(entries) != n*3 {
+		return nil, InvalidLUTError
+	}
+
+	lut.precompute(entries)
+	return lut, nil
+}
+
+func parseFloats(fields []string, n int) ([]float32, error) {
+	if len(fields) != n {
+		return nil, InvalidLUTError
+	}
+
+	v := make([]float32, n)
+	for i, f := range fields {
+		x, err := strconv.ParseFloat(f, 32)
+		if err != nil {
+			return nil, InvalidLUTError
+		}
+		v[i] = float32(x)
+	}
+	return v, nil
+}
+
+// lattice returns the lower entry and the interpolation weight for the 8-bit input v
+// of channel ch.
+func (lut *LUT) lattice(ch int, v int) (int, float32) {
+	min, max := lut.DomainMin[ch], lut.DomainMax[ch]
+	t := (float32(v)/255 - min) / (max - min)
+	if t < 0 {
+		t = 0
+	} else if t > 1 {
+		t = 1
+	}
+
+	x := t * float32(lut.Size-1)
+	i := int(x)
+	if i >= lut.Size-1 {
+		i = lut.Size - 2
+	}
+	return i, x - float32(i)
+}
+
+func (lut *LUT) precompute(entries []float32) {
+	if !lut.Is3D {
+		for ch := 0; ch < 3; ch++ {
+			for v := 0; v < 256; v++ {
+				i, w := lut.lattice(ch, v)
+				a, b := entries[i*3+ch], entries[(i+1)*3+ch]
+				lut.curves[ch][v] = quantize(a+(b-a)*w, 0)
+			}
+		}
+		return
+	}
+
+	lut.table = entries
+	stride := [3]int{3, 3 * lut.Size, 3 * lut.Size * lut.Size}
+	for ch := 0; ch < 3; ch++ {
+		for v := 0; v < 256; v++ {
+			i, w := lut.lattice(ch, v)
+			lut.index[ch][v] = int32(i * stride[ch])
+			lut.weight[ch][v] = w
+		}
+	}
+}
+
+// Apply returns the graded color c.
+func (lut *LUT) Apply(c color.RGBA) color.RGBA {
+	if !lut.Is3D {
+		return color.RGBA{lut.curves[0][c.R], lut.curves[1][c.G], lut.curves[2][c.B], c.A}
+	}
+
+	n := int32(lut.Size * 3)
+	r, g, b := lut.index[0][c.R], lut.index[1][c.G], lut.index[2][c.B]
+	wr, wg, wb := lut.weight[0][c.R], lut.weight[1][c.G], lut.weight[2][c.B]
+
+	// The corners of the cell around c, with red changing fastest.
+	base := r + g + b
+	corners := [8]int32{base, base + 3, base + n, base + n + 3}
+	for i := 0; i < 4; i++ {
+		corners[i+4] = corners[i] + n*int32(lut.Size)
+	}
+
+	t := lut.table
+	var out [3]float32
+	for ch := range out {
+		var v [8]float32
+		for i, offset := range corners {
+			v[i] = t[offset+int32(ch)]
+		}
+
+		x0 := v[0] + (v[1]-v[0])*wr
+		x1 := v[2] + (v[3]-v[2])*wr
+		x2 := v[4] + (v[5]-v[4])*wr
+		x3 := v[6] + (v[7]-v[6])*wr
+		y0 := x0 + (x1-x0)*wg
+		y1 := x2 + (x3-x2)*wg
+		out[ch] = y0 + (y1-y0)*wb
+	}
+	return color.RGBA{quantize(out[0], 0), quantize(out[1], 0), quantize(out[2], 0), c.A}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package trace
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// cubeLUT returns a 3D .cube file of size entries per axis mapping colors with f.
+func cubeLUT(size int, f func(r, g, b float32) [3]float32) string {
+	var text bytes.Buffer
+	fmt.Fprintf(&text, "TITLE \"test\"\nLUT_3D_SIZE %d\n", size)
+	n := float32(size - 1)
+	for b := 0; b < size; b++ {
+		for g := 0; g < size; g++ {
+			for r := 0; r < size; r++ {
+				c := f(float32(r)/n, float32(g)/n, float32(b)/n)
+				fmt.Fprintf(&text, "%f %f %f\n", c[0], c[1], c[2])
+			}
+		}
+	}
+	return text.String()
+}
+
+func parseTestCube(text string) *LUT {
+	lut, err := ParseCube(strings.NewReader(text))
+	if err != nil {
+		panic(err)
+	}
+	return lut
+}
+
+func TestParseCube(t *testing.T) {
+	lut := parseTestCube(`# A curve that only lifts the shadows.
+TITLE "Lift"
+LUT_1D_SIZE 3
+DOMAIN_MIN 0 0 0.5
+DOMAIN_MAX 1 1 1
+
+0.2 0.2 0
+0.6 0.6 0.5
+1 1 1
+`)
+
+	if lut.Title != "Lift" || lut.Size != 3 || lut.Is3D {
+		t.Errorf("unexpected LUT: %v %v %v", lut.Title, lut.Size, lut.Is3D)
+	}
+	if lut.DomainMin != (Vec3{0, 0, 0.5}) || lut.DomainMax != (Vec3{1, 1, 1}) {
+		t.Errorf("unexpected domain: %v %v", lut.DomainMin, lut.DomainMax)
+	}
+
+	// Blue inputs below the domain are clamped to the first entry.
+	for _, test := range []struct{ in, out color.RGBA }{
+		{color.RGBA{0, 0, 0, 7}, color.RGBA{51, 51, 0, 7}},
+		{color.RGBA{255, 255, 255, 255}, color.RGBA{255, 255, 255, 255}},
+		{color.RGBA{0, 0, 100, 255}, color.RGBA{51, 51, 0, 255}},
+		{color.RGBA{255, 0, 191, 255}, color.RGBA{255, 51, 127, 255}},
+	} {
+		if out := lut.Apply(test.in); out != test.out {
+			t.Errorf("%v: %v != %v", test.in, out, test.out)
+		}
+	}
+
+	// The input range stretches 0.2 to 0.8 over the table.
+	lut = parseTestCube("LUT_3D_INPUT_RANGE 0.2 0.8\n" + cubeLUT(2, func(r, g, b float32) [3]float32 { return [3]float32{r, g, b} }))
+	if !lut.Is3D || lut.DomainMin != (Vec3{0.2, 0.2, 0.2}) || lut.DomainMax != (Vec3{0.8, 0.8, 0.8}) {
+		t.Errorf("unexpected LUT: %v %v %v", lut.Is3D, lut.DomainMin, lut.DomainMax)
+	}
+	if c := lut.Apply(color.RGBA{40, 112, 255, 255}); c != (color.RGBA{0, 102, 255, 255}) {
+		t.Errorf("unexpected color: %v", c)
+	}
+
+	for _, text := range []string{
+		"",
+		"0 0 0\n1 1 1\n",
+		"LUT_1D_SIZE 1\n0 0 0\n",
+		"LUT_1D_SIZE 2\n0 0 0\n",
+		"LUT_1D_SIZE 2\n0 0 0\n1 1 x\n",
+		"LUT_1D_SIZE 2\n0 0 0\n1 1\n",
+		"LUT_1D_SIZE 2\nDOMAIN_MIN 1 0 0\n0 0 0\n1 1 1\n",
+		"LUT_1D_SIZE 2\nLUT_3D_SIZE 2\n0 0 0\n1 1 1\n",
+		"LUT_3D_SIZE 2\n0 0 0\n1 1 1\n",
+	} {
+		if _, err := ParseCube(strings.NewReader(text)); err != InvalidLUTError {
+			t.Errorf("%q: expected InvalidLUTError, got %v", text, err)
+		}
+	}
+}
+
+func TestNeutralLUT(t *testing.T) {
+	identity := func(r, g, b float32) [3]float32 { return [3]float32{r, g, b} }
+	for _, size := range []int{2, 17, 33} {
+		lut := parseTestCube(cubeLUT(size, identity))
+		for v := 0; v < 256; v++ {
+			for _, c := range []color.RGBA{{uint8(v), 0, 0, 255}, {0, uint8(v), 255, 255}, {uint8(v), uint8(v / 3), uint8(255 - v), 10}} {
+				if out := lut.Apply(c); out != c {
+					t.Fatalf("size %v: %v != %v", size, out, c)
+				}
+			}
+		}
+	}
+}
+
+func renderLUT(lut *LUT) *image.RGBA {
+	tree := testSphere(4)
+	rect := image.Rect(0, 0, 32, 32)
+	rt := NewRaytracer(Config{
+		FieldOfView: 0.8,
+		TreeScale:   1,
+		ViewDist:    5,
+		LUT:         lut,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	defer rt.Close()
+	rt.SetClearColor(testClearColor)
+
+	camera := LookAtCamera{Pos: Vec3{0.3, 0.6, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	return rt.Image(rt.Trace(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis())))
+}
+
+func TestLUTFrame(t *testing.T) {
+	plain := renderLUT(nil)
+
+	neutral := renderLUT(parseTestCube(cubeLUT(17, func(r, g, b float32) [3]float32 { return [3]float32{r, g, b} })))
+	if !bytes.Equal(plain.Pix, neutral.Pix) {
+		t.Error("a neutral LUT changed the frame")
+	}
+
+	inverted := renderLUT(parseTestCube(cubeLUT(2, func(r, g, b float32) [3]float32 { return [3]float32{1 - r, 1 - g, 1 - b} })))
+	for i := range plain.Pix {
+		expected := 255 - plain.Pix[i]
+		if i%4 == 3 {
+			expected = plain.Pix[i]
+		}
+		if inverted.Pix[i] != expected {
+			t.Fatalf("byte %v: %v != %v", i, inverted.Pix[i], expected)
+		}
+	}
+}
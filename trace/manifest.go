@@ -0,0 +1,148 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"math"
+
+	"github.com/andreas-jonsson/octatron/go3d/vec3"
+)
+
+// matrixNear is the distance of the near plane of CameraMatrix. The far plane
+// is at infinity.
+const matrixNear = 0.001
+
+type (
+	// ManifestCamera is the camera of a RenderManifest.
+	ManifestCamera struct {
+		Position Vec3 `json:"position"`
+		LookAt   Vec3 `json:"look_at"`
+		Up       Vec3 `json:"up"`
+	}
+
+	// ManifestConfig are the settings of the raytracer that change the image.
+	ManifestConfig struct {
+		TreePosition  Vec3       `json:"tree_position"`
+		TreeScale     float32    `json:"tree_scale"`
+		ViewDist      float32    `json:"view_dist"`
+		Near          float32    `json:"near"`
+		Jitter        bool       `json:"jitter"`
+		Samples       int        `json:"samples"`
+		HighPrecision bool       `json:"high_precision"`
+		Traversal     Traversal  `json:"traversal"`
+		Projection    Projection `json:"projection"`
+		Stereo        float32    `json:"stereo"`
+		FlipX         bool       `json:"flip_x"`
+		FlipY         bool       `json:"flip_y"`
+	}
+
+	// RenderManifest describes how a frame was rendered, so it can be rendered
+	// again or combined with the output of other renderers. Matrix is the
+	// CameraMatrix of the frame, mirrored like the image by FlipX and FlipY, and
+	// FieldOfView is in radians.
+	RenderManifest struct {
+		Frame       int            `json:"frame"`
+		Camera      ManifestCamera `json:"camera"`
+		Matrix      [16]float32    `json:"matrix"`
+		Width       int            `json:"width"`
+		Height      int            `json:"height"`
+		FieldOfView float32        `json:"field_of_view"`
+		Tree        string         `json:"tree"`
+		TreeHash    string         `json:"tree_hash"`
+		Config      ManifestConfig `json:"config"`
+
+		// RenderTime is the time spent rendering the frame, in seconds.
+		RenderTime float64 `json:"render_time"`
+	}
+)
+
+// NewRenderManifest returns the manifest of a frame of size rendered with camera
+// and cfg. The tree and the timing are left to the caller.
+func NewRenderManifest(cfg *Config, camera Camera, size image.Point) RenderManifest {
+	fov := cfg.fieldOfView()
+
+	// Flipped images mirror the projected coordinates.
+	matrix := CameraMatrix(camera, fov, size)
+	for col := 0; col < 4; col++ {
+		if cfg.FlipX {
+			matrix[col*4+0] = -matrix[col*4+0]
+		}
+		if cfg.FlipY {
+			matrix[col*4+1] = -matrix[col*4+1]
+		}
+	}
+
+	return RenderManifest{
+		Camera:      ManifestCamera{camera.Position(), camera.LookAt(), camera.Up()},
+		Matrix:      matrix,
+		Width:       size.X,
+		Height:      size.Y,
+		FieldOfView: fov,
+		Config: ManifestConfig{
+			TreePosition:  cfg.TreePosition,
+			TreeScale:     cfg.TreeScale,
+			ViewDist:      cfg.ViewDist,
+			Near:          cfg.Near,
+			Jitter:        cfg.Jitter,
+			Samples:       cfg.Samples,
+			HighPrecision: cfg.HighPrecision,
+			Traversal:     cfg.Traversal,
+			Projection:    cfg.Projection,
+			Stereo:        cfg.Stereo,
+			FlipX:         cfg.FlipX,
+			FlipY:         cfg.FlipY,
+		},
+	}
+}
+
+// CameraMatrix returns the view-projection matrix of the perspective rays traced
+// for camera, with a horizontal field of view of fov radians and an image of
+// size. It is stored column by column, like OpenGL expects it. After the
+// division by w, x and y are -1 at the left and bottom edges of the image and
+// 1 at the right and top. The ray of pixel (x, y) passes through the point
+// that projects to the top-left corner of the pixel, at x = 2x/width-1 and
+// y = 1-2y/height. Depth is mapped from -1 at a near plane close to the eye to
+// 1 at infinity. Stereo and panoramas are not covered.
+func CameraMatrix(camera Camera, fov float32, size image.Point) [16]float32 {
+	eye := vec3.T(camera.Position())
+	forward, right, up := cameraBasis(camera)
+
+	halfWidth := math.Tan(float64(fov / 2))
+	halfHeight := halfWidth * float64(size.Y) / float64(size.X)
+
+	// The rows of the view matrix are the camera basis, with the camera looking
+	// along -z.
+	view := [3][4]float64{}
+	for i, axis := range [3]vec3.T{right, up, forward.Scaled(-1)} {
+		for j := range axis {
+			view[i][j] = float64(axis[j])
+		}
+		view[i][3] = -float64(vec3.Dot(&axis, &eye))
+	}
+
+	var m [16]float32
+	for col := 0; col < 4; col++ {
+		m[col*4+0] = float32(view[0][col] / halfWidth)
+		m[col*4+1] = float32(view[1][col] / halfHeight)
+		m[col*4+2] = float32(-view[2][col])
+		m[col*4+3] = float32(-view[2][col])
+	}
+	m[3*4+2] -= 2 * matrixNear
+	return m
+}
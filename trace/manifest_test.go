@@ -0,0 +1,117 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// project returns the pixel the point p is drawn at with the matrix m.
+func project(m *[16]float32, p Vec3, size image.Point) (image.Point, float32) {
+	var clip [4]float32
+	for row := range clip {
+		clip[row] = m[row] * p[0]
+		clip[row] += m[4+row] * p[1]
+		clip[row] += m[8+row] * p[2]
+		clip[row] += m[12+row]
+	}
+
+	x := (clip[0]/clip[3] + 1) / 2 * float32(size.X)
+	y := (1 - clip[1]/clip[3]) / 2 * float32(size.Y)
+	return image.Point{int(math.Floor(float64(x) + 0.5)), int(math.Floor(float64(y) + 0.5))}, clip[2] / clip[3]
+}
+
+func TestCameraMatrix(t *testing.T) {
+	const depth = 3
+	leaf := color.RGBA{255, 0, 0, 255}
+	center := Vec3{0.6875, 0.3125, 0.5625}
+
+	tree := NewMutableTree(nil, 1<<depth)
+	if err := tree.SetVoxel([3]float32(center), depth, leaf); err != nil {
+		panic(err)
+	}
+
+	cameras := []Camera{
+		&LookAtCamera{Pos: Vec3{1.6, 1.4, 1.8}, Look: Vec3{0.5, 0.5, 0.5}},
+		&LookAtCamera{Pos: Vec3{0.2, 0.9, -1.1}, Look: Vec3{0.6, 0.4, 0.5}},
+		&FreeFlightCamera{Pos: Vec3{0.7, 0.3, 1.5}, XRot: 0.1, YRot: -0.05},
+	}
+
+	for _, size := range []image.Point{{64, 48}, {40, 72}} {
+		for i, camera := range cameras {
+			cfg := Config{
+				FieldOfViewDegrees: 50,
+				TreeScale:          1,
+				ViewDist:           5,
+				FlipX:              i == 1,
+				FlipY:              i == 2,
+				Images:             [2]*image.RGBA{image.NewRGBA(image.Rectangle{Max: size}), image.NewRGBA(image.Rectangle{Max: size})},
+			}
+
+			rt := NewRaytracer(cfg)
+			img := rt.Image(rt.Trace(camera, tree.Octree(), depth+1))
+			rt.Close()
+
+			manifest := NewRenderManifest(&cfg, camera, size)
+			p, z := project(&manifest.Matrix, center, size)
+			if !p.In(img.Bounds()) || !(z > -1 && z < 1) {
+				t.Errorf("camera %d, size %v: leaf projected outside of the view at %v, %v", i, size, p, z)
+				continue
+			}
+
+			if c := img.RGBAAt(p.X, p.Y); c.R != leaf.R || c.G != leaf.G || c.B != leaf.B {
+				t.Errorf("camera %d, size %v: leaf projected to %v, which is %v", i, size, p, c)
+			}
+
+			// The leaf is drawn within the projection of its corners.
+			bounds := image.Rectangle{Min: p, Max: p}
+			for _, corner := range childPositions {
+				q, _ := project(&manifest.Matrix, Vec3{center[0] + (corner[0]-0.5)/(1<<depth), center[1] + (corner[1]-0.5)/(1<<depth), center[2] + (corner[2]-0.5)/(1<<depth)}, size)
+				bounds = bounds.Union(image.Rectangle{Min: q, Max: q.Add(image.Point{1, 1})})
+			}
+			bounds = bounds.Inset(-1)
+
+			for y := 0; y < size.Y; y++ {
+				for x := 0; x < size.X; x++ {
+					if c := img.RGBAAt(x, y); c.R == leaf.R && !(image.Point{x, y}).In(bounds) {
+						t.Errorf("camera %d, size %v: leaf drawn at %d,%d outside of %v", i, size, x, y, bounds)
+					}
+				}
+			}
+		}
+	}
+
+	cfg := Config{FieldOfView: 1, TreeScale: 2, ViewDist: 5, Samples: 4}
+	camera := &LookAtCamera{Pos: Vec3{1, 2, 3}, Look: Vec3{0, 0, 0}}
+	data, err := json.Marshal(NewRenderManifest(&cfg, camera, image.Point{32, 16}))
+	if err != nil {
+		panic(err)
+	}
+
+	var manifest RenderManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		panic(err)
+	}
+	if manifest.Camera.Position != camera.Pos || manifest.Width != 32 || manifest.Height != 16 || manifest.FieldOfView != 1 || manifest.Config.Samples != 4 || manifest.Config.TreeScale != 2 {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+var errMmapUnsupported = errors.New("memory mapping is not supported")
+
+// MappedTree is a tree that renders directly from a memory mapped file. Pages are
+// read on demand and kept by the page cache of the OS, so loading takes the same
+// time for any size of tree.
+//
+// Only trees in the MipR8G8B8A8PackUI28 format are mapped, their nodes are stored
+// the way the raytracer keeps them in memory. Convert other trees with
+// pack.TranscodeTree. Trees in other formats, and all trees on platforms without
+// mmap, are loaded into memory instead.
+type MappedTree struct {
+	lock   sync.RWMutex
+	closed bool
+	mapped bool
+	data   []byte
+	tree   Octree
+	info   *TreeInfo
+
+	// path, size and modTime identify the file of mapped trees, see HotSet.
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// LoadOctreeMapped maps the first tree in the file at path. The checksums of mapped
+// trees are not verified, see pack.ValidateTree.
+func LoadOctreeMapped(path string) (*MappedTree, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var header pack.OctreeHeader
+	if err := pack.DecodeHeader(bufio.NewReader(fp), &header); err != nil {
+		return nil, err
+	}
+
+	if err := checkNumNodes(&header); err != nil {
+		return nil, err
+	}
+
+	if !mappable(&header) {
+		return loadCopied(fp)
+	}
+
+	stat, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	offset := int64(header.Size())
+	size := offset + int64(header.NumNodes)*int64(header.Format.NodeSize())
+	if stat.Size() < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	data, err := mapFile(fp, int(size))
+	if err == errMmapUnsupported {
+		return loadCopied(fp)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var tree Octree
+	if header.NumNodes > 0 {
+		tree = unsafe.Slice((*octreeNode)(unsafe.Pointer(&data[offset])), header.NumNodes)
+	}
+	return &MappedTree{mapped: true, data: data, tree: tree, info: newTreeInfo(&header), path: path, size: stat.Size(), modTime: stat.ModTime()}, nil
+}
+
+// mappable reports if the nodes of the tree can be used as stored. Nodes must
+// start at a multiple of four bytes, which a geo reference can break.
+func mappable(header *pack.OctreeHeader) bool {
+	littleEndian := binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+	aligned := header.Size()%4 == 0
+	return littleEndian && aligned && header.Format == pack.MipR8G8B8A8PackUI28 && !header.Compressed()
+}
+
+func loadCopied(fp *os.File) (*MappedTree, error) {
+	tree, info, err := LoadOctreeParallel(fp, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &MappedTree{tree: tree, info: info}, nil
+}
+
+// Info returns the info of the tree.
+func (m *MappedTree) Info() *TreeInfo {
+	return m.info
+}
+
+// Mapped reports if the tree is memory mapped, it was loaded into memory otherwise.
+func (m *MappedTree) Mapped() bool {
+	return m.mapped
+}
+
+// Acquire returns the tree and keeps it mapped until Release is called. Close waits
+// for all acquired trees to be released. False is returned if the tree is closed.
+// The tree is read-only and must not be acquired twice by the same goroutine.
+func (m *MappedTree) Acquire() (Octree, bool) {
+	m.lock.RLock()
+	if m.closed {
+		m.lock.RUnlock()
+		return nil, false
+	}
+	return m.tree, true
+}
+
+// Release ends the use of a tree returned by Acquire.
+func (m *MappedTree) Release() {
+	m.lock.RUnlock()
+}
+
+// Close unmaps the tree once it is released by all users. New calls to Acquire
+// fail while Close waits.
+func (m *MappedTree) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	m.tree = nil
+
+	if m.data == nil {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	return unmapFile(data)
+}
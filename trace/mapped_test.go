@@ -0,0 +1,198 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+func saveTestTree(tree *MutableTree, format pack.OctreeFormat) string {
+	fp, err := ioutil.TempFile("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer fp.Close()
+
+	if err := tree.Save(fp, format); err != nil {
+		panic(err)
+	}
+	return fp.Name()
+}
+
+func renderMapped(tree Octree, depth int) *image.RGBA {
+	rect := image.Rect(0, 0, 32, 32)
+	cfg := Config{
+		FieldOfView: 0.8,
+		TreeScale:   1,
+		ViewDist:    10,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+
+	rt := NewRaytracer(cfg)
+	defer rt.Close()
+
+	camera := LookAtCamera{Pos: Vec3{0.3, 0.6, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	return rt.Image(rt.Trace(&camera, tree, depth))
+}
+
+func TestLoadOctreeMapped(t *testing.T) {
+	sphere := testSphere(5)
+	depth := TreeWidthToDepth(sphere.VoxelsPerAxis())
+	expected := renderMapped(sphere.Octree(), depth)
+
+	for _, format := range []pack.OctreeFormat{pack.MipR8G8B8A8PackUI28, pack.MipR8G8B8A8UnpackUI32} {
+		file := saveTestTree(sphere, format)
+		defer os.Remove(file)
+
+		mapped, err := LoadOctreeMapped(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if mapped.Mapped() != (format == pack.MipR8G8B8A8PackUI28) {
+			t.Errorf("format %v: unexpected mapping %v", format, mapped.Mapped())
+		}
+		if info := mapped.Info(); info.NumNodes != uint64(len(sphere.Octree())) || info.Depth != depth {
+			t.Errorf("format %v: unexpected info %+v", format, *info)
+		}
+
+		tree, ok := mapped.Acquire()
+		if !ok {
+			t.Fatal("expected open tree")
+		}
+		for i := range tree {
+			n, e := &tree[i], &sphere.Octree()[i]
+			if n.getColor() != e.getColor() || n.childMask() != e.childMask() || n.getChild(7) != e.getChild(7) {
+				t.Fatalf("format %v: node %v differs", format, i)
+			}
+		}
+		if img := renderMapped(tree, depth); !reflect.DeepEqual(img.Pix, expected.Pix) {
+			t.Errorf("format %v: image differs from the loaded tree", format)
+		}
+		mapped.Release()
+
+		if err := mapped.Close(); err != nil {
+			t.Error(err)
+		}
+		if _, ok := mapped.Acquire(); ok {
+			t.Error("expected closed tree")
+		}
+	}
+}
+
+func TestLoadOctreeMappedTruncated(t *testing.T) {
+	file := saveTestTree(testSphere(3), pack.MipR8G8B8A8PackUI28)
+	defer os.Remove(file)
+
+	stat, err := os.Stat(file)
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Truncate(file, stat.Size()-1); err != nil {
+		panic(err)
+	}
+
+	if _, err := LoadOctreeMapped(file); err == nil {
+		t.Error("expected error for truncated tree")
+	}
+}
+
+func TestMappedConcurrentTraversal(t *testing.T) {
+	sphere := testSphere(5)
+	depth := TreeWidthToDepth(sphere.VoxelsPerAxis())
+	expected := renderMapped(sphere.Octree(), depth)
+
+	file := saveTestTree(sphere, pack.MipR8G8B8A8PackUI28)
+	defer os.Remove(file)
+
+	mapped, err := LoadOctreeMapped(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mapped.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				tree, ok := mapped.Acquire()
+				if !ok {
+					t.Error("expected open tree")
+					return
+				}
+				img := renderMapped(tree, depth)
+				mapped.Release()
+
+				if !reflect.DeepEqual(img.Pix, expected.Pix) {
+					t.Error("image differs from the loaded tree")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMappedCloseWhileRendering(t *testing.T) {
+	file := saveTestTree(testSphere(5), pack.MipR8G8B8A8PackUI28)
+	defer os.Remove(file)
+
+	mapped, err := LoadOctreeMapped(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	depth := mapped.Info().Depth
+
+	tree, ok := mapped.Acquire()
+	if !ok {
+		t.Fatal("expected open tree")
+	}
+
+	closed := make(chan error)
+	go func() {
+		closed <- mapped.Close()
+	}()
+
+	// Close must wait for the render to release the tree.
+	for i := 0; i < 3; i++ {
+		renderMapped(tree, depth)
+		select {
+		case <-closed:
+			t.Fatal("tree closed while acquired")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	mapped.Release()
+
+	if err := <-closed; err != nil {
+		t.Error(err)
+	}
+	if _, ok := mapped.Acquire(); ok {
+		t.Error("expected closed tree")
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package trace
+
+import "github.com/andreas-jonsson/octatron/go3d/vec3"
+
+// marchNudge is the fraction of the size of an empty node a ray is moved forward
+// by when rounding keeps it from leaving the node.
+const marchNudge = 1e-5
+
+// Traversal selects how rays find the first node they hit.
+type Traversal int
+
+const (
+	// Recursive descends the tree along the ray and visits the children of every
+	// node front to back.
+	Recursive Traversal = iota
+
+	// Marching steps along the ray with point queries from the root, skipping an
+	// empty node in one step. It visits fewer nodes in large empty regions, like
+	// sparse outdoor scenes, and more in dense trees.
+	Marching
+)
+
+// marchTree finds the first node hit by ray like intersectTree, by marching
+// through the tree. The node containing the current point is looked up from the
+// root, if it is empty the ray moves to the point where it leaves that node.
+func (rt *Raytracer) marchTree(tree []octreeNode, ray *infiniteRay, treePos *vec3.T, treeScale, length, maxDepth float32, visits *uint64) (float32, uint32, uint32, bool) {
+	root := vec3.Box{Min: *treePos, Max: vec3.T{treePos[0] + treeScale, treePos[1] + treeScale, treePos[2] + treeScale}}
+	if intersectBox(ray, length, &root, rt.epsilon*treeScale) == length {
+		return length, 0, 0, false
+	}
+
+	origin, direction := &ray[0], &ray[1]
+	start, final := boxRange(ray, &root)
+	t := float32(start)
+
+	for t < float32(final) && t < length {
+		var (
+			index uint32
+			depth uint32
+			pos   = *treePos
+			scale = treeScale
+			point = vec3.T{origin[0] + direction[0]*t, origin[1] + direction[1]*t, origin[2] + direction[2]*t}
+		)
+
+		for {
+			*visits++
+			node := &tree[index]
+
+			box := vec3.Box{Min: pos, Max: vec3.T{pos[0] + scale, pos[1] + scale, pos[2] + scale}}
+			nodeStart, nodeFinal := boxRange(ray, &box)
+			boxDist := float32(nodeStart)
+			if nodeFinal < nodeStart {
+				boxDist = float32(nodeFinal)
+			}
+
+			d := boxDist / rt.cfg.ViewDist
+			if node.leaf() || depth > uint32(maxDepth*(1-d*d)) {
+				if boxDist < length {
+					return boxDist, index, depth, true
+				}
+				return length, 0, 0, false
+			}
+
+			// Points on the face between two children belong to the one the
+			// ray moves into.
+			scale *= 0.5
+			var i int
+			for axis := 0; axis < 3; axis++ {
+				mid := pos[axis] + scale
+				if point[axis] > mid || (point[axis] == mid && direction[axis] > 0) {
+					i |= 1 << uint(axis)
+					pos[axis] = mid
+				}
+			}
+
+			if node.getChild(i) == 0 {
+				empty := vec3.Box{Min: pos, Max: vec3.T{pos[0] + scale, pos[1] + scale, pos[2] + scale}}
+				_, exit := boxRange(ray, &empty)
+				if next := float32(exit); next > t {
+					t = next
+				} else {
+					t += scale * marchNudge
+				}
+				break
+			}
+
+			index = node.getChild(i)
+			depth++
+		}
+	}
+	return length, 0, 0, false
+}
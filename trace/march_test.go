@@ -0,0 +1,188 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package trace
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/bench"
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+// outdoorTree is a sparse scene, a ground layer with a few pillars.
+func outdoorTree(depth int) *MutableTree {
+	res := 1 << uint(depth)
+	tree := NewMutableTree(nil, res)
+	size := 1 / float32(res)
+
+	set := func(x, y, z int) {
+		pos := [3]float32{(float32(x) + 0.5) * size, (float32(y) + 0.5) * size, (float32(z) + 0.5) * size}
+		c := color.RGBA{uint8(x * 255 / res), uint8(y * 255 / res), uint8(z * 255 / res), 255}
+		if err := tree.SetVoxel(pos, depth, c); err != nil {
+			panic(err)
+		}
+	}
+
+	for z := 0; z < res; z++ {
+		for x := 0; x < res; x++ {
+			set(x, 0, z)
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		x, z, height := rnd.Intn(res), rnd.Intn(res), 1+rnd.Intn(res/2)
+		for y := 1; y < height; y++ {
+			set(x, y, z)
+		}
+	}
+	return tree
+}
+
+// interiorTree is a dense scene, a room with thick noisy walls.
+func interiorTree(depth int) *MutableTree {
+	res := 1 << uint(depth)
+	tree := NewMutableTree(nil, res)
+	size := 1 / float32(res)
+	rnd := rand.New(rand.NewSource(1))
+
+	for z := 0; z < res; z++ {
+		for y := 0; y < res; y++ {
+			for x := 0; x < res; x++ {
+				inside := func(v int) bool { return v >= res/4 && v < res*3/4 }
+				if (inside(x) && inside(y) && inside(z)) || rnd.Intn(4) == 0 {
+					continue
+				}
+
+				pos := [3]float32{(float32(x) + 0.5) * size, (float32(y) + 0.5) * size, (float32(z) + 0.5) * size}
+				c := color.RGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), 255}
+				if err := tree.SetVoxel(pos, depth, c); err != nil {
+					panic(err)
+				}
+			}
+		}
+	}
+	return tree
+}
+
+var (
+	outdoorCamera  = LookAtCamera{Pos: Vec3{0.1, 0.2, 0.93}, Look: Vec3{0.6, 0.1, 0.2}}
+	interiorCamera = LookAtCamera{Pos: Vec3{0.47, 0.52, 0.51}, Look: Vec3{0.1, 0.3, 0.2}}
+)
+
+func TestMarchingMatchesRecursive(t *testing.T) {
+	scenes := []struct {
+		name   string
+		tree   *MutableTree
+		camera Camera
+	}{
+		{"sphere", testSphere(5), &LookAtCamera{Pos: Vec3{0.3, 0.6, 2}, Look: Vec3{0.5, 0.5, 0.5}}},
+		{"outdoor", outdoorTree(5), &outdoorCamera},
+		{"interior", interiorTree(5), &interiorCamera},
+	}
+
+	for _, scene := range scenes {
+		for _, depth := range []bool{false, true} {
+			rect := image.Rect(0, 0, 64, 48)
+			cfg := Config{
+				FieldOfView: 1,
+				TreeScale:   1,
+				ViewDist:    5,
+				Depth:       depth,
+			}
+
+			cfg.Images = [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}
+			recursive, recursiveDepth := renderTestFrame(scene.tree, cfg, scene.camera)
+
+			cfg.Traversal = Marching
+			cfg.Images = [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}
+			marching, marchingDepth := renderTestFrame(scene.tree, cfg, scene.camera)
+
+			// Rays entering through the face between two voxels may be given
+			// either by rounding, at the same distance.
+			if n := countDiff(recursive, marching); n > rect.Dx()*rect.Dy()/100 {
+				t.Errorf("%s: %v pixels differ", scene.name, n)
+			}
+			if depth && !bytes.Equal(recursiveDepth.Pix, marchingDepth.Pix) {
+				t.Errorf("%s: depth output differs", scene.name)
+			}
+		}
+	}
+}
+
+// benchTree loads the reference tree of scene, the tree cmd/octbench benchmarks.
+func benchTree(scene *bench.Scene, depth int) (Octree, int) {
+	var buffer bytes.Buffer
+	if err := scene.Build(&buffer, depth, 1, pack.MipR8G8B8A8UnpackUI32); err != nil {
+		panic(err)
+	}
+
+	tree, info, err := LoadOctreeWithInfo(&buffer)
+	if err != nil {
+		panic(err)
+	}
+	return tree, info.Depth
+}
+
+func benchmarkTraversal(b *testing.B, scene *bench.Scene, depth int, traversal Traversal) {
+	tree, maxDepth := benchTree(scene, depth)
+	camera := LookAtCamera{Pos: scene.Position, Look: scene.LookAt}
+
+	rect := image.Rect(0, 0, 128, 128)
+	rt := NewRaytracer(Config{
+		FieldOfView: 1,
+		TreeScale:   1,
+		ViewDist:    5,
+		Traversal:   traversal,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	defer rt.Close()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		rt.Image(rt.Trace(&camera, tree, maxDepth))
+	}
+}
+
+func BenchmarkOutdoorRecursive(b *testing.B) {
+	benchmarkTraversal(b, bench.Outdoor, 7, Recursive)
+}
+
+func BenchmarkOutdoorMarching(b *testing.B) {
+	benchmarkTraversal(b, bench.Outdoor, 7, Marching)
+}
+
+func BenchmarkInteriorRecursive(b *testing.B) {
+	benchmarkTraversal(b, bench.Interior, 6, Recursive)
+}
+
+func BenchmarkInteriorMarching(b *testing.B) {
+	benchmarkTraversal(b, bench.Interior, 6, Marching)
+}
+
+func BenchmarkNoiseRecursive(b *testing.B) {
+	benchmarkTraversal(b, bench.Noise, 6, Recursive)
+}
+
+func BenchmarkNoiseMarching(b *testing.B) {
+	benchmarkTraversal(b, bench.Noise, 6, Marching)
+}
@@ -0,0 +1,129 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/andreas-jonsson/octatron/go3d/vec3"
+)
+
+// Faces of a node box, the normal of face f points along axis f/2, towards
+// positive values for odd faces. noFace is used for rays that start inside the
+// node.
+const noFace = -1
+
+var faceNormals = [6]Vec3{
+	{-1, 0, 0}, {1, 0, 0},
+	{0, -1, 0}, {0, 1, 0},
+	{0, 0, -1}, {0, 0, 1},
+}
+
+// normalPalette holds the colors written to Config.NormalImage, the face normals
+// mapped from [-1, 1] to [0, 255], followed by the color of faceless hits and of
+// misses. The colors are boxed once so writing them does not allocate.
+var normalPalette = [...]color.Color{
+	color.RGBA{0, 128, 128, 255}, color.RGBA{255, 128, 128, 255},
+	color.RGBA{128, 0, 128, 255}, color.RGBA{128, 255, 128, 255},
+	color.RGBA{128, 128, 0, 255}, color.RGBA{128, 128, 255, 255},
+	color.RGBA{128, 128, 128, 255},
+	color.RGBA{},
+}
+
+// entryFace returns the face of box where ray enters it. It is the face of the slab
+// that is entered last, the axis of the largest entry distance. noFace is returned
+// if the ray starts inside the box.
+func entryFace(ray *infiniteRay, box *vec3.Box) int {
+	face, start := noFace, float32(0)
+	for axis := 0; axis < 3; axis++ {
+		d := ray[1][axis]
+		if d == 0 {
+			continue
+		}
+
+		t, f := (box.Max[axis]-ray[0][axis])/d, axis*2+1
+		if d > 0 {
+			t, f = (box.Min[axis]-ray[0][axis])/d, axis*2
+		}
+		if t > start {
+			face, start = f, t
+		}
+	}
+	return face
+}
+
+// hitFace returns the face of the node at depth that ray hits at dist. The node is
+// found from the hit position, moved a little into the node along the ray.
+func hitFace(ray *infiniteRay, dist float32, depth uint32, nodePos *vec3.T, nodeScale float32) int {
+	size := float32(math.Ldexp(float64(nodeScale), -int(depth)))
+	inside := ray[1].Scaled(dist + size*0.01)
+	inside = vec3.Add(&ray[0], &inside)
+
+	var box vec3.Box
+	for axis := range box.Min {
+		box.Min[axis] = nodePos[axis] + float32(math.Floor(float64((inside[axis]-nodePos[axis])/size)))*size
+		box.Max[axis] = box.Min[axis] + size
+	}
+	return entryFace(ray, &box)
+}
+
+// faceNormal returns the normal of face, or the zero vector for noFace.
+func faceNormal(face int) Vec3 {
+	if face == noFace {
+		return Vec3{}
+	}
+	return faceNormals[face]
+}
+
+// hitInfo returns what the ray returned by traceRay hits at dist, the node at
+// index of instance. The ground plane is hit if ground is true.
+func (rt *Raytracer) hitInfo(ray *infiniteRay, dist, near float32, index, depth uint32, instance uint16, base color.RGBA, hit, ground bool) HitInfo {
+	info := HitInfo{Hit: hit, Distance: dist, Base: base, Node: PickMiss, Instance: InstanceMiss}
+	if !hit {
+		return info
+	}
+
+	pos := ray[1].Scaled(dist - near)
+	info.Position = Vec3(vec3.Add(&ray[0], &pos))
+	if ground {
+		info.Normal = Vec3{0, 1, 0}
+		return info
+	}
+
+	info.Node, info.Instance = index, instance
+	nodePos, nodeScale := rt.cfg.placement(instance)
+	info.Normal = faceNormal(hitFace(ray, dist-near, depth, &nodePos, nodeScale))
+	return info
+}
+
+// writeNormal stores the normal of info at dx, dy of the frame buffers.
+func (rt *Raytracer) writeNormal(img draw.Image, dx, dy int, info *HitInfo) {
+	entry := len(normalPalette) - 1
+	if info.Hit {
+		entry--
+		for face, n := range faceNormals {
+			if n == info.Normal {
+				entry = face
+				break
+			}
+		}
+	}
+	img.Set(dx+rt.origin.X, dy+rt.origin.Y, normalPalette[entry])
+}
@@ -0,0 +1,97 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func unitLeaf() *MutableTree {
+	tree := NewMutableTree(nil, 1)
+	if err := tree.SetVoxel([3]float32{0.5, 0.5, 0.5}, 0, color.RGBA{200, 100, 50, 255}); err != nil {
+		panic(err)
+	}
+	return tree
+}
+
+func TestCastRayNormals(t *testing.T) {
+	tree := unitLeaf()
+	rt := newTestRaytracer(Vec3{}, 1)
+	defer rt.Close()
+
+	for _, normal := range faceNormals {
+		var origin Vec3
+		for i := range origin {
+			origin[i] = 0.5 + 2*normal[i]
+		}
+		dir := Vec3{-normal[0], -normal[1], -normal[2]}
+
+		hit, ok := rt.CastRay(tree.Octree(), 0, origin, dir, 10)
+		if !ok {
+			t.Fatalf("ray from %v missed", origin)
+		}
+		if hit.Normal != normal {
+			t.Errorf("ray from %v hit a face with normal %v, expected %v", origin, hit.Normal, normal)
+		}
+	}
+
+	// Rays starting inside the leaf do not enter a face.
+	hit, ok := rt.CastRay(tree.Octree(), 0, Vec3{0.5, 0.5, 0.5}, Vec3{1, 0, 0}, 10)
+	if !ok || hit.Normal != (Vec3{}) {
+		t.Errorf("unexpected hit from inside the leaf: %+v", hit)
+	}
+}
+
+func TestNormalImage(t *testing.T) {
+	rect := image.Rect(0, 0, 16, 16)
+	normals := image.NewRGBA(rect)
+	var seen []Vec3
+
+	rt := NewRaytracer(Config{
+		FieldOfView: 0.8,
+		TreeScale:   1,
+		ViewDist:    10,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		NormalImage: normals,
+		SurfaceShader: func(p image.Point, info HitInfo) [3]float32 {
+			if p == (image.Point{8, 8}) {
+				seen = append(seen, info.Normal)
+			}
+			return [3]float32{info.Normal[0], info.Normal[1], info.Normal[2]}
+		},
+	})
+	defer rt.Close()
+
+	camera := LookAtCamera{Pos: Vec3{0.5, 0.5, 3}, Look: Vec3{0.5, 0.5, 0.5}}
+	img := rt.Image(rt.Trace(&camera, unitLeaf().Octree(), 0))
+
+	if c := normals.RGBAAt(8, 8); c != (color.RGBA{128, 128, 255, 255}) {
+		t.Errorf("expected the +z normal at the center, got %v", c)
+	}
+	if c := normals.RGBAAt(0, 0); c != (color.RGBA{}) {
+		t.Errorf("expected a transparent miss in the corner, got %v", c)
+	}
+	if c := img.RGBAAt(8, 8); c.R != 0 || c.G != 0 || c.B != 255 {
+		t.Errorf("surface shader was not used: %v", c)
+	}
+	if len(seen) != 1 || seen[0] != (Vec3{0, 0, 1}) {
+		t.Errorf("shader saw normals %v at the center", seen)
+	}
+}
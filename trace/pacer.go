@@ -0,0 +1,78 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package trace
+
+import "time"
+
+// FramePacer limits a render loop to a frame rate and measures the rate it
+// achieves. Frames are due on a fixed schedule of the monotonic clock, so a frame
+// that took longer than its share is made up by the following frames and the rate
+// does not drift. A loop that falls more than a frame behind starts over from the
+// current time rather than rendering a burst of frames to catch up.
+type FramePacer struct {
+	interval time.Duration
+	next     time.Time
+
+	frames int
+	since  time.Time
+	rate   float64
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewFramePacer returns a pacer for fps frames per second. Frames are not limited
+// if fps is zero or less, but the rate is still measured.
+func NewFramePacer(fps float64) *FramePacer {
+	p := &FramePacer{now: time.Now, sleep: time.Sleep}
+	if fps > 0 {
+		p.interval = time.Duration(float64(time.Second) / fps)
+	}
+	return p
+}
+
+// Wait is called before every frame and sleeps until the frame is due.
+func (p *FramePacer) Wait() {
+	now := p.now()
+	if p.interval > 0 {
+		if p.next.IsZero() || now.Sub(p.next) > p.interval {
+			p.next = now
+		} else if d := p.next.Sub(now); d > 0 {
+			p.sleep(d)
+			now = p.now()
+		}
+		p.next = p.next.Add(p.interval)
+	}
+
+	if p.since.IsZero() {
+		p.since = now
+		return
+	}
+
+	p.frames++
+	if elapsed := now.Sub(p.since); elapsed >= time.Second {
+		p.rate = float64(p.frames) / elapsed.Seconds()
+		p.frames = 0
+		p.since = now
+	}
+}
+
+// Rate returns the frames per second achieved, measured about once a second. It
+// is zero until the first second has passed.
+func (p *FramePacer) Rate() float64 {
+	return p.rate
+}
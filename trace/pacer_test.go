@@ -0,0 +1,112 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package trace
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// fakeClock is advanced by the simulated renderer and by sleeps.
+type fakeClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) sleep(d time.Duration) {
+	c.now = c.now.Add(d)
+	c.slept += d
+}
+
+func newTestPacer(fps float64, clock *fakeClock) *FramePacer {
+	p := NewFramePacer(fps)
+	p.now = func() time.Time { return clock.now }
+	p.sleep = clock.sleep
+	return p
+}
+
+// runPacer renders frames with the render times of frameTimes in turn and returns
+// the frames per second.
+func runPacer(p *FramePacer, clock *fakeClock, frames int, frameTimes ...time.Duration) float64 {
+	start := clock.now
+	for i := 0; i < frames; i++ {
+		p.Wait()
+		clock.now = clock.now.Add(frameTimes[i%len(frameTimes)])
+	}
+	p.Wait()
+	return float64(frames) / clock.now.Sub(start).Seconds()
+}
+
+func TestFramePacer(t *testing.T) {
+	const fps = 60
+
+	cases := []struct {
+		name       string
+		frameTimes []time.Duration
+		expected   float64
+	}{
+		{"fast", []time.Duration{2 * time.Millisecond}, fps},
+
+		// Slow frames within a frame of the schedule are made up by fast ones.
+		{"uneven", []time.Duration{time.Millisecond, 30 * time.Millisecond}, fps},
+
+		// Renderers that can't keep up are not held back further.
+		{"slow", []time.Duration{40 * time.Millisecond}, 25},
+	}
+
+	for _, c := range cases {
+		clock := &fakeClock{now: time.Unix(1000, 0)}
+		p := newTestPacer(fps, clock)
+
+		rate := runPacer(p, clock, 600, c.frameTimes...)
+		if math.Abs(rate-c.expected) > c.expected*0.01 {
+			t.Errorf("%s: expected %v frames per second, got %v", c.name, c.expected, rate)
+		}
+		if math.Abs(p.Rate()-c.expected) > c.expected*0.05 {
+			t.Errorf("%s: expected a measured rate of %v, got %v", c.name, c.expected, p.Rate())
+		}
+	}
+}
+
+func TestFramePacerCatchUp(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	p := newTestPacer(60, clock)
+	runPacer(p, clock, 10, 2*time.Millisecond)
+
+	// After a long stall the frames are paced from the current time rather than
+	// rendered back to back.
+	clock.now = clock.now.Add(time.Second)
+	clock.slept = 0
+	runPacer(p, clock, 10, 2*time.Millisecond)
+
+	if expected := 10 * (time.Second/60 - 2*time.Millisecond); clock.slept < expected-time.Millisecond {
+		t.Errorf("expected at least %v of sleep after the stall, got %v", expected, clock.slept)
+	}
+}
+
+func TestFramePacerUnlimited(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	p := newTestPacer(0, clock)
+
+	if rate := runPacer(p, clock, 1000, 2*time.Millisecond); clock.slept != 0 || math.Abs(rate-500) > 1 {
+		t.Errorf("expected 500 frames per second without sleeping, got %v and %v of sleep", rate, clock.slept)
+	}
+	if math.Abs(p.Rate()-500) > 5 {
+		t.Error("expected a measured rate of 500, got", p.Rate())
+	}
+}
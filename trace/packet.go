@@ -0,0 +1,231 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/andreas-jonsson/octatron/go3d/vec3"
+)
+
+const packetSize = 4
+
+type (
+	rayPacket [packetSize]infiniteRay
+
+	// packetResult holds the state of every ray in a packet. Length is the
+	// current max distance of the ray and is updated together with index
+	// and depth when a closer node is hit.
+	packetResult struct {
+		length       [packetSize]float32
+		index, depth [packetSize]uint32
+		hit          [packetSize]bool
+
+		// visits counts node fetches, a node shared by several rays is one.
+		visits uint64
+	}
+
+	scanSetup struct {
+		xInc, yInc, bottomLeft, eye vec3.T
+	}
+)
+
+func (s *scanSetup) ray(w, h int) infiniteRay {
+	return s.rayAt(float32(w), float32(h))
+}
+
+// rayAt returns the ray through a point between scan columns and lines.
+func (s *scanSetup) rayAt(w, h float32) infiniteRay {
+	x := s.xInc.Scaled(w)
+	y := s.yInc.Scaled(h)
+
+	x = vec3.Add(&x, &y)
+	viewPlanePoint := vec3.Add(&s.bottomLeft, &x)
+
+	dir := vec3.Sub(&viewPlanePoint, &s.eye)
+	dir.Normalize()
+
+	return infiniteRay{s.eye, dir}
+}
+
+func (res *packetResult) set(r int, length float32, index, depth uint32) {
+	res.length[r] = length
+	res.index[r] = index
+	res.depth[r] = depth
+	res.hit[r] = true
+}
+
+// intersectBox4 intersects all rays in mask with box. This is where a vectorized
+// implementation should go.
+func intersectBox4(rays *rayPacket, lengths *[packetSize]float32, mask uint8, box *vec3.Box, eps float32, out *[packetSize]float32) {
+	for r := 0; r < packetSize; r++ {
+		if mask&(1<<uint(r)) != 0 {
+			out[r] = intersectBox(&rays[r], lengths[r], box, eps)
+		}
+	}
+}
+
+// intersectPacket is the packet version of intersectTree. It produces the exact same
+// result for each ray but shares node fetches and box setup. When only a single ray
+// remains active the traversal falls back to intersectTree.
+func (rt *Raytracer) intersectPacket(tree []octreeNode, masks []uint8, rays *rayPacket, nodePos *vec3.T, nodeScale, maxDepth float32, nodeIndex, treeDepth uint32, mask uint8, res *packetResult) {
+	res.visits++
+
+	var (
+		node     = &tree[nodeIndex]
+		leaf     = node.leaf()
+		boxDists [packetSize]float32
+
+		// Declare this here to avoid runtime allocation.
+		pos vec3.T
+	)
+
+	box := vec3.Box{Min: *nodePos, Max: vec3.T{nodePos[0] + nodeScale, nodePos[1] + nodeScale, nodePos[2] + nodeScale}}
+	intersectBox4(rays, &res.length, mask, &box, rt.epsilon*nodeScale, &boxDists)
+
+	for r := 0; r < packetSize; r++ {
+		bit := uint8(1 << uint(r))
+		if mask&bit == 0 {
+			continue
+		}
+
+		boxDist := boxDists[r]
+		if boxDist == res.length[r] {
+			mask &^= bit
+			continue
+		}
+
+		d := (boxDist / rt.cfg.ViewDist)
+		if leaf || treeDepth > uint32(maxDepth*(1-d*d)) {
+			res.set(r, boxDist, nodeIndex, treeDepth)
+			mask &^= bit
+		}
+	}
+
+	if mask == 0 {
+		return
+	}
+
+	childScale := nodeScale * 0.5
+	childDepth := treeDepth + 1
+
+	for i := range node {
+		childIndex := node.getChild(i)
+		if childIndex == 0 {
+			continue
+		}
+
+		scaled := childPositions[i].Scaled(childScale)
+		pos = vec3.Add(nodePos, &scaled)
+
+		if mask&(mask-1) == 0 {
+			r := 0
+			for mask&(1<<uint(r)) == 0 {
+				r++
+			}
+
+			if ln, idx, depth, ok := rt.intersectTree(tree, masks, &rays[r], &pos, childScale, res.length[r], maxDepth, childIndex, childDepth, &res.visits); ok {
+				res.set(r, ln, idx, depth)
+			}
+		} else {
+			rt.intersectPacket(tree, masks, rays, &pos, childScale, maxDepth, childIndex, childDepth, mask, res)
+		}
+	}
+}
+
+// tracePackets traces the scan-lines of job in groups of 2x2 pixels.
+func (rt *Raytracer) tracePackets(job *rtJob, scan *scanSetup, size image.Point, jitter, step int, visits *uint64) {
+	var (
+		cfg       = &rt.cfg
+		idx       = job.idx
+		img       = cfg.Images[idx]
+		depth     = rt.depth[idx]
+		nodeScale = cfg.TreeScale
+		nodePos   = vec3.T(cfg.TreePosition)
+		viewDist  = cfg.ViewDist
+
+		packet rayPacket
+		pixels [packetSize]image.Point
+	)
+
+	for h := job.from; h < job.to; h += 2 {
+		if rt.isAborted(idx) {
+			return
+		}
+
+		rows := [2]int{h, h + 1}
+		starts := [2]int{jitterPhase(scanRow(h, size.Y), idx) * jitter, jitterPhase(scanRow(h+1, size.Y), idx) * jitter}
+
+		for k := job.rect.Min.X; ; k += 2 {
+			var (
+				res  packetResult
+				mask uint8
+				more bool
+			)
+
+			for r := 0; r < packetSize; r++ {
+				row := rows[r/2]
+				w := starts[r/2] + (k+r%2)*step
+
+				if row >= job.to || w >= size.X || w/step >= job.rect.Max.X {
+					continue
+				}
+				more = true
+
+				p := scanPixel(w, row, step, size.Y)
+				if !p.In(job.rect) {
+					continue
+				}
+
+				mask |= 1 << uint(r)
+				packet[r] = scan.ray(w, row)
+				pixels[r] = p
+
+				if cfg.Depth {
+					res.length[r] = (float32(depth.Gray16At(pixels[r].X, pixels[r].Y).Y) / math.MaxUint16) * viewDist
+				} else {
+					res.length[r] = viewDist
+				}
+			}
+
+			if !more {
+				break
+			} else if mask == 0 {
+				continue
+			}
+
+			rt.intersectPacket(job.tree, job.masks, &packet, &nodePos, nodeScale, job.maxDepth, 0, 0, mask, &res)
+			*visits += res.visits
+
+			for r := 0; r < packetSize; r++ {
+				if mask&(1<<uint(r)) == 0 {
+					continue
+				}
+
+				p := pixels[r]
+				if cfg.Depth {
+					d := color.Gray16{uint16(math.MaxUint16 * (res.length[r] / viewDist))}
+					depth.SetGray16(p.X, p.Y, d)
+				}
+				img.SetRGBA(p.X, p.Y, rt.shade(p, job.tree, res.index[r], res.length[r], res.hit[r]))
+			}
+		}
+	}
+}
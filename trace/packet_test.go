@@ -0,0 +1,130 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func testSphere(depth int) *MutableTree {
+	res := 1 << uint(depth)
+	tree := NewMutableTree(nil, res)
+	size := 1 / float32(res)
+
+	for z := 0; z < res; z++ {
+		for y := 0; y < res; y++ {
+			for x := 0; x < res; x++ {
+				pos := [3]float32{(float32(x) + 0.5) * size, (float32(y) + 0.5) * size, (float32(z) + 0.5) * size}
+				dx, dy, dz := pos[0]-0.5, pos[1]-0.5, pos[2]-0.5
+				if dx*dx+dy*dy+dz*dz > 0.25 {
+					continue
+				}
+
+				c := color.RGBA{uint8(x * 255 / res), uint8(y * 255 / res), uint8(z * 255 / res), 255}
+				if err := tree.SetVoxel(pos, depth, c); err != nil {
+					panic(err)
+				}
+			}
+		}
+	}
+	return tree
+}
+
+func renderTestFrame(tree *MutableTree, cfg Config, camera Camera) (*image.RGBA, *image.Gray16) {
+	rt := NewRaytracer(cfg)
+	defer rt.Close()
+
+	if cfg.Depth {
+		rt.ClearDepth(rt.Frame())
+	}
+
+	idx := rt.Trace(camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis()))
+	if cfg.Depth {
+		return rt.Image(idx), rt.Depth(idx)
+	}
+	return rt.Image(idx), nil
+}
+
+func TestPacketsMatchScalar(t *testing.T) {
+	tree := testSphere(4)
+	camera := LookAtCamera{Pos: Vec3{0.3, 0.6, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+
+	for _, jitter := range []bool{false, true} {
+		for _, depth := range []bool{false, true} {
+			for _, height := range []int{32, 33} {
+				rect := image.Rect(0, 0, 31, height)
+				cfg := Config{
+					FieldOfView:   0.8,
+					TreeScale:     1,
+					ViewDist:      5,
+					Jitter:        jitter,
+					Depth:         depth,
+					MultiThreaded: true,
+				}
+
+				cfg.Images = [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}
+				scalar, scalarDepth := renderTestFrame(tree, cfg, &camera)
+
+				cfg.Packets = true
+				cfg.Images = [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}
+				packet, packetDepth := renderTestFrame(tree, cfg, &camera)
+
+				if !bytes.Equal(scalar.Pix, packet.Pix) {
+					t.Errorf("color output differs, jitter: %v, depth: %v, height: %v", jitter, depth, height)
+				}
+
+				if depth && !bytes.Equal(scalarDepth.Pix, packetDepth.Pix) {
+					t.Errorf("depth output differs, jitter: %v, height: %v", jitter, height)
+				}
+			}
+		}
+	}
+}
+
+func benchmarkTrace(b *testing.B, packets bool) {
+	tree := testSphere(6)
+	camera := LookAtCamera{Pos: Vec3{0.3, 0.6, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	rect := image.Rect(0, 0, 128, 128)
+
+	rt := NewRaytracer(Config{
+		FieldOfView: 0.8,
+		TreeScale:   1,
+		ViewDist:    5,
+		Packets:     packets,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	defer rt.Close()
+
+	maxDepth := TreeWidthToDepth(tree.VoxelsPerAxis())
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		rt.Image(rt.Trace(&camera, tree.Octree(), maxDepth))
+	}
+}
+
+func BenchmarkTraceScalar(b *testing.B) {
+	benchmarkTrace(b, false)
+}
+
+func BenchmarkTracePackets(b *testing.B) {
+	benchmarkTrace(b, true)
+}
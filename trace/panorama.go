@@ -0,0 +1,120 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"math"
+
+	"github.com/andreas-jonsson/octatron/go3d/vec3"
+)
+
+// Projection selects how pixels are mapped to rays.
+type Projection int
+
+const (
+	// Perspective projects the image on a view plane in front of the camera.
+	Perspective Projection = iota
+
+	// Panorama renders the full sphere around the camera as an equirectangular
+	// image, longitude along x and latitude along y. The image should be twice
+	// as wide as it is high and FieldOfView is ignored.
+	Panorama
+)
+
+// panoramaScan maps scan columns and rows to directions around the eye. The poles
+// are aligned with the up vector of the camera so the horizon stays level.
+type panoramaScan struct {
+	forward, right, up, eye vec3d
+	width, height, offsetX  float64
+	sizeY                   int
+}
+
+func panoramaScanSetup(camera Camera, size image.Point, offsetX int) panoramaScan {
+	viewDirection, _, v := cameraBasis(camera)
+
+	up := vec3.T(camera.Up())
+	if up.LengthSqr() < 1e-12 {
+		up = v
+	}
+	up.Normalize()
+
+	// Forward is the view direction projected on the horizon. If the camera looks
+	// straight at a pole the up vector of the view plane is used instead.
+	d := vec3.Dot(&viewDirection, &up)
+	scaledUp := up.Scaled(d)
+	forward := vec3.Sub(&viewDirection, &scaledUp)
+	if forward.LengthSqr() < 1e-12 {
+		forward = v
+	}
+	forward.Normalize()
+	right := vec3.Cross(&forward, &up)
+
+	return panoramaScan{
+		forward: toVec3d(forward),
+		right:   toVec3d(right),
+		up:      toVec3d(up),
+		eye:     toVec3d(camera.Position()),
+		width:   float64(size.X),
+		height:  float64(size.Y),
+		offsetX: float64(offsetX),
+		sizeY:   size.Y,
+	}
+}
+
+// flip mirrors the longitudes for flipX and the latitudes for flipY.
+func (s *panoramaScan) flip(flipX, flipY bool) {
+	for i := range s.right {
+		if flipX {
+			s.right[i] = -s.right[i]
+		}
+		if flipY {
+			s.up[i] = -s.up[i]
+		}
+	}
+}
+
+// direction returns the unit direction of scan column w and scan-line h. Rays go
+// through pixel centers so the latitude never reaches the poles, where every
+// longitude would give the same direction.
+func (s *panoramaScan) direction(w, h int) vec3d {
+	lon := ((float64(w)-s.offsetX+0.5)/s.width - 0.5) * 2 * math.Pi
+	lat := (0.5 - (float64(scanRow(h, s.sizeY))+0.5)/s.height) * math.Pi
+
+	sinLon, cosLon := math.Sincos(lon)
+	sinLat, cosLat := math.Sincos(lat)
+
+	var dir vec3d
+	for i := range dir {
+		dir[i] = cosLat*(cosLon*s.forward[i]+sinLon*s.right[i]) + sinLat*s.up[i]
+	}
+	return dir
+}
+
+func (s *panoramaScan) ray(w, h int) infiniteRay {
+	dir := s.direction(w, h)
+	eye := s.eye
+	return infiniteRay{
+		vec3.T{float32(eye[0]), float32(eye[1]), float32(eye[2])},
+		vec3.T{float32(dir[0]), float32(dir[1]), float32(dir[2])},
+	}
+}
+
+func (s *panoramaScan) preciseRay(w, h int) preciseRay {
+	return preciseRay{s.eye, s.direction(w, h)}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"flag"
+	"image"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden images in testdata")
+
+func renderPanorama(highPrecision bool) *image.RGBA {
+	rect := image.Rect(0, 0, 128, 64)
+	tree := testSphere(5)
+
+	rt := NewRaytracer(Config{
+		Projection:    Panorama,
+		TreeScale:     1,
+		ViewDist:      5,
+		HighPrecision: highPrecision,
+		Images:        [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	defer rt.Close()
+
+	camera := LookAtCamera{Pos: Vec3{0.5, 0.6, 1.5}, Look: Vec3{0.5, 0.5, 0.5}}
+	img := rt.Image(rt.Trace(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis())))
+
+	// Node colors are not premultiplied, make the image opaque so it survives PNG encoding.
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+	return img
+}
+
+func TestPanoramaGolden(t *testing.T) {
+	file := filepath.Join("testdata", "panorama.png")
+	img := renderPanorama(false)
+
+	golden := loadGolden(file, img)
+	if *updateGolden {
+		return
+	}
+
+	if golden.Bounds() != img.Bounds() {
+		t.Fatal("unexpected golden image size:", golden.Bounds())
+	}
+
+	// Allow a few edge pixels to differ with the floating point rounding of the platform.
+	numPixels := len(img.Pix) / 4
+	if n := countDiff(golden, img); n > numPixels/100 {
+		t.Errorf("%d pixels differ from %s", n, file)
+	}
+
+	if n := countDiff(img, renderPanorama(true)); n > numPixels/100 {
+		t.Errorf("%d pixels differ in high precision mode", n)
+	}
+}
+
+func TestPanoramaDirections(t *testing.T) {
+	size := image.Point{64, 32}
+	cameras := []Camera{
+		&LookAtCamera{Pos: Vec3{0, 0, 0}, Look: Vec3{0, 0, -1}},
+		&LookAtCamera{Pos: Vec3{0, 0, 0}, Look: Vec3{0, 1, 0}},
+		&LookAtCamera{Pos: Vec3{0, 0, 0}, Look: Vec3{0, -1, 0}},
+	}
+
+	for i, camera := range cameras {
+		scan := panoramaScanSetup(camera, size, 0)
+		for h := 0; h < size.Y; h++ {
+			for w := 0; w < size.X; w++ {
+				dir := scan.direction(w, h)
+				l := math.Sqrt(dir[0]*dir[0] + dir[1]*dir[1] + dir[2]*dir[2])
+				if math.IsNaN(l) || math.Abs(l-1) > 1e-6 {
+					t.Fatalf("camera %d: invalid direction %v at %d,%d", i, dir, w, h)
+				}
+
+				// Latitude is always up in the image.
+				if y := scanRow(h, size.Y); y < size.Y/2 && dir[1] <= 0 || y >= size.Y/2 && dir[1] >= 0 {
+					t.Fatalf("camera %d: direction %v at row %d is on the wrong hemisphere", i, dir, y)
+				}
+			}
+		}
+	}
+
+	// The center of the image is in front of the camera.
+	scan := panoramaScanSetup(cameras[0], image.Point{65, 33}, 0)
+	if dir := scan.direction(32, scanRow(16, 33)); math.Abs(dir[2]+1) > 1e-6 {
+		t.Error("expected the image center to look forward, got:", dir)
+	}
+}
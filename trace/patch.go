@@ -0,0 +1,345 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import "image/color"
+
+type (
+	// TreePatch replaces the child of a node with a subtree or removes it. Patches
+	// are made by the edits of a MutableTree and applied to other copies of the tree
+	// with ApplyPatch. The copies may lay out their nodes differently, so the parent
+	// is found by its position instead of its node index.
+	TreePatch struct {
+		// Depth is the depth of the parent and Cell its position in nodes of that
+		// depth. Patches with a negative depth replace the whole tree.
+		Depth int
+		Cell  [3]uint32
+		Slot  int
+
+		// Colors are the colors of the nodes from the root down to the parent.
+		Colors []color.RGBA
+
+		// Nodes is the subtree with its root first. Children are indices into
+		// Nodes, zero for no child, and come after their parents. A patch without
+		// nodes removes the child.
+		Nodes []PatchNode
+	}
+
+	// PatchNode is a node of a TreePatch. The alpha of the color is the
+	// classification code, see NodeAttributes.Class.
+	PatchNode struct {
+		Color    color.RGBA
+		Children [8]uint32
+	}
+)
+
+func (n *octreeNode) rawColor() color.RGBA {
+	c := n.getColor()
+	c.A = n.getClass()
+	return c
+}
+
+func (n *octreeNode) setRawColor(c color.RGBA) {
+	colors := [4]uint8{c.R, c.G, c.B, c.A}
+	for i := range n {
+		var colorNib uint32
+		if i%2 == 0 {
+			colorNib = uint32(colors[i/2]&0xF0) << 24
+		} else {
+			colorNib = uint32(colors[i/2]&0xF) << 28
+		}
+		n[i] = colorNib | n.getChild(i)
+	}
+}
+
+// SetVoxelPatch works like SetVoxel and returns the patch that brings copies of the
+// tree from before the edit up to date.
+func (t *MutableTree) SetVoxelPatch(pos [3]float32, depth int, c color.RGBA) (TreePatch, error) {
+	return t.editPatch(pos, depth, func() error {
+		return t.SetVoxel(pos, depth, c)
+	})
+}
+
+// ClearVoxelPatch works like ClearVoxel and returns the patch that brings copies of
+// the tree from before the edit up to date.
+func (t *MutableTree) ClearVoxelPatch(pos [3]float32, depth int) (TreePatch, error) {
+	return t.editPatch(pos, depth, func() error {
+		return t.ClearVoxel(pos, depth)
+	})
+}
+
+// voxelOctants returns the octants of the nodes on the way down to the voxel
+// containing pos at depth.
+func voxelOctants(pos [3]float32, depth int) []int {
+	if depth < 0 {
+		depth = 0
+	}
+
+	slots := make([]int, depth)
+	scale := float32(0.5)
+	for d := range slots {
+		slots[d], pos = octant(&pos, scale)
+		scale *= 0.5
+	}
+	return slots
+}
+
+// path returns the nodes from the root down through slots, ending at the first
+// missing child.
+func (t *MutableTree) path(slots []int) []uint32 {
+	if len(t.tree) == 0 {
+		return nil
+	}
+
+	path := []uint32{0}
+	for _, slot := range slots {
+		child := t.tree[path[len(path)-1]].getChild(slot)
+		if child == 0 {
+			break
+		}
+		path = append(path, child)
+	}
+	return path
+}
+
+// changedChildren returns a mask with bit i set if child i of a and b differ.
+func changedChildren(a, b *octreeNode) uint8 {
+	var mask uint8
+	for i := range a {
+		if a.getChild(i) != b.getChild(i) {
+			mask |= 1 << uint(i)
+		}
+	}
+	return mask
+}
+
+// editPatch runs edit, which changes the voxel containing pos at depth, and makes
+// the patch of it. Only the nodes on the way down to the voxel are compared, edits
+// don't change other nodes. The patch replaces the child of the shallowest node
+// whose children changed, or the node itself if more than the child on the way down
+// changed. Children that are copied before they are edited are not changes, since
+// ApplyPatch copies the nodes above the patch anyway.
+func (t *MutableTree) editPatch(pos [3]float32, depth int, edit func() error) (TreePatch, error) {
+	slots := voxelOctants(pos, depth)
+
+	var before []octreeNode
+	for _, idx := range t.path(slots) {
+		before = append(before, t.tree[idx])
+	}
+
+	if err := edit(); err != nil {
+		return TreePatch{}, err
+	}
+
+	after := t.path(slots)
+	if len(before) == 0 || len(after) == 0 {
+		return t.rootPatch(), nil
+	}
+
+	// Without changed children only colors changed, the deepest node is replaced.
+	level, replace := len(after)-1, true
+	for d := 0; d < len(before) && d < len(after); d++ {
+		node := &t.tree[after[d]]
+		changed := changedChildren(&before[d], node)
+		if d < len(slots) && before[d].getChild(slots[d]) != 0 && node.getChild(slots[d]) != 0 {
+			changed &^= 1 << uint(slots[d])
+		}
+
+		if changed != 0 {
+			level = d
+			replace = d == len(slots) || changed != 1<<uint(slots[d])
+			break
+		}
+	}
+
+	if replace {
+		if level == 0 {
+			return t.rootPatch(), nil
+		}
+		level--
+	}
+
+	patch := TreePatch{Depth: level, Cell: octantsCell(slots[:level]), Slot: slots[level]}
+	for _, idx := range after[:level+1] {
+		patch.Colors = append(patch.Colors, t.tree[idx].rawColor())
+	}
+	if child := t.tree[after[level]].getChild(patch.Slot); child != 0 {
+		patch.Nodes = t.patchNodes(child)
+	}
+	return patch, nil
+}
+
+// rootPatch returns a patch that replaces the whole tree.
+func (t *MutableTree) rootPatch() TreePatch {
+	patch := TreePatch{Depth: -1}
+	if len(t.tree) > 0 {
+		patch.Nodes = t.patchNodes(0)
+	}
+	return patch
+}
+
+// octantsCell returns the position of the node reached through slots, in nodes of
+// its depth.
+func octantsCell(slots []int) [3]uint32 {
+	var cell [3]uint32
+	for _, slot := range slots {
+		for axis := range cell {
+			cell[axis] = cell[axis]<<1 | uint32(slot>>uint(axis)&1)
+		}
+	}
+	return cell
+}
+
+// patchNodes returns the subtree of root as patch nodes. Shared nodes stay shared
+// and are only listed once, after all of their parents.
+func (t *MutableTree) patchNodes(root uint32) []PatchNode {
+	parents := map[uint32]int{root: 0}
+	reachable := []uint32{root}
+	for i := 0; i < len(reachable); i++ {
+		node := &t.tree[reachable[i]]
+		for j := range node {
+			child := node.getChild(j)
+			if child == 0 {
+				continue
+			}
+			if _, ok := parents[child]; !ok {
+				reachable = append(reachable, child)
+			}
+			parents[child]++
+		}
+	}
+
+	// Nodes are listed when their last parent has been.
+	order := []uint32{root}
+	rel := map[uint32]uint32{root: 0}
+	for i := 0; i < len(order); i++ {
+		node := &t.tree[order[i]]
+		for j := range node {
+			if child := node.getChild(j); child != 0 {
+				if parents[child]--; parents[child] == 0 {
+					rel[child] = uint32(len(order))
+					order = append(order, child)
+				}
+			}
+		}
+	}
+
+	nodes := make([]PatchNode, len(order))
+	for i, idx := range order {
+		node := &t.tree[idx]
+		nodes[i].Color = node.rawColor()
+		for j := range node {
+			if child := node.getChild(j); child != 0 {
+				nodes[i].Children[j] = rel[child]
+			}
+		}
+	}
+	return nodes
+}
+
+// ApplyPatch applies patch to tree and returns the patched tree. The subtree and
+// copies of the nodes between the root and the subtree are appended, so nodes
+// shared with other parents are left as they were, and the root is changed in
+// place. Frames tracing tree must be waited for first, or a copy of it patched.
+// Nodes the patch replaces are not reclaimed. Patches that don't fit tree fail
+// with InvalidPatchError.
+func ApplyPatch(tree Octree, patch *TreePatch) (Octree, error) {
+	if patch.Depth < 0 {
+		return appendPatchNodes(nil, patch.Nodes)
+	}
+
+	if len(tree) == 0 || patch.Depth >= 32 || patch.Slot < 0 || patch.Slot > 7 || len(patch.Colors) != patch.Depth+1 {
+		return nil, InvalidPatchError
+	}
+	for _, v := range patch.Cell {
+		if uint64(v) >= 1<<uint(patch.Depth) {
+			return nil, InvalidPatchError
+		}
+	}
+
+	var (
+		path  = []uint32{0}
+		slots []int
+	)
+
+	for d := 0; d < patch.Depth; d++ {
+		shift := uint(patch.Depth - 1 - d)
+
+		var slot int
+		for axis, v := range patch.Cell {
+			slot |= int(v>>shift&1) << uint(axis)
+		}
+
+		child := tree[path[d]].getChild(slot)
+		if child == 0 || int64(child) >= int64(len(tree)) {
+			return nil, InvalidPatchError
+		}
+		path = append(path, child)
+		slots = append(slots, slot)
+	}
+
+	if int64(len(tree))+int64(len(path))+int64(len(patch.Nodes)) > maxUint28+1 {
+		return nil, Uint28OverflowError
+	}
+
+	for d := 1; d < len(path); d++ {
+		idx := uint32(len(tree))
+		tree = append(tree, tree[path[d]])
+		tree[path[d-1]].setChild(slots[d-1], idx)
+		path[d] = idx
+	}
+
+	var child uint32
+	if len(patch.Nodes) > 0 {
+		var err error
+		child = uint32(len(tree))
+		if tree, err = appendPatchNodes(tree, patch.Nodes); err != nil {
+			return nil, err
+		}
+	}
+
+	tree[path[len(path)-1]].setChild(patch.Slot, child)
+	for d, idx := range path {
+		tree[idx].setRawColor(patch.Colors[d])
+	}
+	return tree, nil
+}
+
+// appendPatchNodes appends nodes to tree. Children must come after their parents.
+func appendPatchNodes(tree Octree, nodes []PatchNode) (Octree, error) {
+	base := uint32(len(tree))
+	if int64(base)+int64(len(nodes)) > maxUint28+1 {
+		return nil, Uint28OverflowError
+	}
+
+	for i := range nodes {
+		var node octreeNode
+		for j, child := range nodes[i].Children {
+			if child == 0 {
+				continue
+			}
+			if child <= uint32(i) || child >= uint32(len(nodes)) {
+				return nil, InvalidPatchError
+			}
+			node.setChild(j, base+child)
+		}
+		node.setRawColor(nodes[i].Color)
+		tree = append(tree, node)
+	}
+	return tree, nil
+}
@@ -0,0 +1,179 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"bytes"
+	"image/color"
+	"testing"
+)
+
+// sameTree reports if the subtrees of a at ia and b at ib have the same nodes,
+// however they are laid out.
+func sameTree(a, b Octree, ia, ib uint32) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+
+	na, nb := &a[ia], &b[ib]
+	if na.rawColor() != nb.rawColor() {
+		return false
+	}
+
+	for i := range na {
+		ca, cb := na.getChild(i), nb.getChild(i)
+		if (ca == 0) != (cb == 0) {
+			return false
+		}
+		if ca != 0 && !sameTree(a, b, ca, cb) {
+			return false
+		}
+	}
+	return true
+}
+
+type voxelEdit struct {
+	pos   [3]float32
+	depth int
+	clear bool
+	color color.RGBA
+}
+
+func (e *voxelEdit) patch(tree *MutableTree) (TreePatch, error) {
+	if e.clear {
+		return tree.ClearVoxelPatch(e.pos, e.depth)
+	}
+	return tree.SetVoxelPatch(e.pos, e.depth, e.color)
+}
+
+func applyEdits(t *testing.T, tree *MutableTree, edits []voxelEdit) {
+	copied := append(Octree(nil), tree.Octree()...)
+	for i, e := range edits {
+		patch, err := e.patch(tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if copied, err = ApplyPatch(copied, &patch); err != nil {
+			t.Fatalf("edit %d: %v", i, err)
+		}
+
+		if !sameTree(tree.Octree(), copied, 0, 0) {
+			t.Fatalf("edit %d: patched tree differs from the edited tree", i)
+		}
+		if !bytes.Equal(renderImage(tree.Octree(), tree.VoxelsPerAxis()), renderImage(copied, tree.VoxelsPerAxis())) {
+			t.Fatalf("edit %d: patched tree renders differently", i)
+		}
+	}
+}
+
+func TestPatchEdits(t *testing.T) {
+	var (
+		red   = color.RGBA{255, 0, 0, 255}
+		green = color.RGBA{0, 255, 0, 255}
+		blue  = color.RGBA{0, 0, 255, 255}
+	)
+
+	applyEdits(t, solidCube(2, red), []voxelEdit{
+		{pos: [3]float32{0.1, 0.1, 0.1}, depth: 2, color: green},
+		{pos: [3]float32{0.6, 0.1, 0.9}, depth: 4, color: blue},
+		{pos: [3]float32{0.6, 0.1, 0.9}, depth: 4, clear: true},
+		{pos: [3]float32{0.9, 0.9, 0.9}, depth: 3, clear: true},
+		{pos: [3]float32{0.3, 0.8, 0.2}, depth: 1, color: blue},
+		{pos: [3]float32{0.3, 0.8, 0.2}, depth: 1, clear: true},
+		{pos: [3]float32{0.3, 0.8, 0.2}, depth: 3, color: green},
+	})
+
+	// Clearing the last voxel removes the tree, the next edit creates it again.
+	applyEdits(t, solidCube(0, red), []voxelEdit{
+		{pos: [3]float32{0.2, 0.2, 0.2}, depth: 1, color: green},
+		{pos: [3]float32{0.2, 0.2, 0.2}, depth: 1, clear: true},
+		{pos: [3]float32{0.7, 0.2, 0.2}, depth: 2, color: blue},
+	})
+
+	applyEdits(t, sharedTree(), []voxelEdit{
+		{pos: [3]float32{0.125, 0.125, 0.125}, depth: 2, color: red},
+		{pos: [3]float32{0.375, 0.125, 0.125}, depth: 2, clear: true},
+		{pos: [3]float32{0.625, 0.125, 0.125}, depth: 2, color: blue},
+	})
+}
+
+func TestPatchSize(t *testing.T) {
+	tree := solidCube(3, color.RGBA{255, 0, 0, 255})
+	numNodes := len(tree.Octree())
+
+	// Recoloring a voxel only sends the voxel.
+	patch, err := tree.SetVoxelPatch([3]float32{0.1, 0.6, 0.3}, 3, color.RGBA{0, 0, 255, 255})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patch.Depth != 2 || len(patch.Nodes) != 1 || len(patch.Colors) != 3 {
+		t.Errorf("expected a single voxel below depth 2, got depth %d with %d nodes", patch.Depth, len(patch.Nodes))
+	}
+	if patch.Cell != [3]uint32{0, 2, 1} {
+		t.Error("unexpected parent cell:", patch.Cell)
+	}
+
+	// Removing a voxel sends no nodes.
+	if patch, err = tree.ClearVoxelPatch([3]float32{0.1, 0.6, 0.3}, 3); err != nil {
+		t.Fatal(err)
+	}
+	if patch.Depth != 2 || len(patch.Nodes) != 0 {
+		t.Errorf("expected a removal below depth 2, got depth %d with %d nodes", patch.Depth, len(patch.Nodes))
+	}
+
+	// Patches are applied without touching the nodes of other parents.
+	copied := append(Octree(nil), tree.Octree()...)
+	before := append(Octree(nil), copied...)
+	if copied, err = ApplyPatch(copied, &patch); err != nil {
+		t.Fatal(err)
+	}
+	if len(copied) != numNodes+2 {
+		t.Errorf("expected two copied nodes to be appended, got %d", len(copied)-numNodes)
+	}
+	for i := 1; i < numNodes; i++ {
+		if copied[i] != before[i] {
+			t.Fatal("node changed in place:", i)
+		}
+	}
+}
+
+func TestInvalidPatch(t *testing.T) {
+	tree := solidCube(2, color.RGBA{255, 0, 0, 255}).Octree()
+	colors := []color.RGBA{{}, {}}
+
+	patches := []TreePatch{
+		{Depth: 1, Slot: 8, Colors: colors},
+		{Depth: 1, Slot: 0, Colors: colors[:1]},
+		{Depth: 1, Cell: [3]uint32{2, 0, 0}, Colors: colors},
+		{Depth: 3, Colors: make([]color.RGBA, 4)},
+		{Depth: 1, Colors: colors, Nodes: []PatchNode{{Children: [8]uint32{0, 1}}, {Children: [8]uint32{1}}}},
+		{Depth: 1, Colors: colors, Nodes: []PatchNode{{Children: [8]uint32{2}}}},
+		{Depth: -1, Nodes: []PatchNode{{Children: [8]uint32{0, 0, 0}}, {Children: [8]uint32{0, 1}}}},
+	}
+
+	for i := range patches {
+		copied := append(Octree(nil), tree...)
+		if _, err := ApplyPatch(copied, &patches[i]); err != InvalidPatchError {
+			t.Errorf("patch %d: expected InvalidPatchError, got %v", i, err)
+		}
+	}
+
+	if _, err := ApplyPatch(nil, &TreePatch{Colors: colors[:1]}); err != InvalidPatchError {
+		t.Error("expected patches of an empty tree to fail:", err)
+	}
+}
@@ -0,0 +1,60 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package trace
+
+import "image"
+
+// PickMiss is written to Config.PickBuffer for pixels where no node was hit.
+const PickMiss uint32 = 0xFFFFFFFF
+
+func (cfg *Config) validatePickBuffer() error {
+	if cfg.PickBuffer == nil || cfg.Images[0] == nil {
+		return nil
+	}
+	size := cfg.Images[0].Bounds().Size()
+	if len(cfg.PickBuffer) < size.X*size.Y {
+		return InvalidSizeError
+	}
+	return nil
+}
+
+// writePick stores the node hit by the pixel at dx, dy of img, which starts at the
+// origin. Pixels outside of a buffer that is too small are dropped.
+func writePick(pick []uint32, img *image.RGBA, dx, dy int, index uint32, hit bool) {
+	if !hit {
+		index = PickMiss
+	}
+	if i := dy*img.Rect.Dx() + dx; i < len(pick) {
+		pick[i] = index
+	}
+}
+
+// SetPickBuffer replaces Config.PickBuffer. Frames in flight are completed first.
+// InvalidSizeError is returned if it is smaller than the images.
+func (rt *Raytracer) SetPickBuffer(pick []uint32) error {
+	rt.traceLock.Lock()
+	defer rt.traceLock.Unlock()
+
+	rt.wait(0)
+	rt.wait(1)
+
+	if size := rt.cfg.Images[0].Bounds().Size(); pick != nil && len(pick) < size.X*size.Y {
+		return invalidConfig("PickBuffer", InvalidSizeError)
+	}
+	rt.cfg.PickBuffer = pick
+	return nil
+}
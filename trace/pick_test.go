@@ -0,0 +1,72 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package trace
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestPickBuffer(t *testing.T) {
+	tree := NewMutableTree(nil, 2)
+	if err := tree.SetVoxel([3]float32{0.25, 0.25, 0.25}, 1, color.RGBA{200, 100, 50, 255}); err != nil {
+		panic(err)
+	}
+
+	rect := image.Rect(0, 0, 32, 32)
+	camera := LookAtCamera{Pos: Vec3{0.25, 0.25, 4}, Look: Vec3{0.25, 0.25, 0.25}}
+
+	rt := newTestRaytracer(Vec3{}, 1)
+	defer rt.Close()
+	leaf, ok := rt.CastRay(tree.Octree(), 1, camera.Pos, Vec3{0, 0, -1}, 10)
+	if !ok {
+		t.Fatal("expected the ray through the leaf to hit it")
+	}
+
+	for _, jitter := range []bool{false, true} {
+		pick := make([]uint32, rect.Dx()*rect.Dy())
+
+		cfg := Config{
+			FieldOfView: 0.8,
+			TreeScale:   1,
+			ViewDist:    10,
+			Packets:     true,
+			Jitter:      jitter,
+			PickBuffer:  pick,
+			Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		renderTestFrame(tree, cfg, &camera)
+
+		// Jitter offsets the rays within the pixels, which still hit the same leaf.
+		if p := pick[16*rect.Dx()+16]; p != leaf.Node {
+			t.Errorf("expected the center pixel to pick node %d with jitter %v, got %d", leaf.Node, jitter, p)
+		}
+		if p := pick[rect.Dx()+1]; p != PickMiss {
+			t.Errorf("expected the corner pixel to miss with jitter %v, got %d", jitter, p)
+		}
+	}
+
+	cfg := Config{FieldOfView: 0.8, PickBuffer: make([]uint32, 10), Images: [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}}
+	if err := cfg.Validate(); !errors.Is(err, InvalidSizeError) {
+		t.Errorf("expected a small pick buffer to be rejected, got %v", err)
+	}
+}
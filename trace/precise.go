@@ -0,0 +1,163 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"math"
+)
+
+type (
+	vec3d      [3]float64
+	preciseRay [2]vec3d
+
+	// preciseScan is the float64 version of scanSetup. Only the positions need the
+	// extra precision, the camera basis is still computed in float32.
+	preciseScan struct {
+		xInc, yInc, bottomLeft, eye vec3d
+	}
+)
+
+func toVec3d(v [3]float32) vec3d {
+	return vec3d{float64(v[0]), float64(v[1]), float64(v[2])}
+}
+
+func (s *preciseScan) ray(w, h int) preciseRay {
+	return s.rayAt(float64(w), float64(h))
+}
+
+func (s *preciseScan) rayAt(w, h float64) preciseRay {
+	var dir vec3d
+	for i := range dir {
+		p := s.bottomLeft[i] + s.xInc[i]*w + s.yInc[i]*h
+		dir[i] = p - s.eye[i]
+	}
+
+	l := math.Sqrt(dir[0]*dir[0] + dir[1]*dir[1] + dir[2]*dir[2])
+	dir[0] /= l
+	dir[1] /= l
+	dir[2] /= l
+
+	return preciseRay{s.eye, dir}
+}
+
+// infinite returns the ray in float32, losing the extra precision.
+func (r *preciseRay) infinite() infiniteRay {
+	var ray infiniteRay
+	for i := range ray {
+		for j := range ray[i] {
+			ray[i][j] = float32(r[i][j])
+		}
+	}
+	return ray
+}
+
+func (rt *Raytracer) preciseScanSetup(camera Camera, size image.Point) preciseScan {
+	width, height := float64(size.X), float64(size.Y)
+
+	eye := toVec3d(camera.Position())
+	viewDirection, u, v := rt.cfg.flippedBasis(camera)
+
+	viewPlaneHalfWidth := math.Tan(float64(rt.cfg.fieldOfView()) / 2)
+	viewPlaneHalfHeight := (height / width) * viewPlaneHalfWidth
+
+	var s preciseScan
+	s.eye = eye
+	for i := 0; i < 3; i++ {
+		s.bottomLeft[i] = eye[i] + float64(viewDirection[i]) - float64(v[i])*viewPlaneHalfHeight - float64(u[i])*viewPlaneHalfWidth
+		s.xInc[i] = float64(u[i]) * 2 * viewPlaneHalfWidth / width
+		s.yInc[i] = float64(v[i]) * 2 * viewPlaneHalfHeight / height
+	}
+	return s
+}
+
+func intersectBoxPrecise(ray *preciseRay, length float64, min *vec3d, size, eps float64) float64 {
+	var (
+		origin    = &ray[0]
+		direction = &ray[1]
+
+		start = 0.0
+		final = math.Inf(1)
+	)
+
+	for i := 0; i < 3; i++ {
+		a := (min[i] - origin[i]) / direction[i]
+		b := (min[i] + size - origin[i]) / direction[i]
+		final = math.Min(final, math.Max(a, b))
+		start = math.Max(start, math.Min(a, b))
+	}
+
+	if final+eps > start && start < length {
+		return start
+	}
+	return length
+}
+
+// intersectTreePrecise is the float64 version of intersectTree.
+func (rt *Raytracer) intersectTreePrecise(tree []octreeNode, masks []uint8, ray *preciseRay, nodePos *vec3d, nodeScale, length float64, maxDepth float32, nodeIndex, treeDepth uint32, visits *uint64) (float64, uint32, uint32, bool) {
+	var (
+		node = &tree[nodeIndex]
+
+		// Declare this here to avoid runtime allocation.
+		pos vec3d
+	)
+
+	*visits++
+
+	boxDist := intersectBoxPrecise(ray, length, nodePos, nodeScale, float64(rt.epsilon)*nodeScale)
+	if boxDist == length {
+		return length, 0, 0, false
+	}
+
+	// The node filter is checked here and not in a separate traversal like
+	// intersectFiltered, the float64 rays are not the fast path.
+	d := float32(boxDist) / rt.cfg.ViewDist
+	if node.leaf() || treeDepth > uint32(maxDepth*(1-d*d)) {
+		if rt.filtered(tree, nodeIndex) {
+			return length, 0, 0, false
+		}
+		return boxDist, nodeIndex, treeDepth, true
+	}
+
+	mask := nodeMask(tree, masks, nodeIndex)
+	childScale := nodeScale * 0.5
+	childDepth := treeDepth + 1
+
+	order := 0
+	for axis := range ray[1] {
+		if ray[1][axis] < 0 {
+			order |= 1 << uint(axis)
+		}
+	}
+
+	for k := 0; k < 8; k++ {
+		i := k ^ order
+		if mask&(1<<uint(i)) == 0 {
+			continue
+		}
+
+		for j := range pos {
+			pos[j] = nodePos[j] + float64(childPositions[i][j])*childScale
+		}
+
+		if ln, idx, depth, ok := rt.intersectTreePrecise(tree, masks, ray, &pos, childScale, length, maxDepth, node.getChild(i), childDepth, visits); ok && ln < length {
+			return ln, idx, depth, true
+		}
+	}
+	return length, 0, 0, false
+}
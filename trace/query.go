@@ -0,0 +1,174 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/andreas-jonsson/octatron/go3d/vec3"
+)
+
+type Hit struct {
+	Distance float32
+	Position Vec3
+	Node     uint32
+	Depth    int
+	Color    color.RGBA
+
+	// Normal is the face normal of the node at the hit, see HitInfo.
+	Normal Vec3
+
+	// Instance is the tree of the node, zero for the tree of the ray and i+1 for
+	// Config.Instances[i].
+	Instance uint16
+}
+
+// CastRay traces a single ray through tree and Config.Instances using the same
+// traversal and level-of-detail as Trace. Origin and the returned position are
+// in world space.
+func (rt *Raytracer) CastRay(tree Octree, maxDepth int, origin, dir Vec3, maxDist float32) (Hit, bool) {
+	var hit Hit
+
+	direction := vec3.T(dir)
+	direction.Normalize()
+
+	ray := infiniteRay{vec3.T(origin), direction}
+	nodePos := vec3.T(rt.cfg.TreePosition)
+
+	var (
+		visits   uint64
+		dist     = maxDist
+		idx      uint32
+		depth    uint32
+		ok       bool
+		instance uint16
+		hitTree  = tree
+	)
+	if len(tree) > 0 {
+		dist, idx, depth, ok = rt.intersectTree(tree, nil, &ray, &nodePos, rt.cfg.TreeScale, maxDist, float32(maxDepth), 0, 0, &visits)
+	}
+	for i, inst := range rt.cfg.placeInstances(tree, nil, float32(maxDepth), 0) {
+		if len(inst.tree) == 0 {
+			continue
+		}
+		if ln, n, d, found := rt.intersectTree(inst.tree, nil, &ray, &inst.pos, inst.scale, dist, inst.maxDepth, 0, 0, &visits); found && ln < dist {
+			dist, idx, depth, ok, instance, hitTree = ln, n, d, true, uint16(i+1), inst.tree
+		}
+	}
+	if !ok {
+		return hit, false
+	}
+
+	nodePos, nodeScale := rt.cfg.placement(instance)
+	hit.Normal = faceNormal(hitFace(&ray, dist, depth, &nodePos, nodeScale))
+	hit.Instance = instance
+
+	direction.Scale(dist)
+	hit.Distance = dist
+	hit.Position = Vec3(vec3.Add(&ray[0], &direction))
+	hit.Node = idx
+	hit.Depth = int(depth)
+	hit.Color = hitTree[idx].getColor()
+	return hit, true
+}
+
+// NodeAt returns the deepest node of tree containing pos, at most maxDepth levels
+// below the root, and its depth. The tree covers the cube of size treeScale at
+// treePos, like Config.TreePosition and TreeScale. Nodes contain their min faces
+// but not their max faces, like the voxels of MutableTree.SetVoxel. The node is
+// a parent with an empty octant at pos if it has children and is above maxDepth.
+// False is returned for points outside the tree and for empty trees.
+func (t Octree) NodeAt(pos, treePos [3]float32, treeScale float32, maxDepth int) (uint32, int, bool) {
+	if len(t) == 0 || !(treeScale > 0) {
+		return 0, 0, false
+	}
+
+	var p [3]float32
+	for axis := range p {
+		p[axis] = (pos[axis] - treePos[axis]) / treeScale
+	}
+	if !insideUnitCube(p) {
+		return 0, 0, false
+	}
+
+	var (
+		idx   uint32
+		depth int
+		scale float32 = 0.5
+	)
+
+	for ; depth < maxDepth; depth++ {
+		var i int
+		i, p = octant(&p, scale)
+
+		child := t[idx].getChild(i)
+		if child == 0 {
+			break
+		}
+
+		idx = child
+		scale *= 0.5
+	}
+	return idx, depth, true
+}
+
+// PixelRay returns the origin and normalized direction of the perspective ray
+// through the point x, y of an image of size, in pixels from the top left corner.
+// Frames of one sample trace the top left corners of the pixels. The ray is the
+// one Trace follows with the field of view and flips of the configuration.
+func (rt *Raytracer) PixelRay(camera Camera, size image.Point, x, y float32) (Vec3, Vec3) {
+	xInc, yInc, bottomLeft := rt.calcIncVectors(camera, size)
+	scan := scanSetup{xInc, yInc, bottomLeft, vec3.T(camera.Position())}
+	ray := scan.rayAt(x, float32(size.Y)-y)
+	return Vec3(ray[0]), Vec3(ray[1])
+}
+
+// ProjectPoint is the inverse of Raytracer.PixelRay. It returns the point x, y of
+// an image of size that pos is seen at, in pixels from the top left corner, with
+// the field of view and flips of cfg. False is returned if pos is not in front of
+// the camera, points outside of the image are returned as is.
+func (cfg *Config) ProjectPoint(camera Camera, size image.Point, pos Vec3) (float32, float32, bool) {
+	eye := vec3.T(camera.Position())
+	p := vec3.T(pos)
+	d := vec3.Sub(&p, &eye)
+
+	viewDirection, u, v := cfg.flippedBasis(camera)
+	z := vec3.Dot(&d, &viewDirection)
+	if !(z > 0) {
+		return 0, 0, false
+	}
+
+	halfWidth := float32(math.Tan(float64(cfg.fieldOfView() / 2)))
+	halfHeight := halfWidth * float32(size.Y) / float32(size.X)
+	x := (vec3.Dot(&d, &u)/z + halfWidth) / (2 * halfWidth) * float32(size.X)
+	y := (vec3.Dot(&d, &v)/z + halfHeight) / (2 * halfHeight) * float32(size.Y)
+	return x, float32(size.Y) - y, true
+}
+
+// VoxelAt returns the color of the leaf of the unit cube tree containing pos, at
+// most maxDepth levels below the root. Nodes at maxDepth are leafs. False is
+// returned if pos is empty or outside the tree.
+func (t Octree) VoxelAt(pos [3]float32, maxDepth int) (color.RGBA, bool) {
+	idx, depth, ok := t.NodeAt(pos, [3]float32{}, 1, maxDepth)
+	if !ok || (depth < maxDepth && !t[idx].leaf()) {
+		return color.RGBA{}, false
+	}
+	return t[idx].getColor(), true
+}
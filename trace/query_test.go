@@ -0,0 +1,247 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func newTestRaytracer(treePos Vec3, treeScale float32) *Raytracer {
+	rect := image.Rect(0, 0, 8, 8)
+	return NewRaytracer(Config{
+		FieldOfView:  0.2,
+		TreeScale:    treeScale,
+		TreePosition: treePos,
+		ViewDist:     10,
+		Images:       [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+}
+
+func near(a, b Vec3) bool {
+	for i := range a {
+		if math.Abs(float64(a[i]-b[i])) > 0.0001 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCastRay(t *testing.T) {
+	blue := color.RGBA{0, 0, 255, 255}
+	tree := NewMutableTree(nil, 4)
+	if err := tree.SetVoxel([3]float32{0.6, 0.3, 0.1}, 2, blue); err != nil {
+		panic(err)
+	}
+
+	rt := newTestRaytracer(Vec3{}, 1)
+	defer rt.Close()
+
+	tests := []struct {
+		origin, dir, pos Vec3
+		dist             float32
+		normal           Vec3
+	}{
+		{Vec3{0.6, 0.3, 2}, Vec3{0, 0, -1}, Vec3{0.6, 0.3, 0.25}, 1.75, Vec3{0, 0, 1}},
+		{Vec3{-1, 0.3, 0.1}, Vec3{2, 0, 0}, Vec3{0.5, 0.3, 0.1}, 1.5, Vec3{-1, 0, 0}},
+		{Vec3{0.6, -2, 0.1}, Vec3{0, 1, 0}, Vec3{0.6, 0.25, 0.1}, 2.25, Vec3{0, -1, 0}},
+	}
+
+	for _, test := range tests {
+		hit, ok := rt.CastRay(tree.Octree(), 3, test.origin, test.dir, 10)
+		if !ok {
+			t.Fatalf("ray from %v missed", test.origin)
+		}
+
+		if !near(hit.Position, test.pos) || math.Abs(float64(hit.Distance-test.dist)) > 0.0001 {
+			t.Errorf("ray from %v hit %v at %v, expected %v at %v", test.origin, hit.Position, hit.Distance, test.pos, test.dist)
+		}
+
+		if hit.Depth != 2 || hit.Color.B != 255 || hit.Normal != test.normal {
+			t.Errorf("unexpected hit: %+v", hit)
+		}
+	}
+
+	if hit, ok := rt.CastRay(tree.Octree(), 3, Vec3{0.1, 0.1, 2}, Vec3{0, 0, -1}, 10); ok {
+		t.Errorf("expected miss, got %+v", hit)
+	}
+
+	if _, ok := rt.CastRay(tree.Octree(), 3, Vec3{0.6, 0.3, 2}, Vec3{0, 0, -1}, 1); ok {
+		t.Error("expected miss beyond max distance")
+	}
+}
+
+func TestCastRayTransformed(t *testing.T) {
+	tree := NewMutableTree(nil, 2)
+	if err := tree.SetVoxel([3]float32{0.75, 0.75, 0.75}, 1, color.RGBA{255, 255, 255, 255}); err != nil {
+		panic(err)
+	}
+
+	rt := newTestRaytracer(Vec3{10, 0, 0}, 4)
+	defer rt.Close()
+
+	hit, ok := rt.CastRay(tree.Octree(), 2, Vec3{13, 3, 10}, Vec3{0, 0, -1}, 20)
+	if !ok || !near(hit.Position, Vec3{13, 3, 4}) {
+		t.Fatalf("unexpected hit: %v, %+v", ok, hit)
+	}
+}
+
+func TestNodeAt(t *testing.T) {
+	var (
+		red   = color.RGBA{255, 0, 0, 1}
+		green = color.RGBA{0, 255, 0, 1}
+		blue  = color.RGBA{0, 0, 255, 1}
+	)
+
+	mutable := NewMutableTree(nil, 4)
+	for _, v := range []struct {
+		pos [3]float32
+		c   color.RGBA
+	}{{[3]float32{0.1, 0.1, 0.1}, red}, {[3]float32{0.6, 0.6, 0.6}, green}, {[3]float32{0.9, 0.9, 0.9}, blue}} {
+		if err := mutable.SetVoxel(v.pos, 2, v.c); err != nil {
+			panic(err)
+		}
+	}
+	tree := mutable.Octree()
+
+	tests := []struct {
+		pos      [3]float32
+		maxDepth int
+		depth    int
+		color    color.RGBA
+	}{
+		{[3]float32{0, 0, 0}, 8, 2, red},
+		{[3]float32{0.5, 0.5, 0.5}, 8, 2, green},
+		{[3]float32{0.9999, 0.9999, 0.9999}, 8, 2, blue},
+		{[3]float32{0, 0, 0}, 1, 1, red},
+		{[3]float32{0.5, 0.5, 0.5}, 0, 0, tree[0].getColor()},
+	}
+
+	for _, test := range tests {
+		idx, depth, ok := tree.NodeAt(test.pos, [3]float32{}, 1, test.maxDepth)
+		if !ok || depth != test.depth || tree[idx].getColor() != test.color {
+			t.Errorf("%v at depth %v: expected %v at depth %v, got %v at depth %v, %v", test.pos, test.maxDepth, test.color, test.depth, tree[idx].getColor(), depth, ok)
+		}
+	}
+
+	// The upper octant of the lower octant is empty, its parent is returned.
+	if idx, depth, ok := tree.NodeAt([3]float32{0.49, 0.49, 0.49}, [3]float32{}, 1, 8); !ok || depth != 1 || tree[idx].childMask() != 1 {
+		t.Errorf("expected the parent of the empty octant, got node %v at depth %v, %v", idx, depth, ok)
+	}
+
+	// Points are moved into the tree with the position and scale.
+	if idx, depth, ok := tree.NodeAt([3]float32{12.4, 2.4, -2.6}, [3]float32{10, 0, -5}, 4, 8); !ok || depth != 2 || tree[idx].getColor() != green {
+		t.Errorf("expected the green voxel in the transformed tree, got node %v at depth %v, %v", idx, depth, ok)
+	}
+
+	for _, pos := range [][3]float32{{1, 1, 1}, {0.5, 1, 0.5}, {-0.001, 0, 0}, {0.5, 0.5, float32(math.NaN())}} {
+		if _, _, ok := tree.NodeAt(pos, [3]float32{}, 1, 8); ok {
+			t.Errorf("expected %v to be outside the tree", pos)
+		}
+	}
+
+	if _, _, ok := Octree(nil).NodeAt([3]float32{0.5, 0.5, 0.5}, [3]float32{}, 1, 8); ok {
+		t.Error("expected no node in an empty tree")
+	}
+}
+
+func TestPixelRay(t *testing.T) {
+	tree := NewMutableTree(nil, 4)
+	if err := tree.SetVoxel([3]float32{0.6, 0.3, 0.1}, 2, color.RGBA{0, 0, 255, 255}); err != nil {
+		panic(err)
+	}
+
+	rect := image.Rect(0, 0, 32, 24)
+	camera := FreeFlightCamera{Pos: Vec3{0.5, 0.5, 2}, XRot: 0.05, YRot: -0.1}
+	for _, flip := range []bool{false, true} {
+		cfg := Config{
+			FieldOfView: 0.6,
+			TreeScale:   1,
+			ViewDist:    10,
+			FlipY:       flip,
+			Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		}
+		img, _ := renderTestFrame(tree, cfg, &camera)
+
+		rt := NewRaytracer(cfg)
+		for y := 0; y < rect.Dy(); y++ {
+			for x := 0; x < rect.Dx(); x++ {
+				origin, dir := rt.PixelRay(&camera, rect.Size(), float32(x), float32(y))
+				_, hit := rt.CastRay(tree.Octree(), 4, origin, dir, 10)
+				if (img.RGBAAt(x, y).B > 0) != hit {
+					t.Errorf("ray through pixel %d, %d with flip %v does not match the frame", x, y, flip)
+				}
+			}
+		}
+		rt.Close()
+	}
+}
+
+func TestProjectPoint(t *testing.T) {
+	size := image.Pt(32, 24)
+	camera := FreeFlightCamera{Pos: Vec3{0.5, 0.5, 2}, XRot: 0.05, YRot: -0.1}
+	for _, flip := range []bool{false, true} {
+		cfg := Config{FieldOfView: 0.6, TreeScale: 1, FlipX: flip, Images: [2]*image.RGBA{image.NewRGBA(image.Rectangle{Max: size}), image.NewRGBA(image.Rectangle{Max: size})}}
+		rt := NewRaytracer(cfg)
+
+		for _, p := range [][2]float32{{0, 0}, {3.5, 20}, {31, 12.25}} {
+			origin, dir := rt.PixelRay(&camera, size, p[0], p[1])
+			pos := Vec3{origin[0] + 3*dir[0], origin[1] + 3*dir[1], origin[2] + 3*dir[2]}
+			x, y, ok := cfg.ProjectPoint(&camera, size, pos)
+			if !ok || math.Abs(float64(x-p[0])) > 0.01 || math.Abs(float64(y-p[1])) > 0.01 {
+				t.Errorf("flip %v: pixel %v projected back to %v, %v", flip, p, x, y)
+			}
+		}
+		rt.Close()
+	}
+
+	if _, _, ok := (&Config{FieldOfView: 0.6}).ProjectPoint(&camera, size, Vec3{0.5, 0.5, 3}); ok {
+		t.Error("points behind the camera can not be projected")
+	}
+}
+
+func TestVoxelAt(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	tree := NewMutableTree(nil, 4)
+	if err := tree.SetVoxel([3]float32{0.1, 0.1, 0.1}, 1, red); err != nil {
+		panic(err)
+	}
+	if err := tree.SetVoxel([3]float32{0.9, 0.9, 0.9}, 2, red); err != nil {
+		panic(err)
+	}
+
+	tests := []struct {
+		pos      [3]float32
+		maxDepth int
+		ok       bool
+	}{
+		{[3]float32{0.4, 0.1, 0.3}, 2, true},
+		{[3]float32{0.8, 0.8, 0.8}, 2, true},
+		{[3]float32{0.6, 0.6, 0.6}, 2, false},
+		{[3]float32{0.6, 0.6, 0.6}, 1, true},
+		{[3]float32{0.9, 0.1, 0.1}, 2, false},
+		{[3]float32{1, 0.1, 0.1}, 2, false},
+	}
+	for _, test := range tests {
+		if c, ok := tree.Octree().VoxelAt(test.pos, test.maxDepth); ok != test.ok || (ok && c.R != 255) {
+			t.Errorf("%v at depth %d: expected %v, got %v, %v", test.pos, test.maxDepth, test.ok, c, ok)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package trace
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/andreas-jonsson/octatron/go3d/vec3"
+)
+
+// rasterNear is the closest distance to the eye along the view direction at which
+// faces are drawn.
+const rasterNear = 1e-4
+
+// rasterEdgeTolerance is how far, in pixels times the length of the edge, a pixel
+// may be outside of a face and still be drawn.
+const rasterEdgeTolerance = 1e-3
+
+// rasterView projects points to scan positions, the inverse of the rays traced
+// through pixels.
+type rasterView struct {
+	eye, forward, bottomLeft vec3.T
+	xInc, yInc               vec3.T
+	xLen, yLen               float32
+}
+
+// project returns the scan position of p and its distance along the view
+// direction.
+func (v *rasterView) project(p *vec3.T) (float32, float32, float32) {
+	d := vec3.Sub(p, &v.eye)
+	z := vec3.Dot(&d, &v.forward)
+	if z <= rasterNear {
+		return 0, 0, z
+	}
+
+	// The point where the line to p crosses the view plane, relative to its
+	// bottom left corner.
+	d.Scale(1 / z)
+	r := vec3.Sub(&d, &v.bottomLeft)
+	return vec3.Dot(&r, &v.xInc) / v.xLen, vec3.Dot(&r, &v.yInc) / v.yLen, z
+}
+
+// RasterizeCubes draws the leafs of tree, or of the tree set with SetTree if tree is
+// nil, as cubes into img from camera. It is much cheaper than tracing at low
+// resolutions but only approximates the image: a cube is drawn in front of or
+// behind another as a whole, by the distance to its center, and nodes are not
+// subdivided below maxDepth or when smaller than a pixel. The framing matches Trace
+// for an image of the same size. Shader, Fog, LUT and NodeFilter are applied, the
+// projection, stereo and the ground plane are not.
+func (rt *Raytracer) RasterizeCubes(camera Camera, tree Octree, maxDepth int, img *image.RGBA) {
+	if tree == nil {
+		if snapshot := rt.acquireSnapshot(); snapshot != nil {
+			defer snapshot.Release()
+			tree, maxDepth = snapshot.tree, snapshot.maxDepth
+		}
+	}
+
+	cfg := &rt.cfg
+	bounds := img.Bounds()
+	size := bounds.Size()
+	if size.X <= 0 || size.Y <= 0 || !finiteCamera(camera) {
+		return
+	}
+
+	xInc, yInc, bottomLeft := rt.calcIncVectors(camera, size)
+	forward, _, _ := cameraBasis(camera)
+	eye := vec3.T(camera.Position())
+	view := rasterView{
+		eye:        eye,
+		forward:    forward,
+		bottomLeft: vec3.Sub(&bottomLeft, &eye),
+		xInc:       xInc,
+		yInc:       yInc,
+		xLen:       xInc.LengthSqr(),
+		yLen:       yInc.LengthSqr(),
+	}
+
+	zbuf := make([]float32, size.X*size.Y)
+	for i := range zbuf {
+		zbuf[i] = float32(math.Inf(1))
+	}
+
+	var nodes []VisibleNode
+	if len(tree) > 0 {
+		fov := cfg.fieldOfView()
+		f := newFrustum(camera, fov, float32(size.X)/float32(size.Y), 2*float32(math.Tan(float64(fov/2)))/float32(size.X))
+		if maxDepth >= 0 {
+			f.maxDepth = uint32(maxDepth)
+		}
+		nodes = f.collect(tree, vec3.T(cfg.TreePosition), cfg.TreeScale, 0, 0, nil)
+	}
+
+	for i := range nodes {
+		n := &nodes[i]
+		if n.Distance > cfg.ViewDist || n.Distance < cfg.Near || rt.filtered(tree, n.Index) {
+			continue
+		}
+
+		half := n.Scale / 2
+		center := vec3.T{n.Position[0] + half, n.Position[1] + half, n.Position[2] + half}
+		d := vec3.Sub(&center, &eye)
+		depth := vec3.Dot(&d, &forward)
+
+		c := n.Color
+		for axis := 0; axis < 3; axis++ {
+			for side := 0; side < 2; side++ {
+				plane := n.Position[axis] + float32(side)*n.Scale
+				if (side == 1) != (eye[axis] > plane) {
+					// The face is turned away from the eye.
+					continue
+				}
+
+				var quad [4][2]float32
+				visible := true
+				for k, corner := range [4][2]float32{{0, 0}, {1, 0}, {1, 1}, {0, 1}} {
+					p := vec3.T(n.Position)
+					p[axis] = plane
+					p[(axis+1)%3] += corner[0] * n.Scale
+					p[(axis+2)%3] += corner[1] * n.Scale
+
+					w, h, z := view.project(&p)
+					if z <= rasterNear {
+						visible = false
+						break
+					}
+					quad[k] = [2]float32{w, h}
+				}
+
+				if visible {
+					rt.fillQuad(img, zbuf, &quad, depth, n.Distance, c)
+				}
+			}
+		}
+	}
+
+	for dy := 0; dy < size.Y; dy++ {
+		for dx := 0; dx < size.X; dx++ {
+			if math.IsInf(float64(zbuf[dy*size.X+dx]), 1) {
+				p := image.Point{bounds.Min.X + dx, bounds.Min.Y + dy}
+				img.SetRGBA(p.X, p.Y, rt.shadeColor(p, rt.clear, cfg.ViewDist, false))
+			}
+		}
+	}
+}
+
+// fillQuad draws the pixels of img whose rays pass through the convex quad, given in
+// scan positions, if they are closer than depth in zbuf.
+func (rt *Raytracer) fillQuad(img *image.RGBA, zbuf []float32, quad *[4][2]float32, depth, dist float32, c color.RGBA) {
+	bounds := img.Bounds()
+	size := bounds.Size()
+
+	minW, minH := quad[0][0], quad[0][1]
+	maxW, maxH := minW, minH
+	for _, q := range quad[1:] {
+		minW = float32(math.Min(float64(minW), float64(q[0])))
+		maxW = float32(math.Max(float64(maxW), float64(q[0])))
+		minH = float32(math.Min(float64(minH), float64(q[1])))
+		maxH = float32(math.Max(float64(maxH), float64(q[1])))
+	}
+
+	// Pixel dx, dy is sampled at scan position dx, size.Y - dy.
+	x0 := int(math.Max(0, math.Ceil(float64(minW))))
+	x1 := int(math.Min(float64(size.X-1), math.Floor(float64(maxW))))
+	y0 := int(math.Max(0, math.Ceil(float64(float32(size.Y)-maxH))))
+	y1 := int(math.Min(float64(size.Y-1), math.Floor(float64(float32(size.Y)-minH))))
+
+	// The winding of the quad depends on which side it is seen from.
+	var area float32
+	for k := range quad {
+		a, b := quad[k], quad[(k+1)%4]
+		area += a[0]*b[1] - b[0]*a[1]
+	}
+	winding := float32(1)
+	if area < 0 {
+		winding = -1
+	}
+
+	for dy := y0; dy <= y1; dy++ {
+		h := float32(size.Y - dy)
+	pixels:
+		for dx := x0; dx <= x1; dx++ {
+			w := float32(dx)
+			for k := range quad {
+				a, b := quad[k], quad[(k+1)%4]
+				// Pixels on an edge are drawn by both faces sharing it, with some
+				// tolerance so rounding does not leave gaps between them.
+				if e := (b[0]-a[0])*(h-a[1]) - (b[1]-a[1])*(w-a[0]); e*winding < -rasterEdgeTolerance {
+					continue pixels
+				}
+			}
+
+			i := dy*size.X + dx
+			if depth >= zbuf[i] {
+				continue
+			}
+			zbuf[i] = depth
+
+			p := image.Point{bounds.Min.X + dx, bounds.Min.Y + dy}
+			img.SetRGBA(p.X, p.Y, rt.shadeColor(p, c, dist, true))
+		}
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package trace
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestRasterizeCubes(t *testing.T) {
+	tree := solidCube(1, color.RGBA{200, 100, 50, 255})
+	rect := image.Rect(0, 0, 64, 48)
+	rt := NewRaytracer(Config{
+		FieldOfViewDegrees: 60,
+		TreeScale:          1,
+		ViewDist:           10,
+		Images:             [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	defer rt.Close()
+	rt.SetClearColor(testClearColor)
+	rt.SetTree(tree.Octree(), 1)
+
+	for _, camera := range []LookAtCamera{
+		{Pos: Vec3{0.47, 0.53, 2.5}, Look: Vec3{0.5, 0.5, 0.5}},
+		{Pos: Vec3{1.8, 1.4, 2}, Look: Vec3{0.5, 0.5, 0.5}},
+	} {
+		traced := rt.Image(rt.Trace(&camera, nil, 0))
+
+		// The image has an offset origin to check that it is respected.
+		raster := image.NewRGBA(rect.Add(image.Point{5, 7}))
+		rt.RasterizeCubes(&camera, nil, 0, raster)
+
+		covered := func(img *image.RGBA, x, y int) bool {
+			b := img.Bounds()
+			return img.RGBAAt(b.Min.X+x, b.Min.Y+y) != testClearColor
+		}
+
+		// Pixels may only differ next to the silhouette.
+		var hits, mismatches int
+		for y := 0; y < rect.Dy(); y++ {
+			for x := 0; x < rect.Dx(); x++ {
+				c := covered(traced, x, y)
+				if c {
+					hits++
+					if r := raster.RGBAAt(raster.Rect.Min.X+x, raster.Rect.Min.Y+y); r != traced.RGBAAt(x, y) {
+						t.Errorf("%v, %v: color %v != %v", x, y, r, traced.RGBAAt(x, y))
+					}
+				}
+				if c == covered(raster, x, y) {
+					continue
+				}
+
+				mismatches++
+				edge := false
+				for _, n := range []image.Point{{x - 1, y}, {x + 1, y}, {x, y - 1}, {x, y + 1}} {
+					if n.In(rect) && covered(traced, n.X, n.Y) != c {
+						edge = true
+					}
+				}
+				if !edge {
+					t.Errorf("%v, %v: pixel differs away from the silhouette", x, y)
+				}
+			}
+		}
+
+		if hits < 100 {
+			t.Errorf("expected the cube in the frame, got %v pixels", hits)
+		}
+		if mismatches > hits/10 {
+			t.Errorf("%v of %v pixels differ", mismatches, hits)
+		}
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/andreas-jonsson/octatron/go3d/quaternion"
 	"github.com/andreas-jonsson/octatron/go3d/vec3"
@@ -35,6 +36,15 @@ import (
 
 const maxUint28 = 1<<28 - 1
 
+// DefaultEpsilon is the ray-box tolerance used when Config.Epsilon is zero.
+const DefaultEpsilon = 1e-5
+
+// Values of Raytracer.aborted for frames that are not presented.
+const (
+	frameAborted = 1 + iota
+	frameInvalid
+)
+
 type (
 	Vec3   [3]float32
 	Octree []octreeNode
@@ -46,7 +56,11 @@ type (
 	}
 
 	Config struct {
-		FieldOfView  float32
+		// FieldOfView is the horizontal field of view in radians. It is ignored
+		// if FieldOfViewDegrees is set.
+		FieldOfView        float32
+		FieldOfViewDegrees float32
+
 		TreeScale    float32
 		TreePosition Vec3
 
@@ -54,25 +68,409 @@ type (
 		FrameSeed     int
 		Jitter, Depth bool
 		MultiThreaded bool
-		Images        [2]*image.RGBA
+		Packets       bool
+
+		// Near is the distance from the eye at which rays start, hits closer than
+		// it are ignored. ViewDist is where the rays end. Level of detail is
+		// measured from the near end. Near disables Packets.
+		Near float32
+
+		// LODBias is the number of levels of detail dropped everywhere, trading
+		// detail for speed. Rays stop at most maxDepth minus LODBias levels below
+		// the root, and coarser with distance as before. Zero traces the full
+		// detail.
+		LODBias float32
+
+		// Epsilon is the tolerance of the ray-box tests relative to the size of
+		// the box. A ray that leaves a box at most Epsilon times its size before
+		// entering it still hits it, which closes the cracks float32 rounding
+		// opens between small nodes far from the origin. It also lifts the origin
+		// of secondary rays off the surface they start from. Zero uses
+		// DefaultEpsilon and a negative value disables the tolerance.
+		Epsilon float32
+
+		// Workers is the number of worker goroutines. If zero, one worker per CPU
+		// is used when MultiThreaded is set.
+		Workers int
+
+		// MaxGoroutines caps the number of worker goroutines, also when Workers
+		// is set. Workers then trace more tiles each. If zero the cap is four
+		// goroutines per CPU.
+		MaxGoroutines int
+
+		// TileSize is the width and height of the tiles handed to workers. If zero
+		// every scan-line is a tile.
+		TileSize int
+
+		// Banded gives every worker a contiguous band of the image instead of
+		// interleaving tiles between them. Idle workers still steal tiles.
+		Banded bool
+
+		// PinWorkers locks every worker to its own OS thread. Goroutines are then
+		// not migrated by the Go scheduler, leaving core affinity to the OS.
+		PinWorkers bool
+
+		// FrameDeadline is how long the tiles of a frame may take before the
+		// frame is reported to Logger as a warning, with the number of tiles left
+		// and workers running. Zero disables the report.
+		FrameDeadline time.Duration
+
+		// Logger receives a summary of every frame at debug level and the
+		// FrameDeadline warnings. pack.NopLogger is used if nil.
+		Logger pack.Logger
+
+		// HighPrecision runs ray setup and traversal in float64. This removes
+		// banding artifacts when the tree is placed far from the origin but
+		// disables Packets.
+		HighPrecision bool
+
+		// Traversal selects how rays find the nodes they hit, Recursive is the
+		// default. Marching disables Packets and is ignored with HighPrecision.
+		Traversal Traversal
+
+		// Shader computes the color of every pixel. If nil the node colors are
+		// used directly.
+		Shader Shader
+
+		// SurfaceShader replaces Shader when set. It disables Packets.
+		SurfaceShader SurfaceShader
+
+		// DoubleBuffer alternates between the two images also when Jitter is
+		// disabled, so one image can be read while the next frame renders to the
+		// other. Without it only the first image is used.
+		DoubleBuffer bool
+
+		// Projection maps pixels to rays, Perspective is the default. Panorama
+		// disables Packets.
+		Projection Projection
+
+		// Images are upright and not mirrored: the up vector of the camera
+		// points to the top of the image and its right, the cross product of
+		// the view direction and up, to the right. FlipX and FlipY mirror the
+		// rays of the pixels about the vertical and horizontal axis of the view
+		// for displays and file formats that expect other conventions. Rays
+		// go through the top-left corner of their pixel, so the flipped image
+		// is shifted by a pixel against the mirrored image.
+		FlipX, FlipY bool
+
+		// Coordinates is the convention of the camera. Its position, look-at
+		// point and up direction are converted to the YUpRightHanded layout of
+		// trees, so a camera placed in the world a tree was built from sees the
+		// same image in every convention. TreePosition, TreeScale and positions
+		// reported back, like hits, stay in tree space. LookAtCamera and
+		// FreeFlightCamera have y as up, Z-up conventions need a camera that
+		// reports z as up.
+		Coordinates pack.CoordinateSystem
+
+		// Stereo is the eye separation of side-by-side stereo rendering. If not
+		// zero the left half of the image is rendered from a camera moved -Stereo/2
+		// along the right vector and the right half from +Stereo/2. The right half
+		// gets the extra column of odd widths.
+		Stereo float32
+
+		// Dither applies an ordered dither to the output of Shader before it is
+		// quantized, hiding banding in smooth gradients.
+		Dither bool
+
+		// Fog fades distant pixels into the fog color, after Shader.
+		Fog Fog
+
+		// Exposure scales the color of every pixel, after Fog. Zero leaves the
+		// colors unchanged, like one.
+		Exposure float32
+
+		// AutoExposure adjusts the exposure after every frame from the luminance
+		// of the pixels it traced, moving their median towards half brightness by
+		// ExposureRate of the difference in stops, 0.1 if zero. Exposure is the
+		// exposure of the first frame. Frames in flight when it changes pick up the
+		// new exposure for the rest of their tiles.
+		AutoExposure bool
+		ExposureRate float32
+
+		// LUT grades the final color of every pixel, after Exposure.
+		LUT *LUT
+
+		// GroundPlane draws a reflective floor below the tree. It disables
+		// Packets.
+		GroundPlane GroundPlane
+
+		// Samples is the number of rays per pixel, spread over the pixel for
+		// anti-aliasing. Zero is one ray through the pixel corner. Panoramas
+		// trace all samples through the pixel center.
+		Samples int
+
+		// AdaptiveAA gives extra samples to the pixels of a tile that differ from
+		// their neighbors, smoothing edges at a fraction of the cost of Samples.
+		// It is ignored with Samples, Accumulate, Jitter, Depth and panoramas and
+		// disables Packets.
+		AdaptiveAA AdaptiveAA
+
+		// Accumulate averages the samples of all frames since the last
+		// ResetAccumulation, so the image is refined while the camera is still.
+		// Frames do not overlap and Packets is disabled. It is ignored with
+		// Jitter.
+		Accumulate bool
+
+		// OnTileDone is called by the worker that traced a tile, as soon as the
+		// pixels inside rect of image frame are written. Tiles complete in any
+		// order and it is not called for tiles of aborted frames.
+		OnTileDone func(frame int, rect image.Rectangle)
+
+		// Checkerboard traces a full resolution frame in a single Trace, in two
+		// phases of alternating pixels. Phase zero is the pixels with an even sum
+		// of their coordinates relative to the corner of the image, phase one
+		// the others, which are not started before phase zero is written.
+		// OnTileDone is called for the tiles of both phases and OnPhaseDone
+		// when a phase is complete, so phase zero can be shown early with
+		// FillCheckerboard. It can not be used with Jitter and disables Packets
+		// and AdaptiveAA.
+		Checkerboard bool
+		OnPhaseDone  func(frame, phase int)
+
+		// CostImage receives a false color of the number of nodes visited by
+		// every pixel, on a log scale. It has the bounds of Images and disables
+		// Packets. Nothing is counted per pixel when it is nil.
+		CostImage draw.Image
+
+		// NormalImage receives the face normal of every pixel as RGB, mapped from
+		// [-1, 1] to [0, 255], see HitInfo. Pixels that miss are transparent. It
+		// has the bounds of Images and disables Packets.
+		NormalImage draw.Image
+
+		// PickBuffer receives the index of the node hit by the first ray of every
+		// pixel, or PickMiss, at dy*width+dx of the frame buffer. It must hold at
+		// least width*height entries and disables Packets. Jittered frames fill
+		// it like full frames, pixels outside of a traced rect are left untouched.
+		PickBuffer []uint32
+
+		// Instances are more trees drawn in the frames, next to the traced tree
+		// placed by TreePosition and TreeScale. They are opaque and hide the
+		// transparent nodes of the traced tree behind them. They are drawn by the
+		// recursive traversal and ignored with HighPrecision, and are not
+		// highlighted, outlined by DebugWireframe or seen by the ground plane.
+		// They disable Packets.
+		Instances []TreeInstance
+
+		// InstanceBuffer receives the instance hit by the first ray of every
+		// pixel, zero for the traced tree and i+1 for Instances[i], or
+		// InstanceMiss. It is laid out like PickBuffer, which holds the nodes of
+		// the tree of the instance, and disables Packets.
+		InstanceBuffer []uint16
+
+		// Highlight marks a node and its subtree, by tinting or outlining it.
+		// It disables Packets when enabled.
+		Highlight Highlight
+
+		// DebugWireframe draws the edges of the nodes over the image. It disables
+		// Packets when enabled.
+		DebugWireframe DebugWireframe
+
+		// GridOverlay draws a grid on an axis plane where rays miss the tree. It
+		// disables Packets when enabled.
+		GridOverlay GridOverlay
+
+		// NodeFilter hides the nodes it returns false for, the rays continue
+		// behind them as if they were empty. It is called for the nodes where
+		// traversal ends, leafs and nodes cut by the level of detail, from
+		// several workers at once. It disables Packets and Marching when set.
+		NodeFilter func(attrs NodeAttributes) bool
+
+		// Transparency makes the alpha of node colors their opacity, trees using
+		// it to store a class code must be left Opaque. It disables Packets,
+		// Marching and AdaptiveAA and is ignored with HighPrecision.
+		Transparency TransparencyMode
+
+		// Strict makes CheckTree fail instead of turning off the features a tree
+		// can not support.
+		Strict bool
+
+		// Images are the two frame buffers. They must have the same bounds, which
+		// may have a non-zero origin like images returned by SubImage.
+		Images [2]*image.RGBA
+
+		// Target replaces Images with a single buffer owned by the caller. It can
+		// not be used with Jitter or DoubleBuffer and the raytracer can not be
+		// resized. Image returns a view of it, in the order of the buffer. Every
+		// pixel is written by a completed frame, the padding between rows never.
+		Target *PixelBuffer
 	}
 
 	Raytracer struct {
-		cfg        Config
-		frame      uint32
-		numThreads int
-		clear      color.RGBA
-		depth      [2]*image.Gray16
-		wg         [2]sync.WaitGroup
-		work       chan rtJob
+		// The counters are first to keep them 64-bit aligned for atomic access.
+		// refined and traced count the pixels given extra samples by AdaptiveAA
+		// and all pixels of its tiles.
+		nodeVisits      [2]uint64
+		refined, traced [2]uint64
+
+		// cfg.Images start at the origin. images are the same buffers with the
+		// bounds given by the caller, which are offset by origin. Red and blue
+		// are swapped when bgra is set.
+		cfg    Config
+		images [2]*image.RGBA
+		origin image.Point
+		bgra   bool
+
+		// epsilon is cfg.Epsilon with the default applied.
+		epsilon float32
+
+		// exposure holds the bits of the current exposure. exposureRect is the
+		// part of each image metered by AutoExposure.
+		exposure     uint32
+		exposureRect [2]image.Rectangle
+
+		frame   uint32
+		clear   color.RGBA
+		depth   [2]*image.Gray16
+		wg      [2]sync.WaitGroup
+		pending [2]int32
+		aborted [2]uint32
+
+		// completed is the index of the last completed frame, or -1 if its
+		// image is being written again.
+		completed int32
+
+		// done is closed when the frame of each image is done, aborted or not.
+		// latest is the image of the most recently started frame. doneLock
+		// guards both.
+		doneLock sync.Mutex
+		done     [2]chan struct{}
+		latest   int
+
+		// accum is the sum of the samples of every pixel since numSamples was
+		// reset, laid out like the images. accumFrame is the last frame that
+		// added to it.
+		accum      []float32
+		numSamples int
+		accumFrame int
+
+		queues                []tileQueue
+		jobs                  []rtJob
+		tileCount, stealCount [2][]int32
+
+		// running is set for the workers that have a goroutine, outstanding
+		// counts the goroutines.
+		running     []int32
+		outstanding int32
+
+		// started counts the frames with tiles. frameID is the number of the
+		// frame of each image and watchdog its FrameDeadline timer. frameStart
+		// and frameJobs are reported in the summary of the frame.
+		started    uint32
+		frameID    [2]uint32
+		watchdog   [2]*time.Timer
+		frameStart [2]time.Time
+		frameJobs  [2]int
+
+		// phaseJobs are the tiles of the second phase of Checkerboard frames,
+		// scheduled when phasePending drops to zero. phaseTimes are the times
+		// of both phases, measured from phaseStart.
+		phaseJobs    [2][]rtJob
+		phasePending [2]int32
+		phaseStart   [2]time.Time
+		phaseTimes   [2][2]time.Duration
+
+		// traceLock serializes TraceRect and Resize so frames are not started
+		// while they wait for them. It also guards the images.
+		traceLock sync.Mutex
+		selected  selectionKey
+
+		// snapshot is the tree of SetTree and SetSnapshot, read once by every
+		// frame. frameTrees hold the references of the frames rendering it,
+		// dropped by frameDone.
+		snapshot   atomic.Pointer[TreeSnapshot]
+		frameTrees [2]*TreeSnapshot
 	}
 )
 
 var (
 	InvalidSizeError    = errors.New("invalid size")
 	Uint28OverflowError = errors.New("uint28 overflow")
+	OutOfBoundsError    = errors.New("position out of bounds")
+	InvalidTreeError    = errors.New("nodes without colors or children out of range")
+
+	InvalidFieldOfViewError = errors.New("invalid field of view")
+	FrameAbortedError       = errors.New("frame aborted")
+	InvalidCameraError      = errors.New("camera is not finite")
+
+	MissingImageError     = errors.New("image is nil")
+	MismatchedImagesError = errors.New("images have different bounds")
+	InvalidTargetError    = errors.New("invalid pixel buffer")
+	TargetFramesError     = errors.New("pixel buffer holds a single frame")
+	CheckerboardError     = errors.New("checkerboard can not be used with jitter")
+	InvalidFogError       = errors.New("invalid fog distances")
+
+	InvalidGroundPlaneError  = errors.New("ground plane reflectivity is not within [0, 1]")
+	InvalidNearError         = errors.New("near distance is not within [0, ViewDist)")
+	InvalidEpsilonError      = errors.New("epsilon is not below one")
+	InvalidHighlightError    = errors.New("invalid highlight mode")
+	InvalidWireframeError    = errors.New("wireframe depth is negative")
+	InvalidGridError         = errors.New("grid spacing is not positive or plane is unknown")
+	InvalidCoordinatesError  = errors.New("unknown coordinate system")
+	InvalidExposureError     = errors.New("invalid exposure")
+	InvalidLODBiasError      = errors.New("level of detail bias is negative")
+	InvalidTransparencyError = errors.New("unknown transparency mode")
+	CyclicTreeError          = errors.New("node is its own ancestor")
+	InvalidPatchError        = errors.New("patch does not fit the tree")
+	InvalidInstanceError     = errors.New("instance scale is not positive or position is not finite")
 )
 
+// ErrInvalidConfig is returned when a field of Config can not be used, by
+// Validate and by the setters of the field. Reason is one of the errors above,
+// errors.Is finds it through the ErrInvalidConfig.
+type ErrInvalidConfig struct {
+	Field  string
+	Reason error
+}
+
+func (e *ErrInvalidConfig) Error() string {
+	return e.Field + ": " + e.Reason.Error()
+}
+
+func (e *ErrInvalidConfig) Unwrap() error {
+	return e.Reason
+}
+
+// invalidConfig returns an ErrInvalidConfig for field if err is not nil.
+func invalidConfig(field string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ErrInvalidConfig{field, err}
+}
+
+// ExitInvalidConfig is the exit code of command line tools for an
+// ErrInvalidConfig, following those of pack.ExitCode.
+const ExitInvalidConfig = pack.ExitWorkerFailed + 1
+
+// ExitCode works like pack.ExitCode and also gives invalid configurations a code
+// of their own.
+func ExitCode(err error) int {
+	var invalid *ErrInvalidConfig
+	if errors.As(err, &invalid) {
+		return ExitInvalidConfig
+	}
+	return pack.ExitCode(err)
+}
+
+// checkImages verifies that both frame buffers exist and are interchangeable.
+func checkImages(images [2]*image.RGBA) error {
+	if images[0] == nil || images[1] == nil {
+		return invalidConfig("Images", MissingImageError)
+	}
+	if images[0].Rect != images[1].Rect {
+		return invalidConfig("Images", MismatchedImagesError)
+	}
+	return nil
+}
+
+// rebaseRGBA returns img with its bounds moved to the origin. The pixels are shared.
+func rebaseRGBA(img *image.RGBA) *image.RGBA {
+	if img.Rect.Min == image.ZP {
+		return img
+	}
+	return &image.RGBA{Pix: img.Pix, Stride: img.Stride, Rect: image.Rectangle{Max: img.Rect.Size()}}
+}
+
 type (
 	infiniteRay [2]vec3.T
 	octreeNode  [8]uint32
@@ -81,13 +479,37 @@ type (
 		camera   Camera
 		tree     Octree
 		maxDepth float32
+		rect     image.Rectangle
+
+		// masks are the child masks of the nodes of tree, stored by its snapshot.
+		// Nil if they are read from the nodes, see nodeMask.
+		masks []uint8
+
+		// instances are Config.Instances, placed for the frame.
+		instances []placedTree
+
+		// view is the part of the image the camera projects onto. If empty the
+		// whole image is used.
+		view image.Rectangle
 
 		from, to, idx int
+
+		// sample is the index of the first sample of the frame and samples the
+		// number of samples per pixel. With accumulate the samples are added to
+		// the accumulation buffer.
+		sample, samples int
+		accumulate      bool
+
+		// selection is the highlighted node, nil if nothing is highlighted.
+		selection *selection
+
+		// phase is the Checkerboard phase traced by the job.
+		phase int
 	}
 )
 
 func (n *octreeNode) setColor(color *pack.Color) error {
-	colors := [4]uint8{uint8(color.R * 255), uint8(color.G * 255), uint8(color.B * 255), 0}
+	colors := [4]uint8{uint8(color.R * 255), uint8(color.G * 255), uint8(color.B * 255), uint8(color.A*255 + 0.5)}
 
 	for i, child := range n {
 		if child > maxUint28 {
@@ -107,6 +529,26 @@ func (n *octreeNode) setColor(color *pack.Color) error {
 	return nil
 }
 
+// setNode stores a decoded node. Nodes in memory have 28-bit child indices, wider
+// indices fail with Uint28OverflowError.
+func (n *octreeNode) setNode(color *pack.Color, children []pack.NodeIndex) error {
+	for i, child := range children {
+		if child > maxUint28 {
+			return Uint28OverflowError
+		}
+		n[i] = uint32(child)
+	}
+	return n.setColor(color)
+}
+
+// checkNumNodes fails trees with more nodes than 28-bit indices can address.
+func checkNumNodes(header *pack.OctreeHeader) error {
+	if header.NumNodes > maxUint28+1 {
+		return Uint28OverflowError
+	}
+	return nil
+}
+
 func (n *octreeNode) getColor() color.RGBA {
 	return color.RGBA{
 		R: uint8(n[0]>>24 | n[1]>>28),
@@ -116,10 +558,65 @@ func (n *octreeNode) getColor() color.RGBA {
 	}
 }
 
+// getClass returns the alpha byte of the stored color, see NodeAttributes.Class.
+func (n *octreeNode) getClass() uint8 {
+	return uint8(n[6]>>24 | n[7]>>28)
+}
+
 func (n *octreeNode) getChild(i int) uint32 {
 	return n[i] & 0xFFFFFFF
 }
 
+// leaf reports if the node is a leaf. Trees in memory have no node flags, the
+// leaf flag of the file is applied when the node is decoded and leafs keep
+// no child indices. See pack.NodeLeaf.
+func (n *octreeNode) leaf() bool {
+	return (n[0]|n[1]|n[2]|n[3]|n[4]|n[5]|n[6]|n[7])&maxUint28 == 0
+}
+
+// childMask returns a mask with bit i set if child i exists.
+func (n *octreeNode) childMask() uint8 {
+	var mask uint8
+	for i := range n {
+		if n[i]&0xFFFFFFF != 0 {
+			mask |= 1 << uint(i)
+		}
+	}
+	return mask
+}
+
+// childMasks returns the child mask of every node of tree, so the traversal reads
+// one byte of a node instead of its eight child indices.
+func childMasks(tree Octree) []uint8 {
+	masks := make([]uint8, len(tree))
+	for i := range tree {
+		masks[i] = tree[i].childMask()
+	}
+	return masks
+}
+
+// nodeMask returns the child mask of node i, from masks if the tree has them.
+// Leafs have no children.
+func nodeMask(tree []octreeNode, masks []uint8, i uint32) uint8 {
+	if masks != nil {
+		return masks[i]
+	}
+	return tree[i].childMask()
+}
+
+// childOrder returns the mask to xor child indices with to visit them front to
+// back along a ray with direction. Axis bits are set for negative directions,
+// so the far half of an axis always comes after the near half.
+func childOrder(direction *vec3.T) int {
+	var order int
+	for axis := 0; axis < 3; axis++ {
+		if direction[axis] < 0 {
+			order |= 1 << uint(axis)
+		}
+	}
+	return order
+}
+
 type LookAtCamera struct {
 	Pos  Vec3
 	Look Vec3
@@ -206,31 +703,141 @@ func TreeWidthToDepth(width int) int {
 	return d
 }
 
+// TreeInfo holds the header information of a loaded tree. Trees always cover the
+// unit cube in tree space, use TreeScale and TreePosition to place them.
+type TreeInfo struct {
+	Format        pack.OctreeFormat
+	NumNodes      uint64
+	NumLeafs      uint64
+	VoxelsPerAxis int
+	Depth         int
+	Optimized     bool
+	Coverage      bool
+
+	// Coordinates is the convention the tree was built from. Set it as the
+	// Coordinates of Config to place cameras in that convention.
+	Coordinates pack.CoordinateSystem
+
+	// Bounds is the world box the tree was built from. It is zero for trees
+	// written before the header stored it. See Config.FitTree.
+	Bounds pack.Box
+
+	// GeoReference places the world coordinates in a real world coordinate
+	// reference system, nil if the tree has none. See TreeToWorld.
+	GeoReference *pack.GeoReference
+}
+
+// LoadOctree reads one tree and leaves reader at the first byte after it, so trees
+// stored back to back are loaded by calling it again. See pack.SkipTree.
 func LoadOctree(reader io.Reader) (Octree, int, error) {
+	tree, info, err := LoadOctreeWithInfo(reader)
+	if err != nil {
+		return nil, 0, err
+	}
+	return tree, info.VoxelsPerAxis, nil
+}
+
+// LoadOctreeOptions changes how LoadOctreeWithOptions reads a tree.
+type LoadOctreeOptions struct {
+	// SkipChecksum loads checksummed trees without verifying them. The trailer is
+	// still skipped.
+	SkipChecksum bool
+
+	// MaxNodes fails trees with more nodes with a NodeCountError before they are
+	// allocated. If it is zero trees may have the 2^28 nodes 28-bit child indices
+	// can address.
+	MaxNodes uint64
+}
+
+// LoadOctreeWithInfo works like LoadOctree and also returns the header information.
+// Checksummed trees are verified, a *pack.ErrChecksumMismatch is returned if they
+// are damaged.
+func LoadOctreeWithInfo(reader io.Reader) (Octree, *TreeInfo, error) {
+	return LoadOctreeWithOptions(reader, LoadOctreeOptions{})
+}
+
+// LoadOctreeWithOptions works like LoadOctreeWithInfo with the given options.
+func LoadOctreeWithOptions(reader io.Reader, opts LoadOctreeOptions) (Octree, *TreeInfo, error) {
 	var (
 		color  pack.Color
 		header pack.OctreeHeader
 	)
 
 	if err := pack.DecodeHeader(reader, &header); err != nil {
-		return nil, 0, err
+		return nil, nil, err
+	}
+
+	if err := checkNumNodes(&header); err != nil {
+		return nil, nil, err
+	}
+
+	if opts.MaxNodes > 0 && header.NumNodes > opts.MaxNodes {
+		return nil, nil, &NodeCountError{header.NumNodes, opts.MaxNodes, false}
+	}
+
+	palette, err := pack.DecodePalette(reader, &header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	capacity, err := nodeCapacity(&header, reader)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	data := make([]octreeNode, header.NumNodes)
-	for i := range data {
-		n := &data[i]
-		if err := pack.DecodeNode(reader, header.Format, &color, n[:]); err != nil {
-			return nil, 0, err
+	var checked *pack.ChecksumReader
+	if header.Checksummed() {
+		checked = pack.NewChecksumReader(reader, !opts.SkipChecksum)
+		reader = checked
+	}
+
+	var (
+		node     octreeNode
+		children [8]pack.NodeIndex
+	)
+
+	decoder := pack.NewNodeDecoder(reader, header.Format, palette)
+	data := make([]octreeNode, 0, capacity)
+	for i := uint64(0); i < header.NumNodes; i++ {
+		if err := decoder.Decode(&color, children[:]); err != nil {
+			return nil, nil, err
 		}
-		if err := n.setColor(&color); err != nil {
-			return nil, 0, err
+		if err := node.setNode(&color, children[:]); err != nil {
+			return nil, nil, err
 		}
+		data = append(data, node)
 	}
 
-	return data, int(header.VoxelsPerAxis), nil
+	if checked != nil {
+		if err := checked.ReadTrailer(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return data, newTreeInfo(&header), nil
+}
+
+func newTreeInfo(header *pack.OctreeHeader) *TreeInfo {
+	return &TreeInfo{
+		Format:        header.Format,
+		NumNodes:      header.NumNodes,
+		NumLeafs:      header.NumLeafs,
+		VoxelsPerAxis: int(header.VoxelsPerAxis),
+		Depth:         TreeWidthToDepth(int(header.VoxelsPerAxis)),
+		Optimized:     header.Optimized(),
+		Coverage:      header.Coverage(),
+		Coordinates:   header.Coordinates,
+		Bounds:        header.Bounds,
+		GeoReference:  header.GeoReference,
+	}
 }
 
 func Reconstruct(a, b image.Image, out draw.Image) error {
+	return ReconstructRect(a, b, out, a.Bounds())
+}
+
+// ReconstructRect works like Reconstruct but only writes the pixels of rect, given
+// in the coordinates of the input images.
+func ReconstructRect(a, b image.Image, out draw.Image, rect image.Rectangle) error {
 	outputSize := out.Bounds().Max
 	inputSize := a.Bounds().Max
 
@@ -242,9 +849,10 @@ func Reconstruct(a, b image.Image, out draw.Image) error {
 		return InvalidSizeError
 	}
 
+	rect = rect.Intersect(a.Bounds())
 	img := [2]image.Image{a, b}
-	for y := 0; y < inputSize.Y; y++ {
-		for x := 0; x < inputSize.X; x++ {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
 			left, right := img[y%2], img[(y+1)%2]
 			out.Set(x*2, y, left.At(x, y))
 			out.Set(x*2+1, y, right.At(x, y))
@@ -254,7 +862,21 @@ func Reconstruct(a, b image.Image, out draw.Image) error {
 	return nil
 }
 
-func intersectBox(ray *infiniteRay, lenght float32, box *vec3.Box) float32 {
+// intersectBox returns the distance to box along ray, or lenght if it is missed or
+// further away. Boxes that the ray leaves at most eps before entering are hit.
+func intersectBox(ray *infiniteRay, lenght float32, box *vec3.Box, eps float32) float32 {
+	start, final := boxRange(ray, box)
+	dist := float32(start)
+	if final+float64(eps) > start && dist < lenght {
+		return dist
+	}
+	return lenght
+}
+
+// boxRange returns the distances along ray where it enters and leaves box. The
+// start is not before the origin of the ray. The box is missed if final is not
+// beyond start.
+func boxRange(ray *infiniteRay, box *vec3.Box) (float64, float64) {
 	origin := ray[0]
 	direction := ray[1]
 
@@ -274,83 +896,219 @@ func intersectBox(ray *infiniteRay, lenght float32, box *vec3.Box) float32 {
 
 	final := math.Min(float64(mMax[0]), math.Min(float64(mMax[1]), float64(mMax[2])))
 	start := math.Max(math.Max(float64(mMin[0]), 0.0), math.Max(float64(mMin[1]), float64(mMin[2])))
-
-	dist := float32(math.Min(final, start))
-	if final > start && dist < lenght {
-		return dist
-	}
-	return lenght
-}
-
-var childPositions = []vec3.T{
-	vec3.T{0, 0, 0}, vec3.T{1, 0, 0}, vec3.T{0, 1, 0}, vec3.T{1, 1, 0},
-	vec3.T{0, 0, 1}, vec3.T{1, 0, 1}, vec3.T{0, 1, 1}, vec3.T{1, 1, 1},
+	return start, final
 }
 
-func (rt *Raytracer) intersectTree(tree []octreeNode, ray *infiniteRay, nodePos *vec3.T, nodeScale, length, maxDepth float32, nodeIndex, treeDepth uint32) (float32, color.RGBA) {
+// childPositions is pack.ChildPositions as vectors.
+var childPositions = func() []vec3.T {
+	positions := make([]vec3.T, len(pack.ChildPositions))
+	for i, p := range pack.ChildPositions {
+		positions[i] = vec3.T{float32(p[0]), float32(p[1]), float32(p[2])}
+	}
+	return positions
+}()
+
+// intersectTree returns the distance to the closest node hit by ray together with the
+// index and depth of that node. The last value is false if nothing was hit. Children
+// are visited front to back, so the first child hit is the closest. Visited nodes
+// are added to visits.
+func (rt *Raytracer) intersectTree(tree []octreeNode, masks []uint8, ray *infiniteRay, nodePos *vec3.T, nodeScale, length, maxDepth float32, nodeIndex, treeDepth uint32, visits *uint64) (float32, uint32, uint32, bool) {
 	var (
-		color = rt.clear
-		node  = tree[nodeIndex]
+		node = &tree[nodeIndex]
 
 		// Declare this here to avoid runtime allocation.
 		pos vec3.T
 	)
 
+	*visits++
+
 	box := vec3.Box{*nodePos, vec3.T{nodePos[0] + nodeScale, nodePos[1] + nodeScale, nodePos[2] + nodeScale}}
-	boxDist := intersectBox(ray, length, &box)
+	boxDist := intersectBox(ray, length, &box, rt.epsilon*nodeScale)
 
 	if boxDist == length {
-		return length, color
+		return length, 0, 0, false
 	}
 
 	{
 		d := (boxDist / rt.cfg.ViewDist)
 		if treeDepth > uint32(maxDepth*(1-d*d)) {
-			return boxDist, node.getColor()
+			return boxDist, nodeIndex, treeDepth, true
 		}
 	}
 
-	numChild := 0
+	mask := nodeMask(tree, masks, nodeIndex)
+	if mask == 0 {
+		return boxDist, nodeIndex, treeDepth, true
+	}
+
 	childScale := nodeScale * 0.5
 	childDepth := treeDepth + 1
+	order := childOrder(&ray[1])
 
-	for i := range node {
-		childIndex := node.getChild(i)
+	for k := 0; k < 8; k++ {
+		i := k ^ order
+		if mask&(1<<uint(i)) == 0 {
+			continue
+		}
 
-		if childIndex != 0 {
-			numChild++
-			scaled := childPositions[i].Scaled(childScale)
-			pos = vec3.Add(nodePos, &scaled)
+		scaled := childPositions[i].Scaled(childScale)
+		pos = vec3.Add(nodePos, &scaled)
 
-			if ln, col := rt.intersectTree(tree, ray, &pos, childScale, length, maxDepth, childIndex, childDepth); ln < length {
-				length = ln
-				color = col
-			}
+		if ln, idx, depth, ok := rt.intersectTree(tree, masks, ray, &pos, childScale, length, maxDepth, node.getChild(i), childDepth, visits); ok && ln < length {
+			return ln, idx, depth, true
 		}
 	}
+	return length, 0, 0, false
+}
 
-	if numChild == 0 {
-		return boxDist, node.getColor()
+func (rt *Raytracer) nodeColor(tree []octreeNode, index uint32, hit bool) color.RGBA {
+	if hit {
+		return tree[index].getColor()
 	}
+	return rt.clear
+}
 
-	return length, color
+// Validate checks that the field of view is within (0, 180) degrees, that fog
+// starts before it ends, that the ground plane reflectivity is within [0, 1], that
+// the epsilon is below one, that the pick and instance buffers cover the images
+// and that the instances are placed. The field of view is not used by panoramas.
+// Failures are returned as an *ErrInvalidConfig.
+func (cfg *Config) Validate() error {
+	if err := cfg.Fog.validate(); err != nil {
+		return invalidConfig("Fog", err)
+	}
+	if err := cfg.GroundPlane.validate(); err != nil {
+		return invalidConfig("GroundPlane", err)
+	}
+	if err := cfg.validatePickBuffer(); err != nil {
+		return invalidConfig("PickBuffer", err)
+	}
+	if err := cfg.validateInstanceBuffer(); err != nil {
+		return invalidConfig("InstanceBuffer", err)
+	}
+	if err := cfg.validateInstances(); err != nil {
+		return invalidConfig("Instances", err)
+	}
+	if cfg.Near != 0 && !(cfg.Near > 0 && cfg.Near < cfg.ViewDist) {
+		return invalidConfig("Near", InvalidNearError)
+	}
+	if !(cfg.Epsilon < 1) {
+		return invalidConfig("Epsilon", InvalidEpsilonError)
+	}
+	if !(cfg.LODBias >= 0) || math.IsInf(float64(cfg.LODBias), 0) {
+		return invalidConfig("LODBias", InvalidLODBiasError)
+	}
+	if cfg.Transparency < Opaque || cfg.Transparency > Stochastic {
+		return invalidConfig("Transparency", InvalidTransparencyError)
+	}
+	if cfg.Checkerboard && cfg.Jitter {
+		return invalidConfig("Checkerboard", CheckerboardError)
+	}
+	if cfg.Coordinates > pack.ZUpLeftHanded {
+		return invalidConfig("Coordinates", InvalidCoordinatesError)
+	}
+	if err := cfg.Highlight.validate(); err != nil {
+		return invalidConfig("Highlight", err)
+	}
+	if err := cfg.DebugWireframe.validate(); err != nil {
+		return invalidConfig("DebugWireframe", err)
+	}
+	if err := cfg.GridOverlay.validate(); err != nil {
+		return invalidConfig("GridOverlay", err)
+	}
+	if err := cfg.validateExposure(); err != nil {
+		return invalidConfig("Exposure", err)
+	}
+	if cfg.Projection == Panorama {
+		return nil
+	}
+	if fov := cfg.fieldOfView(); !(fov > 0 && fov < math.Pi) {
+		return invalidConfig("FieldOfView", InvalidFieldOfViewError)
+	}
+	return cfg.validateTarget()
 }
 
-func (rt *Raytracer) calcIncVectors(camera Camera, size image.Point) (vec3.T, vec3.T, vec3.T) {
-	width := float32(size.X)
-	height := float32(size.Y)
+func (cfg *Config) validateTarget() error {
+	if cfg.Target == nil {
+		return nil
+	}
+	if cfg.Jitter || cfg.DoubleBuffer {
+		return invalidConfig("Target", TargetFramesError)
+	}
+	return invalidConfig("Target", cfg.Target.validate())
+}
+
+// logger returns Logger, or pack.NopLogger if it is nil.
+func (cfg *Config) logger() pack.Logger {
+	return pack.LoggerOrNop(cfg.Logger)
+}
 
+func (cfg *Config) fieldOfView() float32 {
+	if cfg.FieldOfViewDegrees != 0 {
+		return cfg.FieldOfViewDegrees * (math.Pi / 180)
+	}
+	return cfg.FieldOfView
+}
+
+// cameraBasis returns the normalized view direction and the right and up vectors of
+// the view plane. A safe basis is substituted if the camera is degenerate.
+func cameraBasis(camera Camera) (vec3.T, vec3.T, vec3.T) {
 	lookAtPoint := vec3.T(camera.LookAt())
 	eyePoint := vec3.T(camera.Position())
 	up := vec3.T(camera.Up())
 
 	viewDirection := vec3.Sub(&lookAtPoint, &eyePoint)
+	if viewDirection.LengthSqr() < 1e-12 {
+		viewDirection = vec3.T{0, 0, -1}
+	}
+	viewDirection.Normalize()
+
 	u := vec3.Cross(&viewDirection, &up)
+	if u.LengthSqr() < 1e-12 {
+		// Up is zero or parallel to the view direction, use the axis that is
+		// closest to perpendicular instead.
+		axis := 0
+		for i := 1; i < 3; i++ {
+			if math.Abs(float64(viewDirection[i])) < math.Abs(float64(viewDirection[axis])) {
+				axis = i
+			}
+		}
+
+		up = vec3.T{}
+		up[axis] = 1
+		u = vec3.Cross(&viewDirection, &up)
+	}
+
 	v := vec3.Cross(&u, &viewDirection)
 	u.Normalize()
 	v.Normalize()
+	return viewDirection, u, v
+}
 
-	viewPlaneHalfWidth := float32(math.Tan(float64(rt.cfg.FieldOfView / 2)))
+// flippedBasis returns the camera basis with the right and up vectors of the view
+// plane negated by FlipX and FlipY.
+func (cfg *Config) flippedBasis(camera Camera) (vec3.T, vec3.T, vec3.T) {
+	viewDirection, u, v := cameraBasis(camera)
+	if cfg.FlipX {
+		u = u.Scaled(-1)
+	}
+	if cfg.FlipY {
+		v = v.Scaled(-1)
+	}
+	return viewDirection, u, v
+}
+
+func (rt *Raytracer) calcIncVectors(camera Camera, size image.Point) (vec3.T, vec3.T, vec3.T) {
+	width := float32(size.X)
+	height := float32(size.Y)
+
+	// The view plane is placed at unit distance from the eye so the field of view
+	// does not depend on the distance to the look-at point.
+	eyePoint := vec3.T(camera.Position())
+	viewDirection, u, v := rt.cfg.flippedBasis(camera)
+	lookAtPoint := vec3.Add(&eyePoint, &viewDirection)
+
+	viewPlaneHalfWidth := float32(math.Tan(float64(rt.cfg.fieldOfView() / 2)))
 	aspectRatio := height / width
 	viewPlaneHalfHeight := aspectRatio * viewPlaneHalfWidth
 
@@ -374,6 +1132,28 @@ func (rt *Raytracer) calcIncVectors(camera Camera, size image.Point) (vec3.T, ve
 	return xIncVector, yIncVector, viewPlaneBottomLeftPoint
 }
 
+// scanRow returns the image row of scan-line h in an image height rows high.
+// Scan-lines count from the bottom, scan-line h runs along the top edge of row
+// height-1-h, so every row has one. The mapping is its own inverse, scanRow(dy,
+// height) is the scan-line of row dy.
+func scanRow(h, height int) int {
+	return height - 1 - h
+}
+
+// scanPixel returns the image pixel that scan column w of scan-line h is written
+// to, with cols scan columns to a pixel. Jittered and plain frames address the
+// same pixels.
+func scanPixel(w, h, cols, height int) image.Point {
+	return image.Point{w / cols, scanRow(h, height)}
+}
+
+// jitterPhase returns the scan column, zero or one, that jittered frame idx traces
+// first on image row dy. Reconstruct puts frame y%2 in the even columns of row y,
+// so the phase follows the image row.
+func jitterPhase(dy, idx int) int {
+	return (dy + idx) % 2
+}
+
 func (rt *Raytracer) traceScanLines(job *rtJob) {
 	cfg := &rt.cfg
 	idx := job.idx
@@ -385,60 +1165,390 @@ func (rt *Raytracer) traceScanLines(job *rtJob) {
 	nodeScale := cfg.TreeScale
 	nodePos := vec3.T(cfg.TreePosition)
 	viewDist := cfg.ViewDist
+	near := cfg.Near
 
-	jitter, step := 0, 1
+	// Scan column w is traced into image column w/cols. Jittered frames trace
+	// every other scan column of an image twice as wide, checkerboard phases
+	// every other image column.
+	jitter, step, cols := 0, 1, 1
 	if cfg.Jitter {
 		jitter = 1
-		step = 2
+		step, cols = 2, 2
 		size.X *= 2
+	} else if cfg.Checkerboard {
+		step = 2
 	}
 
-	xInc, yInc, bottomLeft := rt.calcIncVectors(job.camera, size)
-	eyePoint := vec3.T(job.camera.Position())
-
 	var (
-		col  color.RGBA
-		dist float32
+		scan        scanSetup
+		preciseScan preciseScan
+		precisePos  vec3d
+		panoScan    panoramaScan
 	)
 
-	for h := job.from; h < job.to; h++ {
-		start := ((h + idx) % 2) * jitter
+	// Columns are offset so the view starts at scan column zero, lines by one so
+	// scan-line h runs along the top edge of its row, see scanRow.
+	viewSize, viewX := size, 0
+	if !job.view.Empty() {
+		viewSize.X = job.view.Dx() * cols
+		viewX = job.view.Min.X * cols
+	}
 
-		for w := start; w < size.X; w += step {
-			x := xInc.Scaled(float32(w))
-			y := yInc.Scaled(float32(h))
+	panorama := cfg.Projection == Panorama
+	if panorama {
+		panoScan = panoramaScanSetup(job.camera, viewSize, viewX)
+		panoScan.flip(cfg.FlipX, cfg.FlipY)
+		precisePos = toVec3d(cfg.TreePosition)
+	} else if cfg.HighPrecision {
+		preciseScan = rt.preciseScanSetup(job.camera, viewSize)
+		precisePos = toVec3d(cfg.TreePosition)
+		for i := range preciseScan.bottomLeft {
+			preciseScan.bottomLeft[i] += preciseScan.yInc[i] - preciseScan.xInc[i]*float64(viewX)
+		}
+	} else {
+		xInc, yInc, bottomLeft := rt.calcIncVectors(job.camera, viewSize)
+		offset := xInc.Scaled(float32(viewX))
+		bottomLeft = vec3.Sub(&bottomLeft, &offset)
+		bottomLeft = vec3.Add(&bottomLeft, &yInc)
+		scan = scanSetup{xInc, yInc, bottomLeft, vec3.T(job.camera.Position())}
+	}
 
-			x = vec3.Add(&x, &y)
-			viewPlanePoint := vec3.Add(&bottomLeft, &x)
+	var visits uint64
+	defer func() {
+		atomic.AddUint64(&rt.nodeVisits[idx], visits)
+	}()
+
+	noTree := len(job.tree) == 0
+	empty := noTree && len(job.instances) == 0
+	multi := job.samples > 1 || job.accumulate
+	costImage := cfg.CostImage
+	normals := cfg.NormalImage
+	surface := normals != nil || cfg.SurfaceShader != nil
+	pick := cfg.PickBuffer
+	instances := cfg.InstanceBuffer
+	ground := cfg.GroundPlane.Enabled
+	transparent := cfg.Transparency != Opaque && !cfg.HighPrecision
+	adaptive := cfg.AdaptiveAA.enabled(cfg) && !multi && !transparent
+	sel := job.selection
+	wire := cfg.DebugWireframe.Enabled
+	grid := cfg.GridOverlay.Enabled
+	if cfg.Packets && !cfg.Checkerboard && cfg.Traversal == Recursive && !cfg.HighPrecision && !panorama && !empty && !multi && costImage == nil && normals == nil && cfg.SurfaceShader == nil && pick == nil && instances == nil && len(job.instances) == 0 && !ground && !adaptive && near == 0 && sel == nil && cfg.NodeFilter == nil && !wire && !grid && !transparent {
+		rt.tracePackets(job, &scan, size, jitter, step, &visits)
+		return
+	}
 
-			dir := vec3.Sub(&viewPlanePoint, &eyePoint)
-			dir.Normalize()
+	intersect := rt.intersector()
+	opaque := intersect
 
-			ray := infiniteRay{eyePoint, dir}
-			dx, dy := w/step, size.Y-h
+	// Rays through transparent nodes keep their state in tr, it is reset for
+	// every sample.
+	var tr transparentRay
+	if transparent {
+		intersect = func(tree []octreeNode, masks []uint8, ray *infiniteRay, nodePos *vec3.T, nodeScale, length, maxDepth float32, nodeIndex, treeDepth uint32, visits *uint64) (float32, uint32, uint32, bool) {
+			tr.restart()
+			return rt.intersectTransparent(tree, masks, ray, nodePos, nodeScale, length, maxDepth, nodeIndex, treeDepth, visits, &tr)
+		}
+	}
 
-			if testDepth {
-				max := (float32(depth.Gray16At(dx, dy).Y) / math.MaxUint16) * viewDist
-				dist, col = rt.intersectTree(job.tree, &ray, &nodePos, nodeScale, max, job.maxDepth, 0, 0)
-				d := color.Gray16{uint16(math.MaxUint16 * (dist / viewDist))}
-				depth.SetGray16(dx, dy, d)
+	// traceRay traces the ray at offset ox, oy from the corner of pixel w, h. The
+	// returned ray starts at the near distance, the distance is from the eye. The
+	// index and depth of the node hit are returned with it, and the instance of
+	// its tree.
+	traceRay := func(w, h int, ox, oy, max float32) (infiniteRay, float32, uint32, uint32, uint16, bool) {
+		var (
+			ray          infiniteRay
+			dist         = viewDist
+			index, level uint32
+			instance     = InstanceMiss
+			hit          bool
+		)
+
+		if max < near {
+			max = near
+		}
+
+		if cfg.HighPrecision {
+			var precise preciseRay
+			if panorama {
+				precise = panoScan.preciseRay(w, h)
 			} else {
-				_, col = rt.intersectTree(job.tree, &ray, &nodePos, nodeScale, viewDist, job.maxDepth, 0, 0)
+				precise = preciseScan.rayAt(float64(w)+float64(ox), float64(h)+float64(oy))
+			}
+			for i := range precise[0] {
+				precise[0][i] += precise[1][i] * float64(near)
+			}
+
+			if !noTree {
+				var ln float64
+				ln, index, level, hit = rt.intersectTreePrecise(job.tree, job.masks, &precise, &precisePos, float64(nodeScale), float64(max-near), job.maxDepth, 0, 0, &visits)
+				dist = float32(ln) + near
+			}
+			if hit {
+				instance = 0
+			}
+			return precise.infinite(), dist, index, level, instance, hit
+		}
+
+		if panorama {
+			ray = panoScan.ray(w, h)
+		} else {
+			ray = scan.rayAt(float32(w)+ox, float32(h)+oy)
+		}
+		for i := range ray[0] {
+			ray[0][i] += ray[1][i] * near
+		}
+
+		if !noTree {
+			if cfg.Traversal == Marching && cfg.NodeFilter == nil && !transparent {
+				dist, index, level, hit = rt.marchTree(job.tree, &ray, &nodePos, nodeScale, max-near, job.maxDepth, &visits)
+			} else {
+				dist, index, level, hit = intersect(job.tree, job.masks, &ray, &nodePos, nodeScale, max-near, job.maxDepth, 0, 0, &visits)
+			}
+			dist += near
+			if hit {
+				instance = 0
 			}
-			img.SetRGBA(dx, dy, col)
 		}
+
+		// The instances are traced to the nearest hit so far.
+		for i := range job.instances {
+			inst := &job.instances[i]
+			if len(inst.tree) == 0 {
+				continue
+			}
+
+			length := max - near
+			if hit {
+				length = dist - near
+			}
+			if ln, idx, depth, ok := opaque(inst.tree, inst.masks, &ray, &inst.pos, inst.scale, length, inst.maxDepth, 0, 0, &visits); ok && ln < length {
+				dist, index, level, instance, hit = ln+near, idx, depth, uint16(i+1), true
+			}
+		}
+
+		// Transparent nodes behind an instance are hidden by it.
+		if instance > 0 {
+			for n := len(tr.layers); n > 0 && tr.layers[n-1].dist+near >= dist; n-- {
+				tr.layers = tr.layers[:n-1]
+			}
+		}
+		return ray, dist, index, level, instance, hit
+	}
+
+	// traceGround traces the ground plane along a ray returned by traceRay.
+	traceGround := func(ray *infiniteRay, max float32) (color.RGBA, float32, bool) {
+		if max <= near {
+			return color.RGBA{}, 0, false
+		}
+		c, ln, ok := rt.traceGround(job.tree, job.masks, ray, &nodePos, nodeScale, max-near, job.maxDepth, &visits)
+		return c, ln + near, ok
 	}
-}
 
-func (rt *Raytracer) workerLoop() {
-	for {
-		job, ok := <-rt.work
-		if !ok {
+	// selected reports if a node hit along a ray returned by traceRay is highlighted.
+	selected := func(ray *infiniteRay, max float32, index uint32, hit bool) bool {
+		return sel != nil && hit && rt.inSelection(job.tree, job.masks, sel, ray, max-near, job.maxDepth, index, &visits)
+	}
+
+	// onWireframe reports if a ray returned by traceRay passes a node edge before
+	// the distance of its hit.
+	pixel := rt.pixelAngle(viewSize.X)
+	onWireframe := func(ray *infiniteRay, dist float32) bool {
+		return wire && !noTree && rt.onWireframe(job.tree, ray, &nodePos, nodeScale, dist-near, pixel, 0, 0, &visits)
+	}
+
+	// onGrid reports if a ray returned by traceRay that missed the tree crosses
+	// a grid line before dist, the distance it was traced to. The ground plane
+	// does not hide the grid.
+	onGrid := func(ray *infiniteRay, dist float32, hit bool) bool {
+		return grid && !hit && rt.onGrid(ray, near, dist-near, pixel)
+	}
+
+	var mask []uint8
+	outline := sel != nil && cfg.Highlight.Mode == Outline
+	if outline {
+		mask = make([]uint8, job.rect.Dx()*job.rect.Dy())
+	}
+
+	for h := job.from; h < job.to; h++ {
+		if rt.isAborted(idx) {
 			return
 		}
 
-		rt.traceScanLines(&job)
-		rt.wg[job.idx].Done()
+		row := scanRow(h, size.Y)
+		if row < job.rect.Min.Y || row >= job.rect.Max.Y {
+			continue
+		}
+
+		start := jitterPhase(row, idx)*jitter + job.rect.Min.X*cols
+		if cfg.Checkerboard {
+			start = job.rect.Min.X + (job.rect.Min.X+row+job.phase)%2
+		}
+		for w := start; w < size.X; w += step {
+			p := scanPixel(w, h, cols, size.Y)
+			dx, dy := p.X, p.Y
+			if dx >= job.rect.Max.X {
+				break
+			}
+
+			if empty && !multi && !ground && !grid {
+				img.SetRGBA(dx, dy, rt.shade(image.Point{dx, dy}, nil, 0, viewDist, false))
+				if costImage != nil {
+					rt.writeCost(costImage, dx, dy, 0)
+				}
+				if normals != nil {
+					rt.writeNormal(normals, dx, dy, &HitInfo{})
+				}
+				if pick != nil {
+					writePick(pick, img, dx, dy, 0, false)
+				}
+				if instances != nil {
+					writeInstance(instances, img, dx, dy, 0, false)
+				}
+				continue
+			}
+
+			pixelVisits := visits
+
+			max := viewDist
+			if testDepth {
+				max = (float32(depth.Gray16At(dx, dy).Y) / math.MaxUint16) * viewDist
+			}
+
+			var sum [4]float32
+			for s := 0; s < job.samples; s++ {
+				var (
+					dist         = viewDist
+					index, level uint32
+					instance     = InstanceMiss
+					hit, onPlane bool
+
+					ox, oy float32
+					ray    infiniteRay
+				)
+
+				if multi {
+					ox, oy = sampleOffset(job.sample + s)
+				}
+				tr.reset(dx, dy, job.sample+s)
+
+				// Without a tree, ground plane or grid only the clear color is accumulated.
+				if !empty || ground || grid {
+					ray, dist, index, level, instance, hit = traceRay(w, h, ox, oy, max)
+				}
+
+				base := rt.nodeColor(job.treeOf(instance), index, hit)
+				if pick != nil && s == 0 {
+					writePick(pick, img, dx, dy, index, hit)
+				}
+				if instances != nil && s == 0 {
+					writeInstance(instances, img, dx, dy, instance, hit)
+				}
+
+				inside := selected(&ray, max, index, hit && instance == 0)
+				if outline && s == 0 {
+					mask[(dy-job.rect.Min.Y)*job.rect.Dx()+dx-job.rect.Min.X] = maskUnselected
+					if inside {
+						mask[(dy-job.rect.Min.Y)*job.rect.Dx()+dx-job.rect.Min.X] = maskSelected
+					}
+				}
+
+				missed, missDist := !hit, dist
+				if ground && !hit {
+					if c, ln, ok := traceGround(&ray, max); ok {
+						base, dist, hit, onPlane = c, ln, true, true
+					}
+				}
+
+				// The depth is that of the first sample.
+				if testDepth && s == 0 && !empty {
+					d := color.Gray16{uint16(math.MaxUint16 * (dist / viewDist))}
+					depth.SetGray16(dx, dy, d)
+				}
+
+				var c color.RGBA
+				if surface {
+					info := rt.hitInfo(&ray, dist, near, index, level, instance, base, hit, onPlane)
+					if normals != nil && s == 0 {
+						rt.writeNormal(normals, dx, dy, &info)
+					}
+					c = rt.shadeHit(image.Point{dx, dy}, &info)
+				} else {
+					c = rt.shadeColor(image.Point{dx, dy}, base, dist, hit)
+				}
+				if len(tr.layers) > 0 {
+					c = rt.composite(image.Point{dx, dy}, job.tree, &tr, near, c)
+				}
+				if inside && !outline {
+					c = rt.highlight(c)
+				}
+				if onWireframe(&ray, dist) {
+					c = rt.wireframe(c)
+				}
+				if onGrid(&ray, missDist, !missed) {
+					c = rt.grid(c)
+				}
+				if !multi {
+					img.SetRGBA(dx, dy, c)
+					break
+				}
+				addSample(&sum, c)
+			}
+
+			if multi {
+				rt.writeSamples(img, dx, dy, job, &sum)
+			}
+
+			if costImage != nil {
+				rt.writeCost(costImage, dx, dy, visits-pixelVisits)
+			}
+		}
+	}
+
+	if adaptive && !rt.isAborted(idx) {
+		rt.refineEdges(job, img, size, func(w, h, dx, dy int, ox, oy float32) color.RGBA {
+			ray, dist, index, level, instance, hit := traceRay(w, h, ox, oy, viewDist)
+			base := rt.nodeColor(job.treeOf(instance), index, hit)
+			inside := selected(&ray, viewDist, index, hit && instance == 0)
+			onPlane, missed, missDist := false, !hit, dist
+			if ground && !hit {
+				if c, ln, ok := traceGround(&ray, viewDist); ok {
+					base, dist, hit, onPlane = c, ln, true, true
+				}
+			}
+
+			var c color.RGBA
+			if surface {
+				info := rt.hitInfo(&ray, dist, near, index, level, instance, base, hit, onPlane)
+				c = rt.shadeHit(image.Point{dx, dy}, &info)
+			} else {
+				c = rt.shadeColor(image.Point{dx, dy}, base, dist, hit)
+			}
+			if inside && !outline {
+				c = rt.highlight(c)
+			}
+			if onWireframe(&ray, dist) {
+				c = rt.wireframe(c)
+			}
+			if onGrid(&ray, missDist, !missed) {
+				c = rt.grid(c)
+			}
+			return c
+		})
+	}
+
+	// The outline is drawn last, refined pixels would replace it.
+	if outline && !rt.isAborted(idx) {
+		var ox, oy float32
+		if multi {
+			ox, oy = sampleOffset(job.sample)
+		}
+
+		rt.outlineSelection(img, job.rect, mask, func(dx, dy int) bool {
+			h := scanRow(dy, size.Y)
+			w := dx*cols + jitterPhase(dy, idx)*jitter
+			ray, _, index, _, instance, hit := traceRay(w, h, ox, oy, viewDist)
+			return selected(&ray, viewDist, index, hit && instance == 0)
+		})
 	}
 }
 
@@ -446,51 +1556,338 @@ func (rt *Raytracer) wait(idx int) {
 	rt.wg[idx].Wait()
 }
 
+func (rt *Raytracer) isAborted(idx int) bool {
+	return atomic.LoadUint32(&rt.aborted[idx]) != 0
+}
+
+func finiteCamera(camera Camera) bool {
+	return finite(camera.Position()) && finite(camera.LookAt()) && finite(camera.Up())
+}
+
+func finite(v Vec3) bool {
+	for _, c := range v {
+		if math.IsNaN(float64(c)) || math.IsInf(float64(c), 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Abort stops all frames in flight. Workers stop at the next scan-line so the
+// images of aborted frames are partially rendered.
+func (rt *Raytracer) Abort() {
+	for idx := range rt.pending {
+		if atomic.LoadInt32(&rt.pending[idx]) > 0 {
+			atomic.StoreUint32(&rt.aborted[idx], frameAborted)
+		}
+	}
+}
+
+// Completed returns the index of the most recently completed frame that was not
+// aborted. The image is not written again until a later Trace reuses it, with
+// DoubleBuffer or Jitter that is the second Trace after the one that rendered it.
+// False is returned if there is no such frame.
+func (rt *Raytracer) Completed() (int, bool) {
+	idx := atomic.LoadInt32(&rt.completed)
+	return int(idx), idx >= 0
+}
+
+// Wait blocks until the frame is done. FrameAbortedError is returned if the frame
+// was aborted and InvalidCameraError if it was skipped, in both cases it should not
+// be presented.
+func (rt *Raytracer) Wait(frame int) error {
+	rt.wait(frame)
+	switch atomic.LoadUint32(&rt.aborted[frame]) {
+	case frameAborted:
+		return FrameAbortedError
+	case frameInvalid:
+		return InvalidCameraError
+	}
+	return nil
+}
+
+// TryWait returns the image of the most recently started frame and reports if
+// it and all earlier frames are done, without blocking.
+func (rt *Raytracer) TryWait() (int, bool) {
+	return rt.WaitTimeout(0)
+}
+
+// WaitTimeout works like TryWait but waits at most d for the frames in flight to
+// be done. If they are not, they can be stopped with Abort and waited for with
+// Wait, which then returns FrameAbortedError.
+func (rt *Raytracer) WaitTimeout(d time.Duration) (int, bool) {
+	rt.doneLock.Lock()
+	latest, done := rt.latest, rt.done
+	rt.doneLock.Unlock()
+
+	var timeout <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for _, ch := range done {
+		select {
+		case <-ch:
+			continue
+		default:
+		}
+
+		if timeout == nil {
+			return latest, false
+		}
+		select {
+		case <-ch:
+		case <-timeout:
+			return latest, false
+		}
+	}
+	return latest, true
+}
+
+// frameDone marks the frame of image idx as done.
+func (rt *Raytracer) frameDone(idx int) {
+	if timer := rt.watchdog[idx]; timer != nil {
+		timer.Stop()
+	}
+
+	if logger := rt.cfg.logger(); logger.Enabled(pack.LogDebug) {
+		rt.logFrame(logger, idx)
+	}
+
+	rt.frameTrees[idx].Release()
+	rt.frameTrees[idx] = nil
+
+	rt.doneLock.Lock()
+	close(rt.done[idx])
+	rt.doneLock.Unlock()
+}
+
+// SetTree sets the tree used by Trace when called without a tree, like SetSnapshot
+// with a new snapshot. The tree is swapped without waiting, frames in flight keep
+// rendering the previous tree, which must not be changed until they are done.
+func (rt *Raytracer) SetTree(tree Octree, maxDepth int) {
+	s := NewTreeSnapshot(tree, maxDepth, nil)
+	rt.SetSnapshot(s)
+	s.Release()
+}
+
+// Resize replaces the images, and depth buffers if enabled, with new images of the
+// given size. Frames in flight are completed first. The contents of the images are
+// lost. Resize must not be called while the images of a frame are being read.
+func (rt *Raytracer) Resize(width, height int) error {
+	if width <= 0 || height <= 0 {
+		return InvalidSizeError
+	}
+	if rt.cfg.Target != nil {
+		return InvalidTargetError
+	}
+
+	rt.traceLock.Lock()
+	defer rt.traceLock.Unlock()
+
+	rt.wait(0)
+	rt.wait(1)
+
+	rect := image.Rect(0, 0, width, height)
+	if rt.cfg.Images[0].Bounds() == rect {
+		return nil
+	}
+
+	rt.cfg.Images = [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}
+	rt.images, rt.origin = rt.cfg.Images, image.ZP
+	if rt.cfg.Depth {
+		rt.depth = [2]*image.Gray16{image.NewGray16(rect), image.NewGray16(rect)}
+	}
+
+	if rt.accum != nil {
+		rt.accum = make([]float32, len(rt.cfg.Images[0].Pix))
+		rt.numSamples = 0
+	}
+	return nil
+}
+
+// Trace starts rendering a frame and returns the index of the image. If tree is nil
+// the tree given to SetTree is used. Frames with a non-finite camera are skipped,
+// see Wait.
 func (rt *Raytracer) Trace(camera Camera, tree Octree, maxDepth int) int {
+	rt.traceLock.Lock()
+	defer rt.traceLock.Unlock()
+	return rt.traceRect(camera, tree, maxDepth, rt.cfg.Images[0].Bounds())
+}
+
+// TraceRect works like Trace but only renders the pixels inside rect. Pixels outside
+// of rect are left untouched.
+func (rt *Raytracer) TraceRect(camera Camera, tree Octree, maxDepth int, rect image.Rectangle) int {
+	rt.traceLock.Lock()
+	defer rt.traceLock.Unlock()
+	return rt.traceRect(camera, tree, maxDepth, rect.Sub(rt.origin))
+}
+
+func (rt *Raytracer) traceRect(camera Camera, tree Octree, maxDepth int, rect image.Rectangle) int {
 	cfg := &rt.cfg
 	idx := int(atomic.LoadUint32(&rt.frame) % 2)
 	size := cfg.Images[0].Bounds().Max // We assume this call is thread-safe.
 
 	rt.wait(idx)
 
-	if cfg.Jitter {
+	if cfg.Jitter || cfg.DoubleBuffer {
 		atomic.AddUint32(&rt.frame, 1)
 	}
+	atomic.CompareAndSwapInt32(&rt.completed, int32(idx), -1)
+
+	atomic.StoreUint64(&rt.nodeVisits[idx], 0)
+	atomic.StoreUint64(&rt.refined[idx], 0)
+	atomic.StoreUint64(&rt.traced[idx], 0)
+	for i := range rt.tileCount[idx] {
+		atomic.StoreInt32(&rt.tileCount[idx][i], 0)
+		atomic.StoreInt32(&rt.stealCount[idx][i], 0)
+	}
 
-	height := size.Y
-	batchSize := height / rt.numThreads
-	rt.wg[idx].Add(rt.numThreads)
+	rt.doneLock.Lock()
+	rt.latest = idx
+	rt.doneLock.Unlock()
 
-	for y := 0; y < height; y += batchSize {
-		rt.work <- rtJob{camera: camera,
-			tree:     tree,
-			maxDepth: float32(maxDepth),
-			from:     y,
-			to:       y + batchSize,
-			idx:      idx,
+	// Non-finite values would turn every ray into NaN. The frame is skipped and
+	// the image left untouched.
+	if !finiteCamera(camera) {
+		atomic.StoreUint32(&rt.aborted[idx], frameInvalid)
+		return idx
+	}
+	camera = treeCamera(camera, cfg.Coordinates)
+
+	// The snapshot is read once, the frame holds a reference until it is done.
+	var (
+		snapshot *TreeSnapshot
+		masks    []uint8
+	)
+	if tree == nil {
+		if snapshot = rt.acquireSnapshot(); snapshot != nil {
+			tree, maxDepth, masks = snapshot.tree, snapshot.maxDepth, snapshot.masks
 		}
 	}
 
+	job := rtJob{camera: camera,
+		tree:     tree,
+		masks:    masks,
+		maxDepth: float32(math.Max(float64(maxDepth)-float64(cfg.LODBias), 0)),
+		rect:     rect,
+		idx:      idx,
+		samples:  1,
+	}
+	job.instances = cfg.placeInstances(tree, masks, job.maxDepth, cfg.LODBias)
+	job.selection = rt.selection(tree)
+
+	if cfg.Samples > 1 {
+		job.samples = cfg.Samples
+	}
+
+	if rt.accum != nil && !cfg.Jitter {
+		// The frames add to the same buffer so they can not overlap. An aborted
+		// frame only added to some of the pixels and is started over.
+		rt.wait(idx ^ 1)
+		if rt.accumFrame >= 0 && rt.isAborted(rt.accumFrame) {
+			rt.numSamples = 0
+		}
+
+		job.accumulate = true
+		job.sample = rt.numSamples
+		rt.numSamples += job.samples
+		rt.accumFrame = idx
+	}
+
+	if cfg.Stereo != 0 {
+		rt.jobs = rt.jobs[:0]
+		for _, eye := range stereoViews(camera, cfg.Stereo, cfg.Images[0].Bounds()) {
+			j := job
+			j.camera, j.view, j.rect = eye.camera, eye.view, rect.Intersect(eye.view)
+			rt.jobs = splitTiles(rt.jobs, j, size, cfg.TileSize)
+		}
+	} else {
+		rt.jobs = splitTiles(rt.jobs[:0], job, size, cfg.TileSize)
+	}
+
+	rt.exposureRect[idx] = rect
+
+	numJobs := len(rt.jobs)
+	if cfg.Checkerboard {
+		numJobs = rt.splitPhases(idx)
+	}
+	if numJobs > 0 {
+		rt.frameTrees[idx] = snapshot
+		rt.doneLock.Lock()
+		rt.done[idx] = make(chan struct{})
+		rt.doneLock.Unlock()
+		rt.startWatchdog(idx, numJobs)
+	} else {
+		snapshot.Release()
+	}
+	rt.wg[idx].Add(numJobs)
+
+	atomic.StoreUint32(&rt.aborted[idx], 0)
+	atomic.AddInt32(&rt.pending[idx], int32(numJobs))
+	if numJobs == 0 {
+		atomic.StoreInt32(&rt.completed, int32(idx))
+	}
+
+	rt.schedule(rt.jobs)
 	return idx
 }
 
 func (rt *Raytracer) Image(frame int) *image.RGBA {
+	rt.traceLock.Lock()
+	defer rt.traceLock.Unlock()
+
 	rt.wait(frame)
-	return rt.cfg.Images[frame]
+	return rt.images[frame]
 }
 
 func (rt *Raytracer) Depth(frame int) *image.Gray16 {
+	rt.traceLock.Lock()
+	defer rt.traceLock.Unlock()
+
 	rt.wait(frame)
-	return rt.depth[frame]
+	if rt.origin == image.ZP {
+		return rt.depth[frame]
+	}
+
+	// The depth buffer is given the bounds of the image.
+	depth := *rt.depth[frame]
+	depth.Rect = depth.Rect.Add(rt.origin)
+	return &depth
 }
 
 func (rt *Raytracer) ClearDepth(frame int) {
+	rt.traceLock.Lock()
+	defer rt.traceLock.Unlock()
+
 	rt.wait(frame)
 	img := rt.depth[frame]
 	clear := image.Uniform{color.Gray16{math.MaxUint16}}
 	draw.Draw(img, img.Bounds(), &clear, image.ZP, draw.Src)
 }
 
+// SetLODBias replaces Config.LODBias. Frames in flight keep the bias they were
+// started with, the next Trace uses the new one. A changed bias starts the
+// accumulation over once the frames in flight are completed.
+func (rt *Raytracer) SetLODBias(bias float32) error {
+	if !(bias >= 0) || math.IsInf(float64(bias), 0) {
+		return invalidConfig("LODBias", InvalidLODBiasError)
+	}
+
+	rt.traceLock.Lock()
+	defer rt.traceLock.Unlock()
+
+	if bias != rt.cfg.LODBias && rt.cfg.Accumulate {
+		rt.wait(0)
+		rt.wait(1)
+		rt.numSamples = 0
+	}
+	rt.cfg.LODBias = bias
+	return nil
+}
+
 func (rt *Raytracer) SetClearColor(c color.RGBA) {
 	rt.clear = c
 }
@@ -499,27 +1896,92 @@ func (rt *Raytracer) Frame() int {
 	return int(atomic.LoadUint32(&rt.frame) % 2)
 }
 
+// Close stops the FrameDeadline watchdog and drops the reference to the snapshot.
+// Frames in flight are still completed, workers exit by themselves once there are
+// no tiles left.
 func (rt *Raytracer) Close() {
-	close(rt.work)
+	rt.traceLock.Lock()
+	defer rt.traceLock.Unlock()
+
+	rt.snapshot.Swap(nil).Release()
+
+	for _, timer := range rt.watchdog {
+		if timer != nil {
+			timer.Stop()
+		}
+	}
 }
 
+// NewRaytracer creates a raytracer rendering to cfg.Images or cfg.Target. It panics
+// with the error of Validate, or an ErrInvalidConfig of MissingImageError or
+// MismatchedImagesError, if they can not be used.
 func NewRaytracer(cfg Config) *Raytracer {
-	rect := cfg.Images[0].Bounds()
-	numCPU := 1
-
-	if cfg.MultiThreaded {
-		numCPU = runtime.NumCPU()
-		for numCPU%rect.Max.Y != 0 {
-			numCPU++
+	if cfg.Target != nil {
+		if err := cfg.validateTarget(); err != nil {
+			panic(err)
 		}
+		img := cfg.Target.image()
+		cfg.Images = [2]*image.RGBA{img, img}
+	}
+
+	if err := checkImages(cfg.Images); err != nil {
+		panic(err)
+	}
+
+	images := cfg.Images
+	cfg.Images = [2]*image.RGBA{rebaseRGBA(images[0]), rebaseRGBA(images[1])}
+
+	numWorkers := 1
+	if cfg.Workers > 0 {
+		numWorkers = cfg.Workers
+	} else if cfg.MultiThreaded {
+		numWorkers = runtime.NumCPU()
+	}
+
+	maxGoroutines := cfg.MaxGoroutines
+	if maxGoroutines <= 0 {
+		maxGoroutines = 4 * runtime.NumCPU()
+	}
+	if numWorkers > maxGoroutines {
+		numWorkers = maxGoroutines
+	}
+
+	epsilon := cfg.Epsilon
+	if epsilon == 0 {
+		epsilon = DefaultEpsilon
+	} else if epsilon < 0 {
+		epsilon = 0
 	}
 
 	rt := &Raytracer{
 		cfg:        cfg,
+		images:     images,
+		origin:     images[0].Rect.Min,
+		bgra:       cfg.Target != nil && cfg.Target.Order == BGRA,
+		epsilon:    epsilon,
 		frame:      uint32(cfg.FrameSeed),
+		completed:  -1,
+		latest:     int(uint32(cfg.FrameSeed) % 2),
+		accumFrame: -1,
 		clear:      color.RGBA{0, 0, 0, 255},
-		numThreads: numCPU,
-		work:       make(chan rtJob, numCPU*2),
+		queues:     make([]tileQueue, numWorkers),
+		running:    make([]int32, numWorkers),
+	}
+
+	exposure := cfg.Exposure
+	if exposure == 0 {
+		exposure = 1
+	}
+	rt.setExposure(exposure)
+
+	for i := range rt.done {
+		rt.done[i] = make(chan struct{})
+		close(rt.done[i])
+	}
+
+	for i := range rt.tileCount {
+		rt.tileCount[i] = make([]int32, numWorkers)
+		rt.stealCount[i] = make([]int32, numWorkers)
 	}
 
 	if cfg.Depth {
@@ -527,9 +1989,8 @@ func NewRaytracer(cfg Config) *Raytracer {
 		rt.depth = [2]*image.Gray16{image.NewGray16(rect), image.NewGray16(rect)}
 	}
 
-	for i := 0; i < numCPU; i++ {
-		go rt.workerLoop()
+	if cfg.Accumulate {
+		rt.accum = make([]float32, len(cfg.Images[0].Pix))
 	}
-
 	return rt
 }
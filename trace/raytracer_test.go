@@ -0,0 +1,1077 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andreas-jonsson/octatron/go3d/vec3"
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+func TestSetTree(t *testing.T) {
+	red := solidCube(2, color.RGBA{255, 0, 0, 255})
+	green := solidCube(2, color.RGBA{0, 255, 0, 255})
+
+	rect := image.Rect(0, 0, 16, 16)
+	rt := NewRaytracer(Config{
+		FieldOfView:   0.2,
+		TreeScale:     1,
+		ViewDist:      10,
+		MultiThreaded: true,
+		Images:        [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	defer rt.Close()
+
+	camera := LookAtCamera{Pos: Vec3{0.375, 0.375, 2}, Look: Vec3{0.375, 0.375, 0}}
+	rt.SetTree(red.Octree(), 3)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			rt.SetTree(green.Octree(), 3)
+			rt.SetTree(red.Octree(), 3)
+		}
+		rt.SetTree(green.Octree(), 3)
+		close(done)
+	}()
+
+	for i := 0; i < 20; i++ {
+		rt.Trace(&camera, nil, 0)
+	}
+	<-done
+
+	for i := 0; i < 2; i++ {
+		idx := rt.Trace(&camera, nil, 0)
+		if c := rt.Image(idx).RGBAAt(8, 8); c.G != 255 || c.R != 0 {
+			t.Fatalf("expected green, got %v", c)
+		}
+	}
+}
+
+func TestTraceRect(t *testing.T) {
+	tree := testSphere(3)
+	camera := LookAtCamera{Pos: Vec3{0.3, 0.6, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	sentinel := color.RGBA{1, 2, 3, 255}
+	roi := image.Rect(5, 3, 20, 11)
+
+	for _, packets := range []bool{false, true} {
+		rect := image.Rect(0, 0, 24, 16)
+		cfg := Config{
+			FieldOfView:   0.8,
+			TreeScale:     1,
+			ViewDist:      5,
+			Jitter:        true,
+			MultiThreaded: true,
+			Packets:       packets,
+			Images:        [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		}
+
+		full, _ := renderTestFrame(tree, cfg, &camera)
+
+		cfg.Images = [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}
+		for _, img := range cfg.Images {
+			draw.Draw(img, rect, &image.Uniform{sentinel}, image.ZP, draw.Src)
+		}
+
+		rt := NewRaytracer(cfg)
+		img := rt.Image(rt.TraceRect(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis()), roi))
+		rt.Close()
+
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				expected := sentinel
+				if image.Pt(x, y).In(roi) {
+					expected = full.RGBAAt(x, y)
+				}
+
+				if c := img.RGBAAt(x, y); c != expected {
+					t.Fatalf("pixel %v,%v is %v, expected %v, packets: %v", x, y, c, expected, packets)
+				}
+			}
+		}
+	}
+}
+
+func TestValidateFieldOfView(t *testing.T) {
+	valid := []Config{{FieldOfView: 0.8}, {FieldOfViewDegrees: 45}, {FieldOfView: 100, FieldOfViewDegrees: 90}}
+	for _, cfg := range valid {
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("expected %+v to be valid", cfg)
+		}
+	}
+
+	invalid := []Config{{}, {FieldOfView: 45}, {FieldOfViewDegrees: 180}, {FieldOfViewDegrees: -10}}
+	for _, cfg := range invalid {
+		if err := cfg.Validate(); !errors.Is(err, InvalidFieldOfViewError) {
+			t.Errorf("expected %+v to be invalid", cfg)
+		}
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	cfg := Config{FieldOfView: 1, Fog: Fog{Enabled: true, Start: 2, End: 1}}
+	err := cfg.Validate()
+
+	var invalid *ErrInvalidConfig
+	if !errors.As(err, &invalid) || invalid.Field != "Fog" || !errors.Is(err, InvalidFogError) {
+		t.Fatalf("expected invalid fog, got %v", err)
+	}
+	if code := ExitCode(err); code != ExitInvalidConfig {
+		t.Errorf("expected exit code %d, got %d", ExitInvalidConfig, code)
+	}
+
+	rt := NewRaytracer(Config{FieldOfView: 1, Images: [2]*image.RGBA{image.NewRGBA(image.Rect(0, 0, 4, 4)), image.NewRGBA(image.Rect(0, 0, 4, 4))}})
+	defer rt.Close()
+	if err := rt.SetHighlight(Highlight{Mode: -1}); !errors.As(err, &invalid) || invalid.Field != "Highlight" {
+		t.Errorf("expected invalid highlight, got %v", err)
+	}
+}
+
+func TestNearPlane(t *testing.T) {
+	tree := NewMutableTree(nil, 2)
+	red := color.RGBA{255, 0, 0, 255}
+	if err := tree.SetVoxel([3]float32{0.25, 0.25, 0.25}, 1, red); err != nil {
+		panic(err)
+	}
+
+	// The front face of the leaf is at distance 1.
+	camera := LookAtCamera{Pos: Vec3{0.25, 0.25, 1.5}, Look: Vec3{0.25, 0.25, 0}}
+	rect := image.Rect(0, 0, 32, 32)
+
+	for _, test := range []struct {
+		near     float32
+		hit      bool
+		precise  bool
+		marching bool
+	}{
+		{0, true, false, false},
+		{2, false, false, false},
+		{0.5, true, false, false},
+		{2, false, true, false},
+		{0.5, true, true, false},
+		{2, false, false, true},
+		{0.5, true, false, true},
+	} {
+		cfg := Config{
+			FieldOfViewDegrees: 20,
+			TreeScale:          1,
+			ViewDist:           10,
+			Near:               test.near,
+			Depth:              true,
+			HighPrecision:      test.precise,
+			Images:             [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		}
+		if test.marching {
+			cfg.Traversal = Marching
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+
+		img, depth := renderTestFrame(tree, cfg, &camera)
+		if hit := img.RGBAAt(15, 15).R > 0; hit != test.hit {
+			t.Errorf("%+v: expected hit %v, got %v", test, test.hit, img.RGBAAt(15, 15))
+		}
+
+		// Depth is measured from the eye.
+		expected := float32(1)
+		if !test.hit {
+			expected = cfg.ViewDist
+		}
+		if d := float32(depth.Gray16At(15, 15).Y) / math.MaxUint16 * cfg.ViewDist; math.Abs(float64(d-expected)) > 0.05 {
+			t.Errorf("%+v: expected depth %v, got %v", test, expected, d)
+		}
+	}
+
+	for _, near := range []float32{-1, 10, 20, float32(math.NaN())} {
+		cfg := Config{FieldOfViewDegrees: 45, ViewDist: 10, Near: near}
+		if err := cfg.Validate(); !errors.Is(err, InvalidNearError) {
+			t.Errorf("near %v: expected %v, got %v", near, InvalidNearError, err)
+		}
+	}
+}
+
+func TestFieldOfViewDegrees(t *testing.T) {
+	tree := solidCube(2, color.RGBA{255, 0, 0, 255})
+
+	// At this distance the front face of the cube exactly fills 45 degrees.
+	dist := 0.5 / math.Tan(math.Pi/8)
+	camera := LookAtCamera{Pos: Vec3{0.5, 0.5, float32(1 + dist)}, Look: Vec3{0.5, 0.5, 0.5}}
+
+	for _, fov := range []float32{45, 50} {
+		rect := image.Rect(0, 0, 32, 16)
+		rt := NewRaytracer(Config{
+			FieldOfViewDegrees: fov,
+			TreeScale:          1,
+			ViewDist:           10,
+			Images:             [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		})
+		rt.SetClearColor(testClearColor)
+
+		img := rt.Image(rt.Trace(&camera, tree.Octree(), 2))
+		rt.Close()
+
+		for _, x := range []int{1, 31} {
+			hit := img.RGBAAt(x, 4) != testClearColor
+			if hit != (fov == 45) {
+				t.Errorf("unexpected result at column %v with %v degrees", x, fov)
+			}
+		}
+	}
+}
+
+func TestDegenerateCamera(t *testing.T) {
+	rect := image.Rect(0, 0, 8, 8)
+	rt := NewRaytracer(Config{
+		FieldOfViewDegrees: 45,
+		TreeScale:          1,
+		ViewDist:           10,
+		Images:             [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	defer rt.Close()
+
+	cameras := []LookAtCamera{
+		{Pos: Vec3{0.5, 0.5, 2}, Look: Vec3{0.5, 0.5, 2}},
+		{Pos: Vec3{0.5, 2, 0.5}, Look: Vec3{0.5, 0.5, 0.5}},
+		{Pos: Vec3{0.5, -2, 0.5}, Look: Vec3{0.5, 0.5, 0.5}},
+	}
+
+	for _, camera := range cameras {
+		xInc, yInc, bottomLeft := rt.calcIncVectors(&camera, rect.Max)
+		for _, v := range [][3]float32{xInc, yInc, bottomLeft} {
+			for _, f := range v {
+				if math.IsNaN(float64(f)) || math.IsInf(float64(f), 0) {
+					t.Fatalf("invalid increment vectors for camera %v", camera)
+				}
+			}
+		}
+	}
+
+	// Looking straight down on the cube should still hit it.
+	tree := solidCube(2, color.RGBA{255, 0, 0, 255})
+	rt.SetClearColor(testClearColor)
+
+	camera := cameras[1]
+	if c := rt.Image(rt.Trace(&camera, tree.Octree(), 2)).RGBAAt(3, 5); c == testClearColor {
+		t.Error("expected hit when looking along the up vector")
+	}
+}
+
+func TestLoadOctreeWithInfo(t *testing.T) {
+	fp, err := ioutil.TempFile("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+
+	cube := solidCube(2, color.RGBA{255, 0, 0, 255})
+	if err := cube.Save(fp, pack.MipR5G6B5UnpackUI16); err != nil {
+		panic(err)
+	}
+
+	if _, err := fp.Seek(0, 0); err != nil {
+		panic(err)
+	}
+
+	tree, info, err := LoadOctreeWithInfo(fp)
+	if err != nil {
+		panic(err)
+	}
+
+	expected := TreeInfo{
+		Format:        pack.MipR5G6B5UnpackUI16,
+		NumNodes:      1 + 8 + 64,
+		NumLeafs:      64,
+		VoxelsPerAxis: 4,
+		Depth:         3,
+	}
+
+	if *info != expected {
+		t.Errorf("expected %+v, got %+v", expected, *info)
+	}
+
+	if len(tree) != int(info.NumNodes) {
+		t.Errorf("expected %v nodes, got %v", info.NumNodes, len(tree))
+	}
+}
+
+func TestLoadConcatenatedTrees(t *testing.T) {
+	var buffer bytes.Buffer
+	red := solidCube(2, color.RGBA{255, 0, 0, 255})
+	green := solidCube(3, color.RGBA{0, 255, 0, 255})
+
+	if err := red.Save(&buffer, pack.MipR8G8B8A8UnpackUI32); err != nil {
+		panic(err)
+	}
+	if err := green.Save(&buffer, pack.MipR5G6B5UnpackUI16); err != nil {
+		panic(err)
+	}
+	buffer.WriteString("end")
+
+	for _, expected := range []*MutableTree{red, green} {
+		tree, vpa, err := LoadOctree(&buffer)
+		if err != nil {
+			panic(err)
+		}
+
+		if vpa != expected.VoxelsPerAxis() || len(tree) != len(expected.Octree()) {
+			t.Errorf("expected a tree of %d voxels and %d nodes, got %d and %d", expected.VoxelsPerAxis(), len(expected.Octree()), vpa, len(tree))
+		}
+	}
+
+	if rest := buffer.String(); rest != "end" {
+		t.Errorf("expected the reader to stop after the trees, %q is left", rest)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	tree := testSphere(6)
+	camera := LookAtCamera{Pos: Vec3{0.3, 0.6, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	maxDepth := TreeWidthToDepth(tree.VoxelsPerAxis())
+	rect := image.Rect(0, 0, 128, 128)
+
+	cfg := Config{
+		FieldOfView: 0.8,
+		TreeScale:   1,
+		ViewDist:    5,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+	reference, _ := renderTestFrame(tree, cfg, &camera)
+
+	cfg.Images = [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}
+	rt := NewRaytracer(cfg)
+	defer rt.Close()
+
+	idx := rt.Trace(&camera, tree.Octree(), maxDepth)
+	time.Sleep(10 * time.Millisecond)
+
+	start := time.Now()
+	rt.Abort()
+
+	if err := rt.Wait(idx); err != FrameAbortedError {
+		t.Errorf("expected aborted frame, got %v", err)
+	}
+
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("abort took %v", d)
+	}
+
+	idx = rt.Trace(&camera, tree.Octree(), maxDepth)
+	if err := rt.Wait(idx); err != nil {
+		t.Fatal(err)
+	}
+
+	if img := rt.Image(idx); !bytes.Equal(img.Pix, reference.Pix) {
+		t.Error("frame after abort differs from reference")
+	}
+
+	// Aborting without frames in flight has no effect.
+	rt.Abort()
+	if err := rt.Wait(idx); err != nil {
+		t.Errorf("expected completed frame, got %v", err)
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	tree := testSphere(4)
+	camera := LookAtCamera{Pos: Vec3{0.3, 0.6, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	maxDepth := TreeWidthToDepth(tree.VoxelsPerAxis())
+	rect := image.Rect(0, 0, 32, 32)
+
+	// The shader stands in for a pathological traversal, a slow frame is one
+	// that blocks on release.
+	var slow int32
+	release := make(chan struct{})
+	cfg := Config{
+		FieldOfView: 0.8,
+		TreeScale:   1,
+		ViewDist:    5,
+		Jitter:      true,
+		Shader: func(p image.Point, c color.RGBA, dist float32, hit bool) [3]float32 {
+			if atomic.LoadInt32(&slow) != 0 {
+				<-release
+			}
+			return [3]float32{float32(c.R) / 255, float32(c.G) / 255, float32(c.B) / 255}
+		},
+		Images: [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+
+	rt := NewRaytracer(cfg)
+	defer rt.Close()
+
+	if idx, ok := rt.TryWait(); !ok || idx != 0 {
+		t.Errorf("expected no frames in flight before the first frame, got %d, %v", idx, ok)
+	}
+
+	idx := rt.Trace(&camera, tree.Octree(), maxDepth)
+	if latest, ok := rt.WaitTimeout(time.Second); !ok || latest != idx {
+		t.Fatalf("expected frame %d to complete, got %d, %v", idx, latest, ok)
+	}
+	if _, ok := rt.TryWait(); !ok {
+		t.Error("expected TryWait to report the completed frame")
+	}
+
+	atomic.StoreInt32(&slow, 1)
+	idx = rt.Trace(&camera, tree.Octree(), maxDepth)
+
+	if latest, ok := rt.TryWait(); ok || latest != idx {
+		t.Errorf("expected frame %d in flight, got %d, %v", idx, latest, ok)
+	}
+
+	start := time.Now()
+	if latest, ok := rt.WaitTimeout(20 * time.Millisecond); ok || latest != idx {
+		t.Errorf("expected frame %d to time out, got %d, %v", idx, latest, ok)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond || d > time.Second {
+		t.Errorf("expected to wait for the timeout, waited %v", d)
+	}
+
+	// The server aborts the frame and moves on once the stuck pixels return.
+	rt.Abort()
+	atomic.StoreInt32(&slow, 0)
+	close(release)
+
+	if err := rt.Wait(idx); err != FrameAbortedError {
+		t.Errorf("expected the timed out frame to be aborted, got %v", err)
+	}
+	if _, ok := rt.TryWait(); !ok {
+		t.Error("expected no frames in flight after the abort")
+	}
+
+	idx = rt.Trace(&camera, tree.Octree(), maxDepth)
+	if err := rt.Wait(idx); err != nil {
+		t.Errorf("expected the next frame to complete, got %v", err)
+	}
+}
+
+func renderAt(tree *MutableTree, offset float32, highPrecision bool) *image.RGBA {
+	rect := image.Rect(0, 0, 64, 64)
+	cfg := Config{
+		FieldOfView:   0.8,
+		TreeScale:     1,
+		TreePosition:  Vec3{offset, offset, offset},
+		ViewDist:      5,
+		HighPrecision: highPrecision,
+		Images:        [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+
+	camera := LookAtCamera{
+		Pos:  Vec3{offset + 0.25, offset + 0.75, offset + 2},
+		Look: Vec3{offset + 0.5, offset + 0.5, offset + 0.5},
+	}
+
+	rt := NewRaytracer(cfg)
+	defer rt.Close()
+	return rt.Image(rt.Trace(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis())))
+}
+
+func countDiff(a, b *image.RGBA) int {
+	num := 0
+	for i := 0; i < len(a.Pix); i += 4 {
+		if !bytes.Equal(a.Pix[i:i+4], b.Pix[i:i+4]) {
+			num++
+		}
+	}
+	return num
+}
+
+func TestHighPrecision(t *testing.T) {
+	const offset = 1e6
+	tree := testSphere(5)
+
+	reference := renderAt(tree, 0, true)
+	numPixels := len(reference.Pix) / 4
+
+	// The float32 path is expected to show banding far from the origin.
+	if n := countDiff(reference, renderAt(tree, offset, false)); n < numPixels/10 {
+		t.Errorf("expected float32 banding at offset, only %d pixels differ", n)
+	}
+
+	if n := countDiff(reference, renderAt(tree, offset, true)); n != 0 {
+		t.Errorf("%d pixels differ from reference in high precision mode", n)
+	}
+}
+
+func TestResize(t *testing.T) {
+	rect := image.Rect(0, 0, 16, 16)
+	tree := testSphere(4)
+	rt := NewRaytracer(Config{
+		FieldOfView:   0.8,
+		TreeScale:     1,
+		ViewDist:      5,
+		Jitter:        true,
+		Depth:         true,
+		MultiThreaded: true,
+		Images:        [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	defer rt.Close()
+	rt.SetTree(tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis()))
+
+	for _, size := range []image.Point{{0, 16}, {16, 0}, {-1, -1}} {
+		if err := rt.Resize(size.X, size.Y); !errors.Is(err, InvalidSizeError) {
+			t.Errorf("expected error for size %v, got %v", size, err)
+		}
+	}
+
+	camera := LookAtCamera{Pos: Vec3{0.5, 0.5, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	for i := 0; i < 100; i++ {
+		size := image.Point{8 + i%5*7, 8 + i%3*5}
+		if err := rt.Resize(size.X, size.Y); err != nil {
+			t.Fatal(err)
+		}
+
+		idx := rt.Trace(&camera, nil, 0)
+		if err := rt.Wait(idx); err != nil {
+			t.Fatal(err)
+		}
+
+		if b := rt.Image(idx).Bounds(); b.Max != size {
+			t.Fatalf("expected image of size %v, got %v", size, b)
+		}
+
+		if b := rt.Depth(idx).Bounds(); b.Max != size {
+			t.Fatalf("expected depth buffer of size %v, got %v", size, b)
+		}
+		rt.ClearDepth(idx)
+	}
+}
+
+func TestDoubleBuffer(t *testing.T) {
+	rect := image.Rect(0, 0, 32, 32)
+	tree := testSphere(4)
+	rt := NewRaytracer(Config{
+		FieldOfView:   0.8,
+		TreeScale:     1,
+		ViewDist:      5,
+		DoubleBuffer:  true,
+		MultiThreaded: true,
+		Images:        [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	defer rt.Close()
+	rt.SetTree(tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis()))
+
+	if _, ok := rt.Completed(); ok {
+		t.Fatal("expected no completed frame before the first trace")
+	}
+
+	lastIdx := -1
+	for i := 0; i < 20; i++ {
+		var (
+			done     int
+			snapshot []byte
+		)
+		if lastIdx >= 0 {
+			idx, ok := rt.Completed()
+			if !ok || idx != lastIdx {
+				t.Fatalf("expected completed frame %d, got %d (%v)", lastIdx, idx, ok)
+			}
+			done = idx
+			snapshot = append([]byte(nil), rt.Image(done).Pix...)
+		}
+
+		camera := LookAtCamera{Pos: Vec3{0.5 + float32(i)*0.1, 0.5, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+		idx := rt.Trace(&camera, nil, 0)
+		if lastIdx >= 0 && idx == lastIdx {
+			t.Fatalf("frame %d reused image %d", i, idx)
+		}
+
+		if snapshot != nil && !bytes.Equal(snapshot, rt.Image(done).Pix) {
+			t.Fatalf("completed image %d was written while frame %d rendered", done, i)
+		}
+
+		if err := rt.Wait(idx); err != nil {
+			t.Fatal(err)
+		}
+
+		if snapshot != nil && !bytes.Equal(snapshot, rt.Image(done).Pix) {
+			t.Fatalf("completed image %d was written by frame %d", done, i)
+		}
+		lastIdx = idx
+	}
+}
+
+// intersectAll is intersectTree without the front to back order, testing every
+// child and keeping the closest hit.
+func (rt *Raytracer) intersectAll(tree []octreeNode, ray *infiniteRay, nodePos *vec3.T, nodeScale, length, maxDepth float32, nodeIndex, treeDepth uint32, visits *uint64) (float32, uint32, bool) {
+	*visits++
+	node := &tree[nodeIndex]
+
+	box := vec3.Box{Min: *nodePos, Max: vec3.T{nodePos[0] + nodeScale, nodePos[1] + nodeScale, nodePos[2] + nodeScale}}
+	boxDist := intersectBox(ray, length, &box, rt.epsilon*nodeScale)
+	if boxDist == length {
+		return length, 0, false
+	}
+
+	d := boxDist / rt.cfg.ViewDist
+	if treeDepth > uint32(maxDepth*(1-d*d)) || node.numChildren() == 0 {
+		return boxDist, nodeIndex, true
+	}
+
+	var (
+		hit      bool
+		hitIndex uint32
+	)
+
+	for i := range node {
+		if child := node.getChild(i); child != 0 {
+			scaled := childPositions[i].Scaled(nodeScale * 0.5)
+			pos := vec3.Add(nodePos, &scaled)
+			if ln, idx, ok := rt.intersectAll(tree, ray, &pos, nodeScale*0.5, length, maxDepth, child, treeDepth+1, visits); ok && ln < length {
+				length, hitIndex, hit = ln, idx, true
+			}
+		}
+	}
+	return length, hitIndex, hit
+}
+
+func TestFrontToBack(t *testing.T) {
+	const size = 96
+
+	tree := testSphere(5)
+	rt := NewRaytracer(Config{
+		FieldOfView: 1.2,
+		TreeScale:   1,
+		ViewDist:    4,
+		Images:      [2]*image.RGBA{image.NewRGBA(image.Rect(0, 0, size, size)), image.NewRGBA(image.Rect(0, 0, size, size))},
+	})
+	defer rt.Close()
+
+	var fullVisits, orderedVisits uint64
+	cameras := []LookAtCamera{
+		{Pos: Vec3{0.5, 0.5, 2}, Look: Vec3{0.5, 0.5, 0.5}},
+		{Pos: Vec3{-1, 1.5, -0.7}, Look: Vec3{0.5, 0.4, 0.5}},
+		{Pos: Vec3{0.9, 0.2, 0.6}, Look: Vec3{0.1, 0.8, 0.3}},
+	}
+
+	for _, camera := range cameras {
+		xInc, yInc, bottomLeft := rt.calcIncVectors(&camera, image.Point{size, size})
+		scan := scanSetup{xInc, yInc, bottomLeft, vec3.T(camera.Position())}
+
+		for _, maxDepth := range []float32{3, 5} {
+			for y := 0; y < size; y++ {
+				for x := 0; x < size; x++ {
+					var (
+						ray     = scan.ray(x, y)
+						nodePos vec3.T
+					)
+
+					expDist, expIndex, expHit := rt.intersectAll(tree.Octree(), &ray, &nodePos, 1, rt.cfg.ViewDist, maxDepth, 0, 0, &fullVisits)
+					dist, index, _, hit := rt.intersectTree(tree.Octree(), nil, &ray, &nodePos, 1, rt.cfg.ViewDist, maxDepth, 0, 0, &orderedVisits)
+
+					if hit != expHit || dist != expDist || index != expIndex {
+						t.Fatalf("ray %v: expected (%v, %v, %v), got (%v, %v, %v)", ray, expDist, expIndex, expHit, dist, index, hit)
+					}
+				}
+			}
+		}
+	}
+
+	if orderedVisits*2 > fullVisits {
+		t.Errorf("expected ordered traversal to visit at most half the nodes: %v of %v", orderedVisits, fullVisits)
+	}
+	t.Logf("node visits: %v ordered, %v full", orderedVisits, fullVisits)
+}
+
+func TestNodeVisitStats(t *testing.T) {
+	rect := image.Rect(0, 0, 32, 32)
+	tree := testSphere(4)
+
+	for _, packets := range []bool{false, true} {
+		rt := NewRaytracer(Config{
+			FieldOfView: 0.8,
+			TreeScale:   1,
+			ViewDist:    5,
+			Packets:     packets,
+			Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		})
+
+		camera := LookAtCamera{Pos: Vec3{0.5, 0.5, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+		idx := rt.Trace(&camera, tree.Octree(), 4)
+		first := rt.Stats(idx).NodeVisits
+
+		// Looking away from the tree only the root is visited, once per pixel.
+		away := LookAtCamera{Pos: Vec3{0.5, 0.5, 2}, Look: Vec3{0.5, 0.5, 3}}
+		idx = rt.Trace(&away, tree.Octree(), 4)
+		second := rt.Stats(idx).NodeVisits
+		rt.Close()
+
+		if first <= uint64(rect.Dx()*rect.Dy()) {
+			t.Errorf("expected more than one visit per pixel, got %v", first)
+		}
+
+		if second > uint64(rect.Dx()*rect.Dy()) {
+			t.Errorf("expected at most one visit per pixel when looking away, got %v", second)
+		}
+	}
+}
+
+func TestLODBias(t *testing.T) {
+	rect := image.Rect(0, 0, 32, 32)
+	tree := testSphere(4)
+
+	cfg := Config{
+		FieldOfView: 0.8,
+		TreeScale:   1,
+		ViewDist:    5,
+		LODBias:     -1,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+	if err := cfg.Validate(); !errors.Is(err, InvalidLODBiasError) {
+		t.Error("expected a negative bias to be rejected, got:", err)
+	}
+	cfg.LODBias = 0
+
+	rt := NewRaytracer(cfg)
+	defer rt.Close()
+
+	camera := LookAtCamera{Pos: Vec3{0.5, 0.5, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	full := rt.Stats(rt.Trace(&camera, tree.Octree(), 5)).NodeVisits
+
+	if err := rt.SetLODBias(2); err != nil {
+		t.Fatal(err)
+	}
+	if visits := rt.Stats(rt.Trace(&camera, tree.Octree(), 5)).NodeVisits; visits >= full {
+		t.Errorf("expected fewer than %d node visits with a bias, got %d", full, visits)
+	}
+
+	if err := rt.SetLODBias(float32(math.NaN())); !errors.Is(err, InvalidLODBiasError) {
+		t.Error("expected NaN to be rejected, got:", err)
+	}
+}
+
+func TestInvalidCamera(t *testing.T) {
+	rect := image.Rect(0, 0, 16, 16)
+	tree := testSphere(3)
+	rt := NewRaytracer(Config{
+		FieldOfView:   0.8,
+		TreeScale:     1,
+		ViewDist:      5,
+		MultiThreaded: true,
+		Images:        [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	defer rt.Close()
+	rt.SetTree(tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis()))
+
+	nan := float32(math.NaN())
+	inf := float32(math.Inf(1))
+	cameras := []Camera{
+		&LookAtCamera{Pos: Vec3{0.5, nan, 2}, Look: Vec3{0.5, 0.5, 0.5}},
+		&LookAtCamera{Pos: Vec3{0.5, 0.5, 2}, Look: Vec3{inf, 0.5, 0.5}},
+		&FreeFlightCamera{Pos: Vec3{0.5, 0.5, 2}, XRot: nan},
+	}
+
+	for _, camera := range cameras {
+		img := rt.Image(0)
+		draw.Draw(img, rect, image.NewUniform(color.RGBA{1, 2, 3, 255}), image.ZP, draw.Src)
+		before := append([]byte(nil), img.Pix...)
+
+		idx := rt.Trace(camera, nil, 0)
+		if err := rt.Wait(idx); err != InvalidCameraError {
+			t.Errorf("expected InvalidCameraError for %+v, got %v", camera, err)
+		}
+
+		if !bytes.Equal(before, rt.Image(idx).Pix) {
+			t.Errorf("image was written for %+v", camera)
+		}
+	}
+
+	if _, ok := rt.Completed(); ok {
+		t.Error("expected skipped frames not to complete")
+	}
+
+	idx := rt.Trace(&LookAtCamera{Pos: Vec3{0.5, 0.5, 2}, Look: Vec3{0.5, 0.5, 0.5}}, nil, 0)
+	if err := rt.Wait(idx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSubImage(t *testing.T) {
+	tree := testSphere(3)
+	camera := LookAtCamera{Pos: Vec3{0.3, 0.6, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	sentinel := color.RGBA{1, 2, 3, 255}
+
+	var parents [2]*image.RGBA
+	newImages := func(bounds, rect image.Rectangle) [2]*image.RGBA {
+		var images [2]*image.RGBA
+		for i := range images {
+			parents[i] = image.NewRGBA(bounds)
+			draw.Draw(parents[i], bounds, image.NewUniform(sentinel), image.ZP, draw.Src)
+			images[i] = parents[i].SubImage(rect).(*image.RGBA)
+		}
+		return images
+	}
+
+	cfg := Config{
+		FieldOfView: 0.8,
+		TreeScale:   1,
+		ViewDist:    5,
+		Depth:       true,
+		Images:      newImages(image.Rect(0, 0, 24, 16), image.Rect(0, 0, 24, 16)),
+	}
+	full, fullDepth := renderTestFrame(tree, cfg, &camera)
+
+	bounds, rect := image.Rect(0, 0, 40, 30), image.Rect(8, 6, 32, 22)
+	cfg.Images = newImages(bounds, rect)
+
+	var tiles []image.Rectangle
+	cfg.OnTileDone = func(frame int, r image.Rectangle) {
+		tiles = append(tiles, r)
+	}
+
+	img, depth := renderTestFrame(tree, cfg, &camera)
+	if img.Bounds() != rect || depth.Bounds() != rect {
+		t.Fatalf("expected bounds %v, got %v and %v", rect, img.Bounds(), depth.Bounds())
+	}
+
+	for _, r := range tiles {
+		if !r.In(rect) {
+			t.Errorf("tile %v is outside of the image", r)
+		}
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if !image.Pt(x, y).In(rect) {
+				for _, parent := range parents {
+					if c := parent.RGBAAt(x, y); c != sentinel {
+						t.Fatalf("pixel %v,%v outside of the sub-image was written", x, y)
+					}
+				}
+				continue
+			}
+
+			if c, expected := img.RGBAAt(x, y), full.RGBAAt(x-rect.Min.X, y-rect.Min.Y); c != expected {
+				t.Fatalf("pixel %v,%v is %v, expected %v", x, y, c, expected)
+			}
+			if d, expected := depth.Gray16At(x, y), fullDepth.Gray16At(x-rect.Min.X, y-rect.Min.Y); d != expected {
+				t.Fatalf("depth %v,%v is %v, expected %v", x, y, d, expected)
+			}
+		}
+	}
+}
+
+func TestMismatchedImages(t *testing.T) {
+	a := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	pairs := map[error][2]*image.RGBA{
+		MismatchedImagesError: {a, image.NewRGBA(image.Rect(0, 0, 16, 8))},
+		MissingImageError:     {a, nil},
+	}
+
+	for expected, images := range pairs {
+		func() {
+			defer func() {
+				if err, _ := recover().(error); !errors.Is(err, expected) {
+					t.Errorf("expected panic with %v, got %v", expected, err)
+				}
+			}()
+			NewRaytracer(Config{FieldOfView: 0.8, Images: images}).Close()
+		}()
+	}
+
+	empty := image.NewRGBA(image.Rectangle{})
+	rt := NewRaytracer(Config{FieldOfView: 0.8, Images: [2]*image.RGBA{empty, empty}})
+	if err := rt.Wait(rt.Trace(&LookAtCamera{Pos: Vec3{0, 0, 1}}, nil, 0)); err != nil {
+		t.Errorf("expected empty frame to complete, got %v", err)
+	}
+	rt.Close()
+
+	// Images of the same size but at different positions are mismatched too.
+	b := image.NewRGBA(image.Rect(0, 0, 32, 32)).SubImage(image.Rect(8, 8, 24, 24)).(*image.RGBA)
+	if err := checkImages([2]*image.RGBA{a, b}); !errors.Is(err, MismatchedImagesError) {
+		t.Errorf("expected MismatchedImagesError, got %v", err)
+	}
+}
+
+func TestFlip(t *testing.T) {
+	// A red voxel in the upper right of the view from the front and a green one
+	// in the lower left.
+	tree := NewMutableTree(nil, 4)
+	red, green := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}
+	if err := tree.SetVoxel([3]float32{0.875, 0.875, 0.5}, 2, red); err != nil {
+		panic(err)
+	}
+	if err := tree.SetVoxel([3]float32{0.125, 0.125, 0.5}, 2, green); err != nil {
+		panic(err)
+	}
+
+	const width, height = 48, 32
+	render := func(flipX, flipY bool, setup func(cfg *Config)) *image.RGBA {
+		rect := image.Rect(0, 0, width, height)
+		cfg := Config{
+			FieldOfView: 1.2,
+			TreeScale:   1,
+			ViewDist:    5,
+			FlipX:       flipX,
+			FlipY:       flipY,
+			Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		}
+		setup(&cfg)
+
+		rt := NewRaytracer(cfg)
+		defer rt.Close()
+
+		camera := LookAtCamera{Pos: Vec3{0.5, 0.5, 1.8}, Look: Vec3{0.5, 0.5, 0.5}}
+		return rt.Image(rt.Trace(&camera, tree.Octree(), 3))
+	}
+
+	setups := map[string]func(cfg *Config){
+		"recursive": func(cfg *Config) {},
+		"packets":   func(cfg *Config) { cfg.Packets = true },
+		"precise":   func(cfg *Config) { cfg.HighPrecision = true },
+	}
+
+	for name, setup := range setups {
+		plain := render(false, false, setup)
+
+		// Without flips up is at the top of the image and right to the right.
+		if c := plain.RGBAAt(width*13/16, height/8); c.R != red.R || c.G != red.G {
+			t.Errorf("%s: expected red in the upper right, got %v", name, c)
+		}
+		if c := plain.RGBAAt(width*3/16, height*7/8); c.R != green.R || c.G != green.G {
+			t.Errorf("%s: expected green in the lower left, got %v", name, c)
+		}
+
+		// Rays are mirrored about the axes of the view, which moves them to the
+		// opposite corner of their pixel. The first row and column are not
+		// compared.
+		for _, flips := range [][2]bool{{true, false}, {false, true}, {true, true}} {
+			flipped := render(flips[0], flips[1], setup)
+			for y := 1; y < height; y++ {
+				for x := 1; x < width; x++ {
+					mx, my := x, y
+					if flips[0] {
+						mx = width - x
+					}
+					if flips[1] {
+						my = height - y
+					}
+
+					if mx < width && my < height && flipped.RGBAAt(x, y) != plain.RGBAAt(mx, my) {
+						t.Fatalf("%s, flip %v: pixel %d,%d is not mirrored from %d,%d", name, flips, x, y, mx, my)
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestDefaultOrientation checks that the view plane of images without flips is
+// the camera basis, bit for bit, so the output of existing renderers does not
+// change.
+func TestDefaultOrientation(t *testing.T) {
+	cameras := []Camera{
+		&LookAtCamera{Pos: Vec3{1.6, 1.4, 1.8}, Look: Vec3{0.5, 0.5, 0.5}},
+		&FreeFlightCamera{Pos: Vec3{0.7, 0.3, 1.5}, XRot: 0.1, YRot: -0.05},
+	}
+
+	var cfg Config
+	for i, camera := range cameras {
+		forward, right, up := cameraBasis(camera)
+		f, r, u := cfg.flippedBasis(camera)
+		if f != forward || r != right || u != up {
+			t.Errorf("camera %d: expected the basis %v, %v, %v, got %v, %v, %v", i, forward, right, up, f, r, u)
+		}
+
+		cfg.FlipX, cfg.FlipY = true, true
+		if _, r, u := cfg.flippedBasis(camera); r != right.Scaled(-1) || u != up.Scaled(-1) {
+			t.Errorf("camera %d: expected the right and up vectors to be negated, got %v, %v", i, r, u)
+		}
+		cfg.FlipX, cfg.FlipY = false, false
+	}
+}
+
+// TestScanPixel walks the tiles of odd and even sized images like traceScanLines.
+// Plain and jittered frames must write every pixel once, and Reconstruct must put
+// the pixels of the two jittered frames in the column of their scan column, so
+// every column of the full image is traced once.
+func TestScanPixel(t *testing.T) {
+	for width := 1; width <= 5; width++ {
+		for height := 1; height <= 6; height++ {
+			size := image.Pt(width, height)
+			for _, tileSize := range []int{0, 2, 4} {
+				jobs := splitTiles(nil, rtJob{rect: image.Rectangle{Max: size}}, size, tileSize)
+
+				// frame returns the scan column written to every pixel by frame idx,
+				// in the red channel.
+				frame := func(idx, cols, jitter int) *image.RGBA {
+					img := image.NewRGBA(image.Rectangle{Max: size})
+					for _, job := range jobs {
+						for h := job.from; h < job.to; h++ {
+							row := scanRow(h, height)
+							if row < job.rect.Min.Y || row >= job.rect.Max.Y {
+								continue
+							}
+							for w := jitterPhase(row, idx)*jitter + job.rect.Min.X*cols; w < width*cols; w += cols {
+								p := scanPixel(w, h, cols, height)
+								if p.X >= job.rect.Max.X {
+									break
+								}
+								if img.RGBAAt(p.X, p.Y).A != 0 {
+									t.Fatalf("%v, tiles of %d, frame %d: pixel %v written twice", size, tileSize, idx, p)
+								}
+								img.SetRGBA(p.X, p.Y, color.RGBA{uint8(w), 0, 0, 255})
+							}
+						}
+					}
+
+					for y := 0; y < height; y++ {
+						for x := 0; x < width; x++ {
+							if img.RGBAAt(x, y).A == 0 {
+								t.Fatalf("%v, tiles of %d, frame %d: pixel %d,%d not written", size, tileSize, idx, x, y)
+							}
+						}
+					}
+					return img
+				}
+
+				plain := frame(0, 1, 0)
+				for y := 0; y < height; y++ {
+					for x := 0; x < width; x++ {
+						if w := int(plain.RGBAAt(x, y).R); w != x {
+							t.Errorf("%v, tiles of %d: pixel %d,%d traced at scan column %d", size, tileSize, x, y, w)
+						}
+					}
+				}
+
+				out := image.NewRGBA(image.Rect(0, 0, width*2, height))
+				if err := Reconstruct(frame(0, 2, 1), frame(1, 2, 1), out); err != nil {
+					t.Fatal(err)
+				}
+				for y := 0; y < height; y++ {
+					for x := 0; x < width*2; x++ {
+						if w := int(out.RGBAAt(x, y).R); w != x {
+							t.Errorf("%v, tiles of %d: column %d of row %d reconstructed from scan column %d", size, tileSize, x, y, w)
+						}
+					}
+				}
+			}
+		}
+	}
+}
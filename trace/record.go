@@ -0,0 +1,208 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FrameSink receives the frames of a recording. Timestamps are the time of the
+// frame since the start of the recording and must not decrease, frames can
+// arrive at a variable rate.
+type FrameSink interface {
+	WriteFrame(img image.Image, ts time.Duration) error
+	Close() error
+}
+
+var errSinkClosed = errors.New("frame sink is closed")
+
+// frameSlot returns the frame of a constant rate stream that a frame at ts is
+// shown from.
+func frameSlot(ts time.Duration, fps float64) int {
+	return int(math.Floor(ts.Seconds()*fps + 0.5))
+}
+
+// fitFrame returns img as an RGBA image of size. Images of another size are
+// scaled to it with the nearest pixel. Buf is reused if it has the right size.
+func fitFrame(img image.Image, size image.Point, buf *image.RGBA) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect == (image.Rectangle{Max: size}) && rgba.Stride == 4*size.X {
+		return rgba
+	}
+
+	if buf == nil || buf.Rect.Size() != size {
+		buf = image.NewRGBA(image.Rectangle{Max: size})
+	}
+
+	b := img.Bounds()
+	for y := 0; y < size.Y; y++ {
+		sy := b.Min.Y + y*b.Dy()/size.Y
+		for x := 0; x < size.X; x++ {
+			sx := b.Min.X + x*b.Dx()/size.X
+			buf.Set(x, y, img.At(sx, sy))
+		}
+	}
+	return buf
+}
+
+// ImageSequence writes every frame to its own file, named by a format string
+// with the frame number. Frames are encoded as JPEG for names ending in .jpg or
+// .jpeg and as PNG otherwise.
+type ImageSequence struct {
+	pattern string
+	quality int
+	n       int
+}
+
+// NewImageSequence returns a sink writing frame i to fmt.Sprintf(pattern, i).
+// Quality is the JPEG quality.
+func NewImageSequence(pattern string, quality int) *ImageSequence {
+	return &ImageSequence{pattern: pattern, quality: quality}
+}
+
+// Name returns the file of frame i.
+func (s *ImageSequence) Name(i int) string {
+	return fmt.Sprintf(s.pattern, i)
+}
+
+func (s *ImageSequence) WriteFrame(img image.Image, ts time.Duration) error {
+	name := s.Name(s.n)
+	fp, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg":
+		err = jpeg.Encode(fp, img, &jpeg.Options{Quality: s.quality})
+	default:
+		err = png.Encode(fp, img)
+	}
+
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		s.n++
+	}
+	return err
+}
+
+func (s *ImageSequence) Close() error {
+	return nil
+}
+
+// PipeArgs splits a command into arguments and replaces {width}, {height} and
+// {fps} with the frame size and rate, for encoders that read raw frames.
+func PipeArgs(command string, size image.Point, fps float64) []string {
+	args := strings.Fields(command)
+	for i, arg := range args {
+		arg = strings.Replace(arg, "{width}", strconv.Itoa(size.X), -1)
+		arg = strings.Replace(arg, "{height}", strconv.Itoa(size.Y), -1)
+		args[i] = strings.Replace(arg, "{fps}", strconv.FormatFloat(fps, 'g', -1, 64), -1)
+	}
+	return args
+}
+
+// PipeSink writes the frames as raw RGBA to the stdin of a command, like
+// ffmpeg -f rawvideo -pix_fmt rgba. Raw video has no timestamps, so frames are
+// repeated to keep their timing at a constant rate, and frames that arrive
+// before their slot is due are dropped.
+type PipeSink struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	size image.Point
+	fps  float64
+	buf  *image.RGBA
+
+	// next is the slot of the next frame, first the timestamp of the first.
+	next    int
+	first   time.Duration
+	started bool
+}
+
+// StartPipe starts cmd and returns a sink writing frames of size to its stdin.
+// With fps at zero every frame is written once, whatever its timestamp.
+func StartPipe(cmd *exec.Cmd, size image.Point, fps float64) (*PipeSink, error) {
+	if size.X <= 0 || size.Y <= 0 || fps < 0 {
+		return nil, errors.New("invalid frame size or rate")
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &PipeSink{cmd: cmd, stdin: stdin, size: size, fps: fps}, nil
+}
+
+func (s *PipeSink) WriteFrame(img image.Image, ts time.Duration) error {
+	if s.stdin == nil {
+		return errSinkClosed
+	}
+
+	if !s.started {
+		s.first, s.started = ts, true
+	}
+
+	repeat := 1
+	if s.fps > 0 {
+		slot := frameSlot(ts-s.first, s.fps)
+		if slot < s.next {
+			return nil
+		}
+		repeat = slot - s.next + 1
+	}
+
+	frame := fitFrame(img, s.size, s.buf)
+	if frame != img {
+		s.buf = frame
+	}
+
+	for ; repeat > 0; repeat-- {
+		if _, err := s.stdin.Write(frame.Pix); err != nil {
+			return err
+		}
+		s.next++
+	}
+	return nil
+}
+
+// Close closes stdin and waits for the command to exit.
+func (s *PipeSink) Close() error {
+	if s.stdin == nil {
+		return errSinkClosed
+	}
+	s.stdin.Close()
+	s.stdin = nil
+	return s.cmd.Wait()
+}
@@ -0,0 +1,116 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestImageSequence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sequence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var sink FrameSink = NewImageSequence(filepath.Join(dir, "frame%03d.png"), 90)
+	for i := 0; i < 3; i++ {
+		if err := sink.WriteFrame(image.NewRGBA(image.Rect(0, 0, 4, 2)), time.Duration(i)*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fp, err := os.Open(filepath.Join(dir, "frame002.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	if img, err := png.Decode(fp); err != nil || img.Bounds() != image.Rect(0, 0, 4, 2) {
+		t.Errorf("unexpected frame: %v", err)
+	}
+}
+
+func TestPipeArgs(t *testing.T) {
+	args := PipeArgs("ffmpeg -s {width}x{height} -r {fps} -i - out.mp4", image.Pt(640, 360), 29.97)
+	if expected := []string{"ffmpeg", "-s", "640x360", "-r", "29.97", "-i", "-", "out.mp4"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("unexpected arguments %q", args)
+	}
+}
+
+func TestPipeSink(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell")
+	}
+
+	dir, err := ioutil.TempDir("", "pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "raw")
+	sink, err := StartPipe(exec.Command("sh", "-c", "cat > "+out), image.Pt(2, 2), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second frame covers three slots, the third is too early for its
+	// slot. Frames are scaled to the size of the pipe.
+	first := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	second := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range second.Pix {
+		second.Pix[i] = 1
+	}
+	for i, ms := range []int{0, 290, 310} {
+		img := first
+		if i > 0 {
+			img = second
+		}
+		if err := sink.WriteFrame(img, time.Duration(ms)*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const frameSize = 2 * 2 * 4
+	if len(data) != 4*frameSize {
+		t.Fatalf("expected 4 frames, got %d bytes", len(data))
+	}
+	if data[0] != 0 || data[frameSize] != 1 || data[len(data)-1] != 1 {
+		t.Error("unexpected frame data")
+	}
+}
@@ -0,0 +1,46 @@
+//go:build linux
+
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// residentPages reports for every page of data if it is in memory.
+func residentPages(data []byte) ([]bool, error) {
+	pageSize := os.Getpagesize()
+	vec := make([]byte, (len(data)+pageSize-1)/pageSize)
+	if len(vec) == 0 {
+		return nil, nil
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_MINCORE, uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), uintptr(unsafe.Pointer(&vec[0])))
+	if errno != 0 {
+		return nil, errno
+	}
+
+	pages := make([]bool, len(vec))
+	for i, v := range vec {
+		pages[i] = v&1 != 0
+	}
+	return pages, nil
+}
@@ -0,0 +1,443 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package scene reads scene files, which place trees in a world with a ground
+// plane, lights, fog and named cameras.
+//
+// Scene files are JSON:
+//
+//	{
+//		"trees": [
+//			{"name": "terrain", "file": "terrain.oct", "scale": 4},
+//			{"name": "rock", "file": "rock.oct", "position": [1, 0.5, 1]}
+//		],
+//		"view_dist": 8,
+//		"ground": {"height": 0, "color": [60, 60, 60], "reflectivity": 0.25},
+//		"fog": {"color": [200, 210, 230], "start": 4, "end": 8},
+//		"ambient": 0.3,
+//		"lights": [{"direction": [-1, -2, -1], "color": [255, 240, 220]}],
+//		"cameras": [{"name": "overview", "position": [2, 3, 6], "look_at": [2, 0, 2]}]
+//	}
+//
+// Tree files are relative to the scene file. Positions are the lower corner of
+// the trees and scales their size, one if not given. Trees can not be rotated
+// by the raytracer, rotation is reserved and must be zero.
+package scene
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+type (
+	// Scene is a loaded scene file.
+	Scene struct {
+		// Config has the view distance, ground plane, fog and lights of the scene
+		// and places the first tree. LoadTrees adds the other trees as its
+		// Instances, in the order of the file, and Place moves the config to
+		// another instance. Images and the other settings are left to the caller.
+		Config trace.Config
+
+		// Instances are the trees of the scene in the order of the file.
+		// Instances of the same file share their tree.
+		Instances []Instance
+
+		// Cameras are the named cameras of the scene, the first is the default.
+		Cameras []Camera
+	}
+
+	// Instance is a tree placed in the scene.
+	Instance struct {
+		Name string
+
+		// File is the tree file, relative to the working directory.
+		File string
+
+		// Tree, Info and MaxDepth are the loaded tree, nil if the scene was only
+		// read.
+		Tree     trace.Octree
+		Info     *trace.TreeInfo
+		MaxDepth int
+
+		Position trace.Vec3
+		Scale    float32
+	}
+
+	// Camera is a named camera of the scene.
+	Camera struct {
+		Name string
+		trace.FreeFlightCamera
+	}
+
+	// Light is a directional light. Surfaces facing Direction are lit by Color,
+	// in linear [0, 1] channels.
+	Light struct {
+		Direction trace.Vec3
+		Color     [3]float32
+	}
+)
+
+// sceneFile is the JSON layout of a scene file.
+type sceneFile struct {
+	Trees []struct {
+		Name     string     `json:"name"`
+		File     string     `json:"file"`
+		Position [3]float32 `json:"position"`
+		Rotation [3]float32 `json:"rotation"`
+		Scale    *float32   `json:"scale"`
+	} `json:"trees"`
+
+	ViewDist float32 `json:"view_dist"`
+
+	Ground *struct {
+		Height       float32  `json:"height"`
+		Color        [3]uint8 `json:"color"`
+		Reflectivity float32  `json:"reflectivity"`
+	} `json:"ground"`
+
+	Fog *struct {
+		Color [3]uint8 `json:"color"`
+		Start float32  `json:"start"`
+		End   float32  `json:"end"`
+	} `json:"fog"`
+
+	Ambient *float32 `json:"ambient"`
+	Lights  []struct {
+		Direction [3]float32 `json:"direction"`
+		Color     *[3]uint8  `json:"color"`
+		Intensity *float32   `json:"intensity"`
+	} `json:"lights"`
+
+	Cameras []struct {
+		Name     string     `json:"name"`
+		Position [3]float32 `json:"position"`
+		LookAt   [3]float32 `json:"look_at"`
+	} `json:"cameras"`
+}
+
+var NoTreesError = errors.New("scene has no trees")
+
+// EntryError is a problem with an entry of a scene file, like the tree
+// "trees[1] (rock)".
+type EntryError struct {
+	Entry string
+	Err   error
+}
+
+func (e *EntryError) Error() string {
+	return e.Entry + ": " + e.Err.Error()
+}
+
+func entryError(list string, i int, name string, format string, a ...interface{}) error {
+	return &EntryError{entryName(list, i, name), fmt.Errorf(format, a...)}
+}
+
+func entryName(list string, i int, name string) string {
+	entry := fmt.Sprintf("%s[%d]", list, i)
+	if name != "" {
+		entry += " (" + name + ")"
+	}
+	return entry
+}
+
+// Load reads the scene file at path and loads its trees.
+func Load(path string) (*Scene, error) {
+	s, err := Read(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.LoadTrees(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Read reads and validates the scene file at path without loading its trees.
+// Errors in the file name the entry they are found in.
+func Read(path string) (*Scene, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	s, err := Decode(fp, filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Decode reads a scene from r. Tree files are resolved relative to dir.
+func Decode(r io.Reader, dir string) (*Scene, error) {
+	var file sceneFile
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, err
+	}
+
+	if len(file.Trees) == 0 {
+		return nil, NoTreesError
+	}
+
+	s := &Scene{Config: trace.Config{ViewDist: file.ViewDist}}
+	if !(file.ViewDist >= 0) {
+		return nil, &EntryError{"view_dist", errors.New("distance is negative")}
+	}
+
+	names := make(map[string]bool)
+	for i, t := range file.Trees {
+		inst := Instance{Name: t.Name, Position: t.Position, Scale: 1}
+		switch {
+		case t.File == "":
+			return nil, entryError("trees", i, t.Name, "no tree file")
+		case t.Name != "" && names[t.Name]:
+			return nil, entryError("trees", i, t.Name, "name is already used")
+		case t.Rotation != [3]float32{}:
+			return nil, entryError("trees", i, t.Name, "trees can not be rotated")
+		case !finite(t.Position[:]...):
+			return nil, entryError("trees", i, t.Name, "position is not finite")
+		}
+		if t.Scale != nil {
+			if !(*t.Scale > 0) || !finite(*t.Scale) {
+				return nil, entryError("trees", i, t.Name, "scale is not positive")
+			}
+			inst.Scale = *t.Scale
+		}
+
+		names[t.Name] = true
+		inst.File = t.File
+		if !filepath.IsAbs(inst.File) {
+			inst.File = filepath.Join(dir, inst.File)
+		}
+		s.Instances = append(s.Instances, inst)
+	}
+	s.Instances[0].Place(&s.Config)
+
+	if g := file.Ground; g != nil {
+		s.Config.GroundPlane = trace.GroundPlane{
+			Enabled:      true,
+			Height:       g.Height,
+			Color:        color.RGBA{g.Color[0], g.Color[1], g.Color[2], 255},
+			Reflectivity: g.Reflectivity,
+		}
+		if !(g.Reflectivity >= 0 && g.Reflectivity <= 1) {
+			return nil, &EntryError{"ground", errors.New("reflectivity is not within [0, 1]")}
+		}
+	}
+
+	if f := file.Fog; f != nil {
+		s.Config.Fog = trace.Fog{
+			Enabled: true,
+			Color:   color.RGBA{f.Color[0], f.Color[1], f.Color[2], 255},
+			Start:   f.Start,
+			End:     f.End,
+		}
+		if !(f.Start >= 0 && f.End > f.Start) {
+			return nil, &EntryError{"fog", errors.New("end is not beyond start")}
+		}
+	}
+
+	if len(file.Lights) > 0 {
+		ambient := float32(0.2)
+		if file.Ambient != nil {
+			ambient = *file.Ambient
+		}
+		if !(ambient >= 0) || !finite(ambient) {
+			return nil, &EntryError{"ambient", errors.New("light is negative")}
+		}
+
+		lights := make([]Light, len(file.Lights))
+		for i, l := range file.Lights {
+			dir, ok := normalize(l.Direction)
+			if !ok {
+				return nil, entryError("lights", i, "", "direction is zero or not finite")
+			}
+
+			c, intensity := [3]uint8{255, 255, 255}, float32(1)
+			if l.Color != nil {
+				c = *l.Color
+			}
+			if l.Intensity != nil {
+				if intensity = *l.Intensity; !(intensity >= 0) || !finite(intensity) {
+					return nil, entryError("lights", i, "", "intensity is negative")
+				}
+			}
+			lights[i] = Light{Direction: dir}
+			for j := range c {
+				lights[i].Color[j] = float32(c[j]) / 255 * intensity
+			}
+		}
+		s.Config.SurfaceShader = LightShader(ambient, lights)
+	} else if file.Ambient != nil {
+		return nil, &EntryError{"ambient", errors.New("ambient light without lights")}
+	}
+
+	names = make(map[string]bool)
+	for i, c := range file.Cameras {
+		switch {
+		case c.Name == "":
+			return nil, entryError("cameras", i, "", "camera has no name")
+		case names[c.Name]:
+			return nil, entryError("cameras", i, c.Name, "name is already used")
+		case !finite(c.Position[:]...) || !finite(c.LookAt[:]...):
+			return nil, entryError("cameras", i, c.Name, "position is not finite")
+		}
+		names[c.Name] = true
+
+		camera, ok := lookAt(c.Position, c.LookAt)
+		if !ok {
+			return nil, entryError("cameras", i, c.Name, "camera looks at its own position")
+		}
+		s.Cameras = append(s.Cameras, Camera{c.Name, camera})
+	}
+	return s, nil
+}
+
+// LoadTrees loads the trees of the instances and places all but the first as
+// Config.Instances. Instances of the same file share the tree, it is loaded once.
+func (s *Scene) LoadTrees() error {
+	loaded := make(map[string]*Instance)
+	for i := range s.Instances {
+		inst := &s.Instances[i]
+		if l, ok := loaded[inst.File]; ok {
+			inst.Tree, inst.Info, inst.MaxDepth = l.Tree, l.Info, l.MaxDepth
+			continue
+		}
+
+		if err := inst.load(); err != nil {
+			return entryError("trees", i, inst.Name, "%v", err)
+		}
+		loaded[inst.File] = inst
+	}
+
+	s.Config.Instances = nil
+	for _, inst := range s.Instances[1:] {
+		s.Config.Instances = append(s.Config.Instances, trace.TreeInstance{
+			Tree:     inst.Tree,
+			MaxDepth: inst.MaxDepth,
+			Position: inst.Position,
+			Scale:    inst.Scale,
+		})
+	}
+	return nil
+}
+
+func (inst *Instance) load() error {
+	fp, err := os.Open(inst.File)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	tree, info, err := trace.LoadOctreeWithInfo(fp)
+	if err != nil {
+		return err
+	}
+	inst.Tree, inst.Info, inst.MaxDepth = tree, info, trace.TreeWidthToDepth(info.VoxelsPerAxis)
+	return nil
+}
+
+// Unplaced returns the entries of the trees Config does not place, like
+// "trees[1] (rock)", all but the first until LoadTrees places them. Programs
+// drawing the scene with a single tree should report them instead of dropping
+// them silently.
+func (s *Scene) Unplaced() []string {
+	var entries []string
+	for i := 1 + len(s.Config.Instances); i < len(s.Instances); i++ {
+		entries = append(entries, entryName("trees", i, s.Instances[i].Name))
+	}
+	return entries
+}
+
+// Place sets the position and scale of cfg to draw the instance.
+func (inst *Instance) Place(cfg *trace.Config) {
+	cfg.TreePosition, cfg.TreeScale = inst.Position, inst.Scale
+}
+
+// Camera returns the camera with the given name.
+func (s *Scene) Camera(name string) (trace.FreeFlightCamera, bool) {
+	for _, c := range s.Cameras {
+		if c.Name == name {
+			return c.FreeFlightCamera, true
+		}
+	}
+	return trace.FreeFlightCamera{}, false
+}
+
+// LightShader returns a surface shader lighting the node colors by the lights and
+// the ambient light, by the face normals of the hits. Misses and hits from
+// inside a node are not lit.
+func LightShader(ambient float32, lights []Light) trace.SurfaceShader {
+	return func(p image.Point, info trace.HitInfo) [3]float32 {
+		base := [3]float32{float32(info.Base.R) / 255, float32(info.Base.G) / 255, float32(info.Base.B) / 255}
+		if !info.Hit || info.Normal == (trace.Vec3{}) {
+			return base
+		}
+
+		light := [3]float32{ambient, ambient, ambient}
+		for _, l := range lights {
+			n, d := info.Normal, l.Direction
+			if facing := -(n[0]*d[0] + n[1]*d[1] + n[2]*d[2]); facing > 0 {
+				for i := range light {
+					light[i] += facing * l.Color[i]
+				}
+			}
+		}
+		return [3]float32{base[0] * light[0], base[1] * light[1], base[2] * light[2]}
+	}
+}
+
+// lookAt returns a camera at pos looking at target, false if they are the same.
+func lookAt(pos, target [3]float32) (trace.FreeFlightCamera, bool) {
+	dir, ok := normalize(trace.Vec3{target[0] - pos[0], target[1] - pos[1], target[2] - pos[2]})
+	if !ok {
+		return trace.FreeFlightCamera{}, false
+	}
+	return trace.FreeFlightCamera{
+		Pos:  pos,
+		XRot: float32(math.Atan2(-float64(dir[0]), -float64(dir[2]))),
+		YRot: float32(math.Asin(float64(dir[1]))),
+	}, true
+}
+
+func normalize(v trace.Vec3) (trace.Vec3, bool) {
+	length := float32(math.Sqrt(float64(v[0]*v[0] + v[1]*v[1] + v[2]*v[2])))
+	if !(length > 0) || !finite(length) {
+		return trace.Vec3{}, false
+	}
+	return trace.Vec3{v[0] / length, v[1] / length, v[2] / length}, true
+}
+
+func finite(v ...float32) bool {
+	for _, f := range v {
+		if math.IsNaN(float64(f)) || math.IsInf(float64(f), 0) {
+			return false
+		}
+	}
+	return true
+}
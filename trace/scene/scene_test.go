@@ -0,0 +1,152 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package scene
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/trace"
+)
+
+func TestLoad(t *testing.T) {
+	s, err := Load("testdata/scene.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type placed struct {
+		name, file string
+		pos        trace.Vec3
+		scale      float32
+	}
+	var instances []placed
+	for _, inst := range s.Instances {
+		if inst.Tree == nil || inst.MaxDepth != 2 {
+			t.Errorf("%s: tree not loaded", inst.Name)
+		}
+		instances = append(instances, placed{inst.Name, inst.File, inst.Position, inst.Scale})
+	}
+
+	expected := []placed{
+		{"terrain", "testdata/terrain.oct", trace.Vec3{-2, 0, -2}, 4},
+		{"rock", "testdata/rock.oct", trace.Vec3{0.5, 0, 0.5}, 0.5},
+		{"boulder", "testdata/rock.oct", trace.Vec3{-1, 0, 1}, 1},
+	}
+	if !reflect.DeepEqual(instances, expected) {
+		t.Errorf("unexpected instances %v", instances)
+	}
+	if &s.Instances[1].Tree[0] != &s.Instances[2].Tree[0] {
+		t.Error("instances of the same file do not share the tree")
+	}
+
+	cfg := s.Config
+	if cfg.TreePosition != (trace.Vec3{-2, 0, -2}) || cfg.TreeScale != 4 || cfg.ViewDist != 10 {
+		t.Errorf("config does not place the first tree: %v %v %v", cfg.TreePosition, cfg.TreeScale, cfg.ViewDist)
+	}
+	if g := cfg.GroundPlane; !g.Enabled || g.Color != (color.RGBA{60, 60, 60, 255}) || g.Reflectivity != 0.25 {
+		t.Errorf("unexpected ground plane %+v", g)
+	}
+	if f := cfg.Fog; !f.Enabled || f.Start != 4 || f.End != 8 {
+		t.Errorf("unexpected fog %+v", f)
+	}
+
+	if len(cfg.Instances) != 2 || cfg.Instances[1].Tree == nil || cfg.Instances[1].Position != (trace.Vec3{-1, 0, 1}) || cfg.Instances[0].Scale != 0.5 {
+		t.Errorf("config does not place the other trees as instances: %+v", cfg.Instances)
+	}
+	if unplaced := s.Unplaced(); unplaced != nil {
+		t.Errorf("unexpected unplaced trees %v", unplaced)
+	}
+	if read, err := Read("testdata/scene.json"); err != nil {
+		t.Fatal(err)
+	} else if unplaced := read.Unplaced(); !reflect.DeepEqual(unplaced, []string{"trees[1] (rock)", "trees[2] (boulder)"}) {
+		t.Errorf("unexpected unplaced trees %v", unplaced)
+	}
+
+	s.Instances[1].Place(&cfg)
+	if cfg.TreePosition != (trace.Vec3{0.5, 0, 0.5}) || cfg.TreeScale != 0.5 {
+		t.Errorf("unexpected placement %v %v", cfg.TreePosition, cfg.TreeScale)
+	}
+
+	// Lit from above, top faces get the ambient light and half the light.
+	base := color.RGBA{200, 100, 0, 255}
+	c := cfg.SurfaceShader(image.Point{}, trace.HitInfo{Hit: true, Normal: trace.Vec3{0, 1, 0}, Base: base})
+	if math.Abs(float64(c[0])-200.0/255*0.75) > 1e-5 || c[2] != 0 {
+		t.Errorf("unexpected lit color %v", c)
+	}
+	c = cfg.SurfaceShader(image.Point{}, trace.HitInfo{Hit: true, Normal: trace.Vec3{1, 0, 0}, Base: base})
+	if math.Abs(float64(c[0])-200.0/255*0.25) > 1e-5 {
+		t.Errorf("unexpected ambient color %v", c)
+	}
+
+	if len(s.Cameras) != 2 || s.Cameras[0].Name != "overview" {
+		t.Fatalf("unexpected cameras %v", s.Cameras)
+	}
+	camera, ok := s.Camera("rock")
+	if !ok || camera.Pos != (trace.Vec3{0.75, 0.25, 2}) {
+		t.Fatalf("unexpected camera %v", camera)
+	}
+	if look := camera.LookAt(); math.Abs(float64(look[2]-1)) > 1e-5 || math.Abs(float64(look[0]-0.75)) > 1e-5 {
+		t.Errorf("camera looks at %v", look)
+	}
+	if _, ok := s.Camera("missing"); ok {
+		t.Error("found a missing camera")
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for _, test := range []struct {
+		scene, entry string
+	}{
+		{`{"trees": []}`, ""},
+		{`{"trees": [{"name": "a", "file": "a.oct"}, {"name": "b"}]}`, "trees[1] (b)"},
+		{`{"trees": [{"name": "a", "file": "a.oct"}, {"name": "a", "file": "b.oct"}]}`, "trees[1] (a)"},
+		{`{"trees": [{"file": "a.oct", "scale": 0}]}`, "trees[0]"},
+		{`{"trees": [{"name": "a", "file": "a.oct", "rotation": [0, 1, 0]}]}`, "trees[0] (a)"},
+		{`{"trees": [{"file": "a.oct"}], "ground": {"reflectivity": 2}}`, "ground"},
+		{`{"trees": [{"file": "a.oct"}], "fog": {"start": 2, "end": 1}}`, "fog"},
+		{`{"trees": [{"file": "a.oct"}], "lights": [{"direction": [0, -1, 0]}, {"direction": [0, 0, 0]}]}`, "lights[1]"},
+		{`{"trees": [{"file": "a.oct"}], "cameras": [{"name": "a", "position": [0, 0, 1]}, {"name": "a"}]}`, "cameras[1] (a)"},
+		{`{"trees": [{"file": "a.oct"}], "cameras": [{"name": "a", "position": [1, 1, 1], "look_at": [1, 1, 1]}]}`, "cameras[0] (a)"},
+	} {
+		_, err := Decode(strings.NewReader(test.scene), ".")
+		if test.entry == "" {
+			if err != NoTreesError {
+				t.Errorf("%s: expected no trees, got %v", test.scene, err)
+			}
+			continue
+		}
+		if e, ok := err.(*EntryError); !ok || e.Entry != test.entry {
+			t.Errorf("%s: expected an error in %s, got %v", test.scene, test.entry, err)
+		}
+	}
+}
+
+func TestLoadMissingTree(t *testing.T) {
+	s, err := Decode(strings.NewReader(`{"trees": [{"file": "terrain.oct"}, {"name": "gone", "file": "missing.oct"}]}`), "testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.LoadTrees(); err == nil || !strings.HasPrefix(err.Error(), "trees[1] (gone): ") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
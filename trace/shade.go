@@ -0,0 +1,136 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Shader returns the color of the pixel p, with channels in [0, 1], before it is
+// quantized to 8 bits. base is the node color, or the clear color if the ray did
+// not hit anything, and dist is the distance along the ray.
+type Shader func(p image.Point, base color.RGBA, dist float32, hit bool) [3]float32
+
+// HitInfo describes the surface seen by a pixel. Position is the world space hit
+// point and Normal the axis aligned normal of the node face the ray entered, both
+// are zero if nothing was hit. The normal is also zero if the ray started inside
+// the node, and points up for hits on the ground plane. Node is the index of the
+// node hit, like in Config.PickBuffer, and PickMiss for misses, the ground plane
+// and pixels shaded without a SurfaceShader. Instance is the tree of the node,
+// like in Config.InstanceBuffer, and InstanceMiss where Node is PickMiss.
+type HitInfo struct {
+	Hit      bool
+	Distance float32
+	Position Vec3
+	Normal   Vec3
+	Base     color.RGBA
+	Node     uint32
+	Instance uint16
+}
+
+// SurfaceShader works like Shader but is also given the hit position and face
+// normal, which allows lighting trees without stored normals.
+type SurfaceShader func(p image.Point, info HitInfo) [3]float32
+
+// bayerMatrix is the 4x4 ordered dither matrix.
+var bayerMatrix = [4][4]float32{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+// ditherOffset returns a threshold in (-0.5, 0.5) for the pixel p. It only depends on
+// the pixel coordinate so the pattern is stable between frames.
+func ditherOffset(p image.Point) float32 {
+	return (bayerMatrix[p.Y&3][p.X&3]+0.5)/16 - 0.5
+}
+
+func quantize(v, offset float32) uint8 {
+	v = v*255 + 0.5 + offset
+	if v <= 0 {
+		return 0
+	} else if v >= 255 {
+		return 255
+	}
+	return uint8(v)
+}
+
+// shade returns the final color of the pixel p, in the channel order of the frame
+// buffers. Without a Shader the node color is used as is, so Dither has no effect
+// on it. Fog and the LUT are applied last.
+func (rt *Raytracer) shade(p image.Point, tree []octreeNode, index uint32, dist float32, hit bool) color.RGBA {
+	return rt.shadeColor(p, rt.nodeColor(tree, index, hit), dist, hit)
+}
+
+// shadeColor works like shade but starts from the base color c.
+func (rt *Raytracer) shadeColor(p image.Point, c color.RGBA, dist float32, hit bool) color.RGBA {
+	info := HitInfo{Hit: hit, Distance: dist, Base: c, Node: PickMiss, Instance: InstanceMiss}
+	return rt.shadeHit(p, &info)
+}
+
+// shadeHit works like shadeColor but is given the whole hit for a SurfaceShader.
+func (rt *Raytracer) shadeHit(p image.Point, info *HitInfo) color.RGBA {
+	c := rt.shadeRGBA(p, info)
+	if rt.cfg.exposureEnabled() {
+		c = rt.expose(c)
+	}
+	if rt.cfg.LUT != nil {
+		c = rt.cfg.LUT.Apply(c)
+	}
+	if rt.bgra {
+		c.R, c.B = c.B, c.R
+	}
+	return c
+}
+
+func (rt *Raytracer) shadeRGBA(p image.Point, info *HitInfo) color.RGBA {
+	c, dist, hit := info.Base, info.Distance, info.Hit
+	fog := rt.cfg.Fog.factor(dist, rt.cfg.ViewDist, hit)
+
+	shader, surface := rt.cfg.Shader, rt.cfg.SurfaceShader
+	if shader == nil && surface == nil {
+		if fog > 0 {
+			return rt.cfg.Fog.blend(c, fog)
+		}
+		return c
+	}
+
+	var offset float32
+	if rt.cfg.Dither {
+		offset = ditherOffset(p)
+	}
+
+	var rgb [3]float32
+	if surface != nil {
+		rgb = surface(p, *info)
+	} else {
+		rgb = shader(p, c, dist, hit)
+	}
+	for i, v := range rgb {
+		if math.IsNaN(float64(v)) {
+			rgb[i] = 0
+		}
+	}
+	if fog > 0 {
+		rt.cfg.Fog.blendRGB(&rgb, fog)
+	}
+	return color.RGBA{quantize(rgb[0], offset), quantize(rgb[1], offset), quantize(rgb[2], offset), c.A}
+}
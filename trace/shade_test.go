@@ -0,0 +1,79 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func renderGradient(dither bool) *image.RGBA {
+	rect := image.Rect(0, 0, 64, 64)
+	tree := testSphere(5)
+
+	// Horizontal bands spanning a few 8-bit levels from top to bottom.
+	gradient := func(p image.Point, base color.RGBA, dist float32, hit bool) [3]float32 {
+		v := 0.25 + 0.05*float32(p.Y)/float32(rect.Dy())
+		return [3]float32{v, v, v}
+	}
+
+	rt := NewRaytracer(Config{
+		FieldOfView: 0.8,
+		TreeScale:   1,
+		ViewDist:    5,
+		Shader:      gradient,
+		Dither:      dither,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	defer rt.Close()
+
+	camera := LookAtCamera{Pos: Vec3{0.5, 0.5, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	return rt.Image(rt.Trace(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis())))
+}
+
+func uniqueValues(img *image.RGBA, y int) int {
+	values := make(map[uint8]bool)
+	for x := 0; x < img.Bounds().Dx(); x++ {
+		values[img.RGBAAt(x, y).R] = true
+	}
+	return len(values)
+}
+
+func TestDither(t *testing.T) {
+	plain := renderGradient(false)
+	dithered := renderGradient(true)
+
+	var numPlain, numDithered int
+	for y := 0; y < plain.Bounds().Dy(); y++ {
+		if n := uniqueValues(plain, y); n != 1 {
+			t.Fatalf("expected a single value in row %d without dither, got %d", y, n)
+		}
+		numPlain++
+		numDithered += uniqueValues(dithered, y)
+	}
+
+	if numDithered <= numPlain {
+		t.Errorf("expected more unique values per row with dither, got %d and %d", numDithered, numPlain)
+	}
+
+	// The pattern is fixed to the pixel coordinate so frames do not shimmer.
+	if n := countDiff(dithered, renderGradient(true)); n != 0 {
+		t.Errorf("%d pixels differ between dithered frames", n)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import "sync/atomic"
+
+// TreeSnapshot is a tree that is never written to again, so any number of
+// raytracers can render it at once. Snapshots are reference counted. The creator
+// holds the first reference, every raytracer it is set on and every frame
+// rendering it hold one more, and release is called when the last one is
+// dropped.
+//
+// The child masks of the nodes are stored with the snapshot, so the traversal of
+// frames rendering it reads one byte of a node to find its children. Trees passed
+// directly to Trace find them in the nodes.
+type TreeSnapshot struct {
+	tree     Octree
+	masks    []uint8
+	maxDepth int
+	refs     int32
+	release  func()
+}
+
+// NewTreeSnapshot returns a snapshot of tree with one reference, held by the
+// caller. The tree must not be changed after this. Release may be nil. Every node
+// is read to find its child mask, which pages in all of a mapped tree.
+func NewTreeSnapshot(tree Octree, maxDepth int, release func()) *TreeSnapshot {
+	return &TreeSnapshot{tree: tree, masks: childMasks(tree), maxDepth: maxDepth, refs: 1, release: release}
+}
+
+func (s *TreeSnapshot) Tree() Octree {
+	return s.tree
+}
+
+func (s *TreeSnapshot) MaxDepth() int {
+	return s.maxDepth
+}
+
+// Acquire adds a reference to the snapshot. False is returned if the last
+// reference was already dropped, the snapshot must not be used then.
+func (s *TreeSnapshot) Acquire() bool {
+	for {
+		refs := atomic.LoadInt32(&s.refs)
+		if refs <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&s.refs, refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// Release drops a reference. Nil snapshots are ignored.
+func (s *TreeSnapshot) Release() {
+	if s == nil {
+		return
+	}
+
+	refs := atomic.AddInt32(&s.refs, -1)
+	if refs < 0 {
+		panic("tree snapshot released too many times")
+	}
+	if refs == 0 && s.release != nil {
+		s.release()
+	}
+}
+
+// Snapshot returns a snapshot of the current tree, the caller holds its
+// reference. The tree is copied before the next edit, so the snapshot is never
+// changed.
+func (t *MutableTree) Snapshot() *TreeSnapshot {
+	t.frozen = true
+	return NewTreeSnapshot(t.tree[:len(t.tree):len(t.tree)], TreeWidthToDepth(t.vpa), nil)
+}
+
+// thaw copies the tree if a snapshot of it was taken, before it is edited.
+func (t *MutableTree) thaw() {
+	if t.frozen {
+		t.tree = append(Octree(nil), t.tree...)
+		t.frozen = false
+	}
+}
+
+// acquireSnapshot returns the snapshot set with SetSnapshot with a reference
+// added, nil if there is none.
+func (rt *Raytracer) acquireSnapshot() *TreeSnapshot {
+	for {
+		s := rt.snapshot.Load()
+		if s == nil || s.Acquire() {
+			return s
+		}
+		// The snapshot was replaced and released since it was loaded.
+	}
+}
+
+// SetSnapshot sets the tree used by Trace when called without a tree. The
+// raytracer keeps a reference until the snapshot is replaced or the raytracer
+// closed, frames in flight keep the tree they were started with and their own
+// reference. False is returned, and the tree kept, if the last reference to s
+// was already dropped. The caller keeps its reference.
+func (rt *Raytracer) SetSnapshot(s *TreeSnapshot) bool {
+	if s != nil && !s.Acquire() {
+		return false
+	}
+	rt.snapshot.Swap(s).Release()
+	return true
+}
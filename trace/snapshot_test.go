@@ -0,0 +1,197 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func snapshotRaytracer() *Raytracer {
+	rect := image.Rect(0, 0, 16, 16)
+	return NewRaytracer(Config{
+		FieldOfView:   0.2,
+		TreeScale:     1,
+		ViewDist:      10,
+		MultiThreaded: true,
+		Images:        [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+}
+
+func TestTreeSnapshotRelease(t *testing.T) {
+	var released int32
+	s := NewTreeSnapshot(solidCube(2, color.RGBA{255, 0, 0, 255}).Octree(), 3, func() {
+		atomic.AddInt32(&released, 1)
+	})
+
+	rt := snapshotRaytracer()
+	if !rt.SetSnapshot(s) {
+		t.Fatal("could not set snapshot")
+	}
+	s.Release()
+
+	camera := LookAtCamera{Pos: Vec3{0.375, 0.375, 2}, Look: Vec3{0.375, 0.375, 0}}
+	idx := rt.Trace(&camera, nil, 0)
+
+	// The frame keeps the snapshot after it is replaced.
+	rt.SetTree(solidCube(2, color.RGBA{0, 255, 0, 255}).Octree(), 3)
+	if c := rt.Image(idx).RGBAAt(8, 8); c.R != 255 {
+		t.Errorf("expected red, got %v", c)
+	}
+	if atomic.LoadInt32(&released) != 1 {
+		t.Fatal("expected the snapshot to be released after the frame")
+	}
+
+	if s.Acquire() || rt.SetSnapshot(s) {
+		t.Error("released snapshots can not be used again")
+	}
+	rt.Close()
+}
+
+// TestSnapshotMasks renders a tree from a snapshot, with the child masks stored,
+// and passed to Trace, with the masks read from the nodes. The frames and the
+// number of visited nodes must be the same.
+func TestSnapshotMasks(t *testing.T) {
+	tree := testSphere(4).Octree()
+
+	s := NewTreeSnapshot(tree, 4, nil)
+	defer s.Release()
+	for i := range tree {
+		if s.masks[i] != tree[i].childMask() || (s.masks[i] == 0) != tree[i].leaf() {
+			t.Fatalf("node %d has mask %08b, expected %08b", i, s.masks[i], tree[i].childMask())
+		}
+	}
+
+	for _, packets := range []bool{false, true} {
+		rect := image.Rect(0, 0, 32, 32)
+		rt := NewRaytracer(Config{
+			FieldOfView:  0.8,
+			TreeScale:    1,
+			ViewDist:     5,
+			Packets:      packets,
+			DoubleBuffer: true,
+			Images:       [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		})
+		rt.SetSnapshot(s)
+
+		camera := LookAtCamera{Pos: Vec3{-0.5, 1.2, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+		stored := rt.Trace(&camera, nil, 0)
+		rt.Wait(stored)
+		read := rt.Trace(&camera, tree, 4)
+		rt.Wait(read)
+		if stored == read {
+			t.Fatal("expected the frames in different images")
+		}
+
+		if !reflect.DeepEqual(rt.Image(stored).Pix, rt.Image(read).Pix) {
+			t.Errorf("packets %v: frames differ", packets)
+		}
+		if a, b := rt.Stats(stored).NodeVisits, rt.Stats(read).NodeVisits; a != b || a == 0 {
+			t.Errorf("packets %v: %d nodes visited with stored masks, %d without", packets, a, b)
+		}
+		rt.Close()
+	}
+}
+
+// TestConcurrentSnapshots edits a tree in one goroutine while four raytracers
+// render its snapshots. Run with -race.
+func TestConcurrentSnapshots(t *testing.T) {
+	const (
+		numTracers = 4
+		numEdits   = 50
+	)
+
+	tree := solidCube(2, color.RGBA{255, 0, 0, 255})
+	tracers := make([]*Raytracer, numTracers)
+	for i := range tracers {
+		tracers[i] = snapshotRaytracer()
+	}
+
+	var (
+		created, released int32
+		changed           int32
+	)
+
+	// publish sets a snapshot of the tree on all raytracers. The snapshot checks
+	// that its nodes are unchanged when the last frame is done with it.
+	publish := func() {
+		s := tree.Snapshot()
+		nodes := append(Octree(nil), s.Tree()...)
+		checked := NewTreeSnapshot(s.Tree(), s.MaxDepth(), func() {
+			if !reflect.DeepEqual(nodes, s.Tree()) {
+				atomic.AddInt32(&changed, 1)
+			}
+			atomic.AddInt32(&released, 1)
+		})
+		atomic.AddInt32(&created, 1)
+
+		for _, rt := range tracers {
+			rt.SetSnapshot(checked)
+		}
+		checked.Release()
+		s.Release()
+	}
+	publish()
+
+	var (
+		wg   sync.WaitGroup
+		stop = make(chan struct{})
+	)
+	for i, rt := range tracers {
+		wg.Add(1)
+		go func(i int, rt *Raytracer) {
+			defer wg.Done()
+			camera := LookAtCamera{Pos: Vec3{0.5, 0.5, 2 + float32(i)}, Look: Vec3{0.5, 0.5, 0}}
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				rt.Wait(rt.Trace(&camera, nil, 0))
+			}
+		}(i, rt)
+	}
+
+	for i := 0; i < numEdits; i++ {
+		pos := [3]float32{float32(i%4) / 4, float32(i/4%4) / 4, 0.9}
+		if i%3 == 2 {
+			tree.ClearVoxel(pos, 2)
+		} else {
+			tree.SetVoxel(pos, 2, color.RGBA{0, uint8(i * 5), 255, 255})
+		}
+		publish()
+	}
+
+	close(stop)
+	wg.Wait()
+	for _, rt := range tracers {
+		rt.Close()
+	}
+
+	if n := atomic.LoadInt32(&changed); n != 0 {
+		t.Errorf("%d snapshots changed while they were rendered", n)
+	}
+	if c, r := atomic.LoadInt32(&created), atomic.LoadInt32(&released); c != r {
+		t.Errorf("%d snapshots created but %d released", c, r)
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+
+	"github.com/andreas-jonsson/octatron/go3d/vec3"
+)
+
+type (
+	// eyeCamera is a camera moved along the right vector of another camera. The
+	// view direction is kept so both eyes converge at infinity.
+	eyeCamera struct {
+		pos, look, up Vec3
+	}
+
+	stereoView struct {
+		camera Camera
+		view   image.Rectangle
+	}
+)
+
+func (c *eyeCamera) Position() Vec3 {
+	return c.pos
+}
+
+func (c *eyeCamera) LookAt() Vec3 {
+	return c.look
+}
+
+func (c *eyeCamera) Up() Vec3 {
+	return c.up
+}
+
+// stereoViews returns the left and right eye of camera and the half of bounds each
+// of them is rendered to.
+func stereoViews(camera Camera, separation float32, bounds image.Rectangle) [2]stereoView {
+	_, u, _ := cameraBasis(camera)
+	pos, look := vec3.T(camera.Position()), vec3.T(camera.LookAt())
+
+	// The left half is rounded down, odd widths give the extra column to the right eye.
+	middle := bounds.Min.X + bounds.Dx()/2
+	left, right := bounds, bounds
+	left.Max.X, right.Min.X = middle, middle
+
+	var views [2]stereoView
+	for i, view := range [2]image.Rectangle{left, right} {
+		offset := u.Scaled(separation * (float32(i) - 0.5))
+		views[i] = stereoView{
+			camera: &eyeCamera{
+				pos:  Vec3(vec3.Add(&pos, &offset)),
+				look: Vec3(vec3.Add(&look, &offset)),
+				up:   camera.Up(),
+			},
+			view: view,
+		}
+	}
+	return views
+}
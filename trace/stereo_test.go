@@ -0,0 +1,114 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func renderStereo(width int, separation, scale, distance float32, highPrecision bool) *image.RGBA {
+	rect := image.Rect(0, 0, width, 64)
+	tree := testSphere(5)
+
+	// White where the tree was hit, black elsewhere.
+	mask := func(p image.Point, base color.RGBA, dist float32, hit bool) [3]float32 {
+		if hit {
+			return [3]float32{1, 1, 1}
+		}
+		return [3]float32{}
+	}
+
+	rt := NewRaytracer(Config{
+		FieldOfView:   0.8,
+		TreeScale:     scale,
+		ViewDist:      distance * 2,
+		Stereo:        separation,
+		Shader:        mask,
+		HighPrecision: highPrecision,
+		Images:        [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	defer rt.Close()
+
+	center := scale / 2
+	camera := LookAtCamera{Pos: Vec3{center, center, center + distance}, Look: Vec3{center, center, center}}
+	return rt.Image(rt.Trace(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis())))
+}
+
+// centroid returns the mean x coordinate, relative to the center of r, of the hit
+// pixels in r.
+func centroid(img *image.RGBA, r image.Rectangle) float64 {
+	var sum, num float64
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if img.RGBAAt(x, y).R != 0 {
+				sum += float64(x - r.Min.X)
+				num++
+			}
+		}
+	}
+	return sum/num - float64(r.Dx()-1)/2
+}
+
+func TestStereo(t *testing.T) {
+	const (
+		fov        = 0.8
+		separation = 0.1
+	)
+
+	for _, width := range []int{128, 129} {
+		for _, highPrecision := range []bool{false, true} {
+			left := image.Rect(0, 0, width/2, 64)
+			right := image.Rect(width/2, 0, width, 64)
+			if right.Dx() != width-width/2 {
+				t.Fatal("unexpected right half")
+			}
+
+			// The near sphere is shifted by the parallax between the eyes.
+			img := renderStereo(width, separation, 1, 1.5, highPrecision)
+			focal := float64(left.Dx()) / 2 / math.Tan(fov/2)
+			expected := separation * focal / 1.5
+
+			if d := centroid(img, left) - centroid(img, right); math.Abs(d-expected) > 0.75 {
+				t.Errorf("width %d: expected parallax of %.2f pixels, got %.2f", width, expected, d)
+			}
+
+			// A sphere far away is at infinity for the eyes.
+			img = renderStereo(width, separation, 400, 1800, highPrecision)
+			if d := centroid(img, left) - centroid(img, right); math.Abs(d) > 0.05 {
+				t.Errorf("width %d: expected no parallax at infinity, got %.2f pixels", width, d)
+			}
+
+			if width%2 == 0 {
+				var diff int
+				for y := 0; y < 64; y++ {
+					for x := 0; x < left.Dx(); x++ {
+						if img.RGBAAt(x, y) != img.RGBAAt(x+right.Min.X, y) {
+							diff++
+						}
+					}
+				}
+				if diff != 0 {
+					t.Errorf("%d pixels differ between the eyes at infinity", diff)
+				}
+			}
+		}
+	}
+}
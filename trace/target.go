@@ -0,0 +1,54 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import "image"
+
+// PixelOrder is the order of the color channels of a PixelBuffer.
+type PixelOrder int
+
+const (
+	RGBA PixelOrder = iota
+	BGRA
+)
+
+// PixelBuffer is memory owned by the caller that frames are rendered to, like a
+// mapped texture or the input of a video encoder. Rows are Stride bytes apart and
+// pixels are four bytes in Order.
+type PixelBuffer struct {
+	Pix    []byte
+	Stride int
+	Order  PixelOrder
+	W, H   int
+}
+
+func (b *PixelBuffer) validate() error {
+	if b.W <= 0 || b.H <= 0 || b.Stride < 4*b.W || len(b.Pix) < b.Stride*(b.H-1)+4*b.W {
+		return InvalidTargetError
+	}
+	if b.Order != RGBA && b.Order != BGRA {
+		return InvalidTargetError
+	}
+	return nil
+}
+
+// image returns an image sharing the memory of the buffer. The channels are in the
+// order of the buffer.
+func (b *PixelBuffer) image() *image.RGBA {
+	return &image.RGBA{Pix: b.Pix, Stride: b.Stride, Rect: image.Rect(0, 0, b.W, b.H)}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"errors"
+	"image"
+	"testing"
+)
+
+func TestPixelBuffer(t *testing.T) {
+	const (
+		w, h    = 24, 16
+		stride  = 4*w + 12
+		padding = 0xaa
+	)
+
+	tree := testSphere(3)
+	camera := LookAtCamera{Pos: Vec3{0.3, 0.6, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+
+	cfg := Config{
+		FieldOfView:   0.8,
+		TreeScale:     1,
+		ViewDist:      5,
+		MultiThreaded: true,
+	}
+
+	rect := image.Rect(0, 0, w, h)
+	cfg.Images = [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}
+	expected, _ := renderTestFrame(tree, cfg, &camera)
+
+	for _, order := range []PixelOrder{RGBA, BGRA} {
+		// The buffer starts out stale, every pixel must be replaced and the row
+		// padding kept.
+		target := &PixelBuffer{Pix: make([]byte, stride*h), Stride: stride, Order: order, W: w, H: h}
+		for i := range target.Pix {
+			target.Pix[i] = padding
+		}
+
+		cfg.Images = [2]*image.RGBA{}
+		cfg.Target = target
+		renderTestFrame(tree, cfg, &camera)
+
+		for y := 0; y < h; y++ {
+			row := target.Pix[y*stride:]
+			for x := 0; x < w; x++ {
+				c := expected.RGBAAt(x, y)
+				pix := [4]byte{c.R, c.G, c.B, c.A}
+				if order == BGRA {
+					pix[0], pix[2] = pix[2], pix[0]
+				}
+
+				if got := [4]byte{row[x*4], row[x*4+1], row[x*4+2], row[x*4+3]}; got != pix {
+					t.Fatalf("order %v, pixel %v,%v is %v, expected %v", order, x, y, got, pix)
+				}
+			}
+
+			for i := 4 * w; i < stride; i++ {
+				if row[i] != padding {
+					t.Fatalf("order %v, padding of row %v was written", order, y)
+				}
+			}
+		}
+	}
+}
+
+func TestInvalidPixelBuffer(t *testing.T) {
+	valid := PixelBuffer{Pix: make([]byte, 4*8*8), Stride: 4 * 8, W: 8, H: 8}
+	if err := valid.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	short, narrow, order := valid, valid, valid
+	short.Pix = short.Pix[:len(short.Pix)-1]
+	narrow.Stride = 4*8 - 1
+	order.Order = 2
+
+	for _, b := range []PixelBuffer{short, narrow, order, {}} {
+		if err := b.validate(); err != InvalidTargetError {
+			t.Errorf("expected InvalidTargetError for %+v, got %v", b, err)
+		}
+	}
+
+	cfg := Config{FieldOfView: 0.8, Jitter: true, Target: &valid}
+	if err := cfg.Validate(); !errors.Is(err, TargetFramesError) {
+		t.Errorf("expected TargetFramesError, got %v", err)
+	}
+}
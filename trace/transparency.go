@@ -0,0 +1,190 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/andreas-jonsson/octatron/go3d/vec3"
+)
+
+// TransparencyMode selects how the alpha of nodes is used, see
+// Config.Transparency.
+type TransparencyMode int
+
+const (
+	// Opaque ignores alpha, trees can store a classification code in it. See
+	// NodeAttributes.Class.
+	Opaque TransparencyMode = iota
+
+	// Composite blends the nodes along the ray front to back by their alpha,
+	// until the ray is opaque. Every node in front of the hit is shaded, dense
+	// transparent regions are costly.
+	Composite
+
+	// Stochastic passes through a node with the probability of its
+	// transparency, decided by a hash of the pixel, the sample and the node, so
+	// a frame costs the same as an opaque frame. With Samples or Accumulate the
+	// image converges to that of Composite.
+	Stochastic
+)
+
+// compositeOpacity is the opacity at which Composite treats a ray as opaque.
+// The node that makes it opaque is the hit.
+const compositeOpacity = 0.995
+
+type (
+	transparentLayer struct {
+		index uint32
+		dist  float32
+		alpha float32
+	}
+
+	// transparentRay is the state of a ray through transparent nodes. Seed is
+	// the hash of the pixel and sample used by Stochastic, layers are the nodes
+	// Composite passed through, front to back.
+	transparentRay struct {
+		seed    uint64
+		opacity float32
+		layers  []transparentLayer
+	}
+)
+
+// mix returns h with its bits mixed, from SplitMix64.
+func mix(h uint64) uint64 {
+	h += 0x9e3779b97f4a7c15
+	h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+	h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+	return h ^ (h >> 31)
+}
+
+// reset starts a new ray through pixel x, y for sample.
+func (tr *transparentRay) reset(x, y, sample int) {
+	tr.seed = mix(mix(mix(uint64(x))^uint64(y)) ^ uint64(sample))
+	tr.restart()
+}
+
+// restart drops the layers, to trace the same ray again.
+func (tr *transparentRay) restart() {
+	tr.opacity = 0
+	tr.layers = tr.layers[:0]
+}
+
+// chance returns a value in [0, 1) for node index, the same for every trace of
+// the ray.
+func (tr *transparentRay) chance(index uint32) float32 {
+	return float32(mix(tr.seed^uint64(index))>>40) / (1 << 24)
+}
+
+// stops reports if the ray ends at the node at index, where the traversal of
+// the tree ends. Nodes the ray passes through are added to the layers of
+// Composite rays.
+func (rt *Raytracer) stops(tree []octreeNode, index uint32, dist float32, tr *transparentRay) bool {
+	if rt.filtered(tree, index) {
+		return false
+	}
+
+	alpha := float32(tree[index].getClass()) / 255
+	if rt.cfg.Transparency == Stochastic {
+		return alpha >= 1 || tr.chance(index) < alpha
+	}
+
+	if alpha >= 1 || tr.opacity+(1-tr.opacity)*alpha >= compositeOpacity {
+		return true
+	}
+	if alpha > 0 {
+		tr.layers = append(tr.layers, transparentLayer{index, dist, alpha})
+		tr.opacity += (1 - tr.opacity) * alpha
+	}
+	return false
+}
+
+// intersectTransparent is intersectFiltered for Config.Transparency. Nodes where
+// the traversal ends are treated as empty if the ray passes through them.
+func (rt *Raytracer) intersectTransparent(tree []octreeNode, masks []uint8, ray *infiniteRay, nodePos *vec3.T, nodeScale, length, maxDepth float32, nodeIndex, treeDepth uint32, visits *uint64, tr *transparentRay) (float32, uint32, uint32, bool) {
+	var (
+		node = &tree[nodeIndex]
+
+		// Declare this here to avoid runtime allocation.
+		pos vec3.T
+	)
+
+	*visits++
+
+	box := vec3.Box{Min: *nodePos, Max: vec3.T{nodePos[0] + nodeScale, nodePos[1] + nodeScale, nodePos[2] + nodeScale}}
+	boxDist := intersectBox(ray, length, &box, rt.epsilon*nodeScale)
+
+	if boxDist == length {
+		return length, 0, 0, false
+	}
+
+	d := boxDist / rt.cfg.ViewDist
+	if node.leaf() || treeDepth > uint32(maxDepth*(1-d*d)) {
+		if !rt.stops(tree, nodeIndex, boxDist, tr) {
+			return length, 0, 0, false
+		}
+		return boxDist, nodeIndex, treeDepth, true
+	}
+
+	mask := nodeMask(tree, masks, nodeIndex)
+	childScale := nodeScale * 0.5
+	childDepth := treeDepth + 1
+	order := childOrder(&ray[1])
+
+	for k := 0; k < 8; k++ {
+		i := k ^ order
+		if mask&(1<<uint(i)) == 0 {
+			continue
+		}
+
+		scaled := childPositions[i].Scaled(childScale)
+		pos = vec3.Add(nodePos, &scaled)
+
+		if ln, idx, depth, ok := rt.intersectTransparent(tree, masks, ray, &pos, childScale, length, maxDepth, node.getChild(i), childDepth, visits, tr); ok && ln < length {
+			return ln, idx, depth, true
+		}
+	}
+	return length, 0, 0, false
+}
+
+// composite blends the layers of a Composite ray over c, the shaded color
+// behind them. Distances are from the eye.
+func (rt *Raytracer) composite(p image.Point, tree []octreeNode, tr *transparentRay, near float32, c color.RGBA) color.RGBA {
+	var (
+		sum           [4]float32
+		transmittance = float32(1)
+	)
+
+	for _, layer := range tr.layers {
+		lc := rt.shadeColor(p, tree[layer.index].getColor(), layer.dist+near, true)
+		w := transmittance * layer.alpha
+		sum[0] += w * float32(lc.R)
+		sum[1] += w * float32(lc.G)
+		sum[2] += w * float32(lc.B)
+		sum[3] += w * float32(lc.A)
+		transmittance *= 1 - layer.alpha
+	}
+
+	return color.RGBA{
+		uint8(sum[0] + transmittance*float32(c.R) + 0.5),
+		uint8(sum[1] + transmittance*float32(c.G) + 0.5),
+		uint8(sum[2] + transmittance*float32(c.B) + 0.5),
+		uint8(sum[3] + transmittance*float32(c.A) + 0.5),
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// translucentTree returns a tree with an opaque red layer at the back and a blue
+// layer of the given opacity in front of it, seen from above.
+func translucentTree(alpha uint8) *MutableTree {
+	tree := NewMutableTree(nil, 4)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			pos := [3]float32{(float32(x) + 0.5) / 4, (float32(y) + 0.5) / 4, 0.125}
+			if err := tree.SetVoxel(pos, 2, color.RGBA{255, 0, 0, 255}); err != nil {
+				panic(err)
+			}
+			pos[2] = 0.875
+			if err := tree.SetVoxel(pos, 2, color.RGBA{0, 0, 255, 255}); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	nodes := tree.Octree()
+	for i := range nodes {
+		if n := &nodes[i]; n.leaf() {
+			c := n.getColor()
+			c.A = 255
+			if c.B != 0 {
+				c.A = alpha
+			}
+			n.setRawColor(c)
+		}
+	}
+	return tree
+}
+
+func renderTransparent(tree *MutableTree, mode TransparencyMode, frames int) *image.RGBA {
+	rect := image.Rect(0, 0, 16, 16)
+	rt := NewRaytracer(Config{
+		FieldOfView:   0.2,
+		TreeScale:     1,
+		ViewDist:      10,
+		MultiThreaded: true,
+		Accumulate:    frames > 1,
+		DoubleBuffer:  frames > 1,
+		Transparency:  mode,
+		Images:        [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	defer rt.Close()
+	rt.SetTree(tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis()))
+
+	camera := LookAtCamera{Pos: Vec3{0.375, 0.375, 2}, Look: Vec3{0.375, 0.375, 0}}
+	var idx int
+	for i := 0; i < frames; i++ {
+		idx = rt.Trace(&camera, nil, 0)
+	}
+	if err := rt.Wait(idx); err != nil {
+		panic(err)
+	}
+	return rt.Image(idx)
+}
+
+func TestTransparency(t *testing.T) {
+	tree := translucentTree(128)
+
+	opaque := renderTransparent(tree, Opaque, 1).RGBAAt(8, 8)
+	if opaque.R != 0 || opaque.B == 0 {
+		t.Errorf("expected the front layer to be opaque, got %v", opaque)
+	}
+
+	composite := renderTransparent(tree, Composite, 1)
+	if c := composite.RGBAAt(8, 8); c.R < 64 || c.B < 64 || int(c.B) > int(opaque.B)*3/4 {
+		t.Errorf("expected red and blue to be blended, got %v", c)
+	}
+
+	// The average of the stochastic frames converges to that of the composite
+	// frames, which are accumulated too so both have the same sample positions.
+	// Each pixel has the noise of 256 coin flips, the image as a whole much less.
+	composite = renderTransparent(tree, Composite, 256)
+	stochastic := renderTransparent(tree, Stochastic, 256)
+	var diff, dist [4]int
+	for i := range composite.Pix {
+		d := int(stochastic.Pix[i]) - int(composite.Pix[i])
+		diff[i%4] += d
+		if d < 0 {
+			d = -d
+		}
+		dist[i%4] += d
+	}
+	n := len(composite.Pix) / 4
+	for i := range diff {
+		if mean := float64(diff[i]) / float64(n); mean < -2 || mean > 2 {
+			t.Errorf("channel %d: stochastic frames differ from composite by %.2f on average", i, mean)
+		}
+		if mean := float64(dist[i]) / float64(n); mean > 12 {
+			t.Errorf("channel %d: stochastic pixels differ from composite by %.2f", i, mean)
+		}
+	}
+
+	// A single stochastic frame shows either layer in each pixel.
+	single := renderTransparent(tree, Stochastic, 1)
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			if c := single.RGBAAt(x, y); c.R != 0 && c.B != 0 {
+				t.Fatalf("expected a single layer at %d, %d, got %v", x, y, c)
+			}
+		}
+	}
+}
+
+func TestInvalidTransparency(t *testing.T) {
+	cfg := Config{FieldOfView: 1, TreeScale: 1, ViewDist: 1, Transparency: Stochastic + 1}
+	if err := cfg.Validate(); !errors.Is(err, InvalidTransparencyError) {
+		t.Errorf("expected InvalidTransparencyError, got %v", err)
+	}
+}
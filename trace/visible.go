@@ -0,0 +1,156 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image/color"
+	"math"
+	"sort"
+
+	"github.com/andreas-jonsson/octatron/go3d/vec3"
+)
+
+type VisibleNode struct {
+	Position Vec3
+	Scale    float32
+	Distance float32
+	Color    color.RGBA
+	Index    uint32
+	Depth    int
+}
+
+type visibleNodes []VisibleNode
+
+func (v visibleNodes) Len() int           { return len(v) }
+func (v visibleNodes) Less(i, j int) bool { return v[i].Distance < v[j].Distance }
+func (v visibleNodes) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+
+type frustum struct {
+	eye, forward, right, up vec3.T
+	tanX, tanY, radX, radY  float32
+	lodBias                 float32
+
+	// maxDepth is the depth below which nodes are not subdivided.
+	maxDepth uint32
+}
+
+func newFrustum(camera Camera, fov, aspect, lodBias float32) *frustum {
+	lookAt := vec3.T(camera.LookAt())
+	eye := vec3.T(camera.Position())
+	up := vec3.T(camera.Up())
+
+	forward := vec3.Sub(&lookAt, &eye)
+	right := vec3.Cross(&forward, &up)
+	up = vec3.Cross(&right, &forward)
+	forward.Normalize()
+	right.Normalize()
+	up.Normalize()
+
+	tanX := float32(math.Tan(float64(fov / 2)))
+	tanY := tanX / aspect
+
+	return &frustum{
+		eye:      eye,
+		forward:  forward,
+		right:    right,
+		up:       up,
+		tanX:     tanX,
+		tanY:     tanY,
+		radX:     float32(math.Sqrt(float64(1 + tanX*tanX))),
+		radY:     float32(math.Sqrt(float64(1 + tanY*tanY))),
+		lodBias:  lodBias,
+		maxDepth: math.MaxUint32,
+	}
+}
+
+// cull tests the bounding sphere of a node against the frustum and returns the
+// distance to the node center along the view direction.
+func (f *frustum) cull(center *vec3.T, radius float32) (float32, bool) {
+	p := vec3.Sub(center, &f.eye)
+	z := vec3.Dot(&p, &f.forward)
+
+	if z < -radius {
+		return z, true
+	}
+
+	x := float32(math.Abs(float64(vec3.Dot(&p, &f.right))))
+	if x > z*f.tanX+radius*f.radX {
+		return z, true
+	}
+
+	y := float32(math.Abs(float64(vec3.Dot(&p, &f.up))))
+	if y > z*f.tanY+radius*f.radY {
+		return z, true
+	}
+
+	return z, false
+}
+
+func (f *frustum) collect(tree Octree, nodePos vec3.T, nodeScale float32, nodeIndex, depth uint32, out []VisibleNode) []VisibleNode {
+	half := nodeScale * 0.5
+	center := vec3.T{nodePos[0] + half, nodePos[1] + half, nodePos[2] + half}
+	radius := half * float32(math.Sqrt(3))
+
+	z, culled := f.cull(&center, radius)
+	if culled {
+		return out
+	}
+
+	node := &tree[nodeIndex]
+	leaf := node.leaf()
+
+	// Nodes containing the eye are always subdivided.
+	if !leaf && depth < f.maxDepth && (z <= radius || nodeScale/z > f.lodBias) {
+		childScale := half
+		for i := range node {
+			if child := node.getChild(i); child != 0 {
+				offset := childPositions[i].Scaled(childScale)
+				out = f.collect(tree, vec3.Add(&nodePos, &offset), childScale, child, depth+1, out)
+			}
+		}
+		return out
+	}
+
+	return append(out, VisibleNode{
+		Position: Vec3(nodePos),
+		Scale:    nodeScale,
+		Distance: vec3.Distance(&center, &f.eye),
+		Color:    node.getColor(),
+		Index:    nodeIndex,
+		Depth:    int(depth),
+	})
+}
+
+// CollectVisible returns the nodes inside the view frustum sorted front to back.
+// Traversal stops when the projected size of a node, scale divided by distance, is
+// below lodBias. Fov is the horizontal field-of-view in radians and aspect is width
+// divided by height. A maxCount of zero or less means no limit.
+func CollectVisible(tree Octree, treePos Vec3, treeScale float32, camera Camera, fov, aspect float32, maxCount int, lodBias float32) []VisibleNode {
+	if len(tree) == 0 {
+		return nil
+	}
+
+	f := newFrustum(camera, fov, aspect, lodBias)
+	nodes := f.collect(tree, vec3.T(treePos), treeScale, 0, 0, nil)
+
+	sort.Sort(visibleNodes(nodes))
+	if maxCount > 0 && len(nodes) > maxCount {
+		nodes = nodes[:maxCount]
+	}
+	return nodes
+}
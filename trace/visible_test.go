@@ -0,0 +1,61 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestCollectVisible(t *testing.T) {
+	tree := solidCube(2, color.RGBA{255, 255, 255, 255}).Octree()
+
+	camera := LookAtCamera{Pos: Vec3{0.5, 0.5, 2.5}, Look: Vec3{0.5, 0.5, 0}}
+	nodes := CollectVisible(tree, Vec3{}, 1, &camera, 1.5, 1, 0, 0.01)
+	if len(nodes) != 64 {
+		t.Fatalf("expected 64 nodes, got %v", len(nodes))
+	}
+
+	for i := 1; i < len(nodes); i++ {
+		if nodes[i-1].Distance > nodes[i].Distance {
+			t.Fatal("nodes are not sorted front to back")
+		}
+	}
+
+	if nodes := CollectVisible(tree, Vec3{}, 1, &camera, 1.5, 1, 10, 0.01); len(nodes) != 10 {
+		t.Errorf("expected 10 nodes, got %v", len(nodes))
+	}
+
+	coarse := CollectVisible(tree, Vec3{}, 1, &camera, 1.5, 1, 0, 1)
+	medium := CollectVisible(tree, Vec3{}, 1, &camera, 1.5, 1, 0, 0.3)
+	if len(coarse) != 1 || len(medium) <= len(coarse) || len(nodes) <= len(medium) {
+		t.Errorf("lod bias does not affect node count: %v, %v, %v", len(coarse), len(medium), len(nodes))
+	}
+
+	away := LookAtCamera{Pos: Vec3{0.5, 0.5, 2.5}, Look: Vec3{0.5, 0.5, 5}}
+	if nodes := CollectVisible(tree, Vec3{}, 1, &away, 1.5, 1, 0, 0.01); len(nodes) != 0 {
+		t.Errorf("expected no nodes behind the camera, got %v", len(nodes))
+	}
+
+	inside := LookAtCamera{Pos: Vec3{0.5, 0.5, 0.5}, Look: Vec3{0.5, 0.5, 0}}
+	for _, n := range CollectVisible(tree, Vec3{}, 1, &inside, 1.5, 1, 0, 0.01) {
+		if n.Position[2] >= 0.75 {
+			t.Errorf("node behind the camera was returned: %+v", n)
+		}
+	}
+}
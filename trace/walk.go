@@ -0,0 +1,88 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+// WalkFunc is called by Octree.Walk for every node reached. Pos is the corner of
+// the node with the lowest coordinates and scale its size, with the tree in the
+// unit cube. Returning false skips the children of the node.
+type WalkFunc func(nodeIndex uint32, depth int, pos [3]float32, scale float32, isLeaf bool) bool
+
+// Walk calls fn for the nodes of the tree depth first, with the children of a node
+// in the order of pack.ChildPositions, the order the tracer uses. Nodes shared by
+// several parents in optimized trees are visited once for every parent.
+func (t Octree) Walk(fn WalkFunc) {
+	if len(t) == 0 {
+		return
+	}
+	t.walk(fn, 0, 0, [3]float32{}, 1)
+}
+
+func (t Octree) walk(fn WalkFunc, nodeIndex uint32, depth int, pos [3]float32, scale float32) {
+	node := &t[nodeIndex]
+	if !fn(nodeIndex, depth, pos, scale, node.leaf()) {
+		return
+	}
+
+	childScale := scale * 0.5
+	for i := range node {
+		if child := node.getChild(i); child != 0 {
+			offset := childPositions[i].Scaled(childScale)
+			t.walk(fn, child, depth+1, [3]float32{pos[0] + offset[0], pos[1] + offset[1], pos[2] + offset[2]}, childScale)
+		}
+	}
+}
+
+// TreeStatistics describes the nodes of a tree as they are reached from the root.
+// Shared nodes are counted once for every parent.
+type TreeStatistics struct {
+	NumNodes, NumLeafs uint64
+
+	// Depth is the depth of the deepest leaf. LeafsPerDepth holds the number
+	// of leafs at every depth from the root.
+	Depth         int
+	LeafsPerDepth []uint64
+
+	// Coverage is the part of the tree volume filled by leafs.
+	Coverage float64
+}
+
+// ComputeStatistics walks the tree and counts its nodes. Nodes at maxDepth are
+// treated as leafs, a negative maxDepth walks the full tree.
+func ComputeStatistics(tree Octree, maxDepth int) TreeStatistics {
+	var stats TreeStatistics
+	tree.Walk(func(nodeIndex uint32, depth int, pos [3]float32, scale float32, isLeaf bool) bool {
+		stats.NumNodes++
+		if !isLeaf && depth != maxDepth {
+			return true
+		}
+
+		stats.NumLeafs++
+		for len(stats.LeafsPerDepth) <= depth {
+			stats.LeafsPerDepth = append(stats.LeafsPerDepth, 0)
+		}
+		stats.LeafsPerDepth[depth]++
+		if depth > stats.Depth {
+			stats.Depth = depth
+		}
+
+		s := float64(scale)
+		stats.Coverage += s * s * s
+		return false
+	})
+	return stats
+}
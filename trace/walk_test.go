@@ -0,0 +1,117 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image/color"
+	"testing"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+func TestChildPositions(t *testing.T) {
+	for i, p := range pack.ChildPositions {
+		for axis := range p {
+			if int(p[axis]) != i>>uint(axis)&1 || childPositions[i][axis] != float32(p[axis]) {
+				t.Errorf("child %d is at %v, expected bit %d of the slot on axis %d", i, childPositions[i], axis, axis)
+			}
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	// Every leaf has a column of its own along z, so nothing is in front of it
+	// when seen from above.
+	tree := NewMutableTree(nil, 8)
+	voxels := []struct {
+		pos   [3]float32
+		depth int
+	}{
+		{[3]float32{0.1, 0.1, 0.1}, 3},
+		{[3]float32{0.9, 0.3, 0.6}, 3},
+		{[3]float32{0.3, 0.8, 0.4}, 2},
+		{[3]float32{0.8, 0.8, 0.9}, 1},
+	}
+	for i, v := range voxels {
+		if err := tree.SetVoxel(v.pos, v.depth, color.RGBA{uint8(i * 60), 0, 255, 255}); err != nil {
+			panic(err)
+		}
+	}
+
+	rt := newTestRaytracer(Vec3{}, 1)
+	defer rt.Close()
+
+	var numLeafs int
+	tree.Octree().Walk(func(nodeIndex uint32, depth int, pos [3]float32, scale float32, isLeaf bool) bool {
+		if !isLeaf {
+			return true
+		}
+		numLeafs++
+
+		center := Vec3{pos[0] + scale/2, pos[1] + scale/2, 2}
+		hit, ok := rt.CastRay(tree.Octree(), 4, center, Vec3{0, 0, -1}, 10)
+		if !ok || hit.Node != nodeIndex || hit.Depth != depth {
+			t.Errorf("leaf %d at depth %d: ray through %v hit %+v, %v", nodeIndex, depth, center, hit, ok)
+		} else if !near(hit.Position, Vec3{center[0], center[1], pos[2] + scale}) {
+			t.Errorf("leaf %d at %v of size %v was hit at %v", nodeIndex, pos, scale, hit.Position)
+		}
+		return true
+	})
+
+	if numLeafs != len(voxels) {
+		t.Errorf("expected %d leafs, got %d", len(voxels), numLeafs)
+	}
+}
+
+func TestWalkPrune(t *testing.T) {
+	tree := solidCube(2, color.RGBA{255, 255, 255, 255})
+
+	var (
+		depths [3]int
+		last   = -1
+	)
+	tree.Octree().Walk(func(nodeIndex uint32, depth int, pos [3]float32, scale float32, isLeaf bool) bool {
+		depths[depth]++
+
+		// Only the first child of the root is walked below it, and the walk
+		// is depth first so its children directly follow it.
+		if depth == 2 && last == 0 {
+			t.Error("the children of the first child were not visited first")
+		}
+		last = depth
+		return depth == 0 || pos == [3]float32{}
+	})
+
+	if depths != [3]int{1, 8, 8} {
+		t.Errorf("expected 1, 8 and 8 nodes per depth, got %v", depths)
+	}
+}
+
+func TestComputeStatistics(t *testing.T) {
+	tree := solidCube(2, color.RGBA{255, 255, 255, 255})
+
+	stats := ComputeStatistics(tree.Octree(), -1)
+	if stats.NumNodes != 73 || stats.NumLeafs != 64 || stats.Depth != 2 || stats.Coverage != 1 {
+		t.Errorf("unexpected statistics for a full tree: %+v", stats)
+	}
+
+	stats = ComputeStatistics(tree.Octree(), 1)
+	if stats.NumNodes != 9 || stats.NumLeafs != 8 || stats.Depth != 1 || len(stats.LeafsPerDepth) != 2 || stats.LeafsPerDepth[1] != 8 {
+		t.Errorf("unexpected statistics at depth 1: %+v", stats)
+	}
+}
@@ -0,0 +1,279 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HotBlockSize is the size of the blocks of a tree file tracked by hot sets.
+const HotBlockSize = 64 << 10
+
+var (
+	// StaleHotSetError is returned for hot sets saved from another version of
+	// the tree file.
+	StaleHotSetError = errors.New("hot set was saved from another version of the tree")
+
+	errNotMapped           = errors.New("tree is not memory mapped")
+	errResidentUnsupported = errors.New("resident pages can not be queried on this platform")
+)
+
+type (
+	// HotSet is the blocks of a tree file that were in memory when a server
+	// stopped. The next server reads them before it renders, so the first frames
+	// do not wait for the disk. Size and ModTime identify the version of the
+	// file.
+	HotSet struct {
+		Size      int64     `json:"size"`
+		ModTime   time.Time `json:"mod_time"`
+		BlockSize int64     `json:"block_size"`
+
+		// Ranges are the hot blocks as first block and number of blocks, in
+		// the order of the file.
+		Ranges [][2]int64 `json:"ranges"`
+	}
+
+	// WarmUp reads the blocks of a hot set in the background, see StartWarmUp.
+	WarmUp struct {
+		loaded, total int64
+
+		ready, done, stop   chan struct{}
+		readyOnce, stopOnce sync.Once
+		err                 error
+	}
+)
+
+// HotSetName returns the file the hot set of the tree in path is saved to,
+// tree.oct has its hot set in tree.oct.hot.
+func HotSetName(path string) string {
+	return path + ".hot"
+}
+
+// NumBlocks returns the number of blocks in the hot set.
+func (hs *HotSet) NumBlocks() int64 {
+	var n int64
+	for _, r := range hs.Ranges {
+		n += r[1]
+	}
+	return n
+}
+
+// HotSet returns the blocks of the tree file that are in memory, the blocks the
+// renders since it was mapped have read and those still cached by the OS. Trees
+// that are not mapped have no hot set.
+func (m *MappedTree) HotSet() (*HotSet, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if !m.mapped || m.data == nil {
+		return nil, errNotMapped
+	}
+
+	pages, err := residentPages(m.data)
+	if err != nil {
+		return nil, err
+	}
+
+	hs := &HotSet{Size: m.size, ModTime: m.modTime, BlockSize: HotBlockSize}
+	pageSize := int64(os.Getpagesize())
+
+	last := int64(-1)
+	for i, resident := range pages {
+		if !resident {
+			continue
+		}
+
+		// Pages are never larger than a block, but may span two of them.
+		first := int64(i) * pageSize / HotBlockSize
+		end := (int64(i+1)*pageSize - 1) / HotBlockSize
+		for block := first; block <= end; block++ {
+			if block <= last {
+				continue
+			}
+			if n := len(hs.Ranges); n > 0 && hs.Ranges[n-1][0]+hs.Ranges[n-1][1] == block {
+				hs.Ranges[n-1][1]++
+			} else {
+				hs.Ranges = append(hs.Ranges, [2]int64{block, 1})
+			}
+			last = block
+		}
+	}
+	return hs, nil
+}
+
+// SaveHotSet writes the hot set of the tree to HotSetName of its file. The file
+// is replaced at once, a server stopped while saving keeps the previous hot set.
+func (m *MappedTree) SaveHotSet() error {
+	hs, err := m.HotSet()
+	if err != nil {
+		return err
+	}
+
+	name := HotSetName(m.path)
+	fp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name))
+	if err != nil {
+		return err
+	}
+
+	err = WriteHotSet(fp, hs)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+	}
+	return err
+}
+
+// WarmUp starts reading the hot set saved for the tree, see StartWarmUp. Nil is
+// returned without error if the tree is not mapped or has no saved hot set.
+func (m *MappedTree) WarmUp(fraction float64) (*WarmUp, error) {
+	if !m.mapped {
+		return nil, nil
+	}
+
+	fp, err := os.Open(HotSetName(m.path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	hs, err := ReadHotSet(fp)
+	fp.Close()
+	if err != nil {
+		return nil, err
+	}
+	if hs.Size != m.size || !hs.ModTime.Equal(m.modTime) {
+		return nil, StaleHotSetError
+	}
+
+	tree, err := os.Open(m.path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := StartWarmUp(tree, hs, fraction)
+	go func() {
+		<-w.Done()
+		tree.Close()
+	}()
+	return w, nil
+}
+
+// WriteHotSet writes hs as JSON.
+func WriteHotSet(w io.Writer, hs *HotSet) error {
+	return json.NewEncoder(w).Encode(hs)
+}
+
+// ReadHotSet reads a hot set written by WriteHotSet.
+func ReadHotSet(r io.Reader) (*HotSet, error) {
+	var hs HotSet
+	if err := json.NewDecoder(r).Decode(&hs); err != nil {
+		return nil, err
+	}
+	if hs.BlockSize <= 0 {
+		return nil, errors.New("invalid hot set block size")
+	}
+	return &hs, nil
+}
+
+// StartWarmUp reads the blocks of hs from r in the background, a block at a time
+// in the order of the file. The data is thrown away, reading it makes the OS keep
+// it in the page cache the mapped tree is read from. Ready is closed once fraction
+// of the blocks are read, or when the warm-up ends early. Reading stops at the
+// first error, the rest of the tree is read on demand.
+func StartWarmUp(r io.ReaderAt, hs *HotSet, fraction float64) *WarmUp {
+	w := &WarmUp{
+		total: hs.NumBlocks(),
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+		stop:  make(chan struct{}),
+	}
+
+	needed := int64(fraction * float64(w.total))
+	if needed <= 0 {
+		w.setReady()
+	}
+
+	go func() {
+		defer close(w.done)
+		defer w.setReady()
+
+		buf := make([]byte, hs.BlockSize)
+		for _, rng := range hs.Ranges {
+			for block := rng[0]; block < rng[0]+rng[1]; block++ {
+				select {
+				case <-w.stop:
+					return
+				default:
+				}
+
+				if _, err := r.ReadAt(buf, block*hs.BlockSize); err != nil && err != io.EOF {
+					w.err = err
+					return
+				}
+				if atomic.AddInt64(&w.loaded, 1) >= needed {
+					w.setReady()
+				}
+			}
+		}
+	}()
+	return w
+}
+
+func (w *WarmUp) setReady() {
+	w.readyOnce.Do(func() { close(w.ready) })
+}
+
+// Ready is closed when the fraction of the blocks given to StartWarmUp is read.
+func (w *WarmUp) Ready() <-chan struct{} {
+	return w.ready
+}
+
+// Done is closed when the warm-up has ended.
+func (w *WarmUp) Done() <-chan struct{} {
+	return w.done
+}
+
+// Progress returns the number of blocks read and the number of blocks in the hot
+// set.
+func (w *WarmUp) Progress() (loaded, total int64) {
+	return atomic.LoadInt64(&w.loaded), w.total
+}
+
+// Err returns the error that ended the warm-up, once Done is closed.
+func (w *WarmUp) Err() error {
+	return w.err
+}
+
+// Stop ends the warm-up after the block being read.
+func (w *WarmUp) Stop() {
+	w.stopOnce.Do(func() { close(w.stop) })
+}
@@ -0,0 +1,159 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+// countingReaderAt records the offsets read. Reads after the first limit wait for
+// resume to be closed.
+type countingReaderAt struct {
+	lock    sync.Mutex
+	offsets []int64
+	limit   int
+	resume  chan struct{}
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.lock.Lock()
+	r.offsets = append(r.offsets, off)
+	n := len(r.offsets)
+	r.lock.Unlock()
+
+	if r.resume != nil && n > r.limit {
+		<-r.resume
+	}
+	return len(p), nil
+}
+
+func TestHotSetRoundTrip(t *testing.T) {
+	hs := &HotSet{Size: 1 << 20, ModTime: time.Unix(1500000000, 0).UTC(), BlockSize: HotBlockSize, Ranges: [][2]int64{{0, 4}, {9, 1}}}
+
+	var buf bytes.Buffer
+	if err := WriteHotSet(&buf, hs); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadHotSet(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, hs) || read.NumBlocks() != 5 {
+		t.Errorf("expected %+v, got %+v", hs, read)
+	}
+
+	if _, err := ReadHotSet(bytes.NewBufferString(`{"block_size": 0}`)); err == nil {
+		t.Error("expected an error for a hot set without block size")
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	hs := &HotSet{BlockSize: 16, Ranges: [][2]int64{{2, 3}, {10, 1}}}
+	r := &countingReaderAt{limit: 2, resume: make(chan struct{})}
+
+	// Half of the blocks are enough, the rest are read in the background.
+	w := StartWarmUp(r, hs, 0.5)
+	<-w.Ready()
+	select {
+	case <-w.Done():
+		t.Fatal("warm-up ended before the reads were resumed")
+	default:
+	}
+	if loaded, total := w.Progress(); loaded != 2 || total != 4 {
+		t.Errorf("expected 2 of 4 blocks, got %d of %d", loaded, total)
+	}
+
+	close(r.resume)
+	<-w.Done()
+	if loaded, _ := w.Progress(); loaded != 4 || w.Err() != nil {
+		t.Errorf("expected all blocks, got %d and %v", loaded, w.Err())
+	}
+	if expected := []int64{32, 48, 64, 160}; !reflect.DeepEqual(r.offsets, expected) {
+		t.Errorf("expected reads at %v, got %v", expected, r.offsets)
+	}
+}
+
+func TestMappedHotSet(t *testing.T) {
+	file := saveTestTree(testSphere(4), pack.MipR8G8B8A8PackUI28)
+	defer os.Remove(file)
+	defer os.Remove(HotSetName(file))
+
+	mapped, err := LoadOctreeMapped(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mapped.Close()
+
+	if w, err := mapped.WarmUp(1); w != nil || err != nil {
+		t.Fatal("expected no warm-up without a hot set")
+	}
+
+	tree, _ := mapped.Acquire()
+	renderMapped(tree, 4)
+	mapped.Release()
+
+	if err := mapped.SaveHotSet(); err == errResidentUnsupported {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rendered tree is in memory, its first block holds the root.
+	fp, err := os.Open(HotSetName(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, err := ReadHotSet(fp)
+	fp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hs.Ranges) == 0 || hs.Ranges[0][0] != 0 {
+		t.Fatalf("expected the first block to be hot, got %v", hs.Ranges)
+	}
+
+	w, err := mapped.WarmUp(1)
+	if err != nil || w == nil {
+		t.Fatal("could not warm up:", err)
+	}
+	<-w.Done()
+	if loaded, total := w.Progress(); loaded != hs.NumBlocks() || total != loaded || w.Err() != nil {
+		t.Errorf("read %d of %d blocks, expected %d: %v", loaded, total, hs.NumBlocks(), w.Err())
+	}
+
+	// Hot sets of other versions of the file are not used.
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(file, later, later); err != nil {
+		panic(err)
+	}
+	stale, err := LoadOctreeMapped(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stale.Close()
+	if _, err := stale.WarmUp(1); err != StaleHotSetError {
+		t.Error("expected a stale hot set, got", err)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image/color"
+	"math"
+
+	"github.com/andreas-jonsson/octatron/go3d/vec3"
+)
+
+// wireframeWidth is the width of the wireframe lines in pixels.
+const wireframeWidth = 1
+
+// DebugWireframe draws the edges of the nodes down to MaxDepth, where the root is
+// at depth zero, over the image to show how the tree is subdivided. Only the nodes
+// a ray enters before it hits something are drawn. The alpha of Color is the
+// strength of the lines.
+type DebugWireframe struct {
+	Enabled  bool
+	MaxDepth int
+	Color    color.RGBA
+}
+
+func (w *DebugWireframe) validate() error {
+	if w.Enabled && w.MaxDepth < 0 {
+		return InvalidWireframeError
+	}
+	return nil
+}
+
+// pixelAngle returns the size of a pixel at unit distance from the eye, for views
+// that are width pixels wide.
+func (rt *Raytracer) pixelAngle(width int) float32 {
+	if rt.cfg.Projection == Panorama {
+		return 2 * math.Pi / float32(width)
+	}
+	return 2 * float32(math.Tan(float64(rt.cfg.fieldOfView()/2))) / float32(width)
+}
+
+// nearEdge reports if p is within width of an edge of box. The point is on a face
+// of the box, so it is near an edge if it is near one of the other faces too.
+func nearEdge(p *vec3.T, box *vec3.Box, width float32) bool {
+	near := 0
+	for i := range p {
+		if p[i]-box.Min[i] < width || box.Max[i]-p[i] < width {
+			near++
+		}
+	}
+	return near >= 2
+}
+
+// onWireframe reports if ray passes an edge of the node or a node below it, down
+// to the wireframe depth, of the nodes it enters before length. The lines are
+// pixel wide at unit distance.
+func (rt *Raytracer) onWireframe(tree []octreeNode, ray *infiniteRay, nodePos *vec3.T, nodeScale, length, pixel float32, nodeIndex, treeDepth uint32, visits *uint64) bool {
+	*visits++
+
+	box := vec3.Box{Min: *nodePos, Max: vec3.T{nodePos[0] + nodeScale, nodePos[1] + nodeScale, nodePos[2] + nodeScale}}
+	start, final := boxRange(ray, &box)
+	if final <= start || start > float64(length) {
+		return false
+	}
+
+	// The edges are checked where the ray enters and leaves the box, so the back
+	// edges of the nodes are seen through them. The entry point of rays that
+	// start inside is not on a face.
+	for _, dist := range [2]float64{start, final} {
+		if dist <= 0 {
+			continue
+		}
+
+		d := float32(dist)
+		p := vec3.T{ray[0][0] + ray[1][0]*d, ray[0][1] + ray[1][1]*d, ray[0][2] + ray[1][2]*d}
+		if nearEdge(&p, &box, d*pixel*wireframeWidth) {
+			return true
+		}
+	}
+
+	node := &tree[nodeIndex]
+	if int(treeDepth) >= rt.cfg.DebugWireframe.MaxDepth {
+		return false
+	}
+
+	childScale := nodeScale * 0.5
+	for i := range node {
+		if child := node.getChild(i); child != 0 {
+			offset := childPositions[i].Scaled(childScale)
+			pos := vec3.Add(nodePos, &offset)
+			if rt.onWireframe(tree, ray, &pos, childScale, length, pixel, child, treeDepth+1, visits) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wireframe blends the wireframe color over c, which is in the channel order of
+// the images.
+func (rt *Raytracer) wireframe(c color.RGBA) color.RGBA {
+	return rt.blend(c, rt.cfg.DebugWireframe.Color)
+}
+
+// SetDebugWireframe replaces Config.DebugWireframe. Frames in flight are completed
+// first.
+func (rt *Raytracer) SetDebugWireframe(w DebugWireframe) error {
+	if err := w.validate(); err != nil {
+		return invalidConfig("DebugWireframe", err)
+	}
+
+	rt.traceLock.Lock()
+	defer rt.traceLock.Unlock()
+
+	rt.wait(0)
+	rt.wait(1)
+	rt.cfg.DebugWireframe = w
+	return nil
+}
@@ -0,0 +1,86 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+)
+
+// countColor returns the number of pixels of img with color c.
+func countColor(img *image.RGBA, c color.RGBA) int {
+	num := 0
+	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+			if img.RGBAAt(x, y) == c {
+				num++
+			}
+		}
+	}
+	return num
+}
+
+func TestDebugWireframe(t *testing.T) {
+	lines := color.RGBA{255, 255, 0, 255}
+	camera := goldenCameras[1].camera
+
+	render := func(tree *MutableTree, wire DebugWireframe) *image.RGBA {
+		return renderGolden(tree, camera, 1, func(cfg *Config) {
+			cfg.DebugWireframe = wire
+		})
+	}
+
+	gray := color.RGBA{96, 96, 96, 255}
+	cube := solidCube(0, gray)
+	if n := countColor(render(cube, DebugWireframe{Color: lines}), lines); n != 0 {
+		t.Errorf("%d wireframe pixels when disabled", n)
+	}
+
+	// The edges behind the cube are drawn too, so all twelve are in the golden image.
+	img := render(cube, DebugWireframe{Enabled: true, Color: lines})
+	file := filepath.Join("testdata", "golden", "wireframe_cube.png")
+	golden := loadGolden(file, img)
+	if n := countChanged(golden, img, goldenTolerance); n > len(img.Pix)/4/100 {
+		t.Errorf("%d pixels differ from %s", n, file)
+	}
+
+	if c := img.RGBAAt(46, 20); c != gray {
+		t.Errorf("face between the edges is %v", c)
+	}
+
+	split := solidCube(1, gray)
+	shallow := countColor(render(split, DebugWireframe{Enabled: true, Color: lines}), lines)
+	deep := countColor(render(split, DebugWireframe{Enabled: true, MaxDepth: 1, Color: lines}), lines)
+	if shallow == 0 || deep <= shallow {
+		t.Errorf("%d wireframe pixels at depth zero and %d at depth one", shallow, deep)
+	}
+
+	cfg := Config{FieldOfView: 1, DebugWireframe: DebugWireframe{Enabled: true, MaxDepth: -1}}
+	if err := cfg.Validate(); !errors.Is(err, InvalidWireframeError) {
+		t.Errorf("negative depth: %v", err)
+	}
+
+	rt := NewRaytracer(Config{FieldOfView: 1, TreeScale: 1, ViewDist: 5, Images: [2]*image.RGBA{image.NewRGBA(image.Rect(0, 0, 64, 48)), image.NewRGBA(image.Rect(0, 0, 64, 48))}})
+	defer rt.Close()
+	if err := rt.SetDebugWireframe(DebugWireframe{Enabled: true, MaxDepth: -1}); !errors.Is(err, InvalidWireframeError) {
+		t.Errorf("SetDebugWireframe accepted a negative depth: %v", err)
+	}
+}
@@ -0,0 +1,292 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"image"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+type (
+	// tileQueue is the work-stealing deque of a worker. The owner takes tiles from
+	// the front while idle workers steal from the back.
+	tileQueue struct {
+		lock sync.Mutex
+		jobs []rtJob
+		head int
+	}
+
+	FrameStats struct {
+		// Tiles is the number of tiles traced by each worker. Stolen is how many
+		// of those were taken from the queue of another worker.
+		Tiles, Stolen []int
+
+		// Goroutines is the number of worker goroutines that traced any tiles.
+		Goroutines int
+
+		// NodeVisits is the number of octree nodes visited by all rays.
+		NodeVisits uint64
+
+		// Refined is the fraction of pixels that AdaptiveAA gave extra samples.
+		Refined float64
+
+		// PhaseTimes are the times the phases of a Checkerboard frame took, the
+		// second from the end of the first.
+		PhaseTimes [2]time.Duration
+	}
+)
+
+func (q *tileQueue) push(job rtJob) {
+	q.lock.Lock()
+	q.jobs = append(q.jobs, job)
+	q.lock.Unlock()
+}
+
+func (q *tileQueue) take(steal bool) (rtJob, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var job rtJob
+	if q.head == len(q.jobs) {
+		return job, false
+	}
+
+	if steal {
+		job = q.jobs[len(q.jobs)-1]
+		q.jobs = q.jobs[:len(q.jobs)-1]
+	} else {
+		job = q.jobs[q.head]
+		q.head++
+	}
+
+	if q.head == len(q.jobs) {
+		q.jobs = q.jobs[:0]
+		q.head = 0
+	}
+	return job, true
+}
+
+func (q *tileQueue) queued() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.head < len(q.jobs)
+}
+
+// splitTiles appends a job for every tile that overlaps job.rect. A tile size of zero
+// gives one tile per scan-line.
+func splitTiles(jobs []rtJob, job rtJob, size image.Point, tileSize int) []rtJob {
+	tileWidth, tileHeight := tileSize, tileSize
+	if tileSize <= 0 {
+		tileWidth, tileHeight = size.X, 1
+	}
+
+	for y := 0; y < size.Y; y += tileHeight {
+		to := y + tileHeight
+		if to > size.Y {
+			to = size.Y
+		}
+
+		for x := 0; x < size.X; x += tileWidth {
+			// Scan-lines y to to-1 are written to rows size.Y-to to size.Y-1-y, see scanRow.
+			tile := image.Rect(x, size.Y-to, x+tileWidth, size.Y-y).Intersect(job.rect)
+			if tile.Empty() {
+				continue
+			}
+
+			j := job
+			j.from, j.to, j.rect = y, to, tile
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs
+}
+
+// schedule distributes jobs over the worker queues and starts the workers. Jobs are
+// interleaved between workers unless Banded is set, in which case every worker is
+// given a contiguous band of the image.
+func (rt *Raytracer) schedule(jobs []rtJob) {
+	numWorkers := len(rt.queues)
+	for i, job := range jobs {
+		worker := i % numWorkers
+		if rt.cfg.Banded {
+			worker = i * numWorkers / len(jobs)
+		}
+		rt.queues[worker].push(job)
+	}
+
+	rt.startWorkers()
+}
+
+// startWorkers starts the workers that are not running. Workers exit when the
+// queues are empty, so an idle raytracer has no goroutines and one that is dropped
+// mid-frame, without Wait or Close, does not leak any once its tiles are traced.
+func (rt *Raytracer) startWorkers() {
+	for i := range rt.running {
+		if atomic.CompareAndSwapInt32(&rt.running[i], 0, 1) {
+			atomic.AddInt32(&rt.outstanding, 1)
+			go rt.workerLoop(i)
+		}
+	}
+}
+
+// queued reports if any queue holds tiles.
+func (rt *Raytracer) queued() bool {
+	for i := range rt.queues {
+		if rt.queues[i].queued() {
+			return true
+		}
+	}
+	return false
+}
+
+// Outstanding returns the number of worker goroutines that are running. It drops
+// to zero shortly after the last frame in flight is done.
+func (rt *Raytracer) Outstanding() int {
+	return int(atomic.LoadInt32(&rt.outstanding))
+}
+
+func (rt *Raytracer) nextJob(worker int) (rtJob, bool, bool) {
+	if job, ok := rt.queues[worker].take(false); ok {
+		return job, false, true
+	}
+
+	numWorkers := len(rt.queues)
+	for i := 1; i < numWorkers; i++ {
+		if job, ok := rt.queues[(worker+i)%numWorkers].take(true); ok {
+			return job, true, true
+		}
+	}
+	return rtJob{}, false, false
+}
+
+func (rt *Raytracer) runNext(worker int) bool {
+	job, stolen, ok := rt.nextJob(worker)
+	if !ok {
+		return false
+	}
+
+	rt.traceScanLines(&job)
+	if rt.cfg.OnTileDone != nil && !rt.isAborted(job.idx) {
+		rt.cfg.OnTileDone(job.idx, job.rect.Add(rt.origin))
+	}
+	if rt.cfg.Checkerboard && job.phase == 0 {
+		rt.firstPhaseDone(job.idx)
+	}
+
+	atomic.AddInt32(&rt.tileCount[job.idx][worker], 1)
+	if stolen {
+		atomic.AddInt32(&rt.stealCount[job.idx][worker], 1)
+	}
+
+	if atomic.AddInt32(&rt.pending[job.idx], -1) == 0 {
+		if rt.cfg.Checkerboard {
+			rt.lastPhaseDone(job.idx)
+		}
+		if !rt.isAborted(job.idx) {
+			if rt.cfg.AutoExposure {
+				rt.meterExposure(job.idx)
+			}
+			atomic.StoreInt32(&rt.completed, int32(job.idx))
+		}
+		rt.frameDone(job.idx)
+	}
+	rt.wg[job.idx].Done()
+	return true
+}
+
+func (rt *Raytracer) workerLoop(worker int) {
+	if rt.cfg.PinWorkers {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+	defer atomic.AddInt32(&rt.outstanding, -1)
+
+	for {
+		for rt.runNext(worker) {
+		}
+
+		// Tiles queued after the last take are either seen here or by the
+		// startWorkers of their frame.
+		atomic.StoreInt32(&rt.running[worker], 0)
+		if !rt.queued() || !atomic.CompareAndSwapInt32(&rt.running[worker], 0, 1) {
+			return
+		}
+	}
+}
+
+// startWatchdog reports the frame of image idx to Config.Logger if its tiles are
+// not traced within Config.FrameDeadline.
+func (rt *Raytracer) startWatchdog(idx, numJobs int) {
+	id := atomic.AddUint32(&rt.started, 1)
+	atomic.StoreUint32(&rt.frameID[idx], id)
+	rt.frameStart[idx], rt.frameJobs[idx] = time.Now(), numJobs
+
+	deadline, logger := rt.cfg.FrameDeadline, rt.cfg.logger()
+	if deadline <= 0 || !logger.Enabled(pack.LogWarn) {
+		return
+	}
+
+	rt.watchdog[idx] = time.AfterFunc(deadline, func() {
+		pending := atomic.LoadInt32(&rt.pending[idx])
+		if pending <= 0 || atomic.LoadUint32(&rt.frameID[idx]) != id {
+			return
+		}
+		logger.Warnf("frame %d: %d of %d tiles not traced after %v, %d workers running", id, pending, numJobs, deadline, rt.Outstanding())
+	})
+}
+
+// logFrame reports the summary of the frame of image idx, once its tiles are done.
+func (rt *Raytracer) logFrame(logger pack.Logger, idx int) {
+	state := "done"
+	if rt.isAborted(idx) {
+		state = "aborted"
+	}
+	logger.Debugf("frame %d %s: %d tiles in %v, %d nodes visited", atomic.LoadUint32(&rt.frameID[idx]), state, rt.frameJobs[idx], time.Since(rt.frameStart[idx]), atomic.LoadUint64(&rt.nodeVisits[idx]))
+}
+
+// Stats waits for frame and returns the number of tiles traced by each worker and
+// the number of nodes visited.
+func (rt *Raytracer) Stats(frame int) FrameStats {
+	rt.wait(frame)
+
+	numWorkers := len(rt.queues)
+	stats := FrameStats{
+		Tiles:      make([]int, numWorkers),
+		Stolen:     make([]int, numWorkers),
+		NodeVisits: atomic.LoadUint64(&rt.nodeVisits[frame]),
+		PhaseTimes: rt.phaseTimes[frame],
+	}
+
+	if traced := atomic.LoadUint64(&rt.traced[frame]); traced > 0 {
+		stats.Refined = float64(atomic.LoadUint64(&rt.refined[frame])) / float64(traced)
+	}
+
+	for i := range stats.Tiles {
+		stats.Tiles[i] = int(atomic.LoadInt32(&rt.tileCount[frame][i]))
+		stats.Stolen[i] = int(atomic.LoadInt32(&rt.stealCount[frame][i]))
+		if stats.Tiles[i] > 0 {
+			stats.Goroutines++
+		}
+	}
+	return stats
+}
@@ -0,0 +1,397 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"log"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andreas-jonsson/octatron/pack"
+)
+
+func TestWorkers(t *testing.T) {
+	tree := testSphere(4)
+	camera := LookAtCamera{Pos: Vec3{0.3, 0.6, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	rect := image.Rect(0, 0, 37, 29)
+
+	cfg := Config{
+		FieldOfView: 0.8,
+		TreeScale:   1,
+		ViewDist:    5,
+		Jitter:      true,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+
+		MaxGoroutines: 8,
+	}
+	reference, _ := renderTestFrame(tree, cfg, &camera)
+
+	for _, workers := range []int{1, 3, 8} {
+		for _, tileSize := range []int{0, 1, 8} {
+			for _, banded := range []bool{false, true} {
+				for _, packets := range []bool{false, true} {
+					cfg.Workers = workers
+					cfg.TileSize = tileSize
+					cfg.Banded = banded
+					cfg.Packets = packets
+					cfg.Images = [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}
+
+					rt := NewRaytracer(cfg)
+					idx := rt.Trace(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis()))
+					img := rt.Image(idx)
+					stats := rt.Stats(idx)
+					rt.Close()
+
+					if !bytes.Equal(reference.Pix, img.Pix) {
+						t.Errorf("output differs, workers: %v, tile size: %v, banded: %v, packets: %v", workers, tileSize, banded, packets)
+					}
+
+					numTiles := len(splitTiles(nil, rtJob{rect: rect}, rect.Max, tileSize))
+					if len(stats.Tiles) != workers {
+						t.Fatalf("expected stats for %d workers, got %d", workers, len(stats.Tiles))
+					}
+
+					sum := 0
+					for i, n := range stats.Tiles {
+						sum += n
+						if stats.Stolen[i] > n {
+							t.Errorf("worker %d stole %d of %d tiles", i, stats.Stolen[i], n)
+						}
+					}
+
+					if sum != numTiles {
+						t.Errorf("expected %d tiles, got %d", numTiles, sum)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestMaxGoroutines(t *testing.T) {
+	tree := testSphere(4)
+	camera := LookAtCamera{Pos: Vec3{0.3, 0.6, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	rect := image.Rect(0, 0, 16, 2000)
+
+	cfg := Config{
+		FieldOfView: 0.8,
+		TreeScale:   1,
+		ViewDist:    5,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+	reference, _ := renderTestFrame(tree, cfg, &camera)
+
+	cfg.Workers = 2000
+	cfg.MaxGoroutines = 8
+	cfg.Images = [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}
+
+	rt := NewRaytracer(cfg)
+	defer rt.Close()
+
+	idx := rt.Trace(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis()))
+	img := rt.Image(idx)
+	stats := rt.Stats(idx)
+
+	if len(stats.Tiles) != 8 || stats.Goroutines == 0 || stats.Goroutines > 8 {
+		t.Errorf("expected at most 8 goroutines, got %d of %d", stats.Goroutines, len(stats.Tiles))
+	}
+
+	if !bytes.Equal(reference.Pix, img.Pix) {
+		t.Error("output differs when workers are capped")
+	}
+}
+
+func TestOnTileDone(t *testing.T) {
+	tree := testSphere(4)
+	camera := LookAtCamera{Pos: Vec3{0.3, 0.6, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	rect := image.Rect(0, 0, 37, 29)
+
+	cfg := Config{
+		FieldOfView: 0.8,
+		TreeScale:   1,
+		ViewDist:    5,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	}
+	reference, _ := renderTestFrame(tree, cfg, &camera)
+
+	var (
+		lock  sync.Mutex
+		tiles []image.Rectangle
+	)
+
+	// Copy every tile as it completes, the copy must match the finished image.
+	streamed := image.NewRGBA(rect)
+	cfg.Workers = 3
+	cfg.TileSize = 8
+	cfg.Images = [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)}
+	cfg.OnTileDone = func(frame int, r image.Rectangle) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		tiles = append(tiles, r)
+		img := cfg.Images[frame]
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			copy(streamed.Pix[streamed.PixOffset(r.Min.X, y):streamed.PixOffset(r.Max.X, y)], img.Pix[img.PixOffset(r.Min.X, y):])
+		}
+	}
+
+	rt := NewRaytracer(cfg)
+	defer rt.Close()
+
+	idx := rt.Trace(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis()))
+	if err := rt.Wait(idx); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if numTiles := len(splitTiles(nil, rtJob{rect: rect}, rect.Max, 8)); len(tiles) != numTiles {
+		t.Errorf("expected %d tiles, got %d", numTiles, len(tiles))
+	}
+
+	if !bytes.Equal(reference.Pix, streamed.Pix) {
+		t.Error("streamed tiles differ from the image")
+	}
+}
+
+func TestSplitTiles(t *testing.T) {
+	size := image.Pt(10, 10)
+
+	jobs := splitTiles(nil, rtJob{rect: image.Rect(0, 0, 10, 10)}, size, 4)
+	if len(jobs) != 9 {
+		t.Errorf("expected 9 tiles, got %d", len(jobs))
+	}
+
+	// Only the tiles overlapping the rectangle are traced.
+	jobs = splitTiles(nil, rtJob{rect: image.Rect(0, 8, 3, 10)}, size, 4)
+	if len(jobs) != 1 || jobs[0].from != 0 || jobs[0].to != 4 {
+		t.Errorf("unexpected tiles: %v", jobs)
+	}
+}
+
+func benchmarkWorkers(b *testing.B, workers, tileSize int, banded bool) {
+	tree := testSphere(6)
+	camera := LookAtCamera{Pos: Vec3{0.3, 0.6, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	rect := image.Rect(0, 0, 128, 128)
+
+	rt := NewRaytracer(Config{
+		FieldOfView: 0.8,
+		TreeScale:   1,
+		ViewDist:    5,
+		Workers:     workers,
+		TileSize:    tileSize,
+		Banded:      banded,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	defer rt.Close()
+
+	maxDepth := TreeWidthToDepth(tree.VoxelsPerAxis())
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		rt.Image(rt.Trace(&camera, tree.Octree(), maxDepth))
+	}
+}
+
+func BenchmarkWorkers8ScanLines(b *testing.B)  { benchmarkWorkers(b, 8, 0, false) }
+func BenchmarkWorkers8Tiles(b *testing.B)      { benchmarkWorkers(b, 8, 16, false) }
+func BenchmarkWorkers8Banded(b *testing.B)     { benchmarkWorkers(b, 8, 16, true) }
+func BenchmarkWorkers32ScanLines(b *testing.B) { benchmarkWorkers(b, 32, 0, false) }
+func BenchmarkWorkers32Tiles(b *testing.B)     { benchmarkWorkers(b, 32, 16, false) }
+func BenchmarkWorkers32Banded(b *testing.B)    { benchmarkWorkers(b, 32, 16, true) }
+func BenchmarkWorkers64ScanLines(b *testing.B) { benchmarkWorkers(b, 64, 0, false) }
+func BenchmarkWorkers64Tiles(b *testing.B)     { benchmarkWorkers(b, 64, 16, false) }
+func BenchmarkWorkers64Banded(b *testing.B)    { benchmarkWorkers(b, 64, 16, true) }
+
+// waitGoroutines waits up to a second for the number of goroutines to drop to n.
+func waitGoroutines(n int) int {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return runtime.NumGoroutine()
+}
+
+func TestDroppedRaytracer(t *testing.T) {
+	tree := testSphere(4)
+	camera := LookAtCamera{Pos: Vec3{0.3, 0.6, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	rect := image.Rect(0, 0, 64, 256)
+	baseline := runtime.NumGoroutine()
+
+	rt := NewRaytracer(Config{
+		FieldOfView: 0.8,
+		TreeScale:   1,
+		ViewDist:    5,
+		Workers:     4,
+		Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+	})
+	if n := rt.Outstanding(); n != 0 {
+		t.Errorf("expected no workers before the first frame, got %d", n)
+	}
+
+	idx := rt.Trace(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis()))
+	if n := rt.Outstanding(); n == 0 || n > 4 {
+		t.Errorf("expected up to 4 workers mid-frame, got %d", n)
+	}
+
+	rt.Image(idx)
+	if n := waitGoroutines(baseline); n > baseline {
+		t.Errorf("%d goroutines left after the frame, expected %d", n, baseline)
+	}
+	if n := rt.Outstanding(); n != 0 {
+		t.Errorf("expected no workers after the frame, got %d", n)
+	}
+
+	// A client that disconnects mid-frame drops the raytracer without Wait or Close.
+	rt.Trace(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis()))
+	rt = nil
+
+	if n := waitGoroutines(baseline); n > baseline {
+		t.Errorf("%d goroutines left after dropping the raytracer, expected %d", n, baseline)
+	}
+}
+
+// logWriter passes every log line to a channel.
+type logWriter chan string
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestFrameDeadline(t *testing.T) {
+	tree := testSphere(4)
+	camera := LookAtCamera{Pos: Vec3{0.3, 0.6, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	rect := image.Rect(0, 0, 16, 16)
+	lines := make(logWriter, 4)
+
+	rt := NewRaytracer(Config{
+		FieldOfView:   0.8,
+		TreeScale:     1,
+		ViewDist:      5,
+		Images:        [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+		FrameDeadline: 10 * time.Millisecond,
+		Logger:        pack.StdLogger(log.New(lines, "", 0), pack.LogWarn),
+		OnTileDone: func(frame int, rect image.Rectangle) {
+			time.Sleep(5 * time.Millisecond)
+		},
+	})
+	defer rt.Close()
+
+	rt.Wait(rt.Trace(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis())))
+
+	select {
+	case line := <-lines:
+		if !strings.HasPrefix(line, "warning: frame 1:") || !strings.Contains(line, "tiles not traced") {
+			t.Errorf("unexpected report: %q", line)
+		}
+	default:
+		t.Error("slow frame was not reported")
+	}
+	if len(lines) != 0 {
+		t.Errorf("frame was reported %d more times", len(lines))
+	}
+}
+
+// captureLogger records the messages of the levels from level up.
+type captureLogger struct {
+	lock     sync.Mutex
+	level    pack.LogLevel
+	messages []string
+}
+
+func (l *captureLogger) Enabled(level pack.LogLevel) bool {
+	return level >= l.level
+}
+
+func (l *captureLogger) logf(level pack.LogLevel, format string, args []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.messages = append(l.messages, level.String()+": "+fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) Debugf(format string, args ...interface{}) {
+	l.logf(pack.LogDebug, format, args)
+}
+
+func (l *captureLogger) Infof(format string, args ...interface{}) {
+	l.logf(pack.LogInfo, format, args)
+}
+
+func (l *captureLogger) Warnf(format string, args ...interface{}) {
+	l.logf(pack.LogWarn, format, args)
+}
+
+func (l *captureLogger) Errorf(format string, args ...interface{}) {
+	l.logf(pack.LogError, format, args)
+}
+
+func (l *captureLogger) lines() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]string(nil), l.messages...)
+}
+
+func TestFrameSummary(t *testing.T) {
+	tree := testSphere(4)
+	camera := LookAtCamera{Pos: Vec3{0.3, 0.6, 2}, Look: Vec3{0.5, 0.5, 0.5}}
+	rect := image.Rect(0, 0, 16, 16)
+
+	for _, level := range []pack.LogLevel{pack.LogDebug, pack.LogInfo} {
+		logger := &captureLogger{level: level}
+		rt := NewRaytracer(Config{
+			FieldOfView: 0.8,
+			TreeScale:   1,
+			ViewDist:    5,
+			Images:      [2]*image.RGBA{image.NewRGBA(rect), image.NewRGBA(rect)},
+			Logger:      logger,
+		})
+
+		for i := 0; i < 2; i++ {
+			rt.Wait(rt.Trace(&camera, tree.Octree(), TreeWidthToDepth(tree.VoxelsPerAxis())))
+		}
+		rt.Close()
+
+		lines := logger.lines()
+		if level != pack.LogDebug {
+			if len(lines) != 0 {
+				t.Errorf("unexpected messages %q", lines)
+			}
+			continue
+		}
+
+		if len(lines) != 2 {
+			t.Fatalf("expected a summary of both frames, got %q", lines)
+		}
+		for i, line := range lines {
+			if prefix := fmt.Sprintf("debug: frame %d done: ", i+1); !strings.HasPrefix(line, prefix) || !strings.Contains(line, "nodes visited") || strings.Contains(line, " 0 nodes") {
+				t.Errorf("unexpected summary %q", line)
+			}
+		}
+	}
+}